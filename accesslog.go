@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With access_log, the relay of an HTTP forward speaks HTTP to the tunnel
+// and writes a line per request in the Common or Combined Log Format of
+// Apache to a file, for log analyzers such as GoAccess or AWStats, or
+// publishes it as an access event on GET /v1/events. Through the tunnel
+// every request comes from 127.0.0.1; behind http_proxy_port, the HTTP
+// proxy on the VPS tells the client's address in X-Forwarded-For, which is
+// then logged instead. Files are opened for appending and opened again on
+// every reload, even one without changes, so logrotate only has to send
+// SIGHUP afterwards.
+
+// accessLogEvents is the access_log that publishes events instead of
+// writing a file.
+const accessLogEvents = "events"
+
+// accessLog is an access log file, shared by the forwards writing to it.
+type accessLog struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// accessLogs are the open access log files by path.
+var accessLogs = struct {
+	sync.Mutex
+	m map[string]*accessLog
+}{m: make(map[string]*accessLog)}
+
+// openAccessLog returns the access log of f, opening its file unless it is
+// open; nil when f has none or the file cannot be opened.
+func openAccessLog(f TCPForward) *accessLog {
+	if f.AccessLog == "" {
+		return nil
+	}
+	accessLogs.Lock()
+	defer accessLogs.Unlock()
+	l, ok := accessLogs.m[f.AccessLog]
+	if !ok {
+		l = &accessLog{path: f.AccessLog}
+		if err := l.open(); err != nil {
+			logEvent(levelWarn, f.Name, "", "access_log: %v", err)
+			return nil
+		}
+		accessLogs.m[f.AccessLog] = l
+	}
+	return l
+}
+
+// reopenAccessLogs opens the access log files again, for logrotate.
+func reopenAccessLogs() {
+	accessLogs.Lock()
+	defer accessLogs.Unlock()
+	for _, l := range accessLogs.m {
+		if err := l.open(); err != nil {
+			logEvent(levelWarn, "", "", "access_log: %v", err)
+		}
+	}
+}
+
+// open opens the file of l for appending, closing the one open before.
+func (l *accessLog) open() error {
+	if l.path == accessLogEvents {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = file
+	l.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// accessRecorder notes the status and body size of a response.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(code int) {
+	if r.status == 0 && code >= 200 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the response.
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// handler logs the requests next serves for forward; forwarded trusts the
+// client address in X-Forwarded-For.
+func (l *accessLog) handler(next http.Handler, forward, format string, forwarded bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		client, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if xff := req.Header.Get("X-Forwarded-For"); forwarded && xff != "" {
+			// the address the proxy on the VPS added last
+			client = strings.TrimSpace(xff[strings.LastIndex(xff, ",")+1:])
+		}
+		if l.path == accessLogEvents {
+			if events.active() {
+				events.publish(apiEvent{Type: "access", Forward: forward, Data: map[string]any{
+					"client":      client,
+					"method":      req.Method,
+					"uri":         req.RequestURI,
+					"host":        req.Host,
+					"status":      rec.status,
+					"bytes":       rec.bytes,
+					"referer":     req.Referer(),
+					"user_agent":  req.UserAgent(),
+					"duration_ms": time.Since(start).Milliseconds(),
+				}})
+			}
+			return
+		}
+		user := "-"
+		if u, _, ok := req.BasicAuth(); ok && u != "" {
+			user = logQuote(u)
+		}
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`, client, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			logQuote(req.Method), logQuote(req.RequestURI), logQuote(req.Proto), rec.status, size)
+		if format == "combined" {
+			line += fmt.Sprintf(` "%s" "%s"`, orDash(logQuote(req.Referer())), orDash(logQuote(req.UserAgent())))
+		}
+		l.mu.Lock()
+		if l.f != nil {
+			_, _ = l.f.WriteString(line + "\n")
+		}
+		l.mu.Unlock()
+	})
+}
+
+// logQuote escapes s for a quoted field of an access log line, as Apache
+// does.
+func logQuote(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// orDash is s, or "-" when it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activation holds the listening sockets systemd passed in (LISTEN_FDS),
+// keyed by their FileDescriptorName. A socket named after a forward is used
+// as that forward's relay listener; "<name>-wrap" is handed to the local
+// socat of a UDP forward as its wrap_tcp_port listener. The sockets stay
+// bound across tut restarts, so ssh and clients only see a short pause.
+type activation struct {
+	files map[string]*os.File
+}
+
+// activated is the socket activation state of this process; nil when tut
+// was not socket activated.
+var activated = socketActivation()
+
+// socketActivation picks up the sockets passed by systemd, or by the
+// process this one replaces during an upgrade, and clears the environment
+// so children do not try to use them as well.
+func socketActivation() *activation {
+	if names, ok := os.LookupEnv("TUT_UPGRADE_FDNAMES"); ok {
+		os.Unsetenv("TUT_UPGRADE_FDNAMES")
+		if names == "" {
+			return nil
+		}
+		return newActivation(upgradeFDsStart, strings.Split(names, ":"))
+	}
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for len(names) < n {
+		names = append(names, "")
+	}
+	return newActivation(listenFDsStart, names[:n])
+}
+
+// newActivation wraps consecutive descriptors starting at first, one per
+// name. Unnamed descriptors are called fd<N>.
+func newActivation(first int, names []string) *activation {
+	a := &activation{files: make(map[string]*os.File, len(names))}
+	for i, name := range names {
+		if name == "" {
+			name = "fd" + strconv.Itoa(first+i)
+		}
+		a.files[name] = os.NewFile(uintptr(first+i), name)
+	}
+	return a
+}
+
+// file returns the socket passed under name, or nil.
+func (a *activation) file(name string) *os.File {
+	if a == nil {
+		return nil
+	}
+	return a.files[name]
+}
+
+// listener returns a listener on the socket passed under name. The socket
+// itself stays open, so closing the listener (e.g. on reload) and asking
+// again later works.
+func (a *activation) listener(name string) (net.Listener, bool) {
+	f := a.file(name)
+	if f == nil {
+		return nil, false
+	}
+	ln, err := net.FileListener(f)
+	if err != nil {
+		logEvent(levelWarn, name, "", "Cannot use activated socket %s: %v", name, err)
+		return nil, false
+	}
+	return ln, true
+}
+
+// names lists the passed socket names, for logging.
+func (a *activation) names() []string {
+	if a == nil {
+		return nil
+	}
+	out := make([]string, 0, len(a.files))
+	for name := range a.files {
+		out = append(out, name)
+	}
+	return out
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The agent is this same binary, run on the VPS as "tut agent <mode>" by
+// the remote script for features that need more than socat. tut uploads it
+// before a session starts whenever the copy on the VPS differs.
+
+// runAgentCommand implements "tut agent", which runs on the VPS.
+func runAgentCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tut agent turn|tun|forward|obfs|tls|redirect|route|page|http|client|mosh|dns|lan|bridge|udp|check|lock|probe|version [flags]")
+		return 2
+	}
+	switch args[0] {
+	case "turn":
+		return runAgentTURN(args[1:])
+	case "tun":
+		return runAgentTUN(args[1:])
+	case "forward":
+		return runAgentForward(args[1:])
+	case "obfs":
+		return runAgentObfs(args[1:])
+	case "tls":
+		return runAgentTLS(args[1:])
+	case "redirect":
+		return runAgentRedirect(args[1:])
+	case "route":
+		return runAgentRoute(args[1:])
+	case "page":
+		return runAgentPage(args[1:])
+	case "http":
+		return runAgentHTTP(args[1:])
+	case "client":
+		return runAgentClient(args[1:])
+	case "mosh":
+		return runAgentMosh(args[1:])
+	case "dns":
+		return runAgentDNS(args[1:])
+	case "bridge":
+		return runAgentBridge(args[1:])
+	case "lan":
+		return runAgentLAN(args[1:])
+	case "udp":
+		return runAgentUDP(args[1:])
+	case "check":
+		return runAgentCheck(args[1:])
+	case "lock":
+		return runAgentLock(args[1:])
+	case "probe":
+		return runAgentProbe(args[1:])
+	case "version":
+		return runAgentVersion()
+	}
+	fmt.Fprintf(os.Stderr, "unknown agent mode: %s\n", args[0])
+	return 2
+}
+
+// agentNeeded reports whether cfg uses a feature run by the agent.
+func agentNeeded(cfg *Config) bool {
+	for _, u := range cfg.UDPForwards {
+		if u.Protocol != "" || u.IntegrityCheck || u.Framing == "length" {
+			return true
+		}
+	}
+	return cfg.TURN.Enabled || cfg.TUN.Enabled || cfg.VPS.Transport == "tailscale" && tailnetForwards(cfg) != "" ||
+		cfg.VPS.Obfuscation.Mode == "shadowsocks" || remoteTLSUsed(cfg) || redirectUsed(cfg) ||
+		cfg.HostRouting.Port != 0 && len(cfg.HostRouting.Routes) > 0 || errorPageUsed(cfg) || httpProxyUsed(cfg) ||
+		clientAddressUsed(cfg)
+}
+
+// agentDir is the directory on the VPS holding the agent and its config
+// files, relative to the login directory unless absolute.
+func agentDir(cfg *Config) string {
+	return path.Dir(cfg.Agent.Path)
+}
+
+// ensureAgent makes sure the VPS runs the configured agent binary and has
+// the current agent config files, uploading whatever differs.
+func ensureAgent(ctx context.Context, cfg *Config) error {
+	bin := cfg.Agent.Binary
+	if bin == "" {
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		bin = self
+	}
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	probe := fmt.Sprintf(`uname -sm; { sha256sum %[1]s 2>/dev/null || sha256 -q %[1]s 2>/dev/null || echo none; } | cut -d' ' -f1`, shellQuote(cfg.Agent.Path))
+	out, err := agentSSH(ctx, cfg, probe, nil)
+	if err != nil {
+		return fmt.Errorf("checking the agent on the VPS: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return fmt.Errorf("unexpected answer from the VPS: %q", out)
+	}
+	if goos, goarch := remotePlatform(lines[0]); cfg.Agent.Binary == "" && (goos != runtime.GOOS || goarch != runtime.GOARCH) {
+		return fmt.Errorf("the VPS runs %s/%s but this tut is %s/%s: build tut for the VPS and set agent.binary",
+			goos, goarch, runtime.GOOS, runtime.GOARCH)
+	}
+	if lines[1] != hex.EncodeToString(sum[:]) {
+		logf("Uploading the agent to the VPS (%s)", cfg.Agent.Path)
+		p := shellQuote(cfg.Agent.Path)
+		upload := fmt.Sprintf(`mkdir -p %s && cat > %s.tmp && chmod 700 %s.tmp && mv %s.tmp %s`, shellQuote(agentDir(cfg)), p, p, p, p)
+		if _, err := agentSSH(ctx, cfg, upload, bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("uploading the agent: %w", err)
+		}
+	}
+	if cfg.TURN.Enabled {
+		tc, err := turnAgentConfig(cfg)
+		if err != nil {
+			return err
+		}
+		b, _ := json.Marshal(tc)
+		file := shellQuote(agentDir(cfg) + "/turn.json")
+		write := fmt.Sprintf(`umask 077 && mkdir -p %s && cat > %s`, shellQuote(agentDir(cfg)), file)
+		if _, err := agentSSH(ctx, cfg, write, bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("writing the TURN config: %w", err)
+		}
+	}
+	for _, f := range cfg.TCPForwards {
+		if !errorPageOnVPS(f) {
+			continue
+		}
+		page, err := os.ReadFile(f.ErrorPage)
+		if err != nil {
+			return fmt.Errorf("%s: error_page: %w", f.Name, err)
+		}
+		write := fmt.Sprintf(`mkdir -p %s && cat > %s`, shellQuote(agentDir(cfg)), shellQuote(agentDir(cfg)+"/"+errorPageFile(f.Name)))
+		if _, err := agentSSH(ctx, cfg, write, bytes.NewReader(page)); err != nil {
+			return fmt.Errorf("uploading the error page of %s: %w", f.Name, err)
+		}
+	}
+	if cfg.VPS.Obfuscation.Mode == "shadowsocks" {
+		out, err := agentSSH(ctx, cfg, obfsEndpointCommand(cfg), strings.NewReader(cfg.VPS.Obfuscation.Password))
+		if err != nil {
+			return fmt.Errorf("starting the obfuscation endpoint: %w", err)
+		}
+		if strings.TrimSpace(out) == "started" {
+			logEvent(levelInfo, "", "obfs-started", "Started the obfuscation endpoint on port %d of the VPS", cfg.VPS.Obfuscation.Port)
+		}
+	}
+	return nil
+}
+
+// agentSSH runs command on the VPS in a separate SSH connection.
+func agentSSH(ctx context.Context, cfg *Config, command string, stdin io.Reader) (string, error) {
+	cmd := sshExec(ctx, cfg, append(sshCommandArgs(cfg), command)...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, lastLine(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// remotePlatform maps the output of "uname -sm" to GOOS and GOARCH.
+func remotePlatform(uname string) (string, string) {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 {
+		return "unknown", "unknown"
+	}
+	goos := strings.ToLower(fields[0])
+	goarch := map[string]string{
+		"x86_64": "amd64", "amd64": "amd64",
+		"aarch64": "arm64", "arm64": "arm64",
+		"armv7l": "arm", "armv6l": "arm",
+		"i386": "386", "i686": "386",
+		"riscv64": "riscv64", "mips": "mips", "mipsel": "mipsle",
+	}[fields[1]]
+	if goarch == "" {
+		goarch = fields[1]
+	}
+	return goos, goarch
+}
+
+// agentScript returns the part of the remote script that starts the agent
+// modes cfg uses, as start functions named after them, and the names.
+func agentScript(cfg *Config) (string, []string) {
+	if !agentNeeded(cfg) {
+		return "", nil
+	}
+	var b strings.Builder
+	var modes []string
+	b.WriteString(fmt.Sprintf(`AGENT_BIN=%s; AGENT_DIR=%s; `, shellQuote(cfg.Agent.Path), shellQuote(agentDir(cfg))))
+	if cfg.TURN.Enabled {
+		// a TURN server left over from an earlier session holds the port
+		b.WriteString(fmt.Sprintf(`start_turn(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/udp 2>/dev/null || true; fi; `, cfg.TURN.Port))
+		b.WriteString(`"$AGENT_BIN" agent turn -config "$AGENT_DIR/turn.json" ` + remoteLog(cfg, "tut-agent-turn.log") + ` & P_TURN="$!"; }; start_turn; `)
+		modes = append(modes, "turn")
+	}
+	if cfg.TUN.Enabled {
+		t := cfg.TUN
+		b.WriteString(fmt.Sprintf(`start_tun(){ "$AGENT_BIN" agent tun -name %s -address %s -mtu %d -routes %s -connect 127.0.0.1:%d %s & P_TUN="$!"; }; start_tun; `,
+			shellQuote(t.Name), shellQuote(t.RemoteAddress), t.MTU, shellQuote(strings.Join(t.RemoteRoutes, ",")), t.TunnelPort, remoteLog(cfg, "tut-agent-tun.log")))
+		modes = append(modes, "tun")
+	}
+	if cfg.VPS.Transport == "tailscale" && tailnetForwards(cfg) != "" {
+		addr, err := tailnetAddress(cfg)
+		if err != nil {
+			b.WriteString(fmt.Sprintf(`echo %s >&2; exit 1; `, shellQuote("ERROR: "+err.Error())))
+		}
+		// the TCP forwards connect to tut over the tailnet
+		b.WriteString(fmt.Sprintf(`start_forward(){ "$AGENT_BIN" agent forward -connect %s -ports %s %s & P_FORWARD="$!"; }; start_forward; `,
+			shellQuote(net.JoinHostPort(addr, strconv.Itoa(cfg.VPS.TailscalePort))), shellQuote(tailnetForwards(cfg)), remoteLog(cfg, "tut-agent-forward.log")))
+		modes = append(modes, "forward")
+	}
+	// public ports presenting TLS, see remotetls.go
+	script, tlsModes := remoteTLSScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, tlsModes...)
+	// HTTP ports redirecting to HTTPS, see redirect.go
+	script, redirectModes := redirectScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, redirectModes...)
+	// a public port shared by name, see hostroute.go
+	script, routeModes := hostRouteScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, routeModes...)
+	// public ports with an error page while the tunnel is down, see errorpage.go
+	script, pageModes := errorPageScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, pageModes...)
+	// HTTP proxies in front of remote forwards, see httpproxy.go
+	script, httpModes := httpProxyScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, httpModes...)
+	// public ports passing client addresses, see clientaddr.go
+	script, clientModes := clientAddressScript(cfg)
+	b.WriteString(script)
+	modes = append(modes, clientModes...)
+	return b.String(), modes
+}
+
+// agentForwardEffect is the effect of c given that changeEffect found
+// effect: the agents terminating TLS, speaking HTTP, routing by name and
+// serving error pages or client addresses for a forward run in the remote
+// script, so changes to the remote side of a forward with remote_tls,
+// http_redirect_port, http_proxy_port, error_page_port, client_address_port
+// or a host route, before or after c, restart the session.
+func agentForwardEffect(old, cur *Config, c configChange, effect string) string {
+	remote := strings.Contains(c.path, ".remote_tls") || strings.Contains(c.path, ".error_page") || strings.Contains(c.path, ".client_address") ||
+		strings.Contains(c.path, ".http_") && !strings.Contains(c.path, ".http_compress") // the relay compresses
+	if effect != effectForward && !remote {
+		return effect
+	}
+	name, ok := strings.CutPrefix(c.path, "tcp_forwards[")
+	if !ok {
+		return effect
+	}
+	name, _, _ = strings.Cut(name, "]")
+	for _, cfg := range []*Config{old, cur} {
+		for _, f := range cfg.TCPForwards {
+			if f.Name == name && (f.RemoteTLS || f.HTTPRedirectPort != 0 || f.ErrorPagePort != 0 || f.HTTPProxyPort != 0 ||
+				f.ClientAddressPort != 0 || hostRouted(cfg, name)) {
+				return effectSession
+			}
+		}
+	}
+	return effect
+}
+
+// wrapListener returns the wrap port listener of the local side of an agent
+// mode: an inherited descriptor when fd is set, otherwise a new listener on
+// addr.
+func wrapListener(addr string, fd int) (net.Listener, error) {
+	if fd != 0 {
+		return net.FileListener(os.NewFile(uintptr(fd), "wrap"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// agentListenUDP listens on the public UDP port of a forward at its
+// remote_bind address.
+func agentListenUDP(bind string, port int) (*net.UDPConn, error) {
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address %q", bind)
+	}
+	return net.ListenUDP(ipNetwork("udp", ip), &net.UDPAddr{IP: ip, Port: port})
+}
+
+// ipNetwork returns network ("udp" or "tcp") limited to the family of ip.
+func ipNetwork(network string, ip net.IP) string {
+	if ip.To4() != nil {
+		return network + "4"
+	}
+	return network + "6"
+}
+
+// writeLenPrefixed writes b with a 2-byte length in front, the framing of
+// DNS over TCP that agent modes also use on the wrap port.
+func writeLenPrefixed(w io.Writer, b []byte) error {
+	if len(b) > 0xFFFF {
+		return errors.New("message too large")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+	return err
+}
+
+func readLenPrefixed(r io.Reader) ([]byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(h[:]))
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The daemon serves a small HTTP API on api.listen, loopback only by
+// default, for the commands that look at a running tut such as "tut top",
+// and the web dashboard. With tokens configured every API request has to
+// carry one: read tokens see everything, admin tokens may also pause
+// forwards and reconnect. Without tokens only the read endpoints are served,
+// to requests naming the listener by address, so that a web page cannot
+// read them through DNS rebinding.
+
+// apiForward is the live state of a forward as served by the API.
+type apiForward struct {
+	Name     string       `json:"name"`
+	Proto    string       `json:"proto"`
+	Public   string       `json:"public"` // address on the VPS
+	Healthy  bool         `json:"healthy"`
+	Active   int64        `json:"active_connections"`
+	BytesIn  int64        `json:"bytes_in"`
+	BytesOut int64        `json:"bytes_out"`
+	Paused   bool         `json:"paused,omitempty"`
+	PausedBy string       `json:"paused_by,omitempty"` // quota or api
+	History  []rateSample `json:"history"`             // oldest first, one per second
+}
+
+// apiAccess is what an endpoint lets a client do.
+type apiAccess int
+
+const (
+	accessRead    apiAccess = iota // any token, or none when none is configured
+	accessControl                  // an admin token
+)
+
+// API token scopes.
+const (
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+// apiTokens returns the configured tokens, api.token included.
+func apiTokens(c APIConfig) []APIToken {
+	tokens := c.Tokens
+	if c.Token != "" {
+		tokens = append([]APIToken{{Name: "api.token", Token: c.Token, Scope: scopeAdmin}}, tokens...)
+	}
+	return tokens
+}
+
+// validateAPI checks the tokens and the dashboard setting.
+func validateAPI(c APIConfig) error {
+	names := make(map[string]bool)
+	for _, t := range apiTokens(c) {
+		if t.Name == "" || t.Token == "" {
+			return fmt.Errorf("api token %q: name and token are required", t.Name)
+		}
+		if t.Scope != scopeRead && t.Scope != scopeAdmin {
+			return fmt.Errorf("api token %s: invalid scope %q (read or admin)", t.Name, t.Scope)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate api token name: %s", t.Name)
+		}
+		names[t.Name] = true
+	}
+	if c.Dashboard && len(names) == 0 {
+		return fmt.Errorf("api.dashboard needs api.token or api.tokens")
+	}
+	return nil
+}
+
+// apiCaller is the context key of the token a request used.
+type apiCaller struct{}
+
+// caller returns the token req was authorized with; without configured
+// tokens it is an unnamed read token.
+func caller(req *http.Request) APIToken {
+	if t, ok := req.Context().Value(apiCaller{}).(APIToken); ok {
+		return t
+	}
+	return APIToken{Scope: scopeRead}
+}
+
+// runAPI serves the API until ctx is done. A port that is taken only costs
+// the API, never the tunnel.
+func runAPI(ctx context.Context, d *daemon) {
+	cfg := d.config()
+	if cfg.API.Listen == "off" {
+		return
+	}
+	ln, err := net.Listen("tcp", cfg.API.Listen)
+	if err != nil {
+		logEvent(levelWarn, "", "", "API disabled: %v", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traffic", d.authorize(accessRead, http.MethodGet, d.apiTraffic))
+	mux.HandleFunc("/v1/events", d.authorize(accessRead, http.MethodGet, d.apiEvents))
+	mux.HandleFunc("/v1/status", d.authorize(accessRead, http.MethodGet, d.apiStatus))
+	mux.HandleFunc("/v1/debug/logs", d.authorize(accessControl, http.MethodGet, d.apiDebugLogs))
+	mux.HandleFunc("/v1/forwards/", d.authorize(accessControl, http.MethodPost, d.apiForwardAction))
+	mux.HandleFunc("/v1/reconnect", d.authorize(accessControl, http.MethodPost, d.apiReconnect))
+	mux.HandleFunc("/v1/config/apply", d.authorize(accessControl, http.MethodPost, d.apiApply))
+	mux.HandleFunc("/v1/handover", d.authorize(accessControl, http.MethodPost, func(w http.ResponseWriter, req *http.Request) {
+		d.apiHandover(ctx, w, req)
+	}))
+	if cfg.API.Dashboard {
+		// the page holds no data; it asks for the token the API needs
+		root, _ := fs.Sub(dashboardFiles, "dashboard")
+		mux.Handle("/", http.FileServer(http.FS(root)))
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logEvent(levelWarn, "", "", "API stopped: %v", err)
+	}
+}
+
+// authorize wraps h so it only serves requests with method that carry a
+// token with the access, either as a bearer token or, for browsers and
+// WebSockets, in the token query parameter.
+func (d *daemon) authorize(access apiAccess, method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tokens := apiTokens(d.config().API)
+		if len(tokens) == 0 {
+			if !directHost(req) {
+				http.Error(w, "without api tokens the API only answers requests for its address", http.StatusForbidden)
+				return
+			}
+			if access == accessControl {
+				http.Error(w, "configure an admin token in api.tokens to enable this endpoint", http.StatusForbidden)
+				return
+			}
+			h(w, req)
+			return
+		}
+		got := req.URL.Query().Get("token")
+		if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			got = strings.TrimPrefix(auth, "Bearer ")
+		}
+		var match *APIToken
+		for i, t := range tokens {
+			// compare with every token so the time taken does not tell which matched
+			if subtle.ConstantTimeCompare([]byte(got), []byte(t.Token)) == 1 && match == nil {
+				match = &tokens[i]
+			}
+		}
+		switch {
+		case match == nil:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case access == accessControl && match.Scope != scopeAdmin:
+			http.Error(w, "token "+match.Name+" is read-only", http.StatusForbidden)
+		default:
+			h(w, req.WithContext(context.WithValue(req.Context(), apiCaller{}, *match)))
+		}
+	}
+}
+
+// apiForwards returns the live state of every forward.
+func (d *daemon) apiForwards() []apiForward {
+	cfg, relays, history := d.config(), d.relaySnapshot(), d.history.snapshot()
+	var out []apiForward
+	for _, ep := range d.endpoints() {
+		f := apiForward{Name: ep.name, Proto: ep.proto, Public: publicAddr(cfg, ep.port), Healthy: ep.healthy, History: history[ep.name]}
+		if f.History == nil {
+			f.History = []rateSample{}
+		}
+		if r, ok := relays[ep.name]; ok {
+			f.Active = r.stats.active.Load()
+			f.BytesIn, f.BytesOut = r.stats.bytesIn.Load(), r.stats.bytesOut.Load()
+			switch {
+			case r.held.Load():
+				f.Paused, f.PausedBy = true, "api"
+			case r.quotaPaused.Load():
+				f.Paused, f.PausedBy = true, "quota"
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// apiTraffic serves the counters and recent throughput of every forward.
+func (d *daemon) apiTraffic(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, map[string]any{"forwards": d.apiForwards()})
+}
+
+// apiStatus serves the state of the tunnel and its forwards.
+func (d *daemon) apiStatus(w http.ResponseWriter, req *http.Request) {
+	status := d.statusSnapshot()
+	status["scope"] = caller(req).Scope
+	writeJSON(w, status)
+}
+
+// statusSnapshot is the state of the tunnel and its forwards, as GET
+// /v1/status shows it.
+func (d *daemon) statusSnapshot() map[string]any {
+	cfg, usage := d.config(), d.st.usage()
+	return map[string]any{
+		"vps":              cfg.VPS.Host,
+		"session_up":       d.sessionUp.Load(),
+		"vpses":            d.vpsStates(cfg),
+		"cloudflare":       d.cloudflare.state(),
+		"ha_role":          d.haRole(),
+		"ha_handover":      d.handoverState(),
+		"ping":             d.pingState(),
+		"reconnects":       d.reconnects.Load(),
+		"connections":      totalConns.active.Load(),
+		"connections_shed": totalConns.shed.Load(),
+		"quota_period":     usage.Period,
+		"quota_used_bytes": usage.Total,
+		"forwards":         d.apiForwards(),
+	}
+}
+
+// apiForwardAction pauses or resumes a forward on POST
+// /v1/forwards/<name>/pause or /resume, and starts or stops tracing it on
+// /trace or /untrace (see trace.go). A paused forward refuses new
+// connections and drops its open ones until it is resumed or tut restarts.
+func (d *daemon) apiForwardAction(w http.ResponseWriter, req *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v1/forwards/"), "/")
+	r, ok := d.relaySnapshot()[name]
+	if !ok {
+		http.Error(w, "unknown forward", http.StatusNotFound)
+		return
+	}
+	switch action {
+	case "pause":
+		if !r.held.Swap(true) {
+			n := r.resetConns()
+			logEvent(levelWarn, name, "forward-paused", "Forward paused through the API (token %s); reset %d socket(s)", caller(req).Name, n)
+		}
+	case "resume":
+		if r.held.Swap(false) {
+			logEvent(levelInfo, name, "forward-resumed", "Forward resumed through the API (token %s)", caller(req).Name)
+		}
+	case "trace":
+		d.apiTrace(w, req, r)
+		return
+	case "untrace":
+		stopped := map[string]string{}
+		if t := r.setTrace(nil, "stopped through the API"); t != nil {
+			logEvent(levelInfo, name, "trace-stopped", "Trace stopped through the API (token %s)", caller(req).Name)
+			stopped["file"] = t.path
+		}
+		writeJSON(w, stopped)
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiReconnect restarts the SSH session.
+func (d *daemon) apiReconnect(w http.ResponseWriter, req *http.Request) {
+	logEvent(levelInfo, "", "reconnect-requested", "Reconnect requested through the API (token %s)", caller(req).Name)
+	d.restartSession()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiClientToken returns the token the commands talking to the daemon
+// send: the first admin token when admin is wanted, else the first one.
+func apiClientToken(c APIConfig, admin bool) string {
+	tokens := apiTokens(c)
+	for _, t := range tokens {
+		if admin && t.Scope == scopeAdmin {
+			return t.Token
+		}
+	}
+	if len(tokens) > 0 {
+		return tokens[0].Token
+	}
+	return ""
+}
+
+// apiRequest calls the API of the daemon configured in cfg and decodes its
+// JSON answer into out unless out is nil.
+func apiRequest(cfg *Config, token, method, path string, out any) error {
+	req, err := http.NewRequest(method, "http://"+cfg.API.Listen+path, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	r, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		// handlers explain refusals in the body
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		if s := strings.TrimSpace(string(msg)); s != "" {
+			return fmt.Errorf("%s: %s", r.Status, s)
+		}
+		return fmt.Errorf("%s", r.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(out)
+}
+
+// directHost reports whether the Host of req names the listener by IP
+// address or as localhost, or not at all. A DNS name could be an attacker's, pointed at
+// the loopback interface to read the API from a web page (DNS rebinding).
+func directHost(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = strings.Trim(req.Host, "[]")
+	}
+	return host == "" || strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil
+}
+
+// sameOrigin reports whether req was not sent by a web page of another
+// site: browsers send Origin with WebSocket handshakes and unsafe
+// requests, other clients usually do not send it at all.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
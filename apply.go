@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// "tut apply" has the running daemon reload its config file through the
+// API and reports what changed; with --check it only reports what a reload
+// would change. With --json the verdict is one JSON object, so Ansible,
+// Puppet and the like can tell a changed run from an idempotent one:
+//
+//	{"changed":true,"check":true,"restart_required":false,"changes":[...]}
+//	{"failed":true,"msg":"..."}
+
+// applyResult is the answer of POST /v1/config/apply.
+type applyResult struct {
+	Changed         bool          `json:"changed"`
+	Check           bool          `json:"check"`
+	RestartRequired bool          `json:"restart_required"` // some change only takes effect when tut restarts
+	Changes         []applyChange `json:"changes"`
+}
+
+type applyChange struct {
+	Op     string `json:"op"` // +, - or ~
+	Path   string `json:"path"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// apiApply reloads the config file on POST /v1/config/apply, or with
+// ?check=1 only compares it with the loaded one.
+func (d *daemon) apiApply(w http.ResponseWriter, req *http.Request) {
+	check := req.URL.Query().Get("check") == "1"
+	cfg, err := d.loadForReload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	d.mu.Lock()
+	base := d.base
+	d.mu.Unlock()
+	res := applyResult{Check: check, Changes: []applyChange{}}
+	for _, c := range diffConfigs(base, cfg) {
+		res.Changes = append(res.Changes, applyChange{Op: c.op, Path: c.path, Old: c.old, New: c.new, Effect: c.effect})
+		res.RestartRequired = res.RestartRequired || c.effect == effectProcess
+	}
+	res.Changed = len(res.Changes) > 0
+	if !check && res.Changed {
+		logEvent(levelInfo, "", "apply-requested", "Config apply requested through the API (token %s)", caller(req).Name)
+		d.applyBase(cfg, "Config apply")
+	}
+	writeJSON(w, res)
+}
+
+// runApplyCommand implements "tut apply".
+func runApplyCommand(args []string) int {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	check := fs.Bool("check", false, "Only report what applying would change")
+	asJSON := fs.Bool("json", false, "Print the verdict as JSON (as -output json)")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+	*asJSON = *asJSON || jsonOutput()
+
+	fail := func(format string, args ...any) int {
+		msg := fmt.Sprintf(format, args...)
+		if *asJSON {
+			_ = json.NewEncoder(os.Stdout).Encode(map[string]any{"failed": true, "msg": msg})
+		} else {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		return 1
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		return fail("Failed to load config: %v", err)
+	}
+	if cfg.API.Listen == "off" {
+		return fail("tut apply needs the API, which is off (api.listen)")
+	}
+	path := "/v1/config/apply"
+	if *check {
+		path += "?check=1"
+	}
+	var res applyResult
+	if err := apiRequest(cfg, apiClientToken(cfg.API, true), http.MethodPost, path, &res); err != nil {
+		return fail("Cannot apply the config through %s: %v", cfg.API.Listen, err)
+	}
+	if *asJSON {
+		_ = json.NewEncoder(os.Stdout).Encode(res)
+		return 0
+	}
+	switch {
+	case !res.Changed:
+		fmt.Println("No changes.")
+	case res.Check:
+		fmt.Println("Applying would change:")
+	default:
+		fmt.Println("Applied:")
+	}
+	for _, c := range res.Changes {
+		fmt.Printf("  %s (%s)\n", configChange{op: c.Op, path: c.Path, old: c.Old, new: c.New}, c.Effect)
+	}
+	if res.RestartRequired {
+		fmt.Println("Some changes only take effect when tut restarts.")
+	}
+	return 0
+}
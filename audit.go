@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// What tut runs on the VPS can be reviewed without connecting to it:
+// "tut -print-remote-script" prints the ssh command lines of every session
+// and the remote script, and the commands of the remote section, the way
+// the config makes them. With log.level: debug, every ssh tut runs is
+// logged as well (ssh-exec). Both show secrets of the config as
+// <redacted>.
+
+// secretKeyRe matches the config keys whose values are secrets.
+var secretKeyRe = regexp.MustCompile(`token|secret|password|passphrase`)
+
+// sshExec prepares an ssh with args, logging it at debug level.
+func sshExec(ctx context.Context, cfg *Config, args ...string) *exec.Cmd {
+	logEvent(levelDebug, "", "ssh-exec", "%s", redactSecrets(cfg, shellCommandLine("ssh", args)))
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	if cfg.VPS.Obfuscation.Mode == "shadowsocks" {
+		cmd.Env = append(os.Environ(), obfsPasswordEnv+"="+cfg.VPS.Obfuscation.Password)
+	}
+	return cmd
+}
+
+// shellCommandLine quotes name and args the way a shell takes them.
+func shellCommandLine(name string, args []string) string {
+	words := []string{name}
+	for _, a := range args {
+		if a != "" && !strings.ContainsFunc(a, func(r rune) bool {
+			return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+,./:@%", r)
+		}) {
+			words = append(words, a)
+		} else {
+			words = append(words, shellQuote(a))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// redactSecrets replaces the secrets of cfg in s.
+func redactSecrets(cfg *Config, s string) string {
+	for _, v := range secretValues(cfg) {
+		s = strings.ReplaceAll(s, v, "<redacted>")
+	}
+	return s
+}
+
+// secretValues returns the values of the secret settings of cfg, longest
+// first so that one containing another is replaced whole.
+func secretValues(cfg *Config) []string {
+	var out []string
+	var walk func(v reflect.Value, secret bool)
+	walk = func(v reflect.Value, secret bool) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				name := yamlName(v.Type().Field(i))
+				if name != "" {
+					walk(v.Field(i), secret || secretKeyRe.MatchString(name))
+				}
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), secret)
+			}
+		case reflect.Map:
+			for _, k := range v.MapKeys() {
+				walk(v.MapIndex(k), secret || secretKeyRe.MatchString(fmt.Sprint(k.Interface())))
+			}
+		case reflect.String:
+			if s := v.String(); secret && s != "" && !isCredential(s) {
+				out = append(out, s)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), false)
+	sort.Slice(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out
+}
+
+// printRemoteScript prints, for "tut -print-remote-script", what tut runs
+// on the VPS with cfg.
+func printRemoteScript(cfg *Config) error {
+	script, err := remoteScript(cfg)
+	if err != nil {
+		return err
+	}
+	out := func(format string, args ...any) {
+		fmt.Println(redactSecrets(cfg, fmt.Sprintf(format, args...)))
+	}
+	for _, c := range cfg.Remote.ProvisionCommands {
+		out("# provision command, once per boot of the VPS\n%s\n", shellCommandLine("ssh", append(sshCommandArgs(cfg), c)))
+	}
+	for _, c := range cfg.Remote.PreCommands {
+		out("# pre command, before each session\n%s\n", shellCommandLine("ssh", append(sshCommandArgs(cfg), c)))
+	}
+	// the relays and the control sockets the daemon would set up, on the
+	// ports and paths of this process
+	relays, err := startRelays(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, r := range relays {
+			r.close()
+		}
+	}()
+	d := &daemon{st: openState(cfg.StateFile), cfg: cfg, base: cfg, relays: relays}
+	args, _ := sessionArgs(cfg, relays, d.st, script)
+	if script == "" {
+		out("# main session, no remote script\n%s\n", shellCommandLine("ssh", args))
+	} else {
+		out("# main session\n%s \"$SCRIPT\"\n", shellCommandLine("ssh", args[:len(args)-1]))
+		out("# SCRIPT, the remote script of the main session\n%s\n", script)
+	}
+	var sessions []forwardSession
+	for k := 1; k < cfg.VPS.Sessions; k++ {
+		sessions = append(sessions, d.extraSession(k))
+	}
+	for _, fs := range append(sessions, d.mirrorSessions(cfg)...) {
+		args, names := fs.sshArgs(cfg, relays, newControlPath(fs.id))
+		if len(names) > 0 {
+			out("# %s\n%s\n", fs.name, shellCommandLine("ssh", args))
+		}
+	}
+	for _, c := range cfg.Remote.PostCommands {
+		out("# post command, after each session\n%s\n", shellCommandLine("ssh", append(sshCommandArgs(cfg), c)))
+	}
+	return nil
+}
+
+// sshCommandArgs are the arguments of an ssh running one remote command,
+// up to the command.
+func sshCommandArgs(cfg *Config) []string {
+	base, target := sshBaseArgs(cfg)
+	return append(base, "-o", "ConnectTimeout=15", target)
+}
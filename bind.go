@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// On multi-homed gateways the SSH connection can be tied to one uplink,
+// e.g. an LTE backup link or a VPN interface, with vps.bind_interface or
+// vps.bind_address. ssh gets BindInterface and BindAddress; tut's own
+// connections to the VPS (the Happy Eyeballs race, health probes, the
+// roaming check and tut doctor) go through vpsDialer to take the same way.
+
+// bindArgs returns the ssh options for vps.bind_interface and
+// vps.bind_address.
+func bindArgs(cfg *Config) []string {
+	var args []string
+	if cfg.VPS.BindInterface != "" {
+		args = append(args, "-o", "BindInterface="+cfg.VPS.BindInterface)
+	}
+	if cfg.VPS.BindAddress != "" {
+		args = append(args, "-o", "BindAddress="+cfg.VPS.BindAddress)
+	}
+	return args
+}
+
+// validateBind checks vps.bind_interface and vps.bind_address. The
+// interface may not exist yet, e.g. a VPN that comes up later.
+func validateBind(c *Config) error {
+	if c.VPS.BindAddress != "" && net.ParseIP(c.VPS.BindAddress) == nil {
+		return fmt.Errorf("invalid vps.bind_address: %q (an IP address)", c.VPS.BindAddress)
+	}
+	if c.VPS.BindInterface != "" && !validName(c.VPS.BindInterface) {
+		return fmt.Errorf("invalid vps.bind_interface: %q", c.VPS.BindInterface)
+	}
+	return nil
+}
+
+// vpsDialer returns a dialer for network ("tcp" or "udp") connections to
+// the VPS that leave through the configured interface and address.
+func vpsDialer(cfg *Config, network string) *net.Dialer {
+	d := &net.Dialer{}
+	ip := net.ParseIP(cfg.VPS.BindAddress)
+	if cfg.VPS.BindInterface != "" {
+		ip = bindToInterface(d, cfg.VPS.BindInterface, ip)
+	}
+	if ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return d
+}
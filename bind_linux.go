@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindToInterface makes the connections of d leave through the interface
+// name with SO_BINDTODEVICE, whatever the routing table says, and returns
+// the source address ip unchanged.
+func bindToInterface(d *net.Dialer, name string, ip net.IP) net.IP {
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+	return ip
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// bindToInterface returns the source address for connections through the
+// interface name: ip when vps.bind_address set one, else the first address
+// of the interface. Whether they also leave through it is up to the
+// routing table.
+func bindToInterface(d *net.Dialer, name string, ip net.IP) net.IP {
+	if ip != nil {
+		return ip
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil
+	}
+	addrs, _ := iface.Addrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLinkLocalUnicast() {
+			return n.IP
+		}
+	}
+	return nil
+}
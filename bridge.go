@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The builtin bridge carries a UDP forward on the local side without socat,
+// for hosts and images that have nothing but the tut binary. It speaks what
+// the socat pair speaks on the wrap port: every read from a TCP connection
+// is sent as one datagram to the service and every datagram of the service
+// is written back to the connection unframed. With framing: length both
+// directions carry the frames of writeLenPrefixed instead, see framing.go.
+
+// bridgeIdle closes a connection without traffic in either direction, like
+// the -T 30 of the socat pair.
+const bridgeIdle = 30 * time.Second
+
+// runAgentBridge implements "tut agent bridge", started by tut itself for
+// UDP forwards when udp_bridge selects it.
+func runAgentBridge(args []string) int {
+	fs := flag.NewFlagSet("agent bridge", flag.ExitOnError)
+	accept := fs.String("accept", "", "Wrap address to listen on")
+	acceptFD := fs.Int("accept-fd", 0, "Inherited wrap listener")
+	target := fs.String("target", "", "UDP address of the service")
+	var o bridgeOptions
+	fs.BoolVar(&o.check, "check", false, "Verify and stamp datagrams, see integrity.go")
+	fs.BoolVar(&o.framed, "framed", false, "Frame datagrams with their length, see framing.go")
+	fs.BoolVar(&o.proxyV2, "proxy-v2", false, "Read client addresses and send them in PROXY v2 headers, see clientaddr.go")
+	_ = fs.Parse(args)
+	if *accept == "" && *acceptFD == 0 || *target == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent bridge -accept addr | -accept-fd n -target addr")
+		return 2
+	}
+	ln, err := wrapListener(*accept, *acceptFD)
+	if err == nil {
+		err = bridgeServe(ln, *target, o)
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
+
+// bridgeOptions are what the wrap stream of a bridge carries besides the
+// datagrams.
+type bridgeOptions struct {
+	check   bool // the trailers of integrity_check
+	framed  bool // the lengths of framing: length
+	proxyV2 bool // the client addresses of client_address: proxy-v2
+}
+
+// bridgeServe bridges every connection accepted on ln to its own UDP
+// socket towards target.
+func bridgeServe(ln net.Listener, target string, o bridgeOptions) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go bridgeConn(c, target, o)
+	}
+}
+
+// bridgeConn relays between c and target until either side fails or both
+// are idle for bridgeIdle.
+func bridgeConn(c net.Conn, target string, o bridgeOptions) {
+	defer c.Close()
+	u, err := net.Dial("udp", target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dial %s: %v\n", target, err)
+		return
+	}
+	defer u.Close()
+
+	var last atomic.Int64
+	last.Store(monoNow())
+	go func() {
+		defer c.Close()
+		buf := make([]byte, 65535)
+		var seq uint32
+		for {
+			_ = u.SetReadDeadline(time.Now().Add(bridgeIdle))
+			n, err := u.Read(buf)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() && monoSince(last.Load()) < bridgeIdle || errors.Is(err, syscall.ECONNREFUSED) {
+					continue // refused: the service is not up yet
+				}
+				return
+			}
+			last.Store(monoNow())
+			out := buf[:n]
+			if o.check {
+				out = stampDatagram(seq, out)
+				seq++
+			}
+			if o.framed {
+				err = writeLenPrefixed(c, out)
+			} else {
+				_, err = c.Write(out)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	br := newFrameReader(c)
+	var header []byte
+	if o.proxyV2 {
+		client, public, err := readAddressFrame(c, br)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading the client address: %v\n", err)
+			return
+		}
+		header = proxyV2Header(client, public)
+		fmt.Fprintf(os.Stderr, "%s client %s (to %s) reaches %s from %s\n", time.Now().Format(time.RFC3339), client, public, target, u.LocalAddr())
+	}
+	checker := integrityChecker{label: "from the VPS to " + target}
+	readDatagrams(c, br, o.framed, &last, func(b []byte) {
+		if header != nil {
+			_, _ = u.Write(append(append([]byte(nil), header...), b...))
+			return
+		}
+		if !o.check {
+			_, _ = u.Write(b) // lost like any datagram
+			return
+		}
+		for _, d := range checker.unstamp(b) {
+			_, _ = u.Write(d)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkPrivilegedPorts makes sure the local listeners can be bound. socat
+// binds wrap_tcp_port as a child of tut, so when that port is privileged a
+// non-root tut needs CAP_NET_BIND_SERVICE in its ambient set, which children
+// inherit across exec. Listeners passed in by systemd are already bound.
+func checkPrivilegedPorts(cfg *Config) error {
+	start := privilegedPortStart()
+	if start == 0 || os.Geteuid() == 0 {
+		return nil
+	}
+	for _, u := range cfg.UDPForwards {
+		if u.WrapTCPPort >= start || activated.file(u.Name+"-wrap") != nil {
+			continue
+		}
+		if hasBindCapability() {
+			return nil
+		}
+		if termuxMode(cfg) {
+			return fmt.Errorf("udp forward %s: wrap_tcp_port %d is below %d, which Android apps cannot bind; use a port >= %d",
+				u.Name, u.WrapTCPPort, start, start)
+		}
+		return fmt.Errorf("udp forward %s: wrap_tcp_port %d is below %d and needs CAP_NET_BIND_SERVICE; "+
+			"add AmbientCapabilities=CAP_NET_BIND_SERVICE to the service (see 'tut export systemd') "+
+			"or use a port >= %d", u.Name, u.WrapTCPPort, start, start)
+	}
+	return nil
+}
+
+// needsBindCapability reports whether cfg binds any privileged local port.
+func needsBindCapability(cfg *Config) bool {
+	start := privilegedPortStart()
+	for _, u := range cfg.UDPForwards {
+		if u.WrapTCPPort < start {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capNetBindService is the capability bit of CAP_NET_BIND_SERVICE.
+const capNetBindService = 10
+
+// privilegedPortStart returns the first port unprivileged processes may bind,
+// honouring net.ipv4.ip_unprivileged_port_start.
+func privilegedPortStart() int {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 1024
+	}
+	return n
+}
+
+// hasBindCapability reports whether CAP_NET_BIND_SERVICE is in the ambient
+// set, so that children like socat get it as well.
+func hasBindCapability() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		v, ok := strings.CutPrefix(sc.Text(), "CapAmb:")
+		if !ok {
+			continue
+		}
+		mask, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+		return err == nil && mask&(1<<capNetBindService) != 0
+	}
+	return false
+}
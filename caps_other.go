@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// privilegedPortStart returns 0: outside Linux tut does not check privileged
+// ports and leaves reporting bind failures to socat.
+func privilegedPortStart() int {
+	return 0
+}
+
+// hasBindCapability is only meaningful on Linux.
+func hasBindCapability() bool {
+	return false
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Through the tunnel every datagram reaches the service from 127.0.0.1, so
+// a game server sees all its players at one address. With client_address:
+// proxy-v2 on a forward with framing: length, the agent on the VPS starts
+// every wrap connection, one per client, with a frame naming the client
+// and the public address it sent to, and the builtin bridge puts a PROXY
+// protocol version 2 header with both in front of every datagram it sends
+// to the service, as HAProxy does for UDP. The bridge also logs which of
+// its local ports stands for which client, for services that cannot read
+// the header.
+//
+// TCP connections reach the relay from the local ssh in the same way, so
+// the policy, plugins and logs of tut would only ever see 127.0.0.1. With
+// client_address_port on a TCP forward, the agent takes remote_port and
+// passes every client to the remote forward on that loopback port behind
+// a PROXY protocol version 2 header, which the relay reads and strips;
+// the service gets the bytes of the client as before. With vps.transport:
+// tailscale the agent names the client next to the forward instead.
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// addressFrame is the first frame of a wrap connection with client
+// addresses: the client and the public address, separated by a space.
+func addressFrame(client, public net.Addr) []byte {
+	return []byte(client.String() + " " + public.String())
+}
+
+// readAddressFrame reads the first frame of a wrap connection with client
+// addresses from br.
+func readAddressFrame(conn net.Conn, br *bufio.Reader) (client, public *net.UDPAddr, err error) {
+	_ = conn.SetReadDeadline(time.Now().Add(bridgeIdle))
+	b, err := readFrame(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, p, ok := strings.Cut(string(b), " ")
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid address frame %q", b)
+	}
+	if client, err = net.ResolveUDPAddr("udp", c); err == nil {
+		public, err = net.ResolveUDPAddr("udp", p)
+	}
+	return client, public, err
+}
+
+// proxyV2Header is the PROXY protocol version 2 header of a datagram from
+// client to public.
+func proxyV2Header(client, public *net.UDPAddr) []byte {
+	return proxyV2(client.IP, public.IP, client.Port, public.Port, 0x2) // SOCK_DGRAM
+}
+
+// proxyV2StreamHeader is the PROXY protocol version 2 header of a TCP
+// connection from client to public.
+func proxyV2StreamHeader(client, public *net.TCPAddr) []byte {
+	return proxyV2(client.IP, public.IP, client.Port, public.Port, 0x1) // SOCK_STREAM
+}
+
+// proxyV2 is the PROXY protocol version 2 header of the transport
+// protocol transport from src to dst.
+func proxyV2(src, dst net.IP, srcPort, dstPort int, transport byte) []byte {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, 0x21) // version 2, PROXY
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 != nil && dst4 != nil {
+		h = append(h, 0x10|transport) // AF_INET
+		h = binary.BigEndian.AppendUint16(h, 12)
+		src, dst = src4, dst4
+	} else {
+		src, dst = src.To16(), dst.To16()
+		if src == nil {
+			src = net.IPv6zero
+		}
+		if dst == nil {
+			dst = net.IPv6zero
+		}
+		h = append(h, 0x20|transport) // AF_INET6
+		h = binary.BigEndian.AppendUint16(h, 36)
+	}
+	h = append(append(h, src...), dst...)
+	h = binary.BigEndian.AppendUint16(h, uint16(srcPort))
+	return binary.BigEndian.AppendUint16(h, uint16(dstPort))
+}
+
+// readProxyV2 reads the PROXY protocol version 2 header c starts with and
+// returns the client it names; the peer of c for a LOCAL header or an
+// address family other than IPv4 and IPv6.
+func readProxyV2(c net.Conn) (net.Addr, error) {
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:12], proxyV2Signature) || h[12]>>4 != 2 {
+		return nil, errors.New("no PROXY protocol version 2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, err
+	}
+	if h[12]&0xf == 0 { // LOCAL: a connection of the proxy itself
+		return c.RemoteAddr(), nil
+	}
+	switch {
+	case h[13]>>4 == 1 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case h[13]>>4 == 2 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return c.RemoteAddr(), nil
+}
+
+// clientConn is a connection of a client whose address the agent told,
+// handed to a relay; the relay unwraps it, see relay.handle.
+type clientConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (c *clientConn) RemoteAddr() net.Addr { return c.client }
+
+// validateClientAddresses checks the client_address_port of the TCP
+// forwards.
+func validateClientAddresses(c *Config) error {
+	used := make(map[int]string)
+	for _, f := range c.TCPForwards {
+		used[f.RemotePort] = "the remote_port of " + f.Name
+		if f.RemoteTLS {
+			used[f.RemoteTLSPort] = "the remote_tls_port of " + f.Name
+		}
+		if f.HTTPRedirectPort != 0 {
+			used[f.HTTPRedirectPort] = "the http_redirect_port of " + f.Name
+		}
+		if f.ErrorPagePort != 0 {
+			used[f.ErrorPagePort] = "the error_page_port of " + f.Name
+		}
+		if f.HTTPProxyPort != 0 {
+			used[f.HTTPProxyPort] = "the http_proxy_port of " + f.Name
+		}
+	}
+	for _, u := range c.UDPForwards {
+		used[u.WrapTCPPort] = "the wrap_tcp_port of " + u.Name
+	}
+	if c.HostRouting.Port != 0 {
+		used[c.HostRouting.Port] = "host_routing.port"
+	}
+	for _, f := range c.TCPForwards {
+		if f.ClientAddressPort == 0 {
+			continue
+		}
+		switch {
+		case !isPort(f.ClientAddressPort):
+			return fmt.Errorf("%s: invalid client_address_port: %d", f.Name, f.ClientAddressPort)
+		case !f.onVPS():
+			return fmt.Errorf("%s: client_address_port needs the forward on the VPS", f.Name)
+		case f.RemotePort == 0:
+			return fmt.Errorf("%s: client_address_port needs a fixed remote_port", f.Name)
+		case f.RemoteTLS || f.ErrorPagePort != 0 || f.HTTPProxyPort != 0 || hostRouted(c, f.Name):
+			return fmt.Errorf("%s: client_address_port does not apply with remote_tls, error_page_port, http_proxy_port or host_routing", f.Name)
+		case c.VPS.Transport == "tailscale":
+			return fmt.Errorf("%s: with vps.transport: tailscale client addresses are passed anyway; drop client_address_port", f.Name)
+		case used[f.ClientAddressPort] != "":
+			return fmt.Errorf("%s: client_address_port %d is %s", f.Name, f.ClientAddressPort, used[f.ClientAddressPort])
+		}
+		used[f.ClientAddressPort] = "the client_address_port of " + f.Name
+	}
+	return nil
+}
+
+// clientAddressScript returns the start functions of the agents passing
+// client addresses of cfg and their modes.
+func clientAddressScript(cfg *Config) (string, []string) {
+	var b strings.Builder
+	var modes []string
+	for i, f := range cfg.TCPForwards {
+		if f.ClientAddressPort == 0 || !f.onVPS() {
+			continue
+		}
+		mode := fmt.Sprintf("client%d", i)
+		b.WriteString(fmt.Sprintf(`start_%s(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, mode, f.RemotePort))
+		b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent client -listen %d -connect 127.0.0.1:%d %s & P_%s="$!"; }; start_%s; `,
+			f.RemotePort, f.ClientAddressPort, remoteLog(cfg, fmt.Sprintf("tut-agent-client-%d.log", f.RemotePort)), strings.ToUpper(mode), mode))
+		modes = append(modes, mode)
+	}
+	return b.String(), modes
+}
+
+// clientAddressUsed reports whether the agent passes the client addresses
+// of a forward of cfg.
+func clientAddressUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if f.ClientAddressPort != 0 && f.onVPS() {
+			return true
+		}
+	}
+	return false
+}
+
+// runAgentClient implements "tut agent client": it passes the clients of a
+// public port to addr, each behind a PROXY protocol header naming it.
+func runAgentClient(args []string) int {
+	fs := flag.NewFlagSet("agent client", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public port")
+	connect := fs.String("connect", "", "Address of the remote forward")
+	_ = fs.Parse(args)
+	if !isPort(*listen) || *connect == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent client -listen port -connect addr")
+		return 2
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *listen))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("Passing port %d to %s with the address of each client", *listen, *connect)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		go func() {
+			defer c.Close()
+			up, err := net.DialTimeout("tcp", *connect, 10*time.Second)
+			if err != nil {
+				return
+			}
+			defer up.Close()
+			client, _ := c.RemoteAddr().(*net.TCPAddr)
+			public, _ := c.LocalAddr().(*net.TCPAddr)
+			if client == nil || public == nil {
+				return
+			}
+			if _, err := up.Write(proxyV2StreamHeader(client, public)); err != nil {
+				return
+			}
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(up, c)
+				closeWrite(up)
+				close(done)
+			}()
+			_, _ = io.Copy(c, up)
+			closeWrite(c)
+			<-done
+		}()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Intervals inside tut are measured on the monotonic clock, so NTP steps
+// and manual clock changes do not shorten or stretch them; log timestamps
+// stay wall-clock time. Timestamps kept in atomics as integers would lose
+// the monotonic reading of a time.Time, so they hold monoNow instead.
+//
+// A suspended machine stops the monotonic clock on Linux and macOS while
+// the wall clock goes on, and stops everything on others. watchClock
+// notices either and re-validates the tunnel right after a resume instead
+// of waiting for ssh keepalives to time out on a connection that died in
+// the meantime.
+
+const (
+	// clockCheckInterval is how often watchClock compares the clocks.
+	clockCheckInterval = 5 * time.Second
+	// clockJump is how far the clocks may drift apart, or a check may be
+	// late, before it counts as a suspend or a clock step.
+	clockJump = 15 * time.Second
+)
+
+// processStart anchors monoNow.
+var processStart = time.Now()
+
+// monoNow returns the monotonic time since the process started, in
+// nanoseconds and never 0, to be stored where a time.Time does not fit.
+func monoNow() int64 {
+	return int64(time.Since(processStart)) + 1
+}
+
+// monoSince returns the time elapsed since the monoNow value t.
+func monoSince(t int64) time.Duration {
+	return time.Duration(monoNow() - t)
+}
+
+// watchClock detects suspend/resume and steps of the wall clock.
+func watchClock(ctx context.Context, d *daemon) {
+	ticker := time.NewTicker(clockCheckInterval)
+	defer ticker.Stop()
+	prev := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		mono := now.Sub(prev)
+		wall := now.Round(0).Sub(prev.Round(0))
+		prev = now
+		switch {
+		case mono > clockCheckInterval+clockJump || wall > mono+clockJump:
+			asleep := max(mono, wall) - clockCheckInterval
+			logEvent(levelWarn, "", "resumed", "Resumed after about %s (suspended, or the clock was set ahead); checking the tunnel", asleep.Round(time.Second))
+			d.revalidate(ctx)
+		case wall < mono-clockJump:
+			logEvent(levelInfo, "", "clock-step", "The wall clock was set back by %s", (mono - wall).Round(time.Second))
+		}
+	}
+}
+
+// revalidate probes the main SSH session and reconnects every session when
+// the probe fails, as after a resume the connections are usually gone.
+func (d *daemon) revalidate(ctx context.Context) {
+	if !d.sessionUp.Load() {
+		return // being (re)established anyway
+	}
+	cfg := d.config()
+	err := probeSession(ctx, cfg, cfg.Health.ProbeTimeout.D())
+	if err == nil {
+		logf("SSH tunnel survived")
+		return
+	}
+	logEvent(levelWarn, "", "probe-failed", "SSH tunnel did not survive (%v); reconnecting", err)
+	d.reconnectAll()
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A TCP forward with expose: cloudflare (or both) is published through
+// Cloudflare Tunnel instead of (or as well as) the VPS. tut runs cloudflared
+// for the remotely managed tunnel cloudflare_tunnel.tunnel_id and sets the
+// tunnel's ingress through the API: the cloudflare_hostname of every such
+// forward goes to the loopback port of its relay, so accounting, policy and
+// quotas apply as for the VPS. With cloudflare_tunnel.zone_id the hostnames
+// are pointed at the tunnel with proxied CNAME records. Whether cloudflared
+// is connected to the edge is polled from its readiness endpoint and shows
+// in the events, GET /v1/status and the metrics.
+
+// cloudflareRetry is how long tut waits after the API or cloudflared failed.
+const cloudflareRetry = 30 * time.Second
+
+// onVPS reports whether the forward is exposed on the VPS.
+func (f TCPForward) onVPS() bool {
+	return f.Expose != "cloudflare"
+}
+
+// onCloudflare reports whether the forward is exposed through Cloudflare
+// Tunnel.
+func (f TCPForward) onCloudflare() bool {
+	return f.Expose == "cloudflare" || f.Expose == "both"
+}
+
+// cloudflareUsed reports whether any forward of cfg is exposed through
+// Cloudflare Tunnel.
+func cloudflareUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if f.onCloudflare() {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCloudflare checks expose, the cloudflare_ settings of the TCP
+// forwards and cloudflare_tunnel.
+func validateCloudflare(c *Config) error {
+	hosts := make(map[string]string)
+	for _, f := range c.TCPForwards {
+		switch f.Expose {
+		case "", "vps":
+			continue
+		case "cloudflare", "both":
+		default:
+			return fmt.Errorf("%s: invalid expose: %q (vps, cloudflare or both)", f.Name, f.Expose)
+		}
+		if f.CloudflareHostname == "" {
+			return fmt.Errorf("%s: expose: %s needs a cloudflare_hostname", f.Name, f.Expose)
+		}
+		if other, ok := hosts[f.CloudflareHostname]; ok {
+			return fmt.Errorf("%s: cloudflare_hostname %s is also used by %s", f.Name, f.CloudflareHostname, other)
+		}
+		hosts[f.CloudflareHostname] = f.Name
+		switch f.CloudflareService {
+		case "http", "https", "tcp", "ssh", "rdp":
+		default:
+			return fmt.Errorf("%s: invalid cloudflare_service: %q (http, https, tcp, ssh or rdp)", f.Name, f.CloudflareService)
+		}
+	}
+	t := c.CloudflareTunnel
+	if len(hosts) > 0 && (t.AccountID == "" || t.TunnelID == "" || t.APIToken == "") {
+		return errors.New("forwards exposed through Cloudflare need cloudflare_tunnel.account_id, tunnel_id and api_token")
+	}
+	if !isPort(t.MetricsPort) {
+		return fmt.Errorf("invalid cloudflare_tunnel.metrics_port: %d", t.MetricsPort)
+	}
+	return nil
+}
+
+// cloudflareIngress is an ingress rule of a remotely managed tunnel.
+type cloudflareIngress struct {
+	Hostname      string         `json:"hostname,omitempty"`
+	Service       string         `json:"service"`
+	OriginRequest map[string]any `json:"originRequest,omitempty"`
+}
+
+// cloudflareTunnel runs cloudflared and keeps the tunnel's ingress in step
+// with the configuration.
+type cloudflareTunnel struct {
+	relays  func() map[string]*relay
+	resync  chan struct{}
+	stopped chan struct{} // closed once cloudflared is stopped
+	up      atomic.Bool
+
+	mu  sync.Mutex
+	cfg *Config
+}
+
+// startCloudflare starts the tunnel when a forward of cfg is exposed
+// through Cloudflare. It runs until ctx ends.
+func startCloudflare(ctx context.Context, cfg *Config, relays func() map[string]*relay) *cloudflareTunnel {
+	if !cloudflareUsed(cfg) {
+		return nil
+	}
+	t := &cloudflareTunnel{relays: relays, resync: make(chan struct{}, 1), stopped: make(chan struct{}), cfg: cfg}
+	go t.run(ctx)
+	go t.watch(ctx)
+	return t
+}
+
+// update makes the tunnel follow cfg after a reload.
+func (t *cloudflareTunnel) update(cfg *Config) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.cfg = cfg
+	t.mu.Unlock()
+	select {
+	case t.resync <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns once cloudflared is stopped, after ctx ended.
+func (t *cloudflareTunnel) wait() {
+	if t != nil {
+		<-t.stopped
+	}
+}
+
+func (t *cloudflareTunnel) config() *Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cfg
+}
+
+// run sets the ingress and keeps cloudflared running with the tunnel
+// token, setting the ingress again on every update.
+func (t *cloudflareTunnel) run(ctx context.Context) {
+	var kid *child
+	defer func() {
+		kid.stop(5 * time.Second)
+		close(t.stopped)
+	}()
+	for ctx.Err() == nil {
+		cfg := t.config()
+		err := t.sync(ctx, cfg)
+		if err == nil && (kid == nil || kid.exited()) {
+			if kid != nil {
+				logEvent(levelWarn, "", "cloudflared-exited", "cloudflared exited; restarting it")
+			}
+			kid, err = t.startCloudflared(ctx, cfg)
+		}
+		wait := time.Duration(0)
+		if err != nil {
+			logEvent(levelWarn, "", "cloudflare-failed", "Cloudflare Tunnel: %v", err)
+			wait = cloudflareRetry
+		}
+		var exited <-chan struct{}
+		if kid != nil {
+			exited = kid.done
+		}
+		select {
+		case <-ctx.Done():
+		case <-t.resync:
+		case <-exited:
+			time.Sleep(5 * time.Second)
+		case <-afterOrNever(wait):
+		}
+	}
+}
+
+// afterOrNever is time.After, or a channel that never fires for d = 0.
+func afterOrNever(d time.Duration) <-chan time.Time {
+	if d == 0 {
+		return nil
+	}
+	return time.After(d)
+}
+
+func (t *cloudflareTunnel) header(cfg *Config) http.Header {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer "+cfg.CloudflareTunnel.APIToken)
+	return h
+}
+
+// sync sets the ingress of the tunnel and, with a zone, the CNAME records
+// of its hostnames.
+func (t *cloudflareTunnel) sync(ctx context.Context, cfg *Config) error {
+	ct := cfg.CloudflareTunnel
+	relays := t.relays()
+	var ingress []cloudflareIngress
+	var hosts []string
+	for _, f := range cfg.TCPForwards {
+		r := relays[f.Name]
+		if !f.onCloudflare() || r == nil {
+			continue
+		}
+		rule := cloudflareIngress{Hostname: f.CloudflareHostname, Service: fmt.Sprintf("%s://127.0.0.1:%d", f.CloudflareService, r.port())}
+		if f.CloudflareService == "https" {
+			// the origin's certificate is not issued for 127.0.0.1
+			rule.OriginRequest = map[string]any{"noTLSVerify": true, "originServerName": f.CloudflareHostname}
+		}
+		ingress = append(ingress, rule)
+		hosts = append(hosts, f.CloudflareHostname)
+	}
+	ingress = append(ingress, cloudflareIngress{Service: "http_status:404"})
+	url := fmt.Sprintf("%s/accounts/%s/cfd_tunnel/%s/configurations", cloudflareAPI, ct.AccountID, ct.TunnelID)
+	body := map[string]any{"config": map[string]any{"ingress": ingress}}
+	if err := registryRequest(ctx, http.MethodPut, url, t.header(cfg), body, nil); err != nil {
+		return fmt.Errorf("setting the ingress: %w", err)
+	}
+	if ct.ZoneID != "" {
+		dns := &cloudflareDNS{token: ct.APIToken, zone: ct.ZoneID}
+		for _, h := range hosts {
+			rr := dnsRecord{typ: "CNAME", name: h, values: []string{ct.TunnelID + ".cfargotunnel.com"}, ttl: 1, proxied: true}
+			if err := dns.upsert(ctx, rr); err != nil {
+				return fmt.Errorf("pointing %s at the tunnel: %w", h, err)
+			}
+		}
+	}
+	logf("Cloudflare Tunnel %s routes %d hostname(s)", ct.TunnelID, len(hosts))
+	return nil
+}
+
+// startCloudflared fetches the tunnel token and starts cloudflared with it.
+func (t *cloudflareTunnel) startCloudflared(ctx context.Context, cfg *Config) (*child, error) {
+	ct := cfg.CloudflareTunnel
+	var token struct {
+		Result string `json:"result"`
+	}
+	url := fmt.Sprintf("%s/accounts/%s/cfd_tunnel/%s/token", cloudflareAPI, ct.AccountID, ct.TunnelID)
+	if err := registryRequest(ctx, http.MethodGet, url, t.header(cfg), nil, &token); err != nil {
+		return nil, fmt.Errorf("fetching the tunnel token: %w", err)
+	}
+	bin := ct.Binary
+	if bin == "" {
+		bin = "cloudflared"
+	}
+	cmd := exec.Command(bin, "tunnel", "--no-autoupdate", "--metrics", fmt.Sprintf("127.0.0.1:%d", ct.MetricsPort), "run")
+	// the token stays out of the process list
+	cmd.Env = append(os.Environ(), "TUNNEL_TOKEN="+token.Result)
+	logPath := ""
+	if wrapperLogDir != "-" {
+		logPath = filepath.Join(wrapperLogDir, "cloudflared.log")
+	}
+	kid, err := startLogged(cmd, logPath, "cloudflared")
+	if err != nil {
+		return nil, err
+	}
+	logf("cloudflared running (PID %d)", kid.cmd.Process.Pid)
+	return kid, nil
+}
+
+// watch polls the readiness endpoint of cloudflared and logs when the
+// tunnel connects to the Cloudflare edge and when it loses it.
+func (t *cloudflareTunnel) watch(ctx context.Context) {
+	tick := time.NewTicker(10 * time.Second)
+	defer tick.Stop()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		ready := false
+		resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/ready", t.config().CloudflareTunnel.MetricsPort))
+		if err == nil {
+			ready = resp.StatusCode == http.StatusOK
+			_ = resp.Body.Close()
+		}
+		if t.up.Swap(ready) == ready {
+			continue
+		}
+		if ready {
+			logEvent(levelInfo, "", "cloudflare-up", "Cloudflare Tunnel connected to the edge")
+			for _, f := range t.config().TCPForwards {
+				if f.onCloudflare() && !f.onVPS() {
+					publishForwardUp(f)
+				}
+			}
+		} else {
+			logEvent(levelWarn, "", "cloudflare-down", "Cloudflare Tunnel lost the edge")
+		}
+	}
+}
+
+// cloudflareState is the state of the tunnel in GET /v1/status.
+type cloudflareState struct {
+	Tunnel string `json:"tunnel"`
+	Up     bool   `json:"up"`
+}
+
+func (t *cloudflareTunnel) state() *cloudflareState {
+	if t == nil {
+		return nil
+	}
+	return &cloudflareState{Tunnel: t.config().CloudflareTunnel.TunnelID, Up: t.up.Load()}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With http_compress, the relay of an HTTP forward speaks HTTP to the
+// tunnel and gzips the responses of the local service before they go up
+// the uplink, which is what limits most sites served from home. Only
+// responses whose Content-Type matches http_compress_types are compressed,
+// and only for clients accepting gzip, when the service did not encode
+// them already and they are not tiny (1 KB) or marked no-transform. Such
+// responses get Vary: Accept-Encoding, so caches, including http_cache on
+// the VPS, keep both versions apart, and their ETags become weak. Brotli
+// would compress better but needs an encoder outside the standard library.
+
+// compressMin is the smallest response worth compressing.
+const compressMin = 1024
+
+// defaultCompressTypes are the media types compressed when
+// http_compress_types is empty.
+var defaultCompressTypes = []string{"text/html", "text/css", "text/plain", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml", "application/wasm", "image/svg+xml"}
+
+// compressTransport reaches the local services of compressing relays; it
+// leaves the encoding of responses alone.
+var compressTransport = &http.Transport{
+	DisableCompression:  true,
+	MaxIdleConnsPerHost: 16,
+	IdleConnTimeout:     time.Minute,
+}
+
+// validateCompressTypes checks the http_compress_types of f.
+func validateCompressTypes(f TCPForward) error {
+	for _, t := range f.HTTPCompressTypes {
+		typ, sub, ok := strings.Cut(t, "/")
+		if !ok || typ == "" || typ == "*" || sub == "" || strings.ContainsAny(t, " ;,") {
+			return fmt.Errorf("%s: invalid http_compress_types entry %q (type/subtype or type/*)", f.Name, t)
+		}
+	}
+	return nil
+}
+
+// compressTypes returns the media types f compresses, nil when it does
+// not compress.
+func compressTypes(f TCPForward) []string {
+	switch {
+	case !f.HTTPCompress:
+		return nil
+	case len(f.HTTPCompressTypes) > 0:
+		return f.HTTPCompressTypes
+	}
+	return defaultCompressTypes
+}
+
+// compressible reports whether contentType matches one of types.
+func compressible(contentType string, types []string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "text/event-stream" { // streamed, gzip would hold it back
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the Accept-Encoding of a request allows gzip.
+func acceptsGzip(h http.Header) bool {
+	for _, part := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if v, ok := strings.CutPrefix(q, "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressResponse gzips resp when it qualifies.
+func compressResponse(resp *http.Response, types []string) error {
+	if resp.Request.Method == http.MethodHead || resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent ||
+		!compressible(resp.Header.Get("Content-Type"), types) {
+		return nil
+	}
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(resp.Request.Header) || resp.Header.Get("Content-Encoding") != "" ||
+		resp.ContentLength >= 0 && resp.ContentLength < compressMin ||
+		strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return nil
+	}
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(pw)
+		_, err := io.Copy(gz, body)
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+		gzipWriters.Put(gz)
+		_ = body.Close()
+		_ = pw.CloseWithError(err)
+	}()
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// gzipWriters are reused; a gzip.Writer takes a good deal of memory.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// serveHTTP serves the HTTP requests arriving on in from the tunnel,
+// proxying them to target, compressing the responses and logging the
+// requests as opts say.
+func (r *relay) serveHTTP(in net.Conn, target string, opts *relayOptions) {
+	r.track(in)
+	r.stats.active.Add(1)
+	defer func() {
+		r.stats.active.Add(-1)
+		r.untrack(in)
+	}()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme, req.URL.Host = "http", target
+			if _, ok := req.Header["X-Forwarded-For"]; !ok {
+				req.Header["X-Forwarded-For"] = nil // the tunnel says nothing of the client
+			}
+		},
+		Transport:      compressTransport,
+		ModifyResponse: func(resp *http.Response) error { return compressResponse(resp, opts.compress) },
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logEvent(levelWarn, r.name, "dial-failed", "%s %s: %v", req.Method, req.URL.Path, err)
+			if opts.errorPage == nil {
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write(opts.errorPage)
+		},
+	}
+	var handler http.Handler = proxy
+	if opts.accessLog != nil {
+		handler = opts.accessLog.handler(proxy, r.name, opts.logFormat, opts.forwarded)
+	}
+	done := make(chan struct{})
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		ConnState: func(_ net.Conn, s http.ConnState) {
+			if s == http.StateClosed || s == http.StateHijacked {
+				close(done)
+			}
+		},
+	}
+	_ = srv.Serve(&oneConnListener{conn: &countingConn{Conn: in, r: r}, done: done})
+}
+
+// countingConn accounts the traffic of a connection served over HTTP to
+// its relay.
+type countingConn struct {
+	net.Conn
+	r *relay
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.r.stats.bytesIn.Add(int64(n))
+		c.r.stats.lastActivity.Store(monoNow())
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.r.stats.bytesOut.Add(int64(n))
+		c.r.stats.lastActivity.Store(monoNow())
+	}
+	return n, err
+}
+
+// oneConnListener hands conn to an http.Server and ends its Serve once
+// done is closed.
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() { c = l.conn })
+	if c != nil {
+		return c, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *oneConnListener) Close() error   { return nil }
+func (l *oneConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	_ "embed"
+	"encoding"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// "tut config example" prints a config generated from Config itself: every
+// setting by its YAML name, with its default as loadConfig fills it in.
+// The explanations come from config.yaml.example, embedded in the binary
+// and matched by path, so a setting that is renamed or removed there is
+// not printed and one without an explanation still is. Without -full only
+// what every config needs is printed.
+
+//go:embed config.yaml.example
+var configExample []byte
+
+// exampleEssentials are the settings printed without -full.
+var exampleEssentials = map[string]bool{
+	"version": true, "vps": true, "vps.host": true, "vps.user": true, "vps.port": true, "vps.ssh_key": true,
+	"tcp_forwards": true, "udp_forwards": true,
+}
+
+// configExampleCommand implements "tut config example".
+func configExampleCommand(args []string) int {
+	fs := flag.NewFlagSet("config example", flag.ExitOnError)
+	full := fs.Bool("full", false, "Print every setting, not only the essential ones")
+	_ = fs.Parse(args)
+
+	var c Config
+	applyDefaults(&c)
+	c.Version = configVersion
+	c.HA.Node = "" // the host name, not a default worth copying
+	var b strings.Builder
+	b.WriteString("# tut configuration, generated by \"tut config example")
+	if *full {
+		b.WriteString(" -full")
+	}
+	b.WriteString("\".\n\n")
+	writeExample(&b, reflect.ValueOf(c), "", "", exampleDocs(), *full)
+	fmt.Print(b.String())
+	return 0
+}
+
+// exampleDoc is the explanation of one setting: the comment block above it
+// and the one after it on its line.
+type exampleDoc struct {
+	head, line string
+}
+
+// exampleDocs returns the comments of config.yaml.example by path, with
+// "[]" for the entries of a list.
+func exampleDocs() map[string]exampleDoc {
+	docs := map[string]exampleDoc{}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(joinCommentLines(configExample), &doc); err != nil {
+		fmt.Fprintf(os.Stderr, "config.yaml.example: %v\n", err)
+		return docs
+	}
+	var walk func(n *yaml.Node, prefix string)
+	walk = func(n *yaml.Node, prefix string) {
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				path := prefix + k.Value
+				line := k.LineComment
+				if line == "" {
+					line = v.LineComment
+				}
+				docs[path] = exampleDoc{k.HeadComment, line}
+				walk(v, path+".")
+			}
+		case yaml.SequenceNode:
+			for _, item := range n.Content {
+				walk(item, strings.TrimSuffix(prefix, ".")+"[].")
+			}
+		}
+	}
+	if root := mappingRoot(&doc); root != nil {
+		walk(root, "")
+	}
+	return docs
+}
+
+// joinCommentLines appends the lines that continue a comment after a
+// setting, aligned under its "#", to that comment.
+func joinCommentLines(src []byte) []byte {
+	var out []string
+	col := -1
+	for _, l := range strings.Split(string(src), "\n") {
+		t := strings.TrimLeft(l, " ")
+		if col >= 0 && strings.HasPrefix(t, "#") && len(l)-len(t) == col {
+			out[len(out)-1] += " " + strings.TrimSpace(strings.TrimPrefix(t, "#"))
+			continue
+		}
+		col = -1
+		if !strings.HasPrefix(t, "#") {
+			if i := strings.Index(l, "  #"); i >= 0 {
+				col = i + 2
+			}
+		}
+		out = append(out, l)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// textMarshalerType is implemented by the settings written as one value,
+// such as Duration.
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// writeExample writes the settings of the struct v at indent, commented
+// out after the prefix "# " in a list entry.
+func writeExample(b *strings.Builder, v reflect.Value, indent, prefix string, docs map[string]exampleDoc, full bool) {
+	t := v.Type()
+	heads := exampleHeads(t, prefix, docs)
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		path := prefix + name
+		if !full && !exampleEssentials[path] && !strings.Contains(prefix, "[]") {
+			continue
+		}
+		f := v.Field(i)
+		doc := docs[path]
+		for _, l := range heads[name] {
+			b.WriteString(indent + l + "\n")
+		}
+		line := ""
+		if doc.line != "" {
+			line = "  " + doc.line
+		}
+		switch {
+		case f.Kind() == reflect.Struct && !f.Type().Implements(textMarshalerType):
+			b.WriteString(indent + name + ":" + line + "\n")
+			writeExample(b, f, indent+"  ", path+".", docs, full)
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+			b.WriteString(indent + name + ": []" + line + "\n")
+			// one entry to copy, commented out
+			var entry strings.Builder
+			writeExample(&entry, reflect.New(f.Type().Elem()).Elem(), "", path+"[].", docs, full)
+			lead := "- "
+			for _, l := range strings.Split(strings.TrimSuffix(entry.String(), "\n"), "\n") {
+				b.WriteString(indent + "#  " + lead + l + "\n")
+				lead = "  "
+			}
+		default:
+			b.WriteString(indent + name + ": " + exampleValue(f) + line + "\n")
+		}
+	}
+}
+
+// commentedSettingRe matches a setting commented out in
+// config.yaml.example, such as "# run_as: tut".
+var commentedSettingRe = regexp.MustCompile(`^# ([a-z0-9_]+):( |$)`)
+
+// exampleHeads returns the comment lines above each setting of the struct
+// type t. In config.yaml.example a setting left out is shown commented out
+// below its explanation, which then sits above the next setting; it is
+// moved to the setting it explains and the commented-out line dropped.
+func exampleHeads(t reflect.Type, prefix string, docs map[string]exampleDoc) map[string][]string {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		names[yamlName(t.Field(i))] = true
+	}
+	heads := map[string][]string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		var cur []string
+		for _, l := range strings.Split(docs[prefix+name].head, "\n") {
+			l = strings.TrimSpace(l)
+			if m := commentedSettingRe.FindStringSubmatch(l); m != nil && names[m[1]] {
+				heads[m[1]] = append(heads[m[1]], cur...)
+				cur = nil
+			} else if l != "" {
+				cur = append(cur, l)
+			}
+		}
+		heads[name] = append(heads[name], cur...)
+	}
+	return heads
+}
+
+// exampleValue formats a setting in flow style, on one line.
+func exampleValue(v reflect.Value) string {
+	var n yaml.Node
+	if err := n.Encode(v.Interface()); err != nil {
+		return `""`
+	}
+	n.Style = yaml.FlowStyle
+	for _, c := range n.Content {
+		c.Style |= yaml.FlowStyle
+	}
+	out, err := yaml.Marshal(&n)
+	if err != nil {
+		return `""`
+	}
+	s := strings.TrimSpace(string(out))
+	if s == "" || v.Kind() == reflect.String && v.Len() == 0 {
+		return `""`
+	}
+	return s
+}
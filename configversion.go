@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The config file carries the version of its layout in "version". When a
+// change to the layout would break existing files, configVersion is bumped
+// and a migration that rewrites the previous layout is added to
+// configMigrations. loadConfig runs the migrations in memory, so old files
+// keep working, and "tut config migrate" writes the result back with the
+// comments kept. Files without "version" predate it and are version 1.
+
+// configVersion is the layout of the config this tut reads and writes.
+const configVersion = 2
+
+// configMigrations[v] rewrites the mapping at the top of a version v config
+// to version v+1.
+var configMigrations = map[int]func(root *yaml.Node) error{
+	1: migrateUnits, // see units.go
+}
+
+// migrateConfigNode brings the parsed config doc up to configVersion in
+// place and returns the version it was written in and whether it changed.
+func migrateConfigNode(doc *yaml.Node) (int, bool, error) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return configVersion, false, nil // nothing to migrate, decoding reports what is wrong
+	}
+	root := doc.Content[0]
+	from := 1
+	versionAt := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "version" {
+			v, err := strconv.Atoi(root.Content[i+1].Value)
+			if err != nil || v < 1 {
+				return 0, false, fmt.Errorf("invalid version: %q", root.Content[i+1].Value)
+			}
+			from, versionAt = v, i
+		}
+	}
+	if from > configVersion {
+		return 0, false, fmt.Errorf("the config is version %d, newer than this tut understands (%d); upgrade tut", from, configVersion)
+	}
+	for v := from; v < configVersion; v++ {
+		if err := configMigrations[v](root); err != nil {
+			return 0, false, fmt.Errorf("migrating the config from version %d: %w", v, err)
+		}
+	}
+	if versionAt >= 0 && from == configVersion {
+		return from, false, nil
+	}
+	if versionAt >= 0 {
+		root.Content[versionAt+1].Value = strconv.Itoa(configVersion)
+		return from, true, nil
+	}
+	// a new version key goes first, under the comment heading the file
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(configVersion)}
+	if len(root.Content) > 0 {
+		key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+	}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+	return from, true, nil
+}
+
+// runConfigMigrate implements "tut config migrate": it prints the config
+// in the current layout, or with -w replaces the file, keeping the old one
+// as <file>.bak.
+func runConfigMigrate(args []string) int {
+	fs := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	write := fs.Bool("w", false, "Rewrite the config file instead of printing it")
+	_ = fs.Parse(args)
+
+	b, err := os.ReadFile(*configPath)
+	if err != nil {
+		die("Failed to read config: %v", err)
+	}
+	if kind := configEncryption(b); kind != "" && *write {
+		die("%s is encrypted with %s; decrypt it, migrate the plaintext and encrypt that again", *configPath, kind)
+	}
+	if b, err = decryptConfig(*configPath, b); err != nil {
+		die("%v", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		die("Failed to parse config: %v", err)
+	}
+	from, changed, err := migrateConfigNode(&doc)
+	if err != nil {
+		die("%v", err)
+	}
+	if *write && !changed {
+		fmt.Printf("%s is already version %d.\n", *configPath, configVersion)
+		return 0
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		die("Failed to write config: %v", err)
+	}
+	_ = enc.Close()
+	if !*write {
+		_, _ = os.Stdout.Write(out.Bytes())
+		return 0
+	}
+	if err := os.WriteFile(*configPath+".bak", b, 0o600); err != nil {
+		die("Failed to back up the config: %v", err)
+	}
+	if err := replaceFile(*configPath, out.Bytes()); err != nil {
+		die("Failed to write config: %v", err)
+	}
+	if from == configVersion {
+		fmt.Printf("Marked %s as version %d; the old file is %s.bak.\n", *configPath, configVersion, *configPath)
+	} else {
+		fmt.Printf("Migrated %s from version %d to %d; the old file is %s.bak.\n", *configPath, from, configVersion, *configPath)
+	}
+	return 0
+}
+
+// replaceFile writes b to path through a temporary file and rename,
+// keeping the mode of the file it replaces.
+func replaceFile(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tut-config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
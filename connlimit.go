@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connLimit caps the connections open through all relays together, so a
+// flood arriving via the VPS cannot exhaust the memory of a small device.
+// Connections over the limit are shed: closed right after accept, before
+// anything is dialled or allocated for them.
+type connLimit struct {
+	max      atomic.Int64 // 0: unlimited
+	active   atomic.Int64
+	shed     atomic.Int64
+	shedding atomic.Bool // shedding started and has not been logged as over
+
+	mu      sync.Mutex
+	lastLog time.Time // of the last shedding log line
+}
+
+// totalConns limits the connections of the daemon, see max_total_connections.
+var totalConns connLimit
+
+// acquire reserves a connection and reports whether the limit allowed it.
+func (l *connLimit) acquire(forward string) bool {
+	n := l.active.Add(1)
+	if max := l.max.Load(); max > 0 && n > max {
+		l.active.Add(-1)
+		l.shed.Add(1)
+		l.shedding.Store(true)
+		l.logShedding(forward, max)
+		return false
+	}
+	return true
+}
+
+// release frees a connection. Once shedding has started, its end is logged
+// when the open connections have dropped to 90% of the limit, so a flood
+// hovering at the limit does not log on every connection.
+func (l *connLimit) release() {
+	n := l.active.Add(-1)
+	if l.shedding.Load() && n <= l.max.Load()*9/10 && l.shedding.CompareAndSwap(true, false) {
+		logEvent(levelInfo, "", "shedding-stopped", "Connections back under max_total_connections (%d shed since start)", l.shed.Load())
+	}
+}
+
+// logShedding logs at most every 10 seconds while connections are shed.
+func (l *connLimit) logShedding(forward string, max int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.lastLog) < 10*time.Second {
+		return
+	}
+	l.lastLog = time.Now()
+	logEvent(levelWarn, forward, "shedding", "Shedding connections: max_total_connections (%d) reached, %d shed since start",
+		max, l.shed.Load())
+}
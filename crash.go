@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// When the daemon panics or stops on a fatal error, it writes a crash
+// report to crash_dir before it exits: one tar.gz holding the panic and the
+// stacks of all goroutines, the config with its secrets redacted, the most
+// recent log entries, the state of the tunnel and its forwards, and tut
+// version --verbose. The error output names the file, so a user can attach
+// it to a bug report. Errors of the Go runtime that cannot be recovered,
+// such as running out of memory, only leave their stacks on stderr.
+
+// crashKeep is how many crash reports crash_dir keeps.
+const crashKeep = 10
+
+// crashStateTimeout bounds collecting the state of the daemon, whose locks
+// a crashed goroutine may hold.
+const crashStateTimeout = 2 * time.Second
+
+// crashDaemon is the running daemon, nil before it started.
+var crashDaemon atomic.Pointer[daemon]
+
+// crashConfig is the config crash reports use, nil outside the daemon.
+var crashConfig atomic.Pointer[Config]
+
+// crashGuard, deferred at the top of a goroutine of the daemon, turns a
+// panic into a crash report and exits.
+func crashGuard() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stacks := allStacks()
+	msg := fmt.Sprintf("panic: %v", r)
+	fmt.Fprintf(os.Stderr, "%s\n\n%s\n", msg, stacks)
+	if path, err := writeCrashReport(msg, stacks); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write the crash report: %v\n", err)
+	} else if path != "" {
+		fmt.Fprintf(os.Stderr, "Crash report written to %s; please attach it to a bug report.\n", path)
+	}
+	os.Exit(2)
+}
+
+// goGuarded runs f in a goroutine under crashGuard.
+func goGuarded(f func()) {
+	go func() {
+		defer crashGuard()
+		f()
+	}()
+}
+
+// allStacks returns the stacks of all goroutines.
+func allStacks() string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// writeCrashReport writes a crash report for the error msg and returns its
+// path, or "" outside the daemon or with crash_dir "-".
+func writeCrashReport(msg, stacks string) (string, error) {
+	cfg := crashConfig.Load()
+	if cfg == nil || cfg.CrashDir == "-" {
+		return "", nil
+	}
+	if err := os.MkdirAll(cfg.CrashDir, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	path := filepath.Join(cfg.CrashDir, "crash-"+now.Format("20060102T150405Z")+".tar.gz")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	add := func(name, content string) {
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content)), ModTime: now})
+		}
+		if err == nil {
+			_, err = tw.Write([]byte(content))
+		}
+	}
+	add("error.txt", fmt.Sprintf("%s\n\ntime: %s\ncommand: %s\n", msg, now.Format(time.RFC3339), strings.Join(os.Args, " ")))
+	add("stacks.txt", stacks)
+	add("config.yaml", crashConfigText(cfg))
+	add("log.txt", logLines(recentLogEntries(time.Time{})))
+	add("state.json", crashState(cfg))
+	version := buildVersion()
+	version.SSH = localVersion("ssh", "-V")
+	version.Socat = localVersion("socat", "-V")
+	b, _ := json.MarshalIndent(version, "", "  ")
+	add("version.json", string(b)+"\n")
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+	pruneCrashReports(cfg.CrashDir)
+	return path, nil
+}
+
+// crashConfigText is cfg as YAML with its secrets redacted.
+func crashConfigText(cfg *Config) string {
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Sprintf("cannot render the config: %v\n", err)
+	}
+	return redactSecrets(cfg, string(b))
+}
+
+// crashState is the state of the daemon as GET /v1/status shows it, or
+// what kept it from being collected.
+func crashState(cfg *Config) string {
+	d := crashDaemon.Load()
+	if d == nil {
+		return `{"error": "the daemon had not started"}` + "\n"
+	}
+	ch := make(chan string, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				ch <- fmt.Sprintf(`{"error": %q}`+"\n", fmt.Sprint("collecting the state panicked: ", r))
+			}
+		}()
+		b, err := json.MarshalIndent(d.statusSnapshot(), "", "  ")
+		if err != nil {
+			ch <- fmt.Sprintf(`{"error": %q}`+"\n", err.Error())
+			return
+		}
+		ch <- redactSecrets(cfg, string(b)) + "\n"
+	}()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(crashStateTimeout):
+		return `{"error": "timed out collecting the state, a lock is held"}` + "\n"
+	}
+}
+
+// pruneCrashReports removes all but the crashKeep newest crash reports in
+// dir.
+func pruneCrashReports(dir string) {
+	names, _ := filepath.Glob(filepath.Join(dir, "crash-*.tar.gz"))
+	sort.Strings(names)
+	for len(names) > crashKeep {
+		_ = os.Remove(names[0])
+		names = names[1:]
+	}
+}
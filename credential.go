@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// vps.ssh_key (and the ssh_key of a mirror) may name a credential instead
+// of a file, and vps.ssh_key_passphrase must, so neither has to sit in the
+// config or next to it:
+//
+//	credential:systemd/<name>                  LoadCredential= of the unit
+//	credential:keychain/<service>[/<account>]  macOS Keychain, generic password
+//	credential:wincred/<target>                Windows Credential Manager, generic
+//
+// or a secret manager, see secrets.go.
+//
+// A systemd credential already is a file ssh can read. A key from the
+// Keychain or the Credential Manager is written to a file only tut can
+// read in runtime_dir while tut runs, since ssh takes keys from files. The
+// passphrase never touches the disk: ssh asks tut itself for it through
+// SSH_ASKPASS (OpenSSH 8.4 or newer), and tut reads it from the store
+// again.
+
+// credentialScheme starts a reference to a secret in a credential store.
+const credentialScheme = "credential:"
+
+// askpassEnv names the credential "tut askpass" answers with.
+const askpassEnv = "TUT_ASKPASS_CREDENTIAL"
+
+func isCredential(s string) bool { return strings.HasPrefix(s, credentialScheme) }
+
+// readCredential returns the secret ref refers to.
+func readCredential(ref string) ([]byte, error) {
+	store, name, _ := strings.Cut(strings.TrimPrefix(ref, credentialScheme), "/")
+	if name == "" {
+		return nil, fmt.Errorf("invalid credential %q (e.g. credential:systemd/ssh-key)", ref)
+	}
+	switch store {
+	case "systemd":
+		path, err := systemdCredentialPath(name)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(path)
+	case "keychain":
+		service, account, _ := strings.Cut(name, "/")
+		return keychainCredential(service, account)
+	case "wincred":
+		return wincredCredential(name)
+	}
+	if isSecretManager(store) {
+		return fetchSecret(ref, store, name)
+	}
+	return nil, fmt.Errorf("unknown credential store %q in %q (systemd, keychain, wincred, aws, gcp or vault)", store, ref)
+}
+
+// systemdCredentialPath returns the file systemd passes the credential
+// name in.
+func systemdCredentialPath(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("no systemd credential %s: CREDENTIALS_DIRECTORY is not set (LoadCredential= in the unit)", name)
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid systemd credential name %q", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// checkSSHKey checks that the SSH key setting key can be read.
+func checkSSHKey(what, key string) error {
+	if isCredential(key) {
+		if _, err := readCredential(key); err != nil {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		return nil
+	}
+	if st, err := os.Stat(key); err != nil || st.IsDir() {
+		return fmt.Errorf("SSH key not readable: %s", key)
+	}
+	return nil
+}
+
+// keyFiles are the files written for keys from a credential store, by
+// reference.
+var keyFiles = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: map[string]string{}}
+
+// sshKeyFile returns the file ssh reads the SSH key of cfg from.
+func sshKeyFile(cfg *Config) (string, error) {
+	ref := cfg.VPS.SSHKey
+	if !isCredential(ref) {
+		return ref, nil
+	}
+	if name, ok := strings.CutPrefix(ref, credentialScheme+"systemd/"); ok {
+		return systemdCredentialPath(name)
+	}
+	keyFiles.Lock()
+	defer keyFiles.Unlock()
+	if path, ok := keyFiles.paths[ref]; ok {
+		return path, nil
+	}
+	b, err := readCredential(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		b = append(b, '\n') // ssh rejects keys without a final newline
+	}
+	path := filepath.Join(cfg.RuntimeDir, "tut-key-"+configHash([]byte(ref)))
+	_ = os.Remove(path)
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		return "", err
+	}
+	keyFiles.paths[ref] = path
+	return path, nil
+}
+
+// removeKeyFiles removes the key files written by sshKeyFile.
+func removeKeyFiles() {
+	keyFiles.Lock()
+	defer keyFiles.Unlock()
+	for ref, path := range keyFiles.paths {
+		_ = os.Remove(path)
+		delete(keyFiles.paths, ref)
+	}
+}
+
+// sshIdentityArgs returns the ssh options for the key of cfg and its
+// passphrase. Without a passphrase ssh runs in batch mode; with one it may
+// only ask SSH_ASKPASS, once, and only for the passphrase.
+func sshIdentityArgs(cfg *Config) []string {
+	key, err := sshKeyFile(cfg)
+	if err != nil {
+		logEvent(levelError, "", "credential-failed", "Cannot read the SSH key %s: %v", cfg.VPS.SSHKey, err)
+		key = cfg.VPS.SSHKey
+	}
+	args := []string{"-i", key}
+	if cfg.VPS.SSHKeyPassphrase == "" {
+		return append(args, "-o", "BatchMode=yes")
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Setenv("SSH_ASKPASS", exe)
+		os.Setenv("SSH_ASKPASS_REQUIRE", "force")
+		os.Setenv(askpassEnv, cfg.VPS.SSHKeyPassphrase)
+	}
+	return append(args, "-o", "BatchMode=no", "-o", "NumberOfPasswordPrompts=1",
+		"-o", "PasswordAuthentication=no", "-o", "KbdInteractiveAuthentication=no")
+}
+
+// runAskpass answers ssh running tut as SSH_ASKPASS with a prompt: it
+// prints the credential named by TUT_ASKPASS_CREDENTIAL for the passphrase
+// of the key and refuses every other question.
+func runAskpass(args []string) int {
+	ref := os.Getenv(askpassEnv)
+	if len(args) == 0 || !strings.Contains(strings.ToLower(args[0]), "passphrase") || !isCredential(ref) {
+		fmt.Fprintln(os.Stderr, "tut askpass only answers ssh asking for the passphrase of vps.ssh_key")
+		return 1
+	}
+	b, err := readCredential(ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(strings.TrimRight(string(b), "\r\n"))
+	return 0
+}
+
+// errNoCredentialStore is returned for a store this platform lacks.
+var errNoCredentialStore = errors.New("credential store not available on this platform")
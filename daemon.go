@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// daemon holds the runtime state shared by the reconnect loop, the watchers
+// and config reloads. The configuration and relay set are swapped as a whole
+// on reload, so readers take a snapshot through config and relaySnapshot.
+type daemon struct {
+	configPath string
+	st         *stateStore
+	wrappers   *wrapperSet
+	punchers   map[string]*puncher // by UDP forward name, fixed at startup
+	reconnects atomic.Int64        // SSH sessions that ended and had to be re-established
+	handedOff  atomic.Bool         // an upgraded process took over the SSH session
+	sessionUp  atomic.Bool         // the SSH session is established
+	failStreak atomic.Int64        // failures since a session was last established
+	direct     directPaths         // verified router mappings
+	history    trafficHistory      // recent throughput per forward
+	extras     *extraSessions      // SSH sessions besides the main one, see sessions.go
+	mirrorsUp  mirrorHealth        // mirrors with their session established, see mirrors.go
+	ha         election            // leader election with other hosts, see ha.go
+	pings      pinger              // results of the pings to the VPS, see ping.go
+	cloudflare *cloudflareTunnel   // nil unless a forward is exposed through Cloudflare
+
+	applyMu sync.Mutex // serializes reloads and discovery updates
+
+	mu            sync.Mutex
+	cfg           *Config                 // configuration in effect
+	base          *Config                 // configuration as loaded, without discovered forwards
+	dynamic       map[string][]TCPForward // discovered forwards by source
+	relays        map[string]*relay
+	cancelSession context.CancelFunc // stops the running SSH session
+	restart       bool               // session was stopped to apply a reload
+	sshPid        int                // PID of the running SSH session
+	sshStderr     *os.File           // its stderr, handed over on upgrade
+}
+
+// config returns the configuration currently in effect.
+func (d *daemon) config() *Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cfg
+}
+
+// relaySnapshot returns a copy of the relay set keyed by forward name.
+func (d *daemon) relaySnapshot() map[string]*relay {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := make(map[string]*relay, len(d.relays))
+	for name, r := range d.relays {
+		m[name] = r
+	}
+	return m
+}
+
+// closeRelays stops every relay.
+func (d *daemon) closeRelays() {
+	for _, r := range d.relaySnapshot() {
+		r.close()
+	}
+}
+
+// restartSession stops the running SSH session so that the reconnect loop
+// immediately starts a new one with the current configuration.
+func (d *daemon) restartSession() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.restart = true
+	if d.cancelSession != nil {
+		d.cancelSession()
+	}
+}
+
+// reconnectAll restarts the main session like restartSession and the extra
+// sessions along with it, for when the network they used is gone.
+func (d *daemon) reconnectAll() {
+	d.restartSession()
+	d.extras.stop()
+	d.syncSessions()
+}
+
+// takeRestart reports whether the last session ended because of
+// restartSession and clears the flag.
+func (d *daemon) takeRestart() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.restart
+	d.restart = false
+	return r
+}
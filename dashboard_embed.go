@@ -0,0 +1,11 @@
+//go:build !nodashboard
+
+package main
+
+import "embed"
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardBuilt reports whether the web dashboard is part of the binary.
+const dashboardBuilt = true
@@ -0,0 +1,11 @@
+//go:build nodashboard
+
+package main
+
+import "embed"
+
+// dashboardFiles is empty: small builds leave out the web dashboard.
+var dashboardFiles embed.FS
+
+// dashboardBuilt reports whether the web dashboard is part of the binary.
+const dashboardBuilt = false
@@ -0,0 +1,660 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tut owns dbusName on the configured bus and exports one object with the
+// state of the tunnel as properties, Connected and Disconnected signals and
+// Reload and Reconnect methods, for tray indicators and other desktop
+// integrations. The wire protocol is implemented here directly; only the
+// few types the interface uses are supported.
+
+const (
+	dbusName      = "io.github.ralphschuler.Tut"
+	dbusPath      = "/io/github/ralphschuler/Tut"
+	dbusInterface = "io.github.ralphschuler.Tut"
+)
+
+// dbusIntrospection describes the exported object.
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="` + dbusInterface + `">
+    <property name="State" type="s" access="read"/>
+    <property name="VPS" type="s" access="read"/>
+    <property name="Reconnects" type="t" access="read"/>
+    <property name="Forwards" type="as" access="read"/>
+    <method name="Reload"/>
+    <method name="Reconnect"/>
+    <signal name="Connected"/>
+    <signal name="Disconnected"/>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get"><arg name="interface" type="s" direction="in"/><arg name="property" type="s" direction="in"/><arg name="value" type="v" direction="out"/></method>
+    <method name="GetAll"><arg name="interface" type="s" direction="in"/><arg name="properties" type="a{sv}" direction="out"/></method>
+    <signal name="PropertiesChanged"><arg name="interface" type="s"/><arg name="changed" type="a{sv}"/><arg name="invalidated" type="as"/></signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="xml" type="s" direction="out"/></method>
+  </interface>
+</node>
+`
+
+// D-Bus message types.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+)
+
+// dbusObjectPath and dbusSignature mark strings of the o and g types,
+// dbusVariant a value of the v type and dbusStruct the fields of a struct.
+type (
+	dbusObjectPath string
+	dbusSignature  string
+	dbusVariant    struct{ v any }
+	dbusStruct     []any
+)
+
+// runDBus serves the D-Bus interface until ctx is done, reconnecting when
+// the bus restarts.
+func runDBus(ctx context.Context, d *daemon) {
+	bus := d.config().DBus.Bus
+	if bus == "" {
+		return
+	}
+	for ctx.Err() == nil {
+		err := serveDBus(ctx, d, bus)
+		if ctx.Err() != nil {
+			return
+		}
+		logEvent(levelWarn, "", "", "D-Bus: %v; retrying in 30s", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// dbusConn is an authenticated connection to a message bus.
+type dbusConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	mu     sync.Mutex // serializes writes and serial numbers
+	serial uint32
+}
+
+// serveDBus connects to bus, takes the name and answers calls until the
+// connection fails or ctx is done.
+func serveDBus(ctx context.Context, d *daemon, bus string) error {
+	c, err := dialDBus(bus)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = c.conn.Close()
+	}()
+
+	// Hello and RequestName are answered in order before anything else
+	// arrives for us, apart from the NameAcquired signal.
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		return err
+	}
+	if _, err := c.reply(); err != nil {
+		return err
+	}
+	// flags 4: do not queue if the name is taken
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "RequestName", "su", dbusName, uint32(4)); err != nil {
+		return err
+	}
+	m, err := c.reply()
+	if err != nil {
+		return err
+	}
+	if code, _ := m.body.uint32(); code != 1 && code != 4 {
+		return fmt.Errorf("the name %s is owned by another process", dbusName)
+	}
+	logf("D-Bus: serving %s on the %s bus", dbusName, bus)
+
+	go c.watchState(ctx, d)
+	for {
+		m, err := c.read()
+		if err != nil {
+			return err
+		}
+		if m.typ == dbusMethodCall {
+			c.handle(d, m)
+		}
+	}
+}
+
+// dialDBus connects to the session or system bus and authenticates with
+// the credentials of the process (SASL EXTERNAL).
+func dialDBus(bus string) (*dbusConn, error) {
+	addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	if bus == "system" {
+		addr = os.Getenv("DBUS_SYSTEM_BUS_ADDRESS")
+		if addr == "" {
+			addr = "unix:path=/run/dbus/system_bus_socket"
+		}
+	}
+	if addr == "" {
+		return nil, errors.New("DBUS_SESSION_BUS_ADDRESS is not set")
+	}
+	var conn net.Conn
+	var err error
+	for _, a := range strings.Split(addr, ";") {
+		var path string
+		for _, kv := range strings.Split(strings.TrimPrefix(a, "unix:"), ",") {
+			switch k, v, _ := strings.Cut(kv, "="); k {
+			case "path":
+				path = v
+			case "abstract":
+				path = "@" + v
+			}
+		}
+		if !strings.HasPrefix(a, "unix:") || path == "" {
+			err = fmt.Errorf("unsupported bus address %q", a)
+			continue
+		}
+		if conn, err = net.DialTimeout("unix", path, 5*time.Second); err == nil {
+			break
+		}
+	}
+	if conn == nil {
+		return nil, err
+	}
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("\x00AUTH EXTERNAL " + uid + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("D-Bus authentication failed: %q %v", strings.TrimSpace(line), err)
+	}
+	if _, err := conn.Write([]byte("BEGIN\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &dbusConn{conn: conn, r: r}, nil
+}
+
+// watchState emits the signals when the SSH session comes up or goes down.
+func (c *dbusConn) watchState(ctx context.Context, d *daemon) {
+	up := d.sessionUp.Load()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := d.sessionUp.Load()
+		if now == up {
+			continue
+		}
+		up = now
+		member := "Disconnected"
+		if up {
+			member = "Connected"
+		}
+		_ = c.signal(dbusPath, dbusInterface, member, "")
+		_ = c.signal(dbusPath, "org.freedesktop.DBus.Properties", "PropertiesChanged", "sa{sv}as", dbusInterface,
+			map[string]any{"State": dbusState(d), "Reconnects": uint64(d.reconnects.Load())}, []string{})
+	}
+}
+
+// dbusState describes the tunnel in one word.
+func dbusState(d *daemon) string {
+	if d.sessionUp.Load() {
+		return "connected"
+	}
+	return "connecting"
+}
+
+// dbusProperties returns the properties of the exported object.
+func dbusProperties(d *daemon) map[string]any {
+	cfg := d.config()
+	var names []string
+	for _, f := range cfg.TCPForwards {
+		names = append(names, f.Name)
+	}
+	for _, u := range cfg.UDPForwards {
+		names = append(names, u.Name)
+	}
+	return map[string]any{
+		"State":      dbusState(d),
+		"VPS":        cfg.VPS.Host,
+		"Reconnects": uint64(d.reconnects.Load()),
+		"Forwards":   names,
+	}
+}
+
+// handle answers a method call. Calls may leave out the interface.
+func (c *dbusConn) handle(d *daemon, m *dbusMessage) {
+	fail := func(name, msg string) {
+		_ = c.send(dbusError, m, "s", map[byte]any{4: name}, msg)
+	}
+	switch m.iface + "." + m.member {
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		_ = c.send(dbusMethodReturn, m, "s", nil, dbusIntrospection)
+	case "org.freedesktop.DBus.Peer.Ping":
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	case "org.freedesktop.DBus.Properties.Get":
+		iface, _ := m.body.string()
+		name, _ := m.body.string()
+		v, ok := dbusProperties(d)[name]
+		if iface != dbusInterface || !ok {
+			fail("org.freedesktop.DBus.Error.UnknownProperty", "no property "+name)
+			return
+		}
+		_ = c.send(dbusMethodReturn, m, "v", nil, dbusVariant{v})
+	case "org.freedesktop.DBus.Properties.GetAll":
+		if iface, _ := m.body.string(); iface != dbusInterface {
+			_ = c.send(dbusMethodReturn, m, "a{sv}", nil, map[string]any{})
+			return
+		}
+		_ = c.send(dbusMethodReturn, m, "a{sv}", nil, dbusProperties(d))
+	case dbusInterface + ".Reload", ".Reload":
+		logEvent(levelInfo, "", "reload-requested", "Reload requested over D-Bus")
+		go d.reload()
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	case dbusInterface + ".Reconnect", ".Reconnect":
+		logEvent(levelInfo, "", "reconnect-requested", "Reconnect requested over D-Bus")
+		d.restartSession()
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	default:
+		fail("org.freedesktop.DBus.Error.UnknownMethod", "unknown method "+m.iface+"."+m.member)
+	}
+}
+
+// call sends a method call; its reply is read with reply.
+func (c *dbusConn) call(dest, path, iface, member, sig string, args ...any) error {
+	return c.write(dbusMethodCall, 0, map[byte]any{
+		1: dbusObjectPath(path), 2: iface, 3: member, 6: dest,
+	}, sig, args...)
+}
+
+// reply reads messages until the reply to the last call arrives.
+func (c *dbusConn) reply() (*dbusMessage, error) {
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch m.typ {
+		case dbusMethodReturn:
+			return m, nil
+		case dbusError:
+			msg, _ := m.body.string()
+			return nil, fmt.Errorf("%s: %s", m.errorName, msg)
+		}
+	}
+}
+
+// signal emits a signal of the object at path.
+func (c *dbusConn) signal(path, iface, member, sig string, args ...any) error {
+	return c.write(dbusSignal, 0, map[byte]any{1: dbusObjectPath(path), 2: iface, 3: member}, sig, args...)
+}
+
+// send answers the call m with a return or an error.
+func (c *dbusConn) send(typ byte, m *dbusMessage, sig string, fields map[byte]any, args ...any) error {
+	if fields == nil {
+		fields = map[byte]any{}
+	}
+	fields[5] = m.serial
+	if m.sender != "" {
+		fields[6] = m.sender
+	}
+	// flag 1: the caller expects no reply
+	if m.flags&1 != 0 {
+		return nil
+	}
+	return c.write(typ, 0, fields, sig, args...)
+}
+
+// write marshals and sends a message with the header fields and body.
+func (c *dbusConn) write(typ, flags byte, fields map[byte]any, sig string, args ...any) error {
+	var body dbusWriter
+	for _, a := range args {
+		body.value(a)
+	}
+	if sig != "" {
+		fields[8] = dbusSignature(sig)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serial++
+	var h dbusWriter
+	h.b = append(h.b, 'l', typ, flags, 1)
+	h.uint32(uint32(len(body.b)))
+	h.uint32(c.serial)
+	codes := make([]int, 0, len(fields))
+	for code := range fields {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	h.array(8, func() {
+		for _, code := range codes {
+			h.align(8)
+			h.b = append(h.b, byte(code))
+			h.variant(fields[byte(code)])
+		}
+	})
+	h.align(8)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(append(h.b, body.b...))
+	return err
+}
+
+// dbusMessage is a received message with the header fields tut needs.
+type dbusMessage struct {
+	typ, flags byte
+	serial     uint32
+	path       string
+	iface      string
+	member     string
+	errorName  string
+	sender     string
+	body       *dbusReader
+}
+
+// read reads the next message from the bus.
+func (c *dbusConn) read() (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if fixed[0] == 'B' {
+		order = binary.BigEndian
+	}
+	bodyLen, fieldsLen := order.Uint32(fixed[4:]), order.Uint32(fixed[12:])
+	headerLen := 16 + int(fieldsLen)
+	total := (headerLen+7)&^7 + int(bodyLen)
+	if total > 1<<24 {
+		return nil, errors.New("D-Bus message too large")
+	}
+	b := make([]byte, total)
+	copy(b, fixed)
+	if _, err := io.ReadFull(c.r, b[16:]); err != nil {
+		return nil, err
+	}
+	m := &dbusMessage{typ: b[1], flags: b[2], serial: order.Uint32(b[8:])}
+	h := &dbusReader{b: b[:headerLen], off: 16, order: order}
+	for h.off < headerLen {
+		h.align(8)
+		if h.off >= headerLen {
+			break
+		}
+		code := h.b[h.off]
+		h.off++
+		sig, _ := h.signature()
+		var s string
+		switch sig {
+		case "s", "o", "g":
+			if sig == "g" {
+				s, _ = h.signature()
+			} else {
+				s, _ = h.string()
+			}
+		case "u":
+			h.uint32()
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected D-Bus header field type %q", sig)
+		}
+		switch code {
+		case 1:
+			m.path = s
+		case 2:
+			m.iface = s
+		case 3:
+			m.member = s
+		case 4:
+			m.errorName = s
+		case 7:
+			m.sender = s
+		}
+	}
+	body := (headerLen + 7) &^ 7
+	m.body = &dbusReader{b: b[body:], order: order}
+	return m, nil
+}
+
+// dbusWriter marshals values in the little-endian wire format.
+type dbusWriter struct {
+	b []byte
+}
+
+func (w *dbusWriter) align(n int) {
+	for len(w.b)%n != 0 {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *dbusWriter) uint32(v uint32) {
+	w.align(4)
+	w.b = binary.LittleEndian.AppendUint32(w.b, v)
+}
+
+func (w *dbusWriter) str(s string) {
+	w.uint32(uint32(len(s)))
+	w.b = append(append(w.b, s...), 0)
+}
+
+// array writes an array whose elements align to elemAlign, with fill
+// writing the elements.
+func (w *dbusWriter) array(elemAlign int, fill func()) {
+	w.align(4)
+	at := len(w.b)
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.align(elemAlign)
+	start := len(w.b)
+	fill()
+	binary.LittleEndian.PutUint32(w.b[at:], uint32(len(w.b)-start))
+}
+
+func (w *dbusWriter) variant(v any) {
+	sig := dbusSignatureOf(v)
+	w.b = append(append(append(w.b, byte(len(sig))), sig...), 0)
+	w.value(v)
+}
+
+// value writes v, one of the types dbusSignatureOf knows.
+func (w *dbusWriter) value(v any) {
+	switch v := v.(type) {
+	case byte:
+		w.b = append(w.b, v)
+	case bool:
+		b := uint32(0)
+		if v {
+			b = 1
+		}
+		w.uint32(b)
+	case int32:
+		w.uint32(uint32(v))
+	case uint32:
+		w.uint32(v)
+	case uint64:
+		w.align(8)
+		w.b = binary.LittleEndian.AppendUint64(w.b, v)
+	case string:
+		w.str(v)
+	case dbusObjectPath:
+		w.str(string(v))
+	case dbusSignature:
+		w.b = append(append(append(w.b, byte(len(v))), v...), 0)
+	case dbusVariant:
+		w.variant(v.v)
+	case dbusStruct:
+		w.align(8)
+		for _, f := range v {
+			w.value(f)
+		}
+	case []int32:
+		w.array(4, func() {
+			for _, i := range v {
+				w.uint32(uint32(i))
+			}
+		})
+	case []string:
+		w.array(4, func() {
+			for _, s := range v {
+				w.str(s)
+			}
+		})
+	case []dbusVariant:
+		w.array(1, func() {
+			for _, e := range v {
+				w.variant(e.v)
+			}
+		})
+	case []dbusStruct:
+		w.array(8, func() {
+			for _, e := range v {
+				w.value(e)
+			}
+		})
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		w.array(8, func() {
+			for _, k := range keys {
+				w.align(8)
+				w.str(k)
+				w.variant(v[k])
+			}
+		})
+	}
+}
+
+// dbusSignatureOf returns the type signature of v.
+func dbusSignatureOf(v any) string {
+	switch v := v.(type) {
+	case byte:
+		return "y"
+	case bool:
+		return "b"
+	case int32:
+		return "i"
+	case uint32:
+		return "u"
+	case uint64:
+		return "t"
+	case string:
+		return "s"
+	case dbusObjectPath:
+		return "o"
+	case dbusSignature:
+		return "g"
+	case dbusVariant:
+		return "v"
+	case dbusStruct:
+		sig := "("
+		for _, f := range v {
+			sig += dbusSignatureOf(f)
+		}
+		return sig + ")"
+	case []int32:
+		return "ai"
+	case []string:
+		return "as"
+	case []dbusVariant:
+		return "av"
+	case map[string]any:
+		return "a{sv}"
+	}
+	panic(fmt.Sprintf("no D-Bus type for %T", v))
+}
+
+// dbusReader unmarshals the values of a header or body.
+type dbusReader struct {
+	b     []byte
+	off   int
+	order binary.ByteOrder
+}
+
+func (r *dbusReader) align(n int) {
+	r.off = (r.off + n - 1) / n * n
+}
+
+func (r *dbusReader) uint32() (uint32, error) {
+	r.align(4)
+	if r.off+4 > len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := r.order.Uint32(r.b[r.off:])
+	r.off += 4
+	return v, nil
+}
+
+func (r *dbusReader) int32() (int32, error) {
+	v, err := r.uint32()
+	return int32(v), err
+}
+
+// int32s reads an array of int32 (ai).
+func (r *dbusReader) int32s() ([]int32, error) {
+	n, err := r.uint32()
+	if err != nil || r.off+int(n) > len(r.b) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var out []int32
+	for end := r.off + int(n); r.off < end; {
+		v, _ := r.int32()
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (r *dbusReader) string() (string, error) {
+	n, err := r.uint32()
+	if err != nil || r.off+int(n)+1 > len(r.b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(r.b[r.off : r.off+int(n)])
+	r.off += int(n) + 1
+	return s, nil
+}
+
+func (r *dbusReader) signature() (string, error) {
+	if r.off >= len(r.b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	n := int(r.b[r.off])
+	if r.off+1+n+1 > len(r.b) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := string(r.b[r.off+1 : r.off+1+n])
+	r.off += n + 2
+	return s, nil
+}
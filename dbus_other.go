@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "context"
+
+// runDBus reports that D-Bus is not supported; it only exists on Linux
+// desktops and servers.
+func runDBus(ctx context.Context, d *daemon) {
+	if d.config().DBus.Bus != "" {
+		logEvent(levelWarn, "", "", "D-Bus is only available on Linux; dbus.bus is ignored")
+	}
+}
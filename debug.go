@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// tut keeps the last log.buffer log entries in memory, debug entries
+// included even when log.level is info, so an intermittent problem can be
+// looked at in detail after it happened instead of by running at debug
+// level until it happens again. "tut debug dump" fetches them from the
+// running daemon through the API (GET /v1/debug/logs, admin, as they show
+// the commands tut runs).
+
+// defaultDumpSince is how far back tut debug dump goes by default.
+const defaultDumpSince = 5 * time.Minute
+
+// runDebugCommand implements "tut debug".
+func runDebugCommand(args []string) int {
+	if len(args) > 0 && args[0] == "udp-sim" {
+		return runUDPSim(args[1:])
+	}
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: tut debug dump [-config path] [-since 5m] | udp-sim [-framing raw|length|both]")
+		return 2
+	}
+	fs := flag.NewFlagSet("debug dump", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	since := Duration(defaultDumpSince)
+	fs.TextVar(&since, "since", since, "Print the log entries of this last period; 0 for all that are kept")
+	outputFlag(fs)
+	_ = fs.Parse(args[1:])
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	var records []logRecord
+	path := "/v1/debug/logs?since=" + url.QueryEscape(since.String())
+	if err := apiRequest(cfg, apiClientToken(cfg.API, true), http.MethodGet, path, &records); err != nil {
+		die("Cannot fetch the log from tut at %s: %v", cfg.API.Listen, err)
+	}
+	if jsonOutput() {
+		printJSON(records)
+		return 0
+	}
+	for _, r := range records {
+		fmt.Println(r.line())
+	}
+	return 0
+}
+
+// apiDebugLogs serves the kept log entries of the period in the since
+// parameter, all of them without it, oldest first.
+func (d *daemon) apiDebugLogs(w http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if s := req.URL.Query().Get("since"); s != "" {
+		var p Duration
+		if err := p.UnmarshalText([]byte(s)); err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p > 0 {
+			since = time.Now().Add(-p.D())
+		}
+	}
+	records := []logRecord{}
+	for _, e := range recentLogEntries(since) {
+		records = append(records, e.record())
+	}
+	writeJSON(w, records)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	directLifetime = time.Hour        // lease requested for router mappings
+	directRenew    = 30 * time.Minute // mappings are renewed this often
+	directRetry    = 10 * time.Minute // wait after a failed discovery or mapping
+)
+
+// portMapper adds and removes port mappings on the local router.
+type portMapper interface {
+	fmt.Stringer
+	externalIP(ctx context.Context) (net.IP, error)
+	// localIP is the address of this host on the router's network.
+	localIP() net.IP
+	// add maps the public port ext to client:port and returns the public
+	// port the router actually granted.
+	add(ctx context.Context, proto string, ext int, client net.IP, port int, lifetime time.Duration, desc string) (int, error)
+	// remove deletes the mapping of public port ext to internal port port.
+	remove(ctx context.Context, proto string, ext, port int) error
+}
+
+// directMapping is the router mapping of one forward.
+type directMapping struct {
+	proto   string // "TCP" or "UDP"
+	host    string // local service
+	port    int
+	ext     int // public port requested, the one used on the VPS
+	granted int // public port the router granted
+	renewAt time.Time
+	ok      bool // mapped and reachable
+}
+
+func (m *directMapping) sameTarget(o directMapping) bool {
+	return m.proto == o.proto && m.host == o.host && m.port == o.port && m.ext == o.ext
+}
+
+// directPaths holds the router's public address and the mappings that were
+// verified to be reachable, by forward name.
+type directPaths struct {
+	mu    sync.Mutex
+	ip    net.IP
+	ports map[string]int
+}
+
+func (p *directPaths) set(ip net.IP, ports map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ip, p.ports = ip, ports
+}
+
+// lookup returns the direct public address of a forward, if it has one.
+func (p *directPaths) lookup(name string) (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	port, ok := p.ports[name]
+	if !ok {
+		return "", 0
+	}
+	return p.ip.String(), port
+}
+
+// runDirect maps the public ports of the forwards on the local router via
+// UPnP or NAT-PMP. Mappings that are reachable from the VPS are advertised
+// as direct paths next to, or instead of, the VPS endpoints. Nothing is
+// advertised when the router itself has no public address (CGNAT).
+func runDirect(ctx context.Context, d *daemon) {
+	dc := d.config().Direct
+	if !dc.Enabled {
+		return
+	}
+	var m portMapper
+	var ext net.IP
+	var retryAt time.Time
+	mapped := map[string]*directMapping{}
+	defer func() {
+		d.direct.set(nil, nil)
+		if m == nil {
+			return
+		}
+		done, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, mp := range mapped {
+			if mp.granted != 0 {
+				_ = m.remove(done, mp.proto, mp.granted, mp.port)
+			}
+		}
+	}()
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		if m == nil && time.Now().After(retryAt) {
+			var err error
+			if m, ext, err = discoverMapper(ctx, dc); err != nil {
+				m = nil
+				retryAt = time.Now().Add(directRetry)
+				if ctx.Err() == nil {
+					logEvent(levelInfo, "", "direct-unavailable", "No direct path, clients use the VPS: %v", err)
+				}
+			} else {
+				logEvent(levelInfo, "", "direct-router", "Mapping ports via %s, public address %s", m, ext)
+			}
+		}
+		if m != nil {
+			d.syncDirect(ctx, m, ext, mapped)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// discoverMapper finds a router speaking the configured protocol and checks
+// that its external address is public.
+func discoverMapper(ctx context.Context, dc DirectConfig) (portMapper, net.IP, error) {
+	m, ip, err := findRouter(ctx, dc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !isPublicIP(ip) {
+		return nil, nil, fmt.Errorf("the router's external address %s is not public (carrier-grade NAT)", ip)
+	}
+	return m, ip, nil
+}
+
+// findRouter finds a router speaking the configured protocol and asks it
+// for its external address.
+func findRouter(ctx context.Context, dc DirectConfig) (portMapper, net.IP, error) {
+	var mappers []func() (portMapper, error)
+	if dc.Protocol == "auto" || dc.Protocol == "upnp" {
+		mappers = append(mappers, func() (portMapper, error) { return discoverUPnP(ctx) })
+	}
+	if dc.Protocol == "auto" || dc.Protocol == "natpmp" {
+		mappers = append(mappers, func() (portMapper, error) { return newNATPMP(dc.Gateway) })
+	}
+	var errs []error
+	for _, discover := range mappers {
+		m, err := discover()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ip, err := m.externalIP(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", m, err))
+			continue
+		}
+		return m, ip, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// isPublicIP reports whether ip is reachable from the internet, i.e. not
+// private, loopback, link-local or in the shared address space of CGNAT.
+func isPublicIP(ip net.IP) bool {
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+	return ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() && !ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() && !cgnat.Contains(ip)
+}
+
+// syncDirect brings the router mappings in line with the forwards: new ones
+// are mapped and verified, changed and removed ones unmapped, and all of
+// them renewed before their lease runs out.
+func (d *daemon) syncDirect(ctx context.Context, m portMapper, ext net.IP, mapped map[string]*directMapping) {
+	cfg := d.config()
+	targets := map[string]directMapping{}
+	for _, f := range cfg.TCPForwards {
+		targets[f.Name] = directMapping{proto: "TCP", host: f.LocalHost, port: f.LocalPort}
+	}
+	for _, u := range cfg.UDPForwards {
+		if u.Protocol == "lan" {
+			continue // local_host is a group, not a host to map to
+		}
+		targets[u.Name] = directMapping{proto: "UDP", host: u.LocalHost, port: u.LocalUDPPort}
+	}
+	seen := map[string]bool{}
+	for _, ep := range d.endpoints() {
+		want, ok := targets[ep.name]
+		if !ok || ep.port == 0 {
+			continue
+		}
+		want.ext = ep.port
+		seen[ep.name] = true
+		old := mapped[ep.name]
+		if old != nil && old.sameTarget(want) && time.Now().Before(old.renewAt) {
+			continue
+		}
+		if old != nil && !old.sameTarget(want) {
+			if old.granted != 0 {
+				_ = m.remove(ctx, old.proto, old.granted, old.port)
+			}
+			old = nil
+		}
+		mp := d.mapDirect(ctx, cfg, m, ext, ep.name, want, old)
+		mapped[ep.name] = &mp
+	}
+	for name, mp := range mapped {
+		if seen[name] {
+			continue
+		}
+		if mp.granted != 0 {
+			_ = m.remove(ctx, mp.proto, mp.granted, mp.port)
+		}
+		delete(mapped, name)
+		logEvent(levelInfo, name, "direct-removed", "Removed router mapping of port %d/%s", mp.granted, mp.proto)
+	}
+	ports := map[string]int{}
+	for name, mp := range mapped {
+		if mp.ok {
+			ports[name] = mp.granted
+		}
+	}
+	d.direct.set(ext, ports)
+}
+
+// mapDirect creates or renews the mapping of one forward. TCP mappings are
+// verified by connecting to them from the VPS; UDP ones cannot be verified
+// without sending datagrams to the service and are trusted.
+func (d *daemon) mapDirect(ctx context.Context, cfg *Config, m portMapper, ext net.IP, name string, want directMapping, old *directMapping) directMapping {
+	want.renewAt = time.Now().Add(directRetry)
+	client, err := mappingClient(want.host, m)
+	if err == nil {
+		want.granted, err = m.add(ctx, want.proto, want.ext, client, want.port, directLifetime, "tut "+name)
+	}
+	if err != nil {
+		if old == nil || old.ok {
+			logEvent(levelWarn, name, "direct-failed", "Router mapping of port %d/%s failed: %v", want.ext, want.proto, err)
+		}
+		return want
+	}
+	want.renewAt = time.Now().Add(directRenew)
+	if old != nil && old.ok && old.granted == want.granted {
+		want.ok = true
+		return want
+	}
+	if want.proto == "TCP" {
+		if !d.sessionUp.Load() {
+			// verify through the VPS once the tunnel is up
+			want.renewAt = time.Time{}
+			return want
+		}
+		timeout := cfg.Health.ProbeTimeout.D()
+		if err := probeDirect(ctx, cfg, ext.String(), want.granted, timeout); err != nil {
+			logEvent(levelInfo, name, "direct-unreachable", "%s:%d is mapped but not reachable from the VPS (%v); clients use the VPS", ext, want.granted, err)
+			want.renewAt = time.Now().Add(directRetry)
+			return want
+		}
+	}
+	want.ok = true
+	logEvent(levelInfo, name, "direct-ok", "Direct path %s:%d/%s is reachable", ext, want.granted, want.proto)
+	return want
+}
+
+// mappingClient returns the LAN address the router forwards to for host.
+// Services on this host (loopback or wildcard addresses) are reached through
+// its address on the router's network, so they must listen on it.
+func mappingClient(host string, m portMapper) (net.IP, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return m.localIP(), nil
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv4 address", host)
+}
+
+// probeDirect checks from the VPS that host:port accepts TCP connections.
+func probeDirect(ctx context.Context, cfg *Config, host string, port int, timeout time.Duration) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	return remoteCommand(ctx, cfg, timeout, fmt.Sprintf("socat -u /dev/null TCP:%s,connect-timeout=%d", addr, int(timeout.Seconds())))
+}
+
+// public returns the address clients should use for the endpoint.
+func (ep endpoint) public() (string, int) {
+	if ep.preferDirect && ep.directPort != 0 {
+		return ep.directHost, ep.directPort
+	}
+	return ep.host, ep.port
+}
+
+// validateDirect checks the direct path settings.
+func validateDirect(c *Config) error {
+	dc := c.Direct
+	switch dc.Protocol {
+	case "auto", "upnp", "natpmp":
+	default:
+		return fmt.Errorf("invalid direct.protocol %q (use auto, upnp or natpmp)", dc.Protocol)
+	}
+	if dc.Gateway != "" && net.ParseIP(dc.Gateway).To4() == nil {
+		return fmt.Errorf("invalid direct.gateway %q: need an IPv4 address", dc.Gateway)
+	}
+	if dc.Hostname != "" && c.DNS.Provider == "" {
+		return errors.New("direct.hostname needs a dns.provider")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// natPMP maps ports with NAT-PMP (RFC 6886). Mappings always point at the
+// host sending the request.
+type natPMP struct {
+	gateway net.IP
+	local   net.IP
+}
+
+// newNATPMP talks to gateway, or to the default gateway when it is empty.
+func newNATPMP(gateway string) (*natPMP, error) {
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		var err error
+		if gw, err = defaultGateway(); err != nil {
+			return nil, fmt.Errorf("NAT-PMP: %w", err)
+		}
+	}
+	// connecting a UDP socket sends nothing but tells the local address
+	c, err := net.Dial("udp4", net.JoinHostPort(gw.String(), "5351"))
+	if err != nil {
+		return nil, fmt.Errorf("NAT-PMP: %w", err)
+	}
+	defer c.Close()
+	return &natPMP{gateway: gw, local: c.LocalAddr().(*net.UDPAddr).IP}, nil
+}
+
+func (n *natPMP) String() string {
+	return "NAT-PMP gateway " + n.gateway.String()
+}
+
+func (n *natPMP) localIP() net.IP {
+	return n.local
+}
+
+// request sends req and waits for the matching response, retransmitting
+// with doubling timeouts as the RFC asks, though fewer times.
+func (n *natPMP) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	c, err := net.Dial("udp4", net.JoinHostPort(n.gateway.String(), "5351"))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	resp := make([]byte, 16)
+	wait := 250 * time.Millisecond
+	for try := 0; try < 4 && ctx.Err() == nil; try++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		_ = c.SetReadDeadline(time.Now().Add(wait))
+		wait *= 2
+		for {
+			k, err := c.Read(resp)
+			if err != nil {
+				break
+			}
+			if k < size || resp[0] != 0 || resp[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(resp[2:4]); code != 0 {
+				return nil, fmt.Errorf("NAT-PMP result code %d", code)
+			}
+			return resp[:size], nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("no NAT-PMP response")
+}
+
+func (n *natPMP) externalIP(ctx context.Context) (net.IP, error) {
+	resp, err := n.request(ctx, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), resp[8:12]...)), nil
+}
+
+func (n *natPMP) add(ctx context.Context, proto string, ext int, client net.IP, port int, lifetime time.Duration, _ string) (int, error) {
+	if !client.Equal(n.local) {
+		return 0, fmt.Errorf("NAT-PMP can only map ports to this host (%s), not %s", n.local, client)
+	}
+	return n.mapPort(ctx, proto, port, ext, lifetime)
+}
+
+// remove deletes a mapping by requesting a lifetime of zero for its
+// internal port, which is how NAT-PMP identifies mappings.
+func (n *natPMP) remove(ctx context.Context, proto string, _, port int) error {
+	_, err := n.mapPort(ctx, proto, port, 0, 0)
+	return err
+}
+
+func (n *natPMP) mapPort(ctx context.Context, proto string, internal, ext int, lifetime time.Duration) (int, error) {
+	req := make([]byte, 12)
+	req[1] = 1 // UDP
+	if proto == "TCP" {
+		req[1] = 2
+	}
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(ext))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime.Seconds()))
+	resp, err := n.request(ctx, req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upnpIGD maps ports through the WANIPConnection or WANPPPConnection service
+// of a UPnP Internet Gateway Device, which can map to any host on the LAN.
+type upnpIGD struct {
+	control string // SOAP control URL
+	service string // service type
+	local   net.IP
+}
+
+// discoverUPnP finds an Internet Gateway Device with SSDP.
+func discoverUPnP(ctx context.Context) (*upnpIGD, error) {
+	c, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %w", err)
+	}
+	defer c.Close()
+	ssdp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	for _, st := range []string{"urn:schemas-upnp-org:device:InternetGatewayDevice:1", "urn:schemas-upnp-org:device:InternetGatewayDevice:2"} {
+		search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\nST: " + st + "\r\n\r\n"
+		if _, err := c.WriteTo([]byte(search), ssdp); err != nil {
+			return nil, fmt.Errorf("UPnP: %w", err)
+		}
+	}
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	var errs []error
+	for ctx.Err() == nil {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		resp, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(buf[:n]))).ReadMIMEHeader()
+		if err != nil {
+			continue
+		}
+		location := resp.Get("Location")
+		if location == "" {
+			continue
+		}
+		igd, err := newUPnPIGD(ctx, location, from.(*net.UDPAddr).IP)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return igd, nil
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, errors.New("UPnP: no Internet Gateway Device answered")
+}
+
+// upnpDevice is a device in a UPnP device description.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the first WAN connection service of the device tree.
+func (dev upnpDevice) find() (service, control string) {
+	for _, s := range dev.Services {
+		if strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+			return s.ServiceType, s.ControlURL
+		}
+	}
+	for _, child := range dev.Devices {
+		if service, control = child.find(); service != "" {
+			return service, control
+		}
+	}
+	return "", ""
+}
+
+// newUPnPIGD reads the device description at location.
+func newUPnPIGD(ctx context.Context, location string, router net.IP) (*upnpIGD, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %w", err)
+	}
+	defer resp.Body.Close()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("UPnP %s: %w", location, err)
+	}
+	service, control := desc.Device.find()
+	if service == "" {
+		return nil, fmt.Errorf("UPnP %s: no WAN connection service", location)
+	}
+	base, err := url.Parse(location)
+	if desc.URLBase != "" {
+		base, err = url.Parse(desc.URLBase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.Dial("udp4", net.JoinHostPort(router.String(), "1900"))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return &upnpIGD{control: base.ResolveReference(ref).String(), service: service, local: c.LocalAddr().(*net.UDPAddr).IP}, nil
+}
+
+func (u *upnpIGD) String() string {
+	return "UPnP " + u.control
+}
+
+func (u *upnpIGD) localIP() net.IP {
+	return u.local
+}
+
+// call invokes a SOAP action with args (name, value pairs in order) and
+// decodes the response body into out.
+func (u *upnpIGD) call(ctx context.Context, action string, args []string, out any) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		_ = xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.control, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+u.service+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Code != 0 {
+			return &upnpError{code: fault.Code, desc: fault.Description}
+		}
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	if out != nil {
+		return xml.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// upnpError is an error reported by the gateway.
+type upnpError struct {
+	code int
+	desc string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.desc)
+}
+
+func (u *upnpIGD) externalIP(ctx context.Context) (net.IP, error) {
+	var resp struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := u.call(ctx, "GetExternalIPAddress", nil, &resp); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(resp.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external address %q", resp.IP)
+	}
+	return ip, nil
+}
+
+func (u *upnpIGD) add(ctx context.Context, proto string, ext int, client net.IP, port int, lifetime time.Duration, desc string) (int, error) {
+	args := func(lease time.Duration) []string {
+		return []string{
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(ext),
+			"NewProtocol", proto,
+			"NewInternalPort", strconv.Itoa(port),
+			"NewInternalClient", client.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", desc,
+			"NewLeaseDuration", strconv.Itoa(int(lease.Seconds())),
+		}
+	}
+	err := u.call(ctx, "AddPortMapping", args(lifetime), nil)
+	var uerr *upnpError
+	if errors.As(err, &uerr) && uerr.code == 725 {
+		// OnlyPermanentLeasesSupported: removed again when tut stops
+		err = u.call(ctx, "AddPortMapping", args(0), nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return ext, nil
+}
+
+func (u *upnpIGD) remove(ctx context.Context, proto string, ext, _ int) error {
+	return u.call(ctx, "DeletePortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(ext),
+		"NewProtocol", proto,
+	}, nil)
+}
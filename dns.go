@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsRecord is a record set to publish. Values are in presentation format,
+// e.g. "203.0.113.7" or "0 5 25565 vps.example.com" for SRV.
+type dnsRecord struct {
+	name   string
+	typ    string
+	ttl    int
+	values []string
+	// proxied sends the traffic through Cloudflare's proxy, for the
+	// records pointing at Cloudflare Tunnel
+	proxied bool
+}
+
+func (rr dnsRecord) String() string {
+	return fmt.Sprintf("%s %s %s", rr.name, rr.typ, strings.Join(rr.values, ", "))
+}
+
+// dnsProvider replaces a record set at a DNS provider.
+type dnsProvider interface {
+	upsert(ctx context.Context, rr dnsRecord) error
+}
+
+// newDNSProvider returns the provider selected in the config.
+func newDNSProvider(c DNSConfig) (dnsProvider, error) {
+	switch c.Provider {
+	case "cloudflare":
+		return &cloudflareDNS{token: c.Cloudflare.APIToken, zone: c.Cloudflare.ZoneID}, nil
+	case "route53":
+		return newRoute53DNS(c)
+	case "rfc2136":
+		return newRFC2136DNS(c)
+	}
+	return nil, fmt.Errorf("unknown dns.provider %q", c.Provider)
+}
+
+// validateDNS checks the DNS settings.
+func validateDNS(c *Config) error {
+	dc := c.DNS
+	srv := false
+	for _, f := range c.TCPForwards {
+		if f.DNSSRV != "" && f.MinecraftSRV != "" {
+			return fmt.Errorf("tcp forward %s: set either dns_srv or minecraft_srv", f.Name)
+		}
+		srv = srv || f.srvName() != ""
+	}
+	for _, u := range c.UDPForwards {
+		srv = srv || u.DNSSRV != ""
+	}
+	if dc.Provider == "" {
+		if dc.Hostname != "" || srv {
+			return errors.New("dns.hostname, dns_srv and minecraft_srv need a dns.provider")
+		}
+		return nil
+	}
+	switch dc.Provider {
+	case "cloudflare":
+		if dc.Cloudflare.APIToken == "" || dc.Cloudflare.ZoneID == "" {
+			return errors.New("dns.cloudflare needs api_token and zone_id")
+		}
+	case "route53":
+		if dc.Route53.HostedZoneID == "" {
+			return errors.New("dns.route53 needs hosted_zone_id")
+		}
+	case "rfc2136":
+		if dc.RFC2136.Server == "" || dc.RFC2136.Zone == "" {
+			return errors.New("dns.rfc2136 needs server and zone")
+		}
+	default:
+		return fmt.Errorf("unknown dns.provider %q (use cloudflare, route53 or rfc2136)", dc.Provider)
+	}
+	if srv && dc.Hostname == "" && net.ParseIP(c.VPS.Host) != nil {
+		return errors.New("SRV records must point at a name: set dns.hostname when vps.host is an IP address")
+	}
+	return nil
+}
+
+// runDNS publishes the records for the VPS and the forwards whenever the
+// tunnel is (re)established and again when a public port changes.
+func runDNS(ctx context.Context, d *daemon) {
+	dc := d.config().DNS
+	if dc.Provider == "" {
+		return
+	}
+	p, err := newDNSProvider(dc)
+	if err != nil {
+		logEvent(levelError, "", "dns-failed", "DNS updates disabled: %v", err)
+		return
+	}
+	published := map[string]string{}
+	wasUp := false
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		cfg := d.config()
+		hosts := d.healthyHosts(cfg)
+		up := len(hosts) > 0
+		if up && !wasUp {
+			// the tunnel was (re)established: publish everything again
+			published = map[string]string{}
+		}
+		if up {
+			for _, rr := range desiredRecords(cfg, hosts, d.endpoints()) {
+				key, val := rr.typ+" "+rr.name, strings.Join(rr.values, ",")
+				if published[key] == val {
+					continue
+				}
+				if err := p.upsert(ctx, rr); err != nil {
+					logEvent(levelWarn, "", "dns-failed", "Updating %s failed: %v", rr, err)
+					continue
+				}
+				published[key] = val
+				logEvent(levelInfo, "", "dns-updated", "Published %s", rr)
+			}
+		}
+		wasUp = up
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// srvName is the SRV record published for the forward, if any.
+func (f TCPForward) srvName() string {
+	if f.MinecraftSRV != "" {
+		return "_minecraft._tcp." + strings.TrimSuffix(f.MinecraftSRV, ".")
+	}
+	return f.DNSSRV
+}
+
+// desiredRecords lists the records that should exist: A/AAAA records of
+// dns.hostname for the VPSes among hosts (vps and the healthy mirrors),
+// an A record of direct.hostname for the router
+// while a direct path works, and an SRV record per forward with dns_srv or
+// minecraft_srv.
+func desiredRecords(cfg *Config, hosts []string, eps []endpoint) []dnsRecord {
+	dc := cfg.DNS
+	var out []dnsRecord
+	if dc.Hostname != "" {
+		var ips []net.IP
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				ips = append(ips, ip)
+				continue
+			}
+			found, err := net.LookupIP(host)
+			if err != nil {
+				logEvent(levelWarn, "", "dns-failed", "Cannot resolve %s: %v", host, err)
+			}
+			ips = append(ips, found...)
+		}
+		var v4, v6 []string
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				v4 = append(v4, ip.String())
+			} else {
+				v6 = append(v6, ip.String())
+			}
+		}
+		if len(v4) > 0 {
+			out = append(out, dnsRecord{name: dc.Hostname, typ: "A", ttl: dc.TTL.Seconds(), values: v4})
+		}
+		if len(v6) > 0 {
+			out = append(out, dnsRecord{name: dc.Hostname, typ: "AAAA", ttl: dc.TTL.Seconds(), values: v6})
+		}
+	}
+	target := dc.Hostname
+	if target == "" {
+		target = cfg.VPS.Host
+	}
+	srv := map[string]string{}
+	for _, f := range cfg.TCPForwards {
+		srv[f.Name] = f.srvName()
+	}
+	for _, u := range cfg.UDPForwards {
+		srv[u.Name] = u.DNSSRV
+	}
+	direct := strings.TrimSuffix(cfg.Direct.Hostname, ".")
+	directIP := ""
+	for _, ep := range eps {
+		if ep.directPort != 0 {
+			directIP = ep.directHost
+		}
+		if srv[ep.name] == "" || ep.port == 0 {
+			continue
+		}
+		// a direct path is tried first; the VPS stays as fallback unless
+		// direct.prefer is set
+		var values []string
+		if ep.directPort != 0 && direct != "" {
+			values = append(values, "0 5 "+strconv.Itoa(ep.directPort)+" "+direct)
+		}
+		if len(values) == 0 || !ep.preferDirect {
+			values = append(values, strconv.Itoa(10*len(values))+" 5 "+strconv.Itoa(ep.port)+" "+strings.TrimSuffix(target, "."))
+		}
+		out = append(out, dnsRecord{name: srv[ep.name], typ: "SRV", ttl: dc.TTL.Seconds(), values: values})
+	}
+	if direct != "" && directIP != "" {
+		out = append(out, dnsRecord{name: direct, typ: "A", ttl: dc.TTL.Seconds(), values: []string{directIP}})
+	}
+	return out
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// cloudflareAPI is the Cloudflare v4 API endpoint.
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareDNS updates records through the Cloudflare API with a token
+// allowed to edit DNS in the zone.
+type cloudflareDNS struct {
+	token string
+	zone  string
+}
+
+// cloudflareRecord is a DNS record as the Cloudflare API represents it.
+type cloudflareRecord struct {
+	ID      string         `json:"id,omitempty"`
+	Type    string         `json:"type"`
+	Name    string         `json:"name"`
+	Content string         `json:"content,omitempty"`
+	Data    map[string]any `json:"data,omitempty"`
+	TTL     int            `json:"ttl"`
+	Proxied bool           `json:"proxied,omitempty"`
+}
+
+func (c *cloudflareDNS) header() http.Header {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer "+c.token)
+	return h
+}
+
+// upsert updates the existing records of the set in place, creates missing
+// ones and deletes the surplus.
+func (c *cloudflareDNS) upsert(ctx context.Context, rr dnsRecord) error {
+	base := cloudflareAPI + "/zones/" + c.zone + "/dns_records"
+	var list struct {
+		Result []cloudflareRecord `json:"result"`
+	}
+	q := url.Values{"type": {rr.typ}, "name": {rr.name}}
+	if err := registryRequest(ctx, http.MethodGet, base+"?"+q.Encode(), c.header(), nil, &list); err != nil {
+		return err
+	}
+	for i, v := range rr.values {
+		rec, err := cloudflareRecordFor(rr, v)
+		if err != nil {
+			return err
+		}
+		if i < len(list.Result) {
+			err = registryRequest(ctx, http.MethodPut, base+"/"+list.Result[i].ID, c.header(), rec, nil)
+		} else {
+			err = registryRequest(ctx, http.MethodPost, base, c.header(), rec, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, old := range list.Result[min(len(rr.values), len(list.Result)):] {
+		if err := registryRequest(ctx, http.MethodDelete, base+"/"+old.ID, c.header(), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudflareRecordFor converts one value; SRV records are structured.
+func cloudflareRecordFor(rr dnsRecord, value string) (cloudflareRecord, error) {
+	rec := cloudflareRecord{Type: rr.typ, Name: rr.name, TTL: rr.ttl, Proxied: rr.proxied}
+	if rr.typ != "SRV" {
+		rec.Content = value
+		return rec, nil
+	}
+	f := strings.Fields(value)
+	if len(f) != 4 {
+		return rec, fmt.Errorf("invalid SRV value %q", value)
+	}
+	nums := make([]int, 3)
+	for i := range nums {
+		n, err := strconv.Atoi(f[i])
+		if err != nil {
+			return rec, fmt.Errorf("invalid SRV value %q", value)
+		}
+		nums[i] = n
+	}
+	rec.Data = map[string]any{"priority": nums[0], "weight": nums[1], "port": nums[2], "target": f[3]}
+	return rec, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNS wire format constants used by dynamic updates.
+const (
+	dnsOpcodeUpdate = 5
+	dnsClassIN      = 1
+	dnsClassANY     = 255
+	dnsTypeSOA      = 6
+	dnsTypeTSIG     = 250
+)
+
+var dnsTypes = map[string]uint16{"A": 1, "AAAA": 28, "SRV": 33}
+
+// tsigAlgorithms maps the supported TSIG algorithms to their hashes.
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// rfc2136DNS sends DNS UPDATE messages (RFC 2136), signed with TSIG when a
+// key is configured, to the primary server of the zone.
+type rfc2136DNS struct {
+	server  string
+	zone    string
+	keyName string
+	alg     string
+	secret  []byte
+}
+
+func newRFC2136DNS(c DNSConfig) (*rfc2136DNS, error) {
+	r := &rfc2136DNS{server: c.RFC2136.Server, zone: c.RFC2136.Zone, keyName: c.RFC2136.KeyName, alg: c.RFC2136.KeyAlgorithm}
+	if _, _, err := net.SplitHostPort(r.server); err != nil {
+		r.server = net.JoinHostPort(r.server, "53")
+	}
+	if r.alg == "" {
+		r.alg = "hmac-sha256"
+	}
+	if _, ok := tsigAlgorithms[r.alg]; !ok {
+		return nil, fmt.Errorf("rfc2136: unsupported key_algorithm %q", r.alg)
+	}
+	if r.keyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(c.RFC2136.KeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2136: key_secret is not base64: %w", err)
+		}
+		r.secret = secret
+	}
+	return r, nil
+}
+
+// upsert replaces the record set: delete the RRset, then add every value.
+func (r *rfc2136DNS) upsert(ctx context.Context, rr dnsRecord) error {
+	typ, ok := dnsTypes[rr.typ]
+	if !ok {
+		return fmt.Errorf("rfc2136: unsupported record type %s", rr.typ)
+	}
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	msg := append([]byte{}, id[:]...)
+	msg = append(msg, dnsOpcodeUpdate<<3, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 1)                        // ZOCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0)                        // PRCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, uint16(1+len(rr.values))) // UPCOUNT
+	msg = binary.BigEndian.AppendUint16(msg, 0)                        // ADCOUNT
+
+	msg = appendName(msg, r.zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	msg = appendRR(msg, rr.name, typ, dnsClassANY, 0, nil) // delete the RRset
+	for _, v := range rr.values {
+		rdata, err := encodeRdata(rr.typ, v)
+		if err != nil {
+			return err
+		}
+		msg = appendRR(msg, rr.name, typ, dnsClassIN, uint32(rr.ttl), rdata)
+	}
+	if r.keyName != "" {
+		msg = r.sign(msg, time.Now())
+	}
+	return r.exchange(ctx, msg)
+}
+
+// sign appends a TSIG record (RFC 8945) to msg.
+func (r *rfc2136DNS) sign(msg []byte, now time.Time) []byte {
+	alg := r.alg + "."
+	timeSigned := uint64(now.Unix())
+	var vars []byte
+	vars = appendName(vars, strings.ToLower(r.keyName))
+	vars = binary.BigEndian.AppendUint16(vars, dnsClassANY)
+	vars = binary.BigEndian.AppendUint32(vars, 0)
+	vars = appendName(vars, alg)
+	vars = append(vars, byte(timeSigned>>40), byte(timeSigned>>32), byte(timeSigned>>24), byte(timeSigned>>16), byte(timeSigned>>8), byte(timeSigned))
+	vars = binary.BigEndian.AppendUint16(vars, 300) // fudge
+	vars = binary.BigEndian.AppendUint16(vars, 0)   // error
+	vars = binary.BigEndian.AppendUint16(vars, 0)   // other len
+
+	m := hmac.New(tsigAlgorithms[r.alg], r.secret)
+	m.Write(msg)
+	m.Write(vars)
+	mac := m.Sum(nil)
+
+	var rdata []byte
+	rdata = appendName(rdata, alg)
+	rdata = append(rdata, byte(timeSigned>>40), byte(timeSigned>>32), byte(timeSigned>>24), byte(timeSigned>>16), byte(timeSigned>>8), byte(timeSigned))
+	rdata = binary.BigEndian.AppendUint16(rdata, 300)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = append(rdata, msg[0], msg[1]) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	msg = appendRR(msg, r.keyName, dnsTypeTSIG, dnsClassANY, 0, rdata)
+	binary.BigEndian.PutUint16(msg[10:], 1) // ADCOUNT
+	return msg
+}
+
+// exchange sends msg over TCP and checks the response code.
+func (r *rfc2136DNS) exchange(ctx context.Context, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if len(resp) < 12 || resp[0] != msg[0] || resp[1] != msg[1] {
+		return errors.New("rfc2136: malformed response")
+	}
+	if rcode := resp[3] & 0x0f; rcode != 0 {
+		return fmt.Errorf("rfc2136: server refused update (rcode %d)", rcode)
+	}
+	return nil
+}
+
+// appendName appends a domain name in uncompressed wire format.
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendRR(b []byte, name string, typ, class uint16, ttl uint32, rdata []byte) []byte {
+	b = appendName(b, name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// encodeRdata converts a presentation format value to wire format.
+func encodeRdata(typ, value string) ([]byte, error) {
+	switch typ {
+	case "A", "AAAA":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		if typ == "A" {
+			return ip.To4(), nil
+		}
+		return ip.To16(), nil
+	case "SRV":
+		f := strings.Fields(value)
+		if len(f) != 4 {
+			return nil, fmt.Errorf("invalid SRV value %q", value)
+		}
+		var b []byte
+		for _, s := range f[:3] {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SRV value %q", value)
+			}
+			b = binary.BigEndian.AppendUint16(b, uint16(n))
+		}
+		return appendName(b, f[3]), nil
+	}
+	return nil, fmt.Errorf("unsupported record type %s", typ)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTSIGSign(t *testing.T) {
+	var c DNSConfig
+	c.RFC2136.Server = "127.0.0.1"
+	c.RFC2136.KeyName = "tut-key.example.com"
+	c.RFC2136.KeySecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM=" // secret-key-for-tests
+	r, err := newRFC2136DNS(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.server != "127.0.0.1:53" || r.alg != "hmac-sha256" {
+		t.Fatalf("server %q, algorithm %q", r.server, r.alg)
+	}
+	msg, _ := hex.DecodeString("123428000001000000000000076578616d706c6503636f6d0000060001")
+	signed := r.sign(msg, time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC))
+
+	// computed independently from RFC 8945
+	want := "123428000001000000000001076578616d706c6503636f6d0000060001" +
+		"077475742d6b6579076578616d706c6503636f6d0000fa00ff00000000003d" +
+		"0b686d61632d7368613235360000006ad36340012c0020" +
+		"9636c09b702d24ed3a394dfe7ce4fe32a15dfbd8007819a1d440ef01a99c31f9" +
+		"123400000000"
+	if got := hex.EncodeToString(signed); got != want {
+		t.Errorf("signed message\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestRFC2136Config(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		server      string
+		alg, secret string
+		wantServer  string
+		wantErr     bool
+	}{
+		{"port kept", "ns1.example.com:5353", "", "", "ns1.example.com:5353", false},
+		{"unsupported algorithm", "ns1.example.com", "hmac-md5", "", "", true},
+		{"secret not base64", "ns1.example.com", "", "not base64!", "", true},
+	} {
+		var c DNSConfig
+		c.RFC2136.Server, c.RFC2136.KeyAlgorithm = tc.server, tc.alg
+		if tc.secret != "" {
+			c.RFC2136.KeyName, c.RFC2136.KeySecret = "key", tc.secret
+		}
+		r, err := newRFC2136DNS(c)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if err == nil && r.server != tc.wantServer {
+			t.Errorf("%s: server = %q, want %q", tc.name, r.server, tc.wantServer)
+		}
+	}
+}
+
+func TestEncodeRdata(t *testing.T) {
+	for _, tc := range []struct {
+		typ, value string
+		want       string // hex, "" for an error
+	}{
+		{"A", "192.0.2.1", "c0000201"},
+		{"AAAA", "2001:db8::1", "20010db8000000000000000000000001"},
+		{"SRV", "0 5 25565 mc.example.com.", "0000000563dd026d63076578616d706c6503636f6d00"},
+		{"A", "not an address", ""},
+		{"SRV", "0 5 mc.example.com.", ""},
+		{"SRV", "0 5 70000 mc.example.com.", ""},
+		{"TXT", "hello", ""},
+	} {
+		got, err := encodeRdata(tc.typ, tc.value)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("encodeRdata(%s, %q) = %x, want an error", tc.typ, tc.value, got)
+			}
+			continue
+		}
+		if err != nil || hex.EncodeToString(got) != tc.want {
+			t.Errorf("encodeRdata(%s, %q) = %x, %v; want %s", tc.typ, tc.value, got, err, tc.want)
+		}
+	}
+}
+
+// TestRFC2136Upsert sends an update to a server that checks the TSIG and
+// answers with the rcode it was given.
+func TestRFC2136Upsert(t *testing.T) {
+	secret := []byte("secret-key-for-tests")
+	for _, tc := range []struct {
+		name    string
+		rcode   byte
+		wantErr bool
+	}{
+		{"accepted", 0, false},
+		{"refused", 5, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			got := make(chan []byte, 1)
+			go func() {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				var size [2]byte
+				if _, err := io.ReadFull(c, size[:]); err != nil {
+					return
+				}
+				msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+				if _, err := io.ReadFull(c, msg); err != nil {
+					return
+				}
+				got <- msg
+				resp := append([]byte{msg[0], msg[1], 0xA8, tc.rcode}, make([]byte, 8)...)
+				_, _ = c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+
+			var c DNSConfig
+			c.RFC2136.Server = ln.Addr().String()
+			c.RFC2136.Zone = "example.com"
+			c.RFC2136.KeyName = "tut-key.example.com"
+			c.RFC2136.KeySecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+			r, err := newRFC2136DNS(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.upsert(context.Background(), dnsRecord{name: "home.example.com", typ: "A", ttl: 60, values: []string{"192.0.2.1", "192.0.2.2"}})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("upsert: %v", err)
+			}
+			msg := <-got
+			if upd := binary.BigEndian.Uint16(msg[8:]); upd != 3 {
+				t.Errorf("UPCOUNT = %d, want a delete and two adds", upd)
+			}
+			if ad := binary.BigEndian.Uint16(msg[10:]); ad != 1 {
+				t.Fatalf("ADCOUNT = %d, want the TSIG record", ad)
+			}
+			// the MAC is the 32 bytes before the original ID and the two
+			// empty fields at the end; it covers the message before TSIG
+			tsig := appendName(nil, "tut-key.example.com")
+			at := bytes.LastIndex(msg, tsig)
+			if at < 0 {
+				t.Fatal("no TSIG record")
+			}
+			unsigned := append([]byte(nil), msg[:at]...)
+			binary.BigEndian.PutUint16(unsigned[10:], 0)
+			mac := msg[len(msg)-6-sha256.Size : len(msg)-6]
+			rdata := msg[at+len(tsig)+10:]
+			alg := appendName(nil, "hmac-sha256.")
+			vars := append(append(append(appendName(nil, "tut-key.example.com"), 0, 255, 0, 0, 0, 0), alg...), rdata[len(alg):len(alg)+8]...)
+			vars = append(vars, 0, 0, 0, 0)
+			m := hmac.New(sha256.New, secret)
+			m.Write(unsigned)
+			m.Write(vars)
+			if !hmac.Equal(m.Sum(nil), mac) {
+				t.Error("TSIG MAC does not verify")
+			}
+		})
+	}
+}
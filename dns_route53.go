@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// route53API is the global Route 53 endpoint; requests are signed for us-east-1.
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+// route53DNS upserts record sets through the Route 53 REST API, signing
+// requests with AWS Signature Version 4.
+type route53DNS struct {
+	zone         string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// newRoute53DNS takes the credentials from the config or, when not set
+// there, from the standard AWS_* environment variables.
+func newRoute53DNS(c DNSConfig) (*route53DNS, error) {
+	r := &route53DNS{
+		zone:         strings.TrimPrefix(c.Route53.HostedZoneID, "/hostedzone/"),
+		accessKey:    c.Route53.AccessKeyID,
+		secretKey:    c.Route53.SecretAccessKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if r.accessKey == "" {
+		r.accessKey, r.secretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if r.accessKey == "" || r.secretKey == "" {
+		return nil, errors.New("route53: no AWS credentials configured")
+	}
+	return r, nil
+}
+
+// route53Change is a ChangeResourceRecordSets request with a single UPSERT.
+type route53Change struct {
+	XMLName xml.Name       `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string         `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string         `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string         `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int            `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Records []route53Value `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord"`
+}
+
+type route53Value struct {
+	Value string `xml:"Value"`
+}
+
+func (r *route53DNS) upsert(ctx context.Context, rr dnsRecord) error {
+	change := route53Change{Action: "UPSERT", Name: rr.name, Type: rr.typ, TTL: rr.ttl}
+	for _, v := range rr.values {
+		change.Records = append(change.Records, route53Value{v})
+	}
+	body, err := xml.Marshal(change)
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route53API+"/hostedzone/"+r.zone+"/rrset", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if r.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", r.sessionToken)
+	}
+	signV4(req, body, r.accessKey, r.secretKey, "us-east-1", "route53", time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("route53: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req.
+func signV4(req *http.Request, body []byte, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": payload, "x-amz-date": amzDate}
+	if t := req.Header.Get("X-Amz-Security-Token"); t != "" {
+		names = append(names, "x-amz-security-token")
+		values["x-amz-security-token"] = t
+	}
+	var headers strings.Builder
+	for _, n := range names {
+		headers.WriteString(n + ":" + values[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, payload}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signed, sig))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
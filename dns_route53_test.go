@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignV4(t *testing.T) {
+	body := []byte("<ChangeResourceRecordSetsRequest/>")
+	req, err := http.NewRequest("POST", "https://route53.amazonaws.com/2013-04-01/hostedzone/Z123/rrset", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	signV4(req, body, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "route53", now)
+
+	if got := req.Header.Get("X-Amz-Date"); got != "20261017T120000Z" {
+		t.Errorf("X-Amz-Date = %q", got)
+	}
+	auth := req.Header.Get("Authorization")
+	for _, want := range []string{
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20261017/us-east-1/route53/aws4_request",
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date",
+		"Signature=a70ad0f4ad15285e180bc400d1c0f55417e63ce4a035133ad90b003ce39edd6a",
+	} {
+		if !strings.Contains(auth, want) {
+			t.Errorf("Authorization = %q, want it to contain %q", auth, want)
+		}
+	}
+
+	// a session token is signed too
+	req.Header.Set("X-Amz-Security-Token", "token")
+	signV4(req, body, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "route53", now)
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token") {
+		t.Errorf("Authorization = %q, want the token signed", auth)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP forwards with protocol: dns expose a local DNS resolver. socat pipes
+// the datagrams of all clients through one stream, so concurrent answers
+// can reach the wrong client and a truncated answer leaves the client
+// nowhere to retry over TCP. The agent instead tags every query with an ID
+// on its way through the tunnel and returns the answer to the client that
+// asked, accepts queries over TCP on the same public port, and limits the
+// queries per second of every client address so the forward cannot be used
+// for amplification. Frames on the wrap port are a 2-byte length of the
+// rest, the 2-byte query ID, the transport (0 UDP, 1 TCP) and the message.
+
+const (
+	dnsQueryTimeout = 5 * time.Second  // for an answer to reach the VPS
+	dnsTCPIdle      = 10 * time.Second // before an idle TCP client is dropped
+)
+
+// runAgentDNS implements "tut agent dns". With -listen it is the VPS side,
+// with -accept or -accept-fd the local side.
+func runAgentDNS(args []string) int {
+	fs := flag.NewFlagSet("agent dns", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public UDP and TCP port (VPS side)")
+	bind := fs.String("bind", "0.0.0.0", "Address of the public port (VPS side)")
+	connect := fs.String("connect", "", "Wrap port to connect to (VPS side)")
+	qps := fs.Int("qps", 20, "Queries per second per client, negative for no limit (VPS side)")
+	accept := fs.String("accept", "", "Wrap address to listen on (local side)")
+	acceptFD := fs.Int("accept-fd", 0, "Inherited wrap listener (local side)")
+	target := fs.String("target", "", "Resolver address (local side)")
+	_ = fs.Parse(args)
+
+	var err error
+	switch {
+	case *listen != 0 && *connect != "":
+		err = newDNSProxy(*qps).serve(*bind, *listen, *connect)
+	case (*accept != "" || *acceptFD != 0) && *target != "":
+		var ln net.Listener
+		if ln, err = wrapListener(*accept, *acceptFD); err == nil {
+			err = dnsLocal(ln, *target)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: tut agent dns -listen port -connect addr [-qps n] | -accept addr -target addr")
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
+
+// dnsProxy is the VPS side of a DNS forward.
+type dnsProxy struct {
+	qps int
+	udp *net.UDPConn
+
+	mu      sync.Mutex
+	conn    net.Conn // through the tunnel, nil while down
+	nextID  uint16
+	pending map[uint16]*dnsQuery
+	buckets map[string]*tokenBucket // by client address
+}
+
+// dnsQuery is a query waiting for its answer.
+type dnsQuery struct {
+	udp     *net.UDPAddr // client of a UDP query
+	tcp     *dnsTCPClient
+	expires time.Time
+}
+
+// dnsTCPClient is a client connected over TCP; its answers may arrive out
+// of order and are written one at a time.
+type dnsTCPClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// tokenBucket allows rate queries per second with bursts of twice that.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newDNSProxy(qps int) *dnsProxy {
+	return &dnsProxy{qps: qps, pending: map[uint16]*dnsQuery{}, buckets: map[string]*tokenBucket{}}
+}
+
+// serve answers queries on the public port until the UDP socket fails.
+func (p *dnsProxy) serve(bind string, port int, connect string) error {
+	var err error
+	if p.udp, err = agentListenUDP(bind, port); err != nil {
+		return err
+	}
+	tl, err := net.Listen(ipNetwork("tcp", net.ParseIP(bind)), net.JoinHostPort(bind, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	logf("DNS relay on UDP and TCP port %d via %s (%d queries/s per client)", port, connect, p.qps)
+	go p.tunnel(connect)
+	go p.serveTCP(tl)
+	go p.expire()
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := p.udp.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 || !p.allow(from.IP) {
+			continue
+		}
+		p.forward(0, buf[:n], &dnsQuery{udp: from})
+	}
+}
+
+func (p *dnsProxy) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			client := &dnsTCPClient{conn: c}
+			r := bufio.NewReader(c)
+			ip := c.RemoteAddr().(*net.TCPAddr).IP
+			for {
+				_ = c.SetReadDeadline(time.Now().Add(dnsTCPIdle))
+				msg, err := readLenPrefixed(r)
+				if err != nil {
+					return
+				}
+				if len(msg) < 12 || !p.allow(ip) {
+					continue
+				}
+				p.forward(1, msg, &dnsQuery{tcp: client})
+			}
+		}()
+	}
+}
+
+// allow takes a token from the bucket of ip.
+func (p *dnsProxy) allow(ip net.IP) bool {
+	if p.qps < 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.buckets[ip.String()]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(2 * p.qps), last: time.Now()}
+		p.buckets[ip.String()] = b
+	}
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(p.qps), float64(2*p.qps))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// forward sends a query through the tunnel under a new ID; it is dropped
+// while the tunnel is down or too many queries are outstanding.
+func (p *dnsProxy) forward(transport byte, msg []byte, q *dnsQuery) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil || len(p.pending) >= 0xFFFF {
+		return
+	}
+	for p.pending[p.nextID] != nil {
+		p.nextID++
+	}
+	id := p.nextID
+	p.nextID++
+	q.expires = time.Now().Add(dnsQueryTimeout)
+	p.pending[id] = q
+	_ = p.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := writeDNSFrame(p.conn, id, transport, msg); err != nil {
+		// makes tunnel reconnect
+		_ = p.conn.Close()
+	}
+}
+
+// tunnel connects to the local side and returns answers to their clients.
+func (p *dnsProxy) tunnel(connect string) {
+	for {
+		c, err := net.DialTimeout("tcp", connect, 5*time.Second)
+		if err != nil {
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		p.mu.Lock()
+		p.conn = c
+		p.mu.Unlock()
+		r := bufio.NewReader(c)
+		for {
+			id, _, msg, err := readDNSFrame(r)
+			if err != nil {
+				break
+			}
+			p.mu.Lock()
+			q := p.pending[id]
+			delete(p.pending, id)
+			p.mu.Unlock()
+			switch {
+			case q == nil:
+			case q.udp != nil:
+				_, _ = p.udp.WriteToUDP(msg, q.udp)
+			default:
+				q.tcp.mu.Lock()
+				_ = q.tcp.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				_ = writeLenPrefixed(q.tcp.conn, msg)
+				q.tcp.mu.Unlock()
+			}
+		}
+		p.mu.Lock()
+		p.conn = nil
+		p.mu.Unlock()
+		_ = c.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// expire forgets unanswered queries and idle clients.
+func (p *dnsProxy) expire() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		p.mu.Lock()
+		for id, q := range p.pending {
+			if now.After(q.expires) {
+				delete(p.pending, id)
+			}
+		}
+		for ip, b := range p.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(p.buckets, ip)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// dnsLocal is the local side: it passes every query to the resolver over
+// the transport the client used and frames the answer back on the
+// connection the query came from.
+func dnsLocal(ln net.Listener, target string) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			var mu sync.Mutex
+			r := bufio.NewReader(c)
+			for {
+				id, transport, msg, err := readDNSFrame(r)
+				if err != nil {
+					return
+				}
+				if len(msg) < 12 {
+					continue
+				}
+				go func() {
+					answer, err := resolveDNS(target, transport, msg)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+					_ = writeDNSFrame(c, id, transport, answer)
+				}()
+			}
+		}()
+	}
+}
+
+// resolveDNS sends msg to the resolver at target over UDP (transport 0)
+// or TCP and returns its answer. A truncated UDP answer is returned as is,
+// so the client retries over TCP.
+func resolveDNS(target string, transport byte, msg []byte) ([]byte, error) {
+	network := "udp"
+	if transport == 1 {
+		network = "tcp"
+	}
+	c, err := net.DialTimeout(network, target, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(dnsQueryTimeout - time.Second))
+	if transport == 1 {
+		if err := writeLenPrefixed(c, msg); err != nil {
+			return nil, err
+		}
+		return readLenPrefixed(c)
+	}
+	if _, err := c.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore answers that do not carry the query's ID
+		if n >= 12 && buf[0] == msg[0] && buf[1] == msg[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func writeDNSFrame(w io.Writer, id uint16, transport byte, msg []byte) error {
+	if len(msg) > 0xFFFF-3 {
+		return errors.New("message too large")
+	}
+	b := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(3+len(msg)))
+	binary.BigEndian.PutUint16(b[2:], id)
+	b[4] = transport
+	copy(b[5:], msg)
+	_, err := w.Write(b)
+	return err
+}
+
+func readDNSFrame(r io.Reader) (uint16, byte, []byte, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(h[:]))
+	if size < 3 {
+		return 0, 0, nil, errors.New("invalid DNS frame")
+	}
+	msg := make([]byte, size-3)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint16(h[2:]), h[4], msg, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Docker labels that expose a container through the VPS. Only
+// tut.remote_port is required.
+const (
+	labelRemotePort = "tut.remote_port" // public port on the VPS, 0 to let it assign one
+	labelPort       = "tut.port"        // container port (default: the only exposed TCP port)
+	labelName       = "tut.name"        // forward name (default: docker-<container name>)
+	labelHost       = "tut.host"        // address to connect to (default: the container IP)
+)
+
+// dockerContainer is the part of the Docker API container listing we use.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerClient talks HTTP to the Docker daemon over its unix socket.
+func dockerClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+// watchDocker keeps the forwards of labelled containers in sync with the
+// running containers until ctx is cancelled.
+func (d *daemon) watchDocker(ctx context.Context) {
+	dc := d.config().Docker
+	if !dc.Enabled {
+		return
+	}
+	client := dockerClient(dc.Socket)
+	for ctx.Err() == nil {
+		err := d.followDocker(ctx, client)
+		if ctx.Err() != nil {
+			return
+		}
+		logEvent(levelWarn, "", "docker-failed", "Docker watch failed: %v; retrying in 10s", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// followDocker syncs once and then again on every container start or stop.
+func (d *daemon) followDocker(ctx context.Context, client *http.Client) error {
+	filters := `{"type":["container"],"event":["start","die"],"label":["` + labelRemotePort + `"]}`
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/events?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("events: %s", resp.Status)
+	}
+	// subscribe first so that no start between listing and watching is missed
+	if err := d.syncDocker(ctx, client); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Action string `json:"Action"`
+		}
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		if err := d.syncDocker(ctx, client); err != nil {
+			return err
+		}
+	}
+}
+
+// syncDocker lists the labelled containers and applies their forwards.
+func (d *daemon) syncDocker(ctx context.Context, client *http.Client) error {
+	filters := `{"label":["` + labelRemotePort + `"]}`
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/json?filters="+url.QueryEscape(filters), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("containers: %s", resp.Status)
+	}
+	var list []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	var fwds []TCPForward
+	for _, c := range list {
+		f, err := c.forward()
+		if err != nil {
+			logEvent(levelWarn, "", "docker-skipped", "Container %s: %v", c.name(), err)
+			continue
+		}
+		fwds = append(fwds, f)
+	}
+	sort.Slice(fwds, func(i, j int) bool { return fwds[i].Name < fwds[j].Name })
+	d.setDynamic("docker", fwds)
+	return nil
+}
+
+func (c dockerContainer) name() string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// forward builds the forward described by the container's labels.
+func (c dockerContainer) forward() (TCPForward, error) {
+	f := TCPForward{Name: c.Labels[labelName], LocalHost: c.Labels[labelHost]}
+	if f.Name == "" {
+		f.Name = "docker-" + c.name()
+	}
+	if !validName(f.Name) {
+		return f, fmt.Errorf("invalid forward name %q", f.Name)
+	}
+	port, err := strconv.Atoi(c.Labels[labelRemotePort])
+	if err != nil || port != 0 && !isPort(port) {
+		return f, fmt.Errorf("invalid %s %q", labelRemotePort, c.Labels[labelRemotePort])
+	}
+	f.RemotePort = port
+	if s, ok := c.Labels[labelPort]; ok {
+		if f.LocalPort, err = strconv.Atoi(s); err != nil || !isPort(f.LocalPort) {
+			return f, fmt.Errorf("invalid %s %q", labelPort, s)
+		}
+	} else {
+		exposed := map[int]bool{}
+		for _, p := range c.Ports {
+			if p.Type == "tcp" {
+				exposed[p.PrivatePort] = true
+			}
+		}
+		if len(exposed) != 1 {
+			return f, fmt.Errorf("%d TCP ports exposed; set %s", len(exposed), labelPort)
+		}
+		for p := range exposed {
+			f.LocalPort = p
+		}
+	}
+	if f.LocalHost == "" {
+		nets := make([]string, 0, len(c.NetworkSettings.Networks))
+		for n := range c.NetworkSettings.Networks {
+			nets = append(nets, n)
+		}
+		sort.Strings(nets)
+		for _, n := range nets {
+			if ip := c.NetworkSettings.Networks[n].IPAddress; ip != "" {
+				f.LocalHost = ip
+				break
+			}
+		}
+	}
+	if f.LocalHost == "" {
+		// host networking: the service listens on the host itself
+		f.LocalHost = "127.0.0.1"
+	}
+	return f, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcomes of a doctor check.
+const (
+	checkOK   = "ok"
+	checkInfo = "info"
+	checkWarn = "warn"
+	checkFail = "FAIL"
+)
+
+// doctor collects the outcomes of the checks run by tut doctor.
+type doctor struct {
+	failed bool
+	checks []doctorCheck // for -output json
+}
+
+// doctorCheck is one outcome in "tut doctor -output json".
+type doctorCheck struct {
+	Outcome string `json:"outcome"` // ok, info, warn or fail
+	Message string `json:"message"`
+}
+
+func (d *doctor) report(outcome, format string, args ...any) {
+	if outcome == checkFail {
+		d.failed = true
+	}
+	msg := fmt.Sprintf(format, args...)
+	if jsonOutput() {
+		d.checks = append(d.checks, doctorCheck{strings.ToLower(outcome), msg})
+		return
+	}
+	fmt.Printf("%-5s %s\n", outcome, msg)
+}
+
+// done ends tut doctor, printing the checks with -output json.
+func (d *doctor) done() int {
+	if jsonOutput() {
+		printJSON(struct {
+			OK     bool          `json:"ok"`
+			Checks []doctorCheck `json:"checks"`
+		}{!d.failed, d.checks})
+	}
+	if d.failed {
+		return 1
+	}
+	return 0
+}
+
+// runDoctorCommand implements "tut doctor": it checks the config, the local
+// dependencies, the connection to the VPS and whether this host is behind
+// NAT, and explains what it finds. It exits non-zero when a check failed.
+func runDoctorCommand(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+
+	var doc doctor
+	for _, bin := range []string{"ssh", "socat"} {
+		if path, err := exec.LookPath(bin); err != nil {
+			doc.report(checkFail, "%s not found in PATH", bin)
+		} else {
+			doc.report(checkOK, "%s found at %s", bin, path)
+		}
+	}
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if err != nil {
+		doc.report(checkFail, "config %s: %v", *configPath, err)
+		return doc.done()
+	}
+	doc.report(checkOK, "config %s is valid (%d TCP, %d UDP forwards)", *configPath, len(cfg.TCPForwards), len(cfg.UDPForwards))
+	if err := checkPrivilegedPorts(cfg); err != nil {
+		doc.report(checkFail, "%v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	doc.checkVPS(ctx, cfg)
+
+	if len(cfg.STUNServers) == 0 {
+		doc.report(checkInfo, "NAT check skipped: no stun_servers configured")
+	} else {
+		r := detectNAT(ctx, cfg)
+		outcome := checkOK
+		if r.Verdict == natUnknown {
+			outcome = checkWarn
+		} else if r.relayNeeded() {
+			outcome = checkInfo
+		}
+		doc.report(outcome, "NAT: %s", r)
+	}
+	return doc.done()
+}
+
+// checkVPS checks that the SSH port of the VPS is reachable, that tut can
+// log in non-interactively and that socat is installed there.
+func (d *doctor) checkVPS(ctx context.Context, cfg *Config) {
+	if r, err := lookupRoute(cfg); err != nil {
+		d.report(checkWarn, "no route to the VPS: %v", err)
+	} else if a := avoidedBy(cfg.VPS.AvoidRoutes, r); a != "" {
+		d.report(checkFail, "route to the VPS: %s goes through %s, excluded by vps.avoid_routes; tut will not connect until it changes (check the default route and VPN split tunneling)", r, a)
+	} else {
+		d.report(checkOK, "route to the VPS: %s", r)
+	}
+	if len(cfg.VPS.Ports) > 0 {
+		found := false
+		for _, p := range cfg.VPS.Ports {
+			if err := probeSSHPort(ctx, cfg, p); err != nil {
+				d.report(checkWarn, "port %d does not reach SSH: %v", p, err)
+				continue
+			}
+			d.report(checkOK, "port %d reaches SSH", p)
+			if !found {
+				vpsPort.Lock()
+				vpsPort.port = p
+				vpsPort.Unlock()
+				found = true
+			}
+		}
+		if !found {
+			d.report(checkFail, "no port of vps.ports reaches SSH; behind a multiplexer like sslh, check that it passes SSH on")
+			return
+		}
+	}
+	if rtt, method, err := pingHost(ctx, cfg, cfg.VPS.Host, 3*time.Second); err != nil {
+		d.report(checkInfo, "VPS does not answer pings (%v); health.ping_interval cannot tell network and VPS failures apart", err)
+	} else {
+		d.report(checkOK, "VPS answers %s pings (%s)", method, rtt.Round(time.Millisecond))
+	}
+	addr := net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(sshPort(cfg)))
+	start := time.Now()
+	dialer := vpsDialer(cfg, "tcp")
+	dialer.Timeout = 10 * time.Second
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		d.report(checkFail, "VPS %s not reachable: %v", addr, err)
+		return
+	}
+	_ = conn.Close()
+	d.report(checkOK, "VPS %s reachable (%s)", addr, time.Since(start).Round(time.Millisecond))
+
+	base, target := sshBaseArgs(cfg)
+	args := append(base, "-o", "ConnectTimeout=10", target, "command -v socat")
+	out, err := sshExec(ctx, cfg, args...).CombinedOutput()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		d.report(checkOK, "SSH login as %s works, socat found on the VPS", cfg.VPS.User)
+	case errors.As(err, &exit) && exit.ExitCode() != 255:
+		d.report(checkFail, "socat is not installed on the VPS")
+		return
+	default:
+		d.report(checkFail, "SSH login as %s failed: %v %s", cfg.VPS.User, err, lastLine(string(out)))
+		return
+	}
+	d.checkRemoteVersions(ctx, cfg)
+}
+
+// checkRemoteVersions reports the versions of socat and the agent on the
+// VPS and whether this tut works with them.
+func (d *doctor) checkRemoteVersions(ctx context.Context, cfg *Config) {
+	v, err := queryRemoteVersions(ctx, cfg, true)
+	if err != nil {
+		d.report(checkWarn, "cannot check the versions on the VPS: %v", err)
+		return
+	}
+	if p := socatProblem(v.socat); p != "" {
+		d.report(checkFail, "%s", p)
+	} else {
+		d.report(checkOK, "socat %s on the VPS", v.socat)
+	}
+	switch p := agentProblem(v.agent); {
+	case p != "" && agentNeeded(cfg):
+		d.report(checkFail, "%s", p)
+	case p != "":
+		d.report(checkWarn, "%s (not needed by this config)", p)
+	case v.agent == "":
+		d.report(checkInfo, "no agent on the VPS yet; tut uploads it when a feature needs it")
+	default:
+		d.report(checkOK, "agent on the VPS speaks protocol %s", v.agent)
+	}
+}
+
+// lastLine returns the last non-empty line of s.
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	return s[strings.LastIndex(s, "\n")+1:]
+}
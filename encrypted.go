@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A config encrypted with age, or with SOPS (whose values are encrypted
+// and whose keys stay readable), can live in git next to the rest of a
+// deployment. tut recognises both when it reads the config or a drop-in
+// file and decrypts them in memory with the age or sops command; the
+// plaintext is never written out. The age identity comes from -identity
+// or TUT_AGE_IDENTITY, and is handed to sops as SOPS_AGE_KEY_FILE; sops
+// files encrypted for KMS or PGP decrypt with the usual credentials of
+// sops.
+
+// decryptTimeout bounds a run of age or sops; sops may ask a cloud KMS.
+const decryptTimeout = 30 * time.Second
+
+// configIdentity is the age identity file for encrypted configs.
+var configIdentity = os.Getenv("TUT_AGE_IDENTITY")
+
+// sopsRe matches the metadata sops adds to the files it encrypts.
+var sopsRe = regexp.MustCompile(`(?m)^sops:\s*$`)
+
+// configEncryption says how the config b is encrypted: "age", "sops" or "".
+func configEncryption(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte("age-encryption.org/v1\n")),
+		bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN AGE ENCRYPTED FILE-----")):
+		return "age"
+	case sopsRe.Match(b) && bytes.Contains(b, []byte("ENC[")):
+		return "sops"
+	}
+	return ""
+}
+
+// decryptConfig returns the config b, read from path, decrypted when it is
+// encrypted with age or sops.
+func decryptConfig(path string, b []byte) ([]byte, error) {
+	kind := configEncryption(b)
+	if kind == "" {
+		return b, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), decryptTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	switch kind {
+	case "age":
+		if configIdentity == "" {
+			return nil, fmt.Errorf("%s is encrypted with age; give the identity file with -identity or TUT_AGE_IDENTITY", path)
+		}
+		cmd = exec.CommandContext(ctx, "age", "--decrypt", "-i", configIdentity)
+		cmd.Stdin = bytes.NewReader(b)
+	case "sops":
+		cmd = exec.CommandContext(ctx, "sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+		if configIdentity != "" && os.Getenv("SOPS_AGE_KEY_FILE") == "" {
+			cmd.Env = append(os.Environ(), "SOPS_AGE_KEY_FILE="+configIdentity)
+		}
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("%s is encrypted with %s, which is not installed", path, kind)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("decrypting %s with %s: %s", path, kind, msg)
+	}
+	return out, nil
+}
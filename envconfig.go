@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envConfigPath selects the environment instead of a config file, e.g.
+// "tut -config env:" in a container.
+const envConfigPath = "env:"
+
+// envPrefix starts every configuration variable. Settings map to
+// TUT_<YAML_PATH>, e.g. vps.ssh_key is TUT_VPS_SSH_KEY; forwards are given
+// as TUT_FORWARD_<n>.
+const envPrefix = "TUT_"
+
+// configFromEnv fills c from the environment. Logs default to JSON on
+// stdout, which suits container log collectors.
+func configFromEnv(c *Config) error {
+	if err := setFromEnv(reflect.ValueOf(c).Elem(), envPrefix); err != nil {
+		return err
+	}
+	if err := forwardsFromEnv(c); err != nil {
+		return err
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = "json"
+	}
+	return nil
+}
+
+// setFromEnv sets the scalar fields of the struct v from prefix+KEY
+// variables. Maps are written as "k1=v1,k2=v2" and lists as "a,b".
+func setFromEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := setFromEnv(f, key+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.String, reflect.Int, reflect.Int64, reflect.Bool:
+			if err := setScalar(f, key, s); err != nil {
+				return err
+			}
+		case reflect.Map:
+			m := reflect.MakeMap(f.Type())
+			for _, kv := range strings.Split(s, ",") {
+				k, val, ok := strings.Cut(kv, "=")
+				if !ok {
+					return fmt.Errorf("%s: expected key=value pairs, got %q", key, kv)
+				}
+				m.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), reflect.ValueOf(strings.TrimSpace(val)))
+			}
+			f.Set(m)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			items := []string{}
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			f.Set(reflect.ValueOf(items))
+		}
+	}
+	return nil
+}
+
+// setScalar sets the string, int or bool field f, or a duration, size or
+// rate, from s. Booleans may also be given as yes/no, on/off or
+// enabled/disabled.
+func setScalar(f reflect.Value, key, s string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if err := u.UnmarshalText([]byte(s)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: invalid number %q", key, s)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "yes", "on", "enabled":
+			s = "true"
+		case "no", "off", "disabled":
+			s = "false"
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", key, s)
+		}
+		f.SetBool(b)
+	}
+	return nil
+}
+
+// forwardsFromEnv adds the forwards given as TUT_FORWARD_<n>, in order of n:
+//
+//	[name=]tcp:<remote_port>:<local_host>:<local_port>
+//	[name=]udp:<udp_public_port>:<local_host>:<local_udp_port>:<wrap_tcp_port>
+func forwardsFromEnv(c *Config) error {
+	type entry struct {
+		n    int
+		key  string
+		spec string
+	}
+	var entries []entry
+	for _, kv := range os.Environ() {
+		key, spec, _ := strings.Cut(kv, "=")
+		idx, ok := strings.CutPrefix(key, envPrefix+"FORWARD_")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(idx)
+		if err != nil {
+			return fmt.Errorf("%s: index must be a number", key)
+		}
+		entries = append(entries, entry{n, key, spec})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].n < entries[j].n })
+	for _, e := range entries {
+		if err := addForwardSpec(c, e.spec); err != nil {
+			return fmt.Errorf("%s: %w", e.key, err)
+		}
+	}
+	return nil
+}
+
+// addForwardSpec parses a single forward spec and appends it to c.
+func addForwardSpec(c *Config, spec string) error {
+	name := ""
+	if n, rest, ok := strings.Cut(spec, "="); ok {
+		name, spec = n, rest
+	}
+	parts := strings.Split(spec, ":")
+	valid := parts[0] == "tcp" && len(parts) == 4 || parts[0] == "udp" && len(parts) == 5
+	if !valid {
+		return fmt.Errorf("invalid forward %q (use tcp:REMOTE:HOST:PORT or udp:PUBLIC:HOST:PORT:WRAP)", spec)
+	}
+	host := parts[2]
+	var ports []int
+	for i, p := range parts[1:] {
+		if i == 1 {
+			continue // the local host
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid port %q in %q", p, spec)
+		}
+		ports = append(ports, n)
+	}
+	if parts[0] == "tcp" {
+		c.TCPForwards = append(c.TCPForwards, TCPForward{
+			Name: name, RemotePort: ports[0], LocalHost: host, LocalPort: ports[1],
+		})
+		return nil
+	}
+	c.UDPForwards = append(c.UDPForwards, UDPForward{
+		Name: name, UDPPublicPort: ports[0], LocalHost: host, LocalUDPPort: ports[1], WrapTCPPort: ports[2],
+	})
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A TCP forward carrying HTTP can have an error_page, an HTML file shown
+// to visitors instead of a reset connection. The relay of the forward
+// serves it with 502 when the local service does not answer and with 503
+// while the forward is paused. With error_page_port, the agent on the VPS
+// takes remote_port and passes connections to the remote forward on that
+// loopback port, serving the page with 503 while the tunnel is down; a
+// forward with remote_tls or http_proxy_port gets the same from its TLS
+// agent or HTTP proxy. The page is
+// uploaded next to the agent at the start of every session.
+
+// errorPageOnVPS reports whether the agent on the VPS serves the error
+// page of f.
+func errorPageOnVPS(f TCPForward) bool {
+	return f.ErrorPage != "" && f.onVPS() && (f.ErrorPagePort != 0 || f.RemoteTLS || f.HTTPProxyPort != 0)
+}
+
+// errorPageFile is the file on the VPS holding the error page of a forward,
+// relative to the agent directory.
+func errorPageFile(name string) string {
+	return "page-" + name + ".html"
+}
+
+// validateErrorPages checks the error_page settings of the TCP forwards.
+func validateErrorPages(c *Config) error {
+	used := make(map[int]string)
+	for _, f := range c.TCPForwards {
+		used[f.RemotePort] = "the remote_port of " + f.Name
+		if f.RemoteTLS {
+			used[f.RemoteTLSPort] = "the remote_tls_port of " + f.Name
+		}
+		if f.HTTPRedirectPort != 0 {
+			used[f.HTTPRedirectPort] = "the http_redirect_port of " + f.Name
+		}
+	}
+	for _, u := range c.UDPForwards {
+		used[u.WrapTCPPort] = "the wrap_tcp_port of " + u.Name
+	}
+	if c.HostRouting.Port != 0 {
+		used[c.HostRouting.Port] = "host_routing.port"
+	}
+	for _, f := range c.TCPForwards {
+		if f.ErrorPagePort == 0 {
+			continue
+		}
+		switch {
+		case f.ErrorPage == "":
+			return fmt.Errorf("%s: error_page_port needs an error_page", f.Name)
+		case !isPort(f.ErrorPagePort):
+			return fmt.Errorf("%s: invalid error_page_port: %d", f.Name, f.ErrorPagePort)
+		case !f.onVPS():
+			return fmt.Errorf("%s: error_page_port needs the forward on the VPS", f.Name)
+		case f.RemotePort == 0:
+			return fmt.Errorf("%s: error_page_port needs a fixed remote_port", f.Name)
+		case f.RemoteTLS:
+			return fmt.Errorf("%s: with remote_tls the TLS agent serves the error page; drop error_page_port", f.Name)
+		case hostRouted(c, f.Name):
+			return fmt.Errorf("%s: error_page_port does not apply to forwards in host_routing", f.Name)
+		case c.VPS.Transport == "tailscale":
+			return fmt.Errorf("%s: error_page_port does not apply to vps.transport: tailscale", f.Name)
+		case used[f.ErrorPagePort] != "":
+			return fmt.Errorf("%s: error_page_port %d is %s", f.Name, f.ErrorPagePort, used[f.ErrorPagePort])
+		}
+		used[f.ErrorPagePort] = "the error_page_port of " + f.Name
+	}
+	return nil
+}
+
+// errorPageScript returns the start functions of the agents serving error
+// pages of cfg and their modes.
+func errorPageScript(cfg *Config) (string, []string) {
+	var b strings.Builder
+	var modes []string
+	for i, f := range cfg.TCPForwards {
+		if !errorPageOnVPS(f) || f.ErrorPagePort == 0 {
+			continue
+		}
+		mode := fmt.Sprintf("page%d", i)
+		b.WriteString(fmt.Sprintf(`start_%s(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, mode, f.RemotePort))
+		b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent page -listen %d -connect 127.0.0.1:%d -page "$AGENT_DIR"/%s %s & P_%s="$!"; }; start_%s; `,
+			f.RemotePort, f.ErrorPagePort, shellQuote(errorPageFile(f.Name)), remoteLog(cfg, fmt.Sprintf("tut-agent-page-%d.log", f.RemotePort)), strings.ToUpper(mode), mode))
+		modes = append(modes, mode)
+	}
+	return b.String(), modes
+}
+
+// readErrorPage reads the error page of f, logging when it cannot.
+func readErrorPage(f TCPForward) []byte {
+	if f.ErrorPage == "" {
+		return nil
+	}
+	page, err := os.ReadFile(f.ErrorPage)
+	if err != nil {
+		logEvent(levelWarn, f.Name, "", "error_page: %v", err)
+		return nil
+	}
+	return page
+}
+
+// serveErrorPage answers the HTTP request on c with page and status code,
+// then closes c.
+func serveErrorPage(c net.Conn, code int, page []byte) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	// read the request first, so that the client sees the answer and not
+	// a reset for the data left unread
+	if req, err := http.ReadRequest(bufio.NewReader(c)); err == nil && req.ContentLength > 0 && req.ContentLength < 1<<20 {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	b.WriteString("Content-Type: text/html; charset=utf-8\r\nCache-Control: no-store\r\nConnection: close\r\n")
+	if code == http.StatusServiceUnavailable {
+		b.WriteString("Retry-After: 30\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(page))
+	_, _ = io.WriteString(c, b.String())
+	_, _ = c.Write(page)
+	closeWrite(c)
+}
+
+// runAgentPage implements "tut agent page": it passes the clients of a
+// public port to addr, serving the error page while addr is down.
+func runAgentPage(args []string) int {
+	fs := flag.NewFlagSet("agent page", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public port")
+	connect := fs.String("connect", "", "Address of the remote forward")
+	file := fs.String("page", "", "HTML file served while the remote forward is down")
+	_ = fs.Parse(args)
+	if !isPort(*listen) || *connect == "" || *file == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent page -listen port -connect addr -page file")
+		return 2
+	}
+	page, err := os.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *listen))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("Passing port %d to %s, with the error page while it is down", *listen, *connect)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		go func() {
+			up, err := net.DialTimeout("tcp", *connect, 10*time.Second)
+			if err != nil {
+				serveErrorPage(c, http.StatusServiceUnavailable, page)
+				return
+			}
+			defer c.Close()
+			defer up.Close()
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(up, c)
+				closeWrite(up)
+				close(done)
+			}()
+			_, _ = io.Copy(c, up)
+			closeWrite(c)
+			<-done
+		}()
+	}
+}
+
+// errorPageUsed reports whether the agent serves the error page of a
+// forward of cfg on its public port.
+func errorPageUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if errorPageOnVPS(f) && f.ErrorPagePort != 0 {
+			return true
+		}
+	}
+	return false
+}
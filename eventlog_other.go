@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// openEventLog is only supported on Windows.
+func openEventLog(next logSink) (logSink, error) {
+	return nil, errors.New("the event log is only available on Windows")
+}
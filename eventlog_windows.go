@@ -0,0 +1,112 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// eventSource is the Application log source name tut reports under.
+const eventSource = "tut"
+
+// Event log entry types.
+const (
+	eventlogErrorType   = 0x0001
+	eventlogWarningType = 0x0002
+)
+
+// eventIDs maps TUT_EVENT names to stable Windows event IDs, so admins can
+// filter and alert on specific failures. Events without an entry use
+// eventIDWarning or eventIDError. IDs stay within 1-1000 because the source
+// is registered with EventCreate.exe as message file.
+var eventIDs = map[string]uint32{
+	"tunnel-failed":          100,
+	"probe-failed":           110,
+	"dial-failed":            111,
+	"wrapper-restart":        120,
+	"wrapper-restart-failed": 121,
+	"wrapper-gave-up":        122,
+	"lease-lost":             130,
+	"reload-rejected":        140,
+	"reload-failed":          141,
+}
+
+const (
+	eventIDWarning uint32 = 900
+	eventIDError   uint32 = 901
+)
+
+var (
+	advapi32                 = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSourceW = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW         = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW      = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW       = advapi32.NewProc("RegSetValueExW")
+	procRegCloseKey          = advapi32.NewProc("RegCloseKey")
+)
+
+// openEventLog returns a sink reporting warnings and errors to the Windows
+// Application event log, passing every entry on to next.
+func openEventLog(next logSink) (logSink, error) {
+	// Registering the source needs administrator rights and only has to
+	// happen once; without it the events are still logged, just without
+	// a pretty description in Event Viewer.
+	registerEventSource()
+	name, _ := syscall.UTF16PtrFromString(eventSource)
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, fmt.Errorf("RegisterEventSource: %v", err)
+	}
+	return func(e logEntry) {
+		next(e)
+		if e.level > levelWarn {
+			return
+		}
+		typ, id := uint16(eventlogWarningType), eventIDWarning
+		if e.level <= levelError {
+			typ, id = eventlogErrorType, eventIDError
+		}
+		if known, ok := eventIDs[e.event]; ok {
+			id = known
+		}
+		msg := e.msg
+		if e.forward != "" {
+			msg = "[" + e.forward + "] " + msg
+		}
+		text, err := syscall.UTF16PtrFromString(msg)
+		if err != nil {
+			return
+		}
+		strs := []*uint16{text}
+		_, _, _ = procReportEventW.Call(h, uintptr(typ), 0, uintptr(id), 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	}, nil
+}
+
+// registerEventSource creates the registry entry for the event source,
+// ignoring failures (e.g. when not running as administrator).
+func registerEventSource() {
+	const hkeyLocalMachine = 0x80000002
+	const keyWrite = 0x20006
+	const regExpandSz = 2
+	const regDword = 4
+	path, _ := syscall.UTF16PtrFromString(`SYSTEM\CurrentControlSet\Services\EventLog\Application\` + eventSource)
+	var key syscall.Handle
+	r, _, _ := procRegCreateKeyExW.Call(hkeyLocalMachine, uintptr(unsafe.Pointer(path)), 0, 0, 0, keyWrite, 0, uintptr(unsafe.Pointer(&key)), 0)
+	if r != 0 {
+		return
+	}
+	defer procRegCloseKey.Call(uintptr(key))
+
+	msgFile, _ := syscall.UTF16FromString(os.ExpandEnv(`%SystemRoot%\System32\EventCreate.exe`))
+	valName, _ := syscall.UTF16PtrFromString("EventMessageFile")
+	_, _, _ = procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(valName)), 0, regExpandSz,
+		uintptr(unsafe.Pointer(&msgFile[0])), uintptr(len(msgFile)*2))
+
+	types := uint32(eventlogErrorType | eventlogWarningType | 0x0004)
+	typesName, _ := syscall.UTF16PtrFromString("TypesSupported")
+	_, _, _ = procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(typesName)), 0, regDword,
+		uintptr(unsafe.Pointer(&types)), 4)
+}
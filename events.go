@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every log entry with an event name, and the open and close of every
+// relayed connection, is published on the event bus. The API streams the
+// bus as JSON over a WebSocket at /v1/events for dashboards that would
+// otherwise have to poll.
+
+// apiEvent is one entry of the event stream.
+type apiEvent struct {
+	Time    time.Time      `json:"time"`
+	Type    string         `json:"type"` // e.g. conn-open, tunnel-up, probe-failed
+	Level   string         `json:"level,omitempty"`
+	Forward string         `json:"forward,omitempty"`
+	Msg     string         `json:"msg,omitempty"`
+	Data    map[string]any `json:"data,omitempty"`
+}
+
+// eventBus fans events out to its subscribers. A subscriber that falls
+// behind loses events rather than slowing down the daemon.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan apiEvent]struct{}
+}
+
+// events is the event bus of the daemon.
+var events eventBus
+
+func (b *eventBus) subscribe() chan apiEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[chan apiEvent]struct{})
+	}
+	ch := make(chan apiEvent, 256)
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan apiEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// active reports whether anyone listens, so callers can skip building
+// events nobody receives.
+func (b *eventBus) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *eventBus) publish(e apiEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// wsGUID is the key suffix of the WebSocket handshake (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+// apiEvents streams the event bus to a WebSocket client, one JSON text
+// message per event. Clients only ever need to answer pings and close.
+func (d *daemon) apiEvents(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || key == "" || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	if !sameOrigin(req) {
+		// WebSockets are not bound by the same-origin policy; without this
+		// any page could open the stream
+		http.Error(w, "cross-origin WebSocket refused", http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + wsGUID))
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+	var mu sync.Mutex // serializes writes of events and pongs
+	send := func(op byte, payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return writeWSFrame(conn, op, payload)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			op, payload, err := readWSFrame(rw.Reader)
+			if err != nil || op == wsClose {
+				_ = send(wsClose, nil)
+				return
+			}
+			if op == wsPing {
+				_ = send(wsPong, payload)
+			}
+		}
+	}()
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case e := <-ch:
+			b, _ := json.Marshal(e)
+			if send(wsText, b) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if send(wsPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeWSFrame writes an unmasked, unfragmented server frame.
+func writeWSFrame(w io.Writer, op byte, payload []byte) error {
+	h := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		h = append(h, byte(n))
+	case n <= 0xFFFF:
+		h = append(h, 126)
+		h = binary.BigEndian.AppendUint16(h, uint16(n))
+	default:
+		h = append(h, 127)
+		h = binary.BigEndian.AppendUint64(h, uint64(n))
+	}
+	_, err := w.Write(append(h, payload...))
+	return err
+}
+
+// readWSFrame reads a client frame and unmasks its payload. Client messages
+// carry nothing the stream needs, so fragments are not reassembled.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	op, n := h[0]&0x0F, uint64(h[1]&0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if h[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
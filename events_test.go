@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The frames of RFC 6455, section 5.7.
+func TestWSFrameVectors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      byte
+		payload []byte
+		header  string // hex, followed by the payload
+	}{
+		{"text", wsText, []byte("Hello"), "8105"},
+		{"ping", wsPing, []byte("Hello"), "8905"},
+		{"empty close", wsClose, nil, "8800"},
+		{"256 bytes", 0x2, bytes.Repeat([]byte{7}, 256), "827e0100"},
+		{"64 KiB", 0x2, bytes.Repeat([]byte{7}, 65536), "827f0000000000010000"},
+	} {
+		var buf bytes.Buffer
+		if err := writeWSFrame(&buf, tc.op, tc.payload); err != nil {
+			t.Fatal(err)
+		}
+		if want := tc.header + hex.EncodeToString(tc.payload); hex.EncodeToString(buf.Bytes()) != want {
+			t.Errorf("%s: frame %.40x…, want %.40s…", tc.name, buf.Bytes(), want)
+		}
+		op, payload, err := readWSFrame(bufio.NewReader(&buf))
+		if err != nil || op != tc.op || !bytes.Equal(payload, tc.payload) {
+			t.Errorf("%s: read back op %#x, %d bytes, %v", tc.name, op, len(payload), err)
+		}
+	}
+
+	// a masked "Hello" from a client
+	masked, _ := hex.DecodeString("818537fa213d7f9f4d5158")
+	op, payload, err := readWSFrame(bufio.NewReader(bytes.NewReader(masked)))
+	if err != nil || op != wsText || string(payload) != "Hello" {
+		t.Errorf("masked frame: op %#x, %q, %v", op, payload, err)
+	}
+}
+
+func TestReadWSFrameRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame string
+	}{
+		{"empty", ""},
+		{"header cut", "81"},
+		{"extended length cut", "817e01"},
+		{"mask cut", "818537fa"},
+		{"payload cut", "818537fa213d7f9f"},
+		{"above 1 MiB", "827f0000000000200000"},
+	} {
+		b, _ := hex.DecodeString(tc.frame)
+		if _, _, err := readWSFrame(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("%s: frame was read", tc.name)
+		}
+	}
+}
+
+// wsDial opens the event stream of srv with the handshake of RFC 6455,
+// section 1.3.
+func wsDial(t *testing.T, srv *httptest.Server, origin string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	c, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET /v1/events HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	if origin != "" {
+		req += "Origin: " + origin + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, r, resp
+}
+
+func TestAPIEvents(t *testing.T) {
+	d := &daemon{}
+	srv := httptest.NewServer(http.HandlerFunc(d.apiEvents))
+	defer srv.Close()
+
+	_, _, resp := wsDial(t, srv, "https://evil.example")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin handshake: %s, want 403", resp.Status)
+	}
+
+	c, r, resp := wsDial(t, srv, "http://"+srv.Listener.Addr().String())
+	defer c.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %s", resp.Status)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); !events.active(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the stream did not subscribe")
+		}
+	}
+	events.publish(apiEvent{Type: "tunnel-up", Forward: "web", Msg: "connected"})
+	op, payload, err := readWSFrame(r)
+	if err != nil || op != wsText {
+		t.Fatalf("event frame: op %#x, %v", op, err)
+	}
+	var e apiEvent
+	if err := json.Unmarshal(payload, &e); err != nil || e.Type != "tunnel-up" || e.Forward != "web" || e.Time.IsZero() {
+		t.Errorf("event %s: %v", payload, err)
+	}
+
+	// clients mask their frames
+	if _, err := c.Write([]byte{0x89, 0x84, 1, 2, 3, 4, 'p' ^ 1, 'i' ^ 2, 'n' ^ 3, 'g' ^ 4}); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err := readWSFrame(r); err != nil || op != wsPong || string(payload) != "ping" {
+		t.Errorf("answer to a ping: op %#x, %q, %v", op, payload, err)
+	}
+	if _, err := c.Write([]byte{0x88, 0x80, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err := readWSFrame(r); err != nil || op != wsClose {
+		t.Errorf("answer to a close: op %#x, %v", op, err)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// runExportCommand implements "tut export <format>", printing service
+// definitions generated from the config.
+func runExportCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tut export systemd|procd|rc.d [-config path] [-binary path]")
+		return 2
+	}
+	switch args[0] {
+	case "systemd":
+		return exportSystemd(args[1:])
+	case "procd":
+		return exportProcd(args[1:])
+	case "rc.d":
+		return exportRCD(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown export format: %s\n", args[0])
+	return 2
+}
+
+// exportSystemd prints a systemd unit for the config. When the config binds
+// privileged local ports and run_as is set, the service runs as that user
+// with CAP_NET_BIND_SERVICE as ambient capability instead of as root.
+func exportSystemd(args []string) int {
+	fs := flag.NewFlagSet("export systemd", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	binary := fs.String("binary", "", "Path of the tut binary (default: this executable)")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		die("Invalid config: %v", err)
+	}
+	if *binary == "" {
+		if *binary, err = os.Executable(); err != nil {
+			*binary = "/usr/local/bin/tut"
+		}
+	}
+	if abs, err := filepath.Abs(*configPath); err == nil && *configPath != envConfigPath && !strings.HasPrefix(*configPath, uciConfigPrefix) {
+		*configPath = abs
+	}
+	fmt.Print(systemdUnit(cfg, *binary, *configPath))
+	return 0
+}
+
+// exportProcd prints an OpenWrt init script that runs tut under procd.
+// With a UCI config the script honours option enabled of the tut section
+// and reloads tut when the config is committed.
+func exportProcd(args []string) int {
+	fs := flag.NewFlagSet("export procd", flag.ExitOnError)
+	configPath := fs.String("config", uciConfigPrefix+uciDefaultPath, "Path to config file")
+	binary := fs.String("binary", "/usr/bin/tut", "Path of the tut binary on the router")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		die("Invalid config: %v", err)
+	}
+	fmt.Print(procdScript(*binary, *configPath))
+	return 0
+}
+
+// procdScript renders the init script.
+func procdScript(binary, configPath string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh /etc/rc.common\n")
+	b.WriteString("# TUT - TCP UDP Tunnel, generated by tut export procd\n\n")
+	b.WriteString("USE_PROCD=1\n")
+	b.WriteString("START=95\n")
+	b.WriteString("STOP=10\n\n")
+	b.WriteString("start_service() {\n")
+	uciFile, uci := strings.CutPrefix(configPath, uciConfigPrefix)
+	if uci {
+		if uciFile == "" {
+			uciFile = uciDefaultPath
+		}
+		fmt.Fprintf(&b, "\tconfig_load %s\n", filepath.Base(uciFile))
+		b.WriteString("\tlocal enabled\n")
+		b.WriteString("\tconfig_get_bool enabled main enabled 1\n")
+		b.WriteString("\t[ \"$enabled\" -eq 1 ] || return 0\n\n")
+	}
+	b.WriteString("\tprocd_open_instance\n")
+	fmt.Fprintf(&b, "\tprocd_set_param command %s -config %s\n", binary, configPath)
+	// tut reconnects by itself; respawn only covers crashes, forever
+	b.WriteString("\tprocd_set_param respawn 3600 5 0\n")
+	b.WriteString("\tprocd_set_param stdout 1\n")
+	b.WriteString("\tprocd_set_param stderr 1\n")
+	b.WriteString("\tprocd_close_instance\n")
+	b.WriteString("}\n\n")
+	b.WriteString("reload_service() {\n")
+	b.WriteString("\tprocd_send_signal tut '*' HUP\n")
+	b.WriteString("}\n")
+	if uci {
+		b.WriteString("\nservice_triggers() {\n")
+		fmt.Fprintf(&b, "\tprocd_add_reload_trigger %s\n", filepath.Base(uciFile))
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// systemdUnit renders the unit file.
+func systemdUnit(cfg *Config, binary, configPath string) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=TUT - TCP UDP Tunnel\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n\n")
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "ExecStart=%s -config %s\n", binary, configPath)
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\n")
+	// lets tut hand the main PID to its successor on upgrade (SIGUSR2)
+	b.WriteString("NotifyAccess=all\n")
+	b.WriteString("Restart=always\n")
+	b.WriteString("RestartSec=2\n")
+	if cfg.RunAs != "" && needsBindCapability(cfg) {
+		// Capabilities do not survive tut's own setuid, so let systemd
+		// start it as the user right away.
+		fmt.Fprintf(&b, "User=%s\n", cfg.RunAs)
+		b.WriteString("AmbientCapabilities=CAP_NET_BIND_SERVICE\n")
+		b.WriteString("CapabilityBoundingSet=CAP_NET_BIND_SERVICE\n")
+		b.WriteString("NoNewPrivileges=true\n")
+		if filepath.Dir(cfg.StateFile) == "/var/lib/tut" {
+			b.WriteString("StateDirectory=tut\n")
+		}
+	} else {
+		b.WriteString("User=root\n")
+	}
+	b.WriteString("StandardOutput=journal\n")
+	b.WriteString("StandardError=journal\n\n")
+	b.WriteString("[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// exportRCD prints an rc.d script for FreeBSD or OpenBSD. tut stays in the
+// foreground, so the script has it run in the background: by daemon(8) on
+// FreeBSD, which also restarts it after a crash, and by rc.subr on OpenBSD.
+func exportRCD(args []string) int {
+	fs := flag.NewFlagSet("export rc.d", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	binary := fs.String("binary", "/usr/local/bin/tut", "Path of the tut binary")
+	goos := "freebsd"
+	if runtime.GOOS == "openbsd" {
+		goos = runtime.GOOS
+	}
+	system := fs.String("os", goos, "freebsd or openbsd")
+	_ = fs.Parse(args)
+
+	if abs, err := filepath.Abs(*configPath); err == nil && *configPath != envConfigPath && !strings.HasPrefix(*configPath, uciConfigPrefix) {
+		*configPath = abs
+	}
+	switch *system {
+	case "freebsd":
+		fmt.Print(freebsdRCScript(*binary, *configPath))
+	case "openbsd":
+		fmt.Print(openbsdRCScript(*binary, *configPath))
+	default:
+		die("unknown -os %q (freebsd or openbsd)", *system)
+	}
+	return 0
+}
+
+// freebsdRCScript renders /usr/local/etc/rc.d/tut. pidfile is the one of
+// daemon(8), which rc.subr stops; reload signals tut itself.
+func freebsdRCScript(binary, configPath string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n#\n")
+	b.WriteString("# PROVIDE: tut\n")
+	b.WriteString("# REQUIRE: NETWORKING\n")
+	b.WriteString("# KEYWORD: shutdown\n#\n")
+	b.WriteString("# TUT - TCP UDP Tunnel, generated by tut export rc.d\n")
+	b.WriteString("# Enable with: sysrc tut_enable=YES\n\n")
+	b.WriteString(". /etc/rc.subr\n\n")
+	b.WriteString("name=\"tut\"\n")
+	b.WriteString("rcvar=\"tut_enable\"\n\n")
+	b.WriteString("load_rc_config $name\n")
+	b.WriteString(": ${tut_enable:=\"NO\"}\n")
+	fmt.Fprintf(&b, ": ${tut_config:=%q}\n\n", configPath)
+	b.WriteString("pidfile=\"/var/run/${name}.pid\"\n")
+	b.WriteString("child_pidfile=\"/var/run/${name}_child.pid\"\n")
+	b.WriteString("command=\"/usr/sbin/daemon\"\n")
+	// restart after 2s like the systemd unit; output goes to syslog
+	fmt.Fprintf(&b, "command_args=\"-R 2 -P ${pidfile} -p ${child_pidfile} -S -T ${name} %s -config ${tut_config}\"\n", binary)
+	b.WriteString("extra_commands=\"reload\"\n")
+	b.WriteString("reload_cmd=\"${name}_reload\"\n\n")
+	b.WriteString("tut_reload()\n{\n")
+	b.WriteString("\tkill -HUP $(cat ${child_pidfile})\n")
+	b.WriteString("}\n\n")
+	b.WriteString("run_rc_command \"$1\"\n")
+	return b.String()
+}
+
+// openbsdRCScript renders /etc/rc.d/tut. rc.subr reloads with SIGHUP and
+// daemon_logger sends the output to syslog.
+func openbsdRCScript(binary, configPath string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/ksh\n#\n")
+	b.WriteString("# TUT - TCP UDP Tunnel, generated by tut export rc.d\n")
+	b.WriteString("# Enable with: rcctl enable tut\n\n")
+	fmt.Fprintf(&b, "daemon=%q\n", binary)
+	fmt.Fprintf(&b, "daemon_flags=%q\n", "-config "+configPath)
+	b.WriteString("daemon_logger=\"daemon.info\"\n\n")
+	b.WriteString(". /etc/rc.d/rc.subr\n\n")
+	b.WriteString("rc_bg=YES\n\n")
+	b.WriteString("rc_cmd $1\n")
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ssh tries the addresses of a host one after another, each until
+// ConnectTimeout, so a VPS with an AAAA record on a network with broken
+// IPv6 stalls every reconnect. With vps.address_family auto, tut races
+// the addresses of both families itself the way RFC 8305 (Happy Eyeballs)
+// describes and tells ssh the family that connected first.
+
+const (
+	// eyeballsDelay is the head start of each attempt over the next
+	// ("Connection Attempt Delay" of RFC 8305).
+	eyeballsDelay = 250 * time.Millisecond
+	// eyeballsTimeout bounds the whole race.
+	eyeballsTimeout = 10 * time.Second
+)
+
+// vpsFamily is the address family that won the last race: "inet6",
+// "inet" or empty to leave the choice to ssh.
+var vpsFamily struct {
+	sync.Mutex
+	name string
+}
+
+// addressFamily returns the AddressFamily ssh is to use for cfg, empty for
+// its default.
+func addressFamily(cfg *Config) string {
+	switch cfg.VPS.AddressFamily {
+	case "inet", "inet6":
+		return cfg.VPS.AddressFamily
+	case "auto":
+		vpsFamily.Lock()
+		defer vpsFamily.Unlock()
+		return vpsFamily.name
+	}
+	return ""
+}
+
+// pickAddressFamily races the addresses of the VPS and records the family
+// of the winner for the SSH sessions that follow.
+func pickAddressFamily(ctx context.Context, cfg *Config) {
+	family, err := raceAddresses(ctx, vpsDialer(cfg, "tcp"), cfg.VPS.Host, sshPort(cfg))
+	if err != nil {
+		logEvent(levelWarn, "", "address-race-failed", "No address of %s answered: %v", cfg.VPS.Host, err)
+	}
+	vpsFamily.Lock()
+	changed := family != vpsFamily.name
+	vpsFamily.name = family
+	vpsFamily.Unlock()
+	if changed && family != "" {
+		logEvent(levelInfo, "", "address-family", "Connecting to %s over %s, which answered first", cfg.VPS.Host, map[string]string{"inet6": "IPv6", "inet": "IPv4"}[family])
+	}
+}
+
+// raceAddresses connects to port on the addresses of host, IPv6 and IPv4
+// interleaved and each attempt started eyeballsDelay after the previous
+// one unless that one failed already, and returns the family of the first
+// connection. It returns an empty family, and does not connect, when host
+// has addresses of one family only.
+func raceAddresses(ctx context.Context, d *net.Dialer, host string, port int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, eyeballsTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	var v6, v4 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP)
+		} else {
+			v6 = append(v6, a.IP)
+		}
+	}
+	if len(v6) == 0 || len(v4) == 0 {
+		return "", nil
+	}
+	var order []net.IP
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			order = append(order, v6[i])
+		}
+		if i < len(v4) {
+			order = append(order, v4[i])
+		}
+	}
+	return raceIPs(ctx, d, order, port)
+}
+
+// raceIPs connects to port on the addresses in order, staggered by
+// eyeballsDelay, and returns the family of the first that connects.
+func raceIPs(ctx context.Context, d *net.Dialer, order []net.IP, port int) (string, error) {
+	type result struct {
+		ip  net.IP
+		err error
+	}
+	results := make(chan result, len(order))
+	started, failed := 0, 0
+	var lastErr error
+	next := time.NewTimer(0)
+	defer next.Stop()
+	for failed < len(order) {
+		select {
+		case <-next.C:
+			if started == len(order) {
+				continue
+			}
+			ip := order[started]
+			started++
+			go func() {
+				c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+				if err == nil {
+					_ = c.Close()
+				}
+				results <- result{ip, err}
+			}()
+			next.Reset(eyeballsDelay)
+		case r := <-results:
+			if r.err == nil {
+				if r.ip.To4() != nil {
+					return "inet", nil
+				}
+				return "inet6", nil
+			}
+			failed++
+			lastErr = r.err
+			// a failed attempt lets the next one start right away
+			if started < len(order) {
+				next.Reset(0)
+			}
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no addresses")
+	}
+	return "", lastErr
+}
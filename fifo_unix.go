@@ -7,6 +7,9 @@ import (
 	"syscall"
 )
 
+// fifoSupported reports whether local UDP wrappers can use FIFOs.
+const fifoSupported = true
+
 // createFIFO creates a named pipe (FIFO) at the specified path.
 // It removes any existing file at that path first.
 func createFIFO(path string) error {
@@ -4,6 +4,10 @@ package main
 
 import "fmt"
 
+// fifoSupported is false: Windows has no FIFOs, which the local socat
+// wrappers of UDP forwards need.
+const fifoSupported = false
+
 // createFIFO is not supported on Windows.
 // Named pipes (FIFOs) are a Unix-specific feature.
 func createFIFO(path string) error {
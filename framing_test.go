@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// TestFramingKeepsDatagrams runs the sweep of "tut debug udp-sim" through
+// a forward with framing: length while the wrap stream is cut and joined
+// at random: every datagram that arrives must arrive whole and in order.
+func TestFramingKeepsDatagrams(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends datagrams of every size through a simulated forward")
+	}
+	results, err := simulateUDP(true, 8, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(udpSimSizes) {
+		t.Fatalf("got %d results, want one per size (%d)", len(results), len(udpSimSizes))
+	}
+	for _, r := range results {
+		if !r.ok() {
+			t.Errorf("size %d: %d damaged, %d reordered of %d", r.Size, r.Damaged, r.Reordered, r.Sent)
+		}
+		if r.Intact == 0 {
+			t.Errorf("size %d: nothing arrived", r.Size)
+		}
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		stream  []byte
+		want    []string
+		wantErr bool
+	}{
+		{"empty frame", []byte{0, 0}, []string{""}, false},
+		{"two frames", []byte{0, 2, 'h', 'i', 0, 1, '!'}, []string{"hi", "!"}, false},
+		{"truncated length", []byte{0}, nil, true},
+		{"truncated payload", []byte{0, 3, 'a', 'b'}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(bytes.NewReader(tc.stream), 2+0xFFFF)
+			var got []string
+			for range tc.want {
+				b, err := readFrame(br)
+				if err != nil {
+					t.Fatalf("readFrame: %v", err)
+				}
+				got = append(got, string(b))
+			}
+			if tc.wantErr {
+				if _, err := readFrame(br); err == nil {
+					t.Fatal("readFrame of a truncated frame succeeded")
+				}
+				return
+			}
+			for i := range tc.want {
+				if got[i] != tc.want[i] {
+					t.Errorf("frame %d = %q, want %q", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway asks route(8) for the IPv4 default route.
+func defaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "-inet", "default").Output()
+	if err != nil {
+		return nil, errors.New("no IPv4 default route")
+	}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		// "    gateway: 192.168.1.1"
+		key, value, ok := strings.Cut(strings.TrimSpace(sc.Text()), ":")
+		if !ok || key != "gateway" {
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no IPv4 default route")
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultGateway reads the IPv4 default route from /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Iface Destination Gateway ..., addresses printed as host-order integers
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.NativeEndian.PutUint32(ip, uint32(v))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no IPv4 default route")
+}
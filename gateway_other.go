@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// defaultGateway is only detected on Linux and the BSDs; elsewhere set
+// direct.gateway.
+func defaultGateway() (net.IP, error) {
+	return nil, errors.New("cannot detect the default gateway, set direct.gateway")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A tunnel that backs up a VPN must not itself run through that VPN: when
+// the VPN fails, the backup goes down with it. vps.avoid_routes lists
+// interfaces and subnets the connection to the VPS must not use. Before
+// each session tut looks up the route the system picks and refuses to
+// connect while it matches one of them; with roaming on, the tunnel comes
+// up as soon as the route changes.
+
+// validateAvoidRoutes checks that every entry of vps.avoid_routes is an
+// interface name or a CIDR.
+func validateAvoidRoutes(c *Config) error {
+	for _, a := range c.VPS.AvoidRoutes {
+		if strings.Contains(a, "/") {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("invalid vps.avoid_routes entry %q: %w", a, err)
+			}
+		} else if !validName(a) {
+			return fmt.Errorf("invalid vps.avoid_routes entry %q (an interface or a CIDR)", a)
+		}
+	}
+	return nil
+}
+
+// checkAvoidRoutes returns an error when the route to the VPS uses an
+// interface, or a local address or gateway in a subnet, of
+// vps.avoid_routes.
+func checkAvoidRoutes(cfg *Config) error {
+	if len(cfg.VPS.AvoidRoutes) == 0 {
+		return nil
+	}
+	r, err := lookupRoute(cfg)
+	if err != nil {
+		return nil // no route: ssh reports that better
+	}
+	if a := avoidedBy(cfg.VPS.AvoidRoutes, r); a != "" {
+		return fmt.Errorf("the route to %s (%s) goes through %s, which vps.avoid_routes excludes", cfg.VPS.Host, r, a)
+	}
+	return nil
+}
+
+// avoidedBy returns the entry of avoid that r matches, if any.
+func avoidedBy(avoid []string, r vpsRoute) string {
+	for _, a := range avoid {
+		if _, network, err := net.ParseCIDR(a); err == nil {
+			if network.Contains(r.local) || r.gateway != nil && network.Contains(r.gateway) {
+				return a
+			}
+		} else if a == r.iface {
+			return a
+		}
+	}
+	return ""
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Two hosts can run tut for the same services as an HA pair. With
+// ha.group set, they elect a leader through a lock on the VPS: each keeps
+// "tut agent lock" running there in an SSH session of its own, and only
+// the one whose agent holds the lock opens the tunnel and binds the public
+// ports. The others stay on standby with their relays and wrappers ready.
+//
+// The lock is an flock on a file next to the agent, held by the agent as
+// long as it hears from its node: the node pings every third of
+// ha.lease and the agent lets go a lease after the last ping. A
+// leader that gets no answer within a third of the lease steps down, which
+// is before its agent lets go, so two leaders never overlap. A standby
+// takes over within about a lease and a third after the leader is gone.
+
+// HAConfig sets up leader election between hosts serving the same forwards.
+type HAConfig struct {
+	Group string   `yaml:"group"` // lock name on the VPS, empty: no election
+	Node  string   `yaml:"node"`  // this host in messages, default: the hostname
+	Lease Duration `yaml:"lease"` // how long the lock outlives its holder
+	Drain Duration `yaml:"drain"` // a handover keeps the old session this long, see handover.go
+}
+
+// haRetry is the pause before the election session is opened again.
+const haRetry = 2 * time.Second
+
+// validateHA checks the ha section.
+func validateHA(c *Config) error {
+	if c.HA.Group == "" {
+		return nil
+	}
+	if !validName(c.HA.Group) {
+		return fmt.Errorf("invalid ha.group: %q", c.HA.Group)
+	}
+	if !validName(c.HA.Node) {
+		return fmt.Errorf("invalid ha.node: %q", c.HA.Node)
+	}
+	if c.HA.Lease.D() < 3*time.Second {
+		return fmt.Errorf("invalid ha.lease: %s (at least 3s)", c.HA.Lease)
+	}
+	if c.HA.Drain < 0 {
+		return fmt.Errorf("invalid ha.drain: %s", c.HA.Drain)
+	}
+	return nil
+}
+
+// election tracks whether this node may run the tunnel.
+type election struct {
+	leader    atomic.Bool
+	wake      chan struct{} // signalled when this node becomes leader or is offered a handover
+	offered   atomic.Bool   // the leader hands over, see handover.go
+	takeover  atomic.Bool   // this node is taking over from the leader
+	releasing atomic.Bool   // this node handed over and let go of the lock
+
+	mu       sync.Mutex
+	holder   string   // node holding the lock as last reported, for messages
+	peer     []string // the node taking over and how far it got, as the leader hears it
+	outbox   []string // commands for the lock agent, sent instead of pings
+	handover string   // progress of a handover from this node, for the API
+}
+
+// send queues a command for the lock agent.
+func (e *election) send(command string) {
+	e.mu.Lock()
+	e.outbox = append(e.outbox, command)
+	e.mu.Unlock()
+}
+
+// next returns the next line for the lock agent.
+func (e *election) next() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.outbox) == 0 {
+		return "ping"
+	}
+	line := e.outbox[0]
+	e.outbox = e.outbox[1:]
+	return line
+}
+
+func (e *election) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// isStandby reports whether this node must leave the tunnel to another.
+func (d *daemon) isStandby() bool {
+	return d.config().HA.Group != "" && !d.ha.leader.Load()
+}
+
+// waitLeader blocks until this node may run the tunnel or is to take it
+// over, and reports false when ctx is cancelled first.
+func (d *daemon) waitLeader(ctx context.Context) bool {
+	for d.isStandby() && !d.ha.takeover.Load() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-d.ha.wake:
+		}
+	}
+	return true
+}
+
+// runElection takes part in the leader election until ctx is cancelled.
+func runElection(ctx context.Context, d *daemon) {
+	if d.config().HA.Group == "" {
+		return
+	}
+	for {
+		err := d.electOnce(ctx)
+		d.stepDown()
+		if ctx.Err() != nil {
+			return
+		}
+		logEvent(levelWarn, "", "ha-failed", "Leader election session ended: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(haRetry):
+		}
+	}
+}
+
+// electOnce runs the lock agent on the VPS and follows its answers until
+// the session ends or does not answer in time.
+func (d *daemon) electOnce(ctx context.Context) error {
+	cfg := d.config()
+	if err := ensureAgent(ctx, cfg); err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lease := cfg.HA.Lease.D()
+	base, target := sshBaseArgs(cfg)
+	lock := fmt.Sprintf("%s agent lock -file %s -node %s -lease %d", shellQuote(cfg.Agent.Path),
+		shellQuote(agentDir(cfg)+"/leader-"+cfg.HA.Group+".lock"), shellQuote(cfg.HA.Node), cfg.HA.Lease.Seconds())
+	cmd := sshExec(ctx, cfg, append(base, "-o", "ConnectTimeout=15", target, lock)...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() { _ = cmd.Wait() }()
+	defer cancel()
+
+	answers := make(chan string)
+	go func() {
+		defer close(answers)
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			answers <- sc.Text()
+		}
+	}()
+	for {
+		sent := time.Now()
+		if _, err := io.WriteString(stdin, d.ha.next()+"\n"); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case answer, ok := <-answers:
+			if !ok {
+				return errors.New("the lock agent exited")
+			}
+			d.elected(answer)
+		case <-time.After(lease / 3):
+			return errors.New("the lock agent did not answer in time")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(sent.Add(lease / 3))):
+		}
+	}
+}
+
+// elected acts on an answer of the lock agent: "leader [<node> <state>]"
+// with the progress of a node taking over, or "standby <holder>
+// [handover]" when the holder hands over.
+func (d *daemon) elected(answer string) {
+	fields := strings.Fields(answer)
+	if len(fields) == 0 {
+		return
+	}
+	if fields[0] == "leader" {
+		d.ha.mu.Lock()
+		d.ha.peer = fields[1:]
+		d.ha.mu.Unlock()
+		if d.ha.releasing.Load() {
+			return // answer to a ping sent before the release
+		}
+		if !d.ha.leader.Swap(true) {
+			if d.ha.takeover.Load() {
+				logEvent(levelInfo, "", "ha-leader", "This node (%s) took over and is the leader", d.config().HA.Node)
+			} else {
+				logEvent(levelInfo, "", "ha-leader", "This node (%s) is the leader; opening the tunnel", d.config().HA.Node)
+			}
+			d.ha.notify()
+			d.syncSessions()
+		}
+		return
+	}
+	d.ha.releasing.Store(false)
+	holder := "-"
+	if len(fields) > 1 {
+		holder = fields[1]
+	}
+	offered := len(fields) > 2 && fields[2] == "handover"
+	d.ha.offered.Store(offered)
+	if offered && !d.ha.takeover.Swap(true) {
+		logEvent(levelInfo, "", "ha-takeover", "%s hands over; taking over the public ports", holder)
+		d.ha.notify()
+	}
+	if holder == "-" {
+		holder = ""
+	}
+	d.stepDown()
+	d.ha.mu.Lock()
+	changed := d.ha.holder != holder
+	d.ha.holder = holder
+	d.ha.mu.Unlock()
+	if changed {
+		logEvent(levelInfo, "", "ha-standby", "Standing by: %s holds the lock", orNone(holder))
+	}
+}
+
+// stepDown closes the tunnel when this node was the leader.
+func (d *daemon) stepDown() {
+	if !d.ha.leader.Swap(false) {
+		return
+	}
+	d.ha.mu.Lock()
+	d.ha.holder = ""
+	d.ha.mu.Unlock()
+	logEvent(levelWarn, "", "ha-stepped-down", "This node is no longer the leader; closing the tunnel")
+	d.restartSession()
+	d.extras.stop()
+}
+
+// haRole describes the part of this node in the election.
+func (d *daemon) haRole() string {
+	switch {
+	case d.config().HA.Group == "":
+		return ""
+	case d.ha.leader.Load():
+		return "leader"
+	}
+	return "standby"
+}
+
+// runAgentLock implements "tut agent lock", run on the VPS: it holds the
+// lock file for its node while commands arrive on stdin, answering each as
+// elected expects, and exits a lease after the last one. Commands besides
+// ping drive a handover: the leader announces it (handover), the node
+// taking over reports its progress (ready, taken) and the leader lets go
+// of the lock (release) or calls it off (abort). The files next to the
+// lock file tell the agents of the other nodes.
+func runAgentLock(args []string) int {
+	fs := flag.NewFlagSet("agent lock", flag.ExitOnError)
+	file := fs.String("file", "", "Lock file")
+	node := fs.String("node", "", "Name of the node")
+	leaseSecs := fs.Int("lease", 10, "Seconds the lock is kept after the last ping")
+	_ = fs.Parse(args)
+	if *file == "" || *node == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent lock -file path -node name [-lease seconds]")
+		return 2
+	}
+	f, err := os.OpenFile(*file, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	handoverFile, readyFile := *file+".handover", *file+".ready"
+	readyBy := func() []string {
+		b, _ := os.ReadFile(readyFile)
+		return strings.Fields(string(b))
+	}
+	// a node that went away cannot take over anymore
+	defer func() {
+		if r := readyBy(); len(r) > 0 && r[0] == *node {
+			_ = os.Remove(readyFile)
+		}
+	}()
+	lease := time.Duration(*leaseSecs) * time.Second
+	commands := make(chan string)
+	go func() {
+		defer close(commands)
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			commands <- sc.Text()
+		}
+	}()
+	held := false
+	for {
+		var command string
+		select {
+		case c, ok := <-commands:
+			if !ok {
+				return 0 // the node went away; exiting releases the lock
+			}
+			command = c
+		case <-time.After(lease):
+			return 0
+		}
+		switch command {
+		case "handover":
+			if held {
+				_ = os.WriteFile(handoverFile, []byte(*node), 0o600)
+			}
+		case "ready", "taken":
+			_ = os.WriteFile(readyFile, []byte(*node+" "+command), 0o600)
+		case "abort":
+			if held {
+				_ = os.Remove(handoverFile)
+				_ = os.Remove(readyFile)
+			}
+		case "release":
+			if held {
+				// the node taking over must not see the handover called
+				// off before the lock is free
+				_ = f.Truncate(0)
+				unlock(f)
+				_ = os.Remove(handoverFile)
+				held = false
+			}
+		}
+		// after a release the lock is left to the node taking over
+		if r := readyBy(); !held && (len(r) == 0 || r[0] == *node) {
+			if held, err = tryLock(f); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				return 1
+			}
+			if held {
+				_ = f.Truncate(0)
+				_, _ = f.WriteAt([]byte(*node), 0)
+				_ = os.Remove(handoverFile)
+				_ = os.Remove(readyFile)
+			}
+		}
+		if held {
+			fmt.Println(strings.Join(append([]string{"leader"}, readyBy()...), " "))
+			continue
+		}
+		holder, _ := os.ReadFile(*file)
+		answer := []string{"standby", "-"}
+		if h := strings.Fields(string(holder)); len(h) > 0 {
+			answer[1] = h[0]
+		}
+		if _, err := os.Stat(handoverFile); err == nil {
+			answer = append(answer, "handover")
+		}
+		fmt.Println(strings.Join(answer, " "))
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// "tut handover" hands the tunnel of an HA pair (see ha.go) from the leader
+// to a standby for planned maintenance, without the public ports going
+// away. The leader announces the handover through its lock agent; a
+// standby opens an SSH connection without forwards and says it is ready.
+// The leader then cancels its remote forwards one by one while the standby
+// keeps requesting each until it gets it, so a port is only unbound for
+// the moment between the two. Once the standby holds every port, the
+// leader keeps its session for ha.drain so the connections it
+// carries can finish, closes it and lets go of the lock, and the standby
+// becomes the leader and starts the remote script. The UDP forwards are
+// carried to the new leader through the moved wrap ports; their VPS side
+// restarts with the remote script, which pauses them for a moment, like
+// the forwards of further vps.sessions and mirrors, which are reconnected.
+
+const (
+	// handoverTimeout bounds each step of a handover.
+	handoverTimeout = time.Minute
+	// takeoverRetry is how often the node taking over requests a port
+	// that is still bound by the leader.
+	takeoverRetry = 50 * time.Millisecond
+)
+
+// setHandover records the progress of a handover for the API.
+func (d *daemon) setHandover(state string) {
+	d.ha.mu.Lock()
+	d.ha.handover = state
+	d.ha.mu.Unlock()
+}
+
+func (d *daemon) handoverState() string {
+	d.ha.mu.Lock()
+	defer d.ha.mu.Unlock()
+	return d.ha.handover
+}
+
+// startHandover starts handing the tunnel over to a standby.
+func (d *daemon) startHandover(ctx context.Context) error {
+	if d.haRole() != "leader" {
+		return errors.New("this node is not the leader")
+	}
+	d.ha.mu.Lock()
+	defer d.ha.mu.Unlock()
+	if d.ha.handover != "" && !strings.HasPrefix(d.ha.handover, "done") && !strings.HasPrefix(d.ha.handover, "failed") {
+		return errors.New("a handover is already running")
+	}
+	d.ha.handover = "waiting for a standby"
+	go d.handover(ctx)
+	return nil
+}
+
+// handover is the leader's side of a handover.
+func (d *daemon) handover(ctx context.Context) {
+	cfg := d.config()
+	fail := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		d.ha.send("abort")
+		d.setHandover("failed: " + msg)
+		logEvent(levelWarn, "", "ha-handover-failed", "Handover failed: %s", msg)
+	}
+	logEvent(levelInfo, "", "ha-handover", "Handing the tunnel over to a standby")
+	d.ha.send("handover")
+	peer, ok := d.waitPeer(ctx, "ready")
+	if !ok {
+		fail("no standby got ready within %s", handoverTimeout)
+		return
+	}
+
+	// no reload or rotation may add the forwards back from here on
+	d.applyMu.Lock()
+	defer d.applyMu.Unlock()
+	d.setHandover("moving the public ports to " + peer)
+	ctl := controlPath()
+	var moved []remoteForward
+	for _, f := range sessionForwards(d.st.withLeases(cfg), d.relaySnapshot(), 0) {
+		if _, err := sshControlAt(cfg, ctl, "cancel", f.spec); err != nil {
+			logEvent(levelWarn, f.name, "", "Cannot cancel %s for the handover: %v", f.spec, err)
+			continue
+		}
+		moved = append(moved, f)
+	}
+	if _, ok := d.waitPeer(ctx, "taken"); !ok {
+		for _, f := range moved {
+			if _, err := sshControlAt(cfg, ctl, "forward", f.spec); err != nil {
+				logEvent(levelWarn, f.name, "", "Cannot restore %s: %v", f.spec, err)
+			}
+		}
+		fail("%s did not take the ports over within %s", peer, handoverTimeout)
+		return
+	}
+
+	d.setHandover(fmt.Sprintf("draining for %s", cfg.HA.Drain))
+	logEvent(levelInfo, "", "ha-draining", "%s holds the public ports; closing this session in %s", peer, cfg.HA.Drain)
+	select {
+	case <-ctx.Done():
+	case <-time.After(cfg.HA.Drain.D()):
+	}
+	d.ha.releasing.Store(true)
+	d.ha.leader.Store(false)
+	d.restartSession()
+	d.extras.stop()
+	d.ha.send("release")
+	d.setHandover("done: " + peer + " took over")
+	logEvent(levelInfo, "", "ha-handed-over", "Handed the tunnel over to %s; standing by", peer)
+}
+
+// waitPeer waits until the lock agent reports a node taking over that got
+// to state, and returns the node.
+func (d *daemon) waitPeer(ctx context.Context, state string) (string, bool) {
+	deadline := time.After(handoverTimeout)
+	for {
+		d.ha.mu.Lock()
+		peer := d.ha.peer
+		d.ha.mu.Unlock()
+		if len(peer) == 2 && peer[1] == state {
+			return peer[0], true
+		}
+		if !d.ha.leader.Load() {
+			return "", false
+		}
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-deadline:
+			return "", false
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// takeOver is the standby's side of a handover: it opens the main session
+// without forwards, takes the remote forwards over as the leader lets go
+// of them and runs the session like runTunnel once it is the leader.
+func (d *daemon) takeOver(ctx context.Context) error {
+	defer d.ha.takeover.Store(false)
+	cfg, relays, st := d.config(), d.relaySnapshot(), d.st
+	script, err := d.prepareSession(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	runRemoteCommands(ctx, cfg, "pre", cfg.Remote.PreCommands)
+	defer d.runPostCommands(cfg)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mu.Lock()
+	d.cancelSession = cancel
+	d.restart = false
+	d.mu.Unlock()
+	defer d.sessionUp.Store(false)
+
+	base, target := sshBaseArgs(cfg)
+	ctl := newControlPath("h")
+	args := append(append([]string{}, base...), "-o", "ControlMaster=yes", "-o", "ControlPath="+ctl, "-N", target)
+	stderr, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to start SSH: %w", err)
+	}
+	cmd := d.sshCommand(ctx, true, args, w)
+	if err := cmd.Start(); err != nil {
+		_ = stderr.Close()
+		_ = w.Close()
+		return fmt.Errorf("failed to start SSH: %w", err)
+	}
+	d.mu.Lock()
+	d.sshPid = cmd.Process.Pid
+	d.sshStderr = stderr
+	d.mu.Unlock()
+	output := make(chan struct{})
+	go func() {
+		watchSSHOutput(stderr, cfg, relays, st, d.punchers)
+		close(output)
+	}()
+	defer func() {
+		cancel()
+		_ = w.Close()
+		<-output
+	}()
+	s := sshSession{cmd: cmd, done: waitFor(cmd), ctl: ctl}
+	if err := waitMaster(ctx, cfg, s); err != nil {
+		return err
+	}
+	d.ha.send("ready")
+
+	pending := sessionForwards(st.withLeases(cfg), relays, 0)
+	for len(pending) > 0 {
+		var left []remoteForward
+		for _, f := range pending {
+			if _, err := sshControlAt(cfg, ctl, "forward", f.spec); err != nil {
+				left = append(left, f)
+			}
+		}
+		pending = left
+		if len(pending) == 0 {
+			break
+		}
+		if !d.ha.offered.Load() && !d.ha.leader.Load() {
+			return errors.New("the leader called the handover off")
+		}
+		select {
+		case err := <-s.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(takeoverRetry):
+		}
+	}
+	d.ha.send("taken")
+	setControlPath(ctl)
+	logEvent(levelInfo, "", "ha-taken", "Holding the public ports; waiting for the leader to let go of the lock")
+	for !d.ha.leader.Load() {
+		select {
+		case err := <-s.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	d.sessionUp.Store(true)
+	d.failStreak.Store(0)
+	logEvent(levelInfo, "", "tunnel-up", "SSH tunnel taken over")
+	publishForwardsUp(mainSession(st.withLeases(cfg)))
+	st.markGood(cfg)
+	st.saveOrLog()
+	r := d.mainRotation(script, w)
+	go d.runScript(ctx, cfg, s, r)
+	return d.superviseSession(ctx, cfg, s, r)
+}
+
+// apiHandover starts a handover on POST /v1/handover.
+func (d *daemon) apiHandover(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if err := d.startHandover(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	logEvent(levelInfo, "", "handover-requested", "Handover requested through the API (token %s)", caller(req).Name)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// runHandoverCommand implements "tut handover": it asks the running leader
+// to hand over and follows the handover until it is done.
+func runHandoverCommand(args []string) int {
+	fs := flag.NewFlagSet("handover", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if cfg.HA.Group == "" {
+		die("tut handover needs leader election (ha.group)")
+	}
+	if cfg.API.Listen == "off" {
+		die("tut handover needs the API, which is off (api.listen)")
+	}
+	token := apiClientToken(cfg.API, true)
+	if err := apiRequest(cfg, token, http.MethodPost, "/v1/handover", nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot start the handover: %v\n", err)
+		return 1
+	}
+	last := ""
+	for {
+		var st struct {
+			Handover string `json:"ha_handover"`
+		}
+		if err := apiRequest(cfg, token, http.MethodGet, "/v1/status", &st); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot reach tut at %s: %v\n", cfg.API.Listen, err)
+			return 1
+		}
+		if st.Handover != last {
+			fmt.Println(st.Handover)
+			last = st.Handover
+		}
+		switch {
+		case strings.HasPrefix(last, "done"):
+			return 0
+		case strings.HasPrefix(last, "failed"):
+			return 1
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// stallCheckInterval is how often forward traffic counters are sampled.
+const stallCheckInterval = 5 * time.Second
+
+// watchStalls samples the traffic counters of every forward and detects
+// half-open forwards: forwards that carried traffic but went silent while
+// clients are still connected. Such forwards are actively probed and, if the
+// probe fails, their connections are reset so clients reconnect through a
+// working path. The rest of the tunnel is left untouched.
+func watchStalls(ctx context.Context, d *daemon) {
+	// last activity stamp each forward was probed at, so a silent forward
+	// is probed once per period of silence rather than on every tick
+	probed := make(map[string]int64)
+
+	ticker := time.NewTicker(stallCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cfg := d.config()
+		if cfg.Health.StallTimeout <= 0 {
+			continue
+		}
+		stall := cfg.Health.StallTimeout.D()
+		timeout := cfg.Health.ProbeTimeout.D()
+		for name, r := range d.relaySnapshot() {
+			last := r.stats.lastActivity.Load()
+			if last == 0 || r.stats.active.Load() == 0 || probed[name] == last {
+				continue
+			}
+			idle := monoSince(last)
+			if idle < stall {
+				continue
+			}
+			probed[name] = last
+			err := probeForward(ctx, cfg, name, r, timeout)
+			if err == nil {
+				r.stats.probeFailed.Store(0)
+				logEvent(levelInfo, name, "probe-ok", "idle for %s with %d connection(s); probe OK", idle.Round(time.Second), r.stats.active.Load())
+				continue
+			}
+			r.stats.probeFailed.Store(monoNow())
+			n := r.resetConns()
+			logEvent(levelWarn, name, "probe-failed", "idle for %s and probe failed (%v); reset %d socket(s) to force reconnect", idle.Round(time.Second), err, n)
+		}
+	}
+}
+
+// probeForward checks that the forward named name still works end to end.
+// TCP forwards with a fixed public port are probed by connecting to that port
+// on the VPS and waiting for the connection to arrive at the relay. UDP
+// forwards cannot be probed without injecting datagrams into the service, so
+// they (and auto-port forwards) probe the SSH session carrying them instead.
+func probeForward(ctx context.Context, cfg *Config, name string, r *relay, timeout time.Duration) error {
+	for _, f := range cfg.TCPForwards {
+		if f.Name == name && f.RemotePort != 0 {
+			return probeTCP(cfg, f.RemotePort, r, timeout)
+		}
+	}
+	return probeSession(ctx, cfg, timeout)
+}
+
+// probeTCP dials port on the VPS and waits until the relay accepts a new
+// connection.
+func probeTCP(cfg *Config, port int, r *relay, timeout time.Duration) error {
+	before := r.stats.accepted.Load()
+	dialer := vpsDialer(cfg, "tcp")
+	dialer.Timeout = timeout
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if r.stats.accepted.Load() > before {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New("probe connection did not arrive through the tunnel")
+}
+
+// probeSession runs a no-op command over the existing SSH control connection,
+// which requires a full round trip through the tunnel transport.
+func probeSession(ctx context.Context, cfg *Config, timeout time.Duration) error {
+	if err := remoteCommand(ctx, cfg, timeout, "true"); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New("session probe timed out")
+		}
+		return err
+	}
+	return nil
+}
+
+// remoteCommand runs command on the VPS over the SSH control connection.
+func remoteCommand(ctx context.Context, cfg *Config, timeout time.Duration, command string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd, err := remoteCmd(ctx, cfg, command)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// remoteCmd prepares command to run on the VPS over the SSH control
+// connection.
+func remoteCmd(ctx context.Context, cfg *Config, command string) (*exec.Cmd, error) {
+	path := controlPath()
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no control connection: %w", err)
+	}
+	target := fmt.Sprintf("%s@%s", cfg.VPS.User, cfg.VPS.Host)
+	return sshExec(ctx, cfg, "-o", "ControlMaster=no", "-o", "ControlPath="+path, "-o", "BatchMode=yes", target, command), nil
+}
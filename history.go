@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The traffic counters of the relays are sampled every second into a short
+// in-memory history per forward (memory.history), which the API
+// serves to "tut top".
+
+const historyInterval = time.Second
+
+// rateSample is the throughput of a forward during one interval.
+type rateSample struct {
+	At     time.Time `json:"at"`
+	InBps  int64     `json:"in_bps"`  // bytes per second from the tunnel
+	OutBps int64     `json:"out_bps"` // bytes per second into the tunnel
+}
+
+// trafficHistory holds the recent samples of every forward.
+type trafficHistory struct {
+	mu      sync.Mutex
+	samples map[string][]rateSample // oldest first
+}
+
+// snapshot returns a copy of the samples of every forward.
+func (h *trafficHistory) snapshot() map[string][]rateSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	m := make(map[string][]rateSample, len(h.samples))
+	for name, s := range h.samples {
+		m[name] = append([]rateSample(nil), s...)
+	}
+	return m
+}
+
+// record samples the relays of d every historyInterval, keeping length
+// samples per forward.
+func (h *trafficHistory) record(ctx context.Context, d *daemon, length int) {
+	type counters struct{ in, out int64 }
+	last := make(map[*relay]counters)
+	prev := time.Now()
+	ticker := time.NewTicker(historyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		secs := now.Sub(prev).Seconds()
+		prev = now
+		relays := d.relaySnapshot()
+		current := make(map[*relay]counters, len(relays))
+		h.mu.Lock()
+		if h.samples == nil {
+			h.samples = make(map[string][]rateSample)
+		}
+		for name, r := range relays {
+			c := counters{r.stats.bytesIn.Load(), r.stats.bytesOut.Load()}
+			current[r] = c
+			p := last[r]
+			s := append(h.samples[name], rateSample{
+				At:     now,
+				InBps:  int64(float64(c.in-p.in) / secs),
+				OutBps: int64(float64(c.out-p.out) / secs),
+			})
+			if len(s) > length {
+				s = s[len(s)-length:]
+			}
+			h.samples[name] = s
+		}
+		// forget forwards that were removed
+		for name := range h.samples {
+			if _, ok := relays[name]; !ok {
+				delete(h.samples, name)
+			}
+		}
+		h.mu.Unlock()
+		last = current
+	}
+}
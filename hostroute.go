@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With host_routing, one public port on the VPS serves any number of TCP
+// forwards: the agent takes the port and reads the name each client asks
+// for, the SNI of its TLS ClientHello or the Host header of its first HTTP
+// request, and hands the connection, those first bytes included, to the
+// forward of the route matching the name. A route's host is a name or
+// *.domain, which matches every name below domain, so one wildcard DNS
+// record is all the forwards need. Exact names win over wildcards, and
+// longer wildcards over shorter ones. The forwards named in routes bind
+// their remote_port on the loopback interface of the VPS, where the agent
+// connects to them; TLS stays end to end unless the forward has remote_tls.
+
+// errSNIRead ends the handshake once the ClientHello is read.
+var errSNIRead = errors.New("ClientHello read")
+
+// validateHostRouting checks host_routing.
+func validateHostRouting(c *Config) error {
+	h := c.HostRouting
+	if h.Port == 0 {
+		if len(h.Routes) > 0 {
+			return errors.New("host_routing.routes need a host_routing.port")
+		}
+		return nil
+	}
+	if !isPort(h.Port) {
+		return fmt.Errorf("invalid host_routing.port: %d", h.Port)
+	}
+	if h.Protocol != "tls" && h.Protocol != "http" {
+		return fmt.Errorf("invalid host_routing.protocol: %q (tls or http)", h.Protocol)
+	}
+	if c.VPS.Transport == "tailscale" {
+		return errors.New("host_routing does not apply to vps.transport: tailscale")
+	}
+	for _, f := range c.TCPForwards {
+		switch h.Port {
+		case f.RemotePort:
+			return fmt.Errorf("host_routing.port %d is the remote_port of %s", h.Port, f.Name)
+		case f.HTTPRedirectPort:
+			return fmt.Errorf("host_routing.port %d is the http_redirect_port of %s", h.Port, f.Name)
+		}
+		if f.RemoteTLS && f.RemoteTLSPort == h.Port {
+			return fmt.Errorf("host_routing.port %d is the remote_tls_port of %s", h.Port, f.Name)
+		}
+	}
+	for _, u := range c.UDPForwards {
+		if u.WrapTCPPort == h.Port {
+			return fmt.Errorf("host_routing.port %d is the wrap_tcp_port of %s", h.Port, u.Name)
+		}
+	}
+	if c.TURN.Enabled && c.TURN.TunnelPort == h.Port || c.TUN.Enabled && c.TUN.TunnelPort == h.Port {
+		return fmt.Errorf("host_routing.port %d is a tunnel_port of turn or tun", h.Port)
+	}
+	hosts := make(map[string]bool)
+	for _, r := range h.Routes {
+		host := strings.ToLower(r.Host)
+		if host == "" || strings.ContainsAny(host, " ,=/:") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("invalid host_routing.routes host %q (a name or *.domain)", r.Host)
+		}
+		if hosts[host] {
+			return fmt.Errorf("host_routing.routes: %s is routed twice", r.Host)
+		}
+		hosts[host] = true
+		var fwd *TCPForward
+		for i := range c.TCPForwards {
+			if c.TCPForwards[i].Name == r.Forward {
+				fwd = &c.TCPForwards[i]
+			}
+		}
+		switch {
+		case fwd == nil:
+			return fmt.Errorf("host_routing.routes: %s routes to %q, which is not a TCP forward", r.Host, r.Forward)
+		case !fwd.onVPS():
+			return fmt.Errorf("host_routing.routes: %s is not exposed on the VPS", fwd.Name)
+		case fwd.RemotePort == 0:
+			return fmt.Errorf("host_routing.routes: %s needs a fixed remote_port", fwd.Name)
+		}
+	}
+	return nil
+}
+
+// hostRouted reports whether a route of cfg leads to the forward name.
+func hostRouted(cfg *Config, name string) bool {
+	if cfg.HostRouting.Port == 0 {
+		return false
+	}
+	for _, r := range cfg.HostRouting.Routes {
+		if r.Forward == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hostRouteScript returns the start function of the routing agent of cfg
+// and its modes.
+func hostRouteScript(cfg *Config) (string, []string) {
+	h := cfg.HostRouting
+	if h.Port == 0 || len(h.Routes) == 0 {
+		return "", nil
+	}
+	ports := make(map[string]int)
+	for _, f := range cfg.TCPForwards {
+		ports[f.Name] = f.RemotePort
+	}
+	var routes []string
+	for _, r := range h.Routes {
+		routes = append(routes, fmt.Sprintf("%s=%d", strings.ToLower(r.Host), ports[r.Forward]))
+	}
+	script := fmt.Sprintf(`start_route(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, h.Port) +
+		fmt.Sprintf(`"$AGENT_BIN" agent route -listen %d -protocol %s -routes %s %s & P_ROUTE="$!"; }; start_route; `,
+			h.Port, h.Protocol, shellQuote(strings.Join(routes, ",")), remoteLog(cfg, "tut-agent-route.log"))
+	return script, []string{"route"}
+}
+
+// hostRoutes maps names to loopback ports.
+type hostRoutes map[string]int
+
+// lookup returns the port of the route matching host: the exact name, or
+// else the longest wildcard above it.
+func (r hostRoutes) lookup(host string) (int, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if p, ok := r[host]; ok {
+		return p, true
+	}
+	for rest := host; ; {
+		_, after, ok := strings.Cut(rest, ".")
+		if !ok {
+			return 0, false
+		}
+		if p, ok := r["*."+after]; ok {
+			return p, true
+		}
+		rest = after
+	}
+}
+
+// runAgentRoute implements "tut agent route": it routes the clients of one
+// port by SNI or Host header.
+func runAgentRoute(args []string) int {
+	fs := flag.NewFlagSet("agent route", flag.ExitOnError)
+	listen := fs.Int("listen", 443, "Public port")
+	protocol := fs.String("protocol", "tls", "tls (route by SNI) or http (by Host header)")
+	list := fs.String("routes", "", "Comma-separated host=port, host a name or *.domain")
+	_ = fs.Parse(args)
+	routes := make(hostRoutes)
+	for _, r := range strings.Split(*list, ",") {
+		host, port, _ := strings.Cut(r, "=")
+		p, err := strconv.Atoi(port)
+		if err != nil || !isPort(p) {
+			routes = nil
+			break
+		}
+		routes[strings.ToLower(host)] = p
+	}
+	if !isPort(*listen) || len(routes) == 0 || *protocol != "tls" && *protocol != "http" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent route -listen port -protocol tls|http -routes host=port,...")
+		return 2
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *listen))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("Routing port %d by %s to %d forward(s)", *listen, map[string]string{"tls": "SNI", "http": "Host header"}[*protocol], len(routes))
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		go routeConn(c, *protocol, routes)
+	}
+}
+
+// routeConn reads the name c asks for and connects it to its forward.
+func routeConn(c net.Conn, protocol string, routes hostRoutes) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var head bytes.Buffer
+	r := io.TeeReader(c, &head)
+	var host string
+	var err error
+	if protocol == "tls" {
+		host, err = readSNI(r)
+	} else {
+		host, err = readHost(r)
+	}
+	if err != nil {
+		logf("%s: %v", c.RemoteAddr(), err)
+		return
+	}
+	port, ok := routes.lookup(host)
+	if !ok {
+		logf("%s: no route for %q", c.RemoteAddr(), host)
+		if protocol == "http" {
+			_, _ = io.WriteString(c, "HTTP/1.1 404 Not Found\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nno forward for "+host+"\n")
+		}
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	up, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 10*time.Second)
+	if err != nil {
+		logf("%s: %s: %v", c.RemoteAddr(), host, err)
+		if protocol == "http" {
+			_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nthe forward for "+host+" is down\n")
+		}
+		return
+	}
+	defer up.Close()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(up, io.MultiReader(&head, c))
+		closeWrite(up)
+		close(done)
+	}()
+	_, _ = io.Copy(c, up)
+	closeWrite(c)
+	<-done
+}
+
+// readSNI reads a TLS ClientHello from r and returns its server name.
+func readSNI(r io.Reader) (string, error) {
+	var name string
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSNIRead
+		},
+	}).Handshake()
+	switch {
+	case !errors.Is(err, errSNIRead):
+		return "", fmt.Errorf("not a TLS ClientHello: %v", err)
+	case name == "":
+		return "", errors.New("ClientHello without a server name")
+	}
+	return name, nil
+}
+
+// readHost reads the header of an HTTP request from r and returns its host
+// without the port.
+func readHost(r io.Reader) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(r))
+	if err != nil {
+		return "", fmt.Errorf("not an HTTP request: %v", err)
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return "", errors.New("HTTP request without a Host header")
+	}
+	return host, nil
+}
+
+// readOnlyConn is a net.Conn reading from r that drops what is written,
+// for reading a ClientHello without answering it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c readOnlyConn) Close() error                     { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c readOnlyConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With http_cache, the HTTP proxy of a forward keeps responses on the VPS,
+// so that static assets are served from there instead of coming up the
+// home uplink for every visitor. It is a shared cache as in RFC 9111, kept
+// simple: it stores complete responses to GET with status 200, 203, 204,
+// 301, 404 or 410 that say how long they stay fresh (s-maxage, max-age or
+// Expires), and never those marked no-store, no-cache or private, those
+// setting cookies or, for requests with credentials, those not marked
+// public. A fresh response is served until it expires, honouring Vary and
+// the client's If-None-Match and If-Modified-Since; stale ones are fetched
+// again rather than revalidated. Requests with Cache-Control no-cache or
+// max-age=0 go to the service and refresh the entry, and other methods
+// than GET and HEAD drop it. The cache holds up to http_cache bytes,
+// dropping the least recently used entries, with no entry above an eighth
+// of it. With http_cache_dir, the entries are files there and survive
+// restarts of the agent; otherwise they are kept in memory. Responses carry
+// X-Cache: HIT or MISS.
+
+// httpCacheable are the statuses the cache stores.
+var httpCacheable = map[int]bool{200: true, 203: true, 204: true, 301: true, 404: true, 410: true}
+
+// httpCache is the response cache of an HTTP proxy.
+type httpCache struct {
+	max, maxEntry int64
+	dir           string // empty: bodies in memory
+
+	hits, misses atomic.Int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry is a stored response; with a directory, it is also the
+// <hash>.json next to the <hash>.body file.
+type cacheEntry struct {
+	Key     string            `json:"key"`
+	Status  int               `json:"status"`
+	Header  http.Header       `json:"header"`
+	Vary    map[string]string `json:"vary,omitempty"` // request headers the response varies on
+	Stored  time.Time         `json:"stored"`         // less the age it arrived with
+	Expires time.Time         `json:"expires"`
+	Size    int64             `json:"size"`
+	body    []byte            // without a directory
+}
+
+// newHTTPCache returns a cache of max bytes, loading the entries left in
+// dir by an earlier run.
+func newHTTPCache(max int64, dir string) (*httpCache, error) {
+	c := &httpCache{max: max, maxEntry: max / 8, dir: dir, lru: list.New(), entries: make(map[string]*list.Element)}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+		c.load()
+	}
+	go c.report()
+	return c, nil
+}
+
+// load adds the fresh entries in the directory and removes the rest.
+func (c *httpCache) load() {
+	files, _ := os.ReadDir(c.dir)
+	now := time.Now()
+	var loaded []*cacheEntry
+	keep := make(map[string]bool)
+	for _, f := range files {
+		name, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		var e cacheEntry
+		data, err := os.ReadFile(filepath.Join(c.dir, f.Name()))
+		if err != nil || json.Unmarshal(data, &e) != nil || now.After(e.Expires) || c.file(e.Key, "") != filepath.Join(c.dir, name) {
+			continue
+		}
+		if st, err := os.Stat(c.file(e.Key, ".body")); err != nil || st.Size() != e.Size {
+			continue
+		}
+		keep[name+".json"], keep[name+".body"] = true, true
+		loaded = append(loaded, &e)
+	}
+	for _, f := range files {
+		if !keep[f.Name()] {
+			_ = os.Remove(filepath.Join(c.dir, f.Name()))
+		}
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Stored.Before(loaded[j].Stored) })
+	c.mu.Lock()
+	for _, e := range loaded {
+		c.insert(e)
+	}
+	c.mu.Unlock()
+	if len(loaded) > 0 {
+		logf("Loaded %d cached responses (%s) from %s", c.lru.Len(), Size(c.size), c.dir)
+	}
+}
+
+// report logs the hits and misses every ten minutes in which there were
+// any.
+func (c *httpCache) report() {
+	var hits, misses int64
+	for range time.Tick(10 * time.Minute) {
+		h, m := c.hits.Load(), c.misses.Load()
+		if h == hits && m == misses {
+			continue
+		}
+		c.mu.Lock()
+		n, size := c.lru.Len(), c.size
+		c.mu.Unlock()
+		logf("Cache: %d hits, %d misses in the last 10 minutes; %d responses, %s", h-hits, m-misses, n, Size(size))
+		hits, misses = h, m
+	}
+}
+
+// file is the path of the file of key with suffix.
+func (c *httpCache) file(key, suffix string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+suffix)
+}
+
+// cacheKey identifies the resource req asks for.
+func cacheKey(req *http.Request) string {
+	return strings.ToLower(req.Host) + req.URL.RequestURI()
+}
+
+// cacheControl parses a Cache-Control header into its directives.
+func cacheControl(h string) map[string]string {
+	d := make(map[string]string)
+	for _, part := range strings.Split(h, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			d[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return d
+}
+
+// handler serves what it can from the cache and passes the rest to next,
+// storing its responses.
+func (c *httpCache) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := cacheKey(req)
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			if req.Method != http.MethodOptions && req.Method != http.MethodTrace {
+				c.remove(key)
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.Header.Get("Range") != "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rcc := cacheControl(req.Header.Get("Cache-Control"))
+		_, noCache := rcc["no-cache"]
+		if !noCache && rcc["max-age"] != "0" && req.Header.Get("Pragma") != "no-cache" {
+			if e, body := c.get(key, req); e != nil {
+				c.hits.Add(1)
+				c.serve(w, req, e, body)
+				return
+			}
+		}
+		c.misses.Add(1)
+		if req.Method == http.MethodHead {
+			w.Header().Set("X-Cache", "MISS")
+			next.ServeHTTP(w, req)
+			return
+		}
+		rec := &cacheRecorder{ResponseWriter: w, limit: c.maxEntry}
+		next.ServeHTTP(rec, req)
+		if _, noStore := rcc["no-store"]; !noStore {
+			if e := c.entry(key, req, rec); e != nil {
+				c.put(e, rec.body.Bytes())
+			}
+		}
+	})
+}
+
+// entry returns the entry for the response rec recorded, or nil when it
+// may not be stored.
+func (c *httpCache) entry(key string, req *http.Request, rec *cacheRecorder) *cacheEntry {
+	if !httpCacheable[rec.status] || rec.failed {
+		return nil
+	}
+	h := rec.Header().Clone()
+	h.Del("X-Cache")
+	if n := h.Get("Content-Length"); n != "" && n != strconv.Itoa(rec.body.Len()) {
+		return nil // cut short
+	}
+	cc := cacheControl(h.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	if len(h.Values("Set-Cookie")) > 0 || req.Header.Get("Authorization") != "" && !public && !shared {
+		return nil
+	}
+	now := time.Now()
+	var lifetime time.Duration
+	switch {
+	case cc["s-maxage"] != "":
+		n, _ := strconv.Atoi(cc["s-maxage"])
+		lifetime = time.Duration(n) * time.Second
+	case cc["max-age"] != "":
+		n, _ := strconv.Atoi(cc["max-age"])
+		lifetime = time.Duration(n) * time.Second
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		date, derr := http.ParseTime(h.Get("Date"))
+		if derr != nil {
+			date = now
+		}
+		if err == nil {
+			lifetime = expires.Sub(date)
+		}
+	}
+	age, _ := strconv.Atoi(h.Get("Age"))
+	stored := now.Add(-time.Duration(age) * time.Second)
+	if lifetime <= time.Duration(age)*time.Second {
+		return nil
+	}
+	e := &cacheEntry{Key: key, Status: rec.status, Header: h, Stored: stored, Expires: stored.Add(lifetime), Size: int64(rec.body.Len())}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				if e.Vary == nil {
+					e.Vary = make(map[string]string)
+				}
+				e.Vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+	return e
+}
+
+// get returns the fresh entry of key matching req and its body, or nil.
+func (c *httpCache) get(key string, req *http.Request) (*cacheEntry, io.ReadCloser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.Expires) {
+		c.drop(el)
+		return nil, nil
+	}
+	for name, v := range e.Vary {
+		if req.Header.Get(name) != v {
+			return nil, nil
+		}
+	}
+	if c.dir == "" {
+		c.lru.MoveToFront(el)
+		return e, io.NopCloser(bytes.NewReader(e.body))
+	}
+	// opened under the lock, the file outlives a concurrent eviction
+	f, err := os.Open(c.file(key, ".body"))
+	if err != nil {
+		c.drop(el)
+		return nil, nil
+	}
+	c.lru.MoveToFront(el)
+	return e, f
+}
+
+// serve answers req with e.
+func (c *httpCache) serve(w http.ResponseWriter, req *http.Request, e *cacheEntry, body io.ReadCloser) {
+	defer body.Close()
+	h := w.Header()
+	for k, v := range e.Header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(e.Stored).Seconds())))
+	h.Set("X-Cache", "HIT")
+	etag := e.Header.Get("ETag")
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etag != "" && (inm == "*" || strings.Contains(inm, etag)) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && !lm.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(e.Status)
+	if req.Method != http.MethodHead {
+		_, _ = io.Copy(w, body)
+	}
+}
+
+// put stores e with body, evicting the least recently used entries to
+// make room.
+func (c *httpCache) put(e *cacheEntry, body []byte) {
+	if e.Size > c.maxEntry {
+		return
+	}
+	if c.dir != "" {
+		// written beside the entry first, so that readers of the old
+		// one keep their file
+		meta, _ := json.Marshal(e)
+		tmp := c.file(e.Key, ".tmp")
+		if os.WriteFile(tmp, body, 0o600) != nil {
+			_ = os.Remove(tmp)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if el, ok := c.entries[e.Key]; ok {
+			c.drop(el)
+		}
+		if os.Rename(tmp, c.file(e.Key, ".body")) != nil || os.WriteFile(c.file(e.Key, ".json"), meta, 0o600) != nil {
+			_ = os.Remove(tmp)
+			return
+		}
+	} else {
+		e.body = append([]byte(nil), body...)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if el, ok := c.entries[e.Key]; ok {
+			c.drop(el)
+		}
+	}
+	c.insert(e)
+}
+
+// insert adds e as the most recently used entry; c.mu is held.
+func (c *httpCache) insert(e *cacheEntry) {
+	for c.size+e.Size > c.max && c.lru.Len() > 0 {
+		c.drop(c.lru.Back())
+	}
+	c.entries[e.Key] = c.lru.PushFront(e)
+	c.size += e.Size
+}
+
+// remove drops the entry of key, if any.
+func (c *httpCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.drop(el)
+	}
+}
+
+// drop removes an entry and its files; c.mu is held.
+func (c *httpCache) drop(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.Key)
+	c.size -= e.Size
+	if c.dir != "" {
+		_ = os.Remove(c.file(e.Key, ".json"))
+		_ = os.Remove(c.file(e.Key, ".body"))
+	}
+}
+
+// cacheRecorder passes a response on to the client and keeps a copy of it
+// of up to limit bytes.
+type cacheRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	limit  int64
+	failed bool // too large, or the client went away
+}
+
+func (r *cacheRecorder) WriteHeader(code int) {
+	if code >= 200 && r.status == 0 {
+		r.status = code
+		r.Header().Set("X-Cache", "MISS")
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *cacheRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.failed {
+		if int64(r.body.Len()+len(p)) > r.limit {
+			r.failed = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	n, err := r.ResponseWriter.Write(p)
+	if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the response.
+func (r *cacheRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
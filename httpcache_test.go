@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// cacheOrigin answers every request with the headers in the query, e.g.
+// /a?Cache-Control=max-age%3D60, with the status in status= and a body of
+// size= bytes, and counts the requests it gets.
+type cacheOrigin struct {
+	requests atomic.Int64
+}
+
+func (o *cacheOrigin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	o.requests.Add(1)
+	q := req.URL.Query()
+	for k, v := range q {
+		if k != "status" && k != "size" {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	status := http.StatusOK
+	if s := q.Get("status"); s != "" {
+		status, _ = strconv.Atoi(s)
+	}
+	w.WriteHeader(status)
+	if n, err := strconv.Atoi(q.Get("size")); err == nil {
+		_, _ = w.Write(make([]byte, n))
+		return
+	}
+	_, _ = io.WriteString(w, "body of "+req.URL.Path+" for "+req.Header.Get("Accept-Encoding"))
+}
+
+// fetch sends a request through h and returns the response.
+func fetch(h http.Handler, method, target string, header ...string) *http.Response {
+	req := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestHTTPCache(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		target string
+		header []string // of both requests
+		cached bool
+	}{
+		{"max-age", "/a?Cache-Control=max-age%3D60", nil, true},
+		{"s-maxage", "/a?Cache-Control=s-maxage%3D60", nil, true},
+		{"expires", "/a?Expires=" + url.QueryEscape(httpDate(time.Now().Add(time.Minute))), nil, true},
+		{"not found", "/a?Cache-Control=max-age%3D60&status=404", nil, true},
+		{"no lifetime", "/a", nil, false},
+		{"expired", "/a?Expires=" + url.QueryEscape(httpDate(time.Now().Add(-time.Minute))), nil, false},
+		{"aged out", "/a?Cache-Control=max-age%3D60&Age=60", nil, false},
+		{"no-store", "/a?Cache-Control=max-age%3D60,no-store", nil, false},
+		{"private", "/a?Cache-Control=private,max-age%3D60", nil, false},
+		{"cookie", "/a?Cache-Control=max-age%3D60&Set-Cookie=session%3D1", nil, false},
+		{"server error", "/a?Cache-Control=max-age%3D60&status=500", nil, false},
+		{"vary *", "/a?Cache-Control=max-age%3D60&Vary=*", nil, false},
+		{"credentials", "/a?Cache-Control=max-age%3D60", []string{"Authorization", "Bearer x"}, false},
+		{"credentials, public", "/a?Cache-Control=public,max-age%3D60", []string{"Authorization", "Bearer x"}, true},
+		{"client no-cache", "/a?Cache-Control=max-age%3D60", []string{"Cache-Control", "no-cache"}, false},
+		{"client no-store", "/a?Cache-Control=max-age%3D60", []string{"Cache-Control", "no-store"}, false},
+		{"range", "/a?Cache-Control=max-age%3D60", []string{"Range", "bytes=0-1"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := newHTTPCache(1<<20, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			origin := &cacheOrigin{}
+			h := c.handler(origin)
+			first := fetch(h, "GET", tc.target, tc.header...)
+			second := fetch(h, "GET", tc.target, tc.header...)
+			if tc.cached != (origin.requests.Load() == 1) {
+				t.Errorf("origin saw %d requests", origin.requests.Load())
+			}
+			if tc.cached && second.Header.Get("X-Cache") != "HIT" {
+				t.Errorf("second response X-Cache %q", second.Header.Get("X-Cache"))
+			}
+			b1, _ := io.ReadAll(first.Body)
+			b2, _ := io.ReadAll(second.Body)
+			if string(b1) != string(b2) || first.StatusCode != second.StatusCode {
+				t.Errorf("responses differ: %d %q, %d %q", first.StatusCode, b1, second.StatusCode, b2)
+			}
+		})
+	}
+}
+
+func httpDate(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+func TestHTTPCacheValidation(t *testing.T) {
+	c, _ := newHTTPCache(1<<20, "")
+	origin := &cacheOrigin{}
+	h := c.handler(origin)
+	lm := httpDate(time.Now().Add(-time.Hour))
+	target := "/a?Cache-Control=max-age%3D60&ETag=%22v1%22&Last-Modified=" + url.QueryEscape(lm)
+	fetch(h, "GET", target)
+
+	for _, tc := range []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"etag matches", []string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+		{"etag differs", []string{"If-None-Match", `"v0"`}, http.StatusOK},
+		{"not modified since", []string{"If-Modified-Since", httpDate(time.Now())}, http.StatusNotModified},
+		{"modified since", []string{"If-Modified-Since", httpDate(time.Now().Add(-2 * time.Hour))}, http.StatusOK},
+	} {
+		if resp := fetch(h, "GET", target, tc.header...); resp.StatusCode != tc.want || resp.Header.Get("X-Cache") != "HIT" {
+			t.Errorf("%s: %d %s, want %d from the cache", tc.name, resp.StatusCode, resp.Header.Get("X-Cache"), tc.want)
+		}
+	}
+	if resp := fetch(h, "HEAD", target); resp.Header.Get("X-Cache") != "HIT" || resp.ContentLength > 0 {
+		t.Errorf("HEAD: %s with %d bytes", resp.Header.Get("X-Cache"), resp.ContentLength)
+	}
+	if n := origin.requests.Load(); n != 1 {
+		t.Errorf("origin saw %d requests", n)
+	}
+
+	// other methods drop the entry
+	fetch(h, "POST", target)
+	fetch(h, "GET", target)
+	if n := origin.requests.Load(); n != 3 {
+		t.Errorf("origin saw %d requests after a POST, want 3", n)
+	}
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	c, _ := newHTTPCache(1<<20, "")
+	origin := &cacheOrigin{}
+	h := c.handler(origin)
+	target := "/a?Cache-Control=max-age%3D60&Vary=Accept-Encoding"
+	fetch(h, "GET", target, "Accept-Encoding", "gzip")
+	if fetch(h, "GET", target, "Accept-Encoding", "gzip").Header.Get("X-Cache") != "HIT" {
+		t.Error("the same Accept-Encoding missed")
+	}
+	resp := fetch(h, "GET", target, "Accept-Encoding", "br")
+	if body, _ := io.ReadAll(resp.Body); resp.Header.Get("X-Cache") != "MISS" || string(body) != "body of /a for br" {
+		t.Errorf("another Accept-Encoding: %s, %q", resp.Header.Get("X-Cache"), body)
+	}
+}
+
+func TestHTTPCacheEviction(t *testing.T) {
+	c, _ := newHTTPCache(800, "") // entries of up to 100 bytes
+	origin := &cacheOrigin{}
+	h := c.handler(origin)
+	for i := 1; i <= 9; i++ {
+		fetch(h, "GET", "/"+strconv.Itoa(i)+"?Cache-Control=max-age%3D60&size=90")
+		if i == 2 {
+			fetch(h, "GET", "/1?Cache-Control=max-age%3D60&size=90") // used again, so /2 is the oldest
+		}
+		if c.size > c.max {
+			t.Fatalf("cache holds %d bytes, above %d", c.size, c.max)
+		}
+	}
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/1", "HIT"},
+		{"/9", "HIT"},
+		{"/2", "MISS"}, // evicted for /9
+	} {
+		if got := fetch(h, "GET", tc.path+"?Cache-Control=max-age%3D60&size=90").Header.Get("X-Cache"); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.path, got, tc.want)
+		}
+	}
+
+	big := "/big?Cache-Control=max-age%3D60&size=101"
+	fetch(h, "GET", big)
+	if got := fetch(h, "GET", big).Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("an entry above an eighth of the cache: %s", got)
+	}
+}
+
+// TestHTTPCacheDir stores an entry in a directory and loads it in a new
+// cache, as after a restart of the agent.
+func TestHTTPCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newHTTPCache(1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := &cacheOrigin{}
+	target := "/a?Cache-Control=max-age%3D60"
+	fetch(c.handler(origin), "GET", target)
+	fetch(c.handler(origin), "GET", "/gone?Cache-Control=max-age%3D1")
+	if err := os.WriteFile(filepath.Join(dir, "stray.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	c, err = newHTTPCache(1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := fetch(c.handler(origin), "GET", target)
+	if body, _ := io.ReadAll(resp.Body); resp.Header.Get("X-Cache") != "HIT" || string(body) != "body of /a for " {
+		t.Errorf("after loading: %s, %q", resp.Header.Get("X-Cache"), body)
+	}
+	// the entry of example.com/a?Cache-Control=max-age%3D60, by its SHA-256;
+	// the expired entry and the stray file are gone
+	const name = "2d6e84a13623a9f47ae775d43238958fc238ad6cf33d2036b661d43fe10f05f7"
+	var names []string
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if len(names) != 2 || names[0] != name+".body" || names[1] != name+".json" {
+		t.Errorf("files %v, want the .body and .json of %s", names, name)
+	}
+}
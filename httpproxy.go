@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A TCP forward carrying HTTP can have the agent on the VPS speak HTTP to
+// its visitors: with http_proxy_port, the remote forward binds that
+// loopback port and the agent runs a reverse proxy in front of it, on
+// remote_port (behind the TLS agent with remote_tls, behind the router in
+// host_routing). The proxy is where the HTTP features that save the home
+// uplink live, such as the cache of http_cache, see httpcache.go. It serves
+// the error_page of the forward while the tunnel is down. It also guards
+// small services against abusive visitors: clients get 10 seconds
+// (http_header_timeout) to send the request headers, which ends slowloris
+// connections at the VPS, bodies over http_max_body are answered with 413,
+// and requests over http_max_requests in flight with 503.
+
+// httpProxyListen is the address the HTTP proxy of f listens on.
+func httpProxyListen(cfg *Config, f TCPForward) string {
+	switch {
+	case f.RemoteTLS:
+		return fmt.Sprintf("127.0.0.1:%d", f.RemoteTLSPort)
+	case hostRouted(cfg, f.Name):
+		return fmt.Sprintf("127.0.0.1:%d", f.RemotePort)
+	}
+	return fmt.Sprintf(":%d", f.RemotePort)
+}
+
+// validateHTTPProxy checks the http_ settings of the TCP forwards served by
+// the HTTP proxy.
+func validateHTTPProxy(c *Config) error {
+	used := make(map[int]string)
+	for _, f := range c.TCPForwards {
+		used[f.RemotePort] = "the remote_port of " + f.Name
+		if f.RemoteTLS {
+			used[f.RemoteTLSPort] = "the remote_tls_port of " + f.Name
+		}
+		if f.HTTPRedirectPort != 0 {
+			used[f.HTTPRedirectPort] = "the http_redirect_port of " + f.Name
+		}
+		if f.ErrorPagePort != 0 {
+			used[f.ErrorPagePort] = "the error_page_port of " + f.Name
+		}
+	}
+	for _, u := range c.UDPForwards {
+		used[u.WrapTCPPort] = "the wrap_tcp_port of " + u.Name
+	}
+	if c.HostRouting.Port != 0 {
+		used[c.HostRouting.Port] = "host_routing.port"
+	}
+	for _, f := range c.TCPForwards {
+		if f.HTTPProxyPort == 0 {
+			if f.HTTPCache != 0 {
+				return fmt.Errorf("%s: http_cache needs an http_proxy_port", f.Name)
+			}
+			if f.HTTPMaxBody != 0 || f.HTTPHeaderTimeout != 0 || f.HTTPMaxRequests != 0 {
+				return fmt.Errorf("%s: http_max_body, http_header_timeout and http_max_requests need an http_proxy_port", f.Name)
+			}
+			continue
+		}
+		switch {
+		case !isPort(f.HTTPProxyPort):
+			return fmt.Errorf("%s: invalid http_proxy_port: %d", f.Name, f.HTTPProxyPort)
+		case !f.onVPS():
+			return fmt.Errorf("%s: http_proxy_port needs the forward on the VPS", f.Name)
+		case f.RemotePort == 0:
+			return fmt.Errorf("%s: http_proxy_port needs a fixed remote_port", f.Name)
+		case f.ErrorPagePort != 0:
+			return fmt.Errorf("%s: the HTTP proxy serves the error page; drop error_page_port", f.Name)
+		case c.VPS.Transport == "tailscale":
+			return fmt.Errorf("%s: http_proxy_port does not apply to vps.transport: tailscale", f.Name)
+		case used[f.HTTPProxyPort] != "":
+			return fmt.Errorf("%s: http_proxy_port %d is %s", f.Name, f.HTTPProxyPort, used[f.HTTPProxyPort])
+		case f.HTTPCache < 0:
+			return fmt.Errorf("%s: invalid http_cache: %s", f.Name, f.HTTPCache)
+		case f.HTTPCacheDir != "" && (f.HTTPCache == 0 || !path.IsAbs(f.HTTPCacheDir)):
+			return fmt.Errorf("%s: http_cache_dir must be an absolute path and needs http_cache", f.Name)
+		case f.HTTPMaxBody < 0:
+			return fmt.Errorf("%s: invalid http_max_body: %s", f.Name, f.HTTPMaxBody)
+		case f.HTTPHeaderTimeout < 0:
+			return fmt.Errorf("%s: invalid http_header_timeout: %s", f.Name, f.HTTPHeaderTimeout)
+		case f.HTTPMaxRequests < 0:
+			return fmt.Errorf("%s: invalid http_max_requests: %d", f.Name, f.HTTPMaxRequests)
+		}
+		used[f.HTTPProxyPort] = "the http_proxy_port of " + f.Name
+	}
+	return nil
+}
+
+// httpProxyScript returns the start functions of the HTTP proxies of cfg
+// and their modes.
+func httpProxyScript(cfg *Config) (string, []string) {
+	var b strings.Builder
+	var modes []string
+	for i, f := range cfg.TCPForwards {
+		if f.HTTPProxyPort == 0 || !f.onVPS() {
+			continue
+		}
+		listen := httpProxyListen(cfg, f)
+		_, port, _ := net.SplitHostPort(listen)
+		mode := fmt.Sprintf("http%d", i)
+		b.WriteString(fmt.Sprintf(`start_%s(){ if command -v fuser >/dev/null 2>&1; then fuser -k %s/tcp 2>/dev/null || true; fi; `, mode, port))
+		b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent http -listen %s -connect 127.0.0.1:%d`, listen, f.HTTPProxyPort))
+		if f.RemoteTLS {
+			b.WriteString(" -proto https")
+		}
+		if errorPageOnVPS(f) {
+			b.WriteString(` -page "$AGENT_DIR"/` + shellQuote(errorPageFile(f.Name)))
+		}
+		if f.HTTPCache > 0 {
+			b.WriteString(fmt.Sprintf(" -cache-size %d", f.HTTPCache))
+			if f.HTTPCacheDir != "" {
+				b.WriteString(" -cache-dir " + shellQuote(f.HTTPCacheDir))
+			}
+		}
+		if f.HTTPMaxBody > 0 {
+			b.WriteString(fmt.Sprintf(" -max-body %d", f.HTTPMaxBody))
+		}
+		if f.HTTPHeaderTimeout > 0 {
+			b.WriteString(" -header-timeout " + f.HTTPHeaderTimeout.D().String())
+		}
+		if f.HTTPMaxRequests > 0 {
+			b.WriteString(fmt.Sprintf(" -max-requests %d", f.HTTPMaxRequests))
+		}
+		b.WriteString(fmt.Sprintf(` %s & P_%s="$!"; }; start_%s; `, remoteLog(cfg, fmt.Sprintf("tut-agent-http-%d.log", f.RemotePort)), strings.ToUpper(mode), mode))
+		modes = append(modes, mode)
+	}
+	return b.String(), modes
+}
+
+// httpProxyUsed reports whether a forward of cfg is served by the HTTP
+// proxy.
+func httpProxyUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if f.HTTPProxyPort != 0 && f.onVPS() {
+			return true
+		}
+	}
+	return false
+}
+
+// runAgentHTTP implements "tut agent http": a reverse proxy in front of the
+// remote forward of an HTTP forward.
+func runAgentHTTP(args []string) int {
+	fs := flag.NewFlagSet("agent http", flag.ExitOnError)
+	listen := fs.String("listen", "", "Address to serve HTTP on")
+	connect := fs.String("connect", "", "Address of the remote forward")
+	pageFile := fs.String("page", "", "HTML file served while the remote forward is down")
+	cacheSize := fs.Int64("cache-size", 0, "Bytes of responses to cache; 0: no cache")
+	cacheDir := fs.String("cache-dir", "", "Directory to keep the cache in instead of memory")
+	proto := fs.String("proto", "http", "Protocol of the visitors for X-Forwarded-Proto")
+	maxBody := fs.Int64("max-body", 0, "Largest request body passed on, in bytes; 0: any")
+	headerTimeout := fs.Duration("header-timeout", 10*time.Second, "Time clients get to send the request headers")
+	maxRequests := fs.Int("max-requests", 0, "Requests passed on at once; 0: any")
+	_ = fs.Parse(args)
+	if *listen == "" || *connect == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent http -listen addr -connect addr [-page file] [-cache-size bytes [-cache-dir dir]] [-max-body bytes] [-header-timeout d] [-max-requests n]")
+		return 2
+	}
+	var page []byte
+	if *pageFile != "" {
+		var err error
+		if page, err = os.ReadFile(*pageFile); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: "http", Host: *connect})
+			r.Out.Host = r.In.Host // the service sees the name visitors asked for
+			r.SetXForwarded()
+			r.Out.Header.Set("X-Forwarded-Proto", *proto)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			code := http.StatusBadGateway
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				code = http.StatusServiceUnavailable // the tunnel is down
+			}
+			logf("%s %s: %v", req.Method, req.URL, err)
+			if page == nil {
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			if code == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "30")
+			}
+			w.WriteHeader(code)
+			_, _ = w.Write(page)
+		},
+	}
+	var handler http.Handler = proxy
+	if *maxBody > 0 || *maxRequests > 0 {
+		handler = limitRequests(handler, *maxBody, *maxRequests)
+	}
+	if *cacheSize > 0 {
+		cache, err := newHTTPCache(*cacheSize, *cacheDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		handler = cache.handler(handler)
+	}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: *headerTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+	logf("Serving HTTP on %s for %s", *listen, *connect)
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", srv.ListenAndServe())
+	return 1
+}
+
+// limitRequests passes the requests with bodies up to maxBody bytes on to
+// next, at most maxRequests at once; 0 means no limit. Cache hits do not
+// count, since the limits protect the service.
+func limitRequests(next http.Handler, maxBody int64, maxRequests int) http.Handler {
+	var slots chan struct{}
+	if maxRequests > 0 {
+		slots = make(chan struct{}, maxRequests)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if maxBody > 0 {
+			if req.ContentLength > maxBody {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			// chunked bodies are cut off where they pass the limit
+			req.Body = http.MaxBytesReader(w, req.Body, maxBody)
+		}
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				w.Header().Set("Retry-After", "5")
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
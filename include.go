@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// "include" lists further config files, as glob patterns relative to the
+// directory of the config, so provisioning tools can drop a forward into
+// /etc/tut/conf.d as a file of its own and remove it again. The files are
+// read pattern by pattern, the matches of each in lexical order, and merged
+// into the config with fixed rules:
+//
+//   - lists (tcp_forwards, udp_forwards, mirrors, ...) are concatenated in
+//     that order, and an entry whose name is already taken is an error;
+//   - sections (vps, health, ...) are merged key by key;
+//   - any other setting may be made in one file only, so two files setting
+//     it is an error instead of one silently winning.
+//
+// Included files use the layout of the config (with their own version) but
+// cannot include further files. A reload (SIGHUP) reads them all again.
+
+// readConfigFile parses the config file at path, decrypted (see
+// encrypted.go), brought up to the current layout and checked for unknown
+// settings, and returns it with the version it was written in.
+func readConfigFile(path string) (*yaml.Node, int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if b, err = decryptConfig(path, b); err != nil {
+		return nil, 0, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	from, _, err := migrateConfigNode(&doc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := checkKnownKeys(&doc, path); err != nil {
+		return nil, 0, err
+	}
+	return &doc, from, nil
+}
+
+// includeFiles merges the files listed under "include" into doc, read from
+// path, and removes the key.
+func includeFiles(doc *yaml.Node, path string) error {
+	root := mappingRoot(doc)
+	if root == nil {
+		return nil
+	}
+	patterns, err := takeInclude(root, path)
+	if err != nil || len(patterns) == 0 {
+		return err
+	}
+	origins := map[string]string{}
+	recordOrigins(root, "", path, origins)
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("include %q: %w", pattern, err)
+		}
+		if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return fmt.Errorf("include %q: no such file", pattern)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+			inc, _, err := readConfigFile(file)
+			if err != nil {
+				return err
+			}
+			src := mappingRoot(inc)
+			if src == nil {
+				continue // empty file
+			}
+			if _, ok := mappingValue(src, "include"); ok {
+				return fmt.Errorf("%s: included files cannot include further files", file)
+			}
+			if err := mergeConfigNode(root, src, "", file, origins); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// takeInclude removes "include" from root and returns its patterns, given
+// as one string or a list.
+func takeInclude(root *yaml.Node, path string) ([]string, error) {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "include" {
+			continue
+		}
+		v := root.Content[i+1]
+		root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		var patterns []string
+		switch v.Kind {
+		case yaml.ScalarNode:
+			if v.Tag != "!!null" {
+				patterns = []string{v.Value}
+			}
+		case yaml.SequenceNode:
+			if err := v.Decode(&patterns); err != nil {
+				return nil, fmt.Errorf("%s: include: %w", path, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: include must be a pattern or a list of them", path)
+		}
+		return patterns, nil
+	}
+	return nil, nil
+}
+
+// mappingRoot returns the mapping at the top of doc, or nil.
+func mappingRoot(doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	return doc.Content[0]
+}
+
+// mappingValue returns the value of key in the mapping m.
+func mappingValue(m *yaml.Node, key string) (*yaml.Node, bool) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1], true
+		}
+	}
+	return nil, false
+}
+
+// recordOrigins notes file as the origin of every setting and named list
+// entry under m, by the path mergeConfigNode reports them with.
+func recordOrigins(m *yaml.Node, prefix, file string, origins map[string]string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, v := prefix+m.Content[i].Value, m.Content[i+1]
+		switch v.Kind {
+		case yaml.MappingNode:
+			recordOrigins(v, key+".", file, origins)
+		case yaml.SequenceNode:
+			for _, item := range v.Content {
+				if name := entryName(item); name != "" {
+					origins[fmt.Sprintf("%s[%s]", key, name)] = file
+				}
+			}
+		default:
+			origins[key] = file
+		}
+	}
+}
+
+// entryName returns the name of a list entry, or "".
+func entryName(item *yaml.Node) string {
+	if item.Kind != yaml.MappingNode {
+		return ""
+	}
+	if n, ok := mappingValue(item, "name"); ok {
+		return n.Value
+	}
+	return ""
+}
+
+// mergeConfigNode merges the mapping src, read from file, into dst by the
+// rules above.
+func mergeConfigNode(dst, src *yaml.Node, prefix, file string, origins map[string]string) error {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		k, v := src.Content[i], src.Content[i+1]
+		key := prefix + k.Value
+		if key == "version" {
+			continue // each file has its own
+		}
+		cur, ok := mappingValue(dst, k.Value)
+		switch {
+		case !ok || cur.Tag == "!!null":
+			if ok {
+				*cur = *v
+			} else {
+				dst.Content = append(dst.Content, k, v)
+			}
+			recordOrigins(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{k, v}}, prefix, file, origins)
+		case cur.Kind == yaml.MappingNode && v.Kind == yaml.MappingNode:
+			if err := mergeConfigNode(cur, v, key+".", file, origins); err != nil {
+				return err
+			}
+		case cur.Kind == yaml.SequenceNode && v.Kind == yaml.SequenceNode:
+			for _, item := range v.Content {
+				if name := entryName(item); name != "" {
+					entry := fmt.Sprintf("%s[%s]", key, name)
+					if other, taken := origins[entry]; taken {
+						return fmt.Errorf("%s: %s %q is already defined in %s", file, key, name, other)
+					}
+					origins[entry] = file
+				}
+			}
+			cur.Content = append(cur.Content, v.Content...)
+		default:
+			return fmt.Errorf("%s: %s is already set in %s", file, key, originOf(origins, key))
+		}
+	}
+	return nil
+}
+
+// originOf returns the file that set key or, for sections and lists, a
+// setting under it.
+func originOf(origins map[string]string, key string) string {
+	if f, ok := origins[key]; ok {
+		return f
+	}
+	keys := make([]string, 0, len(origins))
+	for k := range origins {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.HasPrefix(k, key+".") || strings.HasPrefix(k, key+"[") {
+			return origins[k]
+		}
+	}
+	return "the config"
+}
@@ -33,6 +33,8 @@ detect_platform() {
         Linux*)     OS="linux";;
         Darwin*)    OS="darwin";;
         FreeBSD*)   OS="freebsd";;
+        OpenBSD*)   OS="openbsd";;
+        NetBSD*)    OS="netbsd";;
         *)          error "Unsupported OS: $OS";;
     esac
     
@@ -75,6 +77,15 @@ detect_package_manager() {
     elif command_exists brew; then
         PKG_MANAGER="brew"
         PKG_INSTALL="brew install"
+    elif command_exists pkg_add; then
+        PKG_MANAGER="pkg_add"
+        PKG_INSTALL="pkg_add"
+    elif command_exists pkgin; then
+        PKG_MANAGER="pkgin"
+        PKG_INSTALL="pkgin -y install"
+    elif command_exists pkg; then
+        PKG_MANAGER="pkg"
+        PKG_INSTALL="pkg install -y"
     else
         PKG_MANAGER="unknown"
         warn "Could not detect package manager"
@@ -93,6 +104,8 @@ detect_service_manager() {
         SERVICE_MANAGER="openrc"
     elif command_exists sv && [ -d /etc/sv ]; then
         SERVICE_MANAGER="runit"
+    elif command_exists rcctl && [ -d /etc/rc.d ]; then
+        SERVICE_MANAGER="openbsd"
     elif [ -f /etc/rc.conf ] && [ -d /usr/local/etc/rc.d ]; then
         SERVICE_MANAGER="bsd"
     elif command_exists launchctl && [ "$OS" = "darwin" ]; then
@@ -155,6 +168,10 @@ check_dependencies() {
                 brew)
                     $PKG_INSTALL socat go
                     ;;
+                pkg|pkg_add|pkgin)
+                    # ssh is part of the base system
+                    sudo $PKG_INSTALL socat go
+                    ;;
             esac
         fi
     else
@@ -244,8 +261,8 @@ setup_ssh() {
         info "Generating SSH key pair..."
         ssh-keygen -t ed25519 -f "$SSH_DIR/id_ed25519" -N "" -C "tut@$(hostname)"
         info "SSH key generated at $SSH_DIR/id_ed25519"
-        info "Please copy the public key to your VPS:"
-        info "  ssh-copy-id -i $SSH_DIR/id_ed25519.pub user@your.vps.hostname"
+        info "Once vps.host and vps.user are set in the config, add the key to your VPS with:"
+        info "  tut keygen -enroll -config $CONFIG_FILE"
     else
         info "SSH key already exists"
     fi
@@ -287,6 +304,7 @@ Wants=network-online.target
 [Service]
 Type=simple
 ExecStart=/usr/local/bin/tut -config $CONFIG_PATH
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=2
 User=root
@@ -370,32 +388,16 @@ create_bsd_service() {
         CONFIG_PATH="${HOME}/.config/tut/config.yaml"
     fi
     
-    SERVICE_FILE="/usr/local/etc/rc.d/tut"
-    
-    sudo tee "$SERVICE_FILE" > /dev/null << EOF
-#!/bin/sh
-#
-# PROVIDE: tut
-# REQUIRE: NETWORKING
-# KEYWORD: shutdown
-
-. /etc/rc.subr
-
-name="tut"
-rcvar=tut_enable
-command="/usr/local/bin/tut"
-command_args="-config $CONFIG_PATH"
-pidfile="/var/run/tut.pid"
-
-load_rc_config \$name
-run_rc_command "\$1"
-EOF
-    
-    sudo chmod +x "$SERVICE_FILE"
-    
-    # Add to rc.conf
-    if ! grep -q "tut_enable" /etc/rc.conf 2>/dev/null; then
-        echo 'tut_enable="YES"' | sudo tee -a /etc/rc.conf
+    if [ "$SERVICE_MANAGER" = "openbsd" ]; then
+        SERVICE_FILE="/etc/rc.d/tut"
+        /usr/local/bin/tut export rc.d -os openbsd -config "$CONFIG_PATH" | sudo tee "$SERVICE_FILE" > /dev/null
+        sudo chmod +x "$SERVICE_FILE"
+        sudo rcctl enable tut
+    else
+        SERVICE_FILE="/usr/local/etc/rc.d/tut"
+        /usr/local/bin/tut export rc.d -os freebsd -config "$CONFIG_PATH" | sudo tee "$SERVICE_FILE" > /dev/null
+        sudo chmod +x "$SERVICE_FILE"
+        sudo sysrc tut_enable=YES > /dev/null
     fi
     
     info "BSD rc.d service created at $SERVICE_FILE"
@@ -452,7 +454,7 @@ setup_service() {
         runit)
             create_runit_service
             ;;
-        bsd)
+        bsd|openbsd)
             create_bsd_service
             ;;
         launchd)
@@ -490,6 +492,11 @@ enable_service() {
             info "To start now, run: sudo service tut start"
             info "To check status: sudo service tut status"
             ;;
+        openbsd)
+            info "Service enabled with rcctl"
+            info "To start now, run: rcctl start tut"
+            info "To check status: rcctl check tut"
+            ;;
         launchd)
             launchctl load "$PLIST_FILE"
             info "Service loaded. To check status: launchctl list | grep tut"
@@ -567,6 +574,13 @@ print_instructions() {
             echo "  6. Check the service status:"
             echo "     sudo service tut status"
             ;;
+        openbsd)
+            echo "  5. Start the service:"
+            echo "     rcctl start tut"
+            echo ""
+            echo "  6. Check the service status:"
+            echo "     rcctl check tut"
+            ;;
         launchd)
             echo "  5. Service is already loaded"
             echo ""
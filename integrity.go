@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The wrap stream of a UDP forward carries datagrams without framing: the
+// socat pair and the builtin bridge rely on every read returning exactly one
+// datagram. When that breaks, datagrams arrive merged or cut apart and the
+// service drops them without a word. A UDP forward with integrity_check set
+// is a debugging aid that finds out where: the tut agent on the VPS stamps
+// every datagram from a client with a trailer (sequence number, CRC-32 and
+// length) before the socat pair carries it, and the builtin bridge verifies
+// and strips it before the service sees the datagram; the replies of the
+// service are stamped by the bridge and verified by the agent. Each side
+// logs what it finds to its wrapper log: reads that merged several
+// datagrams (which are then delivered one by one), reads that hold part of
+// one, checksum mismatches and gaps in the sequence. Damaged datagrams are
+// dropped, like the network would.
+
+// integrityMagic ends every trailer.
+const integrityMagic = 0x7455 // "tU"
+
+// integrityTrailer is the size of a trailer: sequence number, CRC-32 of the
+// payload, payload length and integrityMagic.
+const integrityTrailer = 12
+
+// stampDatagram returns b with the trailer of sequence number seq.
+func stampDatagram(seq uint32, b []byte) []byte {
+	out := make([]byte, len(b), len(b)+integrityTrailer)
+	copy(out, b)
+	out = binary.BigEndian.AppendUint32(out, seq)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(b))
+	out = binary.BigEndian.AppendUint16(out, uint16(len(b)))
+	return binary.BigEndian.AppendUint16(out, integrityMagic)
+}
+
+// integrityChecker verifies the datagrams of one direction of a wrap
+// stream.
+type integrityChecker struct {
+	label string // the forward and direction, for the log
+	next  uint32 // the sequence number expected next
+	seen  bool
+}
+
+// unstamp returns the intact datagrams in b, the result of one read, in the
+// order they were sent, and logs what is wrong with it. Trailers sit at the
+// end of their datagram, so b is taken apart from its end.
+func (c *integrityChecker) unstamp(b []byte) [][]byte {
+	type datagram struct {
+		seq     uint32
+		payload []byte
+	}
+	var found []datagram
+	rest := b
+	for len(rest) > 0 {
+		if len(rest) < integrityTrailer || binary.BigEndian.Uint16(rest[len(rest)-2:]) != integrityMagic {
+			c.logf("%d bytes without a trailer in a read of %d: a datagram split across reads, or damaged", len(rest), len(b))
+			break
+		}
+		t := rest[len(rest)-integrityTrailer:]
+		n := int(binary.BigEndian.Uint16(t[8:]))
+		if n > len(rest)-integrityTrailer {
+			c.logf("a trailer for %d bytes in %d: the start of the datagram is in an earlier read, or damaged", n, len(rest)-integrityTrailer)
+			break
+		}
+		payload := rest[len(rest)-integrityTrailer-n : len(rest)-integrityTrailer]
+		seq := binary.BigEndian.Uint32(t)
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(t[4:]) {
+			c.logf("checksum mismatch in datagram %d (%d bytes)", seq, n)
+		} else {
+			found = append(found, datagram{seq, payload})
+		}
+		rest = rest[:len(rest)-integrityTrailer-n]
+	}
+	if len(found) > 1 {
+		c.logf("%d datagrams merged into one read of %d bytes", len(found), len(b))
+	}
+	out := make([][]byte, 0, len(found))
+	for i := len(found) - 1; i >= 0; i-- {
+		d := found[i]
+		switch {
+		case !c.seen:
+		case d.seq > c.next:
+			c.logf("datagrams %d to %d are missing", c.next, d.seq-1)
+		case d.seq < c.next:
+			c.logf("datagram %d arrived after %d", d.seq, c.next-1)
+		}
+		c.seen = true
+		c.next = d.seq + 1
+		out = append(out, d.payload)
+	}
+	return out
+}
+
+func (c *integrityChecker) logf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s integrity %s: %s\n", time.Now().Format(time.RFC3339), c.label, fmt.Sprintf(format, args...))
+}
+
+// runAgentCheck implements "tut agent check", the VPS side of a UDP
+// forward with integrity_check: it takes the datagrams of the public port
+// and relays them stamped to the socat pair listening on relay.
+func runAgentCheck(args []string) int {
+	fs := flag.NewFlagSet("agent check", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public UDP port")
+	bind := fs.String("bind", "0.0.0.0", "Address of the public port")
+	relay := fs.String("relay", "", "UDP address of the socat pair")
+	_ = fs.Parse(args)
+	if *listen == 0 || *relay == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent check -listen port -relay addr")
+		return 2
+	}
+	err := checkServe(*bind, *listen, *relay)
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
+
+// checkServe relays every client of the public port through its own socket
+// to relay, so that socat forks one child per client as it does without
+// the agent.
+func checkServe(bind string, listen int, relay string) error {
+	pc, err := agentListenUDP(bind, listen)
+	if err != nil {
+		return err
+	}
+	raddr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	clients := make(map[string]*checkClient)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		c := clients[addr.String()]
+		if c == nil {
+			conn, err := net.DialUDP("udp", nil, raddr)
+			if err != nil {
+				mu.Unlock()
+				fmt.Fprintf(os.Stderr, "dial %s: %v\n", relay, err)
+				continue
+			}
+			c = &checkClient{conn: conn, check: integrityChecker{label: fmt.Sprintf("port %d, from the service to %s", listen, addr)}}
+			clients[addr.String()] = c
+			go func() {
+				c.replies(pc, addr)
+				mu.Lock()
+				delete(clients, addr.String())
+				mu.Unlock()
+			}()
+		}
+		c.last.Store(monoNow())
+		seq := c.seq
+		c.seq++
+		mu.Unlock()
+		_, _ = c.conn.Write(stampDatagram(seq, buf[:n])) // lost like any datagram
+	}
+}
+
+// checkClient is a client of the public port and its socket towards the
+// socat pair.
+type checkClient struct {
+	conn  *net.UDPConn
+	seq   uint32 // of the next datagram from the client, under the lock of checkServe
+	last  atomic.Int64
+	check integrityChecker
+}
+
+// replies verifies the replies for the client and sends them on from the
+// public port, until both directions are idle for bridgeIdle.
+func (c *checkClient) replies(pc *net.UDPConn, addr *net.UDPAddr) {
+	defer c.conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(bridgeIdle))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && monoSince(c.last.Load()) < bridgeIdle || errors.Is(err, syscall.ECONNREFUSED) {
+				continue // refused: the socat pair is not up yet
+			}
+			return
+		}
+		c.last.Store(monoNow())
+		for _, d := range c.check.unstamp(buf[:n]) {
+			_, _ = pc.WriteToUDP(d, addr)
+		}
+	}
+}
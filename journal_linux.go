@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is the datagram socket of the systemd journal's native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// openJournal returns a sink sending entries to journald with structured
+// fields, so that e.g. `journalctl -u tut TUT_FORWARD=minecraft` works.
+func openJournal() (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return func(e logEntry) {
+		var b bytes.Buffer
+		journalField(&b, "MESSAGE", e.msg)
+		journalField(&b, "PRIORITY", strconv.Itoa(int(e.level)))
+		journalField(&b, "SYSLOG_IDENTIFIER", "tut")
+		if e.forward != "" {
+			journalField(&b, "TUT_FORWARD", e.forward)
+		}
+		if e.event != "" {
+			journalField(&b, "TUT_EVENT", e.event)
+		}
+		if _, err := conn.Write(b.Bytes()); err != nil {
+			// never lose messages because the journal went away
+			writeText(e)
+		}
+	}, nil
+}
+
+// journalField appends one field in the journal export format. Values
+// containing newlines use the length-prefixed binary form.
+func journalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(key + "=" + value + "\n")
+		return
+	}
+	b.WriteString(key + "\n")
+	_ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
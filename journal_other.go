@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// openJournal is not supported outside Linux; systemd only exists there.
+func openJournal() (logSink, error) {
+	return nil, errors.New("journald logging is only available on Linux")
+}
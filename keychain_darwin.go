@@ -0,0 +1,37 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// keychainCredential reads the generic password of service (and account,
+// when given) from the Keychain of the user tut runs as.
+func keychainCredential(service, account string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	args := []string{"find-generic-password", "-s", service, "-w"}
+	if account != "" {
+		args = append(args, "-a", account)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "security", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("keychain item %s: %s", service, strings.TrimSpace(stderr.String()))
+	}
+	out = bytes.TrimSuffix(out, []byte("\n"))
+	// security prints items with line breaks, such as keys, in hex
+	if b, err := hex.DecodeString(string(out)); err == nil && bytes.HasPrefix(b, []byte("-----BEGIN")) {
+		return b, nil
+	}
+	return out, nil
+}
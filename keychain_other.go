@@ -0,0 +1,10 @@
+//go:build !darwin
+
+package main
+
+import "fmt"
+
+// keychainCredential is only supported on macOS.
+func keychainCredential(service, account string) ([]byte, error) {
+	return nil, fmt.Errorf("macOS Keychain: %w", errNoCredentialStore)
+}
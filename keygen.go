@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// "tut keygen" creates the ed25519 key of vps.ssh_key with ssh-keygen, and
+// with -enroll adds it to the authorized_keys of vps.user on the VPS, once,
+// logging in with the password of the user or with a key that works
+// already. The entry is restricted to what tut needs: it may forward ports
+// and run commands, but gets no terminal and forwards no agent or X11.
+
+// authorizedKeyOptions restrict the key in authorized_keys (OpenSSH 7.2 or
+// newer on the VPS).
+const authorizedKeyOptions = "restrict,port-forwarding"
+
+// enrollTimeout bounds the enrollment, typing the password included.
+const enrollTimeout = 5 * time.Minute
+
+// runKeygenCommand implements "tut keygen".
+func runKeygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	keyPath := fs.String("key", "", "Key file to create (default: vps.ssh_key)")
+	enroll := fs.Bool("enroll", false, "Add the public key to authorized_keys on the VPS")
+	with := fs.String("with", "", "Log in with this key to enroll rather than with the password")
+	_ = fs.Parse(args)
+
+	requireBinary("ssh-keygen")
+	var cfg *Config
+	if *enroll || *keyPath == "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil {
+			die("Failed to load config: %v", err)
+		}
+	}
+	path := *keyPath
+	if path == "" {
+		path = cfg.VPS.SSHKey
+	}
+	if path == "" || isCredential(path) {
+		die("tut keygen writes a key file: set vps.ssh_key to its path or give -key")
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		fmt.Printf("Using the existing key %s\n", path)
+	} else {
+		if err := generateKey(path); err != nil {
+			die("Cannot create the key: %v", err)
+		}
+		fmt.Printf("Created %s and %s.pub\n", path, path)
+	}
+	if !*enroll {
+		return 0
+	}
+
+	requireBinary("ssh")
+	fields, err := readPublicKey(path)
+	if err != nil {
+		die("Cannot read the public key: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), enrollTimeout)
+	defer cancel()
+	if err := enrollKey(ctx, cfg, fields, *with); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot enroll the key: %v\n", err)
+		return 1
+	}
+
+	// the same login tut itself does
+	cfg.VPS.SSHKey, cfg.VPS.SSHKeyPassphrase = path, ""
+	if _, err := agentSSH(ctx, cfg, "true", nil); err != nil {
+		fmt.Fprintf(os.Stderr, "The key is enrolled, but logging in with it failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Logging in to %s@%s with %s works.\n", cfg.VPS.User, cfg.VPS.Host, path)
+	return 0
+}
+
+// enrollKey appends the public key, split into fields, to authorized_keys
+// of vps.user unless it is there already, logging in with the key with or
+// else with the password, which ssh asks for on the terminal.
+func enrollKey(ctx context.Context, cfg *Config, pub []string, with string) error {
+	args := []string{"-p", strconv.Itoa(sshPort(cfg)), "-T",
+		"-o", "StrictHostKeyChecking=" + cfg.VPS.StrictHostKey,
+		"-o", "ConnectTimeout=15"}
+	if family := addressFamily(cfg); family != "" {
+		args = append(args, "-o", "AddressFamily="+family)
+	}
+	if with != "" {
+		args = append(args, "-i", with, "-o", "IdentitiesOnly=yes", "-o", "BatchMode=yes")
+	} else {
+		args = append(args, "-o", "PubkeyAuthentication=no",
+			"-o", "PreferredAuthentications=keyboard-interactive,password")
+	}
+	args = append(args, cfg.VPS.User+"@"+cfg.VPS.Host, authorizeKeyScript(pub))
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = strings.NewReader(authorizedKeyEntry(pub))
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "added":
+		fmt.Printf("Added the key to ~/.ssh/authorized_keys of %s on %s\n", cfg.VPS.User, cfg.VPS.Host)
+	case "present":
+		fmt.Printf("The key is in ~/.ssh/authorized_keys of %s on %s already\n", cfg.VPS.User, cfg.VPS.Host)
+	default:
+		return fmt.Errorf("unexpected answer from the VPS: %q", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// generateKey creates an ed25519 key without a passphrase at path.
+func generateKey(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "tut@"+host, "-f", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ssh-keygen failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readPublicKey returns the fields of the public key of the key at path:
+// type, blob and comment.
+func readPublicKey(path string) ([]string, error) {
+	b, err := os.ReadFile(path + ".pub")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%s.pub is not a public key", path)
+	}
+	return fields, nil
+}
+
+// authorizedKeyEntry is the line of the public key pub in authorized_keys.
+func authorizedKeyEntry(pub []string) string {
+	return authorizedKeyOptions + " " + strings.Join(pub, " ") + "\n"
+}
+
+// authorizeKeyScript appends the entry on its stdin to authorized_keys
+// unless the key pub is there already, and says "added" or "present". The
+// blob of the key is base64 and safe to quote.
+func authorizeKeyScript(pub []string) string {
+	return `umask 077 && mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && ` +
+		`if grep -qF '` + pub[1] + `' ~/.ssh/authorized_keys; then echo present; ` +
+		`else cat >> ~/.ssh/authorized_keys && echo added; fi`
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// "tut rotate-key" replaces the key of vps.ssh_key without downtime. It
+// creates a new key next to the old one, adds it to authorized_keys on vps
+// and on every mirror that uses the same key, and checks that each accepts
+// it. Only then does it move the new key over the old file, so the config
+// stays as it is and the running tut takes the new key for its next
+// connection; sessions that are up stay up. Last, it removes the old key
+// from the VPSes, logging in with the new one.
+
+// runRotateKeyCommand implements "tut rotate-key".
+func runRotateKeyCommand(args []string) int {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	_ = fs.Parse(args)
+
+	requireBinary("ssh")
+	requireBinary("ssh-keygen")
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		die("Invalid config: %v", err)
+	}
+	path := cfg.VPS.SSHKey
+	switch {
+	case isCredential(path):
+		die("tut rotate-key replaces a key file; rotate %s in its store", path)
+	case cfg.VPS.SSHKeyPassphrase != "":
+		die("tut rotate-key makes keys without a passphrase; rotate a key with vps.ssh_key_passphrase by hand")
+	}
+	oldPub, err := publicKeyOf(path)
+	if err != nil {
+		die("Cannot read the public key of %s: %v", path, err)
+	}
+	targets := []*Config{cfg}
+	for _, m := range cfg.Mirrors {
+		if m.SSHKey == path {
+			targets = append(targets, mirrorConfig(cfg, m))
+		}
+	}
+
+	newPath := path + ".new"
+	_ = os.Remove(newPath)
+	_ = os.Remove(newPath + ".pub")
+	if err := generateKey(newPath); err != nil {
+		die("Cannot create the new key: %v", err)
+	}
+	newPub, err := readPublicKey(newPath)
+	if err != nil {
+		die("Cannot read the new public key: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), enrollTimeout)
+	defer cancel()
+
+	// the old key stays until every VPS takes the new one
+	var installed []*Config
+	for _, t := range targets {
+		err := installKey(ctx, t, newPath, newPub)
+		if err == nil {
+			installed = append(installed, t)
+			fmt.Printf("%s@%s accepts the new key\n", t.VPS.User, t.VPS.Host)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s@%s: %v\n", t.VPS.User, t.VPS.Host, err)
+		for _, t := range append(installed, t) {
+			if _, err := agentSSH(ctx, t, revokeKeyScript(newPub, oldPub), nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot remove the new key from %s@%s again: %v\n", t.VPS.User, t.VPS.Host, err)
+			}
+		}
+		_ = os.Remove(newPath)
+		_ = os.Remove(newPath + ".pub")
+		fmt.Fprintln(os.Stderr, "Key rotation aborted; the old key is still in use.")
+		return 1
+	}
+
+	if err := os.Rename(newPath, path); err != nil {
+		die("Cannot replace %s: %v", path, err)
+	}
+	if err := os.Rename(newPath+".pub", path+".pub"); err != nil {
+		die("Cannot replace %s.pub: %v", path, err)
+	}
+	fmt.Printf("Replaced %s with the new key\n", path)
+
+	failed := false
+	for _, t := range targets {
+		if _, err := agentSSH(ctx, t, revokeKeyScript(oldPub, newPub), nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot remove the old key from %s@%s: %v\n", t.VPS.User, t.VPS.Host, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Removed the old key from %s@%s\n", t.VPS.User, t.VPS.Host)
+	}
+	if failed {
+		fmt.Fprintf(os.Stderr, "Remove the old key (%s) from authorized_keys there by hand.\n", oldPub[1])
+		return 1
+	}
+	return 0
+}
+
+// installKey adds the key at path, with the public key pub, to
+// authorized_keys on the VPS of cfg through the current key, and checks
+// that the VPS accepts it.
+func installKey(ctx context.Context, cfg *Config, path string, pub []string) error {
+	if _, err := agentSSH(ctx, cfg, authorizeKeyScript(pub), strings.NewReader(authorizedKeyEntry(pub))); err != nil {
+		return fmt.Errorf("adding the new key: %w", err)
+	}
+	test := *cfg
+	test.VPS.SSHKey = path
+	if _, err := agentSSH(ctx, &test, "true", nil); err != nil {
+		return fmt.Errorf("logging in with the new key: %w", err)
+	}
+	return nil
+}
+
+// revokeKeyScript removes the key pub from authorized_keys, provided the
+// key keep is still there so the VPS cannot be locked out.
+func revokeKeyScript(pub, keep []string) string {
+	return `umask 077 && f=~/.ssh/authorized_keys && grep -qF '` + keep[1] + `' "$f" && ` +
+		`{ grep -vF '` + pub[1] + `' "$f" || true; } > "$f.tut" && mv "$f.tut" "$f"`
+}
+
+// publicKeyOf returns the fields of the public key of the key at path,
+// from path.pub or else derived from the private key.
+func publicKeyOf(path string) ([]string, error) {
+	if fields, err := readPublicKey(path); err == nil {
+		return fields, nil
+	}
+	out, err := exec.Command("ssh-keygen", "-y", "-f", path).Output()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return nil, errors.New("ssh-keygen -y printed no public key")
+	}
+	return fields, nil
+}
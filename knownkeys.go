@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A misspelt setting would otherwise be ignored: remoteport instead of
+// remote_port leaves the forward on port 0, which asks the VPS for any
+// free port. checkKnownKeys rejects every key the config has no setting
+// for, with its line and the setting closest to it.
+
+// checkKnownKeys checks the keys of the config doc, read from path,
+// against the settings of Config.
+func checkKnownKeys(doc *yaml.Node, path string) error {
+	root := mappingRoot(doc)
+	if root == nil {
+		return nil
+	}
+	var errs []error
+	unknownKeys(root, reflect.TypeOf(Config{}), "", func(k *yaml.Node, key, hint string) {
+		err := fmt.Errorf("%s:%d: unknown setting %s", path, k.Line, key)
+		if hint != "" {
+			err = fmt.Errorf("%w; did you mean %s?", err, hint)
+		}
+		errs = append(errs, err)
+	})
+	return errors.Join(errs...)
+}
+
+// unknownKeys calls report for every key of the mapping m that the struct
+// t has no field for, by its path and a suggestion.
+func unknownKeys(m *yaml.Node, t reflect.Type, prefix string, report func(k *yaml.Node, key, hint string)) {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		if name := yamlName(t.Field(i)); name != "" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		key := prefix + k.Value
+		ft, ok := fields[k.Value]
+		switch {
+		case !ok && key == "include":
+			// taken out by includeFiles
+		case !ok:
+			report(k, key, suggestKey(key, k.Value, fields))
+		case ft.Kind() == reflect.Struct && v.Kind == yaml.MappingNode:
+			unknownKeys(v, ft, key+".", report)
+		case ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct && v.Kind == yaml.SequenceNode:
+			for j, item := range v.Content {
+				if item.Kind == yaml.MappingNode {
+					unknownKeys(item, ft.Elem(), fmt.Sprintf("%s[%d].", key, j), report)
+				}
+			}
+		}
+	}
+}
+
+// suggestKey returns the setting meant by the unknown key name at path,
+// quoted: the new name of a version 1 setting, or the closest of fields.
+func suggestKey[T any](path, name string, fields map[string]T) string {
+	old := path
+	if i := strings.LastIndexByte(path, '['); i >= 0 {
+		if j := strings.IndexByte(path[i:], ']'); j >= 0 {
+			old = path[:i] + "[]" + path[i+j+1:]
+		}
+	}
+	if renamed, ok := unitRenames[old]; ok {
+		return fmt.Sprintf("%q (with a unit, as of config version 2)", renamed)
+	}
+	squash := func(s string) string { return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(s)) }
+	names := make([]string, 0, len(fields))
+	for f := range fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	best, bestDist := "", 0
+	for _, f := range names {
+		d := editDistance(squash(name), squash(f))
+		if best == "" || d < bestDist {
+			best, bestDist = f, d
+		}
+	}
+	if best == "" || bestDist > max(2, len(name)/3) {
+		return ""
+	}
+	return strconv.Quote(best)
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations that expose a Service or Ingress through the VPS. Only
+// tut.dev/expose is required.
+const (
+	annotationExpose = "tut.dev/expose" // public port on the VPS; "true" uses the service port, "0" lets the VPS assign one
+	annotationPort   = "tut.dev/port"   // port number or name to forward to (default: the only port)
+	annotationName   = "tut.dev/name"   // forward name (default: k8s-<namespace>-<name>)
+)
+
+// serviceAccountDir holds the credentials of the pod tut runs in.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client: it lists and watches.
+type kubeClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// newKubeClient connects to apiURL, or to the cluster tut runs in when empty.
+func newKubeClient(apiURL string) (*kubeClient, error) {
+	if apiURL != "" {
+		// e.g. kubectl proxy, which handles authentication itself
+		return &kubeClient{base: strings.TrimSuffix(apiURL, "/"), http: &http.Client{}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster; set kubernetes.api_url")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid cluster CA certificate")
+	}
+	return &kubeClient{
+		base:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		http:  &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+	}, nil
+}
+
+// get starts a GET request for path and checks the status.
+func (k *kubeClient) get(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// kubeMeta is the object metadata we use.
+type kubeMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// kubePort is a named port of a Service or Ingress backend.
+type kubePort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		ClusterIP string     `json:"clusterIP"`
+		Ports     []kubePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeIngress struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		TLS []json.RawMessage `json:"tls"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP       string `json:"ip"`
+				Hostname string `json:"hostname"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+// watchKubernetes keeps forwards for annotated Services and Ingresses.
+func (d *daemon) watchKubernetes(ctx context.Context) {
+	kc := d.config().Kubernetes
+	if !kc.Enabled {
+		return
+	}
+	client, err := newKubeClient(kc.APIURL)
+	if err != nil {
+		logEvent(levelError, "", "kubernetes-failed", "Kubernetes discovery disabled: %v", err)
+		return
+	}
+	prefix := "/"
+	if kc.Namespace != "" {
+		prefix = "/namespaces/" + kc.Namespace + "/"
+	}
+	go d.followKube(ctx, client, "kubernetes services", "/api/v1"+prefix+"services", serviceForwards)
+	d.followKube(ctx, client, "kubernetes ingresses", "/apis/networking.k8s.io/v1"+prefix+"ingresses", ingressForwards)
+}
+
+// followKube lists the objects at path, applies their forwards and waits
+// for the next change, until ctx is cancelled.
+func (d *daemon) followKube(ctx context.Context, k *kubeClient, source, path string, forwards func([]byte) ([]TCPForward, string, error)) {
+	for ctx.Err() == nil {
+		err := d.syncKube(ctx, k, source, path, forwards)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logEvent(levelWarn, "", "kubernetes-failed", "Watching %s failed: %v; retrying in 10s", source, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+// syncKube lists once, applies the result and returns on the next event or
+// when the server ends the watch.
+func (d *daemon) syncKube(ctx context.Context, k *kubeClient, source, path string, forwards func([]byte) ([]TCPForward, string, error)) error {
+	body, err := k.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	fwds, version, err := forwards(b)
+	if err != nil {
+		return err
+	}
+	d.setDynamic(source, fwds)
+
+	body, err = k.get(ctx, path+"?watch=1&resourceVersion="+version)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var ev struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(body).Decode(&ev); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// serviceForwards builds the forwards of a Service list and returns its
+// resource version.
+func serviceForwards(b []byte) ([]TCPForward, string, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []kubeService `json:"items"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, "", err
+	}
+	var out []TCPForward
+	for _, s := range list.Items {
+		if _, ok := s.Metadata.Annotations[annotationExpose]; !ok {
+			continue
+		}
+		if s.Spec.ClusterIP == "" || s.Spec.ClusterIP == "None" {
+			logEvent(levelWarn, "", "kubernetes-skipped", "Service %s/%s has no cluster IP", s.Metadata.Namespace, s.Metadata.Name)
+			continue
+		}
+		f, err := exposedForward(s.Metadata, "", s.Spec.ClusterIP, s.Spec.Ports)
+		if err != nil {
+			logEvent(levelWarn, "", "kubernetes-skipped", "Service %s/%s: %v", s.Metadata.Namespace, s.Metadata.Name, err)
+			continue
+		}
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, list.Metadata.ResourceVersion, nil
+}
+
+// ingressForwards builds the forwards of an Ingress list. They point at
+// the load balancer address of the ingress, port 443 with TLS and 80
+// otherwise.
+func ingressForwards(b []byte) ([]TCPForward, string, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []kubeIngress `json:"items"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, "", err
+	}
+	var out []TCPForward
+	for _, ing := range list.Items {
+		if _, ok := ing.Metadata.Annotations[annotationExpose]; !ok {
+			continue
+		}
+		lb := ing.Status.LoadBalancer.Ingress
+		if len(lb) == 0 {
+			// not admitted yet; the status update triggers another sync
+			continue
+		}
+		host := lb[0].IP
+		if host == "" {
+			host = lb[0].Hostname
+		}
+		ports := []kubePort{{Name: "http", Port: 80}}
+		if len(ing.Spec.TLS) > 0 {
+			ports = []kubePort{{Name: "https", Port: 443}}
+		}
+		f, err := exposedForward(ing.Metadata, "-ingress", host, ports)
+		if err != nil {
+			logEvent(levelWarn, "", "kubernetes-skipped", "Ingress %s/%s: %v", ing.Metadata.Namespace, ing.Metadata.Name, err)
+			continue
+		}
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, list.Metadata.ResourceVersion, nil
+}
+
+// exposedForward builds the forward described by the annotations of an
+// object reachable at host on one of ports.
+func exposedForward(m kubeMeta, suffix, host string, ports []kubePort) (TCPForward, error) {
+	f := TCPForward{Name: m.Annotations[annotationName], LocalHost: host}
+	if f.Name == "" {
+		f.Name = "k8s-" + m.Namespace + "-" + m.Name + suffix
+	}
+	if !validName(f.Name) {
+		return f, fmt.Errorf("invalid forward name %q", f.Name)
+	}
+	want, ok := m.Annotations[annotationPort]
+	switch {
+	case ok:
+		for _, p := range ports {
+			if p.Name == want || strconv.Itoa(p.Port) == want {
+				f.LocalPort = p.Port
+			}
+		}
+		if f.LocalPort == 0 {
+			if n, err := strconv.Atoi(want); err == nil && isPort(n) {
+				f.LocalPort = n
+			}
+		}
+		if f.LocalPort == 0 {
+			return f, fmt.Errorf("unknown %s %q", annotationPort, want)
+		}
+	case len(ports) == 1:
+		f.LocalPort = ports[0].Port
+	default:
+		return f, fmt.Errorf("%d ports; set %s", len(ports), annotationPort)
+	}
+	switch expose := m.Annotations[annotationExpose]; expose {
+	case "true":
+		f.RemotePort = f.LocalPort
+	default:
+		n, err := strconv.Atoi(expose)
+		if err != nil || n != 0 && !isPort(n) {
+			return f, fmt.Errorf("invalid %s %q", annotationExpose, expose)
+		}
+		f.RemotePort = n
+	}
+	return f, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// LAN games and devices find each other with multicast or broadcast
+// datagrams (game server browsers, SSDP, mDNS), which never leave the local
+// network. A UDP forward with protocol: lan relays one group, or the
+// broadcasts to one port, between the local network and remote players for
+// a "virtual LAN party" through the VPS:
+//   - players run "tut lan join" against the public port; it repeats the
+//     group of their own network to the VPS and what comes back into it;
+//   - the agent on the VPS passes what one player sends to the others and
+//     through the tunnel, and what comes through the tunnel to all players
+//     seen within lanClientTTL;
+//   - locally the agent sends what players send into the group, from one
+//     socket per player so that unicast answers (an SSDP response, a game
+//     server's reply) go back to that player alone, and passes what the
+//     group carries to all players.
+//
+// Frames on the wrap port are writeLenPrefixed frames holding the address
+// of the player, or "*" for all of them, a zero byte and the datagram.
+
+// lanClientTTL is how long the VPS keeps sending to a player that went
+// silent; tut lan join sends an empty datagram every lanKeepalive.
+const (
+	lanClientTTL = 90 * time.Second
+	lanKeepalive = 20 * time.Second
+)
+
+// lanAll addresses a frame to every player.
+const lanAll = "*"
+
+// runAgentLAN implements "tut agent lan". With -listen it is the VPS side,
+// with -accept or -accept-fd the local side.
+func runAgentLAN(args []string) int {
+	fs := flag.NewFlagSet("agent lan", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public UDP port (VPS side)")
+	bind := fs.String("bind", "0.0.0.0", "Address of the public port (VPS side)")
+	connect := fs.String("connect", "", "Wrap port to connect to (VPS side)")
+	accept := fs.String("accept", "", "Wrap address to listen on (local side)")
+	acceptFD := fs.Int("accept-fd", 0, "Inherited wrap listener (local side)")
+	target := fs.String("target", "", "Multicast group or broadcast address and port (local side)")
+	iface := fs.String("interface", "", "Local interface of the group (local side)")
+	_ = fs.Parse(args)
+
+	var err error
+	switch {
+	case *listen != 0 && *connect != "":
+		err = lanServe(*bind, *listen, *connect)
+	case (*accept != "" || *acceptFD != 0) && *target != "":
+		var ln net.Listener
+		if ln, err = wrapListener(*accept, *acceptFD); err == nil {
+			err = lanLocal(ln, *target, *iface)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: tut agent lan -listen port -connect addr | -accept addr -target group:port [-interface name]")
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
+
+// lanFrame is the frame of datagram b to or from the player addr.
+func lanFrame(addr string, b []byte) []byte {
+	return append(append([]byte(addr), 0), b...)
+}
+
+// parseLANFrame splits a frame into the player address and the datagram.
+func parseLANFrame(f []byte) (string, []byte, error) {
+	i := bytes.IndexByte(f, 0)
+	if i < 0 {
+		return "", nil, errors.New("invalid lan frame")
+	}
+	return string(f[:i]), f[i+1:], nil
+}
+
+// lanServe is the VPS side: it keeps the players of the public port and
+// relays between them and the wrap port.
+func lanServe(bind string, port int, connect string) error {
+	pc, err := agentListenUDP(bind, port)
+	if err != nil {
+		return err
+	}
+	logf("LAN relay on UDP port %d via %s", port, connect)
+	var mu sync.Mutex
+	players := make(map[string]*net.UDPAddr)
+	seen := make(map[string]time.Time)
+	// sendTo sends b to the player to, or to all players but except
+	sendTo := func(to, except string, b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		for key, addr := range players {
+			if time.Since(seen[key]) > lanClientTTL {
+				delete(players, key)
+				delete(seen, key)
+				logf("LAN player %s left", key)
+				continue
+			}
+			if to == key || to == lanAll && key != except {
+				_, _ = pc.WriteToUDP(b, addr)
+			}
+		}
+	}
+
+	var cmu sync.Mutex
+	var conn net.Conn
+	go func() {
+		for {
+			c, err := net.DialTimeout("tcp", connect, 5*time.Second)
+			if err != nil {
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			cmu.Lock()
+			conn = c
+			cmu.Unlock()
+			r := bufio.NewReader(c)
+			for {
+				f, err := readLenPrefixed(r)
+				if err != nil {
+					break
+				}
+				if to, b, err := parseLANFrame(f); err == nil {
+					sendTo(to, "", b)
+				}
+			}
+			cmu.Lock()
+			conn = nil
+			cmu.Unlock()
+			_ = c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		key := from.String()
+		mu.Lock()
+		if players[key] == nil {
+			logf("LAN player %s joined", key)
+		}
+		players[key] = from
+		seen[key] = time.Now()
+		mu.Unlock()
+		if n == 0 {
+			continue // a keepalive of tut lan join
+		}
+		sendTo(lanAll, key, buf[:n])
+		cmu.Lock()
+		if conn != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := writeLenPrefixed(conn, lanFrame(key, buf[:n])); err != nil {
+				// makes the reader reconnect
+				_ = conn.Close()
+			}
+		}
+		cmu.Unlock()
+	}
+}
+
+// lanGroup is the multicast group or broadcast address relayed on a
+// network, with the sockets that send into it.
+type lanGroup struct {
+	addr  *net.UDPAddr
+	src   net.IP // the address of the interface, nil for any
+	in    *net.UDPConn
+	mu    sync.Mutex
+	ports map[int]bool // of the sockets sending into the group
+}
+
+// listenLANGroup joins the group target on the interface name, or listens
+// for the broadcasts to its port, sharing the port with local services.
+func listenLANGroup(target, name string) (*lanGroup, error) {
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return nil, err
+	}
+	g := &lanGroup{addr: addr, ports: make(map[int]bool)}
+	var ifi *net.Interface
+	if name != "" {
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			return nil, err
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+				g.src = n.IP
+				break
+			}
+		}
+	}
+	if addr.IP.IsMulticast() {
+		g.in, err = net.ListenMulticastUDP("udp4", ifi, addr)
+		return g, err
+	}
+	lc := net.ListenConfig{Control: reuseAddr}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", addr.Port))
+	if err != nil {
+		return nil, err
+	}
+	g.in = pc.(*net.UDPConn)
+	return g, nil
+}
+
+// sender returns a new socket sending into the group.
+func (g *lanGroup) sender() (*net.UDPConn, error) {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: g.src})
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.ports[c.LocalAddr().(*net.UDPAddr).Port] = true
+	g.mu.Unlock()
+	return c, nil
+}
+
+// release forgets the socket c.
+func (g *lanGroup) release(c *net.UDPConn) {
+	g.mu.Lock()
+	delete(g.ports, c.LocalAddr().(*net.UDPAddr).Port)
+	g.mu.Unlock()
+	_ = c.Close()
+}
+
+// read returns the next datagram of the group that was not sent by one of
+// its senders, which multicast loops back and broadcasts reach too.
+func (g *lanGroup) read(buf []byte) (int, error) {
+	for {
+		n, from, err := g.in.ReadFromUDP(buf)
+		if err != nil {
+			return 0, err
+		}
+		g.mu.Lock()
+		own := g.ports[from.Port] && isLocalIP(from.IP)
+		g.mu.Unlock()
+		if !own {
+			return n, nil
+		}
+	}
+}
+
+// isLocalIP reports whether ip is an address of this host.
+func isLocalIP(ip net.IP) bool {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return ip.IsLoopback()
+}
+
+// lanLocal is the local side: it sends what players send into the group
+// and passes the group and the answers to each player back on the
+// connection that delivered the latest frame.
+func lanLocal(ln net.Listener, target, iface string) error {
+	g, err := listenLANGroup(target, iface)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	var current net.Conn
+	send := func(to string, b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if current != nil {
+			_ = current.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_ = writeLenPrefixed(current, lanFrame(to, b))
+		}
+	}
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := g.read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil {
+				send(lanAll, buf[:n])
+			}
+		}
+	}()
+
+	var pmu sync.Mutex
+	players := make(map[string]*net.UDPConn)
+	// player returns the socket sending into the group for the player addr,
+	// which relays unicast answers to it until it is idle for lanClientTTL
+	player := func(addr string) (*net.UDPConn, error) {
+		pmu.Lock()
+		defer pmu.Unlock()
+		if c := players[addr]; c != nil {
+			return c, nil
+		}
+		c, err := g.sender()
+		if err != nil {
+			return nil, err
+		}
+		players[addr] = c
+		go func() {
+			defer func() {
+				pmu.Lock()
+				delete(players, addr)
+				pmu.Unlock()
+				g.release(c)
+			}()
+			buf := make([]byte, 64*1024)
+			for {
+				_ = c.SetReadDeadline(time.Now().Add(lanClientTTL))
+				n, err := c.Read(buf)
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					return
+				}
+				if err == nil {
+					send(addr, buf[:n])
+				}
+			}
+		}()
+		return c, nil
+	}
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		// the VPS connects once and sends only when players do
+		mu.Lock()
+		current = c
+		mu.Unlock()
+		go func() {
+			defer func() {
+				mu.Lock()
+				if current == c {
+					current = nil
+				}
+				mu.Unlock()
+				_ = c.Close()
+			}()
+			r := bufio.NewReader(c)
+			for {
+				f, err := readLenPrefixed(r)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				current = c
+				mu.Unlock()
+				from, b, err := parseLANFrame(f)
+				if err != nil {
+					continue
+				}
+				if s, err := player(from); err == nil {
+					_, _ = s.WriteToUDP(b, g.addr)
+				}
+			}
+		}()
+	}
+}
+
+// runLANCommand implements "tut lan", run by remote players.
+func runLANCommand(args []string) int {
+	if len(args) == 0 || args[0] != "join" {
+		fmt.Fprintln(os.Stderr, "usage: tut lan join -server vps:port -group group:port [-interface name]")
+		return 2
+	}
+	fs := flag.NewFlagSet("lan join", flag.ExitOnError)
+	server := fs.String("server", "", "Public address of the LAN forward on the VPS")
+	group := fs.String("group", "", "Multicast group or broadcast address and port, as in the forward")
+	iface := fs.String("interface", "", "Local interface of the group")
+	_ = fs.Parse(args[1:])
+	if *server == "" || *group == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut lan join -server vps:port -group group:port [-interface name]")
+		return 2
+	}
+	if err := lanJoin(*server, *group, *iface); err != nil {
+		die("%v", err)
+	}
+	return 0
+}
+
+// lanJoin relays between the group of this network and the VPS until it
+// fails: the group and the answers to what came from the VPS go up, what
+// comes from the VPS goes into the group.
+func lanJoin(server, group, iface string) error {
+	up, err := net.Dial("udp", server)
+	if err != nil {
+		return err
+	}
+	g, err := listenLANGroup(group, iface)
+	if err != nil {
+		return err
+	}
+	out, err := g.sender()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Relaying %s between this network and %s; Ctrl-C to stop\n", group, server)
+	// the first keepalive makes the VPS send to us before we sent anything
+	go func() {
+		for {
+			if _, err := up.Write(nil); err != nil {
+				return
+			}
+			time.Sleep(lanKeepalive)
+		}
+	}()
+	relay := func(read func([]byte) (int, error)) {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err == nil && n > 0 {
+				_, _ = up.Write(buf[:n])
+			}
+		}
+	}
+	go relay(g.read)
+	go relay(out.Read)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := up.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err == nil && n > 0 {
+			_, _ = out.WriteToUDP(buf[:n], g.addr)
+		}
+	}
+}
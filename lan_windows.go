@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// reuseAddr lets the broadcast listener of a LAN forward share its port
+// with the local service that uses it.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var cpuQuotaRe = regexp.MustCompile(`^([0-9]+)%$`)
+
+// ioniceClasses maps the configurable I/O scheduling classes to ionice -c values.
+var ioniceClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+// validateRemote checks the remote resource limit settings.
+func validateRemote(r RemoteConfig) error {
+	if r.Nice < -20 || r.Nice > 19 {
+		return fmt.Errorf("invalid remote.nice: %d (must be -20..19)", r.Nice)
+	}
+	if _, ok := ioniceClasses[r.IONiceClass]; r.IONiceClass != "" && !ok {
+		return fmt.Errorf("invalid remote.ionice_class: %q (use realtime, best-effort or idle)", r.IONiceClass)
+	}
+	if r.MemoryMax < 0 {
+		return fmt.Errorf("invalid remote.memory_max: %s (e.g. 64MiB)", r.MemoryMax)
+	}
+	if m := cpuQuotaRe.FindStringSubmatch(r.CPUQuota); r.CPUQuota != "" && (m == nil || m[1] == "0") {
+		return fmt.Errorf("invalid remote.cpu_quota: %q (e.g. 50%%)", r.CPUQuota)
+	}
+	return nil
+}
+
+// remoteLimits returns the shell snippet that applies the configured limits
+// to the remote script itself, so every process it spawns inherits them.
+// Priorities use renice/ionice; memory and CPU limits use a dedicated cgroup
+// v2 group. Missing tools or permissions only produce a warning so that
+// limits never prevent the tunnel from coming up.
+func remoteLimits(r RemoteConfig) string {
+	var b strings.Builder
+	if r.Nice != 0 {
+		b.WriteString(fmt.Sprintf(`renice -n %d -p $$ >/dev/null 2>&1 || echo "WARNING: renice failed on VPS" >&2; `, r.Nice))
+	}
+	if c, ok := ioniceClasses[r.IONiceClass]; ok {
+		b.WriteString(fmt.Sprintf(`if command -v ionice >/dev/null 2>&1; then ionice -c %d -p $$ 2>/dev/null || echo "WARNING: ionice failed on VPS" >&2; fi; `, c))
+	}
+	if r.MemoryMax == 0 && r.CPUQuota == "" {
+		return b.String()
+	}
+	b.WriteString(`CG="/sys/fs/cgroup/tut-$$"; `)
+	b.WriteString(`if [ -f /sys/fs/cgroup/cgroup.controllers ] && mkdir "$CG" 2>/dev/null; then `)
+	if r.MemoryMax > 0 {
+		b.WriteString(fmt.Sprintf(`echo %d > "$CG/memory.max" 2>/dev/null || echo "WARNING: cannot set memory.max on VPS" >&2; `, int64(r.MemoryMax)))
+	}
+	if m := cpuQuotaRe.FindStringSubmatch(r.CPUQuota); m != nil {
+		pct, _ := strconv.Atoi(m[1])
+		b.WriteString(fmt.Sprintf(`echo "%d 100000" > "$CG/cpu.max" 2>/dev/null || echo "WARNING: cannot set cpu.max on VPS" >&2; `, pct*1000))
+	}
+	b.WriteString(`echo $$ > "$CG/cgroup.procs" 2>/dev/null || echo "WARNING: cannot join cgroup on VPS" >&2; `)
+	b.WriteString(`else CG=""; echo "WARNING: cgroup v2 not writable on VPS; memory/CPU limits not applied" >&2; fi; `)
+	return b.String()
+}
+
+// remoteLimitsCleanup returns the cleanup snippet removing the cgroup created
+// by remoteLimits once the script exits.
+func remoteLimitsCleanup(r RemoteConfig) string {
+	if r.MemoryMax == 0 && r.CPUQuota == "" {
+		return ""
+	}
+	return `if [ -n "$CG" ]; then echo $$ > /sys/fs/cgroup/cgroup.procs 2>/dev/null; rmdir "$CG" 2>/dev/null || true; fi; `
+}
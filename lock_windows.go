@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLock is not available: the lock agent runs on a Unix VPS.
+func tryLock(*os.File) (bool, error) {
+	return false, errors.New("locking is not supported on windows")
+}
+
+func unlock(*os.File) {}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is a syslog severity, as used by journald's PRIORITY field.
+type logLevel int
+
+const (
+	levelError logLevel = 3
+	levelWarn  logLevel = 4
+	levelInfo  logLevel = 6
+	levelDebug logLevel = 7
+)
+
+// logEntry is one log event. forward and event are optional structured
+// fields; sinks that cannot store them render forward as a "[name]" prefix.
+type logEntry struct {
+	time    time.Time
+	level   logLevel
+	forward string
+	event   string
+	msg     string
+}
+
+// logSink writes a log entry to its destination.
+type logSink func(e logEntry)
+
+var (
+	logMu       sync.Mutex
+	currentSink logSink = writeText
+	logDebug    bool    // log.level: debug
+	// logBuffer holds the last logBufferSize entries of every level, debug
+	// included, for tut debug dump and crash reports; logNext counts the
+	// entries ever kept, so the next one goes to logNext%logBufferSize.
+	logBuffer     []logEntry
+	logNext       int
+	logBufferSize = defaultLogBuffer
+)
+
+// defaultLogBuffer is log.buffer unless profile low-memory lowers it.
+const defaultLogBuffer = 5000
+
+// logf logs an informational message.
+func logf(format string, args ...any) {
+	logEvent(levelInfo, "", "", format, args...)
+}
+
+// logEvent logs a message with a severity and optional forward and event
+// fields, e.g. logEvent(levelWarn, "minecraft", "probe-failed", ...).
+func logEvent(level logLevel, forward, event, format string, args ...any) {
+	logMu.Lock()
+	skip := level == levelDebug && !logDebug
+	keep := logBufferSize > 0
+	logMu.Unlock()
+	if skip && !keep {
+		return
+	}
+	e := logEntry{
+		time:    time.Now(),
+		level:   level,
+		forward: forward,
+		event:   event,
+		msg:     fmt.Sprintf(format, args...),
+	}
+	if event != "" && !skip {
+		events.publish(apiEvent{Time: e.time, Type: event, Level: level.String(), Forward: forward, Msg: e.msg})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	keepLogEntry(e)
+	if !skip {
+		currentSink(e)
+	}
+}
+
+// keepLogEntry adds e to logBuffer, replacing the oldest entry once it is
+// full. logMu must be held.
+func keepLogEntry(e logEntry) {
+	if logBufferSize <= 0 {
+		return
+	}
+	if len(logBuffer) < logBufferSize {
+		logBuffer = append(logBuffer, e)
+	} else {
+		logBuffer[logNext%logBufferSize] = e
+	}
+	logNext++
+}
+
+// recentLogEntries returns the entries of logBuffer logged since since,
+// oldest first.
+func recentLogEntries(since time.Time) []logEntry {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return bufferedLogs(since)
+}
+
+// bufferedLogs is recentLogEntries with logMu held.
+func bufferedLogs(since time.Time) []logEntry {
+	var out []logEntry
+	for i := max(0, logNext-len(logBuffer)); i < logNext; i++ {
+		if e := logBuffer[i%len(logBuffer)]; !e.time.Before(since) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// setLogBuffer makes logBuffer hold the last size entries, keeping those
+// it holds already; 0 or less keeps none.
+func setLogBuffer(size int) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	kept := bufferedLogs(time.Time{})
+	if len(kept) > size {
+		kept = kept[len(kept)-max(size, 0):]
+	}
+	logBuffer, logNext, logBufferSize = kept, len(kept), size
+}
+
+// logLines renders entries as text for crash reports, see line.
+func logLines(entries []logEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.record().line() + "\n")
+	}
+	return b.String()
+}
+
+// writeText is the default sink: one timestamped line per entry on stdout.
+func writeText(e logEntry) {
+	writeTextTo(os.Stdout, e)
+}
+
+// String returns the lower-case level name.
+func (l logLevel) String() string {
+	switch l {
+	case levelError:
+		return "error"
+	case levelWarn:
+		return "warning"
+	case levelInfo:
+		return "info"
+	}
+	return "debug"
+}
+
+// logRecord is a log entry in JSON.
+type logRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Forward string `json:"forward,omitempty"`
+	Event   string `json:"event,omitempty"`
+	Msg     string `json:"msg"`
+}
+
+// record returns e in JSON form.
+func (e logEntry) record() logRecord {
+	return logRecord{e.time.Format(time.RFC3339Nano), e.level.String(), e.forward, e.event, e.msg}
+}
+
+// line renders r as one line of text with the level and the event, as tut
+// debug dump prints it.
+func (r logRecord) line() string {
+	s := fmt.Sprintf("%s %-7s", r.Time, r.Level)
+	if r.Event != "" {
+		s += " " + r.Event
+	}
+	if r.Forward != "" {
+		s += " [" + r.Forward + "]"
+	}
+	return s + " " + r.Msg
+}
+
+// writeJSONTo writes e as one JSON object per line to w.
+func writeJSONTo(w io.Writer, e logEntry) {
+	b, _ := json.Marshal(e.record())
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// writeTextTo writes e as one timestamped line to w.
+func writeTextTo(w io.Writer, e logEntry) {
+	msg := e.msg
+	if e.forward != "" {
+		msg = "[" + e.forward + "] " + msg
+	}
+	fmt.Fprintf(w, "%s %s\n", e.time.Format("2006-01-02T15:04:05-0700"), msg)
+}
+
+// setupLogging selects the log sink. Format is "text", "json", "journald"
+// or "auto", which uses the journal when running as a systemd service. Text
+// and JSON go to lc.File when set and stdout otherwise. On Windows, warnings and
+// errors are additionally reported to the event log unless disabled. Debug
+// entries are dropped unless Level is "debug".
+func setupLogging(lc LogConfig) error {
+	var out io.Writer = os.Stdout
+	if lc.File != "" {
+		f, err := os.OpenFile(lc.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	text := logSink(func(e logEntry) { writeTextTo(out, e) })
+	var sink logSink
+	switch lc.Format {
+	case "text":
+		sink = text
+	case "json":
+		sink = func(e logEntry) { writeJSONTo(out, e) }
+	case "journald":
+		j, err := openJournal()
+		if err != nil {
+			return err
+		}
+		sink = j
+	case "", "auto":
+		sink = text
+		if os.Getenv("JOURNAL_STREAM") != "" && lc.File == "" {
+			if j, err := openJournal(); err == nil {
+				sink = j
+			}
+		}
+	default:
+		return fmt.Errorf("unknown log format %q", lc.Format)
+	}
+	switch lc.EventLog {
+	case "", "auto":
+		if runtime.GOOS == "windows" {
+			if el, err := openEventLog(sink); err == nil {
+				sink = el
+			}
+		}
+	case "true":
+		el, err := openEventLog(sink)
+		if err != nil {
+			return err
+		}
+		sink = el
+	case "false":
+	default:
+		return fmt.Errorf("invalid event_log %q: use auto, true or false", lc.EventLog)
+	}
+	var debug bool
+	switch lc.Level {
+	case "", "info":
+	case "debug":
+		debug = true
+	default:
+		return fmt.Errorf("invalid level %q: use info or debug", lc.Level)
+	}
+	logMu.Lock()
+	currentSink = sink
+	logDebug = debug
+	logMu.Unlock()
+	setLogBuffer(lc.Buffer)
+	return nil
+}
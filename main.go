@@ -1,18 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"gopkg.in/yaml.v3"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -20,36 +26,474 @@ import (
 // Config represents the YAML configuration for the tunnel program.
 // See config.example.yaml for a reference.
 type Config struct {
+	// Version is the layout of the config file, see configversion.go.
+	Version int `yaml:"version"`
+
 	VPS struct {
-		Host          string `yaml:"host"`
-		User          string `yaml:"user"`
-		Port          int    `yaml:"port"`
-		SSHKey        string `yaml:"ssh_key"`
-		StrictHostKey string `yaml:"strict_hostkey"`
+		Host             string `yaml:"host"`
+		User             string `yaml:"user"`
+		Port             int    `yaml:"port"`
+		SSHKey           string `yaml:"ssh_key"`            // a file or a credential, see credential.go
+		SSHKeyPassphrase string `yaml:"ssh_key_passphrase"` // credential with the passphrase of SSHKey, if any
+		StrictHostKey    string `yaml:"strict_hostkey"`
+		Compression      string `yaml:"compression"` // true, false or auto (leave it to ssh_config)
+		// AddressFamily is inet, inet6, any (ssh tries the addresses in
+		// order) or auto (race them first, see eyeballs.go).
+		AddressFamily string   `yaml:"address_family"`
+		Ciphers       []string `yaml:"ciphers"`
+		MACs          []string `yaml:"macs"`
+		KexAlgorithms []string `yaml:"kex_algorithms"`
+		// Keepalive is the SSH ServerAliveInterval; three missed keepalives
+		// end the session.
+		Keepalive Duration `yaml:"keepalive"`
+		// Sessions is how many SSH connections the TCP forwards are
+		// spread across, see sessions.go.
+		Sessions int `yaml:"sessions"`
+		// Ports are tried in order before each session when set, instead
+		// of Port; see ports.go.
+		Ports []int `yaml:"ports"`
+		// BindInterface and BindAddress tie the connection to the VPS to
+		// one interface or source address, see bind.go.
+		BindInterface string `yaml:"bind_interface"`
+		BindAddress   string `yaml:"bind_address"`
+		// AvoidRoutes are interfaces and subnets the connection to the VPS
+		// must not go through, see guard.go.
+		AvoidRoutes []string `yaml:"avoid_routes"`
+		// RekeyData and RekeyInterval make ssh renegotiate its keys after
+		// that much data or time (RekeyLimit); 0 keeps the defaults of
+		// ssh.
+		RekeyData     Size     `yaml:"rekey_data"`
+		RekeyInterval Duration `yaml:"rekey_interval"`
+		// MaxAge replaces each session with a new connection once it is
+		// that old, keeping the old one for MaxAgeOverlap; see rotate.go.
+		// 0 keeps sessions as long as they last.
+		MaxAge        Duration `yaml:"max_age"`
+		MaxAgeOverlap Duration `yaml:"max_age_overlap"`
+		// Transport carries the TCP forwards: ssh (remote forwards of the
+		// session) or tailscale (the agent on the VPS connects to tut over
+		// the tailnet), see tailscale.go.
+		Transport        string `yaml:"transport"`
+		TailscaleAddress string `yaml:"tailscale_address"` // of this host in the tailnet, default: from "tailscale ip"
+		TailscalePort    int    `yaml:"tailscale_port"`    // TCP port tut listens on in the tailnet
+		// Obfuscation wraps every SSH connection in a transport that does
+		// not look like SSH, see obfs.go.
+		Obfuscation struct {
+			Mode     string `yaml:"mode"`     // off, shadowsocks or command
+			Port     int    `yaml:"port"`     // of the endpoint on the VPS
+			Password string `yaml:"password"` // of the endpoint
+			Fallback string `yaml:"fallback"` // direct (connect to sshd while the endpoint is down) or none
+			Command  string `yaml:"command"`  // ProxyCommand of mode command, e.g. an obfs4 client
+		} `yaml:"obfuscation"`
 	} `yaml:"vps"`
-	ReconnectDelaySeconds int `yaml:"reconnect_delay_seconds"`
-	TCPForwards           []struct {
-		RemotePort int    `yaml:"remote_port"`
-		LocalHost  string `yaml:"local_host"`
-		LocalPort  int    `yaml:"local_port"`
-	} `yaml:"tcp_forwards"`
-	UDPForwards []struct {
-		UDPPublicPort int    `yaml:"udp_public_port"`
-		LocalHost     string `yaml:"local_host"`
-		LocalUDPPort  int    `yaml:"local_udp_port"`
-		WrapTCPPort   int    `yaml:"wrap_tcp_port"`
-	} `yaml:"udp_forwards"`
-}
-
-// logf prints a timestamped message to stdout.
-func logf(format string, args ...any) {
-	ts := time.Now().Format("2006-01-02T15:04:05-0700")
-	fmt.Printf("%s %s\n", ts, fmt.Sprintf(format, args...))
+	ReconnectDelay Duration `yaml:"reconnect_delay"`
+	StateFile      string   `yaml:"state_file"`
+	RunAs          string   `yaml:"run_as"`
+	Termux         string   `yaml:"termux"` // true, false or auto (detect the app), see termux.go
+	// RuntimeDir holds the FIFOs of the UDP wrappers and the SSH control
+	// socket; it is created when missing.
+	RuntimeDir string `yaml:"runtime_dir"`
+	// CrashDir receives the crash reports of the daemon, see crash.go;
+	// "-" writes none.
+	CrashDir string `yaml:"crash_dir"`
+	// UDPBridge picks what carries UDP forwards on this side: socat, the
+	// builtin bridge (see bridge.go) or auto, socat when it is installed.
+	UDPBridge string `yaml:"udp_bridge"`
+	// Roaming reconnects at once when the route to the VPS changes, see
+	// roam.go: true or false.
+	Roaming string `yaml:"roaming"`
+	// Profile picks defaults: "default" for servers, "low-memory" for
+	// routers and boards with 64-128MB, see memory.go.
+	Profile string       `yaml:"profile"`
+	Memory  MemoryConfig `yaml:"memory"`
+	// MaxTotalConnections caps the connections open through all forwards
+	// together; 0 means no limit. See connlimit.go.
+	MaxTotalConnections int `yaml:"max_total_connections"`
+	Health              struct {
+		StallTimeout        Duration `yaml:"stall_timeout"`
+		ProbeTimeout        Duration `yaml:"probe_timeout"`
+		PingInterval        Duration `yaml:"ping_interval"`         // 0: no pings of the VPS, see ping.go
+		PathReportAfter     int      `yaml:"path_report_after"`     // failures in a row before tracing the path, see traceroute.go
+		PublicCheckInterval Duration `yaml:"public_check_interval"` // 0: no checks of the public ports from the VPS, see publiccheck.go
+	} `yaml:"health"`
+	StatsD struct {
+		Address   string            `yaml:"address"`
+		Prefix    string            `yaml:"prefix"`
+		DogStatsD bool              `yaml:"dogstatsd"`
+		Tags      map[string]string `yaml:"tags"`
+		Interval  Duration          `yaml:"interval"`
+	} `yaml:"statsd"`
+	Log         LogConfig         `yaml:"log"`
+	Remote      RemoteConfig      `yaml:"remote"`
+	Supervisor  SupervisorConfig  `yaml:"supervisor"`
+	Docker      DockerConfig      `yaml:"docker"`
+	Kubernetes  KubernetesConfig  `yaml:"kubernetes"`
+	Registry    RegistryConfig    `yaml:"registry"`
+	DNS         DNSConfig         `yaml:"dns"`
+	Direct      DirectConfig      `yaml:"direct"`
+	Mirrors     []MirrorConfig    `yaml:"mirrors"`
+	HA          HAConfig          `yaml:"ha"`
+	STUNServers []string          `yaml:"stun_servers"`
+	QoS         QoSConfig         `yaml:"qos"`
+	Quota       QuotaConfig       `yaml:"quota"`
+	API         APIConfig         `yaml:"api"`
+	NgrokAPI    NgrokAPIConfig    `yaml:"ngrok_api"`
+	HostRouting HostRoutingConfig `yaml:"host_routing"`
+	DBus        DBusConfig        `yaml:"dbus"`
+	TURN        TURNConfig        `yaml:"turn"`
+	TUN         TUNConfig         `yaml:"tun"`
+	Agent       AgentConfig       `yaml:"agent"`
+	Plugins     []PluginConfig    `yaml:"plugins"`
+	Policy      []PolicyRule      `yaml:"policy"`
+	TCPForwards []TCPForward      `yaml:"tcp_forwards"`
+	UDPForwards []UDPForward      `yaml:"udp_forwards"`
+
+	// CloudflareTunnel is the tunnel of the forwards exposed through
+	// Cloudflare, see cloudflare.go.
+	CloudflareTunnel CloudflareTunnelConfig `yaml:"cloudflare_tunnel"`
+
+	// fileVersion is the version the file was written in, before the
+	// migrations loadConfig ran; 0 for configs that are not files.
+	fileVersion int
+}
+
+// LogConfig selects where log output goes.
+type LogConfig struct {
+	Format   string `yaml:"format"`
+	File     string `yaml:"file"`
+	EventLog string `yaml:"event_log"`
+	Level    string `yaml:"level"` // info or debug
+	// Buffer is how many entries of every level, debug included, are kept
+	// in memory for tut debug dump and crash reports; negative keeps none.
+	Buffer int `yaml:"buffer"`
+	// WrapperDir holds the logs of the local UDP wrappers; "-" sends them
+	// to the standard error of tut.
+	WrapperDir string `yaml:"wrapper_dir"`
+}
+
+// MemoryConfig bounds the memory tut uses itself; profile low-memory
+// lowers the defaults.
+type MemoryConfig struct {
+	Limit       Size     `yaml:"limit"`        // soft limit of the Go runtime, e.g. 32MiB, 0: none
+	RelayBuffer Size     `yaml:"relay_buffer"` // per read of a relayed connection, unless read_buffer is set
+	History     Duration `yaml:"history"`      // throughput history kept per forward, negative: off
+}
+
+// RemoteConfig tunes the processes tut runs on the VPS.
+type RemoteConfig struct {
+	Nice        int    `yaml:"nice"`         // niceness of the remote socat processes
+	IONiceClass string `yaml:"ionice_class"` // realtime, best-effort or idle
+	MemoryMax   Size   `yaml:"memory_max"`   // cgroup v2 memory.max, e.g. 64MiB
+	CPUQuota    string `yaml:"cpu_quota"`    // share of one CPU, e.g. 50%
+	// ScriptTemplate is a text/template file rendered instead of the
+	// generated remote script, see remotetemplate.go.
+	ScriptTemplate string `yaml:"script_template"`
+	// PreCommands run on the VPS before every session, PostCommands after
+	// it ended, see remotecmd.go.
+	PreCommands  []string `yaml:"pre_commands"`
+	PostCommands []string `yaml:"post_commands"`
+	// ProvisionCommands run before a session once per boot of the VPS,
+	// see provision.go.
+	ProvisionCommands []string `yaml:"provision_commands"`
+}
+
+// SupervisorConfig is the restart policy for local child processes.
+type SupervisorConfig struct {
+	BackoffInitial Duration `yaml:"backoff_initial"`
+	BackoffMax     Duration `yaml:"backoff_max"`
+	MaxRestarts    int      `yaml:"max_restarts"`
+	FlapWindow     Duration `yaml:"flap_window"`
+	FlapThreshold  int      `yaml:"flap_threshold"`
+}
+
+// DockerConfig enables forwards for containers labelled tut.remote_port.
+type DockerConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Socket  string `yaml:"socket"`
+}
+
+// KubernetesConfig enables forwards for Services and Ingresses annotated
+// with tut.dev/expose.
+type KubernetesConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	APIURL    string `yaml:"api_url"`
+	Namespace string `yaml:"namespace"`
+}
+
+// RegistryConfig publishes the public endpoints of the forwards in Consul
+// or etcd.
+type RegistryConfig struct {
+	TTL    Duration `yaml:"ttl"`
+	Consul struct {
+		Address string   `yaml:"address"`
+		Token   string   `yaml:"token"`
+		Tags    []string `yaml:"tags"`
+	} `yaml:"consul"`
+	Etcd struct {
+		Address string `yaml:"address"`
+		Prefix  string `yaml:"prefix"`
+	} `yaml:"etcd"`
+}
+
+// DNSConfig publishes DNS records for the VPS and the forwards.
+type DNSConfig struct {
+	Provider   string   `yaml:"provider"`
+	Hostname   string   `yaml:"hostname"`
+	TTL        Duration `yaml:"ttl"`
+	Cloudflare struct {
+		APIToken string `yaml:"api_token"`
+		ZoneID   string `yaml:"zone_id"`
+	} `yaml:"cloudflare"`
+	Route53 struct {
+		HostedZoneID    string `yaml:"hosted_zone_id"`
+		AccessKeyID     string `yaml:"access_key_id"`
+		SecretAccessKey string `yaml:"secret_access_key"`
+	} `yaml:"route53"`
+	RFC2136 struct {
+		Server       string `yaml:"server"`
+		Zone         string `yaml:"zone"`
+		KeyName      string `yaml:"key_name"`
+		KeySecret    string `yaml:"key_secret"`
+		KeyAlgorithm string `yaml:"key_algorithm"`
+	} `yaml:"rfc2136"`
+}
+
+// DirectConfig maps the public ports on the local router with UPnP or
+// NAT-PMP so clients can bypass the VPS.
+type DirectConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Protocol string `yaml:"protocol"` // auto, upnp or natpmp
+	Gateway  string `yaml:"gateway"`  // NAT-PMP gateway, default: the default route
+	Hostname string `yaml:"hostname"` // name published for the router's public address
+	Prefer   bool   `yaml:"prefer"`   // advertise only the direct path when it works
+}
+
+// QoSConfig paces the tunnel so forwards with priority interactive stay
+// responsive while bulk forwards saturate the link.
+type QoSConfig struct {
+	Upload   Rate `yaml:"upload"`   // towards the VPS, e.g. 20Mbit/s, 0: no pacing
+	Download Rate `yaml:"download"` // from the VPS, 0: no pacing
+}
+
+// QuotaConfig limits the monthly transfer of the whole tunnel; forwards
+// have quotas of their own.
+type QuotaConfig struct {
+	Total    Size   `yaml:"total"`     // e.g. 2TB, 0: no limit
+	Action   string `yaml:"action"`    // pause or alert, see quota.go
+	ResetDay int    `yaml:"reset_day"` // day of the month the counters restart
+}
+
+// DBusConfig exports the tunnel state on D-Bus, see dbus_linux.go.
+type DBusConfig struct {
+	Bus string `yaml:"bus"` // session or system, empty: off
+}
+
+// APIConfig controls the HTTP API of the daemon, see api.go.
+type APIConfig struct {
+	Listen    string     `yaml:"listen"`    // address, or "off"
+	Token     string     `yaml:"token"`     // admin token, shorthand for an entry in tokens
+	Tokens    []APIToken `yaml:"tokens"`    // every request needs one of them when set
+	Dashboard bool       `yaml:"dashboard"` // serve the web UI, needs a token
+}
+
+// NgrokAPIConfig serves an emulation of the ngrok agent API, see
+// ngrokapi.go.
+type NgrokAPIConfig struct {
+	Listen string `yaml:"listen"` // loopback address, or "off"
+}
+
+// APIToken grants access to the API with a scope.
+type APIToken struct {
+	Name  string `yaml:"name"` // shown in the log when the token changes something
+	Token string `yaml:"token"`
+	Scope string `yaml:"scope"` // read or admin
+}
+
+// TURNConfig runs a TURN server on the VPS whose allocations reach local
+// WebRTC peers through the tunnel.
+type TURNConfig struct {
+	Enabled    bool              `yaml:"enabled"`
+	Port       int               `yaml:"port"`        // public UDP port on the VPS
+	Realm      string            `yaml:"realm"`       // realm of the long-term credentials
+	Secret     string            `yaml:"secret"`      // shared secret of the TURN REST API
+	Users      map[string]string `yaml:"users"`       // static credentials, user: password
+	RelayPorts string            `yaml:"relay_ports"` // UDP port range of the allocations, e.g. 49152-49407
+	ExternalIP string            `yaml:"external_ip"` // relay address, default: the address of vps.host
+	LocalPeers []string          `yaml:"local_peers"` // networks reached through the tunnel
+	TunnelPort int               `yaml:"tunnel_port"` // TCP port of the tunnel to the agent
+}
+
+// TUNConfig routes subnets between this host and the VPS through a TUN
+// interface on each side, see tun.go.
+type TUNConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Name          string   `yaml:"name"`           // of the interface on both sides
+	LocalAddress  string   `yaml:"local_address"`  // of the local interface, with prefix length
+	RemoteAddress string   `yaml:"remote_address"` // of the interface on the VPS, with prefix length
+	Routes        []string `yaml:"routes"`         // networks reached through the VPS
+	RemoteRoutes  []string `yaml:"remote_routes"`  // networks the VPS reaches through this host
+	MTU           int      `yaml:"mtu"`
+	TunnelPort    int      `yaml:"tunnel_port"` // TCP port of the tunnel to the agent
+}
+
+// CloudflareTunnelConfig names a remotely managed Cloudflare Tunnel and the
+// API token tut configures it with.
+type CloudflareTunnelConfig struct {
+	AccountID   string `yaml:"account_id"`
+	TunnelID    string `yaml:"tunnel_id"`
+	APIToken    string `yaml:"api_token"`    // Cloudflare Tunnel: Edit, and DNS: Edit for zone_id
+	ZoneID      string `yaml:"zone_id"`      // of the hostnames, to point them at the tunnel; empty: done elsewhere
+	Binary      string `yaml:"binary"`       // cloudflared, default: from PATH
+	MetricsPort int    `yaml:"metrics_port"` // loopback port of the readiness endpoint of cloudflared
+}
+
+// AgentConfig selects the tut binary run on the VPS for features that need
+// more than socat.
+type AgentConfig struct {
+	Binary string `yaml:"binary"` // default: this executable
+	Path   string `yaml:"path"`   // on the VPS, relative to the login directory
+}
+
+// PluginConfig is an executable run at lifecycle points, see plugins.go.
+type PluginConfig struct {
+	Name    string   `yaml:"name"`
+	Path    string   `yaml:"path"`
+	Events  []string `yaml:"events"`  // event names, e.g. forward-up
+	Timeout Duration `yaml:"timeout"` // per run
+}
+
+// TCPForward exposes a local TCP service on a public port of the VPS.
+type TCPForward struct {
+	Name       string `yaml:"name"`
+	RemotePort int    `yaml:"remote_port"`
+	LocalHost  string `yaml:"local_host"`
+	LocalPort  int    `yaml:"local_port"`
+	DNSSRV     string `yaml:"dns_srv"`
+	Priority   string `yaml:"priority"` // interactive, normal or bulk, see qos.go
+	// ReadBuffer is the size of each relay read and SO_RCVBUF of the relayed
+	// sockets, WriteBuffer their SO_SNDBUF; 0 keeps the defaults.
+	ReadBuffer  Size   `yaml:"read_buffer"`
+	WriteBuffer Size   `yaml:"write_buffer"`
+	Splice      bool   `yaml:"splice"`       // zero-copy relaying on Linux, see splice_linux.go
+	Quota       Size   `yaml:"quota"`        // monthly transfer, e.g. 500GB, see quota.go
+	QuotaAction string `yaml:"quota_action"` // pause or alert
+	// MinecraftSRV is a domain players connect to; it publishes
+	// _minecraft._tcp.<domain> as the forward's SRV record.
+	MinecraftSRV string `yaml:"minecraft_srv"`
+	// Session pins the forward to one of the vps.sessions SSH connections,
+	// counted from 1; 0 lets tut pick one.
+	Session int `yaml:"session"`
+	// Expose is where the forward is published: vps, cloudflare (Cloudflare
+	// Tunnel, see cloudflare.go) or both.
+	Expose             string `yaml:"expose"`
+	CloudflareHostname string `yaml:"cloudflare_hostname"` // public hostname in Cloudflare
+	CloudflareService  string `yaml:"cloudflare_service"`  // http, https, tcp, ssh or rdp
+	// RemoteTLS terminates TLS on remote_port in the agent, which relays
+	// the plaintext to the remote forward on RemoteTLSPort, see
+	// remotetls.go.
+	RemoteTLS           bool     `yaml:"remote_tls"`
+	RemoteTLSPort       int      `yaml:"remote_tls_port"`        // loopback port on the VPS
+	RemoteTLSHostnames  []string `yaml:"remote_tls_hostnames"`   // of the self-signed certificate, default: vps.host
+	RemoteTLSCert       string   `yaml:"remote_tls_cert"`        // PEM file on the VPS; empty: self-signed
+	RemoteTLSKey        string   `yaml:"remote_tls_key"`         // PEM file on the VPS
+	RemoteTLSMinVersion string   `yaml:"remote_tls_min_version"` // 1.0, 1.1, 1.2 or 1.3
+	// HTTPRedirectPort is a public port on which the agent redirects HTTP
+	// to https on remote_port, see redirect.go.
+	HTTPRedirectPort    int    `yaml:"http_redirect_port"`
+	HTTPRedirectWebroot string `yaml:"http_redirect_webroot"` // directory on the VPS for ACME challenges
+	// ErrorPage is an HTML file shown to visitors of an HTTP forward when
+	// the local service or, with ErrorPagePort, the tunnel is down; see
+	// errorpage.go.
+	ErrorPage     string `yaml:"error_page"`
+	ErrorPagePort int    `yaml:"error_page_port"` // loopback port on the VPS
+	// ClientAddressPort is a loopback port on the VPS for the remote
+	// forward, with the agent in front of it telling the relay the address
+	// of each client; see clientaddr.go.
+	ClientAddressPort int `yaml:"client_address_port"`
+	// HTTPProxyPort is a loopback port on the VPS for the remote forward of
+	// an HTTP forward, with the HTTP proxy of the agent in front of it; see
+	// httpproxy.go.
+	HTTPProxyPort int    `yaml:"http_proxy_port"`
+	HTTPCache     Size   `yaml:"http_cache"`     // bytes of responses the proxy caches, see httpcache.go
+	HTTPCacheDir  string `yaml:"http_cache_dir"` // directory on the VPS for the cache; empty: memory
+	// HTTPMaxBody, HTTPHeaderTimeout and HTTPMaxRequests limit what the
+	// proxy passes on to the service; 0: no limit, 10s for the timeout.
+	HTTPMaxBody       Size     `yaml:"http_max_body"`
+	HTTPHeaderTimeout Duration `yaml:"http_header_timeout"`
+	HTTPMaxRequests   int      `yaml:"http_max_requests"` // at once
+	// HTTPCompress has the relay gzip the responses of the service whose
+	// media type matches HTTPCompressTypes, see compress.go.
+	HTTPCompress      bool     `yaml:"http_compress"`
+	HTTPCompressTypes []string `yaml:"http_compress_types"` // e.g. text/*; empty: the usual text types
+	// AccessLog is a file the relay writes the requests to an HTTP
+	// service to, or "events"; see accesslog.go.
+	AccessLog       string `yaml:"access_log"`
+	AccessLogFormat string `yaml:"access_log_format"` // combined or common
+}
+
+// HostRoutingConfig routes the clients of one public port of the VPS to
+// TCP forwards by the name they ask for, see hostroute.go.
+type HostRoutingConfig struct {
+	Port     int         `yaml:"port"`     // public port on the VPS; 0: off
+	Protocol string      `yaml:"protocol"` // tls (by SNI) or http (by Host header)
+	Routes   []HostRoute `yaml:"routes"`
+}
+
+// HostRoute sends the clients asking for Host, a name or *.domain, to the
+// TCP forward Forward.
+type HostRoute struct {
+	Host    string `yaml:"host"`
+	Forward string `yaml:"forward"`
+}
+
+// UDPForward exposes a local UDP service on a public port of the VPS.
+// The datagrams are carried through the SSH tunnel on WrapTCPPort.
+type UDPForward struct {
+	Name          string `yaml:"name"`
+	UDPPublicPort int    `yaml:"udp_public_port"`
+	RemoteBind    string `yaml:"remote_bind"` // address of udp_public_port on the VPS, 0.0.0.0 by default
+	LocalHost     string `yaml:"local_host"`
+	LocalUDPPort  int    `yaml:"local_udp_port"`
+	WrapTCPPort   int    `yaml:"wrap_tcp_port"`
+	DNSSRV        string `yaml:"dns_srv"`
+	HolePunch     bool   `yaml:"hole_punch"`   // try direct paths to clients, see punch.go
+	Priority      string `yaml:"priority"`     // interactive, normal or bulk, see qos.go
+	Protocol      string `yaml:"protocol"`     // "mosh", "dns" or "lan", carried by the agent, see mosh.go, dnsproxy.go and lan.go
+	Interface     string `yaml:"interface"`    // protocol lan: local interface of the group
+	QPSLimit      int    `yaml:"qps_limit"`    // protocol dns: queries per second per client, negative for no limit
+	Quota         Size   `yaml:"quota"`        // monthly transfer, e.g. 500GB, see quota.go
+	QuotaAction   string `yaml:"quota_action"` // pause or alert
+	// Framing is raw (the socat pair) or length: every datagram carries its
+	// length across the wrap stream, see framing.go
+	Framing string `yaml:"framing"`
+	// ClientAddress is proxy-v2 to hand the address of each client to the
+	// service in a PROXY protocol header, see clientaddr.go
+	ClientAddress string `yaml:"client_address"`
+	// IntegrityCheck stamps and verifies every datagram across the wrap
+	// stream, a debugging aid, see integrity.go
+	IntegrityCheck bool `yaml:"integrity_check"`
 }
 
 // die prints an error message and exits the program.
 func die(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+	msg := fmt.Sprintf(format, args...)
+	// the daemon leaves a crash report, see crash.go
+	report, err := writeCrashReport("fatal: "+msg, allStacks())
+	if err != nil {
+		report = ""
+		fmt.Fprintf(os.Stderr, "Cannot write the crash report: %v\n", err)
+	}
+	if jsonOutput() {
+		out := map[string]string{"error": msg}
+		if report != "" {
+			out["crash_report"] = report
+		}
+		printJSON(out)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %s\n", msg)
+	if report != "" {
+		fmt.Fprintf(os.Stderr, "Crash report written to %s; please attach it to a bug report.\n", report)
+	}
 	os.Exit(1)
 }
 
@@ -58,49 +502,510 @@ func isPort(p int) bool {
 	return p >= 1 && p <= 65535
 }
 
-// loadConfig reads and parses the YAML config at path.
-// Defaults are applied for missing values.
-func loadConfig(path string) (*Config, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// validName checks that a forward name is safe to embed in logs, shell
+// scripts and file names.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
 	}
+	return true
+}
+
+// loadConfig reads and parses the YAML config at path, the environment
+// when path is "env:" or a UCI file when it starts with "uci:". Defaults are
+// applied for missing values.
+func loadConfig(path string) (*Config, error) {
 	var c Config
-	if err := yaml.Unmarshal(b, &c); err != nil {
-		return nil, err
+	if path == envConfigPath {
+		if err := configFromEnv(&c); err != nil {
+			return nil, err
+		}
+	} else if file, ok := strings.CutPrefix(path, uciConfigPrefix); ok {
+		if err := configFromUCI(&c, file); err != nil {
+			return nil, err
+		}
+	} else {
+		doc, from, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := includeFiles(doc, path); err != nil {
+			return nil, err
+		}
+		if doc.Kind != 0 {
+			if err := doc.Decode(&c); err != nil {
+				return nil, err
+			}
+		}
+		c.fileVersion = from
 	}
+	applyDefaults(&c)
+	return &c, nil
+}
+
+// applyDefaults fills in the settings c leaves out.
+func applyDefaults(c *Config) {
 	if c.VPS.Port == 0 {
 		c.VPS.Port = 22
 	}
 	if c.VPS.StrictHostKey == "" {
 		c.VPS.StrictHostKey = "accept-new"
 	}
-	if c.ReconnectDelaySeconds <= 0 {
-		c.ReconnectDelaySeconds = 2
+	if c.VPS.Compression == "" {
+		c.VPS.Compression = "auto"
+	}
+	if c.VPS.AddressFamily == "" {
+		c.VPS.AddressFamily = "auto"
+	}
+	if c.VPS.Transport == "" {
+		c.VPS.Transport = "ssh"
+	}
+	if c.VPS.Obfuscation.Mode == "" {
+		c.VPS.Obfuscation.Mode = "off"
+	}
+	if c.VPS.Obfuscation.Port == 0 {
+		c.VPS.Obfuscation.Port = 8388
+	}
+	if c.VPS.Obfuscation.Fallback == "" {
+		c.VPS.Obfuscation.Fallback = "direct"
+	}
+	if c.VPS.TailscalePort == 0 {
+		c.VPS.TailscalePort = 10480
+	}
+	if c.Termux == "" {
+		c.Termux = "auto"
+	}
+	applyProfile(c)
+	if c.ReconnectDelay <= 0 {
+		c.ReconnectDelay = Duration(2 * time.Second)
+	}
+	if c.StateFile == "" {
+		c.StateFile = "/var/lib/tut/state.json"
+		if termuxMode(c) {
+			c.StateFile = filepath.Join(termuxPrefix(), "var", "lib", "tut", "state.json")
+		}
+	}
+	if c.CrashDir == "" {
+		c.CrashDir = filepath.Join(filepath.Dir(c.StateFile), "crash")
+	}
+	if c.RuntimeDir == "" {
+		c.RuntimeDir = os.TempDir()
+		if termuxMode(c) && os.Getenv("TMPDIR") == "" {
+			c.RuntimeDir = filepath.Join(termuxPrefix(), "tmp")
+		}
+	}
+	if c.Log.WrapperDir == "" {
+		c.Log.WrapperDir = "/var/log"
+		if termuxMode(c) {
+			c.Log.WrapperDir = filepath.Join(termuxPrefix(), "var", "log")
+		}
+	}
+	if c.UDPBridge == "" {
+		c.UDPBridge = "auto"
+	}
+	if c.Roaming == "" {
+		c.Roaming = "true"
+	}
+	if c.VPS.Keepalive <= 0 {
+		c.VPS.Keepalive = Duration(15 * time.Second)
+		if termuxMode(c) {
+			// fewer radio wake-ups; a dead session is noticed within 3 minutes
+			c.VPS.Keepalive = Duration(time.Minute)
+		}
+	}
+	if c.VPS.Sessions <= 0 {
+		c.VPS.Sessions = 1
+	}
+	if c.VPS.MaxAgeOverlap == 0 {
+		c.VPS.MaxAgeOverlap = Duration(2 * time.Minute)
+	}
+	if c.Health.StallTimeout == 0 {
+		c.Health.StallTimeout = Duration(time.Minute)
+	}
+	if c.Health.ProbeTimeout <= 0 {
+		c.Health.ProbeTimeout = Duration(5 * time.Second)
+	}
+	if c.Health.PathReportAfter == 0 {
+		c.Health.PathReportAfter = 3
+	}
+	if c.Supervisor.BackoffInitial <= 0 {
+		c.Supervisor.BackoffInitial = Duration(time.Second)
+	}
+	if c.Supervisor.BackoffMax <= 0 {
+		c.Supervisor.BackoffMax = Duration(time.Minute)
+	}
+	if c.Supervisor.FlapWindow <= 0 {
+		c.Supervisor.FlapWindow = Duration(time.Minute)
+	}
+	if c.Supervisor.FlapThreshold == 0 {
+		c.Supervisor.FlapThreshold = 5
+	}
+	if c.API.Listen == "" {
+		c.API.Listen = "127.0.0.1:7879"
+	}
+	if c.NgrokAPI.Listen == "" {
+		c.NgrokAPI.Listen = "off"
+	}
+	if c.HostRouting.Protocol == "" {
+		c.HostRouting.Protocol = "tls"
+	}
+	if c.Quota.ResetDay == 0 {
+		c.Quota.ResetDay = 1
+	}
+	if c.DNS.TTL <= 0 {
+		c.DNS.TTL = Duration(5 * time.Minute)
+	}
+	if c.STUNServers == nil {
+		c.STUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+	}
+	if c.TURN.Port == 0 {
+		c.TURN.Port = 3478
+	}
+	if c.TURN.Realm == "" {
+		c.TURN.Realm = "tut"
+	}
+	if c.TURN.RelayPorts == "" {
+		c.TURN.RelayPorts = "49152-49407"
+	}
+	if c.TURN.LocalPeers == nil {
+		c.TURN.LocalPeers = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+	}
+	if c.TURN.TunnelPort == 0 {
+		c.TURN.TunnelPort = 10478
+	}
+	if c.CloudflareTunnel.MetricsPort == 0 {
+		c.CloudflareTunnel.MetricsPort = 10481
+	}
+	if c.TUN.Name == "" {
+		c.TUN.Name = "tut0"
+	}
+	if c.TUN.LocalAddress == "" {
+		c.TUN.LocalAddress = "10.77.0.2/30"
+	}
+	if c.TUN.RemoteAddress == "" {
+		c.TUN.RemoteAddress = "10.77.0.1/30"
+	}
+	if c.TUN.MTU == 0 {
+		c.TUN.MTU = 1400
+	}
+	if c.TUN.TunnelPort == 0 {
+		c.TUN.TunnelPort = 10479
+	}
+	if c.Agent.Path == "" {
+		c.Agent.Path = ".cache/tut/tut-agent"
+	}
+	if c.Direct.Protocol == "" {
+		c.Direct.Protocol = "auto"
+	}
+	if c.Registry.TTL <= 0 {
+		c.Registry.TTL = Duration(30 * time.Second)
+	}
+	if c.Registry.Etcd.Prefix == "" {
+		c.Registry.Etcd.Prefix = "/tut/services/"
+	}
+	if c.Docker.Socket == "" {
+		c.Docker.Socket = "/var/run/docker.sock"
+	}
+	if c.StatsD.Prefix == "" {
+		c.StatsD.Prefix = "tut"
+	}
+	if c.StatsD.Interval <= 0 {
+		c.StatsD.Interval = Duration(10 * time.Second)
+	}
+	if c.HA.Node == "" {
+		c.HA.Node, _ = os.Hostname()
+	}
+	if c.HA.Lease == 0 {
+		c.HA.Lease = Duration(10 * time.Second)
+	}
+	if c.HA.Drain == 0 {
+		c.HA.Drain = Duration(30 * time.Second)
+	}
+	for i := range c.Mirrors {
+		m := &c.Mirrors[i]
+		if m.Name == "" {
+			m.Name = m.Host
+		}
+		if m.User == "" {
+			m.User = c.VPS.User
+		}
+		if m.Port == 0 {
+			m.Port = c.VPS.Port
+		}
+		if m.SSHKey == "" {
+			m.SSHKey = c.VPS.SSHKey
+		}
+	}
+	for i := range c.Plugins {
+		if c.Plugins[i].Timeout <= 0 {
+			c.Plugins[i].Timeout = Duration(10 * time.Second)
+		}
+	}
+	for i := range c.TCPForwards {
+		f := &c.TCPForwards[i]
+		switch {
+		case f.Name != "":
+		case f.RemotePort == 0:
+			// auto-assigned ports need a name that is stable across runs
+			f.Name = fmt.Sprintf("tcp-%s-%d", f.LocalHost, f.LocalPort)
+		default:
+			f.Name = fmt.Sprintf("tcp-%d", f.RemotePort)
+		}
+		if f.Expose == "" {
+			f.Expose = "vps"
+		}
+		if f.CloudflareService == "" {
+			f.CloudflareService = "http"
+		}
+		if f.RemoteTLSMinVersion == "" {
+			f.RemoteTLSMinVersion = "1.2"
+		}
+		if f.AccessLogFormat == "" {
+			f.AccessLogFormat = "combined"
+		}
+	}
+	for i := range c.UDPForwards {
+		if c.UDPForwards[i].Name == "" {
+			c.UDPForwards[i].Name = fmt.Sprintf("udp-%d", c.UDPForwards[i].UDPPublicPort)
+		}
+		if c.UDPForwards[i].RemoteBind == "" {
+			c.UDPForwards[i].RemoteBind = "0.0.0.0"
+		}
+		if c.UDPForwards[i].Framing == "" {
+			c.UDPForwards[i].Framing = "raw"
+		}
+		if c.UDPForwards[i].Protocol == "dns" && c.UDPForwards[i].QPSLimit == 0 {
+			c.UDPForwards[i].QPSLimit = 20
+		}
 	}
-	return &c, nil
 }
 
 // validateConfig validates required config fields and value ranges.
 func validateConfig(c *Config) error {
+	if c.Version < 0 || c.Version > configVersion {
+		return fmt.Errorf("invalid version: %d (this tut understands up to %d)", c.Version, configVersion)
+	}
 	if c.VPS.Host == "" || c.VPS.User == "" || c.VPS.SSHKey == "" {
 		return errors.New("missing vps.host, vps.user or vps.ssh_key")
 	}
 	if !isPort(c.VPS.Port) {
 		return fmt.Errorf("invalid vps.port: %d", c.VPS.Port)
 	}
-	if st, err := os.Stat(c.VPS.SSHKey); err != nil || st.IsDir() {
-		return fmt.Errorf("SSH key not readable: %s", c.VPS.SSHKey)
+	for _, p := range c.VPS.Ports {
+		if !isPort(p) {
+			return fmt.Errorf("invalid vps.ports entry: %d", p)
+		}
+	}
+	if c.VPS.Compression != "true" && c.VPS.Compression != "false" && c.VPS.Compression != "auto" {
+		return fmt.Errorf("invalid vps.compression: %q (true, false or auto)", c.VPS.Compression)
+	}
+	switch c.VPS.AddressFamily {
+	case "auto", "any", "inet", "inet6":
+	default:
+		return fmt.Errorf("invalid vps.address_family: %q (auto, any, inet or inet6)", c.VPS.AddressFamily)
+	}
+	if c.VPS.Sessions > maxSessions {
+		return fmt.Errorf("invalid vps.sessions: %d (at most %d)", c.VPS.Sessions, maxSessions)
+	}
+	if err := validateBind(c); err != nil {
+		return err
+	}
+	if err := validateAvoidRoutes(c); err != nil {
+		return err
+	}
+	if c.VPS.RekeyData < 0 {
+		return fmt.Errorf("invalid vps.rekey_data: %s", c.VPS.RekeyData)
+	}
+	if c.VPS.Keepalive.D() < time.Second {
+		return fmt.Errorf("invalid vps.keepalive: %s (at least 1s)", c.VPS.Keepalive)
+	}
+	if c.VPS.RekeyInterval < 0 {
+		return fmt.Errorf("invalid vps.rekey_interval: %s", c.VPS.RekeyInterval)
+	}
+	if c.VPS.MaxAge != 0 && c.VPS.MaxAge.D() < time.Minute || c.VPS.MaxAgeOverlap < 0 {
+		return fmt.Errorf("invalid vps.max_age or vps.max_age_overlap: %s, %s (at least 1m or 0)", c.VPS.MaxAge, c.VPS.MaxAgeOverlap)
+	}
+	if c.Termux != "true" && c.Termux != "false" && c.Termux != "auto" {
+		return fmt.Errorf("invalid termux: %q (true, false or auto)", c.Termux)
+	}
+	if c.UDPBridge != "auto" && c.UDPBridge != "socat" && c.UDPBridge != "builtin" {
+		return fmt.Errorf("invalid udp_bridge: %q (auto, socat or builtin)", c.UDPBridge)
+	}
+	if c.Roaming != "true" && c.Roaming != "false" {
+		return fmt.Errorf("invalid roaming: %q (true or false)", c.Roaming)
+	}
+	if err := validateMemory(c); err != nil {
+		return err
+	}
+	if _, err := remoteScript(c); err != nil {
+		return err
+	}
+	if err := validateSSHAlgorithms(c); err != nil {
+		return err
+	}
+	if err := checkSSHKey("vps.ssh_key", c.VPS.SSHKey); err != nil {
+		return err
+	}
+	if p := c.VPS.SSHKeyPassphrase; p != "" {
+		if !isCredential(p) {
+			return errors.New("vps.ssh_key_passphrase must name a credential, e.g. credential:systemd/ssh-passphrase")
+		}
+		if _, err := readCredential(p); err != nil {
+			return fmt.Errorf("vps.ssh_key_passphrase: %w", err)
+		}
+	}
+	if err := validateRemote(c.Remote); err != nil {
+		return err
+	}
+	if err := validateDNS(c); err != nil {
+		return err
+	}
+	if err := validateDirect(c); err != nil {
+		return err
+	}
+	if err := validateTURN(c); err != nil {
+		return err
+	}
+	if err := validateTailscale(c); err != nil {
+		return err
+	}
+	if err := validateObfuscation(c); err != nil {
+		return err
 	}
+	if err := validateCloudflare(c); err != nil {
+		return err
+	}
+	if err := validateRemoteTLS(c); err != nil {
+		return err
+	}
+	if err := validateRedirects(c); err != nil {
+		return err
+	}
+	if err := validateHostRouting(c); err != nil {
+		return err
+	}
+	if err := validateErrorPages(c); err != nil {
+		return err
+	}
+	if err := validateClientAddresses(c); err != nil {
+		return err
+	}
+	if err := validateHTTPProxy(c); err != nil {
+		return err
+	}
+	if err := validateTUN(c); err != nil {
+		return err
+	}
+	if c.MaxTotalConnections < 0 {
+		return fmt.Errorf("invalid max_total_connections: %d", c.MaxTotalConnections)
+	}
+	if c.DBus.Bus != "" && c.DBus.Bus != "session" && c.DBus.Bus != "system" {
+		return fmt.Errorf("invalid dbus.bus: %q (session or system)", c.DBus.Bus)
+	}
+	if err := validateAPI(c.API); err != nil {
+		return err
+	}
+	if err := validateNgrokAPI(c.NgrokAPI); err != nil {
+		return err
+	}
+	if err := validateQuotas(c); err != nil {
+		return err
+	}
+	if err := validateQoS(c); err != nil {
+		return err
+	}
+	if err := validatePlugins(c); err != nil {
+		return err
+	}
+	if err := validateMirrors(c); err != nil {
+		return err
+	}
+	if err := validateHA(c); err != nil {
+		return err
+	}
+	if _, err := compilePolicy(c.Policy); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
 	for _, f := range c.TCPForwards {
-		if !isPort(f.RemotePort) || !isPort(f.LocalPort) || f.LocalHost == "" {
+		if !validName(f.Name) {
+			return fmt.Errorf("invalid forward name %q: use letters, digits, '.', '_' or '-'", f.Name)
+		}
+		// remote_port 0 lets the VPS assign a port, which is then kept in the state file
+		if (f.RemotePort != 0 && !isPort(f.RemotePort)) || !isPort(f.LocalPort) || f.LocalHost == "" {
 			return fmt.Errorf("invalid tcp_forward: %+v", f)
 		}
+		if f.ReadBuffer < 0 || f.WriteBuffer < 0 {
+			return fmt.Errorf("invalid buffer sizes of %s: %s, %s", f.Name, f.ReadBuffer, f.WriteBuffer)
+		}
+		if f.Session < 0 || f.Session > c.VPS.Sessions {
+			return fmt.Errorf("invalid session of %s: %d (1 to vps.sessions, or 0)", f.Name, f.Session)
+		}
+		if err := validateCompressTypes(f); err != nil {
+			return err
+		}
+		if f.AccessLogFormat != "combined" && f.AccessLogFormat != "common" {
+			return fmt.Errorf("%s: invalid access_log_format: %q (combined or common)", f.Name, f.AccessLogFormat)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("duplicate forward name: %s", f.Name)
+		}
+		names[f.Name] = true
 	}
 	for _, u := range c.UDPForwards {
+		if !validName(u.Name) {
+			return fmt.Errorf("invalid forward name %q: use letters, digits, '.', '_' or '-'", u.Name)
+		}
 		if !isPort(u.UDPPublicPort) || !isPort(u.LocalUDPPort) || !isPort(u.WrapTCPPort) || u.LocalHost == "" {
 			return fmt.Errorf("invalid udp_forward: %+v", u)
 		}
+		if ip := net.ParseIP(u.RemoteBind); ip == nil {
+			return fmt.Errorf("invalid remote_bind of %s: %q (an IPv4 or IPv6 address, e.g. 0.0.0.0, :: or 127.0.0.1)", u.Name, u.RemoteBind)
+		} else if ip.To4() == nil && u.HolePunch {
+			return fmt.Errorf("%s: hole_punch needs an IPv4 remote_bind", u.Name)
+		} else if ip.IsLoopback() && u.DNSSRV != "" {
+			return fmt.Errorf("%s: dns_srv points clients at a port that remote_bind %s keeps on the VPS", u.Name, u.RemoteBind)
+		}
+		if u.Protocol != "" && u.Protocol != "mosh" && u.Protocol != "dns" && u.Protocol != "lan" {
+			return fmt.Errorf("invalid protocol of %s: %q (mosh, dns, lan or empty)", u.Name, u.Protocol)
+		}
+		if u.Protocol == "lan" {
+			if ip := net.ParseIP(u.LocalHost).To4(); ip == nil || !ip.IsMulticast() && ip[3] != 255 {
+				return fmt.Errorf("%s: protocol lan needs an IPv4 multicast group or broadcast address in local_host, got %q", u.Name, u.LocalHost)
+			}
+		} else if u.Interface != "" {
+			return fmt.Errorf("%s: interface is only for protocol lan", u.Name)
+		}
+		if u.Protocol != "" && u.HolePunch {
+			return fmt.Errorf("%s: hole_punch does not work with protocol %s", u.Name, u.Protocol)
+		}
+		if u.Framing != "raw" && u.Framing != "length" {
+			return fmt.Errorf("invalid framing of %s: %q (raw or length)", u.Name, u.Framing)
+		}
+		if u.Framing == "length" && (u.Protocol != "" || u.HolePunch || u.IntegrityCheck) {
+			return fmt.Errorf("%s: framing length does not work with protocol, hole_punch or integrity_check", u.Name)
+		}
+		if u.ClientAddress != "" && u.ClientAddress != "proxy-v2" {
+			return fmt.Errorf("invalid client_address of %s: %q (proxy-v2 or empty)", u.Name, u.ClientAddress)
+		}
+		if u.ClientAddress != "" && u.Framing != "length" {
+			return fmt.Errorf("%s: client_address needs framing: length", u.Name)
+		}
+		if u.IntegrityCheck && u.Protocol != "" {
+			return fmt.Errorf("%s: integrity_check does not work with protocol %s, which frames datagrams itself", u.Name, u.Protocol)
+		}
+		if u.IntegrityCheck && u.HolePunch {
+			return fmt.Errorf("%s: integrity_check does not work with hole_punch", u.Name)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("duplicate forward name: %s", u.Name)
+		}
+		names[u.Name] = true
 	}
 	return nil
 }
@@ -109,7 +1014,31 @@ func validateConfig(c *Config) error {
 type child struct {
 	cmd   *exec.Cmd
 	tag   string
-	fifos []string // FIFO paths to clean up
+	fifos []string      // FIFO paths to clean up
+	done  chan struct{} // closed once the process has exited
+}
+
+// startChild starts cmd and reaps it in the background.
+func startChild(cmd *exec.Cmd, tag string) (*child, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &child{cmd: cmd, tag: tag, done: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// exited reports whether the process has terminated.
+func (c *child) exited() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // stop sends SIGTERM to the process and waits for a grace period before killing it.
@@ -118,17 +1047,11 @@ func (c *child) stop(grace time.Duration) {
 		return
 	}
 	_ = c.cmd.Process.Signal(syscall.SIGTERM)
-	done := make(chan struct{})
-	go func() {
-		_ = c.cmd.Wait()
-		close(done)
-	}()
 	select {
-	case <-done:
-		return
+	case <-c.done:
 	case <-time.After(grace):
 		_ = c.cmd.Process.Kill()
-		_ = c.cmd.Wait()
+		<-c.done
 	}
 	// Clean up FIFOs and directories
 	for _, path := range c.fifos {
@@ -173,111 +1096,355 @@ func requireBinary(name string) {
 	}
 }
 
+// wrapperSet owns the local socat wrappers of all UDP forwards, grouped by
+// forward name so that a single forward can be restarted on its own.
+type wrapperSet struct {
+	ops sync.Mutex // serializes restarts by the watcher and config reloads
+	sup *supervisor
+
+	bridge string // "socat" or "builtin", see udpBridge
+
+	mu      sync.Mutex
+	dir     string            // temporary directory holding the FIFOs
+	targets map[string]string // UDP address to send to instead of the service, by forward name
+	byName  map[string][]*child
+}
+
 // startLocalWrappers starts socat processes to wrap each UDP forward using FIFO pipes.
 // This implementation follows the stable FIFO-based approach from:
 // https://superuser.com/questions/53103/udp-traffic-through-ssh-tunnel
 //
 // Architecture: TCP-LISTEN ↔ UDP (to actual service) via PIPE for bidirectional flow
-func startLocalWrappers(cfg *Config) ([]*child, error) {
+func startLocalWrappers(cfg *Config, targets map[string]string) (*wrapperSet, error) {
+	ws := &wrapperSet{byName: make(map[string][]*child), targets: targets, sup: newSupervisor(policyFromConfig(cfg.Supervisor)), bridge: udpBridge(cfg)}
 	if len(cfg.UDPForwards) == 0 {
 		logf("No udp_forwards configured; skipping local UDP wrappers.")
-		return nil, nil
+		return ws, nil
 	}
 
-	// Create secure temporary directory for FIFOs
-	tmpDir, err := os.MkdirTemp("", "tut-*")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	for _, u := range cfg.UDPForwards {
+		if err := ws.start(u); err != nil {
+			ws.stopAll(1 * time.Second)
+			return nil, err
+		}
 	}
+	return ws, nil
+}
 
-	var kids []*child
+// start launches the socat pair of a single UDP forward.
+func (ws *wrapperSet) start(u UDPForward) error {
+	ws.mu.Lock()
+	target, ok := ws.targets[u.Name]
+	ws.mu.Unlock()
+	if !ok {
+		target = fmt.Sprintf("%s:%d", u.LocalHost, u.LocalUDPPort)
+	}
+	if u.Protocol != "" {
+		return ws.startAgent(u, u.Protocol, target)
+	}
+	if ws.bridge == "builtin" || u.IntegrityCheck || u.Framing == "length" {
+		return ws.startAgent(u, "bridge", target)
+	}
 
-	// Cleanup helper for error cases
-	cleanup := func() {
-		for _, k := range kids {
-			k.stop(1 * time.Second)
+	ws.mu.Lock()
+	if ws.dir == "" {
+		// Create secure temporary directory for FIFOs
+		tmpDir, err := os.MkdirTemp(runtimeDir, "tut-*")
+		if err != nil {
+			ws.mu.Unlock()
+			return fmt.Errorf("failed to create temp directory: %w", err)
 		}
-		_ = os.RemoveAll(tmpDir)
+		ws.dir = tmpDir
 	}
+	dir := ws.dir
+	ws.mu.Unlock()
 
-	for _, u := range cfg.UDPForwards {
-		// Create FIFO in secure temporary directory
-		fifoPath := filepath.Join(tmpDir, fmt.Sprintf("pipe-%d", u.UDPPublicPort))
+	// Create FIFO in secure temporary directory
+	fifoPath := filepath.Join(dir, fmt.Sprintf("pipe-%d", u.UDPPublicPort))
 
-		// Create FIFO
-		if err := createFIFO(fifoPath); err != nil {
-			cleanup()
-			return nil, fmt.Errorf("failed to create FIFO %s: %w", fifoPath, err)
-		}
+	// Create FIFO
+	if err := createFIFO(fifoPath); err != nil {
+		return fmt.Errorf("failed to create FIFO %s: %w", fifoPath, err)
+	}
 
-		llogTCP := fmt.Sprintf("/var/log/socat-local-tcp-%d.log", u.UDPPublicPort)
-		llogUDP := fmt.Sprintf("/var/log/socat-local-udp-%d.log", u.UDPPublicPort)
-		_ = os.MkdirAll(filepath.Dir(llogTCP), 0o755)
+	llogTCP, llogUDP := wrapperLogPaths(u)
 
-		// First socat: TCP-LISTEN → PIPE (receives from SSH tunnel)
-		argsTCP := []string{
-			"-T", "30",
-			fmt.Sprintf("TCP4-LISTEN:%d,bind=127.0.0.1,reuseaddr,fork", u.WrapTCPPort),
-			fmt.Sprintf("PIPE:%s", fifoPath),
-		}
-		cmdTCP := exec.Command("socat", argsTCP...)
-		fTCP, err := os.OpenFile(llogTCP, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
-		if err != nil {
-			cleanup()
-			return nil, err
-		}
-		cmdTCP.Stdout = fTCP
-		cmdTCP.Stderr = fTCP
-		if err := cmdTCP.Start(); err != nil {
-			_ = fTCP.Close()
-			cleanup()
-			return nil, err
-		}
+	// First socat: TCP-LISTEN → PIPE (receives from SSH tunnel)
+	listen := fmt.Sprintf("TCP4-LISTEN:%d,bind=127.0.0.1,reuseaddr,fork", u.WrapTCPPort)
+	sock := activated.file(u.Name + "-wrap")
+	if sock != nil {
+		// systemd owns the listener; ExtraFiles[0] is fd 3 in socat
+		listen = "ACCEPT-FD:3,fork"
+	}
+	argsTCP := []string{
+		"-T", "30",
+		listen,
+		fmt.Sprintf("PIPE:%s", fifoPath),
+	}
+	cmdTCP := exec.Command("socat", argsTCP...)
+	if sock != nil {
+		cmdTCP.ExtraFiles = []*os.File{sock}
+	}
+	kidTCP, err := startLogged(cmdTCP, llogTCP, fmt.Sprintf("local-socat-tcp-%d", u.UDPPublicPort))
+	if err != nil {
+		return err
+	}
+	kidTCP.fifos = []string{fifoPath}
 
-		// Second socat: PIPE → UDP (forwards to actual local service)
-		argsUDP := []string{
-			"-T", "30",
-			fmt.Sprintf("PIPE:%s", fifoPath),
-			fmt.Sprintf("UDP:%s:%d", u.LocalHost, u.LocalUDPPort),
-		}
-		cmdUDP := exec.Command("socat", argsUDP...)
-		fUDP, err := os.OpenFile(llogUDP, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
-		if err != nil {
-			(&child{cmd: cmdTCP, tag: "cleanup"}).stop(1 * time.Second)
-			_ = fTCP.Close()
-			cleanup()
-			return nil, err
-		}
-		cmdUDP.Stdout = fUDP
-		cmdUDP.Stderr = fUDP
-		if err := cmdUDP.Start(); err != nil {
-			(&child{cmd: cmdTCP, tag: "cleanup"}).stop(1 * time.Second)
-			_ = fTCP.Close()
-			_ = fUDP.Close()
-			cleanup()
-			return nil, err
-		}
+	// Second socat: PIPE → UDP (forwards to actual local service)
+	argsUDP := []string{
+		"-T", "30",
+		fmt.Sprintf("PIPE:%s", fifoPath),
+		"UDP:" + target,
+	}
+	kidUDP, err := startLogged(exec.Command("socat", argsUDP...), llogUDP, fmt.Sprintf("local-socat-udp-%d", u.UDPPublicPort))
+	if err != nil {
+		kidTCP.stop(1 * time.Second)
+		return err
+	}
+
+	ws.mu.Lock()
+	ws.byName[u.Name] = []*child{kidTCP, kidUDP}
+	ws.mu.Unlock()
+	ws.sup.started(u.Name)
 
-		kids = append(kids, &child{
-			cmd:   cmdTCP,
-			tag:   fmt.Sprintf("local-socat-tcp-%d", u.UDPPublicPort),
-			fifos: []string{fifoPath},
-		})
-		kids = append(kids, &child{
-			cmd: cmdUDP,
-			tag: fmt.Sprintf("local-socat-udp-%d", u.UDPPublicPort),
-		})
+	logf("Local FIFO wrapper pid=%d/%d : TCP 127.0.0.1:%d <-> PIPE <-> UDP %s (VPS UDP %d)",
+		kidTCP.cmd.Process.Pid, kidUDP.cmd.Process.Pid, u.WrapTCPPort, target, u.UDPPublicPort)
+	return nil
+}
 
-		logf("Local FIFO wrapper pid=%d/%d : TCP 127.0.0.1:%d <-> PIPE <-> UDP %s:%d (VPS UDP %d)",
-			cmdTCP.Process.Pid, cmdUDP.Process.Pid, u.WrapTCPPort, u.LocalHost, u.LocalUDPPort, u.UDPPublicPort)
+// startAgent launches the agent mode that carries a forward locally in
+// place of the socat pair: the one of its protocol, or the builtin bridge.
+func (ws *wrapperSet) startAgent(u UDPForward, mode, target string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
 	}
+	args := []string{"agent", mode, "-accept", fmt.Sprintf("127.0.0.1:%d", u.WrapTCPPort), "-target", target}
+	sock := activated.file(u.Name + "-wrap")
+	if sock != nil {
+		args = []string{"agent", mode, "-accept-fd", "3", "-target", target}
+	}
+	if u.IntegrityCheck {
+		args = append(args, "-check")
+	}
+	if u.Framing == "length" {
+		args = append(args, "-framed")
+	}
+	if u.ClientAddress == "proxy-v2" {
+		args = append(args, "-proxy-v2")
+	}
+	if u.Interface != "" {
+		args = append(args, "-interface", u.Interface)
+	}
+	cmd := exec.Command(self, args...)
+	if sock != nil {
+		cmd.ExtraFiles = []*os.File{sock}
+	}
+	llog, _ := wrapperLogPaths(u)
+	kid, err := startLogged(cmd, llog, fmt.Sprintf("local-%s-%d", mode, u.UDPPublicPort))
+	if err != nil {
+		return err
+	}
+	ws.mu.Lock()
+	ws.byName[u.Name] = []*child{kid}
+	ws.mu.Unlock()
+	ws.sup.started(u.Name)
+	logf("Local %s relay pid=%d : TCP 127.0.0.1:%d <-> UDP %s (VPS UDP %d)", mode, kid.cmd.Process.Pid, u.WrapTCPPort, target, u.UDPPublicPort)
+	return nil
+}
+
+// wrapperLogDir and runtimeDir are log.wrapper_dir and runtime_dir of the
+// running configuration, set by applyPaths.
+var (
+	wrapperLogDir = "/var/log"
+	runtimeDir    string
+)
+
+// applyPaths makes the process use the directories cfg configures.
+func applyPaths(cfg *Config) {
+	wrapperLogDir = cfg.Log.WrapperDir
+	runtimeDir = cfg.RuntimeDir
+}
 
-	// Store tmpDir for cleanup on shutdown - add to first child
-	if len(kids) > 0 {
-		kids[0].fifos = append(kids[0].fifos, tmpDir)
+// udpBridge resolves udp_bridge: auto uses socat when it is installed and
+// the builtin bridge otherwise, e.g. in a scratch container.
+func udpBridge(cfg *Config) string {
+	if cfg.UDPBridge != "auto" {
+		return cfg.UDPBridge
+	}
+	if _, err := exec.LookPath("socat"); err != nil {
+		return "builtin"
 	}
+	return "socat"
+}
+
+// wrapperLogPaths returns the log files of the two local socat processes of
+// u, empty when log.wrapper_dir is "-".
+func wrapperLogPaths(u UDPForward) (string, string) {
+	if wrapperLogDir == "-" {
+		return "", ""
+	}
+	return filepath.Join(wrapperLogDir, fmt.Sprintf("socat-local-tcp-%d.log", u.UDPPublicPort)),
+		filepath.Join(wrapperLogDir, fmt.Sprintf("socat-local-udp-%d.log", u.UDPPublicPort))
+}
+
+// remoteLogDir is the directory of the logs of the processes tut starts on
+// the VPS: log.wrapper_dir, except the Termux default, which only exists on
+// the phone. It is empty when log.wrapper_dir is "-" or empty: no log files.
+func remoteLogDir(cfg *Config) string {
+	dir := cfg.Log.WrapperDir
+	switch {
+	case dir == "-":
+		return ""
+	case termuxMode(cfg) && dir == filepath.Join(termuxPrefix(), "var", "log"):
+		return "/var/log"
+	}
+	return dir
+}
+
+// remoteLog returns the redirection of the output of a process on the VPS
+// to name in remoteLogDir, or to /dev/null when there are no log files.
+func remoteLog(cfg *Config, name string) string {
+	dir := remoteLogDir(cfg)
+	if dir == "" {
+		return ">/dev/null 2>&1"
+	}
+	return ">>" + shellQuote(path.Join(dir, name)) + " 2>&1"
+}
+
+// remoteLogMkdir creates remoteLogDir on the VPS unless it is /var/log.
+func remoteLogMkdir(cfg *Config) string {
+	if dir := remoteLogDir(cfg); dir != "" && dir != "/var/log" {
+		return "mkdir -p " + shellQuote(dir) + "; "
+	}
+	return ""
+}
+
+// startLogged starts cmd with stdout and stderr appended to logPath, or
+// passed through to the standard error of tut when logPath is empty.
+func startLogged(cmd *exec.Cmd, logPath, tag string) (*child, error) {
+	if logPath == "" {
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		return startChild(cmd, tag)
+	}
+	_ = os.MkdirAll(filepath.Dir(logPath), 0o755)
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// The child holds its own copy of the descriptor once started
+	defer f.Close()
+	cmd.Stdout = f
+	cmd.Stderr = f
+	return startChild(cmd, tag)
+}
+
+// stop terminates the wrappers of the named forward.
+func (ws *wrapperSet) stop(name string, grace time.Duration) {
+	ws.mu.Lock()
+	kids := ws.byName[name]
+	delete(ws.byName, name)
+	ws.mu.Unlock()
+	for _, k := range kids {
+		k.stop(grace)
+	}
+}
+
+// stopAll terminates every wrapper and removes the FIFO directory.
+func (ws *wrapperSet) stopAll(grace time.Duration) {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	names := make([]string, 0, len(ws.byName))
+	for name := range ws.byName {
+		names = append(names, name)
+	}
+	ws.mu.Unlock()
+	for _, name := range names {
+		ws.stop(name, grace)
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.dir != "" {
+		_ = os.RemoveAll(ws.dir)
+		ws.dir = ""
+	}
+}
+
+// replace (re)starts the wrappers of a single forward.
+func (ws *wrapperSet) replace(u UDPForward) error {
+	ws.ops.Lock()
+	defer ws.ops.Unlock()
+	ws.sup.forget(u.Name)
+	ws.stop(u.Name, 1*time.Second)
+	return ws.start(u)
+}
 
-	return kids, nil
+// remove stops the wrappers of a forward that is no longer configured.
+func (ws *wrapperSet) remove(name string) {
+	ws.ops.Lock()
+	defer ws.ops.Unlock()
+	ws.sup.forget(name)
+	ws.stop(name, 1*time.Second)
+}
+
+// watch restarts the wrappers of a forward as soon as one of its socat
+// processes exits, leaving every other forward running. Restarts follow the
+// supervisor policy: exponential backoff, flapping detection and an optional
+// restart budget after which the forward is left down.
+func (ws *wrapperSet) watch(ctx context.Context, d *daemon) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ws.ops.Lock()
+		cfg := d.config()
+		ws.sup.setPolicy(policyFromConfig(cfg.Supervisor))
+		for _, u := range cfg.UDPForwards {
+			ws.mu.Lock()
+			kids := ws.byName[u.Name]
+			ws.mu.Unlock()
+			dead := ""
+			if len(kids) == 0 {
+				dead = "wrapper"
+			}
+			for _, k := range kids {
+				if k.exited() {
+					dead = k.tag
+					break
+				}
+			}
+			if dead == "" {
+				continue
+			}
+			decision, note := ws.sup.exited(u.Name)
+			switch decision {
+			case restartLater:
+				continue
+			case restartNever:
+				if len(kids) > 0 {
+					ws.stop(u.Name, 1*time.Second)
+					n, _ := ws.sup.restarts(u.Name)
+					logEvent(levelError, u.Name, "wrapper-gave-up", "%s not running; giving up after %d restarts", dead, n)
+				}
+				continue
+			}
+			n, _ := ws.sup.restarts(u.Name)
+			logEvent(levelWarn, u.Name, "wrapper-restart", "%s not running; restarting this forward only (restart #%d%s)", dead, n, note)
+			ws.stop(u.Name, 1*time.Second)
+			if err := ws.start(u); err != nil {
+				logEvent(levelError, u.Name, "wrapper-restart-failed", "restart failed: %v", err)
+			}
+		}
+		ws.ops.Unlock()
+	}
 }
 
 // assertLocalWrappers checks that the local socat TCP listeners are up.
@@ -291,100 +1458,478 @@ func assertLocalWrappers(cfg *Config) error {
 	return nil
 }
 
+// Every session goes through the OpenSSH client.
+func init() { registerTransport("openssh") }
+
 // buildSSHArgs assembles the arguments for the SSH command and returns them along with the target user@host.
-func buildSSHArgs(cfg *Config) ([]string, string) {
-	base := []string{
-		"-i", cfg.VPS.SSHKey,
-		"-p", strconv.Itoa(cfg.VPS.Port),
-		"-o", "BatchMode=yes",
+// Forwards with a running relay are pointed at the relay port instead of their target.
+func buildSSHArgs(cfg *Config, relays map[string]*relay) ([]string, string) {
+	base, target := sshBaseArgs(cfg)
+	// Open a control socket so health probes can reuse the session
+	if runtime.GOOS != "windows" {
+		base = append(base, "-o", "ControlMaster=yes", "-o", "ControlPath="+controlPath())
+	}
+	for _, f := range sessionForwards(cfg, relays, 0) {
+		base = append(base, "-R", f.spec)
+	}
+	return base, target
+}
+
+// sessionArgs returns the arguments of the ssh of the main session running
+// script, with the ports leased in st and the forwards pointed at relays,
+// along with the target user@host.
+func sessionArgs(cfg *Config, relays map[string]*relay, st *stateStore, script string) ([]string, string) {
+	args, target := buildSSHArgs(st.withLeases(cfg), relays)
+	if script == "" {
+		// nothing to run remotely: no remote command, no shell on the VPS
+		return append(args, "-N", target), target
+	}
+	return append(args, target, script), target
+}
+
+// sshBaseArgs returns the connection options shared by every SSH session
+// tut opens, without any forwards, along with the target user@host.
+func sshBaseArgs(cfg *Config) ([]string, string) {
+	base := append(sshIdentityArgs(cfg),
+		"-p", strconv.Itoa(sshPort(cfg)),
 		"-o", "ExitOnForwardFailure=yes",
-		"-o", "ServerAliveInterval=15",
+		"-o", "ServerAliveInterval="+strconv.Itoa(cfg.VPS.Keepalive.Seconds()),
 		"-o", "ServerAliveCountMax=3",
-		"-o", "StrictHostKeyChecking=" + cfg.VPS.StrictHostKey,
+		"-o", "StrictHostKeyChecking="+cfg.VPS.StrictHostKey,
 		"-T",
+	)
+	// zlib at OpenSSH's fixed level; auto keeps what ssh_config says
+	switch cfg.VPS.Compression {
+	case "true":
+		base = append(base, "-o", "Compression=yes")
+	case "false":
+		base = append(base, "-o", "Compression=no")
 	}
-	// Add TCP forwards
-	for _, f := range cfg.TCPForwards {
-		base = append(base, "-R", fmt.Sprintf("0.0.0.0:%d:%s:%d", f.RemotePort, f.LocalHost, f.LocalPort))
-	}
-	// Add UDP wrappers as TCP forwards
-	for _, u := range cfg.UDPForwards {
-		base = append(base, "-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", u.WrapTCPPort, u.WrapTCPPort))
+	if family := addressFamily(cfg); family != "" {
+		base = append(base, "-o", "AddressFamily="+family)
 	}
+	base = append(base, sshAlgorithmArgs(cfg)...)
+	base = append(base, rekeyArgs(cfg)...)
+	base = append(base, bindArgs(cfg)...)
+	base = append(base, obfsArgs(cfg)...)
 	target := fmt.Sprintf("%s@%s", cfg.VPS.User, cfg.VPS.Host)
 	return base, target
 }
 
+// ctlPath is the SSH control socket path of the main session; an upgraded
+// process keeps the one of the process it replaced, a rotated session
+// brings a new one (see rotate.go).
+var (
+	ctlMu   sync.Mutex
+	ctlPath string
+)
+
+// controlPath returns the SSH control socket path of the main session.
+func controlPath() string {
+	ctlMu.Lock()
+	defer ctlMu.Unlock()
+	if ctlPath == "" {
+		ctlPath = newControlPath("")
+	}
+	return ctlPath
+}
+
+// setControlPath switches the main session to the control socket at path.
+func setControlPath(path string) {
+	ctlMu.Lock()
+	ctlPath = path
+	ctlMu.Unlock()
+}
+
+// newControlPath returns a control socket path for this process that is
+// not in use yet; tag tells apart the sessions and their rotations.
+func newControlPath(tag string) string {
+	dir := runtimeDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if tag != "" {
+		tag = "-" + tag
+	}
+	return filepath.Join(dir, fmt.Sprintf("tut-%d%s.ctl", os.Getpid(), tag))
+}
+
+// socatUDPListen returns the socat address the public port of u listens
+// on, at its remote_bind address.
+func socatUDPListen(u UDPForward) string {
+	if ip := net.ParseIP(u.RemoteBind); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("UDP6-LISTEN:%d,bind=[%s]", u.UDPPublicPort, ip)
+	}
+	return fmt.Sprintf("UDP-LISTEN:%d,bind=%s", u.UDPPublicPort, u.RemoteBind)
+}
+
+// agentBind returns the -bind flag of the agent carrying u on the VPS,
+// empty for the default.
+func agentBind(u UDPForward) string {
+	if u.RemoteBind == "0.0.0.0" {
+		return ""
+	}
+	return " -bind " + shellQuote(u.RemoteBind)
+}
+
 // buildRemoteScript generates a POSIX shell script to run on the remote VPS via SSH.
 // The script creates FIFO pipes and starts socat processes using the stable FIFO-based approach
-// for bidirectional UDP tunneling.
+// for bidirectional UDP tunneling. Each UDP forward gets its own start function so the
+// watchdog can restart a single forward without tearing down the whole session.
+// It is empty when nothing runs on the VPS, so that TCP-only setups need no
+// shell there.
 func buildRemoteScript(cfg *Config) string {
+	agent, modes := agentScript(cfg)
+	if len(cfg.UDPForwards) == 0 && len(modes) == 0 {
+		return ""
+	}
 	var b strings.Builder
 	b.WriteString("set -eu; ")
 	// ensure predictable PATH for non-interactive shells
 	b.WriteString("export PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:$PATH; ")
 	b.WriteString(`SOCAT_BIN="$(command -v socat || true)"; `)
 	b.WriteString(`if [ -z "$SOCAT_BIN" ]; then echo "ERROR: socat not found on VPS. PATH=$PATH" >&2; exit 1; fi; `)
-	b.WriteString(`pids=""; `)
+	// limits applied to this shell are inherited by every socat it starts
+	b.WriteString(remoteLimits(cfg.Remote))
+	b.WriteString(remoteLogMkdir(cfg))
+	// one pid list per forward: P_0, P_1, ..., and one per agent mode: P_TURN, ...
+	var all strings.Builder
+	for i := range cfg.UDPForwards {
+		b.WriteString(fmt.Sprintf(`P_%d=""; `, i))
+		all.WriteString(fmt.Sprintf(" $P_%d", i))
+	}
+	for _, m := range modes {
+		b.WriteString(fmt.Sprintf(`P_%s=""; `, strings.ToUpper(m)))
+		all.WriteString(" $P_" + strings.ToUpper(m))
+	}
 	// Create secure temporary directory for FIFOs
-	b.WriteString(`FIFO_DIR="$(mktemp -d -t tut-XXXXXX)"; `)
-	b.WriteString(`cleanup(){ for p in $pids; do kill "$p" 2>/dev/null || true; done; rm -rf "$FIFO_DIR" 2>/dev/null || true; }; `)
+	// a full template, as -t means different things to GNU and BSD mktemp
+	b.WriteString(`FIFO_DIR="$(mktemp -d "${TMPDIR:-/tmp}/tut-XXXXXX")"; `)
+	b.WriteString(fmt.Sprintf(`cleanup(){ for p in%s; do kill "$p" 2>/dev/null || true; done; rm -rf "$FIFO_DIR" 2>/dev/null || true; %s}; `, all.String(), remoteLimitsCleanup(cfg.Remote)))
 	b.WriteString(`trap cleanup INT TERM EXIT; `)
-	if len(cfg.UDPForwards) == 0 {
-		// Nothing to run; keep the SSH session alive
-		b.WriteString("while true; do sleep 3600; done")
-		return b.String()
-	}
-	for _, u := range cfg.UDPForwards {
+	b.WriteString(agent)
+	for i, u := range cfg.UDPForwards {
+		b.WriteString(fmt.Sprintf(`start_%d(){ `, i))
 		// best-effort kill any existing listener on the public port if fuser exists
 		b.WriteString(fmt.Sprintf(`if command -v fuser >/dev/null 2>&1; then fuser -k %d/udp 2>/dev/null || true; fi; `, u.UDPPublicPort))
 
+		switch u.Protocol {
+		case "mosh":
+			// one roaming session instead of a socat child per source address
+			b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent mosh -listen %d%s -connect 127.0.0.1:%d %s & `,
+				u.UDPPublicPort, agentBind(u), u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("tut-agent-mosh-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; }; start_%d; `, i, i))
+			continue
+		case "lan":
+			// players are kept by the agent and get what the group carries
+			b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent lan -listen %d%s -connect 127.0.0.1:%d %s & `,
+				u.UDPPublicPort, agentBind(u), u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("tut-agent-lan-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; }; start_%d; `, i, i))
+			continue
+		case "dns":
+			// queries are matched one by one and also accepted over TCP
+			b.WriteString(fmt.Sprintf(`if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, u.UDPPublicPort))
+			b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent dns -listen %d%s -connect 127.0.0.1:%d -qps %d %s & `,
+				u.UDPPublicPort, agentBind(u), u.WrapTCPPort, u.QPSLimit, remoteLog(cfg, fmt.Sprintf("tut-agent-dns-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; }; start_%d; `, i, i))
+			continue
+		}
+		if u.Framing == "length" {
+			// every datagram goes with its length, which the FIFOs would lose
+			addr := ""
+			if u.ClientAddress != "" {
+				addr = " -addr"
+			}
+			b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent udp -listen %d%s%s -connect 127.0.0.1:%d %s & `,
+				u.UDPPublicPort, agentBind(u), addr, u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("tut-agent-udp-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; }; start_%d; `, i, i))
+			continue
+		}
+
 		// Create FIFO in secure temp directory
 		b.WriteString(fmt.Sprintf(`FIFO_PATH="$FIFO_DIR/pipe-%d"; `, u.UDPPublicPort))
-		b.WriteString(`mkfifo -m 600 "$FIFO_PATH"; `)
+		b.WriteString(`rm -f "$FIFO_PATH"; mkfifo -m 600 "$FIFO_PATH"; `)
 
 		// First socat: UDP-LISTEN → PIPE (receives from public UDP, writes to FIFO)
-		b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -T 30 UDP-LISTEN:%d,bind=0.0.0.0,reuseaddr,fork PIPE:"$FIFO_PATH" >>/var/log/socat-udp-%d.log 2>&1 & `,
-			u.UDPPublicPort, u.UDPPublicPort))
-		b.WriteString(`pids="$pids $!"; `)
+		if u.IntegrityCheck {
+			b.WriteString(fmt.Sprintf(`if command -v fuser >/dev/null 2>&1; then fuser -k %d/udp 2>/dev/null || true; fi; `, u.WrapTCPPort))
+			// the agent takes the public port and hands the datagrams
+			// stamped to socat, on the UDP port numbered like the wrap port
+			b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent check -listen %d%s -relay 127.0.0.1:%d %s & `,
+				u.UDPPublicPort, agentBind(u), u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("tut-agent-check-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; `, i))
+			b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -T 30 UDP-LISTEN:%d,bind=127.0.0.1,reuseaddr,fork PIPE:"$FIFO_PATH" %s & `,
+				u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("socat-udp-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$P_%d $!"; `, i, i))
+		} else if u.HolePunch {
+			// report the address of every new client to tut through the
+			// session's stderr, parsed from the socat notices
+			b.WriteString(fmt.Sprintf(`LOG_PATH="$FIFO_DIR/log-%d"; rm -f "$LOG_PATH"; mkfifo -m 600 "$LOG_PATH"; `, u.UDPPublicPort))
+			b.WriteString(fmt.Sprintf(`while IFS= read -r l; do printf '%%s\n' "$l" %s; `, remoteLog(cfg, fmt.Sprintf("socat-udp-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`case "$l" in *"accepting UDP connection from AF=2 "*) echo "tut-peer %s ${l##*AF=2 }" >&2;; esac; done <"$LOG_PATH" & `, u.Name))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; `, i))
+			b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -d -d -T 30 %s,reuseaddr,fork PIPE:"$FIFO_PATH" 2>"$LOG_PATH" & `, socatUDPListen(u)))
+			b.WriteString(fmt.Sprintf(`P_%d="$P_%d $!"; `, i, i))
+		} else {
+			b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -T 30 %s,reuseaddr,fork PIPE:"$FIFO_PATH" %s & `,
+				socatUDPListen(u), remoteLog(cfg, fmt.Sprintf("socat-udp-%d.log", u.UDPPublicPort))))
+			b.WriteString(fmt.Sprintf(`P_%d="$!"; `, i))
+		}
 
 		// Second socat: PIPE → TCP (reads from FIFO, forwards to SSH tunnel)
-		b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -T 30 PIPE:"$FIFO_PATH" TCP:127.0.0.1:%d >>/var/log/socat-tcp-%d.log 2>&1 & `,
-			u.WrapTCPPort, u.UDPPublicPort))
-		b.WriteString(`pids="$pids $!"; `)
+		b.WriteString(fmt.Sprintf(`"$SOCAT_BIN" -T 30 PIPE:"$FIFO_PATH" TCP:127.0.0.1:%d %s & `,
+			u.WrapTCPPort, remoteLog(cfg, fmt.Sprintf("socat-tcp-%d.log", u.UDPPublicPort))))
+		b.WriteString(fmt.Sprintf(`P_%d="$P_%d $!"; }; start_%d; `, i, i, i))
 	}
-	// watchdog loop: if any child dies, exit to force reconnect
+	// watchdog loop: if a child dies, restart only the forward it belongs to
 	b.WriteString(`while true; do `)
-	b.WriteString(`for p in $pids; do if ! kill -0 "$p" 2>/dev/null; then echo "Child process $p died; exiting to reconnect" >&2; exit 1; fi; done; `)
+	for i, u := range cfg.UDPForwards {
+		b.WriteString(fmt.Sprintf(`for p in $P_%d; do if ! kill -0 "$p" 2>/dev/null; then echo "[%s] child process $p died; restarting forward" >&2; `, i, u.Name))
+		b.WriteString(fmt.Sprintf(`for q in $P_%d; do kill "$q" 2>/dev/null || true; done; start_%d; break; fi; done; `, i, i))
+	}
+	for _, m := range modes {
+		b.WriteString(fmt.Sprintf(`if ! kill -0 "$P_%s" 2>/dev/null; then echo "[agent %s] exited; restarting" >&2; start_%s; fi; `, strings.ToUpper(m), m, m))
+	}
 	b.WriteString(`sleep 5; done`)
 	return b.String()
 }
 
+// establishedAfter is how long an SSH session has to stay up before its
+// configuration is recorded as last known good.
+const establishedAfter = 5 * time.Second
+
 // runTunnel starts the SSH tunnel and monitors it, restarting on failure.
-func runTunnel(ctx context.Context, cfg *Config, localWrappers []*child) error {
-	sshArgs, target := buildSSHArgs(cfg)
-	script := buildRemoteScript(cfg)
-	fullArgs := append(sshArgs, target, script)
+func (d *daemon) runTunnel(ctx context.Context) error {
+	cfg, relays, st := d.config(), d.relaySnapshot(), d.st
+	script, err := d.prepareSession(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	runRemoteCommands(ctx, cfg, "pre", cfg.Remote.PreCommands)
+	defer d.runPostCommands(cfg)
+	fullArgs, target := sessionArgs(cfg, relays, st, script)
+
+	// A control socket left behind by a killed session would disable multiplexing
+	_ = os.Remove(controlPath())
 
-	logf("Starting SSH tunnel to %s", target)
-	cmd := exec.CommandContext(ctx, "ssh", fullArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mu.Lock()
+	d.cancelSession = cancel
+	d.restart = false
+	d.mu.Unlock()
+
+	defer d.sessionUp.Store(false)
 
+	logEvent(levelInfo, "", "tunnel-start", "Starting SSH tunnel to %s", target)
+	// one pipe for the stderr of the session and of the connections that
+	// replace it when it is rotated
+	stderr, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to start SSH: %w", err)
+	}
+	cmd := d.sshCommand(ctx, true, fullArgs, w)
 	if err := cmd.Start(); err != nil {
+		_ = stderr.Close()
+		_ = w.Close()
 		return fmt.Errorf("failed to start SSH: %w", err)
 	}
 
 	logf("SSH tunnel running (PID %d)", cmd.Process.Pid)
-	return cmd.Wait()
+	d.mu.Lock()
+	d.sshPid = cmd.Process.Pid
+	d.sshStderr = stderr
+	d.mu.Unlock()
+	output := make(chan struct{})
+	go func() {
+		watchSSHOutput(stderr, cfg, relays, st, d.punchers)
+		close(output)
+	}()
+	established := time.NewTimer(establishedAfter)
+	defer established.Stop()
+	go func() {
+		select {
+		case <-established.C:
+			d.sessionUp.Store(true)
+			d.failStreak.Store(0)
+			logEvent(levelInfo, "", "tunnel-up", "SSH tunnel established")
+			publishForwardsUp(mainSession(st.withLeases(cfg)))
+			st.markGood(cfg)
+			st.saveOrLog()
+		case <-output:
+		}
+	}()
+	err = d.superviseSession(ctx, cfg, sshSession{cmd: cmd, done: waitFor(cmd), ctl: controlPath()}, d.mainRotation(script, w))
+	// also ends a connection still kept for the connections it carries
+	cancel()
+	_ = w.Close()
+	<-output
+	return err
+}
+
+// prepareSession does what comes before the main session is opened: it
+// checks the route, picks the port and address family, provisions the VPS
+// after a reboot, updates the agent, checks the versions of socat and the
+// agent there and returns the remote script.
+func (d *daemon) prepareSession(ctx context.Context, cfg *Config) (string, error) {
+	if err := checkAvoidRoutes(cfg); err != nil {
+		return "", err
+	}
+	if len(cfg.VPS.Ports) > 0 {
+		pickPort(ctx, cfg, d.st)
+	}
+	if cfg.VPS.AddressFamily == "auto" {
+		pickAddressFamily(ctx, cfg)
+	}
+	if err := d.provision(ctx, cfg); err != nil {
+		return "", err
+	}
+	if agentNeeded(cfg) {
+		if err := ensureAgent(ctx, cfg); err != nil {
+			return "", fmt.Errorf("agent: %w", err)
+		}
+	}
+	script, err := remoteScript(cfg)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRemoteVersions(ctx, cfg, script); err != nil {
+		return "", err
+	}
+	return script, nil
+}
+
+// mainRotation describes the main session for superviseSession.
+func (d *daemon) mainRotation(script string, stderr *os.File) rotation {
+	return rotation{
+		name:   sessionName(0),
+		main:   true,
+		script: script,
+		stderr: stderr,
+		forwards: func() []remoteForward {
+			return sessionForwards(d.st.withLeases(d.config()), d.relaySnapshot(), 0)
+		},
+		switched: func(s sshSession) {
+			setControlPath(s.ctl)
+			d.mu.Lock()
+			d.sshPid = s.cmd.Process.Pid
+			d.mu.Unlock()
+		},
+	}
+}
+
+// allocatedRe matches the ssh notice for a dynamically allocated remote port.
+var allocatedRe = regexp.MustCompile(`Allocated port (\d+) for remote forward to [^:]+:(\d+)`)
+
+// forwardFailedRe matches the ssh warning for a remote port that could not be bound.
+var forwardFailedRe = regexp.MustCompile(`remote port forwarding failed for listen port (\d+)`)
+
+// peerRe matches the client addresses the remote script reports for UDP
+// forwards with hole_punch.
+var peerRe = regexp.MustCompile(`^tut-peer (\S+) (\S+)$`)
+
+// keyRejectedRe matches ssh giving up because the VPS took none of its keys.
+var keyRejectedRe = regexp.MustCompile(`Permission denied \(publickey`)
+
+// watchSSHOutput copies the ssh stderr to our stderr while recording ports
+// the VPS assigns to auto-port forwards, releasing leases that can no
+// longer be bound, passing client addresses on to the punchers and
+// forgetting a key from a credential store that the VPS rejected.
+func watchSSHOutput(r io.Reader, cfg *Config, relays map[string]*relay, st *stateStore, punchers map[string]*puncher) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := peerRe.FindStringSubmatch(line); m != nil {
+			if p, ok := punchers[m[1]]; ok {
+				p.introduce(m[2])
+			}
+			continue
+		}
+		fmt.Fprintln(os.Stderr, line)
+		if m := allocatedRe.FindStringSubmatch(line); m != nil {
+			port, _ := strconv.Atoi(m[1])
+			relayPort, _ := strconv.Atoi(m[2])
+			for _, f := range cfg.TCPForwards {
+				if r, ok := relays[f.Name]; ok && f.RemotePort == 0 && r.port() == relayPort {
+					logEvent(levelInfo, f.Name, "port-assigned", "VPS assigned public port %d", port)
+					st.setLease(f.Name, "tcp", port)
+					st.saveOrLog()
+				}
+			}
+			continue
+		}
+		if keyRejectedRe.MatchString(line) && isCredential(cfg.VPS.SSHKey) {
+			// the key may have been rotated in its store since it was read
+			logEvent(levelWarn, "", "credential-refetch", "The VPS rejected the SSH key; reading %s again for the next session", cfg.VPS.SSHKey)
+			forgetCredential(cfg.VPS.SSHKey)
+			continue
+		}
+		if m := forwardFailedRe.FindStringSubmatch(line); m != nil {
+			port, _ := strconv.Atoi(m[1])
+			for _, f := range cfg.TCPForwards {
+				if l, ok := st.lease(f.Name); ok && f.RemotePort == 0 && l.Port == port {
+					logEvent(levelWarn, f.Name, "lease-lost", "leased port %d is no longer available; a new one will be assigned", port)
+					st.dropLease(f.Name)
+					st.saveOrLog()
+				}
+			}
+		}
+	}
 }
 
 func main() {
+	if len(os.Args) == 2 && os.Getenv(askpassEnv) != "" && !strings.HasPrefix(os.Args[1], "-") {
+		// ssh asking for the passphrase of the key, see credential.go
+		os.Exit(runAskpass(os.Args[1:]))
+	}
+	args, err := takeOutputFlag(os.Args[1:])
+	if err != nil {
+		die("%v", err)
+	}
+	os.Args = append(os.Args[:1], args...)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(runConfigCommand(os.Args[2:]))
+		case "share":
+			os.Exit(runShareCommand(os.Args[2:]))
+		case "export":
+			os.Exit(runExportCommand(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctorCommand(os.Args[2:]))
+		case "status":
+			os.Exit(runStatusCommand(os.Args[2:]))
+		case "top":
+			os.Exit(runTopCommand(os.Args[2:]))
+		case "tray":
+			os.Exit(runTrayCommand(os.Args[2:]))
+		case "agent":
+			os.Exit(runAgentCommand(os.Args[2:]))
+		case "handover":
+			os.Exit(runHandoverCommand(os.Args[2:]))
+		case "apply":
+			os.Exit(runApplyCommand(os.Args[2:]))
+		case "keygen":
+			os.Exit(runKeygenCommand(os.Args[2:]))
+		case "rotate-key":
+			os.Exit(runRotateKeyCommand(os.Args[2:]))
+		case "version":
+			os.Exit(runVersionCommand(os.Args[2:]))
+		case "lan":
+			os.Exit(runLANCommand(os.Args[2:]))
+		case "debug":
+			os.Exit(runDebugCommand(os.Args[2:]))
+		case "trace":
+			os.Exit(runTraceCommand(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "/etc/tut/config.yaml", "Path to config file")
+	flag.StringVar(&configIdentity, "identity", configIdentity, "age identity file for an encrypted config (TUT_AGE_IDENTITY)")
+	printScript := flag.Bool("print-remote-script", false, "Print the ssh commands and the remote script tut would run, and exit")
 	flag.Parse()
 
 	requireBinary("ssh")
-	requireBinary("socat")
 
 	cfg, err := loadConfig(*configPath)
 	if err != nil {
@@ -395,28 +1940,162 @@ func main() {
 		die("Invalid config: %v", err)
 	}
 
+	if *printScript {
+		applyTermux(cfg)
+		applyPaths(cfg)
+		err := printRemoteScript(cfg)
+		removeKeyFiles()
+		if err != nil {
+			die("%v", err)
+		}
+		return
+	}
+
+	if err := setupLogging(cfg.Log); err != nil {
+		die("Invalid log settings: %v", err)
+	}
+
 	logf("Loaded config from %s", *configPath)
+	if cfg.fileVersion != 0 && cfg.fileVersion < configVersion {
+		logf("The config is version %d; \"tut config migrate -w -config %s\" rewrites it to version %d", cfg.fileVersion, *configPath, configVersion)
+	}
+	if cfg.UDPBridge == "socat" {
+		requireBinary("socat")
+	}
+	applyTermux(cfg)
+	applyPaths(cfg)
+	applyMemoryLimit(cfg)
+	if termuxMode(cfg) {
+		logf("Termux mode: state in %s, logs in %s, SSH keepalive every %s", cfg.StateFile, cfg.Log.WrapperDir, cfg.VPS.Keepalive)
+	}
+	if names := activated.names(); len(names) > 0 {
+		sort.Strings(names)
+		logf("Using inherited listener sockets: %s", strings.Join(names, ", "))
+	}
+	upgradeHandoff.report(upgradeConfigLoaded)
 
-	// Start local UDP wrappers
-	localWrappers, err := startLocalWrappers(cfg)
+	// From here on a panic or fatal error leaves a crash report
+	crashConfig.Store(cfg)
+	defer crashGuard()
+
+	// Restore leases and compare against the last configuration that worked
+	st := openState(cfg.StateFile)
+	st.reportDrift(cfg)
+
+	// The TUN interface is created while tut may still be root
+	tun, err := startTUN(cfg)
 	if err != nil {
-		die("Failed to start local wrappers: %v", err)
+		die("Failed to set up the TUN interface: %v", err)
+	}
+	defer tun.close()
+
+	// Give up root before any child is started, so they inherit the
+	// reduced credentials
+	if err := dropPrivileges(cfg); err != nil {
+		die("Failed to drop privileges: %v", err)
+	}
+	if err := os.MkdirAll(runtimeDir, 0o700); err != nil {
+		die("Failed to create runtime_dir: %v", err)
+	}
+	if err := checkPrivilegedPorts(cfg); err != nil {
+		die("%v", err)
+	}
+
+	// Plugins run as the reduced user and see every connection of the relays
+	plugins = startPlugins(cfg)
+	publishConfigLoaded(cfg)
+
+	// Start the hole punchers the local wrappers of their forwards send to
+	punchers, err := startPunchers(cfg)
+	if err != nil {
+		die("Failed to start hole punching: %v", err)
+	}
+	targets := make(map[string]string)
+	for name, p := range punchers {
+		targets[name] = p.addr()
 	}
 	defer func() {
-		for _, w := range localWrappers {
-			w.stop(2 * time.Second)
+		for _, p := range punchers {
+			p.close()
 		}
 	}()
 
+	// Start the bridge the TURN agent sends datagrams for local peers to
+	bridge, err := startTURNBridge(cfg)
+	if err != nil {
+		die("Failed to start the TURN bridge: %v", err)
+	}
+	defer bridge.close()
+
+	// Start local UDP wrappers
+	upgradeHandoff.waitPortsFree(cfg)
+	localWrappers, err := startLocalWrappers(cfg, targets)
+	if err != nil {
+		die("Failed to start local wrappers: %v", err)
+	}
+	defer localWrappers.stopAll(2 * time.Second)
+
 	// Verify local wrappers are listening
 	if err := assertLocalWrappers(cfg); err != nil {
 		die("Local wrapper health check failed: %v", err)
 	}
 
+	// Start traffic accounting relays in front of every forward
+	relays, err := startRelays(cfg)
+	if err != nil {
+		die("Failed to start relays: %v", err)
+	}
+	d := &daemon{configPath: *configPath, st: st, wrappers: localWrappers, punchers: punchers, cfg: cfg, base: cfg, relays: relays,
+		ha: election{wake: make(chan struct{}, 1)}}
+	crashDaemon.Store(d)
+	defer d.closeRelays()
+
+	// Over tailscale the agent hands the TCP forwards to the relays
+	tailnet, err := startTailnet(cfg, d.relaySnapshot)
+	if err != nil {
+		die("Failed to set up the tailscale transport: %v", err)
+	}
+	defer tailnet.close()
+	defer removeKeyFiles()
+
 	// Setup signal handling
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	// cloudflared is stopped before tut exits
+	d.cloudflare = startCloudflare(ctx, cfg, d.relaySnapshot)
+	defer func() {
+		cancel()
+		d.cloudflare.wait()
+	}()
+
+	goGuarded(func() { watchStalls(ctx, d) })
+	goGuarded(func() { watchVPSPings(ctx, d) })
+	goGuarded(func() { watchPublicPorts(ctx, d) })
+	goGuarded(func() { watchClock(ctx, d) })
+	goGuarded(func() { watchRoaming(ctx, d) })
+	goGuarded(func() { watchQuotas(ctx, d) })
+	if cfg.Memory.History > 0 {
+		goGuarded(func() { d.history.record(ctx, d, int(cfg.Memory.History.D()/historyInterval)) })
+	}
+	goGuarded(func() { runAPI(ctx, d) })
+	goGuarded(func() { runNgrokAPI(ctx, d) })
+	goGuarded(func() { runDBus(ctx, d) })
+	goGuarded(func() { localWrappers.watch(ctx, d) })
+	goGuarded(func() { d.watchReloads(ctx) })
+	d.extras = &extraSessions{ctx: ctx}
+	d.syncSessions()
+	goGuarded(func() { runElection(ctx, d) })
+	goGuarded(func() { runStatsD(ctx, d) })
+	goGuarded(func() { d.watchUpgrades(ctx) })
+	goGuarded(func() { d.watchDocker(ctx) })
+	goGuarded(func() { d.watchKubernetes(ctx) })
+	goGuarded(func() { runRegistry(ctx, d) })
+	goGuarded(func() { runDNS(ctx, d) })
+	goGuarded(func() { runDirect(ctx, d) })
+	goGuarded(func() { checkNAT(ctx, d) })
+	upgradeHandoff.report(upgradeReady)
+
 	// Main reconnect loop
 	for {
 		if ctx.Err() != nil {
@@ -424,17 +2103,54 @@ func main() {
 			return
 		}
 
-		if err := runTunnel(ctx, cfg, localWrappers); err != nil {
+		run := d.runTunnel
+		if upgradeHandoff == nil && !d.waitLeader(ctx) {
+			logf("Shutting down gracefully")
+			return
+		}
+		if d.ha.takeover.Load() && !d.ha.leader.Load() {
+			run = d.takeOver
+		}
+		if h := upgradeHandoff; h != nil {
+			// keep the session of the process we replaced running
+			upgradeHandoff = nil
+			run = func(ctx context.Context) error { return d.followSession(ctx, h) }
+		}
+		if err := run(ctx); err != nil {
 			if ctx.Err() != nil {
 				logf("Tunnel terminated by signal")
 				return
 			}
-			logf("Tunnel failed: %v", err)
+			if d.handedOff.Load() {
+				// the upgrade exits the process once connections drained
+				<-ctx.Done()
+				return
+			}
+			if d.takeRestart() {
+				continue
+			}
+			cfg := d.config()
+			if n := cfg.Health.PathReportAfter; n > 0 && d.failStreak.Add(1) == int64(n) {
+				// the reconnects keep failing: say where on the way the
+				// packets get lost
+				report, rerr := pathReport(ctx, cfg)
+				if rerr != nil {
+					report = fmt.Sprintf("cannot trace the path to the VPS: %v", rerr)
+				}
+				logEvent(levelError, "", "tunnel-failed", "Tunnel failed %d times in a row: %v\n%s", n, err, report)
+			} else {
+				logEvent(levelError, "", "tunnel-failed", "Tunnel failed: %v", err)
+			}
+			if cfg.Health.PingInterval > 0 {
+				logEvent(levelWarn, "", "diagnosis", "Likely cause: %s", d.diagnose(ctx, cfg))
+			}
 		}
+		d.reconnects.Add(1)
 
-		logf("Reconnecting in %d seconds...", cfg.ReconnectDelaySeconds)
+		cfg := d.config()
+		logEvent(levelInfo, "", "reconnecting", "Reconnecting in %s...", cfg.ReconnectDelay)
 		select {
-		case <-time.After(time.Duration(cfg.ReconnectDelaySeconds) * time.Second):
+		case <-time.After(cfg.ReconnectDelay.D()):
 			// Continue to reconnect
 		case <-ctx.Done():
 			logf("Shutting down gracefully")
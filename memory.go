@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// One binary serves both servers and routers with 64-128MB of RAM. Profile
+// low-memory lowers the defaults that cost memory per connection or per
+// forward; every one of them can still be set in the config. Building with
+// -tags nodashboard also leaves out the web dashboard.
+
+// Profiles.
+const (
+	profileDefault   = "default"
+	profileLowMemory = "low-memory"
+)
+
+// applyProfile fills in the memory settings the config leaves open.
+func applyProfile(c *Config) {
+	if c.Profile == "" {
+		c.Profile = profileDefault
+	}
+	low := c.Profile == profileLowMemory
+	if c.Memory.RelayBuffer == 0 {
+		c.Memory.RelayBuffer = 32 * 1024
+		if low {
+			c.Memory.RelayBuffer = 8 * 1024
+		}
+	}
+	if c.Log.Buffer == 0 {
+		c.Log.Buffer = defaultLogBuffer
+		if low {
+			c.Log.Buffer = 500
+		}
+	}
+	if c.Memory.History == 0 {
+		c.Memory.History = Duration(5 * time.Minute)
+		if low {
+			c.Memory.History = Duration(time.Minute)
+		}
+	}
+	if low {
+		if c.Memory.Limit == 0 {
+			c.Memory.Limit = 32 << 20
+		}
+		if c.MaxTotalConnections == 0 {
+			// every connection costs two goroutines and two relay buffers
+			c.MaxTotalConnections = 256
+		}
+	}
+}
+
+// validateMemory checks the profile and the memory settings.
+func validateMemory(c *Config) error {
+	if c.Profile != profileDefault && c.Profile != profileLowMemory {
+		return fmt.Errorf("invalid profile: %q (default or low-memory)", c.Profile)
+	}
+	if c.Memory.Limit < 0 {
+		return fmt.Errorf("invalid memory.limit: %s", c.Memory.Limit)
+	}
+	if c.Memory.RelayBuffer < 1024 {
+		return fmt.Errorf("memory.relay_buffer must be at least 1KiB, got %s", c.Memory.RelayBuffer)
+	}
+	if c.API.Dashboard && !dashboardBuilt {
+		return fmt.Errorf("api.dashboard: this tut was built without the dashboard (-tags nodashboard)")
+	}
+	return nil
+}
+
+// applyMemoryLimit sets the soft memory limit of the Go runtime, which
+// collects garbage more often as the heap approaches it. GOMEMLIMIT in the
+// environment takes precedence.
+func applyMemoryLimit(c *Config) {
+	if c.Memory.Limit == 0 || os.Getenv("GOMEMLIMIT") != "" {
+		return
+	}
+	debug.SetMemoryLimit(int64(c.Memory.Limit))
+	logf("Memory limit: %s (profile %s)", c.Memory.Limit, c.Profile)
+}
@@ -0,0 +1,99 @@
+package main
+
+import "sort"
+
+// Metric kinds.
+const (
+	metricCounter = "counter" // monotonically increasing since start
+	metricGauge   = "gauge"   // current value
+)
+
+// metric is one sample of a counter or gauge. Per-forward metrics carry the
+// forward name in the "forward" tag, per-VPS ones the VPS in "vps".
+type metric struct {
+	name  string
+	kind  string
+	value int64
+	tags  map[string]string
+}
+
+// collectMetrics returns the current value of every metric, sorted by name
+// and forward so sinks produce stable output.
+func (d *daemon) collectMetrics() []metric {
+	out := []metric{
+		{name: "reconnects", kind: metricCounter, value: d.reconnects.Load()},
+		{name: "connections_active_total", kind: metricGauge, value: totalConns.active.Load()},
+		{name: "connections_shed", kind: metricCounter, value: totalConns.shed.Load()},
+	}
+	if d.pings.lastReply.Load() != 0 {
+		out = append(out, metric{name: "vps_ping_rtt_us", kind: metricGauge, value: d.pings.rttMicros.Load()})
+	}
+	cfg := d.config()
+	for _, v := range d.vpsStates(cfg) {
+		up := int64(0)
+		if v.Up {
+			up = 1
+		}
+		out = append(out, metric{name: "vps_up", kind: metricGauge, value: up, tags: map[string]string{"vps": v.Name}})
+	}
+	if cf := d.cloudflare.state(); cf != nil {
+		up := int64(0)
+		if cf.Up {
+			up = 1
+		}
+		out = append(out, metric{name: "cloudflare_tunnel_up", kind: metricGauge, value: up})
+	}
+	for _, u := range cfg.UDPForwards {
+		restarts, gaveUp := d.wrappers.sup.restarts(u.Name)
+		down := int64(0)
+		if gaveUp {
+			down = 1
+		}
+		tags := map[string]string{"forward": u.Name}
+		out = append(out,
+			metric{name: "wrapper_restarts", kind: metricCounter, value: int64(restarts), tags: tags},
+			metric{name: "wrapper_given_up", kind: metricGauge, value: down, tags: tags},
+		)
+	}
+	usage := d.st.usage()
+	out = append(out, metric{name: "quota_used_bytes", kind: metricGauge, value: usage.Total})
+	for name, r := range d.relaySnapshot() {
+		tags := map[string]string{"forward": name}
+		paused, publicDown := int64(0), int64(0)
+		if r.quotaPaused.Load() {
+			paused = 1
+		}
+		if r.stats.publicFailed.Load() != 0 {
+			publicDown = 1
+		}
+		out = append(out,
+			metric{name: "quota_used_bytes", kind: metricGauge, value: usage.Forwards[name], tags: tags},
+			metric{name: "quota_paused", kind: metricGauge, value: paused, tags: tags},
+		)
+		out = append(out,
+			metric{name: "bytes_in", kind: metricCounter, value: r.stats.bytesIn.Load(), tags: tags},
+			metric{name: "bytes_out", kind: metricCounter, value: r.stats.bytesOut.Load(), tags: tags},
+			metric{name: "connections_total", kind: metricCounter, value: r.stats.accepted.Load(), tags: tags},
+			metric{name: "active_connections", kind: metricGauge, value: r.stats.active.Load(), tags: tags},
+			metric{name: "public_port_down", kind: metricGauge, value: publicDown, tags: tags},
+		)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].name != out[j].name {
+			return out[i].name < out[j].name
+		}
+		return out[i].key() < out[j].key()
+	})
+	return out
+}
+
+// key identifies a metric series by name and forward or VPS.
+func (m metric) key() string {
+	if f, ok := m.tags["forward"]; ok {
+		return m.name + "/" + f
+	}
+	if v, ok := m.tags["vps"]; ok {
+		return m.name + "/" + v
+	}
+	return m.name
+}
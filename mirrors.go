@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Mirrors are further VPSes that carry the same TCP forwards as vps at the
+// same time (active-active), so that DNS round-robin or a load balancer in
+// front of them can spread inbound connections. Each mirror gets its own
+// SSH session with the TCP forwards that have a fixed remote_port; ports
+// assigned by the VPS, the UDP forwards and the remote script stay with
+// vps. A VPS counts as healthy while its session is established; with
+// dns.hostname set, only healthy ones are published, so a VPS that became
+// unreachable is withdrawn from the records until it is back.
+
+// MirrorConfig is a VPS that carries the TCP forwards as well as vps.
+type MirrorConfig struct {
+	Name   string `yaml:"name"` // default: the host
+	Host   string `yaml:"host"`
+	User   string `yaml:"user"`    // default: vps.user
+	Port   int    `yaml:"port"`    // default: vps.port
+	SSHKey string `yaml:"ssh_key"` // default: vps.ssh_key
+}
+
+// primaryName names vps in the health of the VPSes.
+const primaryName = "primary"
+
+// validateMirrors checks the mirrors section.
+func validateMirrors(c *Config) error {
+	names := map[string]bool{primaryName: true}
+	for _, m := range c.Mirrors {
+		if m.Host == "" {
+			return fmt.Errorf("mirror %q: missing host", m.Name)
+		}
+		if !validName(m.Name) {
+			return fmt.Errorf("invalid mirror name: %q", m.Name)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("duplicate mirror name: %q", m.Name)
+		}
+		names[m.Name] = true
+		if !isPort(m.Port) {
+			return fmt.Errorf("mirror %q: invalid port: %d", m.Name, m.Port)
+		}
+		if m.Host == c.VPS.Host {
+			return fmt.Errorf("mirror %q: host is vps.host", m.Name)
+		}
+	}
+	return nil
+}
+
+// mirrorConfig returns a copy of cfg that connects to the mirror m.
+func mirrorConfig(cfg *Config, m MirrorConfig) *Config {
+	c := *cfg
+	c.VPS.Host, c.VPS.User, c.VPS.Port, c.VPS.SSHKey = m.Host, m.User, m.Port, m.SSHKey
+	// the port probing and address family choice only know vps
+	c.VPS.Ports = nil
+	if c.VPS.AddressFamily == "auto" {
+		c.VPS.AddressFamily = "any"
+	}
+	return &c
+}
+
+// mirrorForwards returns the remote forwards of a mirror: the TCP forwards
+// of cfg with a fixed remote port.
+func mirrorForwards(cfg *Config, relays map[string]*relay) []remoteForward {
+	var fwds []remoteForward
+	for _, f := range cfg.TCPForwards {
+		if f.RemotePort != 0 && f.onVPS() {
+			fwds = append(fwds, remoteForward{f.Name, tcpForwardSpec(cfg, f, relays[f.Name])})
+		}
+	}
+	return fwds
+}
+
+// mirrorSessions returns the sessions to the mirrors of cfg.
+func (d *daemon) mirrorSessions(cfg *Config) []forwardSession {
+	var out []forwardSession
+	for _, m := range cfg.Mirrors {
+		m := m
+		out = append(out, forwardSession{
+			id:       "mirror-" + m.Name,
+			name:     fmt.Sprintf("Mirror %s", m.Name),
+			connect:  func(cfg *Config) *Config { return mirrorConfig(cfg, m) },
+			forwards: mirrorForwards,
+			up: func(up bool) {
+				d.mirrorsUp.set(m.Name, up)
+				if up {
+					logEvent(levelInfo, "", "mirror-up", "Mirror %s (%s) established", m.Name, m.Host)
+				} else {
+					logEvent(levelWarn, "", "mirror-down", "Mirror %s (%s) lost; withdrawn until it is back", m.Name, m.Host)
+				}
+			},
+		})
+	}
+	return out
+}
+
+// mirrorHealth records which mirrors have their session established.
+type mirrorHealth struct {
+	mu sync.Mutex
+	up map[string]bool
+}
+
+func (h *mirrorHealth) set(name string, up bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.up == nil {
+		h.up = make(map[string]bool)
+	}
+	h.up[name] = up
+}
+
+func (h *mirrorHealth) isUp(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.up[name]
+}
+
+// vpsState is the health of one VPS.
+type vpsState struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Up   bool   `json:"up"`
+}
+
+// vpsStates returns the health of vps and every mirror.
+func (d *daemon) vpsStates(cfg *Config) []vpsState {
+	out := []vpsState{{Name: primaryName, Host: cfg.VPS.Host, Up: d.sessionUp.Load()}}
+	for _, m := range cfg.Mirrors {
+		out = append(out, vpsState{Name: m.Name, Host: m.Host, Up: d.mirrorsUp.isUp(m.Name)})
+	}
+	return out
+}
+
+// healthyHosts returns the hosts of the VPSes that are up, sorted.
+func (d *daemon) healthyHosts(cfg *Config) []string {
+	var hosts []string
+	for _, v := range d.vpsStates(cfg) {
+		if v.Up {
+			hosts = append(hosts, v.Host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
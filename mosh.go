@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A mosh client roams: it keeps its session while its address and source
+// port change, and the server answers wherever the latest authentic
+// datagram came from. socat forks one child per source address, so after a
+// roam the replies still go to the old address. UDP forwards with
+// protocol: mosh are therefore carried by the agent instead: on the VPS it
+// keeps a single session per public port and sends replies to the client
+// address that sent the datagram with the highest sequence number; locally
+// it talks to mosh-server from one socket. Datagrams are framed with
+// writeLenPrefixed on the wrap port.
+
+// moshIdle is how long a client has to be silent before a datagram with a
+// lower sequence number (a new session) may take over. mosh clients send a
+// heartbeat every few seconds.
+const moshIdle = 10 * time.Second
+
+// runAgentMosh implements "tut agent mosh". With -listen it is the VPS side,
+// with -accept or -accept-fd the local side.
+func runAgentMosh(args []string) int {
+	fs := flag.NewFlagSet("agent mosh", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public UDP port (VPS side)")
+	bind := fs.String("bind", "0.0.0.0", "Address of the public port (VPS side)")
+	connect := fs.String("connect", "", "Wrap port to connect to (VPS side)")
+	accept := fs.String("accept", "", "Wrap address to listen on (local side)")
+	acceptFD := fs.Int("accept-fd", 0, "Inherited wrap listener (local side)")
+	target := fs.String("target", "", "mosh-server address (local side)")
+	_ = fs.Parse(args)
+
+	var err error
+	switch {
+	case *listen != 0 && *connect != "":
+		err = moshServe(*bind, *listen, *connect)
+	case (*accept != "" || *acceptFD != 0) && *target != "":
+		var ln net.Listener
+		if ln, err = wrapListener(*accept, *acceptFD); err == nil {
+			err = moshLocal(ln, *target)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: tut agent mosh -listen port -connect addr | -accept addr -target addr")
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
+
+// moshSession is the client of a public port as the VPS side sees it.
+type moshSession struct {
+	mu     sync.Mutex
+	client *net.UDPAddr
+	seq    uint64    // highest sequence number seen from the client
+	last   time.Time // of the latest datagram from client
+}
+
+// observe records a datagram from addr and reports whether replies now go
+// to another address. Datagrams start with mosh's 8-byte nonce: the
+// direction bit (0 towards the server) and a 63-bit sequence number that
+// grows across roams. The payload is authenticated by mosh-server only, so
+// a forged datagram can at worst divert replies until the client's next
+// heartbeat.
+func (s *moshSession) observe(addr *net.UDPAddr, b []byte) bool {
+	if len(b) < 8 || b[0]&0x80 != 0 {
+		return false
+	}
+	seq := binary.BigEndian.Uint64(b) &^ (1 << 63)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	same := s.client != nil && s.client.String() == addr.String()
+	switch {
+	case same:
+		s.seq = max(s.seq, seq)
+	case s.client == nil || seq > s.seq || time.Since(s.last) > moshIdle:
+		s.seq = seq
+	default:
+		// reordered datagram from an address the client left
+		return false
+	}
+	s.client, s.last = addr, time.Now()
+	return !same
+}
+
+func (s *moshSession) peer() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+// moshServe is the VPS side: it carries the datagrams of the public port
+// through the wrap port and the replies back to the current client.
+func moshServe(bind string, port int, connect string) error {
+	pc, err := agentListenUDP(bind, port)
+	if err != nil {
+		return err
+	}
+	logf("mosh session relay on UDP port %d via %s", port, connect)
+	var sess moshSession
+	var mu sync.Mutex
+	var conn net.Conn
+	go func() {
+		for {
+			c, err := net.DialTimeout("tcp", connect, 5*time.Second)
+			if err != nil {
+				time.Sleep(2 * time.Second)
+				continue
+			}
+			mu.Lock()
+			conn = c
+			mu.Unlock()
+			r := bufio.NewReader(c)
+			for {
+				b, err := readLenPrefixed(r)
+				if err != nil {
+					break
+				}
+				if peer := sess.peer(); peer != nil {
+					_, _ = pc.WriteToUDP(b, peer)
+				}
+			}
+			mu.Lock()
+			conn = nil
+			mu.Unlock()
+			_ = c.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		if sess.observe(from, buf[:n]) {
+			logf("mosh client now at %s", from)
+		}
+		mu.Lock()
+		if conn != nil {
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := writeLenPrefixed(conn, buf[:n]); err != nil {
+				// makes the reader reconnect
+				_ = conn.Close()
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// moshLocal is the local side: it sends the datagrams arriving on the wrap
+// port to mosh-server from a single socket, so the server sees one stable
+// client, and frames the replies back on the connection that delivered the
+// latest datagram.
+func moshLocal(ln net.Listener, target string) error {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	svc, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	var current net.Conn
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := svc.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// ICMP port unreachable while mosh-server is not running
+				continue
+			}
+			mu.Lock()
+			if current != nil {
+				_ = current.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				_ = writeLenPrefixed(current, buf[:n])
+			}
+			mu.Unlock()
+		}
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer func() {
+				mu.Lock()
+				if current == c {
+					current = nil
+				}
+				mu.Unlock()
+				_ = c.Close()
+			}()
+			r := bufio.NewReader(c)
+			for {
+				b, err := readLenPrefixed(r)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				current = c
+				mu.Unlock()
+				_, _ = svc.Write(b)
+			}
+		}()
+	}
+}
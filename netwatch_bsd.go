@@ -0,0 +1,28 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// networkWatch is how network changes reach tut, for tut version.
+const networkWatch = "routing socket"
+
+// networkChanges signals changes of links, addresses and routes, as
+// announced by the kernel on a routing socket, which is what
+// SystemConfiguration itself listens to on macOS.
+func networkChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_ROUTE, syscall.SOCK_RAW, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return readChanges(ctx, os.NewFile(uintptr(fd), "route")), nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// networkWatch is how network changes reach tut, for tut version.
+const networkWatch = "netlink"
+
+// rtnetlink multicast groups (linux/rtnetlink.h), missing from syscall
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// networkChanges signals changes of links, addresses and routes, as
+// announced by the kernel over rtnetlink.
+func networkChanges(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return readChanges(ctx, os.NewFile(uintptr(fd), "netlink")), nil
+}
@@ -0,0 +1,39 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// networkWatch is how network changes reach tut, for tut version.
+const networkWatch = "polling"
+
+// roamPoll is how often the route to the VPS is looked at where the system
+// does not announce network changes to tut.
+const roamPoll = 10 * time.Second
+
+// networkChanges signals every roamPoll, so that the route is compared
+// that often.
+func networkChanges(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(roamPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			select {
+			case ch <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
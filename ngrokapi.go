@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ngrok_api.listen set, tut also serves the subset of the local agent
+// API of ngrok that tooling uses to find and drive tunnels: GET /api/tunnels
+// lists every TCP forward as a tunnel with its public URL, POST /api/tunnels
+// starts a forward and DELETE /api/tunnels/<name> stops it again. Test
+// frameworks, editors and scripts written for ngrok thus work with tut by
+// pointing them at ngrok_api.listen, usually 127.0.0.1:4040 as for ngrok.
+// Started tunnels are forwards like discovered ones: they get a relay, are
+// accounted for and live until they are stopped or tut exits. Like ngrok's,
+// the API has no authentication, so it only listens on loopback, and it
+// refuses what a web page could send it: requests with an Origin, for a
+// Host other than loopback (DNS rebinding) and POSTs that are not JSON,
+// which browsers send without asking first.
+
+// ngrokTunnel is a tunnel as the ngrok agent API describes it.
+type ngrokTunnel struct {
+	Name      string `json:"name"`
+	ID        string `json:"ID"`
+	URI       string `json:"uri"`
+	PublicURL string `json:"public_url"`
+	Proto     string `json:"proto"`
+	Config    struct {
+		Addr    string `json:"addr"`
+		Inspect bool   `json:"inspect"`
+	} `json:"config"`
+	Metrics struct {
+		Conns struct {
+			Count int64 `json:"count"`
+			Gauge int64 `json:"gauge"`
+		} `json:"conns"`
+	} `json:"metrics"`
+}
+
+// ngrokStart is the body of POST /api/tunnels. Options tut has no use for,
+// such as inspect or basic_auth, are ignored.
+type ngrokStart struct {
+	Name       string `json:"name"`
+	Addr       string `json:"addr"`
+	Proto      string `json:"proto"`       // http, tcp or tls
+	RemoteAddr string `json:"remote_addr"` // host:port; only the port is used
+}
+
+// ngrokAPI is the ngrok-compatible API and the forwards it started.
+type ngrokAPI struct {
+	d *daemon
+
+	mu      sync.Mutex
+	seq     int
+	started []TCPForward
+	protos  map[string]string // proto of each started forward
+}
+
+// validateNgrokAPI checks ngrok_api.listen.
+func validateNgrokAPI(c NgrokAPIConfig) error {
+	if c.Listen == "off" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid ngrok_api.listen: %q", c.Listen)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("ngrok_api.listen %s: the ngrok API has no authentication and only listens on loopback", c.Listen)
+	}
+	return nil
+}
+
+// runNgrokAPI serves the ngrok-compatible API until ctx is done.
+func runNgrokAPI(ctx context.Context, d *daemon) {
+	cfg := d.config()
+	if cfg.NgrokAPI.Listen == "off" {
+		return
+	}
+	ln, err := net.Listen("tcp", cfg.NgrokAPI.Listen)
+	if err != nil {
+		logEvent(levelWarn, "", "", "ngrok API disabled: %v", err)
+		return
+	}
+	a := &ngrokAPI{d: d, protos: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tunnels", a.tunnels)
+	mux.HandleFunc("/api/tunnels/", a.tunnel)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	logf("ngrok-compatible API on %s", ln.Addr())
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logEvent(levelWarn, "", "", "ngrok API stopped: %v", err)
+	}
+}
+
+// ngrokError writes an error in the format of the ngrok agent API.
+func ngrokError(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error_code": code, "status_code": status, "msg": msg, "details": map[string]string{}})
+}
+
+// loopbackHost reports whether the Host of req is a loopback address or
+// localhost.
+func loopbackHost(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = strings.Trim(req.Host, "[]")
+	}
+	ip := net.ParseIP(host)
+	return strings.EqualFold(host, "localhost") || ip != nil && ip.IsLoopback()
+}
+
+// ngrokAllowed answers requests that may come from a web page with 403 and
+// reports whether req may be served.
+func ngrokAllowed(w http.ResponseWriter, req *http.Request) bool {
+	if !loopbackHost(req) || req.Header.Get("Origin") != "" {
+		ngrokError(w, http.StatusForbidden, 103, "requests from web pages are refused")
+		return false
+	}
+	if req.Method == http.MethodPost {
+		if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != "application/json" {
+			ngrokError(w, http.StatusUnsupportedMediaType, 100, "Content-Type must be application/json")
+			return false
+		}
+	}
+	return true
+}
+
+// tunnels serves GET and POST /api/tunnels.
+func (a *ngrokAPI) tunnels(w http.ResponseWriter, req *http.Request) {
+	if !ngrokAllowed(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		list := a.list()
+		if list == nil {
+			list = []ngrokTunnel{}
+		}
+		writeJSON(w, map[string]any{"tunnels": list, "uri": "/api/tunnels"})
+	case http.MethodPost:
+		var s ngrokStart
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			ngrokError(w, http.StatusBadRequest, 100, "invalid tunnel configuration: "+err.Error())
+			return
+		}
+		t, err := a.start(s)
+		if err != nil {
+			ngrokError(w, http.StatusBadRequest, 102, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(t)
+	default:
+		ngrokError(w, http.StatusMethodNotAllowed, 101, "method not allowed")
+	}
+}
+
+// tunnel serves GET and DELETE /api/tunnels/<name>.
+func (a *ngrokAPI) tunnel(w http.ResponseWriter, req *http.Request) {
+	if !ngrokAllowed(w, req) {
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/api/tunnels/")
+	switch req.Method {
+	case http.MethodGet:
+		for _, t := range a.list() {
+			if t.Name == name {
+				writeJSON(w, t)
+				return
+			}
+		}
+		ngrokError(w, http.StatusNotFound, 404, "tunnel "+name+" not found")
+	case http.MethodDelete:
+		if err := a.stop(name); err != nil {
+			ngrokError(w, http.StatusNotFound, 404, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		ngrokError(w, http.StatusMethodNotAllowed, 101, "method not allowed")
+	}
+}
+
+// list describes every TCP forward as a tunnel.
+func (a *ngrokAPI) list() []ngrokTunnel {
+	cfg, relays := a.d.config(), a.d.relaySnapshot()
+	ports := make(map[string]int)
+	for _, ep := range a.d.endpoints() {
+		ports[ep.name] = ep.port
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []ngrokTunnel
+	for _, f := range cfg.TCPForwards {
+		t := ngrokTunnel{Name: f.Name, ID: f.Name, URI: "/api/tunnels/" + f.Name, Proto: "tcp"}
+		if p, ok := a.protos[f.Name]; ok {
+			t.Proto = p
+		}
+		t.Config.Addr = net.JoinHostPort(f.LocalHost, strconv.Itoa(f.LocalPort))
+		switch {
+		case f.onCloudflare() && !f.onVPS():
+			t.Proto, t.PublicURL = "https", "https://"+f.CloudflareHostname
+		case ports[f.Name] != 0:
+			t.PublicURL = t.Proto + "://" + net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(ports[f.Name]))
+		}
+		if r, ok := relays[f.Name]; ok {
+			t.Metrics.Conns.Count = r.stats.accepted.Load()
+			t.Metrics.Conns.Gauge = r.stats.active.Load()
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// start adds the forward s describes and returns it as a tunnel once it is
+// applied.
+func (a *ngrokAPI) start(s ngrokStart) (ngrokTunnel, error) {
+	switch s.Proto {
+	case "":
+		s.Proto = "http"
+	case "http", "tcp", "tls":
+	default:
+		return ngrokTunnel{}, fmt.Errorf("invalid proto %q (http, tcp or tls)", s.Proto)
+	}
+	host, port, err := ngrokAddr(s.Addr, s.Proto)
+	if err != nil {
+		return ngrokTunnel{}, err
+	}
+	f := TCPForward{Name: s.Name, LocalHost: host, LocalPort: port}
+	if s.RemoteAddr != "" {
+		_, p, err := net.SplitHostPort(s.RemoteAddr)
+		if f.RemotePort, _ = strconv.Atoi(p); err != nil || !isPort(f.RemotePort) {
+			return ngrokTunnel{}, fmt.Errorf("invalid remote_addr %q", s.RemoteAddr)
+		}
+	}
+	cfg := a.d.config()
+	if f.RemotePort == 0 && cfg.VPS.Transport == "tailscale" {
+		return ngrokTunnel{}, errors.New("vps.transport: tailscale needs a remote_addr with a fixed port")
+	}
+
+	a.mu.Lock()
+	if f.Name == "" {
+		a.seq++
+		f.Name = fmt.Sprintf("ngrok-%d", a.seq)
+	}
+	if !validName(f.Name) {
+		a.mu.Unlock()
+		return ngrokTunnel{}, fmt.Errorf("invalid tunnel name %q", f.Name)
+	}
+	for _, c := range append(cfg.TCPForwards, a.started...) {
+		if c.Name == f.Name {
+			a.mu.Unlock()
+			return ngrokTunnel{}, fmt.Errorf("a tunnel named %s already exists", f.Name)
+		}
+	}
+	a.started = append(a.started, f)
+	a.protos[f.Name] = s.Proto
+	fwds := append([]TCPForward(nil), a.started...)
+	a.mu.Unlock()
+	a.d.setDynamic("ngrok", fwds)
+
+	for _, t := range a.list() {
+		if t.Name == f.Name {
+			public := t.PublicURL
+			if public == "" {
+				public = "(port not assigned yet)"
+			}
+			logEvent(levelInfo, f.Name, "ngrok-start", "Started through the ngrok API: %s to %s", public, t.Config.Addr)
+			return t, nil
+		}
+	}
+	// the merge skipped it, e.g. for a remote_port in use
+	_ = a.stop(f.Name)
+	return ngrokTunnel{}, fmt.Errorf("tunnel %s could not be started, see the log", f.Name)
+}
+
+// stop removes a forward started through the API.
+func (a *ngrokAPI) stop(name string) error {
+	a.mu.Lock()
+	i := 0
+	for i < len(a.started) && a.started[i].Name != name {
+		i++
+	}
+	if i == len(a.started) {
+		a.mu.Unlock()
+		return fmt.Errorf("tunnel %s not found or not started through this API", name)
+	}
+	a.started = append(a.started[:i:i], a.started[i+1:]...)
+	delete(a.protos, name)
+	fwds := append([]TCPForward(nil), a.started...)
+	a.mu.Unlock()
+	a.d.setDynamic("ngrok", fwds)
+	logEvent(levelInfo, name, "ngrok-stop", "Stopped through the ngrok API")
+	return nil
+}
+
+// ngrokAddr parses the addr of a tunnel as ngrok accepts it: a port, a
+// host:port or a URL.
+func ngrokAddr(addr, proto string) (string, int, error) {
+	host, port := "127.0.0.1", ""
+	rest := addr
+	if scheme, after, ok := strings.Cut(addr, "://"); ok {
+		rest = after
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			return "", 0, fmt.Errorf("invalid addr %q: only http and https URLs can be forwarded", addr)
+		}
+		rest, _, _ = strings.Cut(rest, "/")
+	}
+	switch h, p, err := net.SplitHostPort(rest); {
+	case err == nil:
+		host, port = h, p
+	case strings.Trim(rest, "0123456789") == "" && rest != "":
+		port = rest
+	case rest != "":
+		host = rest
+	}
+	if host == "localhost" || host == "" {
+		host = "127.0.0.1"
+	}
+	if port == "" && proto == "http" {
+		port = "80"
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !isPort(p) {
+		return "", 0, fmt.Errorf("invalid addr %q", addr)
+	}
+	return host, p, nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// In networks that recognise SSH and throttle or reset it, vps.obfuscation
+// wraps every SSH connection tut opens in a transport that looks like
+// random bytes. With mode: shadowsocks, ssh reaches the VPS through a
+// ProxyCommand that runs "tut agent obfs" and speaks Shadowsocks AEAD
+// (aes-256-gcm) to an endpoint the agent runs on the VPS, which unwraps the
+// stream and hands it to sshd. The endpoint outlives the sessions, since
+// the next session has to reach it, and is started again when the VPS
+// rebooted or the settings changed. Until it runs, e.g. on the first
+// connection after a reboot, fallback: direct lets the ProxyCommand connect
+// to sshd itself. Any Shadowsocks server with aes-256-gcm and the same
+// password can stand in for the agent, as long as it forwards to sshd. With
+// mode: command, vps.obfuscation.command is the ProxyCommand, for
+// transports such as obfs4 whose client and server the user runs.
+
+func init() { registerTransport("shadowsocks-obfs") }
+
+// obfsPasswordEnv passes the password to the ProxyCommand, so it stays out
+// of the process list.
+const obfsPasswordEnv = "TUT_OBFS_PASSWORD"
+
+// Shadowsocks AEAD with aes-256-gcm.
+const (
+	ssKeySize    = 32
+	ssSaltSize   = 32
+	ssTagSize    = 16
+	ssMaxPayload = 0x3FFF
+)
+
+// errSSAuth is a chunk that does not decrypt: a wrong password, a prober or
+// damage on the way.
+var errSSAuth = errors.New("shadowsocks: authentication failed")
+
+// validateObfuscation checks vps.obfuscation.
+func validateObfuscation(c *Config) error {
+	o := c.VPS.Obfuscation
+	switch o.Mode {
+	case "off":
+		return nil
+	case "shadowsocks":
+		if len(o.Password) < 8 {
+			return errors.New("vps.obfuscation.password must have at least 8 characters")
+		}
+		if !isPort(o.Port) || o.Port == c.VPS.Port {
+			return fmt.Errorf("invalid vps.obfuscation.port: %d", o.Port)
+		}
+		if o.Fallback != "direct" && o.Fallback != "none" {
+			return fmt.Errorf("invalid vps.obfuscation.fallback: %q (direct or none)", o.Fallback)
+		}
+	case "command":
+		if o.Command == "" {
+			return errors.New("vps.obfuscation mode command needs a command")
+		}
+	default:
+		return fmt.Errorf("invalid vps.obfuscation.mode: %q (off, shadowsocks or command)", o.Mode)
+	}
+	if len(c.VPS.Ports) > 0 {
+		return errors.New("vps.ports does not apply with vps.obfuscation")
+	}
+	if c.VPS.BindInterface != "" {
+		// ssh ignores BindInterface for a ProxyCommand
+		return errors.New("vps.bind_interface does not apply with vps.obfuscation")
+	}
+	return nil
+}
+
+// obfsArgs returns the ssh options that route the connection through the
+// obfuscation layer.
+func obfsArgs(cfg *Config) []string {
+	o := cfg.VPS.Obfuscation
+	switch o.Mode {
+	case "shadowsocks":
+		self, err := os.Executable()
+		if err != nil {
+			self = "tut"
+		}
+		proxy := fmt.Sprintf("%s agent obfs -connect %%h:%d -target 127.0.0.1:%%p", shellQuote(self), o.Port)
+		if o.Fallback == "direct" {
+			proxy += " -fallback %h:%p"
+		}
+		if cfg.VPS.BindAddress != "" {
+			proxy += " -bind " + shellQuote(cfg.VPS.BindAddress)
+		}
+		return []string{"-o", "ProxyCommand=" + proxy}
+	case "command":
+		return []string{"-o", "ProxyCommand=" + o.Command}
+	}
+	return nil
+}
+
+// obfsEndpointCommand is the command that writes the password next to the
+// agent, read from stdin, and starts the endpoint on the VPS unless it runs
+// with the same settings. An endpoint with other settings is stopped
+// first; it keeps carrying the connections it has, the session running
+// this command possibly among them, until they end.
+func obfsEndpointCommand(cfg *Config) string {
+	o := cfg.VPS.Obfuscation
+	dir := shellQuote(agentDir(cfg))
+	id := configHash([]byte(fmt.Sprintf("%d\x00%s\x00%d", o.Port, o.Password, cfg.VPS.Port)))
+	return fmt.Sprintf(`%[7]sumask 077 && mkdir -p %[1]s && cat > %[1]s/obfs.key && `+
+		`if [ "$(cat %[1]s/obfs.id 2>/dev/null)" != %[2]s ] || ! kill -0 "$(cat %[1]s/obfs.pid 2>/dev/null)" 2>/dev/null; then `+
+		`kill "$(cat %[1]s/obfs.pid 2>/dev/null)" 2>/dev/null || true; `+
+		`nohup %[3]s agent obfs -listen :%[4]d -key-file %[1]s/obfs.key -target 127.0.0.1:%[5]d </dev/null %[6]s & `+
+		`echo "$!" > %[1]s/obfs.pid; echo %[2]s > %[1]s/obfs.id; echo started; fi`,
+		dir, shellQuote(id), shellQuote(cfg.Agent.Path), o.Port, cfg.VPS.Port, remoteLog(cfg, "tut-agent-obfs.log"), remoteLogMkdir(cfg))
+}
+
+// ssKey derives the key from password like every Shadowsocks implementation
+// does (EVP_BytesToKey with MD5).
+func ssKey(password string) []byte {
+	var key, prev []byte
+	for len(key) < ssKeySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:ssKeySize]
+}
+
+// ssAEAD returns the cipher of one direction of a connection: AES-256-GCM
+// under the subkey HKDF-SHA1(key, salt, "ss-subkey").
+func ssAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write(key)
+	prk := mac.Sum(nil)
+	var okm, t []byte
+	for i := byte(1); len(okm) < ssKeySize; i++ {
+		mac = hmac.New(sha1.New, prk)
+		mac.Write(t)
+		mac.Write([]byte("ss-subkey"))
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		okm = append(okm, t...)
+	}
+	block, err := aes.NewCipher(okm[:ssKeySize])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ssIncrement counts the little-endian nonce up by one.
+func ssIncrement(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// ssWriter encrypts what is written into Shadowsocks chunks, starting with
+// a random salt.
+type ssWriter struct {
+	w     io.Writer
+	key   []byte
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (s *ssWriter) Write(p []byte) (int, error) {
+	var out []byte
+	if s.aead == nil {
+		salt := make([]byte, ssSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := ssAEAD(s.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		s.aead, s.nonce, out = aead, make([]byte, aead.NonceSize()), salt
+	}
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), ssMaxPayload)]
+		rest = rest[len(chunk):]
+		out = s.aead.Seal(out, s.nonce, binary.BigEndian.AppendUint16(nil, uint16(len(chunk))), nil)
+		ssIncrement(s.nonce)
+		out = s.aead.Seal(out, s.nonce, chunk, nil)
+		ssIncrement(s.nonce)
+	}
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ssReader decrypts the Shadowsocks chunks read from r.
+type ssReader struct {
+	r     io.Reader
+	key   []byte
+	salt  []byte
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte // decrypted, not yet read
+}
+
+func (s *ssReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk.
+func (s *ssReader) next() error {
+	if s.aead == nil {
+		s.salt = make([]byte, ssSaltSize)
+		if _, err := io.ReadFull(s.r, s.salt); err != nil {
+			return err
+		}
+		aead, err := ssAEAD(s.key, s.salt)
+		if err != nil {
+			return err
+		}
+		s.aead, s.nonce = aead, make([]byte, aead.NonceSize())
+	}
+	head := make([]byte, 2+ssTagSize)
+	if _, err := io.ReadFull(s.r, head); err != nil {
+		return err
+	}
+	size, err := s.aead.Open(head[:0], s.nonce, head, nil)
+	if err != nil {
+		return errSSAuth
+	}
+	ssIncrement(s.nonce)
+	body := make([]byte, int(binary.BigEndian.Uint16(size)&ssMaxPayload)+ssTagSize)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return err
+	}
+	if s.buf, err = s.aead.Open(body[:0], s.nonce, body, nil); err != nil {
+		return errSSAuth
+	}
+	ssIncrement(s.nonce)
+	return nil
+}
+
+// ssAddr encodes host:port as the target address a Shadowsocks client sends
+// first.
+func ssAddr(hostport string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || !isPort(p) {
+		return nil, fmt.Errorf("invalid port in %q", hostport)
+	}
+	var b []byte
+	switch ip := net.ParseIP(host); {
+	case ip != nil && ip.To4() != nil:
+		b = append([]byte{1}, ip.To4()...)
+	case ip != nil:
+		b = append([]byte{4}, ip.To16()...)
+	case len(host) <= 255:
+		b = append([]byte{3, byte(len(host))}, host...)
+	default:
+		return nil, fmt.Errorf("host name too long: %q", host)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(p)), nil
+}
+
+// ssReadAddr reads the target address from the start of a client stream.
+func ssReadAddr(r io.Reader) (string, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(r, typ[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch typ[0] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if typ[0] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("invalid address type %d", typ[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// saltFilter remembers the salts of recent connections, so that a recorded
+// connection replayed by a prober is not answered.
+type saltFilter struct {
+	mu        sync.Mutex
+	cur, prev map[string]bool
+}
+
+// saltFilterSize is how many salts each of the two generations holds.
+const saltFilterSize = 1 << 16
+
+// add records salt and reports whether it is new.
+func (f *saltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := string(salt)
+	if f.cur[k] || f.prev[k] {
+		return false
+	}
+	if f.cur == nil || len(f.cur) >= saltFilterSize {
+		f.prev, f.cur = f.cur, make(map[string]bool)
+	}
+	f.cur[k] = true
+	return true
+}
+
+// runAgentObfs implements "tut agent obfs": the endpoint on the VPS with
+// -listen, and the ProxyCommand of ssh with -connect.
+func runAgentObfs(args []string) int {
+	fs := flag.NewFlagSet("agent obfs", flag.ExitOnError)
+	listen := fs.String("listen", "", "Address of the endpoint, e.g. :8388")
+	keyFile := fs.String("key-file", "", "File holding the password of the endpoint")
+	connect := fs.String("connect", "", "Endpoint to connect stdin and stdout to, password in "+obfsPasswordEnv)
+	target := fs.String("target", "127.0.0.1:22", "SSH server behind the endpoint")
+	fallback := fs.String("fallback", "", "Address to connect to directly when the endpoint cannot be reached")
+	bind := fs.String("bind", "", "Source address of the connection to the endpoint")
+	_ = fs.Parse(args)
+	var err error
+	switch {
+	case *listen != "" && *keyFile != "":
+		var pw []byte
+		if pw, err = os.ReadFile(*keyFile); err == nil {
+			err = obfsServe(*listen, ssKey(strings.TrimSpace(string(pw))), *target)
+		}
+	case *connect != "" && os.Getenv(obfsPasswordEnv) != "":
+		err = obfsConnect(*connect, *target, *fallback, *bind, ssKey(os.Getenv(obfsPasswordEnv)))
+	default:
+		fmt.Fprintln(os.Stderr, "usage: tut agent obfs -listen addr -key-file path [-target 127.0.0.1:22]")
+		fmt.Fprintln(os.Stderr, "       tut agent obfs -connect addr [-target addr] [-fallback addr] [-bind addr] (password in "+obfsPasswordEnv+")")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// obfsServe runs the endpoint: every client that authenticates is connected
+// to target, whatever address it asked for, so the endpoint is no open
+// proxy. On SIGTERM it stops listening and returns once the connections it
+// carries have ended.
+func obfsServe(addr string, key []byte, target string) error {
+	var ln net.Listener
+	var err error
+	// an endpoint being replaced may still hold the port for a moment
+	for i := 0; i < 20; i++ {
+		if ln, err = net.Listen("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	logf("Obfuscation endpoint on %s, connecting to %s", ln.Addr(), target)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-stop
+		_ = ln.Close()
+	}()
+	var wg sync.WaitGroup
+	seen := &saltFilter{}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			wg.Wait()
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obfsHandle(c, key, target, seen)
+		}()
+	}
+}
+
+// obfsHandle unwraps the connection of one client to target.
+func obfsHandle(c net.Conn, key []byte, target string, seen *saltFilter) {
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	r := &ssReader{r: c, key: key}
+	if _, err := ssReadAddr(r); err != nil || !seen.add(r.salt) {
+		// read on until the deadline, so that when the connection ends
+		// tells a prober nothing
+		_, _ = io.Copy(io.Discard, c)
+		logf("Refused %s: %v", c.RemoteAddr(), err)
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	up, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		logf("%s: %v", target, err)
+		return
+	}
+	defer up.Close()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(up, r)
+		closeWrite(up)
+		close(done)
+	}()
+	_, _ = io.Copy(&ssWriter{w: c, key: key}, up)
+	closeWrite(c)
+	<-done
+}
+
+// obfsConnect connects stdin and stdout to target through the endpoint at
+// addr, or directly to fallback when the endpoint cannot be reached.
+func obfsConnect(addr, target, fallback, bind string, key []byte) error {
+	d := net.Dialer{Timeout: 10 * time.Second}
+	if bind != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(bind)}
+	}
+	c, err := d.Dial("tcp", addr)
+	if err != nil {
+		if fallback == "" {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "tut: obfuscation endpoint %s unreachable (%v), connecting to %s directly\n", addr, err, fallback)
+		if c, err = d.Dial("tcp", fallback); err != nil {
+			return err
+		}
+		defer c.Close()
+		return pipeStdio(c, c, c)
+	}
+	defer c.Close()
+	head, err := ssAddr(target)
+	if err != nil {
+		return err
+	}
+	w := &ssWriter{w: c, key: key}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	return pipeStdio(c, &ssReader{r: c, key: key}, w)
+}
+
+// pipeStdio copies stdin to w and r to stdout until r ends.
+func pipeStdio(c net.Conn, r io.Reader, w io.Writer) error {
+	go func() {
+		_, _ = io.Copy(w, os.Stdin)
+		closeWrite(c)
+	}()
+	_, err := io.Copy(os.Stdout, r)
+	return err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// The key and subkey, computed independently from the Shadowsocks AEAD
+// spec: EVP_BytesToKey(MD5) and HKDF-SHA1 with info "ss-subkey".
+const (
+	ssTestKey    = "dfb450efddbb5387197c84460623675b69f2cebcd8ef520a3dfddef7c3d540b2"
+	ssTestSubkey = "7b6ca12d45ef79467432717aaa6a6ae6e1dd046a505fb2ebaaac602210919595"
+)
+
+func TestSSKey(t *testing.T) {
+	if got := hex.EncodeToString(ssKey("test-password")); got != ssTestKey {
+		t.Errorf("ssKey = %s, want %s", got, ssTestKey)
+	}
+
+	salt := make([]byte, ssSaltSize)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	key, _ := hex.DecodeString(ssTestKey)
+	aead, err := ssAEAD(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subkey, _ := hex.DecodeString(ssTestSubkey)
+	block, _ := aes.NewCipher(subkey)
+	want, _ := cipher.NewGCM(block)
+	nonce := make([]byte, 12)
+	if got, exp := aead.Seal(nil, nonce, []byte("payload"), nil), want.Seal(nil, nonce, []byte("payload"), nil); !bytes.Equal(got, exp) {
+		t.Errorf("ssAEAD does not use the subkey: %x, want %x", got, exp)
+	}
+}
+
+func TestSSIncrement(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"000000", "010000"},
+		{"ff0000", "000100"},
+		{"ffff00", "000001"},
+		{"ffffff", "000000"},
+	} {
+		n, _ := hex.DecodeString(tc.in)
+		ssIncrement(n)
+		if got := hex.EncodeToString(n); got != tc.want {
+			t.Errorf("ssIncrement(%s) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+// TestSSWriter decodes what ssWriter writes by the spec: a salt, then per
+// chunk the sealed length and the sealed payload, the nonce counting up
+// from zero, little-endian.
+func TestSSWriter(t *testing.T) {
+	key := ssKey("test-password")
+	var buf bytes.Buffer
+	w := &ssWriter{w: &buf, key: key}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 2000) // two chunks
+	for _, p := range [][]byte{[]byte("hello"), big} {
+		if n, err := w.Write(p); n != len(p) || err != nil {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+
+	stream := buf.Bytes()
+	aead, err := ssAEAD(key, stream[:ssSaltSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = stream[ssSaltSize:]
+	nonce := make([]byte, aead.NonceSize())
+	var got []byte
+	var sizes []int
+	for i := uint64(0); len(stream) > 0; i += 2 {
+		binary.LittleEndian.PutUint64(nonce, i)
+		size, err := aead.Open(nil, nonce, stream[:2+ssTagSize], nil)
+		if err != nil {
+			t.Fatalf("length of chunk %d: %v", i/2, err)
+		}
+		n := int(binary.BigEndian.Uint16(size))
+		stream = stream[2+ssTagSize:]
+		binary.LittleEndian.PutUint64(nonce, i+1)
+		payload, err := aead.Open(nil, nonce, stream[:n+ssTagSize], nil)
+		if err != nil {
+			t.Fatalf("payload of chunk %d: %v", i/2, err)
+		}
+		stream = stream[n+ssTagSize:]
+		got = append(got, payload...)
+		sizes = append(sizes, n)
+	}
+	if want := append([]byte("hello"), big...); !bytes.Equal(got, want) {
+		t.Errorf("decoded %d bytes, want %d", len(got), len(want))
+	}
+	if len(sizes) != 3 || sizes[0] != 5 || sizes[1] != ssMaxPayload || sizes[2] != len(big)-ssMaxPayload {
+		t.Errorf("chunk sizes %v", sizes)
+	}
+}
+
+func TestSSReader(t *testing.T) {
+	key := ssKey("test-password")
+	var buf bytes.Buffer
+	w := &ssWriter{w: &buf, key: key}
+	want := bytes.Repeat([]byte("tut"), 10000)
+	_, _ = w.Write(want[:1])
+	_, _ = w.Write(want[1:])
+	stream := buf.Bytes()
+
+	got, err := io.ReadAll(&ssReader{r: bytes.NewReader(stream), key: key})
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("round trip: %d bytes, %v", len(got), err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		key    []byte
+		stream func([]byte) []byte
+		want   error
+	}{
+		{"wrong password", ssKey("other-password"), func(b []byte) []byte { return b }, errSSAuth},
+		{"length tampered", key, func(b []byte) []byte { b[ssSaltSize] ^= 1; return b }, errSSAuth},
+		{"payload tampered", key, func(b []byte) []byte { b[ssSaltSize+2+ssTagSize] ^= 1; return b }, errSSAuth},
+		{"salt cut", key, func(b []byte) []byte { return b[:ssSaltSize-1] }, io.ErrUnexpectedEOF},
+		{"chunk cut", key, func(b []byte) []byte { return b[:ssSaltSize+2+ssTagSize+1] }, io.ErrUnexpectedEOF},
+	} {
+		b := tc.stream(append([]byte(nil), stream...))
+		_, err := io.ReadAll(&ssReader{r: bytes.NewReader(b), key: tc.key})
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestSSAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, want string
+	}{
+		{"127.0.0.1:22", "017f0000010016"},
+		{"[2001:db8::1]:443", "0420010db800000000000000000000000101bb"},
+		{"vps.example.com:22", "030f7670732e6578616d706c652e636f6d0016"},
+	} {
+		b, err := ssAddr(tc.addr)
+		if err != nil || hex.EncodeToString(b) != tc.want {
+			t.Errorf("ssAddr(%q) = %x, %v; want %s", tc.addr, b, err, tc.want)
+			continue
+		}
+		got, err := ssReadAddr(bytes.NewReader(b))
+		if err != nil || got != tc.addr {
+			t.Errorf("ssReadAddr(%x) = %q, %v", b, got, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:0", "127.0.0.1:70000"} {
+		if _, err := ssAddr(addr); err == nil {
+			t.Errorf("ssAddr(%q) succeeded", addr)
+		}
+	}
+	for _, b := range []string{"", "05", "017f00", "030f7670"} {
+		raw, _ := hex.DecodeString(b)
+		if _, err := ssReadAddr(bytes.NewReader(raw)); err == nil {
+			t.Errorf("ssReadAddr(%s) succeeded", b)
+		}
+	}
+}
+
+func TestSaltFilter(t *testing.T) {
+	var f saltFilter
+	if !f.add([]byte("salt-1")) || f.add([]byte("salt-1")) {
+		t.Error("a replayed salt was accepted")
+	}
+	for i := 0; i < saltFilterSize; i++ {
+		f.add(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	}
+	if f.add([]byte("salt-1")) {
+		t.Error("a salt of the previous generation was accepted")
+	}
+}
+
+// TestObfsHandle connects a client through the endpoint to an echo server.
+func TestObfsHandle(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+	endpoint, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoint.Close()
+	key := ssKey("test-password")
+	go func() {
+		c, err := endpoint.Accept()
+		if err != nil {
+			return
+		}
+		obfsHandle(c, key, echo.Addr().String(), &saltFilter{})
+	}()
+
+	c, err := net.Dial("tcp", endpoint.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	// the address asked for is ignored: the endpoint is no open proxy
+	head, _ := ssAddr("192.0.2.1:25")
+	w := &ssWriter{w: c, key: key}
+	if _, err := w.Write(append(head, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(&ssReader{r: c, key: key}, got); err != nil || string(got) != "hello" {
+		t.Errorf("echo = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// -output json makes the commands that report something (status, doctor,
+// config validate, config diff, apply) print one JSON document on stdout
+// instead of text, so scripts and tests need not parse the text. It may be
+// given before the command, tut -output json status, or after it. Errors
+// that end the command are {"error": "..."} then. Field names only ever
+// get added to.
+
+// outputFormat is text or json.
+var outputFormat = "text"
+
+// jsonOutput reports whether -output json was given.
+func jsonOutput() bool { return outputFormat == "json" }
+
+// outputFlag adds -output to the flags of a command.
+func outputFlag(fs *flag.FlagSet) {
+	fs.Func("output", "Output format: text or json", setOutputFormat)
+}
+
+func setOutputFormat(s string) error {
+	if s != "text" && s != "json" {
+		return errors.New("use text or json")
+	}
+	outputFormat = s
+	return nil
+}
+
+// takeOutputFlag removes a leading -output flag from args, the arguments
+// of tut, and applies it.
+func takeOutputFlag(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	name, value, hasValue := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(args[0], "-"), "-"), "=")
+	if name != "output" || !strings.HasPrefix(args[0], "-") {
+		return args, nil
+	}
+	n := 1
+	if !hasValue {
+		if len(args) < 2 {
+			return args, errors.New("-output needs a value: text or json")
+		}
+		value, n = args[1], 2
+	}
+	if err := setOutputFormat(value); err != nil {
+		return args, fmt.Errorf("invalid -output %q: %w", value, err)
+	}
+	return args[n:], nil
+}
+
+// printJSON prints v as indented JSON on stdout.
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
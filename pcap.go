@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// tut trace -pcap writes what a relay moves as a capture Wireshark opens:
+// tut sees the data of the connections, not their packets, so it makes up
+// the IP packets that would have carried them. A TCP forward shows as TCP
+// connections from the ssh side to the service, with a handshake when the
+// connection opens and a FIN when a side is done. A UDP forward shows as
+// datagrams between the ssh side and the UDP address of the service, one
+// per read of the wrapped stream, as the local wrapper sends them.
+
+// pcap file format constants (microsecond timestamps, raw IP packets).
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapLinkRaw  = 101   // LINKTYPE_RAW: IPv4 or IPv6 without a link header
+	pcapSnapLen  = 65535 // the largest record written
+	pcapSegment  = 65000 // data per made-up packet, below the IPv4 limit
+	pcapProtoTCP = 6
+	pcapProtoUDP = 17
+)
+
+// TCP flags.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapFileHeader is the header a pcap file starts with.
+func pcapFileHeader() []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(b[20:], pcapLinkRaw)
+	return b
+}
+
+// pcapRecord is packet as a pcap record captured at t.
+func pcapRecord(t time.Time, packet []byte) []byte {
+	b := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(b[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(packet)))
+	return append(b, packet...)
+}
+
+// pcapEndpoint is an address of a made-up packet.
+type pcapEndpoint struct {
+	ip   net.IP
+	port int
+}
+
+// endpointOf returns the IP and port of a, 0.0.0.0:0 for addresses that
+// have none.
+func endpointOf(a net.Addr) pcapEndpoint {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return pcapEndpoint{a.IP, a.Port}
+	case *net.UDPAddr:
+		return pcapEndpoint{a.IP, a.Port}
+	}
+	return pcapEndpoint{net.IPv4zero, 0}
+}
+
+// pcapStream is a connection written as TCP: the next sequence number of
+// each side.
+type pcapStream struct {
+	client, server       pcapEndpoint
+	clientSeq, serverSeq uint32
+}
+
+// newPcapStream returns the stream of a connection from client to server,
+// with the packets of the handshake when it is seen opening.
+func newPcapStream(client, server pcapEndpoint, handshake bool) (*pcapStream, [][]byte) {
+	s := &pcapStream{client: client, server: server, clientSeq: 1000, serverSeq: 5000}
+	if !handshake {
+		return s, nil
+	}
+	packets := [][]byte{s.segment(true, tcpSYN, nil)}
+	s.clientSeq++
+	packets = append(packets, s.segment(false, tcpSYN|tcpACK, nil))
+	s.serverSeq++
+	return s, append(packets, s.segment(true, tcpACK, nil))
+}
+
+// data returns the packets carrying b from the client, or from the server.
+func (s *pcapStream) data(fromClient bool, b []byte) [][]byte {
+	var packets [][]byte
+	for len(b) > 0 {
+		n := min(len(b), pcapSegment)
+		packets = append(packets, s.segment(fromClient, tcpPSH|tcpACK, b[:n]))
+		s.advance(fromClient, n)
+		b = b[n:]
+	}
+	return packets
+}
+
+// fin returns the FIN of the client, or of the server.
+func (s *pcapStream) fin(fromClient bool) []byte {
+	p := s.segment(fromClient, tcpFIN|tcpACK, nil)
+	s.advance(fromClient, 1)
+	return p
+}
+
+func (s *pcapStream) advance(fromClient bool, n int) {
+	if fromClient {
+		s.clientSeq += uint32(n)
+	} else {
+		s.serverSeq += uint32(n)
+	}
+}
+
+// segment is a TCP packet from the client, or from the server.
+func (s *pcapStream) segment(fromClient bool, flags byte, payload []byte) []byte {
+	src, dst, seq, ack := s.client, s.server, s.clientSeq, s.serverSeq
+	if !fromClient {
+		src, dst, seq, ack = s.server, s.client, s.serverSeq, s.clientSeq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+	return ipPacket(src.ip, dst.ip, pcapProtoTCP, tcp, 16)
+}
+
+// udpDatagram is a UDP packet carrying payload from src to dst.
+func udpDatagram(src, dst pcapEndpoint, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	return ipPacket(src.ip, dst.ip, pcapProtoUDP, udp, 6)
+}
+
+// ipPacket wraps the TCP or UDP segment l4, whose checksum is at
+// checksumAt, in an IPv4 packet, or an IPv6 one when either address is
+// IPv6.
+func ipPacket(src, dst net.IP, proto byte, l4 []byte, checksumAt int) []byte {
+	src4, dst4 := src.To4(), dst.To4()
+	var ip, pseudo []byte
+	if src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(l4)))
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		pseudo = append(append(append([]byte{}, src4...), dst4...), 0, proto, byte(len(l4)>>8), byte(len(l4)))
+	} else {
+		src16, dst16 := src.To16(), dst.To16()
+		if src16 == nil {
+			src16 = net.IPv6zero
+		}
+		if dst16 == nil {
+			dst16 = net.IPv6zero
+		}
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(l4)))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:], src16)
+		copy(ip[24:], dst16)
+		pseudo = append(append(append([]byte{}, src16...), dst16...), 0, 0, byte(len(l4)>>8), byte(len(l4)), 0, 0, 0, proto)
+	}
+	sum := checksum(append(pseudo, l4...))
+	if proto == pcapProtoUDP && sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[checksumAt:], sum)
+	return append(ip, l4...)
+}
+
+// checksum is the Internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
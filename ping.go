@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// With health.ping_interval set, tut pings the VPS on its own, apart from
+// the SSH keepalives, with ICMP echo where the system lets it (datagram
+// ICMP sockets on Linux and macOS, raw sockets as root) and with a UDP
+// datagram to a closed port otherwise, which the VPS answers with ICMP
+// port unreachable. When the tunnel fails, the ping results and a few
+// quick checks tell apart a broken local network, an unreachable VPS and
+// a VPS whose sshd does not answer, and the log says which it is.
+
+const (
+	// pingLossLimit is how many pings in a row must go unanswered before
+	// the VPS counts as unreachable.
+	pingLossLimit = 3
+	// pingUDPPort is the closed port UDP pings go to, the first port
+	// traceroute uses.
+	pingUDPPort = 33434
+)
+
+// pinger keeps the results of the pings to the VPS.
+type pinger struct {
+	lastReply atomic.Int64 // monoNow of the last answer, 0: none yet
+	rttMicros atomic.Int64 // round trip of the last answer
+	lost      atomic.Int64 // pings in a row without answer
+
+	mu     sync.Mutex
+	method string // of the last answer, icmp or udp
+}
+
+// watchVPSPings pings the VPS every health.ping_interval.
+func watchVPSPings(ctx context.Context, d *daemon) {
+	for {
+		cfg := d.config()
+		interval := cfg.Health.PingInterval.D()
+		if interval <= 0 {
+			interval = time.Minute // wait for a reload to turn it on
+		} else {
+			d.pingVPS(ctx, cfg)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pingVPS pings the VPS once and logs when it stops or starts answering.
+func (d *daemon) pingVPS(ctx context.Context, cfg *Config) error {
+	p := &d.pings
+	rtt, method, err := pingHost(ctx, cfg, cfg.VPS.Host, cfg.Health.ProbeTimeout.D())
+	if err != nil {
+		if p.lost.Add(1) == pingLossLimit && p.lastReply.Load() != 0 {
+			logEvent(levelWarn, "", "vps-unreachable", "%s stopped answering pings (%v)", cfg.VPS.Host, err)
+		}
+		return err
+	}
+	if p.lost.Swap(0) >= pingLossLimit && p.lastReply.Load() != 0 {
+		logEvent(levelInfo, "", "vps-reachable", "%s answers pings again (%s)", cfg.VPS.Host, rtt.Round(time.Millisecond))
+	}
+	p.lastReply.Store(monoNow())
+	p.rttMicros.Store(rtt.Microseconds())
+	p.mu.Lock()
+	p.method = method
+	p.mu.Unlock()
+	return nil
+}
+
+// pingHost sends an ICMP echo request to host, or a UDP ping when ICMP is
+// not available or not answered, and returns the round trip and the
+// method that got an answer.
+func pingHost(ctx context.Context, cfg *Config, host string, timeout time.Duration) (time.Duration, string, error) {
+	ip, err := resolvePingTarget(ctx, cfg, host)
+	if err != nil {
+		return 0, "", err
+	}
+	rtt, icmpErr := pingICMP(ip, timeout)
+	if icmpErr == nil {
+		return rtt, "icmp", nil
+	}
+	rtt, err = pingUDP(cfg, ip, timeout)
+	if err == nil {
+		return rtt, "udp", nil
+	}
+	return 0, "", fmt.Errorf("icmp: %v; udp: %v", icmpErr, err)
+}
+
+// resolvePingTarget returns the address of host in the family ssh uses.
+func resolvePingTarget(ctx context.Context, cfg *Config, host string) (net.IP, error) {
+	network := "ip"
+	switch addressFamily(cfg) {
+	case "inet":
+		network = "ip4"
+	case "inet6":
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// pingICMP sends one echo request to ip and waits for the reply.
+func pingICMP(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	v4 := ip.To4() != nil
+	c, err := icmpConn(v4)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var token [8]byte
+	_, _ = rand.Read(token[:])
+	typ, reply := byte(8), byte(0)
+	if !v4 {
+		typ, reply = 128, 129
+	}
+	// the kernel fills in the identifier of datagram sockets, and the
+	// checksum of ICMPv6
+	msg := append([]byte{typ, 0, 0, 0, 0, 1, 0, 1}, token[:]...)
+	if v4 {
+		sum := icmpChecksum(msg)
+		msg[2], msg[3] = byte(sum>>8), byte(sum)
+	}
+	var dst net.Addr = &net.IPAddr{IP: ip}
+	if _, ok := c.(*net.UDPConn); ok {
+		dst = &net.UDPAddr{IP: ip}
+	}
+	start := time.Now()
+	if _, err := c.WriteTo(msg, dst); err != nil {
+		return 0, err
+	}
+	_ = c.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		b := buf[:n]
+		if v4 && len(b) >= 20 && b[0]>>4 == 4 {
+			// some systems pass the IP header along
+			b = b[int(b[0]&0x0f)*4:]
+		}
+		if len(b) >= 16 && b[0] == reply && string(b[8:16]) == string(token[:]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// icmpChecksum is the Internet checksum of b.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// icmpConn opens an ICMP socket: a datagram one where unprivileged users
+// may, a raw one otherwise.
+func icmpConn(v4 bool) (net.PacketConn, error) {
+	if c, err := icmpDatagramConn(v4); err == nil {
+		return c, nil
+	}
+	if v4 {
+		return net.ListenPacket("ip4:icmp", "")
+	}
+	return net.ListenPacket("ip6:ipv6-icmp", "")
+}
+
+// pingUDP sends a datagram to a closed port of ip and waits for the port
+// unreachable error, which says the host is up.
+func pingUDP(cfg *Config, ip net.IP, timeout time.Duration) (time.Duration, error) {
+	c, err := vpsDialer(cfg, "udp").Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(pingUDPPort)))
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	start := time.Now()
+	_ = c.SetDeadline(start.Add(timeout))
+	if _, err := c.Write([]byte("tut ping")); err != nil {
+		return 0, err
+	}
+	var buf [64]byte
+	_, err = c.Read(buf[:])
+	if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+		return time.Since(start), nil
+	}
+	return 0, err
+}
+
+// diagnose tells what most likely broke the connection to the VPS: the
+// local network, the VPS or the path to it, its sshd, or the SSH session
+// itself.
+func (d *daemon) diagnose(ctx context.Context, cfg *Config) string {
+	timeout := cfg.Health.ProbeTimeout.D()
+	r, err := lookupRoute(cfg)
+	if err != nil {
+		return fmt.Sprintf("network: no route to the VPS (%v)", err)
+	}
+	// pings only count when the VPS answered them before
+	if d.pingVPS(ctx, cfg) != nil && d.pings.lastReply.Load() != 0 {
+		if r.gateway != nil {
+			if _, _, err := pingHost(ctx, cfg, r.gateway.String(), timeout); err != nil {
+				return fmt.Sprintf("network: neither the VPS nor the gateway %s answers pings", r.gateway)
+			}
+		}
+		return "VPS: it stopped answering pings; it is down or the path to it is broken"
+	}
+	port := sshPort(cfg)
+	if err := probeSSHPort(ctx, cfg, port); err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Sprintf("sshd: the VPS is up but refuses connections on port %d", port)
+		}
+		return fmt.Sprintf("sshd: the VPS is up but port %d does not answer with SSH (%v)", port, err)
+	}
+	return "SSH: the VPS and sshd answer; the session itself failed (authentication, host key or forwards)"
+}
+
+// pingState returns the latest ping results for the API: the method, the
+// round trip and how long ago the last answer came, if any.
+func (d *daemon) pingState() map[string]any {
+	p := &d.pings
+	last := p.lastReply.Load()
+	if last == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return map[string]any{
+		"method":          p.method,
+		"rtt_ms":          float64(p.rttMicros.Load()) / 1000,
+		"last_reply_secs": int64(monoSince(last).Seconds()),
+		"lost_in_a_row":   p.lost.Load(),
+	}
+}
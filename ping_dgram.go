@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// icmpDatagramConn opens an unprivileged ICMP socket; on Linux the group
+// of the process must be in net.ipv4.ping_group_range.
+func icmpDatagramConn(v4 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if !v4 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// icmpDatagramConn is not available; raw sockets or UDP pings are used.
+func icmpDatagramConn(bool) (net.PacketConn, error) {
+	return nil, errors.New("no unprivileged ICMP sockets")
+}
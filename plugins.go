@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Plugins extend tut without patching it: executables run at lifecycle
+// points, each event given as the first argument and as JSON on stdin,
+// in the format of the event stream (apiEvent). A plugin subscribes to
+// event names:
+//
+//   - config-loaded: at startup and after every applied reload, with the
+//     forwards in data.
+//   - forward-up: for every forward once a session is established, and
+//     for forwards added by a reload without one.
+//   - connection-accepted: before a connection of a TCP relay is dialed,
+//     with the client in data.remote: loopback for connections through
+//     the VPS unless the agent tells the address, see clientaddr.go. tut
+//     waits for the plugin; a non-zero exit, or none in time, closes the
+//     connection, so custom admission checks fit in here.
+//   - any other event of the event stream, e.g. tunnel-up, reconnecting or
+//     quota-paused, for notifications.
+//
+// Apart from connection-accepted, plugins run in the background, one event
+// at a time per plugin and in order. What they print is logged.
+
+// pluginConnectionAccepted is the event plugins decide on synchronously.
+const pluginConnectionAccepted = "connection-accepted"
+
+// pluginQueue is how many events a slow plugin may fall behind before
+// further events are dropped for it.
+const pluginQueue = 64
+
+// plugin is a configured plugin with its queue of background events.
+type plugin struct {
+	cfg   PluginConfig
+	queue chan apiEvent
+}
+
+// pluginSet holds the plugins by the events they subscribed to.
+type pluginSet struct {
+	byEvent map[string][]*plugin
+}
+
+// plugins are the plugins of the daemon; nil when none are configured.
+var plugins *pluginSet
+
+// startPlugins starts a worker for every configured plugin and feeds it the
+// events it subscribed to from the event bus.
+func startPlugins(cfg *Config) *pluginSet {
+	if len(cfg.Plugins) == 0 {
+		return nil
+	}
+	s := &pluginSet{byEvent: make(map[string][]*plugin)}
+	background := false
+	for _, pc := range cfg.Plugins {
+		p := &plugin{cfg: pc, queue: make(chan apiEvent, pluginQueue)}
+		for _, e := range pc.Events {
+			s.byEvent[e] = append(s.byEvent[e], p)
+			if e != pluginConnectionAccepted {
+				background = true
+			}
+		}
+		go p.work()
+		logf("Plugin %s: %s on %s", pc.Name, pc.Path, strings.Join(pc.Events, ", "))
+	}
+	if background {
+		ch := events.subscribe()
+		go func() {
+			for e := range ch {
+				s.notify(e)
+			}
+		}()
+	}
+	return s
+}
+
+// validatePlugins checks the plugins of c and that their executables exist.
+func validatePlugins(c *Config) error {
+	names := make(map[string]bool)
+	for _, p := range c.Plugins {
+		if !validName(p.Name) || names[p.Name] {
+			return fmt.Errorf("invalid or duplicate plugin name %q", p.Name)
+		}
+		names[p.Name] = true
+		if _, err := exec.LookPath(p.Path); err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name, err)
+		}
+		if len(p.Events) == 0 {
+			return fmt.Errorf("plugin %s: no events", p.Name)
+		}
+	}
+	return nil
+}
+
+// notify queues e for every plugin subscribed to it.
+func (s *pluginSet) notify(e apiEvent) {
+	if s == nil {
+		return
+	}
+	for _, p := range s.byEvent[e.Type] {
+		select {
+		case p.queue <- e:
+		default:
+			logEvent(levelWarn, e.Forward, "", "plugin %s is falling behind; dropped %s event", p.cfg.Name, e.Type)
+		}
+	}
+}
+
+// allow runs the connection-accepted plugins for a connection of forward
+// and reports whether all of them accepted it.
+func (s *pluginSet) allow(forward, remote string) bool {
+	if s == nil || len(s.byEvent[pluginConnectionAccepted]) == 0 {
+		return true
+	}
+	e := apiEvent{Time: time.Now(), Type: pluginConnectionAccepted, Forward: forward, Data: map[string]any{"remote": remote}}
+	for _, p := range s.byEvent[pluginConnectionAccepted] {
+		if err := p.run(e); err != nil {
+			logEvent(levelInfo, forward, "", "plugin %s rejected connection from %s: %v", p.cfg.Name, remote, err)
+			return false
+		}
+	}
+	return true
+}
+
+// work runs the queued background events one after another.
+func (p *plugin) work() {
+	for e := range p.queue {
+		if err := p.run(e); err != nil {
+			logEvent(levelWarn, e.Forward, "", "plugin %s failed on %s: %v", p.cfg.Name, e.Type, err)
+		}
+	}
+}
+
+// run executes the plugin for e and logs what it printed.
+func (p *plugin) run(e apiEvent) error {
+	in, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout.D())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.cfg.Path, e.Type)
+	cmd.Stdin = bytes.NewReader(append(in, '\n'))
+	out, err := cmd.CombinedOutput()
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			logEvent(levelInfo, e.Forward, "", "plugin %s: %s", p.cfg.Name, line)
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("no answer within %s", p.cfg.Timeout)
+	}
+	return err
+}
+
+// publishConfigLoaded announces the forwards of cfg on the event bus.
+func publishConfigLoaded(cfg *Config) {
+	var fwds []map[string]any
+	for _, f := range cfg.TCPForwards {
+		fwds = append(fwds, forwardEventData(f.Name, "tcp", f.RemotePort, f.LocalHost, f.LocalPort))
+	}
+	for _, u := range cfg.UDPForwards {
+		fwds = append(fwds, forwardEventData(u.Name, "udp", u.UDPPublicPort, u.LocalHost, u.LocalUDPPort))
+	}
+	events.publish(apiEvent{Type: "config-loaded", Data: map[string]any{"forwards": fwds}})
+}
+
+// publishForwardsUp announces every forward of cfg, which should carry the
+// leased ports, as up.
+func publishForwardsUp(cfg *Config) {
+	for _, f := range cfg.TCPForwards {
+		if f.onVPS() {
+			publishForwardUp(f)
+		}
+	}
+	for _, u := range cfg.UDPForwards {
+		events.publish(apiEvent{Type: "forward-up", Forward: u.Name, Data: forwardEventData(u.Name, "udp", u.UDPPublicPort, u.LocalHost, u.LocalUDPPort)})
+	}
+}
+
+// publishForwardUp announces the TCP forward f as up.
+func publishForwardUp(f TCPForward) {
+	events.publish(apiEvent{Type: "forward-up", Forward: f.Name, Data: forwardEventData(f.Name, "tcp", f.RemotePort, f.LocalHost, f.LocalPort)})
+}
+
+func forwardEventData(name, protocol string, publicPort int, host string, port int) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"protocol":    protocol,
+		"public_port": publicPort,
+		"local":       fmt.Sprintf("%s:%d", host, port),
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The connection policy decides per connection whether a forward accepts
+// it, refuses it or routes it to another local service, with rules whose
+// conditions are written in a small expression language, which keeps tut
+// free of an embedded Starlark or Lua interpreter:
+//
+//	forward == "ssh" && !(client in ["192.168.0.0/16", "10.0.0.0/8"])
+//	weekday in ["sat", "sun"] || hour < 7 || hour >= 19
+//	forward matches "^admin-" && connections >= 5
+//
+// The grammar, from the lowest precedence up:
+//
+//	condition  = and { "||" and }
+//	and        = not { "&&" not }
+//	not        = "!" not | comparison
+//	comparison = value [ op value ]
+//	op         = "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" | "matches"
+//	value      = string | integer | "true" | "false" | variable | list | "(" condition ")"
+//	list       = "[" [ value { "," value } [ "," ] ] "]"
+//
+// Strings are in double quotes with Go escapes, integers are decimal and
+// not negative, and comparisons do not chain. in tests list membership, or
+// an IP in a CIDR; matches a regular expression. The variables are listed
+// in policyVars; client is loopback for connections through the VPS
+// unless the agent tells the address, see clientaddr.go.
+// The first rule whose condition holds decides; without one the
+// connection is accepted.
+
+// policySyntax sums up the grammar for the errors of conditions that do
+// not parse.
+const policySyntax = `conditions are comparisons "value op value" with op one of == != < <= > >= in matches, ` +
+	`joined with && and ||, negated with ! and grouped with ( ); ` +
+	`values are "strings", integers, true, false, [lists] and the variables `
+
+// policyVars are the variables a condition may use.
+var policyVars = map[string]string{
+	"forward":     "name of the forward",
+	"client":      "IP address of the client",
+	"client_port": "port of the client",
+	"connections": "connections the forward has open",
+	"hour":        "hour of the local time, 0-23",
+	"minute":      "minute of the local time, 0-59",
+	"weekday":     "day of the week: mon, tue, wed, thu, fri, sat or sun",
+}
+
+// policyVarNames lists the variables for error messages.
+func policyVarNames() string {
+	names := make([]string, 0, len(policyVars))
+	for name := range policyVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// PolicyRule is one rule of the connection policy.
+type PolicyRule struct {
+	When   string `yaml:"when"`   // condition, see policy.go; empty: always
+	Action string `yaml:"action"` // accept, deny or route
+	Target string `yaml:"target"` // host:port to dial for route
+}
+
+// policyRule is a PolicyRule with its condition parsed.
+type policyRule struct {
+	cond   policyNode
+	action string
+	target string
+}
+
+// connPolicy is the policy of the running configuration.
+var connPolicy atomic.Pointer[[]policyRule]
+
+// compilePolicy parses the rules of the policy.
+func compilePolicy(rules []PolicyRule) ([]policyRule, error) {
+	var out []policyRule
+	for i, r := range rules {
+		switch r.Action {
+		case "accept", "deny":
+		case "route":
+			if _, _, err := net.SplitHostPort(r.Target); err != nil {
+				return nil, fmt.Errorf("policy[%d]: invalid target %q: %w", i, r.Target, err)
+			}
+		default:
+			return nil, fmt.Errorf("policy[%d]: invalid action %q (accept, deny or route)", i, r.Action)
+		}
+		var cond policyNode = policyLit{true} // no condition: every connection
+		if strings.TrimSpace(r.When) != "" {
+			var err error
+			if cond, err = parsePolicy(r.When); err != nil {
+				return nil, fmt.Errorf("policy[%d].when: %w (%s%s)", i, err, policySyntax, policyVarNames())
+			}
+		}
+		out = append(out, policyRule{cond: cond, action: r.Action, target: r.Target})
+	}
+	return out, nil
+}
+
+// policyConn is what a policy knows about a connection.
+type policyConn struct {
+	forward     string
+	client      net.Addr
+	connections int64
+	now         time.Time
+}
+
+// decide returns the action of the first rule matching c and its target.
+func (c policyConn) decide() (string, string) {
+	rules := connPolicy.Load()
+	if rules == nil {
+		return "accept", ""
+	}
+	for _, r := range *rules {
+		v, err := r.cond.eval(c)
+		if err != nil {
+			logEvent(levelWarn, c.forward, "", "policy condition failed: %v", err)
+			continue
+		}
+		if b, _ := v.(bool); b {
+			return r.action, r.target
+		}
+	}
+	return "accept", ""
+}
+
+// lookup returns the value of the variable name.
+func (c policyConn) lookup(name string) any {
+	switch name {
+	case "forward":
+		return c.forward
+	case "client", "client_port":
+		host, port, _ := net.SplitHostPort(c.client.String())
+		if name == "client" {
+			return host
+		}
+		n, _ := strconv.Atoi(port)
+		return n
+	case "connections":
+		return int(c.connections)
+	case "hour":
+		return c.now.Hour()
+	case "minute":
+		return c.now.Minute()
+	case "weekday":
+		return strings.ToLower(c.now.Weekday().String()[:3])
+	}
+	return nil
+}
+
+// policyNode is a node of a parsed condition.
+type policyNode interface {
+	eval(c policyConn) (any, error)
+}
+
+type (
+	policyLit  struct{ v any }
+	policyVar  struct{ name string }
+	policyList struct{ items []policyNode }
+	policyNot  struct{ x policyNode }
+	policyBin  struct {
+		op   string
+		l, r policyNode
+		re   *regexp.Regexp // matches with a literal pattern
+	}
+)
+
+func (n policyLit) eval(policyConn) (any, error)   { return n.v, nil }
+func (n policyVar) eval(c policyConn) (any, error) { return c.lookup(n.name), nil }
+
+func (n policyList) eval(c policyConn) (any, error) {
+	out := make([]any, 0, len(n.items))
+	for _, it := range n.items {
+		v, err := it.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (n policyNot) eval(c policyConn) (any, error) {
+	v, err := n.x.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %v", v)
+	}
+	return !b, nil
+}
+
+func (n policyBin) eval(c policyConn) (any, error) {
+	l, err := n.l.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" || n.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, l)
+		}
+		if lb == (n.op == "||") {
+			return lb, nil
+		}
+		r, err := n.r.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %v", n.op, r)
+		}
+		return rb, nil
+	}
+	r, err := n.r.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return l == r, nil
+	case "!=":
+		return l != r, nil
+	case "in":
+		if list, ok := r.([]any); ok {
+			for _, item := range list {
+				if policyContains(item, l) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return policyContains(r, l), nil
+	case "matches":
+		s, ok := l.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches needs a string, got %v", l)
+		}
+		re := n.re
+		if re == nil {
+			pattern, _ := r.(string)
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	}
+	li, lok := l.(int)
+	ri, rok := r.(int)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s needs numbers, got %v and %v", n.op, l, r)
+	}
+	switch n.op {
+	case "<":
+		return li < ri, nil
+	case "<=":
+		return li <= ri, nil
+	case ">":
+		return li > ri, nil
+	}
+	return li >= ri, nil
+}
+
+// policyContains reports whether v equals item or, for an IP address and a
+// CIDR, lies in it.
+func policyContains(item, v any) bool {
+	if item == v {
+		return true
+	}
+	s, ok1 := item.(string)
+	ip, ok2 := v.(string)
+	if !ok1 || !ok2 || !strings.Contains(s, "/") {
+		return false
+	}
+	_, network, err := net.ParseCIDR(s)
+	return err == nil && network.Contains(net.ParseIP(ip))
+}
+
+// policyParser is a recursive descent parser of conditions.
+type policyParser struct {
+	toks []string
+	pos  int
+}
+
+// parsePolicy parses a condition.
+func parsePolicy(src string) (policyNode, error) {
+	toks, err := policyTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	p := &policyParser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.toks[p.pos], src)
+	}
+	return n, nil
+}
+
+func (p *policyParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *policyParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *policyParser) or() (policyNode, error) {
+	l, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var r policyNode
+		if r, err = p.and(); err == nil {
+			l = policyBin{op: "||", l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *policyParser) and() (policyNode, error) {
+	l, err := p.not()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var r policyNode
+		if r, err = p.not(); err == nil {
+			l = policyBin{op: "&&", l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *policyParser) not() (policyNode, error) {
+	if p.peek() == "!" {
+		p.next()
+		x, err := p.not()
+		return policyNot{x}, err
+	}
+	return p.cmp()
+}
+
+func (p *policyParser) cmp() (policyNode, error) {
+	l, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "in", "matches":
+	default:
+		return l, nil
+	}
+	p.next()
+	r, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	n := policyBin{op: op, l: l, r: r}
+	if lit, ok := r.(policyLit); ok && op == "matches" {
+		pattern, ok := lit.v.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches needs a string pattern")
+		}
+		if n.re, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *policyParser) primary() (policyNode, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case t == "(":
+		n, err := p.or()
+		if err == nil && p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		return n, err
+	case t == "[":
+		var list policyList
+		for p.peek() != "]" {
+			item, err := p.primary()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if p.peek() == "," {
+				p.next()
+			} else if p.peek() != "]" {
+				return nil, fmt.Errorf("expected , or ] in list")
+			}
+		}
+		p.next()
+		return list, nil
+	case t[0] == '"':
+		s, err := strconv.Unquote(t)
+		return policyLit{s}, err
+	case t[0] >= '0' && t[0] <= '9':
+		n, err := strconv.Atoi(t)
+		return policyLit{n}, err
+	case t == "true" || t == "false":
+		return policyLit{t == "true"}, nil
+	}
+	if _, ok := policyVars[t]; !ok {
+		return nil, fmt.Errorf("unknown variable %q", t)
+	}
+	return policyVar{t}, nil
+}
+
+// policyTokens splits src into operators, punctuation, quoted strings,
+// numbers and words.
+func policyTokens(src string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case ch == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string in %q", src)
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		case strings.ContainsRune("()[],", rune(ch)):
+			toks = append(toks, string(ch))
+			i++
+		case strings.ContainsRune("=!<>&|", rune(ch)):
+			op := string(ch)
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("unknown operator %q in %q", op, src)
+			}
+			toks = append(toks, op)
+			i += len(op)
+		default:
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= '0' && src[j] <= '9' ||
+				src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z') {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %q in %q", ch, src)
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		src     string
+		wantErr string // substring of the error, "" for none
+	}{
+		{`forward == "ssh"`, ""},
+		{`forward == "ssh" && !(client in ["192.168.0.0/16", "10.0.0.0/8"])`, ""},
+		{`weekday in ["sat", "sun"] || hour < 7 || hour >= 19`, ""},
+		{`forward matches "^admin-" && connections >= 5`, ""},
+		{`true`, ""},
+		{``, "empty condition"},
+		{`forward = "ssh"`, "unknown operator"},
+		{`forward == "ssh`, "unterminated string"},
+		{`user == "root"`, "unknown variable"},
+		{`(hour < 7`, "missing )"},
+		{`client in ["10.0.0.0/8"`, "expected , or ]"},
+		{`hour < 7 hour`, "unexpected"},
+		{`forward ==`, "unexpected end"},
+		{`forward matches "("`, "missing closing )"},
+	} {
+		_, err := parsePolicy(tc.src)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("parsePolicy(%q): %v", tc.src, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("parsePolicy(%q) succeeded, want an error with %q", tc.src, tc.wantErr)
+		case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+			t.Errorf("parsePolicy(%q) = %v, want an error with %q", tc.src, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPolicyDecide(t *testing.T) {
+	rules, err := compilePolicy([]PolicyRule{
+		{When: `forward == "ssh" && !(client in ["192.168.0.0/16", "10.0.0.0/8"])`, Action: "deny"},
+		{When: `forward == "shop" && hour >= 2 && hour < 4`, Action: "route", Target: "127.0.0.1:8081"},
+		{When: `forward matches "^mc-" && connections >= 20`, Action: "deny"},
+		{When: `weekday in ["sat", "sun"] && forward == "admin"`, Action: "deny"},
+		{When: `client_port < 1024`, Action: "deny"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := connPolicy.Load()
+	connPolicy.Store(&rules)
+	defer connPolicy.Store(old)
+
+	monday3am := time.Date(2026, 10, 19, 3, 0, 0, 0, time.Local)
+	saturday := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	addr := func(s string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	for _, tc := range []struct {
+		name       string
+		conn       policyConn
+		wantAction string
+		wantTarget string
+	}{
+		{"ssh from the LAN", policyConn{forward: "ssh", client: addr("192.168.1.20:50000"), now: saturday}, "accept", ""},
+		{"ssh from outside", policyConn{forward: "ssh", client: addr("203.0.113.7:50000"), now: saturday}, "deny", ""},
+		{"ssh over IPv6", policyConn{forward: "ssh", client: addr("[2001:db8::1]:50000"), now: saturday}, "deny", ""},
+		{"shop at night", policyConn{forward: "shop", client: addr("203.0.113.7:50000"), now: monday3am}, "route", "127.0.0.1:8081"},
+		{"shop at noon", policyConn{forward: "shop", client: addr("203.0.113.7:50000"), now: saturday}, "accept", ""},
+		{"game under the cap", policyConn{forward: "mc-survival", client: addr("203.0.113.7:50000"), connections: 19, now: saturday}, "accept", ""},
+		{"game at the cap", policyConn{forward: "mc-survival", client: addr("203.0.113.7:50000"), connections: 20, now: saturday}, "deny", ""},
+		{"admin on a weekday", policyConn{forward: "admin", client: addr("203.0.113.7:50000"), now: monday3am}, "accept", ""},
+		{"admin on the weekend", policyConn{forward: "admin", client: addr("203.0.113.7:50000"), now: saturday}, "deny", ""},
+		{"privileged client port", policyConn{forward: "web", client: addr("203.0.113.7:80"), now: saturday}, "deny", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			action, target := tc.conn.decide()
+			if action != tc.wantAction || target != tc.wantTarget {
+				t.Errorf("decide() = %q, %q; want %q, %q", action, target, tc.wantAction, tc.wantTarget)
+			}
+		})
+	}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule PolicyRule
+		ok   bool
+	}{
+		{"no condition", PolicyRule{Action: "deny"}, true},
+		{"route with a target", PolicyRule{When: "true", Action: "route", Target: "127.0.0.1:8081"}, true},
+		{"route without a port", PolicyRule{When: "true", Action: "route", Target: "127.0.0.1"}, false},
+		{"unknown action", PolicyRule{When: "true", Action: "drop"}, false},
+		{"bad condition", PolicyRule{When: "hour <", Action: "deny"}, false},
+	} {
+		if _, err := compilePolicy([]PolicyRule{tc.rule}); (err == nil) != tc.ok {
+			t.Errorf("%s: compilePolicy error = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestCompilePolicySyntaxHelp(t *testing.T) {
+	_, err := compilePolicy([]PolicyRule{{When: `host == "nas"`, Action: "deny"}})
+	if err == nil || !strings.Contains(err.Error(), policySyntax) || !strings.Contains(err.Error(), "client_port, connections, forward") {
+		t.Errorf("compilePolicy error = %v, want the grammar and the variables", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Networks that only let HTTPS out leave port 443, which VPS operators
+// often share between a web server and sshd with a protocol multiplexer
+// such as sslh. With vps.ports, tut tries the listed ports in order before
+// each session, starting with the one that worked last time (kept in the
+// state file), and connects to the first that answers like an SSH server.
+// The probe sends an SSH identification line first, since multiplexers
+// pick the backend from what the client says.
+
+// portProbeTimeout bounds the probe of one port.
+const portProbeTimeout = 5 * time.Second
+
+// vpsPort is the port of vps.ports that answered last.
+var vpsPort struct {
+	sync.Mutex
+	port int
+}
+
+// sshPort returns the port ssh is to connect to.
+func sshPort(cfg *Config) int {
+	if len(cfg.VPS.Ports) == 0 {
+		return cfg.VPS.Port
+	}
+	vpsPort.Lock()
+	defer vpsPort.Unlock()
+	for _, p := range cfg.VPS.Ports {
+		if p == vpsPort.port {
+			return p
+		}
+	}
+	return cfg.VPS.Ports[0]
+}
+
+// portOrder returns vps.ports with the port that worked last first.
+func portOrder(cfg *Config, st *stateStore) []int {
+	last := st.sshPort()
+	order := []int{}
+	for _, p := range cfg.VPS.Ports {
+		if p == last {
+			order = append([]int{p}, order...)
+		} else {
+			order = append(order, p)
+		}
+	}
+	return order
+}
+
+// pickPort probes vps.ports and records the first that reaches an SSH
+// server for the sessions that follow.
+func pickPort(ctx context.Context, cfg *Config, st *stateStore) {
+	var errs []string
+	for _, p := range portOrder(cfg, st) {
+		err := probeSSHPort(ctx, cfg, p)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%d: %v", p, err))
+			continue
+		}
+		vpsPort.Lock()
+		changed := vpsPort.port != p
+		vpsPort.port = p
+		vpsPort.Unlock()
+		if st.sshPort() != p {
+			st.setSSHPort(p)
+			st.saveOrLog()
+		}
+		if changed {
+			logEvent(levelInfo, "", "ssh-port", "Reaching SSH on %s port %d", cfg.VPS.Host, p)
+		}
+		return
+	}
+	logEvent(levelWarn, "", "ssh-port-failed", "No port of vps.ports reaches SSH (%s); trying %d", strings.Join(errs, "; "), sshPort(cfg))
+}
+
+// probeSSHPort connects to port on the VPS, introduces itself as an SSH
+// client and checks that an SSH server answers.
+func probeSSHPort(ctx context.Context, cfg *Config, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, portProbeTimeout)
+	defer cancel()
+	c, err := vpsDialer(cfg, "tcp").DialContext(ctx, "tcp", net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	deadline, _ := ctx.Deadline()
+	_ = c.SetDeadline(deadline)
+	if _, err := c.Write([]byte("SSH-2.0-tut_probe\r\n")); err != nil {
+		return err
+	}
+	// servers may send other lines before the identification (RFC 4253)
+	r := bufio.NewReader(c)
+	for i := 0; i < 10; i++ {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("no SSH server: %w", err)
+		}
+	}
+	return fmt.Errorf("no SSH server")
+}
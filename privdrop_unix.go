@@ -0,0 +1,122 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the run_as user when started as
+// root. Files tut keeps writing to after initialization (state, log file and
+// socat logs) are handed over to that user first. Every child started
+// afterwards (ssh, socat) inherits the reduced credentials.
+func dropPrivileges(cfg *Config) error {
+	if cfg.RunAs == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		logf("run_as %q ignored: not running as root", cfg.RunAs)
+		return nil
+	}
+	u, err := user.Lookup(cfg.RunAs)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s: invalid uid %q", u.Username, u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s: invalid gid %q", u.Username, u.Gid)
+	}
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.Atoi(id); err == nil {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	for _, o := range ownedPaths(cfg) {
+		if err := handOver(o, uid, gid); err != nil {
+			logEvent(levelWarn, "", "", "Cannot hand %s over to %s: %v", o.path, u.Username, err)
+		}
+	}
+
+	// group membership must change while we still are root
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	if os.Geteuid() != uid {
+		return fmt.Errorf("still running as uid %d after setuid", os.Geteuid())
+	}
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	os.Setenv("LOGNAME", u.Username)
+	logf("Dropped privileges to %s (uid %d, gid %d)", u.Username, uid, gid)
+	return nil
+}
+
+// ownedPath is a file or directory tut writes to after dropping privileges.
+type ownedPath struct {
+	path string
+	dir  bool
+}
+
+// ownedPaths lists what the run_as user needs write access to. The state
+// file is replaced atomically, so its directory is handed over as well, but
+// only when it is tut's own (named "tut", like the default /var/lib/tut).
+func ownedPaths(cfg *Config) []ownedPath {
+	var out []ownedPath
+	if cfg.StateFile != "" {
+		if dir := filepath.Dir(cfg.StateFile); filepath.Base(dir) == "tut" {
+			out = append(out, ownedPath{path: dir, dir: true})
+		}
+		out = append(out, ownedPath{path: cfg.StateFile})
+	}
+	if cfg.Log.File != "" {
+		out = append(out, ownedPath{path: cfg.Log.File})
+	}
+	if cfg.CrashDir != "-" {
+		out = append(out, ownedPath{path: cfg.CrashDir, dir: true})
+	}
+	for _, u := range cfg.UDPForwards {
+		tcpLog, udpLog := wrapperLogPaths(u)
+		if tcpLog != "" {
+			out = append(out, ownedPath{path: tcpLog}, ownedPath{path: udpLog})
+		}
+	}
+	return out
+}
+
+// handOver creates o when missing and changes its owner to uid/gid.
+func handOver(o ownedPath, uid, gid int) error {
+	if o.dir {
+		if err := os.MkdirAll(o.path, 0o755); err != nil {
+			return err
+		}
+		return os.Chown(o.path, uid, gid)
+	}
+	if err := os.MkdirAll(filepath.Dir(o.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Chown(o.path, uid, gid)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows; run tut as the desired
+// account through the service manager instead.
+func dropPrivileges(cfg *Config) error {
+	if cfg.RunAs == "" {
+		return nil
+	}
+	return errors.New("run_as is not supported on Windows")
+}
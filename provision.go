@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// remote.provision_commands set the VPS up for the tunnel in ways that do
+// not survive a reboot: firewall rules, sysctls, a tmpfs the agent lives
+// in. Before each session tut reads the boot ID of the VPS, and when the
+// VPS booted since the commands last ran, or the commands changed, it runs
+// them again before any forward is requested. A failing command fails the
+// session, so tut retries rather than serving from a half-configured host.
+// The agent is checked and uploaded before every session anyway.
+
+// bootIDCommand prints an ID that changes with every boot of the VPS.
+const bootIDCommand = `cat /proc/sys/kernel/random/boot_id 2>/dev/null || sysctl -n kern.boottime`
+
+// provision runs remote.provision_commands unless they already ran since
+// the VPS booted.
+func (d *daemon) provision(ctx context.Context, cfg *Config) error {
+	if len(cfg.Remote.ProvisionCommands) == 0 {
+		return nil
+	}
+	out, err := agentSSH(ctx, cfg, bootIDCommand, nil)
+	if err != nil {
+		return fmt.Errorf("reading the boot ID of the VPS: %w", err)
+	}
+	boot := strings.TrimSpace(out)
+	if boot == "" {
+		return errors.New("the VPS has no boot ID")
+	}
+	digest := configHash([]byte(strings.Join(cfg.Remote.ProvisionCommands, "\x00")))
+	lastBoot, lastDigest := d.st.provisioned()
+	switch {
+	case lastBoot == boot && lastDigest == digest:
+		return nil
+	case lastBoot != "" && lastBoot != boot:
+		logEvent(levelWarn, "", "vps-rebooted", "The VPS rebooted since it was provisioned; provisioning it again")
+	default:
+		logEvent(levelInfo, "", "provisioning", "Provisioning the VPS")
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteCommandTimeout)
+	defer cancel()
+	for _, c := range cfg.Remote.ProvisionCommands {
+		if err := runRemoteCommand(ctx, cfg, "provision", c); err != nil {
+			return fmt.Errorf("provision-command %q failed: %w", c, err)
+		}
+	}
+	d.st.setProvisioned(boot, digest)
+	d.st.saveOrLog()
+	logEvent(levelInfo, "", "provisioned", "Provisioned the VPS")
+	return nil
+}
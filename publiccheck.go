@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With health.public_check_interval set, tut checks the public ports from
+// the outside as far as the VPS itself can: the agent connects to the
+// public port of every TCP forward at the public address of the VPS and
+// reports back over the SSH connection, and tut checks that each connection
+// arrived at its relay through the tunnel. This notices exposure that broke
+// on the VPS while the session looks fine, like sshd binding forwards to
+// loopback only (GatewayPorts) or a firewall rule that does not exempt
+// loopback. A provider firewall is only crossed when the public address is
+// NATed to the VPS; an address on the VPS's own interface is reached
+// through loopback.
+
+// publicCheckHold bounds how long the agent keeps its connections open,
+// waiting for tut to see them arrive.
+const publicCheckHold = 30 * time.Second
+
+// watchPublicPorts checks the public ports every health.public_check_interval
+// while the tunnel is up.
+func watchPublicPorts(ctx context.Context, d *daemon) {
+	agentReady, failing := false, false
+	for {
+		cfg := d.config()
+		interval := cfg.Health.PublicCheckInterval.D()
+		if interval <= 0 {
+			interval = time.Minute // wait for a reload to turn it on
+		} else if d.sessionUp.Load() {
+			err := error(nil)
+			if !agentReady {
+				if err = ensureAgent(ctx, cfg); err != nil {
+					err = fmt.Errorf("agent: %w", err)
+				}
+				agentReady = err == nil
+			}
+			if err == nil {
+				err = d.checkPublicPorts(ctx, cfg)
+			}
+			if err != nil && ctx.Err() == nil {
+				if !failing {
+					logEvent(levelWarn, "", "public-check-failed", "Cannot check the public ports from the VPS: %v", err)
+				}
+				agentReady = false
+			}
+			failing = err != nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkPublicPorts has the agent connect to the public ports and records
+// for each forward whether its connection arrived.
+func (d *daemon) checkPublicPorts(ctx context.Context, cfg *Config) error {
+	relays := d.relaySnapshot()
+	type check struct {
+		f        TCPForward
+		r        *relay
+		accepted int64
+	}
+	var checks []check
+	var ports []string
+	for _, f := range d.st.withLeases(cfg).TCPForwards {
+		if r := relays[f.Name]; r != nil && f.RemotePort != 0 {
+			checks = append(checks, check{f, r, r.stats.accepted.Load()})
+			ports = append(ports, strconv.Itoa(f.RemotePort))
+		}
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	ip, err := resolvePingTarget(ctx, cfg, cfg.VPS.Host)
+	if err != nil {
+		return err
+	}
+	timeout := cfg.Health.ProbeTimeout.D()
+
+	ctx, cancel := context.WithTimeout(ctx, 2*timeout+publicCheckHold)
+	defer cancel()
+	cmd, err := remoteCmd(ctx, cfg, fmt.Sprintf("%s agent probe -addr %s -ports %s -timeout %d",
+		shellQuote(cfg.Agent.Path), shellQuote(ip.String()), strings.Join(ports, ","), max(cfg.Health.ProbeTimeout.Seconds(), 1)))
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// closing stdin lets the agent close its connections and exit
+	defer func() { _ = cmd.Wait() }()
+	defer stdin.Close()
+
+	results := make(map[string]string, len(ports))
+	sc := bufio.NewScanner(stdout)
+	for len(results) < len(ports) && sc.Scan() {
+		if port, result, ok := strings.Cut(sc.Text(), " "); ok {
+			results[port] = result
+		}
+	}
+	if len(results) < len(ports) {
+		if ctx.Err() != nil {
+			return errors.New("the agent did not answer in time")
+		}
+		return errors.New("the agent exited without answering")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, c := range checks {
+		result := results[strconv.Itoa(c.f.RemotePort)]
+		var err error
+		if result != "ok" {
+			err = errors.New(result)
+		} else {
+			for c.r.stats.accepted.Load() == c.accepted && time.Now().Before(deadline) {
+				time.Sleep(50 * time.Millisecond)
+			}
+			if c.r.stats.accepted.Load() == c.accepted {
+				err = errors.New("the connection was accepted on the VPS but did not arrive through the tunnel")
+			}
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(c.f.RemotePort))
+		if err != nil {
+			if c.r.stats.publicFailed.Swap(monoNow()) == 0 {
+				logEvent(levelWarn, c.f.Name, "public-port-unreachable", "%s is not reachable from the VPS: %v", addr, err)
+			}
+		} else if c.r.stats.publicFailed.Swap(0) != 0 {
+			logEvent(levelInfo, c.f.Name, "public-port-reachable", "%s is reachable again", addr)
+		}
+	}
+	return nil
+}
+
+// runAgentProbe implements "tut agent probe", run on the VPS: it connects
+// to each of the ports at addr, prints "<port> ok" or "<port> <error>" for
+// each and keeps the connections open until stdin is closed, so that tut
+// can see them arrive.
+func runAgentProbe(args []string) int {
+	fs := flag.NewFlagSet("agent probe", flag.ExitOnError)
+	addr := fs.String("addr", "", "Public address of the VPS")
+	ports := fs.String("ports", "", "Comma-separated ports to connect to")
+	timeoutSecs := fs.Int("timeout", 5, "Seconds each connection may take")
+	_ = fs.Parse(args)
+	if *addr == "" || *ports == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent probe -addr address -ports port,... [-timeout seconds]")
+		return 2
+	}
+	list := strings.Split(*ports, ",")
+	results := make([]string, len(list))
+	conns := make([]net.Conn, len(list))
+	var wg sync.WaitGroup
+	for i, port := range list {
+		wg.Add(1)
+		go func(i int, port string) {
+			defer wg.Done()
+			c, err := net.DialTimeout("tcp", net.JoinHostPort(*addr, port), time.Duration(*timeoutSecs)*time.Second)
+			if err != nil {
+				results[i] = err.Error()
+				return
+			}
+			conns[i], results[i] = c, "ok"
+		}(i, port)
+	}
+	wg.Wait()
+	for i, port := range list {
+		fmt.Printf("%s %s\n", port, results[i])
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(publicCheckHold):
+	}
+	for _, c := range conns {
+		if c != nil {
+			_ = c.Close()
+		}
+	}
+	return 0
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	punchProbeWindow = 10 * time.Second // how long replies are duplicated to a new client
+	punchRetry       = 5 * time.Minute  // wait before probing a client that did not switch again
+)
+
+// puncher carries a UDP forward with hole_punch on the local side. The local
+// socat wrapper sends the relayed datagrams to the puncher instead of the
+// service. When the VPS introduces a client (its public address, as seen by
+// the remote socat), the puncher sends the service's replies to that client
+// directly from a public socket as well, which opens the local NAT for it.
+// A client that follows its peer's address, as WireGuard roaming does, then
+// talks to the direct socket, and replies take the path the latest datagram
+// came in on. Everything else keeps using the relayed path.
+type puncher struct {
+	name    string
+	relay   *net.UDPConn // datagrams from and to the local socat wrapper
+	service *net.UDPConn // connected to the local service
+	direct  *net.UDPConn // public socket for direct paths
+
+	mu      sync.Mutex
+	wrapper *net.UDPAddr     // where relayed replies go
+	probing map[string]probe // introduced clients by address
+	active  *net.UDPAddr     // client on the direct path, nil while relayed
+}
+
+// probe is a client that is sent replies directly on trial.
+type probe struct {
+	addr    *net.UDPAddr
+	started time.Time
+}
+
+// startPunchers starts one puncher per UDP forward with hole_punch set.
+func startPunchers(cfg *Config) (map[string]*puncher, error) {
+	punchers := make(map[string]*puncher)
+	for _, u := range cfg.UDPForwards {
+		if !u.HolePunch {
+			continue
+		}
+		p, err := startPuncher(u)
+		if err != nil {
+			for _, p := range punchers {
+				p.close()
+			}
+			return nil, fmt.Errorf("hole punching for %s: %w", u.Name, err)
+		}
+		punchers[u.Name] = p
+	}
+	return punchers, nil
+}
+
+func startPuncher(u UDPForward) (*puncher, error) {
+	svc, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", u.LocalHost, u.LocalUDPPort))
+	if err != nil {
+		return nil, err
+	}
+	p := &puncher{name: u.Name, probing: map[string]probe{}}
+	if p.relay, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		return nil, err
+	}
+	if p.service, err = net.DialUDP("udp4", nil, svc); err != nil {
+		p.close()
+		return nil, err
+	}
+	if p.direct, err = net.ListenUDP("udp4", nil); err != nil {
+		p.close()
+		return nil, err
+	}
+	go p.fromRelay()
+	go p.fromDirect()
+	go p.fromService()
+	return p, nil
+}
+
+// addr is where the local socat wrapper sends relayed datagrams.
+func (p *puncher) addr() string {
+	return p.relay.LocalAddr().String()
+}
+
+func (p *puncher) close() {
+	for _, c := range []*net.UDPConn{p.relay, p.service, p.direct} {
+		if c != nil {
+			_ = c.Close()
+		}
+	}
+}
+
+// introduce is called with the public address of a client the VPS saw.
+func (p *puncher) introduce(addr string) {
+	peer, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil || peer.IP.To4() == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active != nil && p.active.IP.Equal(peer.IP) {
+		return
+	}
+	for key, pr := range p.probing {
+		if time.Since(pr.started) >= punchRetry {
+			delete(p.probing, key)
+		}
+	}
+	if _, ok := p.probing[peer.String()]; ok {
+		return
+	}
+	p.probing[peer.String()] = probe{addr: peer, started: time.Now()}
+	logEvent(levelDebug, p.name, "punch-probe", "Trying a direct path to %s", peer)
+}
+
+// fromRelay forwards relayed datagrams to the service. A client sending
+// through the VPS again has left the direct path.
+func (p *puncher) fromRelay() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := p.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.wrapper = from
+		if p.active != nil {
+			logEvent(levelInfo, p.name, "punch-relayed", "Client %s is back on the relayed path", p.active)
+			p.active = nil
+		}
+		p.mu.Unlock()
+		_, _ = p.service.Write(buf[:n])
+	}
+}
+
+// fromDirect forwards datagrams of introduced clients to the service and
+// drops everything else. Clients behind a NAT may show up from another
+// port than the VPS saw, so only the address has to match.
+func (p *puncher) fromDirect() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := p.direct.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !p.switchTo(from) {
+			continue
+		}
+		_, _ = p.service.Write(buf[:n])
+	}
+}
+
+// switchTo makes from the active direct client if it was introduced.
+func (p *puncher) switchTo(from *net.UDPAddr) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active != nil && p.active.String() == from.String() {
+		return true
+	}
+	for key, pr := range p.probing {
+		if pr.addr.IP.Equal(from.IP) {
+			delete(p.probing, key)
+			p.active = from
+			logEvent(levelInfo, p.name, "punch-direct", "Client %s switched to the direct path", from)
+			return true
+		}
+	}
+	return false
+}
+
+// fromService sends replies along the path the latest datagram came in on,
+// and also directly to clients that are being probed.
+func (p *puncher) fromService() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := p.service.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// ICMP port unreachable while the service restarts
+			continue
+		}
+		p.mu.Lock()
+		active, wrapper := p.active, p.wrapper
+		var probes []*net.UDPAddr
+		if active == nil {
+			for _, pr := range p.probing {
+				if time.Since(pr.started) < punchProbeWindow {
+					probes = append(probes, pr.addr)
+				}
+			}
+		}
+		p.mu.Unlock()
+		if active != nil {
+			_, _ = p.direct.WriteToUDP(buf[:n], active)
+			continue
+		}
+		if wrapper != nil {
+			_, _ = p.relay.WriteToUDP(buf[:n], wrapper)
+		}
+		for _, peer := range probes {
+			_, _ = p.direct.WriteToUDP(buf[:n], peer)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Priority classes of forwards, most urgent first.
+const (
+	priorityInteractive = iota
+	priorityNormal
+	priorityBulk
+	priorityClasses
+)
+
+// qosChunk is the largest write a relay makes at once while QoS is on, so
+// an urgent write never queues behind much bulk data.
+const qosChunk = 4 * 1024
+
+// priorityClass maps a forward's priority setting to its class.
+func priorityClass(p string) (int, error) {
+	switch p {
+	case "interactive":
+		return priorityInteractive, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "bulk":
+		return priorityBulk, nil
+	}
+	return 0, fmt.Errorf("invalid priority %q (interactive, normal or bulk)", p)
+}
+
+// validateQoS checks the priorities of the forwards and the link rates.
+func validateQoS(c *Config) error {
+	if c.QoS.Upload < 0 || c.QoS.Download < 0 {
+		return fmt.Errorf("invalid qos rates: %s, %s", c.QoS.Upload, c.QoS.Download)
+	}
+	for _, f := range c.TCPForwards {
+		if _, err := priorityClass(f.Priority); err != nil {
+			return fmt.Errorf("tcp forward %s: %w", f.Name, err)
+		}
+	}
+	for _, u := range c.UDPForwards {
+		if _, err := priorityClass(u.Priority); err != nil {
+			return fmt.Errorf("udp forward %s: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// qosLink shares the bandwidth of one direction of the tunnel between the
+// relays by strict priority: a write waits while writes of a more urgent
+// class wait, and all of them are paced at the configured rate so that the
+// queue builds up here rather than in ssh or the router, where it would
+// delay everyone alike.
+type qosLink struct {
+	mu      sync.Mutex
+	rate    float64 // bytes per second, 0 when off
+	tokens  float64
+	last    time.Time
+	waiting [priorityClasses]int
+}
+
+// setRate sets the link rate; 0 turns pacing off.
+func (l *qosLink) setRate(r Rate) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = r.BytesPerSecond()
+	l.tokens, l.last = 0, time.Now()
+}
+
+func (l *qosLink) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate > 0
+}
+
+// acquire waits until n bytes of class may be written.
+func (l *qosLink) acquire(class, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiting[class]++
+	defer func() { l.waiting[class]-- }()
+	for l.rate > 0 {
+		now := time.Now()
+		// at most 50ms worth of tokens, so an idle link does not let a
+		// burst of bulk data through
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate/20)
+		l.last = now
+		if l.tokens > 0 && !l.urgentWaiting(class) {
+			l.tokens -= float64(n)
+			return
+		}
+		wait := time.Millisecond
+		if l.tokens <= 0 {
+			wait = max(wait, time.Duration(-l.tokens/l.rate*float64(time.Second)))
+		}
+		l.mu.Unlock()
+		time.Sleep(wait)
+		l.mu.Lock()
+	}
+}
+
+// urgentWaiting reports whether a more urgent class is waiting.
+func (l *qosLink) urgentWaiting(class int) bool {
+	for c := 0; c < class; c++ {
+		if l.waiting[c] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// qosUp and qosDown pace the traffic into and out of the tunnel.
+var qosUp, qosDown qosLink
+
+// qosWrite writes b to dst through link in chunks, at priority class.
+func qosWrite(link *qosLink, class int, dst io.Writer, b []byte) error {
+	if !link.enabled() {
+		_, err := dst.Write(b)
+		return err
+	}
+	for len(b) > 0 {
+		n := min(len(b), qosChunk)
+		link.acquire(class, n)
+		if _, err := dst.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VPS egress is billed, so the transfer of every forward (both directions,
+// as counted by its relay) is added up per month in the state file, where
+// it survives restarts. A forward over its quota is paused, i.e. its relay
+// refuses connections and drops the open ones until the next period, or
+// only alerts with quota_action: alert. The tunnel-wide quota pauses every
+// forward. Warnings are logged at 90% and when a quota is exceeded.
+
+const (
+	quotaCheckInterval = 10 * time.Second
+	quotaSaveEvery     = 6 // checks between writes of the state file
+)
+
+var byteSizeRe = regexp.MustCompile(`(?i)^([0-9]+(?:\.[0-9]+)?)\s*([KMGTP]?)(i?)B?$`)
+
+// parseBytes parses a size such as 500GB, 1.5T or 200GiB. The units are
+// decimal (as billed by most providers) unless written with an i.
+func parseBytes(s string) (int64, error) {
+	m := byteSizeRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q (e.g. 500GB)", s)
+	}
+	n, _ := strconv.ParseFloat(m[1], 64)
+	base := 1000.0
+	if m[3] != "" {
+		base = 1024
+	}
+	exp := strings.Index("KMGTP", strings.ToUpper(m[2])) + 1
+	if m[2] == "" {
+		exp = 0
+	}
+	return int64(n * math.Pow(base, float64(exp))), nil
+}
+
+// formatBytes formats n with a decimal unit, the inverse of parseBytes.
+func formatBytes(n int64) string {
+	f := float64(n)
+	for _, unit := range []string{"B", "KB", "MB", "GB", "TB"} {
+		if f < 1000 || unit == "TB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", n)
+			}
+			return fmt.Sprintf("%.1f %s", f, unit)
+		}
+		f /= 1000
+	}
+	return ""
+}
+
+// validateQuotas checks the quotas of the tunnel and the forwards.
+func validateQuotas(c *Config) error {
+	check := func(what string, quota Size, action string) error {
+		if quota < 0 {
+			return fmt.Errorf("%s: invalid quota %s", what, quota)
+		}
+		if action != "" && action != "pause" && action != "alert" {
+			return fmt.Errorf("%s: invalid quota action %q (pause or alert)", what, action)
+		}
+		return nil
+	}
+	if err := check("quota", c.Quota.Total, c.Quota.Action); err != nil {
+		return err
+	}
+	if c.Quota.ResetDay < 1 || c.Quota.ResetDay > 28 {
+		return fmt.Errorf("invalid quota.reset_day: %d (1..28)", c.Quota.ResetDay)
+	}
+	for _, f := range c.TCPForwards {
+		if err := check("tcp forward "+f.Name, f.Quota, f.QuotaAction); err != nil {
+			return err
+		}
+	}
+	for _, u := range c.UDPForwards {
+		if err := check("udp forward "+u.Name, u.Quota, u.QuotaAction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quotaPeriod returns the first day of the quota period now falls in.
+func quotaPeriod(now time.Time, resetDay int) string {
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start.Format("2006-01-02")
+}
+
+// quota is a limit and what happens when it is exceeded.
+type quota struct {
+	limit int64 // 0: none
+	pause bool
+}
+
+func newQuota(limit Size, action string) quota {
+	return quota{limit: int64(limit), pause: action != "alert"}
+}
+
+// forwardQuotas returns the quota of every forward of cfg.
+func forwardQuotas(cfg *Config) map[string]quota {
+	m := make(map[string]quota)
+	for _, f := range cfg.TCPForwards {
+		m[f.Name] = newQuota(f.Quota, f.QuotaAction)
+	}
+	for _, u := range cfg.UDPForwards {
+		m[u.Name] = newQuota(u.Quota, u.QuotaAction)
+	}
+	return m
+}
+
+// quotaLevel is how far a quota is used up.
+type quotaLevel int
+
+const (
+	quotaOK quotaLevel = iota
+	quotaWarn
+	quotaExceeded
+)
+
+func (q quota) level(used int64) quotaLevel {
+	switch {
+	case q.limit == 0 || used < q.limit*9/10:
+		return quotaOK
+	case used < q.limit:
+		return quotaWarn
+	}
+	return quotaExceeded
+}
+
+// watchQuotas accounts the transfer of the relays into the state file and
+// pauses or resumes forwards as their quotas demand.
+func watchQuotas(ctx context.Context, d *daemon) {
+	seen := make(map[*relay]int64)          // counters at the last check
+	reported := make(map[string]quotaLevel) // by forward, "" for the tunnel
+	var period string
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for tick := 1; ; tick++ {
+		select {
+		case <-ctx.Done():
+			d.st.saveOrLog()
+			return
+		case <-ticker.C:
+		}
+		cfg := d.config()
+		relays := d.relaySnapshot()
+		deltas := make(map[string]int64)
+		current := make(map[*relay]int64, len(relays))
+		for name, r := range relays {
+			n := r.stats.bytesIn.Load() + r.stats.bytesOut.Load()
+			current[r] = n
+			if n > seen[r] {
+				deltas[name] = n - seen[r]
+			}
+		}
+		seen = current
+		p := quotaPeriod(time.Now(), cfg.Quota.ResetDay)
+		if p != period {
+			if period != "" {
+				logEvent(levelInfo, "", "quota-reset", "New quota period from %s", p)
+			}
+			period = p
+			clear(reported)
+		}
+		usage := d.st.addUsage(p, deltas)
+		if tick%quotaSaveEvery == 0 {
+			d.st.saveOrLog()
+		}
+
+		total := newQuota(cfg.Quota.Total, cfg.Quota.Action)
+		totalLevel := total.level(usage.Total)
+		reportQuota(reported, "", totalLevel, usage.Total, total)
+		for name, q := range forwardQuotas(cfg) {
+			used := usage.Forwards[name]
+			level := q.level(used)
+			reportQuota(reported, name, level, used, q)
+			r := relays[name]
+			if r == nil {
+				continue
+			}
+			pause := (level == quotaExceeded && q.pause) || (totalLevel == quotaExceeded && total.pause)
+			if pause && !r.quotaPaused.Swap(true) {
+				n := r.resetConns()
+				logEvent(levelWarn, name, "quota-paused", "Forward paused for the rest of the quota period; reset %d socket(s)", n)
+			} else if !pause && r.quotaPaused.Swap(false) {
+				logEvent(levelInfo, name, "quota-resumed", "Forward resumed")
+			}
+		}
+	}
+}
+
+// reportQuota logs when the quota of forward ("" for the tunnel) reaches a
+// new level, once per level and period.
+func reportQuota(reported map[string]quotaLevel, forward string, level quotaLevel, used int64, q quota) {
+	if level == reported[forward] {
+		return
+	}
+	prev := reported[forward]
+	reported[forward] = level
+	what := "Tunnel"
+	if forward != "" {
+		what = "Forward"
+	}
+	switch {
+	case level == quotaWarn && prev < quotaWarn:
+		logEvent(levelWarn, forward, "quota-warning", "%s used %s of its %s monthly quota", what, formatBytes(used), formatBytes(q.limit))
+	case level == quotaExceeded:
+		logEvent(levelError, forward, "quota-exceeded", "%s exceeded its %s monthly quota (%s used)", what, formatBytes(q.limit), formatBytes(used))
+	}
+}
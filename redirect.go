@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A TCP forward serving HTTPS on remote_port, with remote_tls or through
+// the local service, usually wants plain HTTP on another port, 80, to send
+// browsers there. With http_redirect_port the agent on the VPS answers
+// every request on that port with a redirect to the same host and path on
+// remote_port over https, so nothing else has to run on the VPS. With
+// http_redirect_webroot it serves /.well-known/acme-challenge/ from that
+// directory instead of redirecting it, so that certbot --webroot can renew
+// the certificate of remote_tls_cert while the agent holds the port.
+
+// acmeChallengePath is where ACME HTTP-01 challenges are fetched.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// validateRedirects checks the http_redirect settings of the TCP forwards.
+func validateRedirects(c *Config) error {
+	used := make(map[int]string)
+	for _, f := range c.TCPForwards {
+		used[f.RemotePort] = "the remote_port of " + f.Name
+		if f.RemoteTLS {
+			used[f.RemoteTLSPort] = "the remote_tls_port of " + f.Name
+		}
+	}
+	for _, u := range c.UDPForwards {
+		used[u.WrapTCPPort] = "the wrap_tcp_port of " + u.Name
+	}
+	if c.TURN.Enabled {
+		used[c.TURN.TunnelPort] = "turn.tunnel_port"
+	}
+	if c.TUN.Enabled {
+		used[c.TUN.TunnelPort] = "tun.tunnel_port"
+	}
+	for _, f := range c.TCPForwards {
+		if f.HTTPRedirectPort == 0 {
+			continue
+		}
+		switch {
+		case !isPort(f.HTTPRedirectPort):
+			return fmt.Errorf("%s: invalid http_redirect_port: %d", f.Name, f.HTTPRedirectPort)
+		case !f.onVPS():
+			return fmt.Errorf("%s: http_redirect_port needs the forward on the VPS", f.Name)
+		case f.RemotePort == 0:
+			return fmt.Errorf("%s: http_redirect_port needs a fixed remote_port", f.Name)
+		case used[f.HTTPRedirectPort] != "":
+			return fmt.Errorf("%s: http_redirect_port %d is %s", f.Name, f.HTTPRedirectPort, used[f.HTTPRedirectPort])
+		case f.HTTPRedirectWebroot != "" && !path.IsAbs(f.HTTPRedirectWebroot):
+			return fmt.Errorf("%s: http_redirect_webroot must be an absolute path", f.Name)
+		}
+		used[f.HTTPRedirectPort] = "the http_redirect_port of " + f.Name
+	}
+	return nil
+}
+
+// redirectScript returns the start functions of the redirecting agents of
+// cfg and their modes.
+func redirectScript(cfg *Config) (string, []string) {
+	var b strings.Builder
+	var modes []string
+	for _, f := range cfg.TCPForwards {
+		if f.HTTPRedirectPort == 0 || !f.onVPS() {
+			continue
+		}
+		p := f.HTTPRedirectPort
+		mode := fmt.Sprintf("redirect%d", p)
+		b.WriteString(fmt.Sprintf(`start_%s(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, mode, p))
+		b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent redirect -listen %d -to %d -host %s`, p, f.RemotePort, shellQuote(cfg.VPS.Host)))
+		if f.HTTPRedirectWebroot != "" {
+			b.WriteString(" -webroot " + shellQuote(f.HTTPRedirectWebroot))
+		}
+		b.WriteString(fmt.Sprintf(` %s & P_%s="$!"; }; start_%s; `, remoteLog(cfg, fmt.Sprintf("tut-agent-redirect-%d.log", p)), strings.ToUpper(mode), mode))
+		modes = append(modes, mode)
+	}
+	return b.String(), modes
+}
+
+// runAgentRedirect implements "tut agent redirect": it redirects every
+// HTTP request to https on another port.
+func runAgentRedirect(args []string) int {
+	fs := flag.NewFlagSet("agent redirect", flag.ExitOnError)
+	listen := fs.Int("listen", 80, "HTTP port")
+	to := fs.Int("to", 443, "HTTPS port to redirect to")
+	host := fs.String("host", "", "Host to redirect requests without a Host header to")
+	webroot := fs.String("webroot", "", "Directory to serve "+acmeChallengePath+" from")
+	_ = fs.Parse(args)
+	if !isPort(*listen) || !isPort(*to) || *host == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent redirect -listen 80 -to 443 -host name [-webroot dir]")
+		return 2
+	}
+	mux := http.NewServeMux()
+	if *webroot != "" {
+		mux.Handle(acmeChallengePath, http.FileServer(http.Dir(*webroot)))
+	}
+	mux.Handle("/", httpsRedirect(*to, *host))
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", *listen),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	logf("Redirecting HTTP on port %d to HTTPS on port %d", *listen, *to)
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", srv.ListenAndServe())
+	return 1
+}
+
+// httpsRedirect answers with a redirect to the same host and path over
+// https on port to: 301 for GET and HEAD, 308 for other methods so that
+// clients repeat them with their body.
+func httpsRedirect(to int, fallbackHost string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			host = fallbackHost
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6 literal
+		}
+		if to != 443 {
+			host += ":" + strconv.Itoa(to)
+		}
+		code := http.StatusMovedPermanently
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), code)
+	})
+}
+
+// redirectUsed reports whether a forward of cfg has the agent redirect
+// HTTP to it.
+func redirectUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if f.HTTPRedirectPort != 0 && f.onVPS() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// endpoint is the public address of a forward on the VPS.
+type endpoint struct {
+	name    string
+	proto   string // "tcp" or "udp"
+	host    string
+	port    int  // 0 until the VPS assigned one
+	healthy bool // session up and the forward passed its last probe
+
+	directHost   string // public address of a verified router mapping, if any
+	directPort   int
+	preferDirect bool // advertise the direct path instead of the VPS
+}
+
+// endpoints returns the public endpoint of every forward.
+func (d *daemon) endpoints() []endpoint {
+	cfg, relays, up := d.config(), d.relaySnapshot(), d.sessionUp.Load()
+	healthy := func(name string) bool {
+		r, ok := relays[name]
+		return up && (!ok || r.stats.healthy())
+	}
+	var out []endpoint
+	for _, f := range cfg.TCPForwards {
+		port := f.RemotePort
+		if l, ok := d.st.lease(f.Name); ok && port == 0 {
+			port = l.Port
+		}
+		out = append(out, endpoint{name: f.Name, proto: "tcp", host: cfg.VPS.Host, port: port, healthy: healthy(f.Name)})
+	}
+	for _, u := range cfg.UDPForwards {
+		_, gaveUp := d.wrappers.sup.restarts(u.Name)
+		out = append(out, endpoint{name: u.Name, proto: "udp", host: cfg.VPS.Host, port: u.UDPPublicPort, healthy: healthy(u.Name) && !gaveUp})
+	}
+	for i := range out {
+		out[i].directHost, out[i].directPort = d.direct.lookup(out[i].name)
+		out[i].preferDirect = cfg.Direct.Prefer
+	}
+	return out
+}
+
+// registry publishes endpoints to a service discovery system.
+type registry interface {
+	sync(ctx context.Context, eps []endpoint) error
+	close(ctx context.Context)
+}
+
+// runRegistry keeps the configured registries in sync with the forwards
+// and their health until ctx is cancelled, then withdraws the endpoints.
+func runRegistry(ctx context.Context, d *daemon) {
+	rc := d.config().Registry
+	ttl := rc.TTL.D()
+	var regs []registry
+	if rc.Consul.Address != "" {
+		regs = append(regs, &consulRegistry{cfg: rc, ttl: ttl, registered: map[string]endpoint{}})
+	}
+	if rc.Etcd.Address != "" {
+		regs = append(regs, &etcdRegistry{cfg: rc, ttl: ttl, written: map[string]endpoint{}})
+	}
+	if len(regs) == 0 {
+		return
+	}
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		eps := d.endpoints()
+		for _, r := range regs {
+			if err := r.sync(ctx, eps); err != nil && ctx.Err() == nil {
+				logEvent(levelWarn, "", "registry-failed", "Service registration failed: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			done, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			for _, r := range regs {
+				r.close(done)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// registryRequest sends a JSON request and fails on non-2xx responses.
+func registryRequest(ctx context.Context, method, url string, header http.Header, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// consulRegistry registers every forward as a Consul service with a TTL
+// check that tut passes while the forward is healthy.
+type consulRegistry struct {
+	cfg        RegistryConfig
+	ttl        time.Duration
+	registered map[string]endpoint // by service ID
+}
+
+func (c *consulRegistry) url(path string) string {
+	return strings.TrimSuffix(c.cfg.Consul.Address, "/") + path
+}
+
+func (c *consulRegistry) header() http.Header {
+	h := http.Header{}
+	if c.cfg.Consul.Token != "" {
+		h.Set("X-Consul-Token", c.cfg.Consul.Token)
+	}
+	return h
+}
+
+func (c *consulRegistry) sync(ctx context.Context, eps []endpoint) error {
+	seen := map[string]bool{}
+	for _, ep := range eps {
+		if ep.port == 0 {
+			continue
+		}
+		id := "tut-" + ep.name
+		seen[id] = true
+		host, port := ep.public()
+		if old, ok := c.registered[id]; !ok || old.host != ep.host || old.port != ep.port || old.directPort != ep.directPort || old.directHost != ep.directHost {
+			meta := map[string]string{"proto": ep.proto}
+			if ep.directPort != 0 {
+				meta["direct"] = net.JoinHostPort(ep.directHost, strconv.Itoa(ep.directPort))
+			}
+			svc := map[string]any{
+				"ID":      id,
+				"Name":    ep.name,
+				"Address": host,
+				"Port":    port,
+				"Tags":    append(append([]string{}, c.cfg.Consul.Tags...), ep.proto),
+				"Meta":    meta,
+				"Check": map[string]any{
+					"CheckID":                        id,
+					"Name":                           "tut forward " + ep.name,
+					"TTL":                            c.ttl.String(),
+					"DeregisterCriticalServiceAfter": (10 * c.ttl).String(),
+				},
+			}
+			if err := registryRequest(ctx, http.MethodPut, c.url("/v1/agent/service/register"), c.header(), svc, nil); err != nil {
+				return err
+			}
+			logEvent(levelInfo, ep.name, "registered", "Registered %s:%d/%s in Consul", host, port, ep.proto)
+		}
+		c.registered[id] = ep
+		status, output := "passing", "forward healthy"
+		if !ep.healthy {
+			status, output = "critical", "tunnel down or probe failed"
+		}
+		update := map[string]string{"Status": status, "Output": output}
+		if err := registryRequest(ctx, http.MethodPut, c.url("/v1/agent/check/update/"+id), c.header(), update, nil); err != nil {
+			return err
+		}
+	}
+	for id, ep := range c.registered {
+		if seen[id] {
+			continue
+		}
+		if err := registryRequest(ctx, http.MethodPut, c.url("/v1/agent/service/deregister/"+id), c.header(), nil, nil); err != nil {
+			return err
+		}
+		delete(c.registered, id)
+		logEvent(levelInfo, ep.name, "deregistered", "Removed from Consul")
+	}
+	return nil
+}
+
+func (c *consulRegistry) close(ctx context.Context) {
+	for id := range c.registered {
+		_ = registryRequest(ctx, http.MethodPut, c.url("/v1/agent/service/deregister/"+id), c.header(), nil, nil)
+	}
+}
+
+// etcdRegistry writes healthy endpoints as JSON under a key prefix, bound to
+// a lease that tut keeps alive, through the etcd v3 JSON gateway. Keys of
+// unhealthy forwards are removed; all keys expire when tut stops.
+type etcdRegistry struct {
+	cfg     RegistryConfig
+	ttl     time.Duration
+	lease   string
+	written map[string]endpoint // by key
+}
+
+func (e *etcdRegistry) url(path string) string {
+	return strings.TrimSuffix(e.cfg.Etcd.Address, "/") + path
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// keepAlive refreshes the lease, granting a new one when it expired. It
+// reports whether the keys have to be written again.
+func (e *etcdRegistry) keepAlive(ctx context.Context) (bool, error) {
+	if e.lease != "" {
+		var ka struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := registryRequest(ctx, http.MethodPost, e.url("/v3/lease/keepalive"), nil, map[string]string{"ID": e.lease}, &ka)
+		if err == nil && ka.Result.TTL != "" && ka.Result.TTL != "0" {
+			return false, nil
+		}
+	}
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := registryRequest(ctx, http.MethodPost, e.url("/v3/lease/grant"), nil, map[string]any{"TTL": int(e.ttl.Seconds())}, &grant); err != nil {
+		return false, err
+	}
+	e.lease = grant.ID
+	e.written = map[string]endpoint{}
+	return true, nil
+}
+
+func (e *etcdRegistry) sync(ctx context.Context, eps []endpoint) error {
+	if _, err := e.keepAlive(ctx); err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, ep := range eps {
+		if ep.port == 0 || !ep.healthy {
+			continue
+		}
+		key := e.cfg.Etcd.Prefix + ep.name
+		seen[key] = true
+		if old, ok := e.written[key]; ok && old == ep {
+			continue
+		}
+		host, port := ep.public()
+		v := map[string]any{"host": host, "port": port, "proto": ep.proto}
+		if ep.directPort != 0 {
+			v["direct"] = net.JoinHostPort(ep.directHost, strconv.Itoa(ep.directPort))
+		}
+		value, _ := json.Marshal(v)
+		put := map[string]string{"key": b64(key), "value": b64(string(value)), "lease": e.lease}
+		if err := registryRequest(ctx, http.MethodPost, e.url("/v3/kv/put"), nil, put, nil); err != nil {
+			return err
+		}
+		e.written[key] = ep
+	}
+	for key := range e.written {
+		if seen[key] {
+			continue
+		}
+		if err := registryRequest(ctx, http.MethodPost, e.url("/v3/kv/deleterange"), nil, map[string]string{"key": b64(key)}, nil); err != nil {
+			return err
+		}
+		delete(e.written, key)
+	}
+	return nil
+}
+
+func (e *etcdRegistry) close(ctx context.Context) {
+	if e.lease != "" {
+		_ = registryRequest(ctx, http.MethodPost, e.url("/v3/lease/revoke"), nil, map[string]string{"ID": e.lease}, nil)
+	}
+}
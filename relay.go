@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardStats holds the traffic counters of a single forward.
+// All fields are updated atomically by the relay goroutines.
+type forwardStats struct {
+	bytesIn      atomic.Int64 // bytes received from the tunnel
+	bytesOut     atomic.Int64 // bytes sent back into the tunnel
+	active       atomic.Int64 // currently open connections
+	accepted     atomic.Int64 // connections accepted since start
+	lastActivity atomic.Int64 // monoNow of the last transferred byte
+	probeFailed  atomic.Int64 // monoNow of the last failed probe, 0 after a good one
+	publicFailed atomic.Int64 // monoNow of the last failed check from the VPS, see publiccheck.go
+}
+
+// healthy reports whether the forward works as far as tut can tell: its
+// last probe and public port check did not fail, or traffic flowed again
+// since.
+func (s *forwardStats) healthy() bool {
+	failed := max(s.probeFailed.Load(), s.publicFailed.Load())
+	return failed == 0 || s.lastActivity.Load() > failed
+}
+
+// relay is an in-process TCP proxy that sits between the SSH reverse forward
+// and the real target, so traffic of each forward can be accounted for.
+type relay struct {
+	name  string
+	ln    net.Listener
+	stats forwardStats
+	opts  atomic.Pointer[relayOptions]
+	// paused relays refuse connections: over quota (see quota.go) or held
+	// through the API until resumed
+	quotaPaused atomic.Bool
+	held        atomic.Bool
+	trace       atomic.Pointer[forwardTrace] // see trace.go
+
+	mu     sync.Mutex
+	target string
+	conns  map[net.Conn]struct{}
+}
+
+// relayOptions are the per-forward settings of a relay.
+type relayOptions struct {
+	class       int      // priority class, see qos.go
+	readBuffer  int      // bytes per read and SO_RCVBUF, 0: defaults
+	chunk       int      // bytes per read when readBuffer is 0 (memory.relay_buffer)
+	writeBuffer int      // SO_SNDBUF, 0: system default
+	splice      bool     // zero-copy relaying where supported
+	errorPage   []byte   // served to HTTP clients the target cannot take, see errorpage.go
+	compress    []string // media types to gzip, see compress.go
+	accessLog   *accessLog
+	logFormat   string // of accessLog: combined or common
+	forwarded   bool   // X-Forwarded-For comes from the HTTP proxy on the VPS
+	proxyHeader bool   // connections start with a PROXY header, see clientaddr.go
+}
+
+// startRelay listens on an ephemeral loopback port, or on the socket systemd
+// passed for the forward, and proxies every accepted connection to target.
+func startRelay(name, target string) (*relay, error) {
+	ln, ok := activated.listener(name)
+	if !ok {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return nil, fmt.Errorf("relay %s: %w", name, err)
+		}
+	}
+	r := &relay{
+		name:   name,
+		target: target,
+		ln:     ln,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	r.opts.Store(&relayOptions{class: priorityNormal})
+	goGuarded(r.serve)
+	return r, nil
+}
+
+// port returns the loopback port the relay is listening on.
+func (r *relay) port() int {
+	return r.ln.Addr().(*net.TCPAddr).Port
+}
+
+// paused reports whether the relay refuses connections.
+func (r *relay) paused() bool {
+	return r.quotaPaused.Load() || r.held.Load()
+}
+
+// setTarget points new connections at target; open ones are left alone.
+func (r *relay) setTarget(target string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.target = target
+}
+
+func (r *relay) currentTarget() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.target
+}
+
+// serve accepts connections until the listener is closed.
+func (r *relay) serve() {
+	for {
+		c, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.accept(c)
+	}
+}
+
+// accept counts c and relays it in the background unless the relay is
+// paused or the connection limit is reached.
+func (r *relay) accept(c net.Conn) {
+	r.stats.accepted.Add(1)
+	if page := r.opts.Load().errorPage; page != nil && r.paused() {
+		go serveErrorPage(c, http.StatusServiceUnavailable, page)
+		return
+	}
+	if r.paused() || !totalConns.acquire(r.name) {
+		_ = c.Close()
+		return
+	}
+	go func() {
+		defer crashGuard()
+		defer totalConns.release()
+		r.handle(c)
+	}()
+}
+
+// handle proxies a single connection to the relay target.
+func (r *relay) handle(in net.Conn) {
+	target := r.currentTarget()
+	opts := r.opts.Load()
+	// through the tunnel every connection comes from loopback; the client
+	// is what the agent on the VPS tells, if anything
+	client := in.RemoteAddr()
+	if cc, ok := in.(*clientConn); ok {
+		in, client = cc.Conn, cc.client
+	} else if opts.proxyHeader {
+		var err error
+		if client, err = readProxyV2(in); err != nil {
+			logEvent(levelWarn, r.name, "", "client address: %v", err)
+			_ = in.Close()
+			return
+		}
+	}
+	switch action, to := (policyConn{forward: r.name, client: client, connections: r.stats.active.Load(), now: time.Now()}).decide(); action {
+	case "deny":
+		logEvent(levelInfo, r.name, "", "policy denied connection from %s", client)
+		_ = in.Close()
+		return
+	case "route":
+		target = to
+	}
+	if !plugins.allow(r.name, client.String()) {
+		_ = in.Close()
+		return
+	}
+	if opts.compress != nil || opts.accessLog != nil {
+		r.serveHTTP(&clientConn{Conn: in, client: client}, target, opts)
+		return
+	}
+	out, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		logEvent(levelWarn, r.name, "dial-failed", "dial %s failed: %v", target, err)
+		if opts.errorPage != nil {
+			serveErrorPage(in, http.StatusBadGateway, opts.errorPage)
+			return
+		}
+		_ = in.Close()
+		return
+	}
+	for _, c := range []net.Conn{in, out} {
+		if tc, ok := c.(*net.TCPConn); ok {
+			if opts.readBuffer > 0 {
+				_ = tc.SetReadBuffer(opts.readBuffer)
+			}
+			if opts.writeBuffer > 0 {
+				_ = tc.SetWriteBuffer(opts.writeBuffer)
+			}
+		}
+	}
+	r.track(in, out)
+	r.stats.active.Add(1)
+	start := time.Now()
+	ct := connTrace{id: traceConnIDs.Add(1), start: start, client: client, server: out.RemoteAddr()}
+	var sentIn, sentOut int64
+	if t := r.activeTrace(); t != nil {
+		t.opened(ct)
+	}
+	if events.active() {
+		events.publish(apiEvent{Type: "conn-open", Forward: r.name, Data: map[string]any{"remote": client.String()}})
+	}
+	defer func() {
+		if events.active() {
+			events.publish(apiEvent{Type: "conn-close", Forward: r.name, Data: map[string]any{
+				"remote":      client.String(),
+				"duration_ms": time.Since(start).Milliseconds(),
+				"bytes_in":    sentIn,
+				"bytes_out":   sentOut,
+			}})
+		}
+		if t := r.activeTrace(); t != nil {
+			t.closed(ct, sentIn, sentOut)
+		}
+		r.stats.active.Add(-1)
+		r.untrack(in, out)
+		_ = in.Close()
+		_ = out.Close()
+	}()
+
+	done := make(chan struct{}, 2)
+	goGuarded(func() {
+		sentIn = r.pipe(out, in, &r.stats.bytesIn, &qosDown, opts, ct.towards("->"))
+		done <- struct{}{}
+	})
+	goGuarded(func() {
+		sentOut = r.pipe(in, out, &r.stats.bytesOut, &qosUp, opts, ct.towards("<-"))
+		done <- struct{}{}
+	})
+	<-done
+	<-done
+}
+
+// connTrace identifies a connection, or one direction of it, in traces.
+type connTrace struct {
+	id             int64
+	start          time.Time
+	client, server net.Addr
+	dir            string // "->" from the tunnel to the service, "<-" back
+}
+
+// towards returns ct for the direction dir.
+func (ct connTrace) towards(dir string) connTrace {
+	ct.dir = dir
+	return ct
+}
+
+// pipe copies src to dst, accounting the transferred bytes in counter and
+// pacing them on link, and half-closes dst once src is exhausted. It returns
+// the number of bytes copied.
+func (r *relay) pipe(dst, src net.Conn, counter *atomic.Int64, link *qosLink, opts *relayOptions, ct connTrace) int64 {
+	size := opts.readBuffer
+	if size <= 0 {
+		size = opts.chunk
+	}
+	if size <= 0 {
+		size = 32 * 1024
+	}
+	var total int64
+	if opts.splice && spliceSupported && !link.enabled() && r.trace.Load() == nil {
+		total = r.splice(dst, src, counter, size)
+	} else {
+		buf := make([]byte, size)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				total += int64(n)
+				counter.Add(int64(n))
+				r.stats.lastActivity.Store(monoNow())
+				if t := r.activeTrace(); t != nil {
+					t.chunk(ct, buf[:n])
+				}
+				if werr := qosWrite(link, opts.class, dst, buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if t := r.activeTrace(); t != nil {
+		t.eof(ct)
+	}
+	if tc, ok := dst.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+	return total
+}
+
+func (r *relay) track(conns ...net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range conns {
+		r.conns[c] = struct{}{}
+	}
+}
+
+func (r *relay) untrack(conns ...net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range conns {
+		delete(r.conns, c)
+	}
+}
+
+// resetConns closes every open connection of the relay so that clients
+// reconnect through a fresh path. It returns the number of closed sockets.
+func (r *relay) resetConns() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.conns)
+	for c := range r.conns {
+		_ = c.Close()
+	}
+	return n
+}
+
+// stopAccepting closes the listener but leaves open connections alone.
+func (r *relay) stopAccepting() {
+	_ = r.ln.Close()
+}
+
+// close stops accepting new connections and drops the open ones.
+func (r *relay) close() {
+	_ = r.ln.Close()
+	r.resetConns()
+	r.setTrace(nil, "the forward was closed")
+}
+
+// startRelays starts one relay per configured forward, keyed by forward name.
+// TCP forwards are relayed to their local service, UDP forwards to the local
+// socat wrapper listening on the wrap port.
+func startRelays(cfg *Config) (map[string]*relay, error) {
+	relays := make(map[string]*relay)
+	closeAll := func() {
+		for _, r := range relays {
+			r.close()
+		}
+	}
+	for _, f := range cfg.TCPForwards {
+		r, err := startRelay(f.Name, tcpTarget(f))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		relays[f.Name] = r
+	}
+	for _, u := range cfg.UDPForwards {
+		r, err := startRelay(u.Name, udpTarget(u))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		relays[u.Name] = r
+	}
+	configureRelays(cfg, relays)
+	return relays, nil
+}
+
+// configureRelays applies the QoS link rates and the per-forward settings
+// of cfg; open connections keep the settings they started with.
+func configureRelays(cfg *Config, relays map[string]*relay) {
+	qosUp.setRate(cfg.QoS.Upload)
+	qosDown.setRate(cfg.QoS.Download)
+	totalConns.max.Store(int64(cfg.MaxTotalConnections))
+	if rules, err := compilePolicy(cfg.Policy); err == nil {
+		connPolicy.Store(&rules)
+	}
+	for _, f := range cfg.TCPForwards {
+		if r, ok := relays[f.Name]; ok {
+			class, _ := priorityClass(f.Priority)
+			r.opts.Store(&relayOptions{class: class, readBuffer: f.ReadBuffer.Int(), writeBuffer: f.WriteBuffer.Int(), splice: f.Splice,
+				chunk: cfg.Memory.RelayBuffer.Int(), errorPage: readErrorPage(f), compress: compressTypes(f),
+				accessLog: openAccessLog(f), logFormat: f.AccessLogFormat, forwarded: f.HTTPProxyPort != 0,
+				proxyHeader: f.ClientAddressPort != 0})
+		}
+	}
+	for _, u := range cfg.UDPForwards {
+		if r, ok := relays[u.Name]; ok {
+			class, _ := priorityClass(u.Priority)
+			r.opts.Store(&relayOptions{class: class, chunk: cfg.Memory.RelayBuffer.Int()})
+		}
+	}
+}
+
+// tcpTarget is the address a TCP forward relays to.
+func tcpTarget(f TCPForward) string {
+	return net.JoinHostPort(f.LocalHost, strconv.Itoa(f.LocalPort))
+}
+
+// udpTarget is the address a UDP forward relays to: its local socat wrapper.
+func udpTarget(u UDPForward) string {
+	return fmt.Sprintf("127.0.0.1:%d", u.WrapTCPPort)
+}
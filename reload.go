@@ -0,0 +1,640 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Effects describe how a reload applies a configuration change.
+const (
+	effectLive    = "applied live"
+	effectForward = "remote forward updated in place"
+	effectWrapper = "UDP wrapper restarted"
+	effectSession = "SSH session restarted"
+	effectProcess = "requires restarting tut"
+)
+
+// configChange is a single difference between two configurations.
+type configChange struct {
+	op     string // "+", "-" or "~"
+	path   string // yaml path, e.g. vps.host or tcp_forwards[web].local_port
+	old    string
+	new    string
+	effect string
+}
+
+// String renders the change in a diff-like, human readable form.
+func (c configChange) String() string {
+	switch c.op {
+	case "+":
+		return fmt.Sprintf("+ %s: %s", c.path, c.new)
+	case "-":
+		return fmt.Sprintf("- %s: %s", c.path, c.old)
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", c.path, c.old, c.new)
+}
+
+// diffConfigs lists every difference between old and cur. Lists of named
+// entries (the forwards) are matched by name so that reordering them is not
+// reported as a change.
+func diffConfigs(old, cur *Config) []configChange {
+	var out []configChange
+	diffValues("", reflect.ValueOf(*old), reflect.ValueOf(*cur), &out)
+	for i := range out {
+		out[i].effect = agentForwardEffect(old, cur, out[i], changeEffect(out[i]))
+	}
+	return out
+}
+
+// diffValues appends the differences between the structs a and b to out.
+func diffValues(prefix string, a, b reflect.Value, out *[]configChange) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		path := prefix + name
+		fa, fb := a.Field(i), b.Field(i)
+		switch {
+		case fa.Kind() == reflect.Struct:
+			diffValues(path+".", fa, fb, out)
+		case fa.Kind() == reflect.Slice && hasNameField(fa.Type().Elem()):
+			diffNamed(path, fa, fb, out)
+		case !reflect.DeepEqual(fa.Interface(), fb.Interface()):
+			*out = append(*out, configChange{op: "~", path: path, old: formatValue(fa), new: formatValue(fb)})
+		}
+	}
+}
+
+// diffNamed compares two slices of structs carrying a Name field.
+func diffNamed(path string, a, b reflect.Value, out *[]configChange) {
+	before, after := byName(a), byName(b)
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ea, inOld := before[name]
+		eb, inNew := after[name]
+		entry := fmt.Sprintf("%s[%s]", path, name)
+		switch {
+		case !inOld:
+			*out = append(*out, configChange{op: "+", path: entry, new: formatEntry(eb)})
+		case !inNew:
+			*out = append(*out, configChange{op: "-", path: entry, old: formatEntry(ea)})
+		default:
+			diffValues(entry+".", ea, eb, out)
+		}
+	}
+}
+
+// byName indexes a slice of structs by their Name field.
+func byName(s reflect.Value) map[string]reflect.Value {
+	m := make(map[string]reflect.Value, s.Len())
+	for i := 0; i < s.Len(); i++ {
+		e := s.Index(i)
+		m[e.FieldByName("Name").String()] = e
+	}
+	return m
+}
+
+func hasNameField(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	f, ok := t.FieldByName("Name")
+	return ok && f.Type.Kind() == reflect.String
+}
+
+// yamlName returns the yaml key of a struct field, or "" if it is not serialized.
+func yamlName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if tag == "-" || !f.IsExported() {
+		return ""
+	}
+	if tag == "" {
+		return strings.ToLower(f.Name)
+	}
+	return tag
+}
+
+// formatValue renders a scalar config value.
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// formatEntry renders a named list entry as "key=value" pairs.
+func formatEntry(v reflect.Value) string {
+	t := v.Type()
+	var parts []string
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		if name == "" || name == "name" || v.Field(i).IsZero() {
+			continue
+		}
+		parts = append(parts, name+"="+formatValue(v.Field(i)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// changeEffect classifies how a reload applies c.
+func changeEffect(c configChange) string {
+	field := c.path[strings.LastIndex(c.path, ".")+1:]
+	switch {
+	case field == "dns_srv" || field == "minecraft_srv" || field == "priority" || field == "read_buffer" ||
+		field == "write_buffer" || field == "splice" || field == "quota" || field == "quota_action" ||
+		c.path == "memory.relay_buffer":
+		return effectLive
+	case field == "hole_punch":
+		// the punchers are set up at startup
+		return effectProcess
+	case c.path == "vps.transport" || strings.HasPrefix(c.path, "vps.tailscale_"):
+		// the tailnet listener is set up at startup
+		return effectProcess
+	case strings.HasPrefix(c.path, "vps.") || strings.HasPrefix(c.path, "remote.") || strings.HasPrefix(c.path, "host_routing."):
+		return effectSession
+	case c.path == "state_file" || c.path == "run_as" || c.path == "termux" || c.path == "profile" ||
+		c.path == "runtime_dir" || c.path == "crash_dir" || c.path == "udp_bridge" || c.path == "roaming" ||
+		c.path == "memory.limit" || c.path == "memory.history" || strings.HasPrefix(c.path, "statsd.") ||
+		strings.HasPrefix(c.path, "log.") || strings.HasPrefix(c.path, "docker.") || strings.HasPrefix(c.path, "kubernetes.") ||
+		strings.HasPrefix(c.path, "registry.") || strings.HasPrefix(c.path, "dns.") || strings.HasPrefix(c.path, "direct.") ||
+		strings.HasPrefix(c.path, "stun_servers") || strings.HasPrefix(c.path, "turn.") || strings.HasPrefix(c.path, "tun.") || strings.HasPrefix(c.path, "cloudflare_tunnel.") || strings.HasPrefix(c.path, "agent.") ||
+		strings.HasPrefix(c.path, "api.") || strings.HasPrefix(c.path, "ngrok_api.") || strings.HasPrefix(c.path, "dbus.") || strings.HasPrefix(c.path, "plugins") ||
+		strings.HasPrefix(c.path, "mirrors") || strings.HasPrefix(c.path, "ha."):
+		return effectProcess
+	case strings.HasPrefix(c.path, "tcp_forwards["):
+		if c.op != "~" || field == "remote_port" || field == "session" || field == "expose" {
+			return effectForward
+		}
+		return effectLive
+	case strings.HasPrefix(c.path, "udp_forwards["):
+		if c.op != "~" || field == "udp_public_port" || field == "wrap_tcp_port" || field == "protocol" || field == "qps_limit" ||
+			field == "remote_bind" || field == "framing" || field == "client_address" || field == "integrity_check" {
+			return effectSession
+		}
+		return effectWrapper
+	}
+	return effectLive
+}
+
+// watchReloads reloads the configuration whenever SIGHUP is received.
+func (d *daemon) watchReloads(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			d.reload()
+		}
+	}
+}
+
+// reload re-reads the config file and applies only what changed. An invalid
+// config is rejected and the running configuration is kept.
+func (d *daemon) reload() {
+	reopenAccessLogs()
+	cfg, err := d.loadForReload()
+	if err != nil {
+		logEvent(levelError, "", "reload-rejected", "Config reload rejected: %v", err)
+		return
+	}
+	d.applyBase(cfg, "Config reload")
+}
+
+// loadForReload reads the config file the daemon runs with and checks it.
+func (d *daemon) loadForReload() (*Config, error) {
+	cfg, err := loadConfig(d.configPath)
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if err == nil {
+		err = checkPrivilegedPorts(cfg)
+	}
+	return cfg, err
+}
+
+// applyBase makes cfg the loaded configuration and applies it.
+func (d *daemon) applyBase(cfg *Config, reason string) {
+	d.applyMu.Lock()
+	defer d.applyMu.Unlock()
+	d.mu.Lock()
+	d.base = cfg
+	d.mu.Unlock()
+	d.update(reason)
+	publishConfigLoaded(cfg)
+}
+
+// setDynamic replaces the forwards discovered by source (e.g. "docker") and
+// applies them like a reload.
+func (d *daemon) setDynamic(source string, fwds []TCPForward) {
+	d.applyMu.Lock()
+	defer d.applyMu.Unlock()
+	d.mu.Lock()
+	if d.dynamic == nil {
+		d.dynamic = make(map[string][]TCPForward)
+	}
+	d.dynamic[source] = fwds
+	d.mu.Unlock()
+	d.update(source + " discovery")
+}
+
+// update applies the loaded configuration plus the discovered forwards.
+func (d *daemon) update(reason string) {
+	old, cfg := d.config(), d.effectiveConfig()
+	changes := diffConfigs(old, cfg)
+	if len(changes) == 0 {
+		logf("%s: no changes", reason)
+		return
+	}
+	logEvent(levelInfo, "", "reload", "%s: %d change(s)", reason, len(changes))
+	for _, c := range changes {
+		logf("  %s (%s)", c, c.effect)
+	}
+	d.apply(old, cfg, changes)
+}
+
+// effectiveConfig merges the discovered forwards into the loaded
+// configuration. Forwards clashing with a configured name or public port
+// are skipped.
+func (d *daemon) effectiveConfig() *Config {
+	d.mu.Lock()
+	base := d.base
+	sources := make([]string, 0, len(d.dynamic))
+	for s := range d.dynamic {
+		sources = append(sources, s)
+	}
+	sort.Strings(sources)
+	var found []TCPForward
+	for _, s := range sources {
+		found = append(found, d.dynamic[s]...)
+	}
+	d.mu.Unlock()
+
+	cfg := *base
+	cfg.TCPForwards = append([]TCPForward(nil), base.TCPForwards...)
+	names, ports := make(map[string]bool), make(map[int]bool)
+	for _, f := range base.TCPForwards {
+		names[f.Name] = true
+		ports[f.RemotePort] = true
+	}
+	for _, u := range base.UDPForwards {
+		names[u.Name] = true
+		ports[u.WrapTCPPort] = true
+	}
+	for _, f := range found {
+		if names[f.Name] || f.RemotePort != 0 && ports[f.RemotePort] {
+			logEvent(levelWarn, f.Name, "discovery-conflict", "Ignoring discovered forward: name or remote_port %d already in use", f.RemotePort)
+			continue
+		}
+		names[f.Name] = true
+		ports[f.RemotePort] = true
+		cfg.TCPForwards = append(cfg.TCPForwards, f)
+	}
+	return &cfg
+}
+
+// apply moves the daemon from old to cfg. Relays and UDP wrappers are only
+// touched for forwards that changed; remote TCP forwards are added and
+// cancelled over the SSH control socket, and the SSH session is only
+// restarted when nothing less disruptive can apply the change.
+func (d *daemon) apply(old, cfg *Config, changes []configChange) {
+	needSession := false
+	for _, c := range changes {
+		if c.effect == effectSession {
+			needSession = true
+		}
+	}
+
+	relays := d.relaySnapshot()
+	oldTCP, newTCP := tcpByName(old), tcpByName(cfg)
+	oldUDP, newUDP := udpByName(old), udpByName(cfg)
+	var cancels, adds []string // remote forward specs to change in place
+
+	for name, f := range oldTCP {
+		n, keep := newTCP[name]
+		r := relays[name]
+		// the other sessions are restarted by syncSessions below
+		inMain := sessionOf(old, f) == 0 && f.onVPS()
+		if !keep {
+			if inMain {
+				cancels = append(cancels, tcpForwardSpec(d.st.withLeases(old), f, r))
+			}
+			r.close()
+			delete(relays, name)
+			continue
+		}
+		if n.RemotePort != f.RemotePort || sessionOf(cfg, n) != sessionOf(old, f) || n.onVPS() != f.onVPS() {
+			if inMain {
+				cancels = append(cancels, tcpForwardSpec(d.st.withLeases(old), f, r))
+			}
+			if sessionOf(cfg, n) == 0 && n.onVPS() {
+				adds = append(adds, name)
+			}
+		}
+		if n.LocalHost != f.LocalHost || n.LocalPort != f.LocalPort {
+			r.setTarget(tcpTarget(n))
+		}
+	}
+	for name, f := range newTCP {
+		if _, ok := oldTCP[name]; ok {
+			continue
+		}
+		r, err := startRelay(name, tcpTarget(f))
+		if err != nil {
+			logEvent(levelError, name, "reload-failed", "%v", err)
+			continue
+		}
+		relays[name] = r
+		if sessionOf(cfg, f) == 0 && f.onVPS() {
+			adds = append(adds, name)
+		}
+	}
+
+	for name := range oldUDP {
+		if _, keep := newUDP[name]; !keep {
+			d.wrappers.remove(name)
+			relays[name].close()
+			delete(relays, name)
+		}
+	}
+	for name, u := range newUDP {
+		o, existed := oldUDP[name]
+		if existed && sameLocalWrapper(o, u) {
+			continue
+		}
+		if err := d.wrappers.replace(u); err != nil {
+			logEvent(levelError, name, "reload-failed", "%v", err)
+		}
+		if existed {
+			relays[name].setTarget(udpTarget(u))
+			continue
+		}
+		r, err := startRelay(name, udpTarget(u))
+		if err != nil {
+			logEvent(levelError, name, "reload-failed", "%v", err)
+			continue
+		}
+		relays[name] = r
+	}
+
+	if cfg.VPS.Transport == "tailscale" && len(cancels)+len(adds) > 0 {
+		// the agent listens on the remote ports, see tailscale.go
+		needSession = true
+		cancels, adds = nil, nil
+	}
+	configureRelays(cfg, relays)
+
+	d.mu.Lock()
+	d.cfg = cfg
+	d.relays = relays
+	d.mu.Unlock()
+	d.syncSessions()
+	d.cloudflare.update(cfg)
+
+	if !needSession {
+		leased := d.st.withLeases(cfg)
+		for _, spec := range cancels {
+			if err := sshControl(cfg, "cancel", spec); err != nil {
+				logEvent(levelWarn, "", "reload-failed", "Cancelling remote forward %s failed: %v", spec, err)
+				needSession = true
+			}
+		}
+		for _, name := range adds {
+			f := newTCP[name]
+			out, err := sshControlOutput(cfg, "forward", tcpForwardSpec(leased, f, relays[name]))
+			if err != nil {
+				logEvent(levelWarn, name, "reload-failed", "adding remote forward failed: %v", err)
+				needSession = true
+				continue
+			}
+			if port, err := strconv.Atoi(strings.TrimSpace(out)); err == nil && f.RemotePort == 0 {
+				logEvent(levelInfo, name, "port-assigned", "VPS assigned public port %d", port)
+				d.st.setLease(name, "tcp", port)
+				f.RemotePort = port
+			}
+			publishForwardUp(f)
+		}
+	}
+	if needSession {
+		logf("Restarting SSH session to apply config")
+		d.restartSession()
+		return
+	}
+	d.st.markGood(cfg)
+	d.st.saveOrLog()
+	logf("Config reload applied without restarting the SSH session")
+}
+
+func tcpByName(c *Config) map[string]TCPForward {
+	m := make(map[string]TCPForward, len(c.TCPForwards))
+	for _, f := range c.TCPForwards {
+		m[f.Name] = f
+	}
+	return m
+}
+
+// sameLocalWrapper reports whether the UDP forwards o and u run the same
+// local wrapper.
+func sameLocalWrapper(o, u UDPForward) bool {
+	return o.LocalHost == u.LocalHost && o.LocalUDPPort == u.LocalUDPPort && o.WrapTCPPort == u.WrapTCPPort &&
+		o.Protocol == u.Protocol && o.Framing == u.Framing && o.ClientAddress == u.ClientAddress &&
+		o.IntegrityCheck == u.IntegrityCheck && o.Interface == u.Interface
+}
+
+func udpByName(c *Config) map[string]UDPForward {
+	m := make(map[string]UDPForward, len(c.UDPForwards))
+	for _, u := range c.UDPForwards {
+		m[u.Name] = u
+	}
+	return m
+}
+
+// tcpForwardSpec returns the ssh -R specification of the TCP forward f as
+// found in cfg (which should carry the leased ports).
+func tcpForwardSpec(cfg *Config, f TCPForward, r *relay) string {
+	for _, g := range cfg.TCPForwards {
+		if g.Name == f.Name {
+			f = g
+		}
+	}
+	bind := fmt.Sprintf("0.0.0.0:%d", f.RemotePort)
+	if f.HTTPProxyPort != 0 {
+		// behind the HTTP proxy of the agent, see httpproxy.go
+		bind = fmt.Sprintf("127.0.0.1:%d", f.HTTPProxyPort)
+	} else if f.RemoteTLS {
+		// the agent takes the public port, see remotetls.go
+		bind = fmt.Sprintf("127.0.0.1:%d", f.RemoteTLSPort)
+	} else if f.ErrorPagePort != 0 {
+		// the agent takes the public port, see errorpage.go
+		bind = fmt.Sprintf("127.0.0.1:%d", f.ErrorPagePort)
+	} else if f.ClientAddressPort != 0 {
+		// the agent takes the public port, see clientaddr.go
+		bind = fmt.Sprintf("127.0.0.1:%d", f.ClientAddressPort)
+	} else if hostRouted(cfg, f.Name) {
+		// only reached through the agent routing by name, see hostroute.go
+		bind = fmt.Sprintf("127.0.0.1:%d", f.RemotePort)
+	}
+	if r != nil {
+		return fmt.Sprintf("%s:127.0.0.1:%d", bind, r.port())
+	}
+	return fmt.Sprintf("%s:%s:%d", bind, f.LocalHost, f.LocalPort)
+}
+
+// sshControl sends a control command (forward or cancel) for the remote
+// forward spec to the running SSH master.
+func sshControl(cfg *Config, op, spec string) error {
+	_, err := sshControlOutput(cfg, op, spec)
+	return err
+}
+
+// sshControlOutput is sshControl returning what ssh printed on stdout, which
+// for a forward with remote port 0 is the port the VPS allocated.
+func sshControlOutput(cfg *Config, op, spec string) (string, error) {
+	return sshControlAt(cfg, controlPath(), op, spec)
+}
+
+// sshControlAt is sshControlOutput for the SSH master on the control socket
+// ctl.
+func sshControlAt(cfg *Config, ctl, op, spec string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("control sockets are not supported on %s", runtime.GOOS)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	target := fmt.Sprintf("%s@%s", cfg.VPS.User, cfg.VPS.Host)
+	cmd := sshExec(ctx, cfg, "-o", "ControlPath="+ctl, "-O", op, "-R", spec, target)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// runConfigCommand implements the "tut config" subcommands.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: tut config validate|diff|migrate|example [-config path]")
+		return 2
+	}
+	switch args[0] {
+	case "validate":
+		return configValidate(args[1:])
+	case "example":
+		return configExampleCommand(args[1:])
+	case "diff":
+		return configDiff(args[1:])
+	case "migrate":
+		return runConfigMigrate(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown config subcommand: %s\n", args[0])
+	return 2
+}
+
+// configValidate checks the config file the way tut does when it starts,
+// without connecting anywhere.
+func configValidate(args []string) int {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if jsonOutput() {
+		res := struct {
+			Valid       bool     `json:"valid"`
+			Path        string   `json:"path"`
+			Errors      []string `json:"errors"`
+			Version     int      `json:"version,omitempty"` // of the file, before migrations
+			TCPForwards int      `json:"tcp_forwards"`
+			UDPForwards int      `json:"udp_forwards"`
+		}{Valid: err == nil, Path: *configPath, Errors: []string{}}
+		if err != nil {
+			res.Errors = strings.Split(err.Error(), "\n")
+		} else {
+			res.Version, res.TCPForwards, res.UDPForwards = cfg.fileVersion, len(cfg.TCPForwards), len(cfg.UDPForwards)
+		}
+		printJSON(res)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+	} else {
+		fmt.Printf("%s is valid (%d TCP, %d UDP forwards)\n", *configPath, len(cfg.TCPForwards), len(cfg.UDPForwards))
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// configDiff previews what a reload would change by comparing the config
+// file with the configuration last applied by the daemon (from the state file).
+func configDiff(args []string) int {
+	fs := flag.NewFlagSet("config diff", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		die("Invalid config: %v", err)
+	}
+	old, at, ok := openState(cfg.StateFile).lastGood()
+	if jsonOutput() {
+		res := struct {
+			AppliedAt *time.Time    `json:"applied_at"` // null: nothing applied yet, everything changes
+			Changes   []applyChange `json:"changes"`
+		}{Changes: []applyChange{}}
+		if ok {
+			res.AppliedAt = &at
+			for _, c := range diffConfigs(old, cfg) {
+				res.Changes = append(res.Changes, applyChange{Op: c.op, Path: c.path, Old: c.old, New: c.new, Effect: c.effect})
+			}
+		}
+		printJSON(res)
+		return 0
+	}
+	if !ok {
+		fmt.Printf("No applied configuration recorded in %s; a reload would apply everything.\n", cfg.StateFile)
+		return 0
+	}
+	changes := diffConfigs(old, cfg)
+	if len(changes) == 0 {
+		fmt.Println("No changes.")
+		return 0
+	}
+	fmt.Printf("Changes against the configuration applied at %s:\n", at.Format(time.RFC3339))
+	for _, c := range changes {
+		fmt.Printf("  %s (%s)\n", c, c.effect)
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// remoteCommandTimeout bounds each of remote.pre_commands,
+// remote.post_commands and remote.provision_commands as a whole.
+const remoteCommandTimeout = time.Minute
+
+// runRemoteCommands runs commands on the VPS one after another, each in an
+// SSH connection of its own, and logs their output and errors line by
+// line. Like the resource limits, a failing command is logged and does not
+// keep the tunnel from coming up.
+func runRemoteCommands(ctx context.Context, cfg *Config, stage string, commands []string) {
+	if len(commands) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteCommandTimeout)
+	defer cancel()
+	for _, c := range commands {
+		if err := runRemoteCommand(ctx, cfg, stage, c); err != nil {
+			logEvent(levelWarn, "", "remote-command-failed", "%s-command %q failed: %v", stage, c, err)
+		}
+	}
+}
+
+// runRemoteCommand runs one command on the VPS in an SSH connection of its
+// own and logs its output line by line.
+func runRemoteCommand(ctx context.Context, cfg *Config, stage, command string) error {
+	out, err := sshExec(ctx, cfg, append(sshCommandArgs(cfg), command)...).CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			logEvent(levelInfo, "", "remote-command", "%s-command %q: %s", stage, command, line)
+		}
+	}
+	return err
+}
+
+// runPostCommands runs remote.post_commands once a session has ended,
+// unless it was handed over to an upgraded process. The session context is
+// usually cancelled by then, so the commands get a context of their own.
+func (d *daemon) runPostCommands(cfg *Config) {
+	if d.handedOff.Load() {
+		return
+	}
+	runRemoteCommands(context.Background(), cfg, "post", cfg.Remote.PostCommands)
+}
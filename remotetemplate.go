@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// remote.script_template replaces the script tut runs on the VPS with one
+// rendered from a Go text/template, for site-specific socat options,
+// logging or SELinux contexts. The template sees remoteScriptData and can
+// embed the script tut would run as {{.Default}}, e.g. to wrap it:
+//
+//	runcon -t tut_t sh -c {{quote .Default}}
+//
+// An empty result runs no remote command at all, like a TCP-only tunnel.
+
+// remoteScriptData is what a remote script template is executed with.
+type remoteScriptData struct {
+	Config      *Config
+	TCPForwards []TCPForward
+	UDPForwards []UDPForward
+	Default     string // the script tut generates, see buildRemoteScript
+}
+
+// remoteScriptFuncs are the functions available to remote script templates.
+var remoteScriptFuncs = template.FuncMap{
+	"quote": shellQuote,
+	"join":  strings.Join,
+}
+
+// remoteScript returns the script to run on the VPS: the rendered template
+// when remote.script_template is set, otherwise the generated one.
+func remoteScript(cfg *Config) (string, error) {
+	def := buildRemoteScript(cfg)
+	if cfg.Remote.ScriptTemplate == "" {
+		return def, nil
+	}
+	text, err := os.ReadFile(cfg.Remote.ScriptTemplate)
+	if err != nil {
+		return "", fmt.Errorf("remote.script_template: %w", err)
+	}
+	tmpl, err := template.New("remote").Funcs(remoteScriptFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", fmt.Errorf("remote.script_template: %w", err)
+	}
+	var b strings.Builder
+	data := remoteScriptData{Config: cfg, TCPForwards: cfg.TCPForwards, UDPForwards: cfg.UDPForwards, Default: def}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("remote.script_template: %w", err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A TCP forward with remote_tls: true presents TLS on its public port for
+// clients that insist on it, while the local service keeps speaking
+// plaintext. The remote forward then binds remote_tls_port on the
+// loopback interface of the VPS, and the agent listens on remote_port,
+// terminates TLS and relays the plaintext to it. The certificate is
+// managed by the agent: the files remote_tls_cert and remote_tls_key on the
+// VPS, e.g. from certbot, are loaded again whenever they change; without
+// them the agent makes a self-signed certificate for remote_tls_hostnames
+// and replaces it a month before it expires.
+
+// remoteTLSRenew is how long before its expiry a self-signed certificate
+// is replaced.
+const remoteTLSRenew = 30 * 24 * time.Hour
+
+// remoteTLSVersions are the values of remote_tls_min_version.
+var remoteTLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validateRemoteTLS checks the remote_tls settings of the TCP forwards.
+func validateRemoteTLS(c *Config) error {
+	used := make(map[int]string)
+	for _, f := range c.TCPForwards {
+		used[f.RemotePort] = "the remote_port of " + f.Name
+	}
+	for _, u := range c.UDPForwards {
+		used[u.WrapTCPPort] = "the wrap_tcp_port of " + u.Name
+	}
+	if c.TURN.Enabled {
+		used[c.TURN.TunnelPort] = "turn.tunnel_port"
+	}
+	if c.TUN.Enabled {
+		used[c.TUN.TunnelPort] = "tun.tunnel_port"
+	}
+	for _, f := range c.TCPForwards {
+		if !f.RemoteTLS {
+			continue
+		}
+		switch {
+		case !f.onVPS():
+			return fmt.Errorf("%s: remote_tls needs the forward on the VPS", f.Name)
+		case c.VPS.Transport == "tailscale":
+			return fmt.Errorf("%s: remote_tls does not apply to vps.transport: tailscale", f.Name)
+		case f.RemotePort == 0:
+			return fmt.Errorf("%s: remote_tls needs a fixed remote_port", f.Name)
+		case !isPort(f.RemoteTLSPort):
+			return fmt.Errorf("%s: remote_tls needs a remote_tls_port", f.Name)
+		case used[f.RemoteTLSPort] != "":
+			return fmt.Errorf("%s: remote_tls_port %d is %s", f.Name, f.RemoteTLSPort, used[f.RemoteTLSPort])
+		case (f.RemoteTLSCert == "") != (f.RemoteTLSKey == ""):
+			return fmt.Errorf("%s: remote_tls_cert and remote_tls_key go together", f.Name)
+		case remoteTLSVersions[f.RemoteTLSMinVersion] == 0:
+			return fmt.Errorf("%s: invalid remote_tls_min_version: %q (1.0, 1.1, 1.2 or 1.3)", f.Name, f.RemoteTLSMinVersion)
+		}
+		used[f.RemoteTLSPort] = "the remote_tls_port of " + f.Name
+		for _, h := range f.RemoteTLSHostnames {
+			if h == "" || strings.ContainsAny(h, " ,/") {
+				return fmt.Errorf("%s: invalid remote_tls_hostnames entry %q", f.Name, h)
+			}
+		}
+	}
+	return nil
+}
+
+// remoteTLSScript returns the start functions of the TLS agents of cfg and
+// their modes.
+func remoteTLSScript(cfg *Config) (string, []string) {
+	var b strings.Builder
+	var modes []string
+	for i, f := range cfg.TCPForwards {
+		if !f.RemoteTLS || !f.onVPS() {
+			continue
+		}
+		hosts := f.RemoteTLSHostnames
+		if len(hosts) == 0 {
+			hosts = []string{cfg.VPS.Host}
+		}
+		mode := fmt.Sprintf("tls%d", i)
+		b.WriteString(fmt.Sprintf(`start_%s(){ if command -v fuser >/dev/null 2>&1; then fuser -k %d/tcp 2>/dev/null || true; fi; `, mode, f.RemotePort))
+		b.WriteString(fmt.Sprintf(`"$AGENT_BIN" agent tls -listen %d -connect 127.0.0.1:%d -min-version %s -hosts %s -state "$AGENT_DIR"/%s`,
+			f.RemotePort, f.RemoteTLSPort, f.RemoteTLSMinVersion, shellQuote(strings.Join(hosts, ",")), shellQuote("tls-"+f.Name+".pem")))
+		if f.RemoteTLSCert != "" {
+			b.WriteString(fmt.Sprintf(` -cert %s -key %s`, shellQuote(f.RemoteTLSCert), shellQuote(f.RemoteTLSKey)))
+		}
+		if errorPageOnVPS(f) {
+			b.WriteString(` -page "$AGENT_DIR"/` + shellQuote(errorPageFile(f.Name)))
+		}
+		b.WriteString(fmt.Sprintf(` %s & P_%s="$!"; }; start_%s; `, remoteLog(cfg, fmt.Sprintf("tut-agent-tls-%d.log", f.RemotePort)), strings.ToUpper(mode), mode))
+		modes = append(modes, mode)
+	}
+	return b.String(), modes
+}
+
+// remoteTLSUsed reports whether a forward of cfg terminates TLS on the VPS.
+func remoteTLSUsed(cfg *Config) bool {
+	for _, f := range cfg.TCPForwards {
+		if f.RemoteTLS && f.onVPS() {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsCertStore hands out the certificate of the agent, loading the files
+// again when they change and renewing the self-signed one in time.
+type tlsCertStore struct {
+	certFile, keyFile string   // given certificate, if any
+	state             string   // file of the self-signed certificate
+	hosts             []string // names of the self-signed certificate
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	loaded  time.Time // modification time of the loaded files
+	checked time.Time
+}
+
+// get returns the current certificate; it is checked at most once a
+// minute.
+func (s *tlsCertStore) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cert != nil && time.Since(s.checked) < time.Minute {
+		return s.cert, nil
+	}
+	s.checked = time.Now()
+	if err := s.refresh(); err != nil {
+		if s.cert == nil {
+			return nil, err
+		}
+		logf("Keeping the current certificate: %v", err)
+	}
+	return s.cert, nil
+}
+
+// refresh loads or makes the certificate when the current one is missing,
+// outdated or about to expire.
+func (s *tlsCertStore) refresh() error {
+	if s.certFile != "" {
+		ci, err := os.Stat(s.certFile)
+		if err != nil {
+			return err
+		}
+		ki, err := os.Stat(s.keyFile)
+		if err != nil {
+			return err
+		}
+		mod := ci.ModTime()
+		if ki.ModTime().After(mod) {
+			mod = ki.ModTime()
+		}
+		if s.cert != nil && !mod.After(s.loaded) {
+			return nil
+		}
+		c, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return err
+		}
+		s.cert, s.loaded = &c, mod
+		logf("Loaded the certificate %s", s.certFile)
+		return nil
+	}
+	if s.cert == nil {
+		if data, err := os.ReadFile(s.state); err == nil {
+			if c, err := tls.X509KeyPair(data, data); err == nil {
+				s.cert = &c
+			}
+		}
+	}
+	if s.cert != nil && s.current() {
+		return nil
+	}
+	c, pemData, err := selfSignedCert(s.hosts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.state, pemData, 0o600); err != nil {
+		logf("Cannot keep the certificate in %s: %v", s.state, err)
+	}
+	s.cert = c
+	logf("Made a self-signed certificate for %s", strings.Join(s.hosts, ", "))
+	return nil
+}
+
+// current reports whether the self-signed certificate is for the hosts and
+// not about to expire.
+func (s *tlsCertStore) current() bool {
+	leaf, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil || time.Until(leaf.NotAfter) < remoteTLSRenew {
+		return false
+	}
+	var names []string
+	names = append(names, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	want := slices.Clone(s.hosts)
+	slices.Sort(names)
+	slices.Sort(want)
+	return slices.Equal(names, want)
+}
+
+// selfSignedCert makes a certificate for hosts valid for a year, with an
+// RSA key since old clients know nothing else. It also returns it and its
+// key as PEM.
+func selfSignedCert(hosts []string) (*tls.Certificate, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	c, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &c, data, nil
+}
+
+// runAgentTLS implements "tut agent tls": it terminates TLS on the public
+// port and relays the plaintext to the remote forward.
+func runAgentTLS(args []string) int {
+	fs := flag.NewFlagSet("agent tls", flag.ExitOnError)
+	listen := fs.Int("listen", 0, "Public TCP port")
+	connect := fs.String("connect", "", "Address of the remote forward")
+	certFile := fs.String("cert", "", "Certificate file (PEM), reloaded when it changes")
+	keyFile := fs.String("key", "", "Key file (PEM)")
+	hosts := fs.String("hosts", "", "Comma-separated names of the self-signed certificate")
+	state := fs.String("state", "", "File keeping the self-signed certificate")
+	minVersion := fs.String("min-version", "1.2", "Oldest TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	pageFile := fs.String("page", "", "HTML file served while the remote forward is down")
+	_ = fs.Parse(args)
+	version := remoteTLSVersions[*minVersion]
+	if !isPort(*listen) || *connect == "" || version == 0 || *certFile == "" && (*hosts == "" || *state == "") {
+		fmt.Fprintln(os.Stderr, "usage: tut agent tls -listen port -connect addr (-cert file -key file | -hosts names -state file) [-min-version 1.2]")
+		return 2
+	}
+	store := &tlsCertStore{certFile: *certFile, keyFile: *keyFile, state: *state, hosts: strings.Split(*hosts, ",")}
+	if _, err := store.get(nil); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	tc := &tls.Config{GetCertificate: store.get, MinVersion: version}
+	if version < tls.VersionTLS12 {
+		// the suites of old clients, which Go no longer offers by default
+		for _, s := range tls.CipherSuites() {
+			tc.CipherSuites = append(tc.CipherSuites, s.ID)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, tls.TLS_RSA_WITH_AES_128_CBC_SHA, tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_256_GCM_SHA384)
+	}
+	var page []byte
+	if *pageFile != "" {
+		var err error
+		if page, err = os.ReadFile(*pageFile); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *listen))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("Terminating TLS %s+ on port %d for %s", *minVersion, *listen, *connect)
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", tlsServe(ln, tc, *connect, page))
+	return 1
+}
+
+// tlsServe terminates TLS for every client of ln and connects it to addr,
+// or serves page while addr is down.
+func tlsServe(ln net.Listener, tc *tls.Config, addr string, page []byte) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			conn := tls.Server(c, tc)
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.Handshake(); err != nil {
+				var rec tls.RecordHeaderError
+				if errors.As(err, &rec) {
+					err = errors.New("not TLS")
+				}
+				logf("%s: handshake failed: %v", c.RemoteAddr(), err)
+				return
+			}
+			_ = conn.SetDeadline(time.Time{})
+			up, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			if err != nil {
+				logf("%s: %v", addr, err)
+				if page != nil {
+					serveErrorPage(conn, http.StatusServiceUnavailable, page)
+				}
+				return
+			}
+			defer up.Close()
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(up, conn)
+				closeWrite(up)
+				close(done)
+			}()
+			_, _ = io.Copy(conn, up)
+			closeWrite(conn)
+			<-done
+		}()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// When a laptop moves from Wi-Fi to a phone hotspot, the SSH connection is
+// bound to an address that no longer exists and only ssh keepalives would
+// notice, after up to three intervals. With roaming on, tut listens for
+// changes of the routing table and interfaces (netlink on Linux, a routing
+// socket on macOS and the BSDs, polling elsewhere) and reconnects at once
+// when the way to the VPS changed: another interface, local address or
+// default gateway.
+
+// roamSettle is how long a burst of network changes must be quiet before
+// the route is looked at; interfaces come up in several steps.
+const roamSettle = 2 * time.Second
+
+// watchRoaming reconnects the tunnel when the route to the VPS changes.
+func watchRoaming(ctx context.Context, d *daemon) {
+	if d.config().Roaming != "true" {
+		return
+	}
+	changes, err := networkChanges(ctx)
+	if err != nil {
+		logEvent(levelWarn, "", "", "Cannot watch for network changes: %v", err)
+		return
+	}
+	last := routeToVPS(d.config())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		}
+		// wait for the burst to settle
+		settle := time.NewTimer(roamSettle)
+	burst:
+		for {
+			select {
+			case <-ctx.Done():
+				settle.Stop()
+				return
+			case <-changes:
+				settle.Reset(roamSettle)
+			case <-settle.C:
+				break burst
+			}
+		}
+		cfg := d.config()
+		route := routeToVPS(cfg)
+		if route == last {
+			continue
+		}
+		was := last
+		last = route
+		if route == "" {
+			logEvent(levelWarn, "", "network-lost", "No route to %s since the network changed", cfg.VPS.Host)
+			continue
+		}
+		logEvent(levelInfo, "", "network-changed", "Route to %s changed from %s to %s; reconnecting", cfg.VPS.Host, orNone(was), route)
+		d.reconnectAll()
+	}
+}
+
+// vpsRoute is the way the system picks to the VPS.
+type vpsRoute struct {
+	iface   string // empty when unknown
+	local   net.IP
+	gateway net.IP // IPv4 default gateway, nil when unknown
+}
+
+func (r vpsRoute) String() string {
+	s := r.local.String()
+	if r.iface != "" {
+		s = r.iface + " " + s
+	}
+	if r.gateway != nil {
+		s += fmt.Sprintf(" via %s", r.gateway)
+	}
+	return s
+}
+
+// lookupRoute returns the interface and local address the system picks for
+// the VPS and the default gateway.
+func lookupRoute(cfg *Config) (vpsRoute, error) {
+	// connecting a UDP socket picks the route without sending anything
+	c, err := vpsDialer(cfg, "udp").Dial("udp", net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(sshPort(cfg))))
+	if err != nil {
+		return vpsRoute{}, err
+	}
+	r := vpsRoute{local: c.LocalAddr().(*net.UDPAddr).IP}
+	_ = c.Close()
+	r.iface = interfaceOf(r.local)
+	if gw, err := defaultGateway(); err == nil {
+		r.gateway = gw
+	}
+	return r, nil
+}
+
+// routeToVPS describes the route to the VPS, empty without one.
+func routeToVPS(cfg *Config) string {
+	r, err := lookupRoute(cfg)
+	if err != nil {
+		return ""
+	}
+	return r.String()
+}
+
+// interfaceOf returns the name of the interface that has ip.
+func interfaceOf(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// readChanges signals every message read from the kernel socket f until
+// ctx is cancelled. The messages themselves are not parsed: routeToVPS
+// tells whether they mattered.
+func readChanges(ctx context.Context, f *os.File) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 65536)
+		for {
+			if _, err := f.Read(buf); err != nil && !errors.Is(err, syscall.ENOBUFS) {
+				// ENOBUFS: messages were lost, which is a change as well
+				if ctx.Err() == nil {
+					logEvent(levelWarn, "", "", "Stopped watching for network changes: %v", err)
+				}
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Long-lived SSH sessions are a problem for some compliance rules and for
+// VPS-side leaks that grow with the session. vps.rekey_data and
+// vps.rekey_interval make ssh renegotiate its keys more often
+// (RekeyLimit). vps.max_age goes further and replaces each session
+// once it is that old: a new connection is opened next to it, the remote
+// forwards are moved over its control socket one by one, and the old
+// session is kept for max_age_overlap so that the connections it
+// carries can finish. The remote script of the main session is started in
+// the new connection once the old one is gone, so UDP forwards pause for
+// that moment.
+
+// rotateReadyTimeout bounds how long a new session may take to come up.
+const rotateReadyTimeout = 30 * time.Second
+
+// rotations numbers the connections opened by rotations, for their control
+// sockets.
+var rotations atomic.Int64
+
+// rekeyArgs returns the ssh options for vps.rekey_data and
+// vps.rekey_interval.
+func rekeyArgs(cfg *Config) []string {
+	if cfg.VPS.RekeyData == 0 && cfg.VPS.RekeyInterval == 0 {
+		return nil
+	}
+	data, interval := "default", "none"
+	if cfg.VPS.RekeyData > 0 {
+		data = strconv.FormatInt(int64(cfg.VPS.RekeyData), 10)
+	}
+	if cfg.VPS.RekeyInterval > 0 {
+		interval = strconv.Itoa(cfg.VPS.RekeyInterval.Seconds())
+	}
+	return []string{"-o", "RekeyLimit=" + data + " " + interval}
+}
+
+// sshSession is an SSH connection of the daemon.
+type sshSession struct {
+	cmd  *exec.Cmd
+	done <-chan error // receives the result of cmd.Wait
+	ctl  string       // its control socket
+}
+
+// rotation is what rotating an SSH session needs to know about it.
+type rotation struct {
+	name   string   // of the session in messages
+	main   bool     // the main session, see sshCommand
+	script string   // remote script of the main session
+	stderr *os.File // shared by all processes of the session
+	// forwards returns the remote forwards the session carries.
+	forwards func() []remoteForward
+	// switched is called once the forwards are moved to s.
+	switched func(s sshSession)
+}
+
+// sshCommand returns an ssh process that writes its notices to stderr and
+// is killed when ctx is cancelled. The main session is left running when
+// it was handed over to an upgraded process.
+func (d *daemon) sshCommand(ctx context.Context, main bool, args []string, stderr *os.File) *exec.Cmd {
+	cmd := sshExec(ctx, d.config(), args...)
+	if main {
+		cmd.Cancel = func() error {
+			// after an upgrade the session belongs to the new process
+			if d.handedOff.Load() {
+				return nil
+			}
+			return cmd.Process.Kill()
+		}
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	return cmd
+}
+
+// waitFor waits for cmd in the background.
+func waitFor(cmd *exec.Cmd) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	return done
+}
+
+// superviseSession waits for the session s to end and rotates it whenever
+// it reaches vps.max_age.
+func (d *daemon) superviseSession(ctx context.Context, cfg *Config, s sshSession, r rotation) error {
+	if cfg.VPS.MaxAge <= 0 {
+		return <-s.done
+	}
+	maxAge := cfg.VPS.MaxAge.D()
+	age := time.NewTimer(maxAge)
+	defer age.Stop()
+	for {
+		select {
+		case err := <-s.done:
+			return err
+		case <-age.C:
+			next, err := d.rotateSession(ctx, cfg, s, r)
+			if err != nil {
+				logEvent(levelWarn, "", "rotate-failed", "Cannot rotate %s: %v; reconnecting instead", r.name, err)
+				_ = s.cmd.Process.Kill()
+				return <-s.done
+			}
+			s = next
+			age.Reset(maxAge)
+		}
+	}
+}
+
+// rotateSession opens a new connection next to old, moves the remote
+// forwards of the session over to it and retires old in the background.
+func (d *daemon) rotateSession(ctx context.Context, cfg *Config, old sshSession, r rotation) (sshSession, error) {
+	if runtime.GOOS == "windows" {
+		return sshSession{}, fmt.Errorf("control sockets are not supported on %s", runtime.GOOS)
+	}
+	logEvent(levelInfo, "", "session-rotating", "%s reached its maximum age; opening a new connection", r.name)
+	base, target := sshBaseArgs(cfg)
+	ctl := newControlPath(fmt.Sprintf("r%d", rotations.Add(1)))
+	args := append(append([]string{}, base...), "-o", "ControlMaster=yes", "-o", "ControlPath="+ctl, "-N", target)
+	cmd := d.sshCommand(ctx, r.main, args, r.stderr)
+	if err := cmd.Start(); err != nil {
+		return sshSession{}, err
+	}
+	next := sshSession{cmd: cmd, done: waitFor(cmd), ctl: ctl}
+	if err := waitMaster(ctx, cfg, next); err != nil {
+		_ = cmd.Process.Kill()
+		return sshSession{}, err
+	}
+
+	d.applyMu.Lock()
+	err := d.moveForwards(cfg, old.ctl, next.ctl, r.forwards())
+	d.applyMu.Unlock()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return sshSession{}, err
+	}
+	r.switched(next)
+	logEvent(levelInfo, "", "session-rotated", "%s moved to a new connection (PID %d); the old one is closed in %s",
+		r.name, cmd.Process.Pid, cfg.VPS.MaxAgeOverlap)
+
+	go func() {
+		select {
+		case <-time.After(cfg.VPS.MaxAgeOverlap.D()):
+		case <-ctx.Done():
+		}
+		_ = old.cmd.Process.Kill()
+		<-old.done
+		// the remote script ended with the old connection
+		d.runScript(ctx, cfg, next, r)
+	}()
+	return next, nil
+}
+
+// runScript runs the remote script of r, if any, as a client of the SSH
+// master of s and ends s when the script ends.
+func (d *daemon) runScript(ctx context.Context, cfg *Config, s sshSession, r rotation) {
+	if r.script == "" || ctx.Err() != nil {
+		return
+	}
+	base, target := sshBaseArgs(cfg)
+	client := d.sshCommand(ctx, r.main, append(append([]string{}, base...), "-o", "ControlMaster=no", "-o", "ControlPath="+s.ctl, target, r.script), r.stderr)
+	err := client.Run()
+	if ctx.Err() == nil && !d.handedOff.Load() {
+		logEvent(levelWarn, "", "", "Remote script ended: %v", err)
+		_ = s.cmd.Process.Kill()
+	}
+}
+
+// waitMaster waits until the control socket of s accepts commands.
+func waitMaster(ctx context.Context, cfg *Config, s sshSession) error {
+	ctx, cancel := context.WithTimeout(ctx, rotateReadyTimeout)
+	defer cancel()
+	target := fmt.Sprintf("%s@%s", cfg.VPS.User, cfg.VPS.Host)
+	for {
+		check := sshExec(ctx, cfg, "-o", "ControlPath="+s.ctl, "-O", "check", target)
+		if check.Run() == nil {
+			return nil
+		}
+		select {
+		case err := <-s.done:
+			return fmt.Errorf("new connection ended: %v", err)
+		case <-ctx.Done():
+			return errors.New("new connection did not come up in time")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// moveForwards cancels fwds at the SSH master on from and requests them
+// from the one on to, one at a time so that each port is only closed for a
+// moment.
+func (d *daemon) moveForwards(cfg *Config, from, to string, fwds []remoteForward) error {
+	for _, f := range fwds {
+		if _, err := sshControlAt(cfg, from, "cancel", f.spec); err != nil {
+			return fmt.Errorf("cancelling %s: %w", f.spec, err)
+		}
+		out, err := sshControlAt(cfg, to, "forward", f.spec)
+		if err != nil {
+			return fmt.Errorf("forwarding %s: %w", f.spec, err)
+		}
+		if port, err := strconv.Atoi(strings.TrimSpace(out)); err == nil && f.name != "" {
+			logEvent(levelInfo, f.name, "port-assigned", "VPS assigned public port %d", port)
+			d.st.setLease(f.name, "tcp", port)
+			d.st.saveOrLog()
+		}
+	}
+	return nil
+}
+
+// sessionName names session k in messages.
+func sessionName(k int) string {
+	if k == 0 {
+		return "SSH tunnel"
+	}
+	return fmt.Sprintf("SSH session %d", k)
+}
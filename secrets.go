@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fleets keep the SSH key in a secret manager rather than in the image, and
+// name it with a credential: URI like the stores of credential.go:
+//
+//	credential:aws/<secret id or ARN>[#<key>]      AWS Secrets Manager
+//	credential:gcp/<project>/<secret>[/<version>]  GCP Secret Manager
+//	credential:vault/<path>[#<key>]                HashiCorp Vault (KV v1 or v2)
+//
+// The key is fetched once and kept in memory; when the VPS rejects it,
+// forgetCredential drops it so the next session fetches it again and picks
+// up a rotated key. Credentials for the managers come from where their own
+// tools take them: the AWS_* variables or the instance or task role, the
+// service account in GOOGLE_APPLICATION_CREDENTIALS or of the instance, and
+// VAULT_ADDR with VAULT_TOKEN or ~/.vault-token.
+
+// secretTimeout bounds fetching a secret, credentials included.
+const secretTimeout = 30 * time.Second
+
+// metadataClient talks to the instance metadata services, which are not
+// there at all off the cloud, so it gives up quickly.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+// secretCache holds the secrets fetched from a secret manager, by reference.
+var secretCache = struct {
+	sync.Mutex
+	secrets map[string][]byte
+}{secrets: map[string][]byte{}}
+
+// isSecretManager reports whether store is a secret manager rather than a
+// local credential store.
+func isSecretManager(store string) bool {
+	return store == "aws" || store == "gcp" || store == "vault"
+}
+
+// fetchSecret returns the secret name in the secret manager store,
+// fetching it unless it is cached already.
+func fetchSecret(ref, store, name string) ([]byte, error) {
+	secretCache.Lock()
+	defer secretCache.Unlock()
+	if b, ok := secretCache.secrets[ref]; ok {
+		return b, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	var b []byte
+	var err error
+	switch store {
+	case "aws":
+		b, err = awsSecret(ctx, name)
+	case "gcp":
+		b, err = gcpSecret(ctx, name)
+	case "vault":
+		b, err = vaultSecret(ctx, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+	secretCache.secrets[ref] = b
+	return b, nil
+}
+
+// forgetCredential drops what was fetched or written for the credential
+// ref, so the next use reads it from its store again.
+func forgetCredential(ref string) {
+	secretCache.Lock()
+	delete(secretCache.secrets, ref)
+	secretCache.Unlock()
+	keyFiles.Lock()
+	if path, ok := keyFiles.paths[ref]; ok {
+		_ = os.Remove(path)
+		delete(keyFiles.paths, ref)
+	}
+	keyFiles.Unlock()
+}
+
+// secretField returns the value of key in the JSON object of a secret; an
+// empty key picks the only value of an object with one.
+func secretField(obj map[string]any, key string) ([]byte, error) {
+	if key == "" {
+		if len(obj) != 1 {
+			names := make([]string, 0, len(obj))
+			for k := range obj {
+				names = append(names, k)
+			}
+			return nil, fmt.Errorf("secret has %d values (%s); name one with #<key>", len(obj), strings.Join(names, ", "))
+		}
+		for k := range obj {
+			key = k
+		}
+	}
+	v, ok := obj[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret has no string value %q", key)
+	}
+	return []byte(v), nil
+}
+
+// secretRequest sends req and decodes the JSON answer into out.
+func secretRequest(client *http.Client, req *http.Request, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// awsSecret fetches name, a secret id or ARN with an optional #key, from
+// AWS Secrets Manager.
+func awsSecret(ctx context.Context, name string) ([]byte, error) {
+	id, key, _ := strings.Cut(name, "#")
+	creds, err := awsCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AWS_REGION")
+	if arn := strings.Split(id, ":"); len(arn) > 3 && arn[0] == "arn" {
+		region = arn[3]
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		if region, err = imdsGet(ctx, "placement/region"); err != nil {
+			return nil, errors.New("no AWS region: set AWS_REGION or use the ARN of the secret")
+		}
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://secretsmanager."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+	signV4(req, body, creds.AccessKeyID, creds.SecretAccessKey, region, "secretsmanager", time.Now())
+	var out struct {
+		SecretString string
+		SecretBinary []byte
+	}
+	if err := secretRequest(http.DefaultClient, req, &out); err != nil {
+		return nil, err
+	}
+	if out.SecretString == "" {
+		return out.SecretBinary, nil
+	}
+	if key == "" {
+		return []byte(out.SecretString), nil
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(out.SecretString), &obj); err != nil {
+		return nil, fmt.Errorf("secret is not a JSON object, so it has no key %q", key)
+	}
+	return secretField(obj, key)
+}
+
+// awsCreds are AWS credentials as the metadata services return them.
+type awsCreds struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+}
+
+// awsCredentials takes the credentials from the AWS_* variables, or else
+// from the role of the ECS task or of the EC2 instance.
+func awsCredentials(ctx context.Context) (awsCreds, error) {
+	c := awsCreds{os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}
+	if c.AccessKeyID != "" && c.SecretAccessKey != "" {
+		return c, nil
+	}
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.170.2"+rel, nil)
+		if err != nil {
+			return c, err
+		}
+		err = secretRequest(metadataClient, req, &c)
+		return c, err
+	}
+	role, err := imdsGet(ctx, "iam/security-credentials/")
+	if err != nil {
+		return c, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or give the instance a role")
+	}
+	role, _, _ = strings.Cut(role, "\n")
+	b, err := imdsGet(ctx, "iam/security-credentials/"+role)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal([]byte(b), &c)
+	return c, err
+}
+
+// imdsGet reads path under latest/meta-data from the EC2 instance metadata
+// service, version 2.
+func imdsGet(ctx context.Context, path string) (string, error) {
+	const imds = "http://169.254.169.254/latest/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, imds+"api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadataText(req)
+	if err != nil {
+		return "", err
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, imds+"meta-data/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return metadataText(req)
+}
+
+// metadataText returns the body of a metadata service answer.
+func metadataText(req *http.Request) (string, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return strings.TrimSpace(string(b)), err
+}
+
+// gcpSecret fetches name, <project>/<secret>[/<version>], from GCP Secret
+// Manager; the version defaults to latest.
+func gcpSecret(ctx context.Context, name string) ([]byte, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) == 2 {
+		parts = append(parts, "latest")
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("expected credential:gcp/<project>/<secret>[/<version>]")
+	}
+	token, err := gcpToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("https://secretmanager.googleapis.com/v1/projects/%s/secrets/%s/versions/%s:access",
+		url.PathEscape(parts[0]), url.PathEscape(parts[1]), url.PathEscape(parts[2]))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var out struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := secretRequest(http.DefaultClient, req, &out); err != nil {
+		return nil, err
+	}
+	return out.Payload.Data, nil
+}
+
+// gcpToken returns an access token for the service account in the key file
+// GOOGLE_APPLICATION_CREDENTIALS names, or else for that of the instance.
+func gcpToken(ctx context.Context) (string, error) {
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		assertion, tokenURI, err := gcpAssertion(path)
+		if err != nil {
+			return "", err
+		}
+		form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		err = secretRequest(http.DefaultClient, req, &tok)
+		return tok.AccessToken, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if err := secretRequest(metadataClient, req, &tok); err != nil {
+		return "", errors.New("no GCP credentials: set GOOGLE_APPLICATION_CREDENTIALS or run with a service account")
+	}
+	return tok.AccessToken, nil
+}
+
+// gcpAssertion signs the JWT that trades the service account key in path
+// for an access token, and returns it with the token endpoint.
+func gcpAssertion(path string) (string, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &key); err != nil || key.Type != "service_account" {
+		return "", "", fmt.Errorf("%s is not a service account key", path)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", "", fmt.Errorf("%s: no private key", path)
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return "", "", fmt.Errorf("%s: not an RSA key", path)
+	}
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": key.ClientEmail, "aud": key.TokenURI, "iat": now, "exp": now + 600,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), key.TokenURI, nil
+}
+
+// vaultSecret fetches name, <path>[#<key>], from Vault. The path is the
+// one of the API: secret/data/tut for the tut secret of a KV version 2
+// engine mounted at secret.
+func vaultSecret(ctx context.Context, name string) ([]byte, error) {
+	path, key, _ := strings.Cut(name, "#")
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			b, _ := os.ReadFile(filepath.Join(home, ".vault-token"))
+			token = strings.TrimSpace(string(b))
+		}
+	}
+	if token == "" {
+		return nil, errors.New("no Vault token: set VAULT_TOKEN or log in with vault login")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	var out struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := secretRequest(http.DefaultClient, req, &out); err != nil {
+		return nil, err
+	}
+	data := out.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner // KV version 2
+	}
+	return secretField(data, key)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With vps.sessions above 1, the TCP forwards are spread across that many
+// SSH connections to the VPS. A single TCP connection caps throughput on
+// long fat networks, and a session that stalls only stalls its own
+// forwards. Session 0 is the main session: it carries the UDP forwards,
+// the remote script, the control socket and the remaining TCP forwards.
+// The other sessions only carry TCP forwards (ssh -N) and reconnect on
+// their own.
+
+// maxSessions bounds vps.sessions.
+const maxSessions = 16
+
+// sessionOf returns the index of the SSH session carrying the TCP forward
+// f: the one it is pinned to with session, otherwise one picked by its
+// name, so that forwards keep their session when others come and go.
+func sessionOf(cfg *Config, f TCPForward) int {
+	n := cfg.VPS.Sessions
+	if n <= 1 {
+		return 0
+	}
+	if f.Session > 0 {
+		return (f.Session - 1) % n
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name))
+	return int(h.Sum32() % uint32(n))
+}
+
+// mainSession returns a copy of cfg with only the TCP forwards of the main
+// session.
+func mainSession(cfg *Config) *Config {
+	c := *cfg
+	c.TCPForwards = nil
+	for _, f := range cfg.TCPForwards {
+		if sessionOf(cfg, f) == 0 {
+			c.TCPForwards = append(c.TCPForwards, f)
+		}
+	}
+	return &c
+}
+
+// remoteForward is one -R forward of an SSH session.
+type remoteForward struct {
+	name string // of the TCP forward; empty for the wrap and TURN ports
+	spec string
+}
+
+// sessionForwards returns the remote forwards session k carries for cfg,
+// which should carry the leased ports. The main session also carries the
+// wrap ports of the UDP forwards and the TURN and TUN ports.
+func sessionForwards(cfg *Config, relays map[string]*relay, k int) []remoteForward {
+	var fwds []remoteForward
+	for _, f := range cfg.TCPForwards {
+		// over tailscale the agent carries them, see tailscale.go
+		if sessionOf(cfg, f) == k && f.onVPS() && cfg.VPS.Transport != "tailscale" {
+			fwds = append(fwds, remoteForward{f.Name, tcpForwardSpec(cfg, f, relays[f.Name])})
+		}
+	}
+	if k != 0 {
+		return fwds
+	}
+	// UDP wrappers as TCP forwards
+	for _, u := range cfg.UDPForwards {
+		localPort := u.WrapTCPPort
+		if r, ok := relays[u.Name]; ok {
+			localPort = r.port()
+		}
+		fwds = append(fwds, remoteForward{"", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", u.WrapTCPPort, localPort)})
+	}
+	// The TURN agent reaches the local bridge on the same port
+	if cfg.TURN.Enabled {
+		fwds = append(fwds, remoteForward{"", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", cfg.TURN.TunnelPort, cfg.TURN.TunnelPort)})
+	}
+	// and so does the TUN agent
+	if cfg.TUN.Enabled {
+		fwds = append(fwds, remoteForward{"", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", cfg.TUN.TunnelPort, cfg.TUN.TunnelPort)})
+	}
+	return fwds
+}
+
+// extraSession is a running session other than the main one.
+type extraSession struct {
+	key    string // its forward specs, to tell whether a reload changes it
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// extraSessions runs the sessions other than the main one by their id.
+type extraSessions struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	running map[string]*extraSession
+}
+
+// forwardSession is an SSH session that only carries remote forwards: one
+// of vps.sessions besides the main one, or one to a mirror (see
+// mirrors.go).
+type forwardSession struct {
+	id   string // for its control socket
+	name string // in messages
+	// connect returns the configuration to connect with for cfg.
+	connect func(cfg *Config) *Config
+	// forwards returns the remote forwards the session carries for cfg.
+	forwards func(cfg *Config, relays map[string]*relay) []remoteForward
+	// up is told when the session is established and when it ends again.
+	up func(up bool)
+}
+
+// extraSession returns session k of vps.sessions.
+func (d *daemon) extraSession(k int) forwardSession {
+	return forwardSession{
+		id:      strconv.Itoa(k),
+		name:    sessionName(k),
+		connect: func(cfg *Config) *Config { return cfg },
+		forwards: func(cfg *Config, relays map[string]*relay) []remoteForward {
+			return sessionForwards(d.st.withLeases(cfg), relays, k)
+		},
+		up: func(up bool) {
+			if !up {
+				return
+			}
+			logEvent(levelInfo, "", "session-up", "SSH session %d established", k)
+			cfg := d.st.withLeases(d.config())
+			for _, f := range cfg.TCPForwards {
+				if sessionOf(cfg, f) == k && f.onVPS() {
+					publishForwardUp(f)
+				}
+			}
+		},
+	}
+}
+
+// syncSessions starts, restarts and stops the sessions other than the main
+// one so they match the configuration and relays in effect.
+func (d *daemon) syncSessions() {
+	x := d.extras
+	if x == nil || d.isStandby() {
+		return
+	}
+	cfg, relays := d.config(), d.relaySnapshot()
+	var wanted []forwardSession
+	for k := 1; k < cfg.VPS.Sessions; k++ {
+		wanted = append(wanted, d.extraSession(k))
+	}
+	wanted = append(wanted, d.mirrorSessions(cfg)...)
+	want := make(map[string]forwardSession)
+	keys := make(map[string]string)
+	for _, fs := range wanted {
+		var specs []string
+		for _, f := range fs.forwards(cfg, relays) {
+			specs = append(specs, f.spec)
+		}
+		if len(specs) > 0 {
+			want[fs.id] = fs
+			keys[fs.id] = strings.Join(specs, " ")
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.running == nil {
+		x.running = make(map[string]*extraSession)
+	}
+	for id, s := range x.running {
+		if keys[id] != s.key {
+			s.cancel()
+			<-s.done
+			delete(x.running, id)
+		}
+	}
+	for id, fs := range want {
+		if _, ok := x.running[id]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(x.ctx)
+		s := &extraSession{key: keys[id], cancel: cancel, done: make(chan struct{})}
+		x.running[id] = s
+		go func(fs forwardSession) {
+			defer close(s.done)
+			d.runForwardSession(ctx, fs)
+		}(fs)
+	}
+}
+
+// stop ends the extra sessions. After an upgrade they are not handed over:
+// the new process starts its own once the ports are free.
+func (x *extraSessions) stop() {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for id, s := range x.running {
+		s.cancel()
+		<-s.done
+		delete(x.running, id)
+	}
+}
+
+// runForwardSession keeps fs up until ctx is cancelled.
+func (d *daemon) runForwardSession(ctx context.Context, fs forwardSession) {
+	for {
+		err := d.forwardSessionOnce(ctx, fs)
+		if ctx.Err() != nil {
+			return
+		}
+		d.reconnects.Add(1)
+		delay := d.config().ReconnectDelay
+		logEvent(levelWarn, "", "session-failed", "%s ended: %v; reconnecting in %s", fs.name, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay.D()):
+		}
+	}
+}
+
+// sshArgs returns the arguments of the ssh of fs for cfg, with its control
+// socket at ctl, and the names of the forwards it carries.
+func (fs forwardSession) sshArgs(cfg *Config, relays map[string]*relay, ctl string) ([]string, []string) {
+	args, target := sshBaseArgs(fs.connect(cfg))
+	if runtime.GOOS != "windows" {
+		// lets the session be rotated, see rotate.go
+		args = append(args, "-o", "ControlMaster=yes", "-o", "ControlPath="+ctl)
+	}
+	var names []string
+	for _, f := range fs.forwards(cfg, relays) {
+		args = append(args, "-R", f.spec)
+		names = append(names, f.name)
+	}
+	return append(args, "-N", target), names
+}
+
+// forwardSessionOnce runs fs until it ends.
+func (d *daemon) forwardSessionOnce(ctx context.Context, fs forwardSession) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	base, relays := d.config(), d.relaySnapshot()
+	cfg := fs.connect(base)
+	ctl := newControlPath(fs.id)
+	_ = os.Remove(ctl)
+	args, names := fs.sshArgs(base, relays, ctl)
+
+	stderr, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+	cmd := d.sshCommand(ctx, false, args, w)
+	if err := cmd.Start(); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed to start SSH: %w", err)
+	}
+	logf("%s running (PID %d): %s", fs.name, cmd.Process.Pid, strings.Join(names, ", "))
+	output := make(chan struct{})
+	go func() {
+		watchSSHOutput(stderr, base, relays, d.st, nil)
+		close(output)
+	}()
+	var established atomic.Bool
+	up := time.AfterFunc(establishedAfter, func() {
+		established.Store(true)
+		fs.up(true)
+	})
+	defer func() {
+		if !up.Stop() && established.Load() {
+			fs.up(false)
+		}
+	}()
+	err = d.superviseSession(ctx, cfg, sshSession{cmd: cmd, done: waitFor(cmd), ctl: ctl}, rotation{
+		name:   fs.name,
+		stderr: w,
+		forwards: func() []remoteForward {
+			return fs.forwards(d.config(), d.relaySnapshot())
+		},
+		switched: func(sshSession) {},
+	})
+	cancel()
+	_ = w.Close()
+	<-output
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runShareCommand implements "tut share": it exposes one configured TCP
+// forward on a random public port of the VPS for a limited time. With -http
+// the endpoint additionally requires a secret path token, which is stripped
+// before requests reach the local service.
+func runShareCommand(args []string) int {
+	fs := flag.NewFlagSet("share", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	ttl := fs.Duration("ttl", time.Hour, "How long the share stays open")
+	httpMode := fs.Bool("http", false, "Treat the forward as HTTP and gate it behind a path token")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tut share [-config path] [-ttl 2h] [-http] <forward>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || *ttl <= 0 {
+		fs.Usage()
+		return 2
+	}
+	name := fs.Arg(0)
+
+	requireBinary("ssh")
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if err := validateConfig(cfg); err != nil {
+		die("Invalid config: %v", err)
+	}
+	var fwd *TCPForward
+	for i := range cfg.TCPForwards {
+		if cfg.TCPForwards[i].Name == name {
+			fwd = &cfg.TCPForwards[i]
+		}
+	}
+	if fwd == nil {
+		die("no tcp_forward named %q (only TCP forwards can be shared)", name)
+	}
+
+	ln, token, err := startShareListener(*fwd, *httpMode)
+	if err != nil {
+		die("Failed to start share listener: %v", err)
+	}
+	defer ln.Close()
+	localPort := ln.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	ctx, expire := context.WithTimeout(ctx, *ttl)
+	defer expire()
+	expires := time.Now().Add(*ttl)
+
+	// Port 0 lets the VPS pick a random free port; reconnects ask for the
+	// same port again so the shared endpoint stays valid until it expires.
+	publicPort := 0
+	for {
+		port, err := runShareSession(ctx, cfg, publicPort, localPort, func(port int) {
+			if publicPort != 0 {
+				return
+			}
+			if *httpMode {
+				fmt.Printf("Sharing %s at http://%s/%s/\n", name, net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(port)), token)
+			} else {
+				fmt.Printf("Sharing %s at %s\n", name, net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(port)))
+			}
+			fmt.Printf("Expires at %s\n", expires.Format(time.RFC3339))
+		})
+		if port != 0 {
+			publicPort = port
+		}
+		if ctx.Err() != nil {
+			if time.Now().Before(expires) {
+				logf("Share of %s stopped", name)
+			} else {
+				logf("Share of %s expired", name)
+			}
+			return 0
+		}
+		logf("Share session ended: %v", err)
+		select {
+		case <-time.After(cfg.ReconnectDelay.D()):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// startShareListener starts the local side of a share. Plain shares relay
+// raw TCP; HTTP shares serve a reverse proxy that only answers below a
+// random path token.
+func startShareListener(f TCPForward, httpMode bool) (net.Listener, string, error) {
+	if !httpMode {
+		r, err := startRelay(f.Name, tcpTarget(f))
+		if err != nil {
+			return nil, "", err
+		}
+		return r.ln, "", nil
+	}
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(b)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: tcpTarget(f)})
+	prefix := "/" + token
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			http.NotFound(w, req)
+			return
+		}
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+		req.URL.RawPath = ""
+		if req.URL.Path == "" {
+			req.URL.Path = "/"
+		}
+		proxy.ServeHTTP(w, req)
+	})
+	go func() {
+		_ = http.Serve(ln, handler)
+	}()
+	return ln, token, nil
+}
+
+// runShareSession opens an SSH session carrying a single remote forward from
+// publicPort on the VPS to localPort. onAllocated is called with the public
+// port once it is known. It returns the port that was used.
+func runShareSession(ctx context.Context, cfg *Config, publicPort, localPort int, onAllocated func(int)) (int, error) {
+	base, target := sshBaseArgs(cfg)
+	args := append(base, "-N", "-R", fmt.Sprintf("0.0.0.0:%d:127.0.0.1:%d", publicPort, localPort), target)
+	cmd := sshExec(ctx, cfg, args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start SSH: %w", err)
+	}
+	port := publicPort
+	if port != 0 {
+		onAllocated(port)
+	}
+	sc := bufio.NewScanner(stderr)
+	for sc.Scan() {
+		line := sc.Text()
+		if m := allocatedRe.FindStringSubmatch(line); m != nil && port == 0 {
+			port, _ = strconv.Atoi(m[1])
+			onAllocated(port)
+			continue
+		}
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return port, cmd.Wait()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceSupported reports whether relays can move data between sockets
+// without copying it through user space.
+const spliceSupported = true
+
+// splice copies src to dst with splice(2), which net.TCPConn.ReadFrom uses
+// on Linux when reading from another TCP socket. The copy runs in chunks of
+// up to chunk bytes so the counters still move; they are updated once per
+// chunk rather than per read. It returns the number of bytes copied.
+func (r *relay) splice(dst, src net.Conn, counter *atomic.Int64, chunk int) int64 {
+	tc, ok := dst.(*net.TCPConn)
+	if !ok {
+		n, _ := io.Copy(dst, src)
+		counter.Add(n)
+		return n
+	}
+	var total int64
+	for {
+		n, err := tc.ReadFrom(&io.LimitedReader{R: src, N: int64(chunk)})
+		if n > 0 {
+			total += n
+			counter.Add(n)
+			r.stats.lastActivity.Store(monoNow())
+		}
+		if err != nil || n == 0 {
+			return total
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// spliceSupported is false: splice(2) only exists on Linux.
+const spliceSupported = false
+
+// splice is never called outside Linux.
+func (r *relay) splice(dst, src net.Conn, counter *atomic.Int64, chunk int) int64 { return 0 }
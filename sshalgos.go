@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// sshAlgorithms lists the algorithm settings of the vps section with the
+// ssh_config option and the "ssh -Q" query for the names ssh supports.
+var sshAlgorithms = []struct {
+	field, option, query string
+	names                func(c *Config) []string
+}{
+	{"vps.ciphers", "Ciphers", "cipher", func(c *Config) []string { return c.VPS.Ciphers }},
+	{"vps.macs", "MACs", "mac", func(c *Config) []string { return c.VPS.MACs }},
+	{"vps.kex_algorithms", "KexAlgorithms", "kex", func(c *Config) []string { return c.VPS.KexAlgorithms }},
+}
+
+// validateSSHAlgorithms checks the configured algorithm names against the
+// ones the local ssh supports. When ssh cannot be asked, ssh itself
+// reports unknown names on connect.
+func validateSSHAlgorithms(c *Config) error {
+	for _, a := range sshAlgorithms {
+		names := a.names(c)
+		if len(names) == 0 {
+			continue
+		}
+		out, err := exec.Command("ssh", "-Q", a.query).Output()
+		if err != nil {
+			continue
+		}
+		known := make(map[string]bool)
+		for _, n := range strings.Fields(string(out)) {
+			known[n] = true
+		}
+		for _, n := range names {
+			if !known[n] {
+				return fmt.Errorf("unknown %s entry %q (ssh -Q %s lists the supported ones)", a.field, n, a.query)
+			}
+		}
+	}
+	return nil
+}
+
+// sshAlgorithmArgs returns the ssh options restricting the algorithms.
+func sshAlgorithmArgs(c *Config) []string {
+	var args []string
+	for _, a := range sshAlgorithms {
+		if names := a.names(c); len(names) > 0 {
+			args = append(args, "-o", a.option+"="+strings.Join(names, ","))
+		}
+	}
+	return args
+}
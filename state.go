@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stateVersion is bumped whenever the state file layout changes incompatibly.
+const stateVersion = 1
+
+// State is persisted between runs so that tut can resume with the same public
+// endpoints after a crash or reboot and detect config drift.
+type State struct {
+	Version        int              `json:"version"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	LastGoodAt     time.Time        `json:"last_good_at,omitempty"`
+	LastGoodHash   string           `json:"last_good_hash,omitempty"`
+	LastGoodConfig string           `json:"last_good_config,omitempty"`
+	Leases         map[string]Lease `json:"leases"`
+	NAT            *NATReport       `json:"nat,omitempty"`
+	Usage          *Usage           `json:"usage,omitempty"`
+	SSHPort        int              `json:"ssh_port,omitempty"` // of vps.ports, see ports.go
+	// ProvisionedBoot is the boot ID of the VPS remote.provision_commands
+	// last ran for, ProvisionedHash a digest of those commands.
+	ProvisionedBoot string `json:"provisioned_boot,omitempty"`
+	ProvisionedHash string `json:"provisioned_hash,omitempty"`
+}
+
+// Usage is the transfer of the current quota period, in bytes.
+type Usage struct {
+	Period   string           `json:"period"` // first day, 2006-01-02
+	Total    int64            `json:"total"`  // including forwards removed since
+	Forwards map[string]int64 `json:"forwards"`
+}
+
+// Lease records a public port the VPS assigned to a forward.
+type Lease struct {
+	Proto      string    `json:"proto"`
+	Port       int       `json:"port"`
+	AssignedAt time.Time `json:"assigned_at"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// stateStore guards the state and writes it to disk atomically.
+type stateStore struct {
+	path string
+
+	mu sync.Mutex
+	st State
+}
+
+// openState loads the state file at path. A missing file yields an empty
+// state; a corrupt one is moved aside so that tut can still start.
+func openState(path string) *stateStore {
+	s := &stateStore{path: path, st: State{Version: stateVersion, Leases: map[string]Lease{}}}
+	if path == "" {
+		return s
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s
+	}
+	if err != nil {
+		logEvent(levelWarn, "", "", "Cannot read state file %s: %v", path, err)
+		return s
+	}
+	var st State
+	if err := json.Unmarshal(b, &st); err != nil || st.Version != stateVersion {
+		logEvent(levelWarn, "", "", "Ignoring unusable state file %s (moved to %s.bad)", path, path)
+		_ = os.Rename(path, path+".bad")
+		return s
+	}
+	if st.Leases == nil {
+		st.Leases = map[string]Lease{}
+	}
+	s.st = st
+	return s
+}
+
+// save writes the state to disk via a temporary file and rename, so a crash
+// mid-write never leaves a truncated state behind.
+func (s *stateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	s.st.UpdatedAt = time.Now()
+	b, err := json.MarshalIndent(s.st, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// saveOrLog saves the state and logs failures instead of returning them.
+func (s *stateStore) saveOrLog() {
+	if err := s.save(); err != nil {
+		logEvent(levelError, "", "", "Failed to write state file %s: %v", s.path, err)
+	}
+}
+
+// lease returns the lease held by the named forward.
+func (s *stateStore) lease(name string) (Lease, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.st.Leases[name]
+	return l, ok
+}
+
+// setLease records port as assigned to the named forward.
+func (s *stateStore) setLease(name, proto string, port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	l, ok := s.st.Leases[name]
+	if !ok || l.Port != port {
+		l = Lease{Proto: proto, Port: port, AssignedAt: now}
+	}
+	l.LastSeen = now
+	s.st.Leases[name] = l
+}
+
+// dropLease forgets the lease of the named forward.
+func (s *stateStore) dropLease(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.st.Leases, name)
+}
+
+// sshPort returns the port of vps.ports that reached SSH last time.
+func (s *stateStore) sshPort() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.SSHPort
+}
+
+// setSSHPort records the port of vps.ports that reached SSH.
+func (s *stateStore) setSSHPort(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.SSHPort = port
+}
+
+// provisioned returns the boot ID of the VPS and the digest of the commands
+// it was last provisioned with.
+func (s *stateStore) provisioned() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.st.ProvisionedBoot, s.st.ProvisionedHash
+}
+
+// setProvisioned records that the VPS was provisioned in boot with the
+// commands of digest.
+func (s *stateStore) setProvisioned(boot, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.ProvisionedBoot, s.st.ProvisionedHash = boot, digest
+}
+
+// setNAT records the result of the NAT check.
+func (s *stateStore) setNAT(r NATReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.NAT = &r
+}
+
+// addUsage adds the transfer in deltas to the usage of period, starting
+// over when a new period began, and returns a copy of the result.
+func (s *stateStore) addUsage(period string, deltas map[string]int64) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.st.Usage == nil || s.st.Usage.Period != period {
+		s.st.Usage = &Usage{Period: period, Forwards: map[string]int64{}}
+	}
+	u := s.st.Usage
+	for name, n := range deltas {
+		u.Forwards[name] += n
+		u.Total += n
+	}
+	return u.copy()
+}
+
+// usage returns a copy of the recorded usage.
+func (s *stateStore) usage() Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.st.Usage == nil {
+		return Usage{Forwards: map[string]int64{}}
+	}
+	return s.st.Usage.copy()
+}
+
+func (u *Usage) copy() Usage {
+	c := *u
+	c.Forwards = make(map[string]int64, len(u.Forwards))
+	for name, n := range u.Forwards {
+		c.Forwards[name] = n
+	}
+	return c
+}
+
+// markGood remembers cfg as the last configuration a tunnel was successfully
+// established with. Leases of forwards no longer configured are released.
+func (s *stateStore) markGood(cfg *Config) {
+	c := *cfg
+	c.Version = configVersion // also for configs from the environment or UCI
+	b, err := yaml.Marshal(&c)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.st.LastGoodAt = time.Now()
+	s.st.LastGoodHash = configHash(b)
+	s.st.LastGoodConfig = string(b)
+	for name := range s.st.Leases {
+		if !cfg.hasForward(name) {
+			delete(s.st.Leases, name)
+		}
+	}
+}
+
+// lastGood returns the last known good configuration, if any.
+func (s *stateStore) lastGood() (*Config, time.Time, bool) {
+	s.mu.Lock()
+	raw, at := s.st.LastGoodConfig, s.st.LastGoodAt
+	s.mu.Unlock()
+	if raw == "" {
+		return nil, time.Time{}, false
+	}
+	// an older tut may have recorded it in an older layout
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, time.Time{}, false
+	}
+	if _, _, err := migrateConfigNode(&doc); err != nil {
+		return nil, time.Time{}, false
+	}
+	var c Config
+	if err := doc.Decode(&c); err != nil {
+		return nil, time.Time{}, false
+	}
+	return &c, at, true
+}
+
+// reportDrift logs how cfg differs from the last configuration that was
+// successfully used.
+func (s *stateStore) reportDrift(cfg *Config) {
+	old, at, ok := s.lastGood()
+	if !ok {
+		return
+	}
+	changes := diffConfigs(old, cfg)
+	if len(changes) == 0 {
+		return
+	}
+	logf("Config changed since last successful run (%s):", at.Format(time.RFC3339))
+	for _, c := range changes {
+		logf("  %s", c)
+	}
+}
+
+// hasForward reports whether a forward with the given name is configured.
+func (c *Config) hasForward(name string) bool {
+	for _, f := range c.TCPForwards {
+		if f.Name == name {
+			return true
+		}
+	}
+	for _, u := range c.UDPForwards {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withLeases returns a copy of cfg in which auto-port forwards request the
+// public port they were assigned before, so endpoints survive restarts.
+func (s *stateStore) withLeases(cfg *Config) *Config {
+	c := *cfg
+	c.TCPForwards = append([]TCPForward(nil), cfg.TCPForwards...)
+	for i, f := range c.TCPForwards {
+		if f.RemotePort != 0 {
+			continue
+		}
+		if l, ok := s.lease(f.Name); ok && l.Proto == "tcp" {
+			c.TCPForwards[i].RemotePort = l.Port
+		}
+	}
+	return &c
+}
+
+// configHash returns a short stable digest of a marshaled configuration.
+func configHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runStatsD periodically sends the daemon metrics to a StatsD server.
+// Counters are sent as deltas since the previous flush, gauges as their
+// current value. In dogstatsd mode the forward name and configured tags are
+// sent as tags; plain StatsD has no tags, so the forward name becomes part of
+// the metric name instead.
+func runStatsD(ctx context.Context, d *daemon) {
+	sc := d.config().StatsD
+	if sc.Address == "" {
+		return
+	}
+	conn, err := net.Dial("udp", sc.Address)
+	if err != nil {
+		logEvent(levelWarn, "", "", "StatsD disabled: %v", err)
+		return
+	}
+	defer conn.Close()
+	logf("Sending metrics to StatsD at %s every %s", sc.Address, sc.Interval)
+
+	last := make(map[string]int64)
+	ticker := time.NewTicker(sc.Interval.D())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var lines []string
+		for _, m := range d.collectMetrics() {
+			value := m.value
+			kind := "g"
+			if m.kind == metricCounter {
+				value -= last[m.key()]
+				last[m.key()] = m.value
+				kind = "c"
+			}
+			lines = append(lines, statsdLine(sc.Prefix, sc.DogStatsD, sc.Tags, m, value, kind))
+		}
+		// keep datagrams well below common MTUs
+		for len(lines) > 0 {
+			n, size := 0, 0
+			for n < len(lines) && size+len(lines[n]) < 1400 {
+				size += len(lines[n]) + 1
+				n++
+			}
+			if n == 0 {
+				n = 1
+			}
+			_, _ = conn.Write([]byte(strings.Join(lines[:n], "\n")))
+			lines = lines[n:]
+		}
+	}
+}
+
+// statsdLine formats one StatsD datagram line.
+func statsdLine(prefix string, dogstatsd bool, extra map[string]string, m metric, value int64, kind string) string {
+	name := m.name
+	if f, ok := m.tags["forward"]; ok && !dogstatsd {
+		name = "forward." + f + "." + name
+	}
+	if v, ok := m.tags["vps"]; ok && !dogstatsd {
+		name = "vps." + v + "." + name
+	}
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	if !dogstatsd {
+		return fmt.Sprintf("%s:%d|%s", name, value, kind)
+	}
+	tags := make([]string, 0, len(extra)+len(m.tags))
+	for k, v := range extra {
+		tags = append(tags, k+":"+v)
+	}
+	for k, v := range m.tags {
+		tags = append(tags, k+":"+v)
+	}
+	if len(tags) == 0 {
+		return fmt.Sprintf("%s:%d|%s", name, value, kind)
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("%s:%d|%s|#%s", name, value, kind, strings.Join(tags, ","))
+}
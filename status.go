@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runStatusCommand implements "tut status": it prints what the state file
+// records about the service, such as assigned ports and the NAT verdict.
+func runStatusCommand(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if _, err := os.Stat(cfg.StateFile); err != nil {
+		if jsonOutput() {
+			printJSON(statusOf(cfg, nil))
+			return 0
+		}
+		fmt.Printf("No state file at %s; tut has not run yet.\n", cfg.StateFile)
+		return 0
+	}
+	st := openState(cfg.StateFile)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.st
+	if jsonOutput() {
+		printJSON(statusOf(cfg, &s))
+		return 0
+	}
+	if s.LastGoodAt.IsZero() {
+		fmt.Println("Tunnel:  never established")
+	} else {
+		fmt.Printf("Tunnel:  last established %s\n", s.LastGoodAt.Format(time.RFC3339))
+	}
+	for _, f := range cfg.TCPForwards {
+		port := f.RemotePort
+		if l, ok := s.Leases[f.Name]; ok && port == 0 {
+			port = l.Port
+		}
+		addr := publicAddr(cfg, port)
+		switch f.Expose {
+		case "cloudflare":
+			addr = f.CloudflareHostname + " (Cloudflare Tunnel)"
+		case "both":
+			addr += ", " + f.CloudflareHostname + " (Cloudflare Tunnel)"
+		}
+		fmt.Printf("Forward: %-20s tcp %s%s\n", f.Name, addr, usageNote(s.Usage, f.Name, f.Quota))
+	}
+	for _, u := range cfg.UDPForwards {
+		bind := ""
+		if u.RemoteBind != "0.0.0.0" {
+			bind = " (bound to " + u.RemoteBind + " on the VPS)"
+		}
+		fmt.Printf("Forward: %-20s udp %s%s%s\n", u.Name, publicAddr(cfg, u.UDPPublicPort), bind, usageNote(s.Usage, u.Name, u.Quota))
+	}
+	if s.Usage != nil {
+		fmt.Printf("Usage:   %s since %s%s\n", formatBytes(s.Usage.Total), s.Usage.Period, usageNote(nil, "", cfg.Quota.Total))
+	}
+	if s.NAT == nil {
+		fmt.Println("NAT:     not checked yet")
+	} else {
+		fmt.Printf("NAT:     %s (checked %s)\n", s.NAT, s.NAT.CheckedAt.Format(time.RFC3339))
+	}
+	return 0
+}
+
+// publicAddr formats the public address of a forward on the VPS.
+func publicAddr(cfg *Config, port int) string {
+	if port == 0 {
+		return "(port not assigned yet)"
+	}
+	return net.JoinHostPort(cfg.VPS.Host, strconv.Itoa(port))
+}
+
+// usageNote describes the transfer of the named forward this period and its
+// quota, if any.
+func usageNote(u *Usage, name string, quota Size) string {
+	var note string
+	if u != nil {
+		note = ", " + formatBytes(u.Forwards[name]) + " this period"
+	}
+	if quota > 0 {
+		note += " (quota " + quota.String() + ")"
+	}
+	return note
+}
+
+// statusReport is "tut status -output json".
+type statusReport struct {
+	Ran             bool            `json:"ran"` // there is a state file
+	LastEstablished *time.Time      `json:"last_established"`
+	Forwards        []statusForward `json:"forwards"`
+	Usage           *Usage          `json:"usage"`
+	NAT             *NATReport      `json:"nat"`
+}
+
+// statusForward is a forward and where it is reachable.
+type statusForward struct {
+	Name       string `json:"name"`
+	Proto      string `json:"proto"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"` // 0 until the VPS assigned one
+	Local      string `json:"local"`
+	UsageBytes int64  `json:"usage_bytes"`
+	Quota      Size   `json:"quota,omitempty"`
+	Cloudflare string `json:"cloudflare,omitempty"` // hostname in Cloudflare Tunnel
+}
+
+// statusOf reports the forwards of cfg with the state s, nil before tut
+// first ran.
+func statusOf(cfg *Config, s *State) statusReport {
+	r := statusReport{Ran: s != nil, Forwards: []statusForward{}}
+	if s != nil {
+		if !s.LastGoodAt.IsZero() {
+			r.LastEstablished = &s.LastGoodAt
+		}
+		r.Usage, r.NAT = s.Usage, s.NAT
+	}
+	usage := func(name string) int64 {
+		if r.Usage == nil {
+			return 0
+		}
+		return r.Usage.Forwards[name]
+	}
+	for _, f := range cfg.TCPForwards {
+		port := f.RemotePort
+		if s != nil {
+			if l, ok := s.Leases[f.Name]; ok && port == 0 {
+				port = l.Port
+			}
+		}
+		host, hostname := cfg.VPS.Host, ""
+		if f.onCloudflare() {
+			hostname = f.CloudflareHostname
+		}
+		if !f.onVPS() {
+			host, port = hostname, 0
+		}
+		r.Forwards = append(r.Forwards, statusForward{f.Name, "tcp", host, port,
+			net.JoinHostPort(f.LocalHost, strconv.Itoa(f.LocalPort)), usage(f.Name), f.Quota, hostname})
+	}
+	for _, u := range cfg.UDPForwards {
+		r.Forwards = append(r.Forwards, statusForward{u.Name, "udp", cfg.VPS.Host, u.UDPPublicPort,
+			net.JoinHostPort(u.LocalHost, strconv.Itoa(u.LocalUDPPort)), usage(u.Name), u.Quota, ""})
+	}
+	return r
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT verdicts of detectNAT.
+const (
+	natNone      = "none"      // this host has a public address
+	natCone      = "nat"       // behind a NAT whose router has a public address
+	natCGNAT     = "cgnat"     // behind carrier-grade or double NAT
+	natSymmetric = "symmetric" // the mapping changes with the destination
+	natUnknown   = "unknown"   // STUN failed
+)
+
+// NATReport is the result of the startup reachability check.
+type NATReport struct {
+	Verdict   string    `json:"verdict"`
+	Mapped    string    `json:"mapped,omitempty"` // address the STUN servers saw
+	Detail    string    `json:"detail"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// relayNeeded reports whether inbound connections can only reach this host
+// through the VPS.
+func (r NATReport) relayNeeded() bool {
+	return r.Verdict != natNone && r.Verdict != natCone
+}
+
+func (r NATReport) String() string {
+	need := "the VPS relay is needed"
+	switch r.Verdict {
+	case natNone:
+		need = "the VPS relay is not needed unless a firewall blocks inbound connections"
+	case natCone:
+		need = "port forwarding on the router (or direct.enabled) would work without the VPS"
+	case natUnknown:
+		need = "assume the VPS relay is needed"
+	}
+	return fmt.Sprintf("%s: %s", r.Detail, need)
+}
+
+// detectNAT asks the configured STUN servers for this host's public address
+// from a single socket. Different answers mean a symmetric NAT; an answer
+// matching the local address means no NAT at all. Whether the router itself
+// sits behind carrier-grade NAT is decided from its external address, which
+// is asked for via UPnP or NAT-PMP when the router supports either.
+func detectNAT(ctx context.Context, cfg *Config) NATReport {
+	r := NATReport{Verdict: natUnknown, CheckedAt: time.Now()}
+	if len(cfg.STUNServers) == 0 {
+		r.Detail = "no STUN servers configured"
+		return r
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	defer conn.Close()
+	var mapped []*net.UDPAddr
+	var local net.IP
+	var errs []error
+	for _, server := range cfg.STUNServers {
+		addr, err := net.ResolveUDPAddr("udp4", server)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m, err := stunBinding(ctx, conn, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		mapped = append(mapped, m)
+		if local == nil {
+			local = outboundIP(addr)
+		}
+		if len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) == 0 {
+		r.Detail = fmt.Sprintf("STUN failed, UDP may be blocked (%v)", errors.Join(errs...))
+		return r
+	}
+	m := mapped[0]
+	r.Mapped = m.String()
+	switch {
+	case len(mapped) > 1 && mapped[1].String() != m.String():
+		r.Verdict = natSymmetric
+		r.Detail = fmt.Sprintf("behind a symmetric NAT (mapped to %s and %s)", m, mapped[1])
+	case m.IP.Equal(local):
+		r.Verdict, r.Detail = natNone, "not behind NAT, public address "+m.IP.String()
+	default:
+		r.Verdict, r.Detail = natCGNAT, routerVerdict(ctx, cfg, local, m.IP)
+		if r.Detail == "" {
+			r.Verdict, r.Detail = natCone, "behind a NAT with public address "+m.IP.String()
+		}
+	}
+	return r
+}
+
+// routerVerdict explains why this host is behind carrier-grade NAT, or
+// returns "" when the router holds the public address itself.
+func routerVerdict(ctx context.Context, cfg *Config, local, public net.IP) string {
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+	if cgnat.Contains(local) {
+		return "behind carrier-grade NAT, local address " + local.String()
+	}
+	_, ext, err := findRouter(ctx, cfg.Direct)
+	if err != nil {
+		return ""
+	}
+	if !ext.Equal(public) {
+		return fmt.Sprintf("behind carrier-grade or double NAT, router address %s but public address %s", ext, public)
+	}
+	return ""
+}
+
+// outboundIP returns the local address used to reach addr.
+func outboundIP(addr *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// stunMagic is the STUN magic cookie (RFC 5389).
+const stunMagic = 0x2112A442
+
+// stunBinding sends a STUN Binding request to server from conn and returns
+// the mapped address from the response.
+func stunBinding(ctx context.Context, conn net.PacketConn, server *net.UDPAddr) (*net.UDPAddr, error) {
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001) // Binding request
+	binary.BigEndian.PutUint32(req[4:], stunMagic)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1024)
+	wait := 500 * time.Millisecond
+	for try := 0; try < 3 && ctx.Err() == nil; try++ {
+		if _, err := conn.WriteTo(req, server); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(wait))
+		wait *= 2
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			// ignore stray responses to earlier requests
+			if n < 20 || binary.BigEndian.Uint16(buf[0:]) != 0x0101 || string(buf[8:20]) != string(req[8:20]) {
+				continue
+			}
+			return parseSTUNMapped(buf[20:n])
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, errors.New("no response")
+}
+
+// parseSTUNMapped extracts XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS from old
+// servers, from the attributes of a Binding response.
+func parseSTUNMapped(attrs []byte) (*net.UDPAddr, error) {
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		typ, size := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		v := attrs[4 : 4+size]
+		// IPv4 only: family 0x01
+		if size >= 8 && v[1] == 0x01 {
+			port := int(binary.BigEndian.Uint16(v[2:]))
+			ip := net.IP(append([]byte(nil), v[4:8]...))
+			switch typ {
+			case 0x0020: // XOR-MAPPED-ADDRESS
+				port ^= stunMagic >> 16
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)^stunMagic)
+				return &net.UDPAddr{IP: ip, Port: port}, nil
+			case 0x0001: // MAPPED-ADDRESS
+				mapped = &net.UDPAddr{IP: ip, Port: port}
+			}
+		}
+		next := 4 + (size+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, errors.New("no mapped address in response")
+	}
+	return mapped, nil
+}
+
+// checkNAT runs detectNAT once at startup, logs the verdict and keeps it in
+// the state file for tut status and tut doctor.
+func checkNAT(ctx context.Context, d *daemon) {
+	if len(d.config().STUNServers) == 0 {
+		return
+	}
+	r := detectNAT(ctx, d.config())
+	if ctx.Err() != nil {
+		return
+	}
+	level := levelInfo
+	if r.Verdict == natUnknown {
+		level = levelWarn
+	}
+	logEvent(level, "", "nat-detected", "NAT check: %s", r)
+	d.st.setNAT(r)
+	d.st.saveOrLog()
+}
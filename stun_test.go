@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// testSTUNAttr builds a STUN attribute, padded to a multiple of 4 bytes.
+func testSTUNAttr(typ uint16, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	binary.BigEndian.PutUint16(b[0:], typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// testSTUNAddr builds the value of a (XOR-)MAPPED-ADDRESS for an IPv4 address.
+func testSTUNAddr(ip string, port int, xor bool) []byte {
+	v := make([]byte, 8)
+	v[1] = 0x01
+	p, a := uint16(port), binary.BigEndian.Uint32(net.ParseIP(ip).To4())
+	if xor {
+		p ^= stunMagic >> 16
+		a ^= stunMagic
+	}
+	binary.BigEndian.PutUint16(v[2:], p)
+	binary.BigEndian.PutUint32(v[4:], a)
+	return v
+}
+
+func concat(bs ...[]byte) []byte {
+	var out []byte
+	for _, b := range bs {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func TestParseSTUNMapped(t *testing.T) {
+	xorMapped := testSTUNAttr(0x0020, testSTUNAddr("203.0.113.7", 40000, true))
+	mapped := testSTUNAttr(0x0001, testSTUNAddr("198.51.100.1", 3478, false))
+	software := testSTUNAttr(0x8022, []byte("tut")) // padded to 4
+	ipv6 := testSTUNAttr(0x0020, append([]byte{0, 0x02, 0, 80}, make([]byte, 16)...))
+
+	for _, tc := range []struct {
+		name  string
+		attrs []byte
+		want  string // "" for an error
+	}{
+		{"xor-mapped", xorMapped, "203.0.113.7:40000"},
+		{"mapped", mapped, "198.51.100.1:3478"},
+		{"xor-mapped wins", concat(mapped, xorMapped), "203.0.113.7:40000"},
+		{"after a padded attribute", concat(software, xorMapped), "203.0.113.7:40000"},
+		{"no attributes", nil, ""},
+		{"shorter than a header", []byte{0x00, 0x20, 0x00}, ""},
+		{"value cut short", xorMapped[:10], ""},
+		{"length past the end", concat(software, []byte{0x00, 0x20, 0x00, 0x08, 0, 1}), ""},
+		{"mapped before a cut attribute", concat(mapped, xorMapped[:6]), "198.51.100.1:3478"},
+		{"last attribute unpadded", testSTUNAttr(0x0001, append(testSTUNAddr("192.0.2.9", 9, false), 0xff))[:13], "192.0.2.9:9"},
+		{"ipv6 only", ipv6, ""},
+		{"unknown family", testSTUNAttr(0x0001, []byte{0, 0x07, 0, 80, 1, 2, 3, 4}), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSTUNMapped(tc.attrs)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("parseSTUNMapped = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("parseSTUNMapped = %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
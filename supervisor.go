@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// restartPolicy controls how exited children are restarted.
+type restartPolicy struct {
+	initialBackoff time.Duration // delay before the first restart
+	maxBackoff     time.Duration // upper bound for the doubling delay
+	maxRestarts    int           // give up after this many restarts; 0 means never
+	flapWindow     time.Duration // window for flapping detection; running longer resets the backoff
+	flapThreshold  int           // restarts within flapWindow that mark a unit as flapping
+}
+
+// policyFromConfig builds the restart policy from the supervisor settings.
+func policyFromConfig(c SupervisorConfig) restartPolicy {
+	return restartPolicy{
+		initialBackoff: c.BackoffInitial.D(),
+		maxBackoff:     c.BackoffMax.D(),
+		maxRestarts:    c.MaxRestarts,
+		flapWindow:     c.FlapWindow.D(),
+		flapThreshold:  c.FlapThreshold,
+	}
+}
+
+// childState tracks the restart history of one supervised unit.
+type childState struct {
+	startedAt time.Time
+	restarts  int
+	recent    []time.Time // restarts within the flap window
+	backoff   time.Duration
+	next      time.Time // earliest time of the next restart
+	flapping  bool
+	gaveUp    bool
+}
+
+// supervisor applies a restart policy to named units (for example all socat
+// processes of one forward). It only decides when to restart; starting and
+// stopping is left to the caller.
+type supervisor struct {
+	mu     sync.Mutex
+	policy restartPolicy
+	units  map[string]*childState
+}
+
+func newSupervisor(p restartPolicy) *supervisor {
+	return &supervisor{policy: p, units: make(map[string]*childState)}
+}
+
+// setPolicy replaces the policy; histories are kept.
+func (s *supervisor) setPolicy(p restartPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = p
+}
+
+func (s *supervisor) state(name string) *childState {
+	st, ok := s.units[name]
+	if !ok {
+		st = &childState{}
+		s.units[name] = st
+	}
+	return st
+}
+
+// started records that the unit was (re)started now.
+func (s *supervisor) started(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state(name).startedAt = time.Now()
+}
+
+// forget drops the history of a unit, e.g. after its config changed.
+func (s *supervisor) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.units, name)
+}
+
+// restartDecision is the outcome of exited.
+type restartDecision int
+
+const (
+	restartNow restartDecision = iota
+	restartLater
+	restartNever
+)
+
+// exited is called while the unit is down. It decides whether it should be
+// restarted now, later (backing off) or never (the restart budget is spent).
+// When restartNow is returned the restart is accounted for, along with a
+// note for the log line when the unit just started flapping.
+func (s *supervisor) exited(name string) (restartDecision, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, st, now := s.policy, s.state(name), time.Now()
+	if st.gaveUp {
+		return restartNever, ""
+	}
+	if now.Before(st.next) {
+		return restartLater, ""
+	}
+	if p.maxRestarts > 0 && st.restarts >= p.maxRestarts {
+		st.gaveUp = true
+		return restartNever, ""
+	}
+	// a unit that ran longer than the flap window was healthy: start over
+	if !st.startedAt.IsZero() && now.Sub(st.startedAt) > p.flapWindow {
+		st.backoff = 0
+		st.flapping = false
+	}
+	kept := st.recent[:0]
+	for _, t := range st.recent {
+		if now.Sub(t) <= p.flapWindow {
+			kept = append(kept, t)
+		}
+	}
+	st.recent = append(kept, now)
+	st.restarts++
+	if st.backoff == 0 {
+		st.backoff = p.initialBackoff
+	} else if st.backoff *= 2; st.backoff > p.maxBackoff {
+		st.backoff = p.maxBackoff
+	}
+	note := ""
+	if p.flapThreshold > 0 && len(st.recent) >= p.flapThreshold {
+		if !st.flapping {
+			note = "; flapping detected, backing off to the maximum delay"
+		}
+		st.flapping = true
+		st.backoff = p.maxBackoff
+	}
+	st.next = now.Add(st.backoff)
+	return restartNow, note
+}
+
+// restarts returns how often the unit has been restarted and whether the
+// supervisor gave up on it.
+func (s *supervisor) restarts(name string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.units[name]
+	if !ok {
+		return 0, false
+	}
+	return st.restarts, st.gaveUp
+}
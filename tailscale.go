@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With vps.transport: tailscale the TCP forwards ride an existing tailscale
+// (or headscale) connection between this host and the VPS instead of remote
+// forwards of the SSH session, so they take the direct path tailscale finds
+// through the NATs whenever there is one. The session still runs the remote
+// script: the agent on the VPS listens on the remote_port of every TCP
+// forward and connects to tut at vps.tailscale_address:tailscale_port for
+// each client, naming the forward and then the client in two frames. tut
+// hands the connection to the relay of the forward, so accounting, policy
+// with the client's address, quotas and health are the same as over SSH. Only connections from an address of
+// vps.host are taken, so vps.host has to be the VPS's tailnet name or
+// address. UDP forwards, TURN and TUN stay on the SSH session.
+
+func init() { registerTransport("tailscale") }
+
+// validateTailscale checks vps.transport and the tailscale settings.
+func validateTailscale(c *Config) error {
+	switch c.VPS.Transport {
+	case "ssh":
+		return nil
+	case "tailscale":
+	default:
+		return fmt.Errorf("invalid vps.transport: %q (ssh or tailscale)", c.VPS.Transport)
+	}
+	if c.VPS.TailscaleAddress != "" && net.ParseIP(c.VPS.TailscaleAddress) == nil {
+		return fmt.Errorf("invalid vps.tailscale_address: %q", c.VPS.TailscaleAddress)
+	}
+	if !isPort(c.VPS.TailscalePort) {
+		return fmt.Errorf("invalid vps.tailscale_port: %d", c.VPS.TailscalePort)
+	}
+	if c.VPS.Sessions > 1 {
+		return errors.New("vps.sessions does not apply to vps.transport: tailscale")
+	}
+	for _, f := range c.TCPForwards {
+		if f.RemotePort == 0 && f.onVPS() {
+			return fmt.Errorf("%s: vps.transport: tailscale needs a fixed remote_port", f.Name)
+		}
+	}
+	return nil
+}
+
+// tailnetDetected caches the address "tailscale ip" reported.
+var tailnetDetected struct {
+	sync.Once
+	addr string
+	err  error
+}
+
+// tailnetAddress returns the address of this host in the tailnet:
+// vps.tailscale_address, or the first address "tailscale ip" reports.
+func tailnetAddress(cfg *Config) (string, error) {
+	if cfg.VPS.TailscaleAddress != "" {
+		return cfg.VPS.TailscaleAddress, nil
+	}
+	tailnetDetected.Do(func() {
+		out, err := exec.Command("tailscale", "ip").Output()
+		if err != nil {
+			tailnetDetected.err = fmt.Errorf("tailscale ip: %w (set vps.tailscale_address)", err)
+			return
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 || net.ParseIP(fields[0]) == nil {
+			tailnetDetected.err = fmt.Errorf("tailscale ip reported no address (set vps.tailscale_address)")
+			return
+		}
+		tailnetDetected.addr = fields[0]
+	})
+	return tailnetDetected.addr, tailnetDetected.err
+}
+
+// tailnetForwards is the -ports argument of the forward agent: name=port
+// of every TCP forward.
+func tailnetForwards(cfg *Config) string {
+	var ports []string
+	for _, f := range cfg.TCPForwards {
+		if !f.onVPS() {
+			continue
+		}
+		ports = append(ports, fmt.Sprintf("%s=%d", f.Name, f.RemotePort))
+	}
+	return strings.Join(ports, ",")
+}
+
+// tailnetListener is the end of the tailscale transport in tut.
+type tailnetListener struct {
+	ln     net.Listener
+	host   string // vps.host, whose addresses may connect
+	relays func() map[string]*relay
+}
+
+// startTailnet listens on the tailnet address when vps.transport is
+// tailscale and logs the path tailscale takes to the VPS.
+func startTailnet(cfg *Config, relays func() map[string]*relay) (*tailnetListener, error) {
+	if cfg.VPS.Transport != "tailscale" {
+		return nil, nil
+	}
+	addr, err := tailnetAddress(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(cfg.VPS.TailscalePort)))
+	if err != nil {
+		return nil, err
+	}
+	t := &tailnetListener{ln: ln, host: cfg.VPS.Host, relays: relays}
+	go t.serve()
+	logf("TCP forwards ride the tailnet: listening on %s, %s", ln.Addr(), tailscalePath(cfg.VPS.Host))
+	return t, nil
+}
+
+func (t *tailnetListener) close() {
+	if t != nil {
+		_ = t.ln.Close()
+	}
+}
+
+// serve accepts the connections of the agent and hands each one to the
+// relay of the forward it names.
+func (t *tailnetListener) serve() {
+	for {
+		c, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if !t.fromVPS(c.RemoteAddr()) {
+				logEvent(levelWarn, "", "tailnet-refused", "Refused a connection from %s, which is not an address of %s", c.RemoteAddr(), t.host)
+				_ = c.Close()
+				return
+			}
+			_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			name, err := readLenPrefixed(c)
+			var client []byte
+			if err == nil {
+				client, err = readLenPrefixed(c)
+			}
+			r := t.relays()[string(name)]
+			if err != nil || r == nil {
+				_ = c.Close()
+				return
+			}
+			_ = c.SetReadDeadline(time.Time{})
+			addr, err := net.ResolveTCPAddr("tcp", string(client))
+			if err != nil {
+				_ = c.Close()
+				return
+			}
+			r.accept(&clientConn{Conn: c, client: addr})
+		}()
+	}
+}
+
+// fromVPS reports whether addr is an address of vps.host.
+func (t *tailnetListener) fromVPS(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if ip := net.ParseIP(t.host); ip != nil {
+		return ip.Equal(tcp.IP)
+	}
+	ips, _ := net.LookupIP(t.host)
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// tailscalePath describes how tailscale reaches host: directly or through
+// a DERP relay, as "tailscale status" reports it.
+func tailscalePath(host string) string {
+	out, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return "path to the VPS unknown"
+	}
+	var st struct {
+		Peer map[string]struct {
+			HostName     string
+			DNSName      string
+			TailscaleIPs []string
+			CurAddr      string
+			Relay        string
+		}
+	}
+	if json.Unmarshal(out, &st) != nil {
+		return "path to the VPS unknown"
+	}
+	for _, p := range st.Peer {
+		match := strings.EqualFold(p.HostName, host) || strings.EqualFold(strings.TrimSuffix(p.DNSName, "."), host)
+		for _, ip := range p.TailscaleIPs {
+			match = match || ip == host
+		}
+		switch {
+		case !match:
+		case p.CurAddr != "":
+			return "direct path to the VPS via " + p.CurAddr
+		case p.Relay != "":
+			return "the VPS is reached through the DERP relay " + p.Relay
+		default:
+			return "no path to the VPS yet"
+		}
+	}
+	return "the VPS is not a peer in the tailnet"
+}
+
+// runAgentForward implements "tut agent forward", the VPS end of the
+// tailscale transport: it listens on the remote port of every TCP forward
+// and connects each client to tut over the tailnet.
+func runAgentForward(args []string) int {
+	fs := flag.NewFlagSet("agent forward", flag.ExitOnError)
+	connect := fs.String("connect", "", "Address of tut in the tailnet")
+	ports := fs.String("ports", "", "Comma-separated name=port of the forwards")
+	_ = fs.Parse(args)
+	if *connect == "" || *ports == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent forward -connect addr -ports name=port,...")
+		return 2
+	}
+	errs := make(chan error)
+	for _, p := range strings.Split(*ports, ",") {
+		name, port, ok := strings.Cut(p, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid forward %q\n", p)
+			return 2
+		}
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		go func() { errs <- forwardServe(ln, name, *connect) }()
+	}
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", <-errs)
+	return 1
+}
+
+// forwardServe connects every client of ln to tut at addr for the forward
+// name.
+func forwardServe(ln net.Listener, name, addr string) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			up, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				return
+			}
+			defer up.Close()
+			// the forward, then the client, see tailnetListener.serve
+			if writeLenPrefixed(up, []byte(name)) != nil || writeLenPrefixed(up, []byte(c.RemoteAddr().String())) != nil {
+				return
+			}
+			done := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(up, c)
+				closeWrite(up)
+				close(done)
+			}()
+			_, _ = io.Copy(c, up)
+			closeWrite(c)
+			<-done
+		}()
+	}
+}
+
+// closeWrite half-closes c when it is a TCP or TLS connection.
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Termux runs tut on an Android phone without root, e.g. as an edge relay
+// on a spare device. The app sandbox has no /var/log, /var/lib or /tmp, only
+// the directories below $PREFIX and $HOME, and every keepalive wakes up the
+// radio, so Termux mode moves the default paths into the sandbox and sends
+// SSH keepalives less often.
+
+// termuxDefaultPrefix is $PREFIX of the Termux app.
+const termuxDefaultPrefix = "/data/data/com.termux/files/usr"
+
+// inTermux reports whether tut runs inside the Termux app.
+func inTermux() bool {
+	return os.Getenv("TERMUX_VERSION") != "" || strings.Contains(os.Getenv("PREFIX"), "/com.termux/")
+}
+
+// termuxMode reports whether cfg selects Termux mode: termux is true,
+// false or auto, which detects the app.
+func termuxMode(c *Config) bool {
+	switch c.Termux {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return inTermux()
+}
+
+// termuxPrefix returns the root of the Termux file system.
+func termuxPrefix() string {
+	if p := os.Getenv("PREFIX"); p != "" {
+		return p
+	}
+	return termuxDefaultPrefix
+}
+
+// applyTermux points the temporary directory of the process and its
+// children into the sandbox when cfg selects Termux mode. The paths of tut
+// itself default to the sandbox in loadConfig.
+func applyTermux(c *Config) {
+	if !termuxMode(c) {
+		return
+	}
+	if os.Getenv("TMPDIR") == "" {
+		_ = os.Setenv("TMPDIR", filepath.Join(termuxPrefix(), "tmp"))
+	}
+}
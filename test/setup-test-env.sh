@@ -18,6 +18,8 @@ fi
 
 # Create test configuration file
 cat > config/config.yaml <<EOF
+version: 2
+
 vps:
   host: "remote"
   user: "testuser"
@@ -25,7 +27,7 @@ vps:
   ssh_key: "/ssh-keys/id_ed25519"
   strict_hostkey: "no"
 
-reconnect_delay_seconds: 2
+reconnect_delay: 2s
 
 tcp_forwards:
   - remote_port: 9001
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runTopCommand implements "tut top": a live view of the forwards of the
+// running daemon, busiest first, read from its API.
+func runTopCommand(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	once := fs.Bool("once", false, "Print the view once instead of refreshing it (default when not on a terminal)")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if cfg.API.Listen == "off" {
+		die("tut top needs the API, which is off (api.listen)")
+	}
+	token := apiClientToken(cfg.API, false)
+	for {
+		var resp struct {
+			Forwards []apiForward `json:"forwards"`
+		}
+		if err := apiRequest(cfg, token, http.MethodGet, "/v1/traffic", &resp); err != nil {
+			die("Cannot reach tut at %s: %v", cfg.API.Listen, err)
+		}
+		view := renderTop(resp.Forwards)
+		if *once || !stdoutIsTerminal() {
+			fmt.Print(view)
+			return 0
+		}
+		// clear the screen and move the cursor home
+		fmt.Print("\033[H\033[2J" + view)
+		time.Sleep(*interval)
+	}
+}
+
+// renderTop formats the forwards sorted by their current rate.
+func renderTop(fwds []apiForward) string {
+	rate := func(f apiForward) (int64, int64) {
+		if len(f.History) == 0 {
+			return 0, 0
+		}
+		s := f.History[len(f.History)-1]
+		return s.InBps, s.OutBps
+	}
+	sort.SliceStable(fwds, func(i, j int) bool {
+		ai, ao := rate(fwds[i])
+		bi, bo := rate(fwds[j])
+		return ai+ao > bi+bo
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "tut top - %s\n\n", time.Now().Format("15:04:05"))
+	fmt.Fprintf(&b, "%-20s %-5s %12s %12s %6s %12s  %s\n", "FORWARD", "PROTO", "IN/s", "OUT/s", "CONNS", "TOTAL", "LAST 60s")
+	for _, f := range fwds {
+		in, out := rate(f)
+		name := f.Name
+		if f.Paused {
+			name += " (paused)"
+		}
+		fmt.Fprintf(&b, "%-20s %-5s %12s %12s %6d %12s  %s\n", name, f.Proto,
+			formatBytes(in), formatBytes(out), f.Active, formatBytes(f.BytesIn+f.BytesOut), sparkline(f.History, 60))
+	}
+	return b.String()
+}
+
+// sparkline draws the total rate of the last n samples.
+func sparkline(samples []rateSample, n int) string {
+	if len(samples) > n {
+		samples = samples[len(samples)-n:]
+	}
+	var peak int64
+	for _, s := range samples {
+		peak = max(peak, s.InBps+s.OutBps)
+	}
+	bars := []rune("▁▂▃▄▅▆▇█")
+	var b strings.Builder
+	for _, s := range samples {
+		i := 0
+		if peak > 0 {
+			i = int((s.InBps + s.OutBps) * int64(len(bars)-1) / peak)
+		}
+		b.WriteRune(bars[i])
+	}
+	return b.String()
+}
+
+// stdoutIsTerminal reports whether stdout is a character device.
+func stdoutIsTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
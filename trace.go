@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// "tut trace <forward>" makes the running tut trace the traffic of one
+// forward into a file of its own: every connection opening and closing and
+// every chunk the relay moves, with its direction, length, the time since
+// the connection opened and a hex dump of its first bytes. For a UDP
+// forward that is the stream of the wrapped datagrams between the tunnel
+// and the local wrapper. A trace ends after a while on its own, and its
+// file is rotated once it reaches its size cap, keeping a few old files,
+// so a forgotten trace cannot fill the disk. With -pcap the trace is a
+// capture for Wireshark instead, see pcap.go. Connections that splice(2)
+// are only traced when they open and close.
+
+// Defaults of tut trace.
+const (
+	defaultTraceFor     = 10 * time.Minute
+	defaultTraceBytes   = 64
+	defaultTraceMaxSize = 10 << 20
+	defaultTraceKeep    = 1
+)
+
+// traceConnIDs numbers the connections of all relays for traces.
+var traceConnIDs atomic.Int64
+
+// traceOptions are the settings of a trace.
+type traceOptions struct {
+	d       time.Duration
+	snippet int   // bytes of each chunk dumped in text
+	maxSize int64 // bytes before the file is rotated to path.1
+	keep    int   // rotated files kept, path.1 to path.<keep>
+	pcap    bool
+}
+
+// forwardTrace is a trace of one forward, written to path.
+type forwardTrace struct {
+	traceOptions
+	forward string
+	path    string
+	until   time.Time
+	// udp is the service of a UDP forward in a pcap, which gets its data
+	// as datagrams
+	udp *net.UDPAddr
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	streams map[int64]*pcapStream // the TCP connections in a pcap
+}
+
+// tracePath is the trace file of forward: trace/<forward>.log, or .pcap,
+// next to the state file.
+func tracePath(cfg *Config, forward string, pcap bool) string {
+	ext := ".log"
+	if pcap {
+		ext = ".pcap"
+	}
+	return filepath.Join(filepath.Dir(cfg.StateFile), "trace", forward+ext)
+}
+
+// startTrace opens the trace file of forward, appending to it.
+func startTrace(cfg *Config, forward string, o traceOptions) (*forwardTrace, error) {
+	t := &forwardTrace{traceOptions: o, forward: forward, path: tracePath(cfg, forward, o.pcap), until: time.Now().Add(o.d),
+		streams: make(map[int64]*pcapStream)}
+	if o.pcap {
+		for _, u := range cfg.UDPForwards {
+			if u.Name == forward {
+				addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.LocalHost, strconv.Itoa(u.LocalUDPPort)))
+				if err != nil {
+					return nil, err
+				}
+				t.udp = addr
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+	t.printf("trace of %s started, until %s, %d bytes per chunk, rotated at %d bytes\n",
+		forward, t.until.Format(time.RFC3339), o.snippet, o.maxSize)
+	return t, nil
+}
+
+// open opens the trace file for appending, starting a pcap with its
+// header. t.mu must be held or t unshared.
+func (t *forwardTrace) open() error {
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.f, t.size = f, info.Size()
+	if t.pcap && t.size == 0 {
+		n, err := f.Write(pcapFileHeader())
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		t.size = int64(n)
+	}
+	return nil
+}
+
+// expired reports whether the trace ran out of time.
+func (t *forwardTrace) expired() bool {
+	return time.Now().After(t.until)
+}
+
+// write appends b to the trace, rotating the files when it would grow past
+// maxSize: path becomes path.1, path.1 becomes path.2 and so on up to
+// path.<keep>. t.mu must be held.
+func (t *forwardTrace) write(b []byte) {
+	if t.f == nil {
+		return
+	}
+	if t.size > 0 && t.size+int64(len(b)) > t.maxSize {
+		_ = t.f.Close()
+		t.f = nil
+		for i := t.keep - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", t.path, i), fmt.Sprintf("%s.%d", t.path, i+1))
+		}
+		if t.keep > 0 {
+			_ = os.Rename(t.path, t.path+".1")
+		} else {
+			_ = os.Remove(t.path)
+		}
+		if err := t.open(); err != nil {
+			logEvent(levelWarn, t.forward, "trace-stopped", "Cannot rotate the trace file: %v", err)
+			return
+		}
+	}
+	n, _ := t.f.Write(b)
+	t.size += int64(n)
+}
+
+// printf appends a timestamped line to a text trace.
+func (t *forwardTrace) printf(format string, args ...any) {
+	if t.pcap {
+		return
+	}
+	line := time.Now().Format("15:04:05.000000") + " " + fmt.Sprintf(format, args...)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.write([]byte(line))
+}
+
+// packets appends packets to a pcap trace.
+func (t *forwardTrace) packets(packets ...[]byte) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range packets {
+		t.write(pcapRecord(now, p))
+	}
+}
+
+// stream returns the pcap stream of the connection of ct, made up without
+// a handshake when the trace started after the connection opened. t.mu
+// must be held.
+func (t *forwardTrace) stream(ct connTrace) *pcapStream {
+	s, ok := t.streams[ct.id]
+	if !ok {
+		s, _ = newPcapStream(endpointOf(ct.client), endpointOf(ct.server), false)
+		t.streams[ct.id] = s
+	}
+	return s
+}
+
+// opened traces the connection of ct opening.
+func (t *forwardTrace) opened(ct connTrace) {
+	if !t.pcap {
+		t.printf("conn %d open from %s to %s\n", ct.id, ct.client, ct.server)
+		return
+	}
+	if t.udp != nil {
+		return
+	}
+	t.mu.Lock()
+	s, packets := newPcapStream(endpointOf(ct.client), endpointOf(ct.server), true)
+	t.streams[ct.id] = s
+	t.mu.Unlock()
+	t.packets(packets...)
+}
+
+// chunk traces the bytes b moving in direction ct.dir of its connection.
+func (t *forwardTrace) chunk(ct connTrace, b []byte) {
+	if !t.pcap {
+		dump := b
+		if len(dump) > t.snippet {
+			dump = dump[:t.snippet]
+		}
+		s := fmt.Sprintf("conn %d %s %d bytes at +%s\n", ct.id, ct.dir, len(b), time.Since(ct.start).Round(time.Microsecond))
+		if len(dump) > 0 {
+			s += hex.Dump(dump)
+		}
+		t.printf("%s", s)
+		return
+	}
+	fromClient := ct.dir == "->"
+	if t.udp != nil {
+		src, dst := endpointOf(ct.client), endpointOf(t.udp)
+		if !fromClient {
+			src, dst = dst, src
+		}
+		var packets [][]byte
+		for len(b) > 0 {
+			n := min(len(b), pcapSegment)
+			packets = append(packets, udpDatagram(src, dst, b[:n]))
+			b = b[n:]
+		}
+		t.packets(packets...)
+		return
+	}
+	t.mu.Lock()
+	packets := t.stream(ct).data(fromClient, b)
+	t.mu.Unlock()
+	t.packets(packets...)
+}
+
+// eof traces the side sending in direction ct.dir finishing.
+func (t *forwardTrace) eof(ct connTrace) {
+	if !t.pcap || t.udp != nil {
+		return
+	}
+	t.mu.Lock()
+	p := t.stream(ct).fin(ct.dir == "->")
+	t.mu.Unlock()
+	t.packets(p)
+}
+
+// closed traces the connection of ct closing after moving in and out
+// bytes.
+func (t *forwardTrace) closed(ct connTrace, in, out int64) {
+	t.printf("conn %d closed after %s, %d bytes ->, %d bytes <-\n", ct.id, time.Since(ct.start).Round(time.Microsecond), in, out)
+	t.mu.Lock()
+	delete(t.streams, ct.id)
+	t.mu.Unlock()
+}
+
+// close ends the trace with why.
+func (t *forwardTrace) close(why string) {
+	t.printf("trace of %s stopped: %s\n", t.forward, why)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f != nil {
+		_ = t.f.Close()
+		t.f = nil
+	}
+}
+
+// activeTrace returns the trace of r, ending it when its time is up.
+func (r *relay) activeTrace() *forwardTrace {
+	t := r.trace.Load()
+	if t == nil || !t.expired() {
+		return t
+	}
+	if r.trace.CompareAndSwap(t, nil) {
+		t.close("time is up")
+		logEvent(levelInfo, r.name, "trace-stopped", "Trace ended; written to %s", t.path)
+	}
+	return nil
+}
+
+// setTrace replaces the trace of r with t, nil to stop tracing, and
+// returns the one that was running.
+func (r *relay) setTrace(t *forwardTrace, why string) *forwardTrace {
+	old := r.trace.Swap(t)
+	if old != nil {
+		old.close(why)
+	}
+	return old
+}
+
+// apiTrace starts a trace of the forward of r on POST
+// /v1/forwards/<name>/trace, with the parameters for, bytes, max_size,
+// keep and pcap, and answers with the path of the trace file.
+func (d *daemon) apiTrace(w http.ResponseWriter, req *http.Request, r *relay) {
+	q := req.URL.Query()
+	dur, maxSize := Duration(defaultTraceFor), Size(defaultTraceMaxSize)
+	o := traceOptions{snippet: defaultTraceBytes, keep: defaultTraceKeep, pcap: q.Get("pcap") == "1"}
+	var err error
+	if s := q.Get("for"); s != "" {
+		err = dur.UnmarshalText([]byte(s))
+	}
+	if s := q.Get("bytes"); s != "" && err == nil {
+		o.snippet, err = strconv.Atoi(s)
+	}
+	if s := q.Get("max_size"); s != "" && err == nil {
+		err = maxSize.UnmarshalText([]byte(s))
+	}
+	if s := q.Get("keep"); s != "" && err == nil {
+		o.keep, err = strconv.Atoi(s)
+	}
+	if err == nil && (dur <= 0 || o.snippet < 0 || maxSize < 4096 || o.keep < 0 || o.keep > 100) {
+		err = errors.New("for must be positive, bytes 0 or more, max_size at least 4KiB and keep 0 to 100")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o.d, o.maxSize = dur.D(), int64(maxSize)
+	t, err := startTrace(d.config(), r.name, o)
+	if err != nil {
+		http.Error(w, "cannot open the trace file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.setTrace(t, "replaced by a new trace")
+	logEvent(levelInfo, r.name, "trace-started", "Tracing for %s into %s (token %s)", dur, t.path, caller(req).Name)
+	writeJSON(w, map[string]any{"file": t.path, "until": t.until})
+}
+
+// runTraceCommand implements "tut trace".
+func runTraceCommand(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	off := fs.Bool("off", false, "Stop tracing the forward")
+	dur := Duration(defaultTraceFor)
+	fs.TextVar(&dur, "for", dur, "Stop tracing after this long")
+	snippet := fs.Int("bytes", defaultTraceBytes, "Bytes of each chunk to hex dump")
+	maxSize := Size(defaultTraceMaxSize)
+	fs.TextVar(&maxSize, "max-size", maxSize, "Rotate the trace file to <file>.1 at this size")
+	keep := fs.Int("keep", defaultTraceKeep, "Rotated trace files to keep")
+	pcap := fs.Bool("pcap", false, "Write a pcap capture for Wireshark instead of text")
+	outputFlag(fs)
+	if len(args) == 0 || args[0] == "" || args[0][0] == '-' {
+		fmt.Fprintln(os.Stderr, "usage: tut trace <forward> [-config path] [-for 10m] [-bytes 64] [-max-size 10MiB] [-keep 1] [-pcap] [-off]")
+		return 2
+	}
+	name := args[0]
+	_ = fs.Parse(args[1:])
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	token := apiClientToken(cfg.API, true)
+	path := "/v1/forwards/" + url.PathEscape(name) + "/untrace"
+	if *off {
+		var stopped struct {
+			File string `json:"file,omitempty"`
+		}
+		if err := apiRequest(cfg, token, http.MethodPost, path, &stopped); err != nil {
+			die("Cannot stop the trace: %v", err)
+		}
+		switch {
+		case jsonOutput():
+			printJSON(stopped)
+		case stopped.File == "":
+			fmt.Printf("%s was not being traced\n", name)
+		default:
+			fmt.Printf("Stopped tracing %s; the trace is in %s\n", name, stopped.File)
+		}
+		return 0
+	}
+	q := url.Values{"for": {dur.String()}, "bytes": {strconv.Itoa(*snippet)}, "max_size": {maxSize.String()}, "keep": {strconv.Itoa(*keep)}}
+	if *pcap {
+		q.Set("pcap", "1")
+	}
+	var started struct {
+		File  string    `json:"file"`
+		Until time.Time `json:"until"`
+	}
+	path = "/v1/forwards/" + url.PathEscape(name) + "/trace?" + q.Encode()
+	if err := apiRequest(cfg, token, http.MethodPost, path, &started); err != nil {
+		die("Cannot start the trace: %v", err)
+	}
+	if jsonOutput() {
+		printJSON(started)
+		return 0
+	}
+	fmt.Printf("Tracing %s into %s until %s (tut trace %s -off stops it)\n", name, started.File, started.Until.Format(time.RFC3339), name)
+	return 0
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// After health.path_report_after reconnects in a row failed, tut traces
+// the path to the VPS the way mtr does: a few rounds of probes with every
+// hop limit from 1 up, each hop reported with its address, loss and round
+// trips. The report goes with the tunnel-failed event, so the log shows
+// whether packets die at the home router, somewhere at the ISP or only at
+// the VPS. Probes are ICMP echo requests on a raw socket, which needs root
+// (or CAP_NET_RAW); on Linux without it they are UDP datagrams whose ICMP
+// errors the kernel reports to the unprivileged socket.
+
+const (
+	traceMaxHops = 30
+	traceRounds  = 3
+	traceTimeout = time.Second
+)
+
+// hopProbe sends one probe to dst with hop limit ttl and returns who
+// answered, whether it was dst itself, and the round trip.
+type hopProbe func(dst net.IP, ttl int, timeout time.Duration) (net.IP, bool, time.Duration, error)
+
+// hopStats sums up the answers for one hop limit.
+type hopStats struct {
+	addrs              []string // every address that answered, in order
+	sent, recv         int
+	total, best, worst time.Duration
+}
+
+func (h *hopStats) add(from net.IP, rtt time.Duration) {
+	h.recv++
+	h.total += rtt
+	if h.best == 0 || rtt < h.best {
+		h.best = rtt
+	}
+	if rtt > h.worst {
+		h.worst = rtt
+	}
+	for _, a := range h.addrs {
+		if a == from.String() {
+			return
+		}
+	}
+	h.addrs = append(h.addrs, from.String())
+}
+
+// pathReport traces the path to the VPS and formats it as a table.
+func pathReport(ctx context.Context, cfg *Config) (string, error) {
+	ip, err := resolvePingTarget(ctx, cfg, cfg.VPS.Host)
+	if err != nil {
+		return "", err
+	}
+	probe, method, err := pickHopProbe(ip)
+	if err != nil {
+		return "", err
+	}
+	hops := make([]hopStats, traceMaxHops+1)
+	last := traceMaxHops
+	for round := 0; round < traceRounds && ctx.Err() == nil; round++ {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for ttl := 1; ttl <= last; ttl++ {
+			wg.Add(1)
+			go func(ttl int) {
+				defer wg.Done()
+				from, reached, rtt, err := probe(ip, ttl, traceTimeout)
+				mu.Lock()
+				defer mu.Unlock()
+				hops[ttl].sent++
+				if err != nil || from == nil {
+					return
+				}
+				hops[ttl].add(from, rtt)
+				if reached && ttl < last {
+					last = ttl
+				}
+			}(ttl)
+		}
+		wg.Wait()
+	}
+	// silent hops after the last one that answered are shown as one
+	answered := 0
+	for ttl := 1; ttl <= last; ttl++ {
+		if hops[ttl].recv > 0 {
+			answered = ttl
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Path to %s (%s, %d rounds):", ip, method, traceRounds)
+	for ttl := 1; ttl <= answered; ttl++ {
+		h := hops[ttl]
+		if h.recv == 0 {
+			fmt.Fprintf(&b, "\n%3d  %-39s 100%% loss", ttl, "???")
+			continue
+		}
+		loss := 100 * (h.sent - h.recv) / h.sent
+		fmt.Fprintf(&b, "\n%3d  %-39s %3d%% loss  avg %.1f ms  best %.1f ms  worst %.1f ms", ttl, strings.Join(h.addrs, " "), loss,
+			millis(h.total/time.Duration(h.recv)), millis(h.best), millis(h.worst))
+	}
+	if answered < last {
+		fmt.Fprintf(&b, "\n%3d-%d  no answer", answered+1, last)
+	}
+	return b.String(), nil
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pickHopProbe returns the kind of probe this process can send.
+func pickHopProbe(dst net.IP) (hopProbe, string, error) {
+	c, err := rawICMPConn(dst.To4() != nil)
+	if err == nil {
+		_ = c.Close()
+		return icmpHop, "icmp", nil
+	}
+	if udpHopSupported {
+		return udpHop, "udp", nil
+	}
+	return nil, "", fmt.Errorf("tracing the path needs raw sockets: %w", err)
+}
+
+func rawICMPConn(v4 bool) (net.PacketConn, error) {
+	if v4 {
+		return net.ListenPacket("ip4:icmp", "")
+	}
+	return net.ListenPacket("ip6:ipv6-icmp", "")
+}
+
+// icmpHop sends an echo request with hop limit ttl on a raw socket and
+// waits for the reply or the time exceeded error of a router, recognized
+// by the echo request it quotes.
+func icmpHop(dst net.IP, ttl int, timeout time.Duration) (net.IP, bool, time.Duration, error) {
+	v4 := dst.To4() != nil
+	c, err := rawICMPConn(v4)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	defer c.Close()
+	raw, err := c.(*net.IPConn).SyscallConn()
+	if err != nil {
+		return nil, false, 0, err
+	}
+	var setErr error
+	if err := raw.Control(func(fd uintptr) { setErr = setHopLimit(fd, v4, ttl) }); err != nil {
+		return nil, false, 0, err
+	}
+	if setErr != nil {
+		return nil, false, 0, setErr
+	}
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	echo, reply, exceeded := byte(8), byte(0), byte(11)
+	if !v4 {
+		echo, reply, exceeded = 128, 129, 3
+	}
+	msg := []byte{echo, 0, 0, 0, id[0], id[1], 0, byte(ttl), 't', 'u', 't'}
+	if v4 {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	start := time.Now()
+	if _, err := c.WriteTo(msg, &net.IPAddr{IP: dst}); err != nil {
+		return nil, false, 0, err
+	}
+	_ = c.SetReadDeadline(start.Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			return nil, false, 0, err
+		}
+		b := buf[:n]
+		if v4 && len(b) >= 20 && b[0]>>4 == 4 {
+			b = b[int(b[0]&0x0f)*4:]
+		}
+		if len(b) < 8 {
+			continue
+		}
+		src := from.(*net.IPAddr).IP
+		switch {
+		case b[0] == reply && b[4] == id[0] && b[5] == id[1] && b[7] == byte(ttl):
+			return src, true, time.Since(start), nil
+		case b[0] == exceeded:
+			if q := quotedICMP(b[8:], v4); len(q) >= 8 && q[0] == echo && q[4] == id[0] && q[5] == id[1] && q[7] == byte(ttl) {
+				return src, false, time.Since(start), nil
+			}
+		}
+	}
+}
+
+// quotedICMP returns the ICMP header of the packet an ICMP error quotes.
+func quotedICMP(b []byte, v4 bool) []byte {
+	if v4 {
+		if len(b) < 20 {
+			return nil
+		}
+		return b[int(b[0]&0x0f)*4:]
+	}
+	if len(b) < 40 {
+		return nil
+	}
+	return b[40:]
+}
+
+// errNoHopProbe is returned where unprivileged UDP probes are not available.
+var errNoHopProbe = errors.New("no unprivileged path probes on this system")
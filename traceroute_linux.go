@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// udpHopSupported tells whether udpHop works without privileges.
+const udpHopSupported = true
+
+// Linux values not in package syscall.
+const (
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+	ipv6RecvErr     = 25
+)
+
+// udpHop sends a UDP datagram with hop limit ttl to a closed port of dst
+// and reads the ICMP error it causes from the error queue of the socket,
+// which IP_RECVERR makes available without privileges.
+func udpHop(dst net.IP, ttl int, timeout time.Duration) (net.IP, bool, time.Duration, error) {
+	v4 := dst.To4() != nil
+	family, level, recvErr := syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_RECVERR
+	if !v4 {
+		family, level, recvErr = syscall.AF_INET6, syscall.IPPROTO_IPV6, ipv6RecvErr
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	defer syscall.Close(fd)
+	if err := setHopLimit(uintptr(fd), v4, ttl); err != nil {
+		return nil, false, 0, err
+	}
+	if err := syscall.SetsockoptInt(fd, level, recvErr, 1); err != nil {
+		return nil, false, 0, err
+	}
+	var sa syscall.Sockaddr
+	if v4 {
+		a := &syscall.SockaddrInet4{Port: pingUDPPort + ttl}
+		copy(a.Addr[:], dst.To4())
+		sa = a
+	} else {
+		a := &syscall.SockaddrInet6{Port: pingUDPPort + ttl}
+		copy(a.Addr[:], dst.To16())
+		sa = a
+	}
+	start := time.Now()
+	if err := syscall.Sendto(fd, []byte("tut"), 0, sa); err != nil {
+		return nil, false, 0, err
+	}
+	buf, oob := make([]byte, 512), make([]byte, 512)
+	for {
+		left := time.Until(start.Add(timeout))
+		if left <= 0 {
+			return nil, false, 0, errors.New("timeout")
+		}
+		// an error in the queue makes the socket readable
+		var fds syscall.FdSet
+		bits := 8 * int(unsafe.Sizeof(fds.Bits[0]))
+		fds.Bits[fd/bits] |= 1 << (uint(fd) % uint(bits))
+		tv := syscall.NsecToTimeval(left.Nanoseconds())
+		if n, err := syscall.Select(fd+1, &fds, nil, nil, &tv); err != nil && err != syscall.EINTR {
+			return nil, false, 0, err
+		} else if n <= 0 {
+			continue
+		}
+		_, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+		if err != nil {
+			// no error queued: the port answered with data
+			if _, _, err := syscall.Recvfrom(fd, buf, syscall.MSG_DONTWAIT); err == nil {
+				return dst, true, time.Since(start), nil
+			}
+			continue
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Level != int32(level) || m.Header.Type != int32(recvErr) || len(m.Data) < 16 {
+				continue
+			}
+			// struct sock_extended_err, followed by the offender address
+			if origin := m.Data[4]; origin != soEEOriginICMP && origin != soEEOriginICMP6 {
+				continue
+			}
+			off := m.Data[16:]
+			var from net.IP
+			switch {
+			case v4 && len(off) >= 8:
+				from = net.IP(append([]byte(nil), off[4:8]...))
+			case !v4 && len(off) >= 24:
+				from = net.IP(append([]byte(nil), off[8:24]...))
+			default:
+				continue
+			}
+			return from, from.Equal(dst), time.Since(start), nil
+		}
+	}
+}
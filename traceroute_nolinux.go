@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// udpHopSupported tells whether udpHop works without privileges.
+const udpHopSupported = false
+
+func udpHop(net.IP, int, time.Duration) (net.IP, bool, time.Duration, error) {
+	return nil, false, 0, errNoHopProbe
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// setHopLimit sets the TTL or IPv6 hop limit of the socket fd.
+func setHopLimit(fd uintptr, v4 bool, ttl int) error {
+	if v4 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+}
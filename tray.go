@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// "tut tray" shows a status icon for the running daemon, for laptops where
+// tut runs in a terminal or as a user service. It is a client of the API
+// like "tut top"; the icon and its menu are drawn by the platform code in
+// runTray: a StatusNotifierItem on Linux, an NSStatusItem on macOS and a
+// notification area icon on Windows. Elsewhere the dashboard stands in.
+
+// trayStatus is the part of GET /v1/status the tray shows.
+type trayStatus struct {
+	Scope       string       `json:"scope"`
+	VPS         string       `json:"vps"`
+	SessionUp   bool         `json:"session_up"`
+	Reconnects  int64        `json:"reconnects"`
+	Connections int64        `json:"connections"`
+	Forwards    []apiForward `json:"forwards"`
+}
+
+// trayItem is an entry of the tray menu. Items without action are shown
+// disabled.
+type trayItem struct {
+	id        int32
+	label     string
+	separator bool
+	action    func() error
+	children  []trayItem
+}
+
+// tray holds the state of the daemon as last read and the menu built from
+// it.
+type tray struct {
+	cfg   *Config
+	token string
+	quit  func()
+
+	mu       sync.Mutex
+	status   *trayStatus // nil while the daemon cannot be reached
+	err      error
+	menu     []trayItem
+	actions  map[int32]func() error
+	revision uint32 // bumped whenever the menu changes
+	layout   string // fingerprint of the menu, to detect changes
+
+	changed chan struct{} // signalled after the menu or the icon changed
+}
+
+func runTrayCommand(args []string) int {
+	fs := flag.NewFlagSet("tray", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/tut/config.yaml", "Path to config file")
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tut tray [-config path] [-interval 2s]")
+		fmt.Fprintln(os.Stderr, "Linux desktops with a StatusNotifierItem tray, the macOS menu bar and the Windows notification area; elsewhere use the web dashboard (api.dashboard) or tut top.")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		die("Failed to load config: %v", err)
+	}
+	if cfg.API.Listen == "off" {
+		die("tut tray needs the API, which is off (api.listen)")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	t := &tray{cfg: cfg, token: apiClientToken(cfg.API, true), quit: cancel, changed: make(chan struct{}, 1)}
+	t.refresh()
+	go func() {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.refresh()
+			}
+		}
+	}()
+	if err := runTray(ctx, t); err != nil && ctx.Err() == nil {
+		die("tut tray: %v", err)
+	}
+	return 0
+}
+
+// refresh reads the status of the daemon and rebuilds the menu.
+func (t *tray) refresh() {
+	var st trayStatus
+	err := apiRequest(t.cfg, t.token, http.MethodGet, "/v1/status", &st)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.status, t.err = nil, err
+	} else {
+		t.status, t.err = &st, nil
+	}
+	t.actions = make(map[int32]func() error)
+	t.menu = t.build()
+	var b strings.Builder
+	fingerprint(&b, t.menu)
+	if layout := t.state() + "\n" + b.String(); layout != t.layout {
+		t.layout = layout
+		t.revision++
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// build returns the menu for the current status. Called with t.mu held.
+func (t *tray) build() []trayItem {
+	var id int32
+	item := func(label string, action func() error, children ...trayItem) trayItem {
+		id++
+		if action != nil {
+			t.actions[id] = action
+		}
+		return trayItem{id: id, label: label, action: action, children: children}
+	}
+	separator := func() trayItem {
+		id++
+		return trayItem{id: id, separator: true}
+	}
+	quit := item("Quit tray", func() error { t.quit(); return nil })
+	st := t.status
+	if st == nil {
+		return []trayItem{item("tut is not running ("+t.err.Error()+")", nil), separator(), quit}
+	}
+	admin := st.Scope == scopeAdmin
+	title := "Connected to " + st.VPS
+	if !st.SessionUp {
+		title = "Connecting to " + st.VPS
+	}
+	menu := []trayItem{
+		item(title, nil),
+		item(fmt.Sprintf("%d connections, %d reconnects", st.Connections, st.Reconnects), nil),
+		separator(),
+	}
+	for _, f := range st.Forwards {
+		label, state := f.Name+"  "+f.Public, ""
+		switch {
+		case f.Paused:
+			state = " (paused by " + f.PausedBy + ")"
+		case !f.Healthy:
+			state = " (unhealthy)"
+		}
+		toggle := item("Pause", nil)
+		held := f.Paused && f.PausedBy == "api"
+		if held {
+			toggle.label = "Resume"
+		}
+		if admin {
+			path := "/v1/forwards/" + url.PathEscape(f.Name) + "/pause"
+			if held {
+				path = "/v1/forwards/" + url.PathEscape(f.Name) + "/resume"
+			}
+			toggle.action = t.post(path)
+			t.actions[toggle.id] = toggle.action
+		}
+		menu = append(menu, item(label+state, nil,
+			item(fmt.Sprintf("%s, %d connections, %s transferred", f.Proto, f.Active, formatBytes(f.BytesIn+f.BytesOut)), nil),
+			toggle))
+	}
+	reconnect := item("Reconnect", nil)
+	if admin {
+		reconnect.action = t.post("/v1/reconnect")
+		t.actions[reconnect.id] = reconnect.action
+	}
+	return append(menu, separator(), reconnect, quit)
+}
+
+// post returns an action that posts to path.
+func (t *tray) post(path string) func() error {
+	return func() error {
+		return apiRequest(t.cfg, t.token, http.MethodPost, path, nil)
+	}
+}
+
+// fingerprint writes the labels and the enabled state of the items.
+func fingerprint(b *strings.Builder, items []trayItem) {
+	for _, it := range items {
+		fmt.Fprintf(b, "%d %q %v %v [", it.id, it.label, it.separator, it.action != nil)
+		fingerprint(b, it.children)
+		b.WriteString("]\n")
+	}
+}
+
+// activate runs the action of the item with id and refreshes the menu.
+func (t *tray) activate(id int32) {
+	t.mu.Lock()
+	action := t.actions[id]
+	t.mu.Unlock()
+	if action == nil {
+		return
+	}
+	go func() {
+		if err := action(); err != nil {
+			logf("tut tray: %v", err)
+		}
+		t.refresh()
+	}()
+}
+
+// state describes the tunnel for the icon: connected, connecting or
+// unreachable. Called with t.mu held.
+func (t *tray) state() string {
+	switch {
+	case t.status == nil:
+		return "unreachable"
+	case t.status.SessionUp:
+		return "connected"
+	}
+	return "connecting"
+}
+
+// title is the one-line summary shown as the tooltip or title of the icon.
+// Called with t.mu held.
+func (t *tray) title() string {
+	switch t.state() {
+	case "unreachable":
+		return "tut: not running"
+	case "connected":
+		return "tut: connected to " + t.status.VPS
+	}
+	return "tut: connecting to " + t.status.VPS
+}
@@ -0,0 +1,160 @@
+//go:build darwin
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// On macOS the tray icon is an NSStatusItem in the menu bar. Cocoa is only
+// reached from Go through cgo, which the release builds go without, so the
+// item is run by osascript with the JavaScript for Automation bridge to
+// Cocoa, like the Keychain is read with security: tut writes the title
+// and menu as a line of JSON to its stdin whenever they change, and it
+// prints the id of every item picked. It quits when its stdin closes.
+
+// trayScript is the JXA program behind the status item.
+const trayScript = `
+ObjC.import('Cocoa');
+var app = $.NSApplication.sharedApplication;
+app.setActivationPolicy(1); // NSApplicationActivationPolicyAccessory: no Dock icon
+var item = $.NSStatusBar.systemStatusBar.statusItemWithLength(-1);
+var stdout = $.NSFileHandle.fileHandleWithStandardOutput;
+var stdin = $.NSFileHandle.fileHandleWithStandardInput;
+var pending = '';
+ObjC.registerSubclass({
+	name: 'TutTray',
+	methods: {
+		'clicked:': {
+			types: ['void', ['id']],
+			implementation: function (sender) {
+				stdout.writeData($(sender.tag + '\n').dataUsingEncoding($.NSUTF8StringEncoding));
+			}
+		},
+		'read:': {
+			types: ['void', ['id']],
+			implementation: function (note) {
+				var data = note.userInfo.objectForKey($.NSFileHandleNotificationDataItem);
+				if (data.length == 0) {
+					app.terminate(null);
+					return;
+				}
+				pending += $.NSString.alloc.initWithDataEncoding(data, $.NSUTF8StringEncoding).js;
+				var lines = pending.split('\n');
+				pending = lines.pop();
+				if (lines.length > 0) {
+					show(JSON.parse(lines[lines.length - 1]));
+				}
+				stdin.readInBackgroundAndNotify;
+			}
+		}
+	}
+});
+var handler = $.TutTray.alloc.init;
+function build(items) {
+	var menu = $.NSMenu.alloc.init;
+	menu.autoenablesItems = false;
+	items.forEach(function (it) {
+		if (it.separator) {
+			menu.addItem($.NSMenuItem.separatorItem);
+			return;
+		}
+		var mi = $.NSMenuItem.alloc.initWithTitleActionKeyEquivalent(it.label, 'clicked:', '');
+		mi.tag = it.id;
+		mi.target = handler;
+		mi.enabled = it.enabled;
+		if (it.children) {
+			mi.submenu = build(it.children);
+		}
+		menu.addItem(mi);
+	});
+	return menu;
+}
+function show(u) {
+	item.button.title = u.icon;
+	item.button.toolTip = u.title;
+	item.menu = build(u.menu);
+}
+$.NSNotificationCenter.defaultCenter.addObserverSelectorNameObject(handler, 'read:', $.NSFileHandleReadCompletionNotification, stdin);
+stdin.readInBackgroundAndNotify;
+app.run;
+`
+
+// trayIcons are the menu bar titles of the states of the tunnel.
+var trayIcons = map[string]string{
+	"connected":   "tut ⇅",
+	"connecting":  "tut …",
+	"unreachable": "tut ✕",
+}
+
+// darwinTrayItem is a trayItem as the script reads it.
+type darwinTrayItem struct {
+	ID        int32            `json:"id"`
+	Label     string           `json:"label,omitempty"`
+	Separator bool             `json:"separator,omitempty"`
+	Enabled   bool             `json:"enabled"`
+	Children  []darwinTrayItem `json:"children,omitempty"`
+}
+
+func darwinTrayItems(items []trayItem) []darwinTrayItem {
+	out := make([]darwinTrayItem, 0, len(items))
+	for _, it := range items {
+		out = append(out, darwinTrayItem{ID: it.id, Label: it.label, Separator: it.separator,
+			Enabled: it.action != nil || len(it.children) > 0, Children: darwinTrayItems(it.children)})
+	}
+	return out
+}
+
+// runTray shows the icon until ctx is done or osascript exits.
+func runTray(ctx context.Context, t *tray) error {
+	cmd := exec.CommandContext(ctx, "osascript", "-l", "JavaScript", "-e", trayScript)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("osascript: %w", err)
+	}
+	go func() {
+		defer in.Close()
+		for {
+			t.mu.Lock()
+			b, _ := json.Marshal(map[string]any{"icon": trayIcons[t.state()], "title": t.title(), "menu": darwinTrayItems(t.menu)})
+			t.mu.Unlock()
+			if _, err := in.Write(append(b, '\n')); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.changed:
+			}
+		}
+	}()
+	picked := bufio.NewScanner(out)
+	for picked.Scan() {
+		// the script's own result is printed when it ends
+		if id, err := strconv.Atoi(picked.Text()); err == nil {
+			t.activate(int32(id))
+		}
+	}
+	_, _ = io.Copy(io.Discard, out)
+	if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("osascript: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
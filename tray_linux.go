@@ -0,0 +1,331 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// On Linux the tray icon is a StatusNotifierItem on the session bus with a
+// com.canonical.dbusmenu menu, which KDE, XFCE, waybar, GNOME with the
+// AppIndicator extension and most other panels show.
+
+const (
+	sniInterface  = "org.kde.StatusNotifierItem"
+	sniPath       = "/StatusNotifierItem"
+	sniWatcher    = "org.kde.StatusNotifierWatcher"
+	menuInterface = "com.canonical.dbusmenu"
+	menuPath      = "/MenuBar"
+)
+
+const trayIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.kde.StatusNotifierItem">
+    <property name="Category" type="s" access="read"/>
+    <property name="Id" type="s" access="read"/>
+    <property name="Title" type="s" access="read"/>
+    <property name="Status" type="s" access="read"/>
+    <property name="IconName" type="s" access="read"/>
+    <property name="Menu" type="o" access="read"/>
+    <property name="ItemIsMenu" type="b" access="read"/>
+    <method name="Activate"><arg name="x" type="i" direction="in"/><arg name="y" type="i" direction="in"/></method>
+    <method name="SecondaryActivate"><arg name="x" type="i" direction="in"/><arg name="y" type="i" direction="in"/></method>
+    <method name="ContextMenu"><arg name="x" type="i" direction="in"/><arg name="y" type="i" direction="in"/></method>
+    <method name="Scroll"><arg name="delta" type="i" direction="in"/><arg name="orientation" type="s" direction="in"/></method>
+    <signal name="NewTitle"/>
+    <signal name="NewIcon"/>
+    <signal name="NewStatus"><arg name="status" type="s"/></signal>
+  </interface>
+  <interface name="com.canonical.dbusmenu">
+    <property name="Version" type="u" access="read"/>
+    <property name="TextDirection" type="s" access="read"/>
+    <property name="Status" type="s" access="read"/>
+    <property name="IconThemePath" type="as" access="read"/>
+    <method name="GetLayout">
+      <arg name="parentId" type="i" direction="in"/>
+      <arg name="recursionDepth" type="i" direction="in"/>
+      <arg name="propertyNames" type="as" direction="in"/>
+      <arg name="revision" type="u" direction="out"/>
+      <arg name="layout" type="(ia{sv}av)" direction="out"/>
+    </method>
+    <method name="GetGroupProperties">
+      <arg name="ids" type="ai" direction="in"/>
+      <arg name="propertyNames" type="as" direction="in"/>
+      <arg name="properties" type="a(ia{sv})" direction="out"/>
+    </method>
+    <method name="GetProperty">
+      <arg name="id" type="i" direction="in"/>
+      <arg name="name" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="Event">
+      <arg name="id" type="i" direction="in"/>
+      <arg name="eventId" type="s" direction="in"/>
+      <arg name="data" type="v" direction="in"/>
+      <arg name="timestamp" type="u" direction="in"/>
+    </method>
+    <method name="AboutToShow">
+      <arg name="id" type="i" direction="in"/>
+      <arg name="needUpdate" type="b" direction="out"/>
+    </method>
+    <method name="AboutToShowGroup">
+      <arg name="ids" type="ai" direction="in"/>
+      <arg name="updatesNeeded" type="ai" direction="out"/>
+      <arg name="idErrors" type="ai" direction="out"/>
+    </method>
+    <signal name="LayoutUpdated"><arg name="revision" type="u"/><arg name="parent" type="i"/></signal>
+  </interface>
+</node>`
+
+// runTray shows the icon until ctx is done or the session bus goes away.
+// It registers again whenever the tray host restarts.
+func runTray(ctx context.Context, t *tray) error {
+	c, err := dialDBus("session")
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = c.conn.Close()
+	}()
+
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		return err
+	}
+	if _, err := c.reply(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("org.kde.StatusNotifierItem-%d-1", os.Getpid())
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "RequestName", "su", name, uint32(4)); err != nil {
+		return err
+	}
+	if _, err := c.reply(); err != nil {
+		return err
+	}
+	if err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s",
+		"type='signal',interface='org.freedesktop.DBus',member='NameOwnerChanged',arg0='"+sniWatcher+"'"); err != nil {
+		return err
+	}
+	if _, err := c.reply(); err != nil {
+		return err
+	}
+	// The reply is not waited for: the host calls back before it answers.
+	// A failed registration arrives as an error in the loop below.
+	register := func() error {
+		return c.call(sniWatcher, "/StatusNotifierWatcher", sniWatcher, "RegisterStatusNotifierItem", "s", name)
+	}
+	if err := register(); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.changed:
+			}
+			t.mu.Lock()
+			revision, status := t.revision, t.state()
+			t.mu.Unlock()
+			_ = c.signal(sniPath, sniInterface, "NewIcon", "")
+			_ = c.signal(sniPath, sniInterface, "NewTitle", "")
+			_ = c.signal(sniPath, sniInterface, "NewStatus", "s", sniStatus(status))
+			_ = c.signal(menuPath, menuInterface, "LayoutUpdated", "ui", revision, int32(0))
+		}
+	}()
+	for {
+		m, err := c.read()
+		if err != nil {
+			return err
+		}
+		switch m.typ {
+		case dbusMethodCall:
+			c.handleTray(t, m)
+		case dbusError:
+			msg, _ := m.body.string()
+			if m.errorName == "org.freedesktop.DBus.Error.ServiceUnknown" {
+				return fmt.Errorf("no tray on the session bus (%s is not running); on GNOME install the AppIndicator extension", sniWatcher)
+			}
+			return fmt.Errorf("%s: %s", m.errorName, msg)
+		case dbusSignal:
+			if m.member != "NameOwnerChanged" {
+				continue
+			}
+			_, _ = m.body.string()
+			_, _ = m.body.string()
+			if owner, _ := m.body.string(); owner != "" {
+				if err := register(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// sniStatus maps the state of the tunnel to a StatusNotifierItem status.
+func sniStatus(state string) string {
+	if state == "connected" {
+		return "Active"
+	}
+	return "NeedsAttention"
+}
+
+// trayProperties returns the properties of the object at path.
+func trayProperties(t *tray, iface string) map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch iface {
+	case sniInterface:
+		icon := map[string]string{
+			"connected":   "network-transmit-receive",
+			"connecting":  "network-offline",
+			"unreachable": "network-error",
+		}[t.state()]
+		return map[string]any{
+			"Category":   "ApplicationStatus",
+			"Id":         "tut",
+			"Title":      t.title(),
+			"Status":     sniStatus(t.state()),
+			"IconName":   icon,
+			"Menu":       dbusObjectPath(menuPath),
+			"ItemIsMenu": true,
+		}
+	case menuInterface:
+		return map[string]any{
+			"Version":       uint32(3),
+			"TextDirection": "ltr",
+			"Status":        "normal",
+			"IconThemePath": []string{},
+		}
+	}
+	return nil
+}
+
+// handleTray answers a call to the item or its menu.
+func (c *dbusConn) handleTray(t *tray, m *dbusMessage) {
+	fail := func(name, msg string) {
+		_ = c.send(dbusError, m, "s", map[byte]any{4: name}, msg)
+	}
+	switch m.iface + "." + m.member {
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		_ = c.send(dbusMethodReturn, m, "s", nil, trayIntrospection)
+	case "org.freedesktop.DBus.Peer.Ping":
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	case "org.freedesktop.DBus.Properties.Get":
+		iface, _ := m.body.string()
+		name, _ := m.body.string()
+		v, ok := trayProperties(t, iface)[name]
+		if !ok {
+			fail("org.freedesktop.DBus.Error.UnknownProperty", "no property "+name)
+			return
+		}
+		_ = c.send(dbusMethodReturn, m, "v", nil, dbusVariant{v})
+	case "org.freedesktop.DBus.Properties.GetAll":
+		iface, _ := m.body.string()
+		props := trayProperties(t, iface)
+		if props == nil {
+			props = map[string]any{}
+		}
+		_ = c.send(dbusMethodReturn, m, "a{sv}", nil, props)
+	case sniInterface + ".Activate", sniInterface + ".SecondaryActivate", sniInterface + ".ContextMenu", sniInterface + ".Scroll":
+		// the menu is all there is; hosts open it themselves (ItemIsMenu)
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	case menuInterface + ".GetLayout":
+		parent, _ := m.body.int32()
+		depth, _ := m.body.int32()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		root := trayItem{children: t.menu}
+		if parent != 0 {
+			it, ok := findTrayItem(t.menu, parent)
+			if !ok {
+				fail("org.freedesktop.DBus.Error.InvalidArgs", "no menu item "+fmt.Sprint(parent))
+				return
+			}
+			root = it
+		}
+		_ = c.send(dbusMethodReturn, m, "u(ia{sv}av)", nil, t.revision, menuLayout(root, depth))
+	case menuInterface + ".GetGroupProperties":
+		ids, _ := m.body.int32s()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		out := []dbusStruct{}
+		for _, id := range ids {
+			if it, ok := findTrayItem(t.menu, id); ok {
+				out = append(out, dbusStruct{it.id, menuProperties(it)})
+			}
+		}
+		_ = c.send(dbusMethodReturn, m, "a(ia{sv})", nil, out)
+	case menuInterface + ".GetProperty":
+		id, _ := m.body.int32()
+		name, _ := m.body.string()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		it, _ := findTrayItem(t.menu, id)
+		v, ok := menuProperties(it)[name]
+		if !ok {
+			fail("org.freedesktop.DBus.Error.InvalidArgs", "no property "+name)
+			return
+		}
+		_ = c.send(dbusMethodReturn, m, "v", nil, dbusVariant{v})
+	case menuInterface + ".Event":
+		id, _ := m.body.int32()
+		if event, _ := m.body.string(); event == "clicked" {
+			t.activate(id)
+		}
+		_ = c.send(dbusMethodReturn, m, "", nil)
+	case menuInterface + ".AboutToShow":
+		_ = c.send(dbusMethodReturn, m, "b", nil, false)
+	case menuInterface + ".AboutToShowGroup":
+		_ = c.send(dbusMethodReturn, m, "aiai", nil, []int32{}, []int32{})
+	default:
+		// clients fall back to Event when EventGroup is unknown
+		fail("org.freedesktop.DBus.Error.UnknownMethod", "unknown method "+m.iface+"."+m.member)
+	}
+}
+
+// findTrayItem returns the item with id.
+func findTrayItem(items []trayItem, id int32) (trayItem, bool) {
+	for _, it := range items {
+		if it.id == id {
+			return it, true
+		}
+		if found, ok := findTrayItem(it.children, id); ok {
+			return found, true
+		}
+	}
+	return trayItem{}, false
+}
+
+// menuProperties returns the dbusmenu properties of an item.
+func menuProperties(it trayItem) map[string]any {
+	if it.separator {
+		return map[string]any{"type": "separator"}
+	}
+	p := map[string]any{"label": it.label, "enabled": it.action != nil || len(it.children) > 0}
+	if len(it.children) > 0 {
+		p["children-display"] = "submenu"
+	}
+	return p
+}
+
+// menuLayout returns the (ia{sv}av) layout of it and its children down to
+// depth levels, all of them for a negative depth.
+func menuLayout(it trayItem, depth int32) dbusStruct {
+	children := []dbusVariant{}
+	if depth != 0 {
+		for _, child := range it.children {
+			children = append(children, dbusVariant{menuLayout(child, depth-1)})
+		}
+	}
+	props := menuProperties(it)
+	if it.id == 0 {
+		props = map[string]any{"children-display": "submenu"}
+	}
+	return dbusStruct{it.id, props, children}
+}
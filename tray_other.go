@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// runTray reports that the tray icon is not available: there is one for
+// Linux desktops, the macOS menu bar and the Windows notification area.
+// The web dashboard offers the same controls elsewhere.
+func runTray(ctx context.Context, t *tray) error {
+	return errors.New("the tray icon is only available on Linux, macOS and Windows; use the web dashboard (api.dashboard) or tut top")
+}
@@ -0,0 +1,260 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// On Windows the tray icon is a notification area icon (Shell_NotifyIcon)
+// owned by a hidden window, whose message loop runs on one locked thread.
+// Clicking the icon opens the menu as a popup menu; a restarted Explorer
+// gets the icon again through the TaskbarCreated message.
+
+var (
+	kernel32                   = syscall.NewLazyDLL("kernel32.dll")
+	user32                     = syscall.NewLazyDLL("user32.dll")
+	shell32                    = syscall.NewLazyDLL("shell32.dll")
+	procShellNotifyIconW       = shell32.NewProc("Shell_NotifyIconW")
+	procRegisterClassExW       = user32.NewProc("RegisterClassExW")
+	procCreateWindowExW        = user32.NewProc("CreateWindowExW")
+	procDefWindowProcW         = user32.NewProc("DefWindowProcW")
+	procDestroyWindow          = user32.NewProc("DestroyWindow")
+	procGetMessageW            = user32.NewProc("GetMessageW")
+	procTranslateMessage       = user32.NewProc("TranslateMessage")
+	procDispatchMessageW       = user32.NewProc("DispatchMessageW")
+	procPostMessageW           = user32.NewProc("PostMessageW")
+	procPostQuitMessage        = user32.NewProc("PostQuitMessage")
+	procRegisterWindowMessageW = user32.NewProc("RegisterWindowMessageW")
+	procLoadIconW              = user32.NewProc("LoadIconW")
+	procCreatePopupMenu        = user32.NewProc("CreatePopupMenu")
+	procAppendMenuW            = user32.NewProc("AppendMenuW")
+	procDestroyMenu            = user32.NewProc("DestroyMenu")
+	procTrackPopupMenu         = user32.NewProc("TrackPopupMenu")
+	procSetForegroundWindow    = user32.NewProc("SetForegroundWindow")
+	procGetCursorPos           = user32.NewProc("GetCursorPos")
+	procGetModuleHandleW       = kernel32.NewProc("GetModuleHandleW")
+)
+
+// Window messages, Shell_NotifyIcon commands and flags, menu flags and
+// stock icons of the Win32 API.
+const (
+	wmNull        = 0x0000
+	wmDestroy     = 0x0002
+	wmClose       = 0x0010
+	wmLButtonUp   = 0x0202
+	wmRButtonUp   = 0x0205
+	wmApp         = 0x8000
+	wmTrayIcon    = wmApp + 1 // the icon was clicked
+	wmTrayChanged = wmApp + 2 // the icon or the menu changed
+
+	nimAdd     = 0
+	nimModify  = 1
+	nimDelete  = 2
+	nifMessage = 0x1
+	nifIcon    = 0x2
+	nifTip     = 0x4
+
+	mfString    = 0x0
+	mfGrayed    = 0x1
+	mfPopup     = 0x10
+	mfSeparator = 0x800
+
+	tpmRightButton = 0x2
+	tpmNoNotify    = 0x80
+	tpmReturnCmd   = 0x100
+
+	idiApplication = 32512
+	idiError       = 32513
+	idiWarning     = 32515
+)
+
+// notifyIconData mirrors NOTIFYICONDATAW.
+type notifyIconData struct {
+	Size            uint32
+	Wnd             uintptr
+	ID              uint32
+	Flags           uint32
+	CallbackMessage uint32
+	Icon            uintptr
+	Tip             [128]uint16
+	State           uint32
+	StateMask       uint32
+	Info            [256]uint16
+	Version         uint32
+	InfoTitle       [64]uint16
+	InfoFlags       uint32
+	GUIDItem        [16]byte
+	BalloonIcon     uintptr
+}
+
+// wndClassEx mirrors WNDCLASSEXW.
+type wndClassEx struct {
+	Size       uint32
+	Style      uint32
+	WndProc    uintptr
+	ClsExtra   int32
+	WndExtra   int32
+	Instance   uintptr
+	Icon       uintptr
+	Cursor     uintptr
+	Background uintptr
+	MenuName   *uint16
+	ClassName  *uint16
+	IconSm     uintptr
+}
+
+// winPoint mirrors POINT.
+type winPoint struct{ X, Y int32 }
+
+// winMsg mirrors MSG.
+type winMsg struct {
+	Hwnd     uintptr
+	Message  uint32
+	WParam   uintptr
+	LParam   uintptr
+	Time     uint32
+	Pt       winPoint
+	LPrivate uint32
+}
+
+// runTray shows the icon until ctx is done.
+func runTray(ctx context.Context, t *tray) error {
+	// the window belongs to the thread that created it, and only that
+	// thread receives its messages
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	instance, _, _ := procGetModuleHandleW.Call(0)
+	className, _ := syscall.UTF16PtrFromString("tut-tray")
+	taskbarName, _ := syscall.UTF16PtrFromString("TaskbarCreated")
+	taskbarCreated, _, _ := procRegisterWindowMessageW.Call(uintptr(unsafe.Pointer(taskbarName)))
+
+	nid := notifyIconData{ID: 1, Flags: nifMessage | nifIcon | nifTip, CallbackMessage: wmTrayIcon}
+	nid.Size = uint32(unsafe.Sizeof(nid))
+	// show updates the icon and its tooltip; add puts it into the
+	// notification area first
+	show := func(add bool) {
+		t.mu.Lock()
+		state, title := t.state(), t.title()
+		t.mu.Unlock()
+		icon := map[string]uintptr{"connected": idiApplication, "connecting": idiWarning, "unreachable": idiError}[state]
+		nid.Icon, _, _ = procLoadIconW.Call(0, icon)
+		tip, _ := syscall.UTF16FromString(title)
+		if len(tip) > len(nid.Tip) {
+			tip = append(tip[:len(nid.Tip)-1], 0)
+		}
+		nid.Tip = [128]uint16{}
+		copy(nid.Tip[:], tip)
+		cmd := uintptr(nimModify)
+		if add {
+			cmd = nimAdd
+		}
+		procShellNotifyIconW.Call(cmd, uintptr(unsafe.Pointer(&nid)))
+	}
+	wndProc := func(h, msg, wparam, lparam uintptr) uintptr {
+		switch {
+		case msg == wmTrayIcon && (lparam == wmLButtonUp || lparam == wmRButtonUp):
+			if id := popupTrayMenu(h, t); id != 0 {
+				t.activate(id)
+			}
+			return 0
+		case msg == wmTrayChanged:
+			show(false)
+			return 0
+		case msg == taskbarCreated && taskbarCreated != 0:
+			show(true)
+			return 0
+		case msg == wmClose:
+			procDestroyWindow.Call(h)
+			return 0
+		case msg == wmDestroy:
+			procShellNotifyIconW.Call(nimDelete, uintptr(unsafe.Pointer(&nid)))
+			procPostQuitMessage.Call(0)
+			return 0
+		}
+		r, _, _ := procDefWindowProcW.Call(h, msg, wparam, lparam)
+		return r
+	}
+	wc := wndClassEx{WndProc: syscall.NewCallback(wndProc), Instance: instance, ClassName: className}
+	wc.Size = uint32(unsafe.Sizeof(wc))
+	if r, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&wc))); r == 0 {
+		return fmt.Errorf("RegisterClassEx: %v", err)
+	}
+	// a top-level window that is never shown: a message-only window could
+	// not take the foreground, which the popup menu needs to close again
+	hwnd, _, err := procCreateWindowExW.Call(0, uintptr(unsafe.Pointer(className)), uintptr(unsafe.Pointer(className)),
+		0, 0, 0, 0, 0, 0, 0, instance, 0)
+	if hwnd == 0 {
+		return fmt.Errorf("CreateWindowEx: %v", err)
+	}
+	nid.Wnd = hwnd
+	show(true)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				procPostMessageW.Call(hwnd, wmClose, 0, 0)
+				return
+			case <-t.changed:
+				procPostMessageW.Call(hwnd, wmTrayChanged, 0, 0)
+			}
+		}
+	}()
+	var msg winMsg
+	for {
+		r, _, err := procGetMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0)
+		switch int32(r) {
+		case 0:
+			return nil
+		case -1:
+			return fmt.Errorf("GetMessage: %v", err)
+		}
+		procTranslateMessage.Call(uintptr(unsafe.Pointer(&msg)))
+		procDispatchMessageW.Call(uintptr(unsafe.Pointer(&msg)))
+	}
+}
+
+// popupTrayMenu shows the menu at the mouse pointer and returns the id of
+// the item picked, 0 for none.
+func popupTrayMenu(hwnd uintptr, t *tray) int32 {
+	t.mu.Lock()
+	menu := buildTrayMenu(t.menu)
+	t.mu.Unlock()
+	defer procDestroyMenu.Call(menu)
+	var pt winPoint
+	procGetCursorPos.Call(uintptr(unsafe.Pointer(&pt)))
+	// without the foreground the menu stays open when clicking elsewhere
+	procSetForegroundWindow.Call(hwnd)
+	id, _, _ := procTrackPopupMenu.Call(menu, tpmRightButton|tpmReturnCmd|tpmNoNotify,
+		uintptr(pt.X), uintptr(pt.Y), 0, hwnd, 0)
+	procPostMessageW.Call(hwnd, wmNull, 0, 0)
+	return int32(id)
+}
+
+// buildTrayMenu returns a popup menu of items; destroying it destroys its
+// submenus as well.
+func buildTrayMenu(items []trayItem) uintptr {
+	menu, _, _ := procCreatePopupMenu.Call()
+	for _, it := range items {
+		if it.separator {
+			procAppendMenuW.Call(menu, mfSeparator, 0, 0)
+			continue
+		}
+		label, _ := syscall.UTF16PtrFromString(it.label)
+		flags, id := uintptr(mfString), uintptr(it.id)
+		switch {
+		case len(it.children) > 0:
+			flags, id = mfPopup, buildTrayMenu(it.children)
+		case it.action == nil:
+			flags |= mfGrayed
+		}
+		procAppendMenuW.Call(menu, flags, id, uintptr(unsafe.Pointer(label)))
+	}
+	return menu
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With tun.enabled, tut and the agent on the VPS each create a TUN
+// interface and carry the IP packets between them through the tunnel, for
+// users who need full IP connectivity rather than per-port forwards. Each
+// side routes the networks behind the other one through its interface:
+// tun.routes are reached through the VPS, tun.remote_routes through this
+// host. Packets are framed like the datagrams of framing: length. The agent
+// connects to the local end through a remote forward of tun.tunnel_port and
+// reconnects whenever the session is replaced; meanwhile packets are
+// dropped, as on a link that is down. Creating the interfaces needs root or
+// CAP_NET_ADMIN on both sides, and Linux, see tun_linux.go.
+
+// tunHello is the first frame of the agent's connection, so that another
+// process on the VPS connecting to the forwarded port does not take over
+// the link.
+const tunHello = "tut tun 1"
+
+// validateTUN checks the TUN settings.
+func validateTUN(c *Config) error {
+	t := c.TUN
+	if !t.Enabled {
+		return nil
+	}
+	if len(t.Name) > 15 || strings.ContainsAny(t.Name, "/ \t\n") || t.Name == "." || t.Name == ".." {
+		return fmt.Errorf("invalid tun.name: %q", t.Name)
+	}
+	local, localNet, err := net.ParseCIDR(t.LocalAddress)
+	if err != nil {
+		return fmt.Errorf("invalid tun.local_address: %q (an address with prefix length, e.g. 10.77.0.2/30)", t.LocalAddress)
+	}
+	remote, _, err := net.ParseCIDR(t.RemoteAddress)
+	if err != nil {
+		return fmt.Errorf("invalid tun.remote_address: %q (an address with prefix length, e.g. 10.77.0.1/30)", t.RemoteAddress)
+	}
+	if local.Equal(remote) || !localNet.Contains(remote) {
+		return fmt.Errorf("tun.local_address %s and tun.remote_address %s must be different addresses of one network", t.LocalAddress, t.RemoteAddress)
+	}
+	if _, err := parseNets(t.Routes); err != nil {
+		return fmt.Errorf("tun.routes: %w", err)
+	}
+	if _, err := parseNets(t.RemoteRoutes); err != nil {
+		return fmt.Errorf("tun.remote_routes: %w", err)
+	}
+	if t.MTU < 576 || t.MTU > 0xFFFF {
+		return fmt.Errorf("invalid tun.mtu: %d (576 to 65535)", t.MTU)
+	}
+	if !isPort(t.TunnelPort) {
+		return fmt.Errorf("invalid tun.tunnel_port: %d", t.TunnelPort)
+	}
+	if c.TURN.Enabled && c.TURN.TunnelPort == t.TunnelPort {
+		return fmt.Errorf("tun.tunnel_port %d is turn.tunnel_port", t.TunnelPort)
+	}
+	for _, u := range c.UDPForwards {
+		if u.WrapTCPPort == t.TunnelPort {
+			return fmt.Errorf("tun.tunnel_port %d is the wrap_tcp_port of %s", t.TunnelPort, u.Name)
+		}
+	}
+	return nil
+}
+
+// tunPump carries the packets of a TUN interface over the current
+// connection to the other side.
+type tunPump struct {
+	dev *os.File
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// attach makes conn the connection packets go out on and closes the one
+// before it.
+func (p *tunPump) attach(conn net.Conn) {
+	p.mu.Lock()
+	old := p.conn
+	p.conn = conn
+	p.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+// inbound writes the packets arriving on conn to the interface until conn
+// fails.
+func (p *tunPump) inbound(conn net.Conn, br *bufio.Reader) {
+	defer func() {
+		_ = conn.Close()
+		p.mu.Lock()
+		if p.conn == conn {
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}()
+	for {
+		b, err := readFrame(br)
+		if err != nil {
+			return
+		}
+		_, _ = p.dev.Write(b) // a packet the kernel refuses is lost like on a wire
+	}
+}
+
+// outbound sends the packets read from the interface over the current
+// connection until the interface is closed. Without a connection they are
+// dropped.
+func (p *tunPump) outbound() {
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := p.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		conn := p.conn
+		p.mu.Unlock()
+		if conn != nil && writeLenPrefixed(conn, buf[:n]) != nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+// tunLink is the local end of the TUN link: the interface and the listener
+// the agent connects to through the tunnel.
+type tunLink struct {
+	ln   net.Listener
+	pump *tunPump
+}
+
+// startTUN creates and configures the local interface and listens on
+// tun.tunnel_port when TUN mode is enabled.
+func startTUN(cfg *Config) (*tunLink, error) {
+	t := cfg.TUN
+	if !t.Enabled {
+		return nil, nil
+	}
+	dev, err := openTUN(t.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureTUN(t.Name, t.LocalAddress, t.MTU, t.Routes); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", t.TunnelPort))
+	if err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+	l := &tunLink{ln: ln, pump: &tunPump{dev: dev}}
+	go l.serve()
+	go l.pump.outbound()
+	logf("TUN interface %s up as %s, the VPS is %s", t.Name, t.LocalAddress, t.RemoteAddress)
+	return l, nil
+}
+
+func (l *tunLink) close() {
+	if l == nil {
+		return
+	}
+	_ = l.ln.Close()
+	l.pump.attach(nil)
+	_ = l.pump.dev.Close()
+}
+
+// serve accepts the connections of the agent; the newest one carries the
+// link.
+func (l *tunLink) serve() {
+	for {
+		c, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			br := newFrameReader(c)
+			_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			hello, err := readFrame(br)
+			if err != nil || string(hello) != tunHello {
+				_ = c.Close()
+				return
+			}
+			_ = c.SetReadDeadline(time.Time{})
+			logEvent(levelInfo, "", "tun-up", "The VPS end of the TUN link connected")
+			l.pump.attach(c)
+			l.pump.inbound(c, br)
+		}()
+	}
+}
+
+// runAgentTUN implements "tut agent tun", the VPS end of the TUN link.
+func runAgentTUN(args []string) int {
+	fs := flag.NewFlagSet("agent tun", flag.ExitOnError)
+	name := fs.String("name", "tut0", "Name of the interface")
+	address := fs.String("address", "", "Address of the interface, with prefix length")
+	mtu := fs.Int("mtu", 1400, "MTU of the interface")
+	routes := fs.String("routes", "", "Comma-separated networks to route through the interface")
+	connect := fs.String("connect", "", "Tunnel port to connect to")
+	_ = fs.Parse(args)
+	if *address == "" || *connect == "" {
+		fmt.Fprintln(os.Stderr, "usage: tut agent tun -address addr/len -connect addr [-name tut0] [-mtu 1400] [-routes net,...]")
+		return 2
+	}
+	var nets []string
+	if *routes != "" {
+		nets = strings.Split(*routes, ",")
+	}
+	dev, err := openTUN(*name)
+	if err == nil {
+		err = configureTUN(*name, *address, *mtu, nets)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("TUN interface %s up as %s", *name, *address)
+	p := &tunPump{dev: dev}
+	go p.outbound()
+	for {
+		err := tunConnect(p, *connect)
+		logf("TUN link: %v, reconnecting", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// tunConnect connects the agent's end of the link to the local end and
+// carries packets until the connection fails.
+func tunConnect(p *tunPump, addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := writeLenPrefixed(conn, []byte(tunHello)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.attach(conn)
+	p.inbound(conn, newFrameReader(conn))
+	return errors.New("connection closed")
+}
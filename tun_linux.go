@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/if_tun.h.
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+// openTUN creates the TUN interface name, without packet information
+// headers, and returns its descriptor. The interface goes away when the
+// descriptor is closed.
+func openTUN(name string) (*os.File, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening /dev/net/tun: %w", err)
+	}
+	var ifr [40]byte // struct ifreq
+	copy(ifr[:15], name)
+	*(*uint16)(unsafe.Pointer(&ifr[16])) = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("creating %s (tut needs root or CAP_NET_ADMIN): %w", name, errno)
+	}
+	// non-blocking, so that the runtime poller serves reads and Close ends them
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+// configureTUN gives the interface name its address and MTU, brings it up
+// and routes nets through it, with ip(8).
+func configureTUN(name, address string, mtu int, nets []string) error {
+	cmds := [][]string{
+		{"addr", "replace", address, "dev", name},
+		{"link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up"},
+	}
+	for _, n := range nets {
+		cmds = append(cmds, []string{"route", "replace", n, "dev", name})
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// openTUN is only implemented on Linux.
+func openTUN(name string) (*os.File, error) {
+	return nil, errors.New("TUN mode needs Linux")
+}
+
+// configureTUN is only implemented on Linux.
+func configureTUN(name, address string, mtu int, nets []string) error {
+	return errors.New("TUN mode needs Linux")
+}
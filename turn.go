@@ -0,0 +1,927 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The TURN server (RFC 8656, UDP transport, IPv4) runs on the VPS as
+// "tut agent turn". Allocations relay to public peers from the VPS itself;
+// peers in turn.local_peers are local WebRTC applications, and datagrams
+// for them are carried through the SSH tunnel to the turn bridge of tut,
+// which sends them on from the local network (see turn_bridge.go).
+
+const (
+	turnDefaultLifetime = 10 * time.Minute
+	turnMaxLifetime     = time.Hour
+	turnPermission      = 5 * time.Minute
+	turnChannel         = 10 * time.Minute
+	turnNonceLifetime   = time.Hour
+)
+
+// STUN methods and classes, combined into the message type.
+const (
+	methodBinding          = 0x001
+	methodAllocate         = 0x003
+	methodRefresh          = 0x004
+	methodSend             = 0x006
+	methodData             = 0x007
+	methodCreatePermission = 0x008
+	methodChannelBind      = 0x009
+
+	classRequest    = 0x000
+	classIndication = 0x010
+	classSuccess    = 0x100
+	classError      = 0x110
+)
+
+// STUN and TURN attributes.
+const (
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrUnknownAttributes  = 0x000A
+	attrChannelNumber      = 0x000C
+	attrLifetime           = 0x000D
+	attrXorPeerAddress     = 0x0012
+	attrData               = 0x0013
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXorRelayedAddress  = 0x0016
+	attrRequestedFamily    = 0x0017
+	attrRequestedTransport = 0x0019
+	attrDontFragment       = 0x001A
+	attrXorMappedAddress   = 0x0020
+	attrPriority           = 0x0024
+	attrUseCandidate       = 0x0025
+	attrSoftware           = 0x8022
+	attrFingerprint        = 0x8028
+)
+
+// agentTURNConfig is the TURN config tut writes next to the agent.
+type agentTURNConfig struct {
+	Port       int               `json:"port"`
+	Realm      string            `json:"realm"`
+	Secret     string            `json:"secret,omitempty"`
+	Users      map[string]string `json:"users,omitempty"`
+	RelayPorts string            `json:"relay_ports"`
+	ExternalIP string            `json:"external_ip"`
+	LocalPeers []string          `json:"local_peers"`
+	Tunnel     string            `json:"tunnel"` // end of the tunnel to the turn bridge
+}
+
+// turnAgentConfig builds the agent's TURN config from cfg.
+func turnAgentConfig(cfg *Config) (agentTURNConfig, error) {
+	t := cfg.TURN
+	ip := t.ExternalIP
+	if ip == "" {
+		ips, err := net.LookupIP(cfg.VPS.Host)
+		if err != nil {
+			return agentTURNConfig{}, fmt.Errorf("resolving the VPS address for TURN: %w", err)
+		}
+		for _, a := range ips {
+			if a.To4() != nil {
+				ip = a.String()
+				break
+			}
+		}
+		if ip == "" {
+			return agentTURNConfig{}, fmt.Errorf("%s has no IPv4 address: set turn.external_ip", cfg.VPS.Host)
+		}
+	}
+	return agentTURNConfig{
+		Port:       t.Port,
+		Realm:      t.Realm,
+		Secret:     t.Secret,
+		Users:      t.Users,
+		RelayPorts: t.RelayPorts,
+		ExternalIP: ip,
+		LocalPeers: t.LocalPeers,
+		Tunnel:     fmt.Sprintf("127.0.0.1:%d", t.TunnelPort),
+	}, nil
+}
+
+// validateTURN checks the TURN settings.
+func validateTURN(c *Config) error {
+	t := c.TURN
+	if !t.Enabled {
+		return nil
+	}
+	if t.Secret == "" && len(t.Users) == 0 {
+		return errors.New("turn needs a secret or users")
+	}
+	if !isPort(t.Port) || !isPort(t.TunnelPort) {
+		return fmt.Errorf("invalid turn.port or turn.tunnel_port: %d, %d", t.Port, t.TunnelPort)
+	}
+	lo, hi, err := parsePortRange(t.RelayPorts)
+	if err != nil {
+		return fmt.Errorf("turn.relay_ports: %w", err)
+	}
+	if t.Port >= lo && t.Port <= hi {
+		return fmt.Errorf("turn.port %d is within turn.relay_ports", t.Port)
+	}
+	if t.ExternalIP != "" && net.ParseIP(t.ExternalIP).To4() == nil {
+		return fmt.Errorf("invalid turn.external_ip: %q", t.ExternalIP)
+	}
+	if _, err := parseNets(t.LocalPeers); err != nil {
+		return fmt.Errorf("turn.local_peers: %w", err)
+	}
+	for _, u := range c.UDPForwards {
+		if u.WrapTCPPort == t.TunnelPort {
+			return fmt.Errorf("turn.tunnel_port %d is the wrap_tcp_port of %s", t.TunnelPort, u.Name)
+		}
+		if u.UDPPublicPort == t.Port || (u.UDPPublicPort >= lo && u.UDPPublicPort <= hi) {
+			return fmt.Errorf("udp_public_port %d of %s is used by TURN", u.UDPPublicPort, u.Name)
+		}
+	}
+	return nil
+}
+
+// runAgentTURN implements "tut agent turn".
+func runAgentTURN(args []string) int {
+	fs := flag.NewFlagSet("agent turn", flag.ExitOnError)
+	configPath := fs.String("config", "turn.json", "Path to the TURN config written by tut")
+	_ = fs.Parse(args)
+
+	var tc agentTURNConfig
+	b, err := os.ReadFile(*configPath)
+	if err == nil {
+		err = json.Unmarshal(b, &tc)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	s, err := newTURNServer(tc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	logf("TURN server listening on UDP port %d, relaying from %s", tc.Port, s.external)
+	go s.tunnel.run(s.fromTunnel)
+	go s.expire()
+	if err := s.serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	return 1
+}
+
+// turnServer holds the allocations of the TURN server.
+type turnServer struct {
+	cfg      agentTURNConfig
+	conn     *net.UDPConn // the port clients talk to
+	external net.IP
+	lo, hi   int // relay port range
+	local    []*net.IPNet
+	nonceKey []byte
+	tunnel   *turnTunnel
+
+	mu     sync.Mutex
+	allocs map[string]*allocation // by client address
+	ports  map[int]*allocation    // by relay port
+}
+
+// allocation is a relayed transport address held for one client.
+type allocation struct {
+	client   *net.UDPAddr
+	relay    *net.UDPConn
+	port     int
+	user     string
+	txid     [12]byte // of the Allocate request, to answer retransmissions
+	expires  time.Time
+	perms    map[string]time.Time // peer IP → expiry
+	channels map[uint16]*channel
+}
+
+// channel is a channel binding of an allocation.
+type channel struct {
+	peer    *net.UDPAddr
+	expires time.Time
+}
+
+func newTURNServer(tc agentTURNConfig) (*turnServer, error) {
+	s := &turnServer{
+		cfg:      tc,
+		external: net.ParseIP(tc.ExternalIP).To4(),
+		nonceKey: make([]byte, 16),
+		tunnel:   &turnTunnel{addr: tc.Tunnel},
+		allocs:   map[string]*allocation{},
+		ports:    map[int]*allocation{},
+	}
+	if s.external == nil {
+		return nil, fmt.Errorf("invalid external_ip: %q", tc.ExternalIP)
+	}
+	var err error
+	if s.lo, s.hi, err = parsePortRange(tc.RelayPorts); err != nil {
+		return nil, err
+	}
+	if s.local, err = parseNets(tc.LocalPeers); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(s.nonceKey); err != nil {
+		return nil, err
+	}
+	if s.conn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: tc.Port}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parsePortRange parses "low-high".
+func parsePortRange(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, "-")
+	lo, err1 := strconv.Atoi(strings.TrimSpace(a))
+	hi, err2 := strconv.Atoi(strings.TrimSpace(b))
+	if !ok || err1 != nil || err2 != nil || !isPort(lo) || !isPort(hi) || lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range: %q", s)
+	}
+	return lo, hi, nil
+}
+
+// parseNets parses a list of CIDR networks.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve handles the messages of clients until the socket fails.
+func (s *turnServer) serve() error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		switch b := buf[:n]; {
+		case n >= 4 && b[0]&0xC0 == 0x40:
+			s.channelData(from, b)
+		case n >= 20:
+			s.handle(from, b)
+		}
+	}
+}
+
+// handle answers a STUN request or processes a Send indication.
+func (s *turnServer) handle(from *net.UDPAddr, b []byte) {
+	m, err := parseSTUN(b)
+	if err != nil {
+		return
+	}
+	class, method := m.typ&0x0110, m.typ&^0x0110
+	if class == classIndication {
+		if method == methodSend {
+			s.send(from, m)
+		}
+		return
+	}
+	if class != classRequest {
+		return
+	}
+	if unknown := m.unknownRequired(); len(unknown) > 0 {
+		r := errorReply(m, 420, "Unknown Attribute")
+		v := make([]byte, 2*len(unknown))
+		for i, t := range unknown {
+			binary.BigEndian.PutUint16(v[2*i:], t)
+		}
+		r.add(attrUnknownAttributes, v)
+		s.write(from, r.finish(nil))
+		return
+	}
+	if method == methodBinding {
+		r := newSTUN(methodBinding|classSuccess, m.txid)
+		r.add(attrXorMappedAddress, xorAddr(from))
+		s.write(from, r.finish(nil))
+		return
+	}
+	user, key, challenge := s.authenticate(m)
+	if challenge != nil {
+		s.write(from, challenge.finish(nil))
+		return
+	}
+	s.mu.Lock()
+	var r *stunBuilder
+	a := s.allocs[from.String()]
+	switch {
+	case a != nil && a.user != user:
+		r = errorReply(m, 441, "Wrong Credentials")
+	case method == methodAllocate:
+		r = s.allocate(from, m, a, user)
+	case a == nil:
+		r = errorReply(m, 437, "Allocation Mismatch")
+	case method == methodRefresh:
+		r = s.refresh(m, a)
+	case method == methodCreatePermission:
+		r = s.createPermission(m, a)
+	case method == methodChannelBind:
+		r = s.channelBind(m, a)
+	default:
+		r = errorReply(m, 400, "Bad Request")
+	}
+	s.mu.Unlock()
+	s.write(from, r.finish(key))
+}
+
+// authenticate checks the long-term credentials of a request. It returns
+// the user and key, or the error response asking for (new) credentials.
+func (s *turnServer) authenticate(m *stunMsg) (string, []byte, *stunBuilder) {
+	if m.get(attrMessageIntegrity) == nil {
+		return "", nil, s.challenge(m, 401, "Unauthorized")
+	}
+	user, realm, nonce := m.get(attrUsername), m.get(attrRealm), m.get(attrNonce)
+	if user == nil || realm == nil || nonce == nil {
+		return "", nil, errorReply(m, 400, "Bad Request")
+	}
+	if !s.validNonce(string(nonce)) {
+		return "", nil, s.challenge(m, 438, "Stale Nonce")
+	}
+	pass, ok := s.password(string(user))
+	if !ok || string(realm) != s.cfg.Realm {
+		return "", nil, s.challenge(m, 401, "Unauthorized")
+	}
+	sum := md5.Sum([]byte(string(user) + ":" + s.cfg.Realm + ":" + pass))
+	if !m.checkIntegrity(sum[:]) {
+		return "", nil, s.challenge(m, 401, "Unauthorized")
+	}
+	return string(user), sum[:], nil
+}
+
+// challenge is an error response carrying the realm and a fresh nonce.
+func (s *turnServer) challenge(m *stunMsg, code int, reason string) *stunBuilder {
+	r := errorReply(m, code, reason)
+	r.add(attrRealm, []byte(s.cfg.Realm))
+	r.add(attrNonce, []byte(s.nonce(time.Now())))
+	return r
+}
+
+// nonce returns a nonce issued at t, which the server can verify without
+// keeping it.
+func (s *turnServer) nonce(t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 16)
+	mac := hmac.New(sha1.New, s.nonceKey)
+	mac.Write([]byte(ts))
+	return ts + "-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+func (s *turnServer) validNonce(n string) bool {
+	ts, _, _ := strings.Cut(n, "-")
+	sec, err := strconv.ParseInt(ts, 16, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(sec, 0)
+	return time.Since(issued) < turnNonceLifetime && hmac.Equal([]byte(n), []byte(s.nonce(issued)))
+}
+
+// password returns the password of user: a static one from turn.users, or
+// one derived from turn.secret for time-limited REST API usernames of the
+// form "expiry:name", expiry being a Unix time.
+func (s *turnServer) password(user string) (string, bool) {
+	if p, ok := s.cfg.Users[user]; ok {
+		return p, true
+	}
+	if s.cfg.Secret == "" {
+		return "", false
+	}
+	ts, _, _ := strings.Cut(user, ":")
+	expiry, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+	mac := hmac.New(sha1.New, []byte(s.cfg.Secret))
+	mac.Write([]byte(user))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// allocate handles an Allocate request; a is the client's allocation, if
+// it already has one.
+func (s *turnServer) allocate(from *net.UDPAddr, m *stunMsg, a *allocation, user string) *stunBuilder {
+	if a != nil {
+		if a.txid != m.txid {
+			return errorReply(m, 437, "Allocation Mismatch")
+		}
+		// retransmission of the request that created a
+		return s.allocated(m, a)
+	}
+	tr := m.get(attrRequestedTransport)
+	if len(tr) != 4 {
+		return errorReply(m, 400, "Bad Request")
+	}
+	if tr[0] != 17 {
+		return errorReply(m, 442, "Unsupported Transport Protocol")
+	}
+	if f := m.get(attrRequestedFamily); f != nil && (len(f) != 4 || f[0] != 0x01) {
+		return errorReply(m, 440, "Address Family not Supported")
+	}
+	relay, port := s.listenRelay()
+	if relay == nil {
+		return errorReply(m, 508, "Insufficient Capacity")
+	}
+	a = &allocation{
+		client:   from,
+		relay:    relay,
+		port:     port,
+		user:     user,
+		txid:     m.txid,
+		expires:  time.Now().Add(requestedLifetime(m)),
+		perms:    map[string]time.Time{},
+		channels: map[uint16]*channel{},
+	}
+	s.allocs[from.String()] = a
+	s.ports[port] = a
+	go s.fromRelay(a)
+	logf("TURN allocation %s:%d for %s (%s)", s.external, port, from, user)
+	return s.allocated(m, a)
+}
+
+// allocated is the success response to the Allocate request of a.
+func (s *turnServer) allocated(m *stunMsg, a *allocation) *stunBuilder {
+	r := newSTUN(methodAllocate|classSuccess, m.txid)
+	r.add(attrXorRelayedAddress, xorAddr(&net.UDPAddr{IP: s.external, Port: a.port}))
+	r.add(attrLifetime, lifetimeValue(time.Until(a.expires)))
+	r.add(attrXorMappedAddress, xorAddr(a.client))
+	return r
+}
+
+// listenRelay binds a free port of the relay range, starting at a random
+// one so that ports are not reused right away.
+func (s *turnServer) listenRelay() (*net.UDPConn, int) {
+	n := s.hi - s.lo + 1
+	var r [2]byte
+	_, _ = rand.Read(r[:])
+	start := int(binary.BigEndian.Uint16(r[:])) % n
+	for i := 0; i < n; i++ {
+		port := s.lo + (start+i)%n
+		if s.ports[port] != nil {
+			continue
+		}
+		if c, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port}); err == nil {
+			return c, port
+		}
+	}
+	return nil, 0
+}
+
+// requestedLifetime is the lifetime a request asks for, within limits.
+func requestedLifetime(m *stunMsg) time.Duration {
+	d := turnDefaultLifetime
+	if v := m.get(attrLifetime); len(v) == 4 {
+		d = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return max(min(d, turnMaxLifetime), turnDefaultLifetime)
+}
+
+func lifetimeValue(d time.Duration) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(max(d, 0)/time.Second))
+	return v
+}
+
+func (s *turnServer) refresh(m *stunMsg, a *allocation) *stunBuilder {
+	d := time.Duration(0)
+	if v := m.get(attrLifetime); len(v) != 4 || binary.BigEndian.Uint32(v) != 0 {
+		d = requestedLifetime(m)
+		a.expires = time.Now().Add(d)
+	} else {
+		s.remove(a)
+	}
+	r := newSTUN(methodRefresh|classSuccess, m.txid)
+	r.add(attrLifetime, lifetimeValue(d))
+	return r
+}
+
+func (s *turnServer) createPermission(m *stunMsg, a *allocation) *stunBuilder {
+	var peers []*net.UDPAddr
+	for _, v := range m.getAll(attrXorPeerAddress) {
+		peer, err := parseXorAddr(v)
+		if err != nil {
+			return errorReply(m, 443, "Peer Address Family Mismatch")
+		}
+		if !s.allowedPeer(peer.IP) {
+			return errorReply(m, 403, "Forbidden")
+		}
+		peers = append(peers, peer)
+	}
+	if len(peers) == 0 {
+		return errorReply(m, 400, "Bad Request")
+	}
+	for _, peer := range peers {
+		a.perms[peer.IP.String()] = time.Now().Add(turnPermission)
+	}
+	return newSTUN(methodCreatePermission|classSuccess, m.txid)
+}
+
+func (s *turnServer) channelBind(m *stunMsg, a *allocation) *stunBuilder {
+	v := m.get(attrChannelNumber)
+	if len(v) != 4 {
+		return errorReply(m, 400, "Bad Request")
+	}
+	num := binary.BigEndian.Uint16(v)
+	peer, err := parseXorAddr(m.get(attrXorPeerAddress))
+	if num < 0x4000 || num > 0x4FFF || err != nil {
+		return errorReply(m, 400, "Bad Request")
+	}
+	if !s.allowedPeer(peer.IP) {
+		return errorReply(m, 403, "Forbidden")
+	}
+	for n, ch := range a.channels {
+		if (n == num) != (ch.peer.String() == peer.String()) {
+			// the channel or the peer is bound otherwise
+			return errorReply(m, 400, "Bad Request")
+		}
+	}
+	a.channels[num] = &channel{peer: peer, expires: time.Now().Add(turnChannel)}
+	a.perms[peer.IP.String()] = time.Now().Add(turnPermission)
+	return newSTUN(methodChannelBind|classSuccess, m.txid)
+}
+
+// allowedPeer reports whether allocations may send to ip. Peers in
+// turn.local_peers are reached through the tunnel; other private and
+// special addresses would be reached from the VPS and are refused.
+func (s *turnServer) allowedPeer(ip net.IP) bool {
+	if containsIP(s.local, ip) {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.Equal(net.IPv4bcast))
+}
+
+// send handles a Send indication.
+func (s *turnServer) send(from *net.UDPAddr, m *stunMsg) {
+	peer, err := parseXorAddr(m.get(attrXorPeerAddress))
+	data := m.get(attrData)
+	if err != nil || data == nil {
+		return
+	}
+	s.mu.Lock()
+	a := s.allocs[from.String()]
+	ok := a != nil && time.Now().Before(a.perms[peer.IP.String()])
+	s.mu.Unlock()
+	if ok {
+		s.toPeer(a, peer, data)
+	}
+}
+
+// channelData handles a ChannelData message.
+func (s *turnServer) channelData(from *net.UDPAddr, b []byte) {
+	num, size := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+	if 4+size > len(b) {
+		return
+	}
+	s.mu.Lock()
+	var peer *net.UDPAddr
+	a := s.allocs[from.String()]
+	if a != nil {
+		if ch := a.channels[num]; ch != nil && time.Now().Before(ch.expires) {
+			peer = ch.peer
+		}
+	}
+	s.mu.Unlock()
+	if peer != nil {
+		s.toPeer(a, peer, b[4:4+size])
+	}
+}
+
+// toPeer sends data from the relayed address of a to peer.
+func (s *turnServer) toPeer(a *allocation, peer *net.UDPAddr, data []byte) {
+	if containsIP(s.local, peer.IP) {
+		s.tunnel.send(uint16(a.port), peer, data)
+		return
+	}
+	_, _ = a.relay.WriteToUDP(data, peer)
+}
+
+// fromRelay passes datagrams public peers send to the relayed address of a
+// on to its client.
+func (s *turnServer) fromRelay(a *allocation) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		s.toClient(a, from, buf[:n])
+	}
+}
+
+// fromTunnel passes datagrams of local peers on to the client of the
+// allocation with the relay port they were sent to.
+func (s *turnServer) fromTunnel(port uint16, peer *net.UDPAddr, data []byte) {
+	s.mu.Lock()
+	a := s.ports[int(port)]
+	s.mu.Unlock()
+	if a != nil {
+		s.toClient(a, peer, data)
+	}
+}
+
+// toClient sends data from peer to the client of a, over the peer's
+// channel if it has one, if a permits the peer.
+func (s *turnServer) toClient(a *allocation, peer *net.UDPAddr, data []byte) {
+	s.mu.Lock()
+	if !time.Now().Before(a.perms[peer.IP.String()]) {
+		s.mu.Unlock()
+		return
+	}
+	num := uint16(0)
+	for n, ch := range a.channels {
+		if ch.peer.String() == peer.String() && time.Now().Before(ch.expires) {
+			num = n
+		}
+	}
+	s.mu.Unlock()
+	if num != 0 {
+		b := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint16(b, num)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+		copy(b[4:], data)
+		s.write(a.client, b)
+		return
+	}
+	var txid [12]byte
+	_, _ = rand.Read(txid[:])
+	r := newSTUN(methodData|classIndication, txid)
+	r.add(attrXorPeerAddress, xorAddr(peer))
+	r.add(attrData, data)
+	s.write(a.client, r.finish(nil))
+}
+
+func (s *turnServer) write(to *net.UDPAddr, b []byte) {
+	_, _ = s.conn.WriteToUDP(b, to)
+}
+
+// remove deletes a; the caller holds s.mu.
+func (s *turnServer) remove(a *allocation) {
+	delete(s.allocs, a.client.String())
+	delete(s.ports, a.port)
+	_ = a.relay.Close()
+	logf("TURN allocation %s:%d for %s released", s.external, a.port, a.client)
+}
+
+// expire drops allocations, permissions and channels that were not
+// refreshed in time.
+func (s *turnServer) expire() {
+	for range time.Tick(30 * time.Second) {
+		now := time.Now()
+		s.mu.Lock()
+		for _, a := range s.allocs {
+			if now.After(a.expires) {
+				s.remove(a)
+				continue
+			}
+			for ip, t := range a.perms {
+				if now.After(t) {
+					delete(a.perms, ip)
+				}
+			}
+			for n, ch := range a.channels {
+				if now.After(ch.expires) {
+					delete(a.channels, n)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// turnTunnel is the agent's connection through the SSH tunnel to the turn
+// bridge of tut. It is re-established whenever it drops.
+type turnTunnel struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// run connects to the bridge and passes the datagrams of local peers to
+// deliver.
+func (t *turnTunnel) run(deliver func(uint16, *net.UDPAddr, []byte)) {
+	for {
+		c, err := net.DialTimeout("tcp", t.addr, 5*time.Second)
+		if err != nil {
+			time.Sleep(2 * time.Second)
+			continue
+		}
+		t.mu.Lock()
+		t.conn = c
+		t.mu.Unlock()
+		r := bufio.NewReader(c)
+		for {
+			port, peer, data, err := readTURNFrame(r)
+			if err != nil {
+				break
+			}
+			deliver(port, peer, data)
+		}
+		t.mu.Lock()
+		t.conn = nil
+		t.mu.Unlock()
+		_ = c.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// send passes a datagram for a local peer to the bridge; it is dropped
+// while the tunnel is down.
+func (t *turnTunnel) send(port uint16, peer *net.UDPAddr, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return
+	}
+	_ = t.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := writeTURNFrame(t.conn, port, peer, data); err != nil {
+		// makes run reconnect
+		_ = t.conn.Close()
+	}
+}
+
+// stunMsg is a parsed STUN message.
+type stunMsg struct {
+	typ   uint16
+	txid  [12]byte
+	attrs []stunAttr
+	raw   []byte
+}
+
+type stunAttr struct {
+	typ uint16
+	val []byte
+	off int // of the attribute header in raw
+}
+
+// parseSTUN parses a STUN message with the magic cookie of RFC 5389.
+func parseSTUN(b []byte) (*stunMsg, error) {
+	if len(b) < 20 || b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:]) != stunMagic ||
+		int(binary.BigEndian.Uint16(b[2:])) != len(b)-20 || len(b)%4 != 0 {
+		return nil, errors.New("not a STUN message")
+	}
+	m := &stunMsg{typ: binary.BigEndian.Uint16(b), raw: b}
+	copy(m.txid[:], b[8:20])
+	for off := 20; off < len(b); {
+		if off+4 > len(b) {
+			return nil, errors.New("truncated attribute")
+		}
+		typ, size := binary.BigEndian.Uint16(b[off:]), int(binary.BigEndian.Uint16(b[off+2:]))
+		if off+4+size > len(b) {
+			return nil, errors.New("truncated attribute")
+		}
+		m.attrs = append(m.attrs, stunAttr{typ: typ, val: b[off+4 : off+4+size], off: off})
+		off += 4 + (size+3)&^3
+	}
+	return m, nil
+}
+
+// get returns the value of the first attribute of type t, or nil.
+func (m *stunMsg) get(t uint16) []byte {
+	for _, a := range m.attrs {
+		if a.typ == t {
+			return a.val
+		}
+	}
+	return nil
+}
+
+func (m *stunMsg) getAll(t uint16) [][]byte {
+	var vals [][]byte
+	for _, a := range m.attrs {
+		if a.typ == t {
+			vals = append(vals, a.val)
+		}
+	}
+	return vals
+}
+
+// unknownRequired lists the comprehension-required attributes the server
+// does not understand.
+func (m *stunMsg) unknownRequired() []uint16 {
+	var unknown []uint16
+	for _, a := range m.attrs {
+		switch a.typ {
+		case attrUsername, attrMessageIntegrity, attrRealm, attrNonce, attrChannelNumber, attrLifetime,
+			attrXorPeerAddress, attrData, attrRequestedFamily, attrRequestedTransport, attrDontFragment,
+			attrPriority, attrUseCandidate:
+		default:
+			if a.typ < 0x8000 {
+				unknown = append(unknown, a.typ)
+			}
+		}
+	}
+	return unknown
+}
+
+// checkIntegrity verifies MESSAGE-INTEGRITY with key. The HMAC covers the
+// message up to the attribute, with the length as if it ended there.
+func (m *stunMsg) checkIntegrity(key []byte) bool {
+	for _, a := range m.attrs {
+		if a.typ != attrMessageIntegrity {
+			continue
+		}
+		if len(a.val) != sha1.Size {
+			return false
+		}
+		b := append([]byte(nil), m.raw[:a.off]...)
+		binary.BigEndian.PutUint16(b[2:], uint16(a.off-20+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(b)
+		return hmac.Equal(mac.Sum(nil), a.val)
+	}
+	return false
+}
+
+// stunBuilder builds a STUN message.
+type stunBuilder struct {
+	b []byte
+}
+
+func newSTUN(typ uint16, txid [12]byte) *stunBuilder {
+	b := make([]byte, 20, 128)
+	binary.BigEndian.PutUint16(b, typ)
+	binary.BigEndian.PutUint32(b[4:], stunMagic)
+	copy(b[8:], txid[:])
+	return &stunBuilder{b: b}
+}
+
+// errorReply is an error response to m.
+func errorReply(m *stunMsg, code int, reason string) *stunBuilder {
+	r := newSTUN(m.typ&^0x0110|classError, m.txid)
+	r.add(attrErrorCode, append([]byte{0, 0, byte(code / 100), byte(code % 100)}, reason...))
+	return r
+}
+
+// add appends an attribute, padded to four bytes.
+func (r *stunBuilder) add(t uint16, v []byte) {
+	r.b = binary.BigEndian.AppendUint16(r.b, t)
+	r.b = binary.BigEndian.AppendUint16(r.b, uint16(len(v)))
+	r.b = append(r.b, v...)
+	for len(r.b)%4 != 0 {
+		r.b = append(r.b, 0)
+	}
+	binary.BigEndian.PutUint16(r.b[2:], uint16(len(r.b)-20))
+}
+
+// finish appends SOFTWARE, MESSAGE-INTEGRITY when key is set, and
+// FINGERPRINT, and returns the message.
+func (r *stunBuilder) finish(key []byte) []byte {
+	r.add(attrSoftware, []byte("tut"))
+	if key != nil {
+		binary.BigEndian.PutUint16(r.b[2:], uint16(len(r.b)-20+24))
+		mac := hmac.New(sha1.New, key)
+		mac.Write(r.b)
+		r.add(attrMessageIntegrity, mac.Sum(nil))
+	}
+	binary.BigEndian.PutUint16(r.b[2:], uint16(len(r.b)-20+8))
+	crc := crc32.ChecksumIEEE(r.b) ^ 0x5354554e
+	r.add(attrFingerprint, binary.BigEndian.AppendUint32(nil, crc))
+	return r.b
+}
+
+// xorAddr encodes an IPv4 address as XOR-MAPPED-ADDRESS and its relatives.
+func xorAddr(addr *net.UDPAddr) []byte {
+	v := make([]byte, 8)
+	v[1] = 0x01
+	binary.BigEndian.PutUint16(v[2:], uint16(addr.Port)^stunMagic>>16)
+	binary.BigEndian.PutUint32(v[4:], binary.BigEndian.Uint32(addr.IP.To4())^stunMagic)
+	return v
+}
+
+// parseXorAddr decodes an IPv4 XOR-PEER-ADDRESS.
+func parseXorAddr(v []byte) (*net.UDPAddr, error) {
+	if len(v) != 8 || v[1] != 0x01 {
+		return nil, errors.New("not an IPv4 address")
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(v[4:])^stunMagic)
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(v[2:]) ^ stunMagic>>16)}, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// turnSocketIdle is how long the bridge keeps the socket of a relay port
+// that carried no datagrams.
+const turnSocketIdle = 10 * time.Minute
+
+// turnBridge is the local end of the TURN relay. The agent on the VPS
+// connects to it through the tunnel and passes on what TURN clients send to
+// local peers; the bridge sends it from one UDP socket per relay port, so a
+// peer sees each allocation as a stable address, and frames the peers'
+// answers back.
+type turnBridge struct {
+	ln    net.Listener
+	local []*net.IPNet
+
+	mu    sync.Mutex
+	conn  net.Conn // current connection of the agent
+	socks map[uint16]*bridgeSocket
+}
+
+type bridgeSocket struct {
+	conn *net.UDPConn
+	used time.Time
+}
+
+// startTURNBridge listens on turn.tunnel_port when TURN is enabled.
+func startTURNBridge(cfg *Config) (*turnBridge, error) {
+	if !cfg.TURN.Enabled {
+		return nil, nil
+	}
+	local, err := parseNets(cfg.TURN.LocalPeers)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.TURN.TunnelPort))
+	if err != nil {
+		return nil, err
+	}
+	b := &turnBridge{ln: ln, local: local, socks: map[uint16]*bridgeSocket{}}
+	go b.serve()
+	go b.expire()
+	return b, nil
+}
+
+func (b *turnBridge) close() {
+	if b == nil {
+		return
+	}
+	_ = b.ln.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		_ = b.conn.Close()
+	}
+	for port, s := range b.socks {
+		_ = s.conn.Close()
+		delete(b.socks, port)
+	}
+}
+
+// serve accepts connections through the tunnel. Answers go to the one that
+// delivered the latest datagram, so a stray connection (a health check, or
+// the agent's old one) does not take over.
+func (b *turnBridge) serve() {
+	for {
+		c, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		logEvent(levelDebug, "", "turn-connected", "TURN agent connected")
+		go b.fromAgent(c)
+	}
+}
+
+// fromAgent sends the datagrams the agent passes on to their local peers.
+func (b *turnBridge) fromAgent(c net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		if b.conn == c {
+			b.conn = nil
+		}
+		b.mu.Unlock()
+		_ = c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		port, peer, data, err := readTURNFrame(r)
+		if err != nil {
+			return
+		}
+		if !containsIP(b.local, peer.IP) {
+			continue
+		}
+		s, err := b.socket(port, c)
+		if err != nil {
+			logEvent(levelWarn, "", "turn-failed", "TURN relay port %d: %v", port, err)
+			continue
+		}
+		_, _ = s.WriteToUDP(data, peer)
+	}
+}
+
+// socket returns the socket of a relay port, opening it on first use, and
+// makes c the connection answers go to.
+func (b *turnBridge) socket(port uint16, c net.Conn) (*net.UDPConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = c
+	if s, ok := b.socks[port]; ok {
+		s.used = time.Now()
+		return s.conn, nil
+	}
+	u, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	b.socks[port] = &bridgeSocket{conn: u, used: time.Now()}
+	go b.fromPeers(port, u)
+	return u, nil
+}
+
+// fromPeers frames the answers of local peers back to the agent.
+func (b *turnBridge) fromPeers(port uint16, c *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := c.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || !containsIP(b.local, from.IP) {
+			continue
+		}
+		b.mu.Lock()
+		if s, ok := b.socks[port]; ok {
+			s.used = time.Now()
+		}
+		if b.conn != nil {
+			_ = b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := writeTURNFrame(b.conn, port, from, buf[:n]); err != nil {
+				_ = b.conn.Close()
+				b.conn = nil
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// expire closes the sockets of relay ports that are no longer used.
+func (b *turnBridge) expire() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		b.mu.Lock()
+		for port, s := range b.socks {
+			if time.Since(s.used) > turnSocketIdle {
+				_ = s.conn.Close()
+				delete(b.socks, port)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// The agent and the bridge exchange datagrams as frames of a 2-byte length
+// of the rest of the frame, the 2-byte relay port of the allocation, the
+// peer's IPv4 address and port, and the payload.
+
+func writeTURNFrame(w io.Writer, relayPort uint16, peer *net.UDPAddr, data []byte) error {
+	ip := peer.IP.To4()
+	if ip == nil || len(data) > 0xFFFF-8 {
+		return errors.New("datagram cannot be framed")
+	}
+	b := make([]byte, 10+len(data))
+	binary.BigEndian.PutUint16(b, uint16(8+len(data)))
+	binary.BigEndian.PutUint16(b[2:], relayPort)
+	copy(b[4:8], ip)
+	binary.BigEndian.PutUint16(b[8:], uint16(peer.Port))
+	copy(b[10:], data)
+	_, err := w.Write(b)
+	return err
+}
+
+func readTURNFrame(r io.Reader) (uint16, *net.UDPAddr, []byte, error) {
+	var h [10]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(h[:]))
+	if size < 8 {
+		return 0, nil, nil, errors.New("invalid TURN frame")
+	}
+	data := make([]byte, size-8)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, nil, err
+	}
+	peer := &net.UDPAddr{IP: net.IP(append([]byte(nil), h[4:8]...)), Port: int(binary.BigEndian.Uint16(h[8:]))}
+	return binary.BigEndian.Uint16(h[2:]), peer, data, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSTUNMessage(t *testing.T) {
+	var txid [12]byte
+	for i := range txid {
+		txid[i] = byte(i)
+	}
+	key := md5.Sum([]byte("alice:tut:secret"))
+	r := newSTUN(methodBinding|classSuccess, txid)
+	r.add(attrXorMappedAddress, xorAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 32853}))
+	b := r.finish(key[:])
+
+	// computed independently from RFC 8489
+	want := "010100342112a442000102030405060708090a0b" +
+		"002000080001a147e112a643" +
+		"8022000374757400" +
+		"0008001487000d4fe14d08983df40bb0f4e0573f2ea44da5" +
+		"80280004da03b2fe"
+	if got := hex.EncodeToString(b); got != want {
+		t.Fatalf("message\n got %s\nwant %s", got, want)
+	}
+
+	m, err := parseSTUN(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.typ != methodBinding|classSuccess || m.txid != txid {
+		t.Errorf("type %#x, txid %x", m.typ, m.txid)
+	}
+	if !m.checkIntegrity(key[:]) {
+		t.Error("MESSAGE-INTEGRITY does not verify with the key")
+	}
+	wrong := md5.Sum([]byte("alice:tut:wrong"))
+	if m.checkIntegrity(wrong[:]) {
+		t.Error("MESSAGE-INTEGRITY verifies with the wrong key")
+	}
+	addr, err := parseXorAddr(m.get(attrXorMappedAddress))
+	if err != nil || addr.String() != "192.0.2.1:32853" {
+		t.Errorf("XOR-MAPPED-ADDRESS = %v, %v", addr, err)
+	}
+}
+
+func TestParseSTUN(t *testing.T) {
+	var txid [12]byte
+	r := newSTUN(methodBinding, txid)
+	r.add(attrUsername, []byte("alice"))
+	good := r.b
+
+	withLength := func(b []byte, n uint16) []byte {
+		b = append([]byte(nil), b...)
+		binary.BigEndian.PutUint16(b[2:], n)
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		ok   bool
+	}{
+		{"request", good, true},
+		{"header only", good[:20], false},
+		{"short", good[:12], false},
+		{"length beyond the message", withLength(good, uint16(len(good)-20+4)), false},
+		{"attribute past the end", append(withLength(good[:20], 8), 0, 6, 0, 9, 'a', 'l', 'i', 'c'), false},
+		{"attribute header cut", append(withLength(good[:20], 4), 0, 6, 0, 0)[:22], false},
+		{"not a multiple of 4", append(withLength(good, uint16(len(good)-20+1)), 0), false},
+		{"no magic cookie", append(append([]byte(nil), good[:4]...), append([]byte{0, 0, 0, 0}, good[8:]...)...), false},
+		{"channel data", append([]byte{0x40, 0x00}, good[2:]...), false},
+	} {
+		_, err := parseSTUN(tc.b)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: parseSTUN error = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+
+	r = newSTUN(methodAllocate, txid)
+	r.add(0x0030, []byte{1, 2, 3, 4}) // comprehension-required, unknown
+	r.add(0x8030, []byte{1, 2, 3, 4}) // optional
+	m, err := parseSTUN(r.b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := m.unknownRequired(); len(u) != 1 || u[0] != 0x0030 {
+		t.Errorf("unknownRequired = %#x, want [0x30]", u)
+	}
+}
+
+func TestTURNFrame(t *testing.T) {
+	var buf bytes.Buffer
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 5004}
+	for _, data := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte{0xAB}, 0xFFFF-8)} {
+		if err := writeTURNFrame(&buf, 49160, peer, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeTURNFrame(&buf, 49160, peer, make([]byte, 0xFFFF)); err == nil {
+		t.Error("a datagram too large for a frame was framed")
+	}
+	if err := writeTURNFrame(&buf, 49160, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, nil); err == nil {
+		t.Error("an IPv6 peer was framed")
+	}
+	for _, want := range []int{0, 5, 0xFFFF - 8} {
+		port, from, data, err := readTURNFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if port != 49160 || from.String() != peer.String() || len(data) != want {
+			t.Errorf("frame: port %d, peer %v, %d bytes; want %d bytes", port, from, len(data), want)
+		}
+	}
+	if _, _, _, err := readTURNFrame(bytes.NewReader([]byte{0, 4, 0, 0, 0, 0, 0, 0, 0, 0})); err == nil {
+		t.Error("a frame shorter than its header was read")
+	}
+	if _, _, _, err := readTURNFrame(bytes.NewReader([]byte{0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 1})); err == nil {
+		t.Error("a truncated frame was read")
+	}
+}
+
+// turnClient talks to a TURN server from a UDP socket.
+type turnClient struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server *net.UDPAddr
+}
+
+// request sends b and returns the parsed response.
+func (c *turnClient) request(b []byte) *stunMsg {
+	c.t.Helper()
+	if _, err := c.conn.WriteToUDP(b, c.server); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readSTUN()
+}
+
+func (c *turnClient) read() []byte {
+	c.t.Helper()
+	buf := make([]byte, 2048)
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func (c *turnClient) readSTUN() *stunMsg {
+	c.t.Helper()
+	m, err := parseSTUN(c.read())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// errorCode returns the code of an error response, or 0.
+func errorCode(m *stunMsg) int {
+	v := m.get(attrErrorCode)
+	if m.typ&0x0110 != classError || len(v) < 4 {
+		return 0
+	}
+	return int(v[2])*100 + int(v[3])
+}
+
+// TestTURNRelay allocates a relay on a server, binds a channel to a local
+// peer and sends a datagram each way through the tunnel to the bridge.
+func TestTURNRelay(t *testing.T) {
+	bridge, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+	s, err := newTURNServer(agentTURNConfig{
+		Realm:      "tut",
+		Users:      map[string]string{"alice": "secret"},
+		RelayPorts: "40000-40999",
+		ExternalIP: "192.0.2.1",
+		LocalPeers: []string{"127.0.0.0/8"},
+		Tunnel:     bridge.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		s.mu.Lock()
+		for _, a := range s.allocs {
+			s.remove(a)
+		}
+		s.mu.Unlock()
+		_ = s.conn.Close()
+	}()
+	go s.tunnel.run(s.fromTunnel)
+	go func() { _ = s.serve() }()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &turnClient{t: t, conn: conn, server: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: s.conn.LocalAddr().(*net.UDPAddr).Port}}
+
+	var txid [12]byte
+	txid[0] = 1
+	allocate := newSTUN(methodAllocate, txid)
+	allocate.add(attrRequestedTransport, []byte{17, 0, 0, 0})
+	m := c.request(allocate.finish(nil))
+	if errorCode(m) != 401 || string(m.get(attrRealm)) != "tut" || m.get(attrNonce) == nil {
+		t.Fatalf("Allocate without credentials: type %#x, code %d", m.typ, errorCode(m))
+	}
+	nonce := m.get(attrNonce)
+
+	auth := func(r *stunBuilder, pass string) []byte {
+		r.add(attrUsername, []byte("alice"))
+		r.add(attrRealm, []byte("tut"))
+		r.add(attrNonce, nonce)
+		key := md5.Sum([]byte("alice:tut:" + pass))
+		return r.finish(key[:])
+	}
+	key := md5.Sum([]byte("alice:tut:secret"))
+
+	txid[0] = 2
+	allocate = newSTUN(methodAllocate, txid)
+	allocate.add(attrRequestedTransport, []byte{17, 0, 0, 0})
+	if m := c.request(auth(allocate, "wrong")); errorCode(m) != 401 {
+		t.Fatalf("Allocate with a wrong password: type %#x, code %d", m.typ, errorCode(m))
+	}
+
+	txid[0] = 3
+	allocate = newSTUN(methodAllocate, txid)
+	allocate.add(attrRequestedTransport, []byte{17, 0, 0, 0})
+	m = c.request(auth(allocate, "secret"))
+	if m.typ != methodAllocate|classSuccess || !m.checkIntegrity(key[:]) {
+		t.Fatalf("Allocate: type %#x, code %d", m.typ, errorCode(m))
+	}
+	relayed, err := parseXorAddr(m.get(attrXorRelayedAddress))
+	if err != nil || !relayed.IP.Equal(net.IPv4(192, 0, 2, 1)) || relayed.Port < 40000 || relayed.Port > 40999 {
+		t.Fatalf("XOR-RELAYED-ADDRESS = %v, %v", relayed, err)
+	}
+	if mapped, err := parseXorAddr(m.get(attrXorMappedAddress)); err != nil || mapped.String() != conn.LocalAddr().String() {
+		t.Errorf("XOR-MAPPED-ADDRESS = %v, %v; want %v", mapped, err, conn.LocalAddr())
+	}
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5004}
+	txid[0] = 4
+	bind := newSTUN(methodChannelBind, txid)
+	bind.add(attrChannelNumber, []byte{0x40, 0x00, 0, 0})
+	bind.add(attrXorPeerAddress, xorAddr(peer))
+	if m := c.request(auth(bind, "secret")); m.typ != methodChannelBind|classSuccess {
+		t.Fatalf("ChannelBind: type %#x, code %d", m.typ, errorCode(m))
+	}
+
+	txid[0] = 5
+	forbidden := newSTUN(methodCreatePermission, txid)
+	forbidden.add(attrXorPeerAddress, xorAddr(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 1}))
+	if m := c.request(auth(forbidden, "secret")); errorCode(m) != 403 {
+		t.Errorf("CreatePermission for a private peer: type %#x, code %d; want 403", m.typ, errorCode(m))
+	}
+
+	_ = bridge.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	tunnel, err := bridge.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.tunnel.mu.Lock()
+		up := s.tunnel.conn != nil
+		s.tunnel.mu.Unlock()
+		if up {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the server did not connect to the bridge")
+		}
+	}
+
+	if _, err := conn.WriteToUDP([]byte{0x40, 0x00, 0, 5, 'h', 'e', 'l', 'l', 'o'}, c.server); err != nil {
+		t.Fatal(err)
+	}
+	_ = tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	port, from, data, err := readTURNFrame(bufio.NewReader(tunnel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(port) != relayed.Port || from.String() != peer.String() || string(data) != "hello" {
+		t.Errorf("frame to the bridge: port %d, peer %v, %q", port, from, data)
+	}
+
+	if err := writeTURNFrame(tunnel, port, peer, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(); !bytes.Equal(got, []byte{0x40, 0x00, 0, 5, 'w', 'o', 'r', 'l', 'd'}) {
+		t.Errorf("ChannelData to the client = %x", got)
+	}
+}
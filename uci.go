@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// uciConfigPrefix selects a UCI file instead of YAML, e.g. "tut -config
+// uci:" for /etc/config/tut on OpenWrt, where the LuCI web interface and
+// the uci command edit the configuration:
+//
+//	config tut 'main'
+//		option enabled '1'
+//		option reconnect_delay '5s'
+//
+//	config vps
+//		option host 'vps.example.com'
+//		option ssh_key '/etc/tut/id_ed25519'
+//
+//	config tcp_forward 'web'
+//		option remote_port '8080'
+//		option local_host '192.168.1.10'
+//		option local_port '80'
+//
+// Options carry the YAML names. The tut section holds the top-level
+// settings, a section named after a YAML block (vps, api, log, ...) that
+// block, with nested blocks flattened (option consul_address in config
+// registry). tcp_forward, udp_forward, api_token, plugin and mirror sections are
+// named after their entry; policy sections are rules in file order. Lists and maps are given as list options, maps as
+// 'key=value'.
+const uciConfigPrefix = "uci:"
+
+// uciDefaultPath is the file "uci:" stands for.
+const uciDefaultPath = "/etc/config/tut"
+
+// uciSection is one config block of a UCI file.
+type uciSection struct {
+	typ, name string
+	line      int
+	options   map[string][]string // lists have several values
+}
+
+// configFromUCI fills c from the UCI file at path.
+func configFromUCI(c *Config, path string) error {
+	if path == "" {
+		path = uciDefaultPath
+	}
+	sections, err := readUCI(path)
+	if err != nil {
+		return err
+	}
+	root := reflect.ValueOf(c).Elem()
+	for _, s := range sections {
+		var target reflect.Value
+		switch s.typ {
+		case "tut":
+			target = root
+			delete(s.options, "enabled") // read by the init script
+		case "tcp_forward":
+			c.TCPForwards = append(c.TCPForwards, TCPForward{Name: s.name})
+			target = reflect.ValueOf(&c.TCPForwards[len(c.TCPForwards)-1]).Elem()
+		case "udp_forward":
+			c.UDPForwards = append(c.UDPForwards, UDPForward{Name: s.name})
+			target = reflect.ValueOf(&c.UDPForwards[len(c.UDPForwards)-1]).Elem()
+		case "api_token":
+			c.API.Tokens = append(c.API.Tokens, APIToken{Name: s.name})
+			target = reflect.ValueOf(&c.API.Tokens[len(c.API.Tokens)-1]).Elem()
+		case "plugin":
+			c.Plugins = append(c.Plugins, PluginConfig{Name: s.name})
+			target = reflect.ValueOf(&c.Plugins[len(c.Plugins)-1]).Elem()
+		case "mirror":
+			c.Mirrors = append(c.Mirrors, MirrorConfig{Name: s.name})
+			target = reflect.ValueOf(&c.Mirrors[len(c.Mirrors)-1]).Elem()
+		case "policy":
+			c.Policy = append(c.Policy, PolicyRule{})
+			target = reflect.ValueOf(&c.Policy[len(c.Policy)-1]).Elem()
+		default:
+			if f, ok := uciFields(root, "")[s.typ]; ok && f.Kind() == reflect.Struct {
+				target = f
+			}
+		}
+		if !target.IsValid() {
+			return fmt.Errorf("%s:%d: unknown section type %q", path, s.line, s.typ)
+		}
+		fields := uciFields(target, "")
+		for name, values := range s.options {
+			f, ok := fields[name]
+			if !ok || f.Kind() == reflect.Struct {
+				err := fmt.Errorf("%s:%d: unknown option %q in %s section", path, s.line, name, s.typ)
+				key := s.typ + "." + name
+				if s.typ == "tut" {
+					key = name
+				}
+				if hint := suggestKey(key, name, fields); hint != "" {
+					err = fmt.Errorf("%w; did you mean %s?", err, hint)
+				}
+				return err
+			}
+			if err := setUCIOption(f, s.typ+"."+name, values); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, s.line, err)
+			}
+		}
+	}
+	return nil
+}
+
+// uciFields returns the fields of the struct v by YAML name, the fields of
+// nested structs prefixed with the name of the struct and an underscore.
+// Lists of structs have sections of their own and are left out.
+func uciFields(v reflect.Value, prefix string) map[string]reflect.Value {
+	out := make(map[string]reflect.Value)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := yamlName(t.Field(i))
+		f := v.Field(i)
+		if name == "" || f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			continue
+		}
+		out[prefix+name] = f
+		if f.Kind() == reflect.Struct {
+			for k, sub := range uciFields(f, prefix+name+"_") {
+				out[k] = sub
+			}
+		}
+	}
+	return out
+}
+
+// setUCIOption sets f from the values of an option or list.
+func setUCIOption(f reflect.Value, key string, values []string) error {
+	switch f.Kind() {
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("%s: unsupported option", key)
+		}
+		f.Set(reflect.ValueOf(append([]string{}, values...)))
+	case reflect.Map:
+		m := reflect.MakeMap(f.Type())
+		for _, kv := range values {
+			k, val, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("%s: expected key=value, got %q", key, kv)
+			}
+			m.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(val))
+		}
+		f.Set(m)
+	default:
+		if len(values) != 1 {
+			return fmt.Errorf("%s: expected one value, got a list", key)
+		}
+		return setScalar(f, key, values[0])
+	}
+	return nil
+}
+
+// readUCI parses a UCI file: config, option and list lines with shell-like
+// quoting, and comments.
+func readUCI(path string) ([]*uciSection, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var sections []*uciSection
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		words, err := uciWords(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "package":
+			continue
+		case "config":
+			if len(words) < 2 || len(words) > 3 {
+				return nil, fmt.Errorf("%s:%d: expected config <type> ['<name>']", path, n)
+			}
+			s := &uciSection{typ: words[1], line: n, options: make(map[string][]string)}
+			if len(words) == 3 {
+				s.name = words[2]
+			}
+			sections = append(sections, s)
+		case "option", "list":
+			if len(words) != 3 {
+				return nil, fmt.Errorf("%s:%d: expected %s <name> '<value>'", path, n, words[0])
+			}
+			if len(sections) == 0 {
+				return nil, fmt.Errorf("%s:%d: %s outside of a config section", path, n, words[0])
+			}
+			s := sections[len(sections)-1]
+			if words[0] == "option" {
+				s.options[words[1]] = []string{words[2]}
+			} else {
+				s.options[words[1]] = append(s.options[words[1]], words[2])
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unexpected %q", path, n, words[0])
+		}
+	}
+	return sections, sc.Err()
+}
+
+// uciWords splits a line into words. Single quotes keep everything
+// literally, double quotes and bare words allow backslash escapes, and
+// adjacent parts join into one word. A # outside of quotes starts a
+// comment.
+func uciWords(line string) ([]string, error) {
+	var words []string
+	var w strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			if inWord {
+				words = append(words, w.String())
+				w.Reset()
+				inWord = false
+			}
+		case ch == '#' && !inWord:
+			return words, nil
+		case ch == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			w.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case ch == '"':
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				w.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		case ch == '\\' && i+1 < len(line):
+			i++
+			w.WriteByte(line[i])
+			inWord = true
+		default:
+			w.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, w.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// "tut debug udp-sim" runs a UDP forward inside this process and shows
+// whether it keeps datagram boundaries and order: a virtual client sends
+// datagrams of a sweep of sizes, from 1 byte to the largest UDP payload,
+// through the VPS side, a wrap stream and the builtin bridge to a virtual
+// echo server and back. Between the two sides the stream is cut at random
+// and pieces are held back and joined, as ssh, a FIFO or a busy TCP
+// connection may do, so raw wrapping fails where framing: length holds.
+
+// udpSimSizes are the payload sizes of the sweep, around the common MTUs
+// and beyond them up to the largest UDP payload over IPv4.
+var udpSimSizes = []int{1, 16, 64, 512, 1200, 1280, 1472, 1473, 1500, 4096, 8192, 9000, 16384, 32768, 65507}
+
+// udpSimResult is the outcome of one size of the sweep.
+type udpSimResult struct {
+	Framing   string `json:"framing"`
+	Size      int    `json:"size"`
+	Sent      int    `json:"sent"`
+	Intact    int    `json:"intact"`
+	Damaged   int    `json:"damaged"` // merged, split or changed
+	Lost      int    `json:"lost"`
+	Reordered int    `json:"reordered"`
+}
+
+// ok reports whether boundaries and order were kept. Losses are allowed, as
+// with any UDP.
+func (r udpSimResult) ok() bool {
+	return r.Damaged == 0 && r.Reordered == 0
+}
+
+// runUDPSim implements "tut debug udp-sim".
+func runUDPSim(args []string) int {
+	fs := flag.NewFlagSet("debug udp-sim", flag.ExitOnError)
+	framing := fs.String("framing", "both", "Framing to simulate: raw, length or both")
+	count := fs.Int("count", 20, "Datagrams per size")
+	chaos := fs.Bool("chaos", true, "Cut and join the wrap stream at random")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+	var modes []string
+	switch *framing {
+	case "raw", "length":
+		modes = []string{*framing}
+	case "both":
+		modes = []string{"raw", "length"}
+	default:
+		fmt.Fprintln(os.Stderr, "usage: tut debug udp-sim [-framing raw|length|both] [-count 20] [-chaos=false]")
+		return 2
+	}
+	if *count < 1 || *count > 256 {
+		die("-count must be between 1 and 256")
+	}
+
+	var results []udpSimResult
+	failed := false
+	for _, mode := range modes {
+		rs, err := simulateUDP(mode == "length", *count, *chaos)
+		if err != nil {
+			die("Cannot run the simulation: %v", err)
+		}
+		for _, r := range rs {
+			r.Framing = mode
+			results = append(results, r)
+			// raw is expected to fail; only framing length has to hold
+			failed = failed || mode == "length" && !r.ok()
+		}
+	}
+	if jsonOutput() {
+		printJSON(results)
+	} else {
+		printUDPSim(results, *chaos)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// printUDPSim prints the results of each framing as a table.
+func printUDPSim(results []udpSimResult, chaos bool) {
+	stream := "passed through"
+	if chaos {
+		stream = "cut and joined at random"
+	}
+	for i, r := range results {
+		if i == 0 || results[i-1].Framing != r.Framing {
+			fmt.Printf("framing %s, wrap stream %s\n", r.Framing, stream)
+			fmt.Printf("  %6s %5s %7s %8s %5s %10s\n", "size", "sent", "intact", "damaged", "lost", "reordered")
+		}
+		fmt.Printf("  %6d %5d %7d %8d %5d %10d\n", r.Size, r.Sent, r.Intact, r.Damaged, r.Lost, r.Reordered)
+		if i == len(results)-1 || results[i+1].Framing != r.Framing {
+			verdict := "kept"
+			for _, s := range results {
+				if s.Framing == r.Framing && !s.ok() {
+					verdict = "NOT kept"
+				}
+			}
+			fmt.Printf("  datagram boundaries and order: %s\n\n", verdict)
+		}
+	}
+}
+
+// simulateUDP runs the sweep through a forward with or without framing and
+// returns a result per size.
+func simulateUDP(framed bool, count int, chaos bool) ([]udpSimResult, error) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	echo, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return nil, err
+	}
+	defer echo.Close()
+	_ = echo.SetReadBuffer(4 << 20)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	wrap, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer wrap.Close()
+	go func() { _ = bridgeServe(wrap, echo.LocalAddr().String(), bridgeOptions{framed: framed}) }()
+	target := wrap.Addr().String()
+	if chaos {
+		mid, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer mid.Close()
+		go udpSimChaos(mid, target)
+		target = mid.Addr().String()
+	}
+
+	public, err := net.ListenUDP("udp", loopback)
+	if err != nil {
+		return nil, err
+	}
+	defer public.Close()
+	_ = public.SetReadBuffer(4 << 20)
+	go func() {
+		_ = udpServe(public, func() (net.Conn, error) {
+			return net.DialTimeout("tcp", target, 5*time.Second)
+		}, framed, false)
+	}()
+
+	var results []udpSimResult
+	for _, size := range udpSimSizes {
+		r, err := simulateSize(public.LocalAddr().(*net.UDPAddr), size, count)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// simulateSize sends count datagrams of size from a new client to the
+// public port and checks what comes back.
+func simulateSize(public *net.UDPAddr, size, count int) (udpSimResult, error) {
+	r := udpSimResult{Size: size, Sent: count}
+	c, err := net.DialUDP("udp", nil, public)
+	if err != nil {
+		return r, err
+	}
+	defer c.Close()
+	_ = c.SetReadBuffer(4 << 20)
+	var sent atomic.Bool
+	go func() {
+		for seq := 0; seq < count; seq++ {
+			_, _ = c.Write(udpSimPayload(seq, size))
+			// paced so that the socket buffers on the way do not overflow
+			time.Sleep(time.Duration(size/1024+1) * 50 * time.Microsecond)
+		}
+		sent.Store(true)
+	}()
+
+	seen := make(map[int]bool)
+	last := -1
+	buf := make([]byte, 65536)
+	for len(seen) < count {
+		wait := 2 * time.Second
+		if sent.Load() {
+			wait = 300 * time.Millisecond
+		}
+		_ = c.SetReadDeadline(time.Now().Add(wait))
+		n, err := c.Read(buf)
+		if err != nil {
+			break // nothing more arrives
+		}
+		seq := int(buf[0])
+		if n != size || seq >= count || !bytes.Equal(buf[:n], udpSimPayload(seq, size)) {
+			r.Damaged++
+			continue
+		}
+		if seen[seq] {
+			continue
+		}
+		seen[seq] = true
+		r.Intact++
+		if seq < last {
+			r.Reordered++
+		}
+		last = max(last, seq)
+	}
+	r.Lost = count - r.Intact
+	return r, nil
+}
+
+// udpSimChaos relays the connections of ln to target and cuts and joins
+// the stream at random in both directions.
+func udpSimChaos(ln net.Listener, target string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		w, err := net.DialTimeout("tcp", target, 5*time.Second)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		go udpSimRechunk(w, c)
+		go udpSimRechunk(c, w)
+	}
+}
+
+// udpSimRechunk copies src to dst: it holds back what it reads for up to
+// 2ms, joining whatever follows in that time, and writes the result in
+// pieces of random size.
+func udpSimRechunk(dst, src net.Conn) {
+	defer dst.Close()
+	chunks := make(chan []byte, 64)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 65536)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				chunks <- append([]byte(nil), buf[:n]...)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for b := range chunks {
+		hold := time.After(time.Duration(rand.Intn(2000)) * time.Microsecond)
+	join:
+		for {
+			select {
+			case more, ok := <-chunks:
+				if !ok {
+					break join
+				}
+				b = append(b, more...)
+			case <-hold:
+				break join
+			}
+		}
+		for len(b) > 0 {
+			n := 1 + rand.Intn(len(b))
+			if _, err := dst.Write(b[:n]); err != nil {
+				return
+			}
+			b = b[n:]
+			time.Sleep(100 * time.Microsecond)
+		}
+	}
+}
+
+// udpSimPayload is datagram seq of a size: every byte derives from both, so
+// that a merged, split or shifted datagram does not compare equal. The
+// first byte is seq.
+func udpSimPayload(seq, size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(seq + i*7)
+	}
+	return b
+}
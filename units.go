@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Durations, sizes and rates in the config are written with their unit:
+// reconnect_delay: 2s, read_buffer: 256KiB, qos.upload: 20Mbit/s. A bare
+// number is a size in bytes, but never a duration or a rate, where it
+// would leave open whether seconds or milliseconds, bits or bytes were
+// meant. Config version 1 had bare seconds and kbit/s under names ending
+// in _seconds and _kbps; migrateUnits rewrites them.
+
+// Duration is a config duration such as 300ms, 2s, 5m, 1h30m or 7d.
+type Duration time.Duration
+
+// D returns d as a time.Duration.
+func (d Duration) D() time.Duration { return time.Duration(d) }
+
+// Seconds returns d in whole seconds, for the settings that cannot be finer.
+func (d Duration) Seconds() int { return int(time.Duration(d) / time.Second) }
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "0" {
+		*d = 0
+		return nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return fmt.Errorf("duration %q has no unit (e.g. %ss or %sms)", s, s, s)
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q (e.g. 2s, 5m or 1h30m)", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// String formats d the way it would be written in the config: 90s rather
+// than 1m30s, 5m rather than 5m0s.
+func (d Duration) String() string {
+	v := time.Duration(d)
+	switch {
+	case v == 0:
+		return "0s"
+	case v%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", v/(24*time.Hour))
+	case v%time.Hour == 0:
+		return fmt.Sprintf("%dh", v/time.Hour)
+	case v%time.Minute == 0:
+		return fmt.Sprintf("%dm", v/time.Minute)
+	case v%time.Second == 0:
+		return fmt.Sprintf("%ds", v/time.Second)
+	}
+	return v.String()
+}
+
+// Size is a config size in bytes, written as 65536, 64KiB or 1.5MB; the
+// units are decimal unless written with an i, as in parseBytes.
+type Size int64
+
+// Int returns s as an int, for buffer sizes.
+func (s Size) Int() int { return int(s) }
+
+func (s *Size) UnmarshalText(b []byte) error {
+	if len(b) == 0 { // "", as older examples wrote unset sizes
+		*s = 0
+		return nil
+	}
+	n, err := parseBytes(string(b))
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+func (s Size) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// String formats s with the largest unit, binary or decimal, that divides
+// it, or in bytes.
+func (s Size) String() string {
+	for _, u := range []struct {
+		name string
+		n    Size
+	}{{"TiB", 1 << 40}, {"TB", 1e12}, {"GiB", 1 << 30}, {"GB", 1e9}, {"MiB", 1 << 20}, {"MB", 1e6}, {"KiB", 1 << 10}, {"KB", 1e3}} {
+		if s != 0 && s%u.n == 0 {
+			return fmt.Sprintf("%d%s", s/u.n, u.name)
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// Rate is a config rate in bytes per second, written in bytes (10MiB/s,
+// 500KB/s) or in bits (20Mbit/s, 512kbit/s) per second.
+type Rate int64
+
+var bitRateRe = regexp.MustCompile(`(?i)^([0-9]+(?:\.[0-9]+)?)\s*([KMGT]?)bit/s$`)
+
+// BytesPerSecond returns r as a float, for pacing.
+func (r Rate) BytesPerSecond() float64 { return float64(r) }
+
+func (r *Rate) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "0" {
+		*r = 0
+		return nil
+	}
+	if m := bitRateRe.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.ParseFloat(m[1], 64)
+		exp := strings.Index("KMGT", strings.ToUpper(m[2])) + 1
+		*r = Rate(n * math.Pow(1000, float64(exp)) / 8)
+		return nil
+	}
+	size, ok := strings.CutSuffix(s, "/s")
+	if !ok {
+		return fmt.Errorf("invalid rate %q (e.g. 10MiB/s or 20Mbit/s)", s)
+	}
+	n, err := parseBytes(size)
+	if err != nil {
+		return fmt.Errorf("invalid rate %q (e.g. 10MiB/s or 20Mbit/s)", s)
+	}
+	*r = Rate(n)
+	return nil
+}
+
+func (r Rate) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+// String formats r in bit/s when it is a whole number of kbit/s, as link
+// rates usually are, and in bytes per second otherwise.
+func (r Rate) String() string {
+	bits := int64(r) * 8
+	for _, u := range []struct {
+		name string
+		n    int64
+	}{{"Gbit/s", 1e9}, {"Mbit/s", 1e6}, {"kbit/s", 1e3}} {
+		if bits != 0 && bits%u.n == 0 {
+			return fmt.Sprintf("%d%s", bits/u.n, u.name)
+		}
+	}
+	return Size(r).String() + "/s"
+}
+
+// unitRenames are the settings of config version 1 that took bare seconds
+// or kbit/s, by path ("[]" for every entry of a list), with their new name.
+var unitRenames = map[string]string{
+	"reconnect_delay_seconds":            "reconnect_delay",
+	"vps.keepalive_seconds":              "keepalive",
+	"vps.rekey_interval_seconds":         "rekey_interval",
+	"vps.max_age_seconds":                "max_age",
+	"vps.max_age_overlap_seconds":        "max_age_overlap",
+	"health.stall_seconds":               "stall_timeout",
+	"health.probe_timeout_seconds":       "probe_timeout",
+	"health.ping_seconds":                "ping_interval",
+	"health.public_check_seconds":        "public_check_interval",
+	"statsd.interval_seconds":            "interval",
+	"memory.history_seconds":             "history",
+	"supervisor.backoff_initial_seconds": "backoff_initial",
+	"supervisor.backoff_max_seconds":     "backoff_max",
+	"supervisor.flap_window_seconds":     "flap_window",
+	"dns.ttl_seconds":                    "ttl",
+	"registry.ttl_seconds":               "ttl",
+	"ha.lease_seconds":                   "lease",
+	"ha.drain_seconds":                   "drain",
+	"plugins[].timeout_seconds":          "timeout",
+	"qos.upload_kbps":                    "upload",
+	"qos.download_kbps":                  "download",
+}
+
+// migrateUnits rewrites the settings in unitRenames from version 1 to 2:
+// stall_seconds: 60 becomes stall_timeout: 60s, upload_kbps: 2000 becomes
+// upload: 2000kbit/s.
+func migrateUnits(root *yaml.Node) error {
+	return renameUnits(root, "")
+}
+
+func renameUnits(m *yaml.Node, prefix string) error {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		path := prefix + k.Value
+		switch v.Kind {
+		case yaml.MappingNode:
+			if err := renameUnits(v, path+"."); err != nil {
+				return err
+			}
+			continue
+		case yaml.SequenceNode:
+			for _, item := range v.Content {
+				if item.Kind == yaml.MappingNode {
+					if err := renameUnits(item, path+"[]."); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		name, ok := unitRenames[path]
+		if !ok || v.Tag == "!!null" {
+			continue
+		}
+		n, err := strconv.Atoi(v.Value)
+		if err != nil {
+			return fmt.Errorf("%s: expected a whole number, got %q", path, v.Value)
+		}
+		unit := "s"
+		if strings.HasSuffix(k.Value, "_kbps") {
+			unit = "kbit/s"
+		}
+		k.Value = name
+		v.Tag, v.Style, v.Value = "!!str", 0, strconv.Itoa(n)+unit
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSizeUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Size
+		ok   bool
+	}{
+		{"65536", 65536, true},
+		{"64KiB", 64 << 10, true},
+		{"64K", 64000, true},
+		{"1.5MB", 1500000, true},
+		{"5 GB", 5e9, true},
+		{"5gib", 5 << 30, true},
+		{"2TB", 2e12, true},
+		{"", 0, true},
+		{"5 gigs", 0, false},
+		{"-1", 0, false},
+		{"MB", 0, false},
+	} {
+		var s Size
+		err := s.UnmarshalText([]byte(tc.in))
+		if (err == nil) != tc.ok {
+			t.Errorf("Size(%q): error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && s != tc.want {
+			t.Errorf("Size(%q) = %d, want %d", tc.in, s, tc.want)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	for _, tc := range []struct {
+		in   Size
+		want string
+	}{
+		{0, "0"},
+		{1500, "1500"},
+		{64 << 20, "64MiB"},
+		{500e9, "500GB"},
+		{2e12, "2TB"},
+		{1 << 40, "1TiB"},
+	} {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("Size(%d).String() = %q, want %q", int64(tc.in), got, tc.want)
+		}
+		var back Size
+		if err := back.UnmarshalText([]byte(tc.in.String())); err != nil || back != tc.in {
+			t.Errorf("Size %q does not parse back: %d, %v", tc.in.String(), back, err)
+		}
+	}
+}
+
+func TestDurationUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"2s", 2 * time.Second, true},
+		{"300ms", 300 * time.Millisecond, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"0", 0, true},
+		{"2", 0, false},
+		{"1.5", 0, false},
+		{"abc", 0, false},
+		{"1.5d", 0, false},
+	} {
+		var d Duration
+		err := d.UnmarshalText([]byte(tc.in))
+		if (err == nil) != tc.ok {
+			t.Errorf("Duration(%q): error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && d.D() != tc.want {
+			t.Errorf("Duration(%q) = %v, want %v", tc.in, d.D(), tc.want)
+		}
+	}
+}
+
+func TestDurationString(t *testing.T) {
+	for _, tc := range []struct {
+		in   time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{90 * time.Second, "90s"},
+		{5 * time.Minute, "5m"},
+		{48 * time.Hour, "2d"},
+		{300 * time.Millisecond, "300ms"},
+	} {
+		if got := Duration(tc.in).String(); got != tc.want {
+			t.Errorf("Duration(%v).String() = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRateUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Rate
+		ok   bool
+	}{
+		{"20Mbit/s", 2500000, true},
+		{"512kbit/s", 64000, true},
+		{"1 Gbit/s", 125000000, true},
+		{"10MiB/s", 10 << 20, true},
+		{"500KB/s", 500000, true},
+		{"0", 0, true},
+		{"10MB", 0, false},
+		{"20Mbps", 0, false},
+		{"fast/s", 0, false},
+	} {
+		var r Rate
+		err := r.UnmarshalText([]byte(tc.in))
+		if (err == nil) != tc.ok {
+			t.Errorf("Rate(%q): error = %v, want ok %v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && r != tc.want {
+			t.Errorf("Rate(%q) = %d, want %d", tc.in, r, tc.want)
+		}
+	}
+}
+
+func TestRateString(t *testing.T) {
+	for _, tc := range []struct {
+		in   Rate
+		want string
+	}{
+		{2500000, "20Mbit/s"},
+		{64000, "512kbit/s"},
+		{10 << 20, "10MiB/s"},
+		{1000, "8kbit/s"},
+		{100, "100/s"},
+	} {
+		if got := tc.in.String(); got != tc.want {
+			t.Errorf("Rate(%d).String() = %q, want %q", int64(tc.in), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Upgrade handoff: on SIGUSR2 tut starts its own binary again and passes it
+// the relay listeners, the running ssh session and the control socket. The
+// new process reports its progress over a pipe; once it is ready the old one
+// stops accepting, lets its open connections finish and exits without
+// touching the ssh session, which the new process now follows.
+
+// Progress reports sent by the new process.
+const (
+	upgradeConfigLoaded = 'c' // config valid; the old process stops its wrappers
+	upgradeReady        = 'r' // listeners and wrappers are up; the old process hands off
+)
+
+// File descriptors of the handoff in the new process. Listener sockets
+// follow, named by TUT_UPGRADE_FDNAMES.
+const (
+	upgradeStatusFD  = 3
+	upgradeStderrFD  = 4
+	upgradeFDsStart  = 5
+	upgradeDrainTime = 5 * time.Minute // how long the old process waits for open connections
+)
+
+// handoff is what the new process inherited from the one it replaces.
+type handoff struct {
+	status *os.File // progress reports to the old process
+	stderr *os.File // stderr of the inherited ssh session
+	sshPid int
+}
+
+// upgradeHandoff is set when this process was started by an upgrade.
+var upgradeHandoff = inheritedHandoff()
+
+// inheritedHandoff picks up the handoff from the environment.
+func inheritedHandoff() *handoff {
+	pid, err := strconv.Atoi(os.Getenv("TUT_UPGRADE_SSH_PID"))
+	if err != nil {
+		return nil
+	}
+	if path := os.Getenv("TUT_UPGRADE_CONTROL"); path != "" {
+		ctlPath = path
+	}
+	os.Unsetenv("TUT_UPGRADE_SSH_PID")
+	os.Unsetenv("TUT_UPGRADE_CONTROL")
+	return &handoff{
+		status: os.NewFile(upgradeStatusFD, "upgrade-status"),
+		stderr: os.NewFile(upgradeStderrFD, "ssh-stderr"),
+		sshPid: pid,
+	}
+}
+
+// report tells the old process how far the startup got. When the last
+// report has been sent the pipe is closed.
+func (h *handoff) report(stage byte) {
+	if h == nil || h.status == nil {
+		return
+	}
+	_, _ = h.status.Write([]byte{stage})
+	if stage == upgradeReady {
+		_ = h.status.Close()
+		h.status = nil
+	}
+}
+
+// waitPortsFree waits until the old process released the wrap ports.
+func (h *handoff) waitPortsFree(cfg *Config) {
+	if h == nil {
+		return
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, u := range cfg.UDPForwards {
+		if activated.file(u.Name+"-wrap") != nil {
+			continue
+		}
+		for time.Now().Before(deadline) && dialLocal(u.WrapTCPPort, 150*time.Millisecond) == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// followSession takes over the ssh session of the old process. It returns
+// when the session ends (its stderr is closed) and kills it when ctx is
+// cancelled, like runTunnel does for sessions it started itself.
+func (d *daemon) followSession(ctx context.Context, h *handoff) error {
+	cfg, relays, st := d.config(), d.relaySnapshot(), d.st
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d.mu.Lock()
+	d.cancelSession = cancel
+	d.restart = false
+	d.sshPid = h.sshPid
+	d.sshStderr = h.stderr
+	d.mu.Unlock()
+
+	d.sessionUp.Store(true)
+	defer d.sessionUp.Store(false)
+	defer d.runPostCommands(cfg)
+	logEvent(levelInfo, "", "tunnel-adopted", "Following SSH tunnel (PID %d) of the previous process", h.sshPid)
+	output := make(chan struct{})
+	go func() {
+		watchSSHOutput(h.stderr, cfg, relays, st, d.punchers)
+		close(output)
+	}()
+	select {
+	case <-output:
+	case <-ctx.Done():
+		if !d.handedOff.Load() {
+			if p, err := os.FindProcess(h.sshPid); err == nil {
+				_ = p.Kill()
+			}
+		}
+		<-output
+	}
+	_ = h.stderr.Close()
+	return errors.New("inherited SSH session ended")
+}
+
+// drain waits until the relays have no open connections, the drain time
+// is up or ctx is cancelled.
+func (d *daemon) drain(ctx context.Context) {
+	deadline := time.Now().Add(upgradeDrainTime)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		open := int64(0)
+		for _, r := range d.relaySnapshot() {
+			open += r.stats.active.Load()
+		}
+		if open == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// errUpgradeAborted is returned when the new process did not become ready.
+var errUpgradeAborted = errors.New("new process did not become ready")
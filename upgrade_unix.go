@@ -0,0 +1,153 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchUpgrades hands over to a freshly started tut binary on SIGUSR2.
+func (d *daemon) watchUpgrades(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := d.upgrade(ctx); err != nil {
+				logEvent(levelError, "", "upgrade-failed", "Upgrade failed: %v", err)
+			}
+		}
+	}
+}
+
+// upgrade starts the new process and, once it is ready, drains and exits.
+// It only returns when the handoff failed; the old process then carries on.
+func (d *daemon) upgrade(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	pid, stderr := d.sshPid, d.sshStderr
+	d.mu.Unlock()
+	if stderr == nil {
+		return fmt.Errorf("no SSH session running")
+	}
+
+	// Listener sockets by name: the relays, plus wrap sockets systemd passed
+	relays := d.relaySnapshot()
+	var names []string
+	files := map[string]*os.File{}
+	for name, r := range relays {
+		f, err := r.ln.(*net.TCPListener).File()
+		if err != nil {
+			return fmt.Errorf("relay %s: %w", name, err)
+		}
+		defer f.Close()
+		files[name] = f
+		names = append(names, name)
+	}
+	for _, name := range activated.names() {
+		if _, ok := files[name]; !ok {
+			files[name] = activated.file(name)
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	statusR, statusW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer statusR.Close()
+	extra := []*os.File{statusW, stderr}
+	for _, name := range names {
+		extra = append(extra, files[name])
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = extra
+	cmd.Env = append(os.Environ(),
+		"TUT_UPGRADE_SSH_PID="+strconv.Itoa(pid),
+		"TUT_UPGRADE_CONTROL="+controlPath(),
+		"TUT_UPGRADE_FDNAMES="+strings.Join(names, ":"),
+	)
+	logEvent(levelInfo, "", "upgrade", "Starting %s to take over", exe)
+	if err := cmd.Start(); err != nil {
+		statusW.Close()
+		return err
+	}
+	statusW.Close()
+	go func() { _ = cmd.Wait() }()
+
+	abort := func(stage string) error {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("%w (%s)", errUpgradeAborted, stage)
+	}
+	_ = statusR.SetReadDeadline(time.Now().Add(time.Minute))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(statusR, buf); err != nil || buf[0] != upgradeConfigLoaded {
+		return abort("loading config")
+	}
+	// the new process binds the wrap ports next
+	d.wrappers.ops.Lock()
+	d.wrappers.stopAll(2 * time.Second)
+	d.wrappers.ops.Unlock()
+	if _, err := io.ReadFull(statusR, buf); err != nil || buf[0] != upgradeReady {
+		err := abort("starting")
+		for _, u := range d.config().UDPForwards {
+			if serr := d.wrappers.replace(u); serr != nil {
+				logEvent(levelError, u.Name, "wrapper-restart-failed", "Cannot restart wrappers: %v", serr)
+			}
+		}
+		return err
+	}
+
+	// The new process owns everything from here on
+	d.handedOff.Store(true)
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		logEvent(levelWarn, "", "", "Cannot tell systemd about the new main process: %v", err)
+	}
+	for _, r := range relays {
+		r.stopAccepting()
+	}
+	d.extras.stop()
+	_ = stderr.Close()
+	logEvent(levelInfo, "", "upgrade", "Handed over to PID %d; draining open connections", cmd.Process.Pid)
+	d.drain(ctx)
+	logf("Upgrade complete, exiting")
+	os.Exit(0)
+	return nil
+}
+
+// sdNotify sends a state update to systemd when running under it.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "context"
+
+// watchUpgrades is a no-op: Windows has no SIGUSR2 and cannot pass
+// listeners to a new process this way.
+func (d *daemon) watchUpgrades(ctx context.Context) {}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// "tut version" prints the release; with --verbose it adds what a bug
+// report needs: the commit and time of the build, the Go toolchain, the
+// platform, what was built in and what this system offers, and the ssh and
+// socat found on the PATH. The release and build time are stamped at link
+// time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.buildDate=2024-05-01T12:00:00Z"
+//
+// while the commit comes from the VCS data Go records in the binary.
+
+var (
+	// version is the release, stamped with -X main.version.
+	version = ""
+	// commit is the git commit, stamped with -X main.commit.
+	commit = ""
+	// buildDate is the time of the build, stamped with -X main.buildDate.
+	buildDate = ""
+)
+
+// versionReport is the output of tut version --verbose.
+type versionReport struct {
+	Version    string          `json:"version"`
+	Commit     string          `json:"commit,omitempty"`
+	Modified   bool            `json:"modified,omitempty"` // built from a tree with uncommitted changes
+	CommitDate string          `json:"commit_date,omitempty"`
+	BuildDate  string          `json:"build_date,omitempty"`
+	Go         string          `json:"go"`
+	Platform   string          `json:"platform"`
+	Agent      int             `json:"agent_protocol"`
+	Transports []string        `json:"transports"`
+	Features   map[string]bool `json:"features"`
+	Network    string          `json:"network_changes"`
+	SSH        string          `json:"ssh"`
+	Socat      string          `json:"socat"`
+}
+
+// runVersionCommand implements "tut version".
+func runVersionCommand(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	verbose := fs.Bool("verbose", false, "Also print build info, features and the local ssh and socat")
+	outputFlag(fs)
+	_ = fs.Parse(args)
+
+	r := buildVersion()
+	if !*verbose {
+		if jsonOutput() {
+			printJSON(map[string]string{"version": r.Version})
+		} else {
+			fmt.Println("tut " + r.Version)
+		}
+		return 0
+	}
+	r.SSH = localVersion("ssh", "-V")
+	r.Socat = localVersion("socat", "-V")
+	if jsonOutput() {
+		printJSON(r)
+		return 0
+	}
+	fmt.Println("tut " + r.Version)
+	commit := r.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if r.Modified {
+		commit += " (modified)"
+	}
+	if r.CommitDate != "" {
+		commit += " from " + r.CommitDate
+	}
+	fmt.Printf("  commit:          %s\n", commit)
+	fmt.Printf("  built:           %s\n", orUnknown(r.BuildDate))
+	fmt.Printf("  go:              %s\n", r.Go)
+	fmt.Printf("  platform:        %s\n", r.Platform)
+	fmt.Printf("  agent protocol:  %d\n", r.Agent)
+	fmt.Printf("  transports:      %s\n", strings.Join(r.Transports, ", "))
+	var on, off []string
+	for _, name := range versionFeatures {
+		if r.Features[name] {
+			on = append(on, name)
+		} else {
+			off = append(off, name)
+		}
+	}
+	fmt.Printf("  features:        %s\n", orUnknown(strings.Join(on, ", ")))
+	if len(off) > 0 {
+		fmt.Printf("  not available:   %s\n", strings.Join(off, ", "))
+	}
+	fmt.Printf("  network changes: %s\n", r.Network)
+	fmt.Printf("  ssh:             %s\n", r.SSH)
+	fmt.Printf("  socat:           %s\n", r.Socat)
+	return 0
+}
+
+// versionFeatures are the features tut version reports, in order.
+var versionFeatures = []string{"dashboard", "fifo", "splice", "unprivileged-traceroute", "journald", "dbus", "keychain", "wincred", "eventlog", "run_as"}
+
+// transports are the transports compiled into tut, as tut version reports
+// them; each registers itself next to its implementation.
+var transports []string
+
+// registerTransport adds name to the transports tut version reports.
+func registerTransport(name string) {
+	transports = append(transports, name)
+	sort.Strings(transports)
+}
+
+// buildVersion collects what tut version reports about the binary itself.
+func buildVersion() versionReport {
+	r := versionReport{
+		Version:    version,
+		Commit:     commit,
+		BuildDate:  buildDate,
+		Go:         runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+		Agent:      agentProtocol,
+		Transports: append([]string(nil), transports...),
+		Network:    networkWatch,
+		Features: map[string]bool{
+			"dashboard":               dashboardBuilt,
+			"fifo":                    fifoSupported,
+			"splice":                  spliceSupported,
+			"unprivileged-traceroute": udpHopSupported,
+			"journald":                runtime.GOOS == "linux",
+			"dbus":                    runtime.GOOS == "linux",
+			"keychain":                runtime.GOOS == "darwin",
+			"wincred":                 runtime.GOOS == "windows",
+			"eventlog":                runtime.GOOS == "windows",
+			"run_as":                  runtime.GOOS != "windows",
+		},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if r.Version == "" && info.Main.Version != "(devel)" {
+			r.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if r.Commit == "" {
+					r.Commit = s.Value
+				}
+			case "vcs.time":
+				r.CommitDate = s.Value
+			case "vcs.modified":
+				r.Modified = s.Value == "true"
+			}
+		}
+	}
+	if r.Version == "" {
+		r.Version = "devel"
+	}
+	return r
+}
+
+// localVersion returns the first line name prints when run with arg, or
+// why it cannot be run.
+func localVersion(name, arg string) string {
+	if _, err := exec.LookPath(name); err != nil {
+		return "not found"
+	}
+	out, _ := exec.Command(name, arg).CombinedOutput()
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return orUnknown(line)
+}
+
+// orUnknown returns s, or "unknown" when it is empty.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
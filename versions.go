@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Before each session tut asks the VPS which socat and which agent it
+// runs, when the session uses them, and refuses to start it with versions
+// known not to work instead of letting the forwards fail silently. The
+// agent is normally this very binary, but agent.binary can point to a
+// build of another tut version, whose agent modes may speak differently.
+
+// minSocat is the oldest socat the remote script works with.
+var minSocat = []int{1, 7}
+
+// agentProtocol is bumped whenever an agent mode changes incompatibly, so
+// that tut notices an agent.binary built from an older or newer tut.
+const agentProtocol = 1
+
+// remoteVersions are the versions found on the VPS; empty when not asked
+// for or not installed.
+type remoteVersions struct {
+	socat string
+	agent string // protocol of the agent, "0" for agents without "agent version"
+}
+
+// queryRemoteVersions asks the VPS for the version of socat and, with
+// agent set, of the agent.
+func queryRemoteVersions(ctx context.Context, cfg *Config, agent bool) (remoteVersions, error) {
+	command := `socat -V 2>/dev/null | sed -n 's/^socat version \([0-9][0-9.]*\).*/socat \1/p'`
+	if agent {
+		p := shellQuote(cfg.Agent.Path)
+		command += fmt.Sprintf(`; if [ -x %s ]; then %s agent version 2>/dev/null || echo agent 0; fi`, p, p)
+	}
+	out, err := agentSSH(ctx, cfg, command, nil)
+	if err != nil {
+		return remoteVersions{}, err
+	}
+	var v remoteVersions
+	for _, line := range strings.Split(out, "\n") {
+		switch f := strings.Fields(line); {
+		case len(f) == 2 && f[0] == "socat":
+			v.socat = f[1]
+		case len(f) == 2 && f[0] == "agent":
+			v.agent = f[1]
+		}
+	}
+	return v, nil
+}
+
+// socatProblem says what is wrong with socat version v, or returns "".
+func socatProblem(v string) string {
+	if v == "" {
+		return "socat is not installed on the VPS or does not report its version"
+	}
+	parts := strings.Split(v, ".")
+	for i, want := range minSocat {
+		n := 0
+		if i < len(parts) {
+			n, _ = strconv.Atoi(parts[i])
+		}
+		if n > want {
+			return ""
+		}
+		if n < want {
+			return fmt.Sprintf("socat %s on the VPS is too old; the remote script needs socat %d.%d or newer", v, minSocat[0], minSocat[1])
+		}
+	}
+	return ""
+}
+
+// agentProblem says what is wrong with an agent speaking protocol v, or
+// returns "".
+func agentProblem(v string) string {
+	switch v {
+	case "", strconv.Itoa(agentProtocol):
+		return ""
+	case "0":
+		return "the agent on the VPS predates version checks; build agent.binary from this tut version"
+	}
+	return fmt.Sprintf("the agent on the VPS speaks protocol %s, this tut %d; build agent.binary from this tut version", v, agentProtocol)
+}
+
+// checkRemoteVersions refuses a session whose remote script needs socat,
+// or whose features need the agent, when the VPS has versions that do not
+// work with this tut.
+func checkRemoteVersions(ctx context.Context, cfg *Config, script string) error {
+	socat := strings.Contains(script, "socat")
+	agent := agentNeeded(cfg)
+	if !socat && !agent {
+		return nil
+	}
+	v, err := queryRemoteVersions(ctx, cfg, agent)
+	if err != nil {
+		return fmt.Errorf("checking the versions on the VPS: %w", err)
+	}
+	if p := socatProblem(v.socat); socat && p != "" {
+		return errors.New(p)
+	}
+	if p := agentProblem(v.agent); agent && p != "" {
+		return errors.New(p)
+	}
+	return nil
+}
+
+// runAgentVersion implements "tut agent version": it prints the protocol
+// the agent modes of this binary speak.
+func runAgentVersion() int {
+	fmt.Printf("agent %d\n", agentProtocol)
+	return 0
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// wincredCredential is only supported on Windows.
+func wincredCredential(target string) ([]byte, error) {
+	return nil, fmt.Errorf("Windows Credential Manager: %w", errNoCredentialStore)
+}
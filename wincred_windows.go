@@ -0,0 +1,63 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	procCredReadW = advapi32.NewProc("CredReadW")
+	procCredFree  = advapi32.NewProc("CredFree")
+)
+
+// credTypeGeneric is CRED_TYPE_GENERIC.
+const credTypeGeneric = 1
+
+// credentialW mirrors CREDENTIALW.
+type credentialW struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// wincredCredential reads the secret of the generic credential target
+// from the Credential Manager of the user tut runs as.
+func wincredCredential(target string) ([]byte, error) {
+	name, err := syscall.UTF16PtrFromString(target)
+	if err != nil {
+		return nil, err
+	}
+	var cred *credentialW
+	r, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(name)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return nil, fmt.Errorf("credential %s: %v", target, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := append([]byte(nil), unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)...)
+	// cmdkey and the Control Panel store the secret as UTF-16
+	if len(blob)%2 == 0 && len(blob) > 0 {
+		u := make([]uint16, len(blob)/2)
+		text := true
+		for i := range u {
+			u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+			text = text && blob[2*i+1] == 0
+		}
+		if text {
+			return []byte(string(utf16.Decode(u))), nil
+		}
+	}
+	return blob, nil
+}